@@ -18,7 +18,6 @@ import (
 	"context"
 	"crypto/tls"
 	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
-	"net"
 	"net/http"
 	"strings"
 
@@ -57,6 +56,9 @@ var (
 	corsAllowed      []string
 	insecure_enabled bool
 	with_block       bool
+
+	// Networks of proxies whose X-Forwarded-For entries are trusted when resolving client IP
+	trustedProxies []string
 )
 
 func init() {
@@ -69,6 +71,7 @@ func init() {
 	viper.SetDefault("ADMIN_UI_HOST", ":8080")
 	viper.SetDefault("INSECURE", true)
 	viper.SetDefault("WITH_BLOCK", false)
+	viper.SetDefault("TRUSTED_PROXIES", strings.Join(http_server.DefaultTrustedProxies, ","))
 
 	gatewayHost = viper.GetString("GATEWAY_HOST")
 	adminUiHost = viper.GetString("ADMIN_UI_HOST")
@@ -83,6 +86,7 @@ func init() {
 	corsAllowed = strings.Split(viper.GetString("CORS_ALLOWED"), ",")
 	insecure_enabled = viper.GetBool("INSECURE")
 	with_block = viper.GetBool("WITH_BLOCK")
+	trustedProxies = strings.Split(viper.GetString("TRUSTED_PROXIES"), ",")
 }
 
 func main() {
@@ -91,6 +95,9 @@ func main() {
 	}()
 
 	log.Info("Starting REST-API Server")
+	if err := http_server.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES", zap.Error(err))
+	}
 	log.Info("Registering Endpoints", zap.String("server", apiserver))
 	var err error
 
@@ -347,9 +354,12 @@ func main() {
 		AllowedOrigins: corsAllowed,
 		AllowedHeaders: []string{"*", "Connect-Protocol-Version", "grpc-metadata-nocloud-primary-currency-code", "NoCloud-Primary-Currency-Code", "NoCloud-Primary-Currency-Precision-Override",
 			"grpc-metadata-nocloud-primary-currency-precision-override", "nocloud-primary-currency-precision-override"},
-		AllowedMethods:   []string{"GET", "POST", "DELETE", "PUT", "PATCH", "OPTIONS", "HEAD"},
+		AllowedMethods: []string{"GET", "POST", "DELETE", "PUT", "PATCH", "OPTIONS", "HEAD"},
+		// Lets UI show that session is impersonated
+		ExposedHeaders: []string{"Nocloud-Impersonated-By", "Nocloud-Impersonation-Mode",
+			"Grpc-Metadata-Nocloud-Impersonated-By", "Grpc-Metadata-Nocloud-Impersonation-Mode"},
 		AllowCredentials: true,
-	}).Handler(withConsentClientIP(gwmux))
+	}).Handler(withClientIP(gwmux))
 
 	// AdminUI Handler
 	ui_handler := cors.New(cors.Options{
@@ -368,34 +378,14 @@ func main() {
 	http_server.Serve(log, gatewayHost, wsproxy.WebsocketProxy(handler))
 }
 
-// withConsentClientIP captures the real visitor IP for POST /consent at the point
-// this instance receives the original HTTP request, before it's re-forwarded as an
-// internal gRPC call (which would otherwise overwrite X-Forwarded-For with the
-// address of that internal hop). Scoped to /consent only — every other route is
-// passed through untouched.
-func withConsentClientIP(next http.Handler) http.Handler {
+// withClientIP captures the real visitor IP at the point this instance receives the
+// original HTTP request, before it's re-forwarded as an internal gRPC call (which would
+// otherwise overwrite X-Forwarded-For with the address of that internal hop). Consent
+// and signup screening read it from x-client-ip metadata. Header is always overwritten,
+// so clients can't set it themselves.
+func withClientIP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/consent" {
-			r.Header.Set("Grpc-Metadata-X-Client-Ip", realClientIP(r))
-		}
+		r.Header.Set("Grpc-Metadata-"+http_server.ClientIPHeader, http_server.ClientIP(r))
 		next.ServeHTTP(w, r)
 	})
 }
-
-func realClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		if ip := strings.TrimSpace(strings.Split(xff, ",")[0]); ip != "" {
-			return ip
-		}
-	}
-	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
-		return ip
-	}
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
-	}
-	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		return host
-	}
-	return r.RemoteAddr
-}
@@ -22,7 +22,6 @@ import (
 	"github.com/cskr/pubsub"
 	"github.com/rs/cors"
 	pb "github.com/slntopp/nocloud-proto/billing"
-	driverpb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
 	epb "github.com/slntopp/nocloud-proto/events"
 	"github.com/slntopp/nocloud-proto/health/healthconnect"
 	ccinstances "github.com/slntopp/nocloud-proto/instances/instancesconnect"
@@ -53,6 +52,7 @@ import (
 	"github.com/slntopp/nocloud/pkg/nocloud"
 	auth "github.com/slntopp/nocloud/pkg/nocloud/connect_auth"
 	"github.com/slntopp/nocloud/pkg/nocloud/connectdb"
+	driverreg "github.com/slntopp/nocloud/pkg/nocloud/drivers"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 
 	"connectrpc.com/grpchealth"
@@ -255,21 +255,9 @@ func main() {
 
 	instancesClient := ccinstances.NewInstancesServiceClient(http.DefaultClient, "http://"+instancesHost)
 
-	registeredDrivers := make(map[string]driverpb.DriverServiceClient)
-	for _, driver := range drivers {
-		log.Info("Registering Driver", zap.String("driver", driver))
-		dconn, err := grpc.Dial(driver, grpc.WithTransportCredentials(insecure.NewCredentials()))
-		if err != nil {
-			log.Fatal("Error registering driver", zap.String("driver", driver), zap.Error(err))
-		}
-		client := driverpb.NewDriverServiceClient(dconn)
-		driver_type, err := client.GetType(context.Background(), &driverpb.GetTypeRequest{})
-		if err != nil {
-			log.Fatal("Error dialing driver and getting its type", zap.String("driver", driver), zap.Error(err))
-		}
-		registeredDrivers[driver_type.GetType()] = client
-		log.Info("Registered Driver", zap.String("driver", driver), zap.String("type", driver_type.GetType()))
-	}
+	// Drivers are shared with services registry through redis, so ones added there at runtime are used here too
+	registeredDrivers := driverreg.NewRegistry(log, rdb, driverreg.DefaultConfig())
+	registeredDrivers.AddStatic(context.Background(), drivers)
 
 	log.Info("Registering Payment Gateway Server")
 	pgServer := billing.NewPaymentGatewayServer(log, db, rdb, SIGNING_KEY, settingsClient)
@@ -285,6 +273,7 @@ func main() {
 	ctx = context.WithValue(ctx, nocloud.NoCloudToken, token)
 	ctx = context.WithValue(ctx, nocloud.NoCloudAccount, schema.ROOT_ACCOUNT_KEY)
 	ctx, cancel := context.WithCancel(ctx)
+	go registeredDrivers.Routine(ctx)
 
 	billing.SetupSettingsContext(ctx)
 
@@ -306,6 +295,8 @@ func main() {
 		nssCtrl, plansCtrl, transactCtrl, invoicesCtrl, recordsCtrl, currCtrl, accountsCtrl, descCtrl,
 		instCtrl, spCtrl, srvCtrl, addonsCtrl, caCtrl, promoCtrl, pgsCtrl, accGroupsCtrl, whmcsGw, invoicesPublisher, ksefPublisher, instancesPublisher, ps, tps, syncCreatedDateOnPayment, enableKsef, ksefClient)
 
+	server.RegisterOrphansGCRoutes(router, rdb, SIGNING_KEY)
+
 	if whmcsModSecret := strings.TrimSpace(viper.GetString("BILLING_WHMCS_MODULE_SECRET")); whmcsModSecret != "" {
 		billing.RegisterWhmcsModuleVerificationRoute(log, router, server, whmcsModSecret)
 		log.Info("WHMCS PHP module: internal account-verification route enabled",
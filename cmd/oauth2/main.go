@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
+	"github.com/arangodb/go-driver"
 	"github.com/go-redis/redis/v8"
+	"github.com/slntopp/nocloud-proto/access"
 	"github.com/slntopp/nocloud-proto/registry"
+	settingspb "github.com/slntopp/nocloud-proto/settings"
+	"github.com/slntopp/nocloud/pkg/credentials"
 	"github.com/slntopp/nocloud/pkg/graph"
 	"github.com/slntopp/nocloud/pkg/nocloud"
 	"github.com/slntopp/nocloud/pkg/nocloud/auth"
 	"github.com/slntopp/nocloud/pkg/nocloud/connect_auth"
 	"github.com/slntopp/nocloud/pkg/nocloud/connectdb"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	"github.com/slntopp/nocloud/pkg/oauth2"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"strings"
 )
 
@@ -22,8 +31,11 @@ var (
 
 	corsAllowed  []string
 	registryHost string
+	settingsHost string
 	redisHost    string
 	SIGNING_KEY  []byte
+	// Signs identity assertions handed to registry, must differ from SIGNING_KEY
+	IDP_ASSERTION_KEY []byte
 
 	oauthIssuer string
 
@@ -39,6 +51,7 @@ func init() {
 	viper.SetDefault("PORT", "8000")
 
 	viper.SetDefault("REGISTRY_HOST", "registry:8000")
+	viper.SetDefault("SETTINGS_HOST", "settings:8000")
 	viper.SetDefault("REDIS_HOST", "redis:6379")
 
 	viper.SetDefault("CORS_ALLOWED", "*")
@@ -48,11 +61,13 @@ func init() {
 	port = viper.GetString("PORT")
 
 	registryHost = viper.GetString("REGISTRY_HOST")
+	settingsHost = viper.GetString("SETTINGS_HOST")
 	redisHost = viper.GetString("REDIS_HOST")
 
 	corsAllowed = strings.Split(viper.GetString("CORS_ALLOWED"), ",")
 
 	SIGNING_KEY = []byte(viper.GetString("SIGNING_KEY"))
+	IDP_ASSERTION_KEY = []byte(viper.GetString("IDP_ASSERTION_KEY"))
 
 	oauthIssuer = viper.GetString("OAUTH_ISSUER")
 
@@ -81,16 +96,81 @@ func main() {
 
 	registryClient := registry.NewAccountsServiceClient(registryConn)
 
+	settingsConn, err := grpc.Dial(settingsHost, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		panic(err)
+	}
+	defer settingsConn.Close()
+	settingsClient := settingspb.NewSettingsServiceClient(settingsConn)
+
+	token, err := auth.MakeToken(schema.ROOT_ACCOUNT_KEY)
+	if err != nil {
+		log.Fatal("Can't generate token", zap.Error(err))
+	}
+	sc.Setup(log, metadata.AppendToOutgoingContext(
+		context.Background(), "authorization", "bearer "+token,
+	), &settingsClient)
+
 	oauthRepository := graph.NewOAuthController(log, db, nil)
 	authorizer := &oauth2.BasicAuthorizer{Key: SIGNING_KEY, Ic: connect_auth.NewInterceptor(log, rdb, SIGNING_KEY)}
 
 	server := oauth2.NewOAuth2Server(log, SIGNING_KEY)
 	server.SetupRegistryClient(registryClient)
+	server.SetupNamespaceJoiner(&namespaceJoiner{
+		db:         db,
+		accounts:   graph.NewAccountsController(log, db),
+		namespaces: graph.NewNamespacesController(log, db),
+	})
+	if len(IDP_ASSERTION_KEY) == 0 || string(IDP_ASSERTION_KEY) == string(SIGNING_KEY) {
+		log.Warn("IDP_ASSERTION_KEY is not set or equals SIGNING_KEY, identity providers are disabled")
+	} else {
+		server.SetupIdentityProviders(rdb, IDP_ASSERTION_KEY, &identityLookup{db: db})
+	}
 	server.Start(port, corsAllowed, oauth2.Dependencies{
 		Clients:       oauthRepository,
 		Codes:         oauthRepository,
 		Tokens:        oauthRepository,
 		Interactions:  oauthRepository,
 		Authorization: authorizer,
+		Devices:       oauthRepository,
+		Registry:      oauthRepository,
+		Admins:        oauthRepository,
 	})
 }
+
+// namespaceJoiner applies identity providers group mapping directly through graph
+type namespaceJoiner struct {
+	db         driver.Database
+	accounts   graph.AccountsController
+	namespaces graph.NamespacesController
+}
+
+func (j *namespaceJoiner) JoinNamespace(ctx context.Context, account, namespace string, level access.Level) error {
+	acc, err := j.accounts.Get(ctx, account)
+	if err != nil {
+		return err
+	}
+	ns, err := j.namespaces.Get(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	// Only missing memberships are added, existing ones keep level and role they were given
+	edges, err := j.db.Collection(ctx, schema.NS2ACC)
+	if err != nil {
+		return err
+	}
+	exists, err := edges.DocumentExists(ctx, ns.Key+"-"+acc.Key)
+	if err != nil || exists {
+		return err
+	}
+	return j.namespaces.Join(ctx, acc, ns, level, roles.DEFAULT)
+}
+
+// identityLookup checks identity providers credentials directly through graph
+type identityLookup struct {
+	db driver.Database
+}
+
+func (l *identityLookup) IdentityExists(ctx context.Context, credType, subject string) (bool, error) {
+	return credentials.IdentityProviderCredentialsExist(ctx, l.db, credType, subject)
+}
@@ -16,12 +16,19 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"strings"
+
 	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
+	"github.com/rs/cors"
 	"github.com/slntopp/nocloud/pkg/account_groups"
 	"github.com/slntopp/nocloud/pkg/consent"
 	grpc_server "github.com/slntopp/nocloud/pkg/nocloud/grpc"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/sms"
 	"github.com/slntopp/nocloud/pkg/nocloud/ssh"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -39,22 +46,27 @@ import (
 	"github.com/slntopp/nocloud/pkg/sessions"
 
 	consentpb "github.com/slntopp/nocloud-proto/consent"
+	epb "github.com/slntopp/nocloud-proto/events"
 	healthpb "github.com/slntopp/nocloud-proto/health"
 	pb "github.com/slntopp/nocloud-proto/registry"
 	sspb "github.com/slntopp/nocloud-proto/sessions"
 )
 
 var (
-	port string
-	log  *zap.Logger
+	port     string
+	restPort string
+	log      *zap.Logger
 
 	arangodbHost    string
 	arangodbCred    string
 	arangodbName    string
 	nocloudRootPass string
 	settingsHost    string
+	eventsHost      string
 	redisHost       string
 	SIGNING_KEY     []byte
+	// Verifies identity assertions oauth2 service issues for upstream identity providers, must differ from SIGNING_KEY
+	IDP_ASSERTION_KEY []byte
 
 	sshPrivateKeyPath string // Host's private key
 
@@ -66,6 +78,9 @@ var (
 
 	baseHost string
 	appHost  string
+
+	// Networks of proxies whose X-Forwarded-For entries are trusted when resolving client IP
+	trustedProxies []string
 )
 
 func init() {
@@ -73,12 +88,14 @@ func init() {
 	log = nocloud.NewLogger()
 
 	viper.SetDefault("PORT", "8000")
+	viper.SetDefault("REST_PORT", "8080")
 
 	viper.SetDefault("DB_HOST", "db:8529")
 	viper.SetDefault("DB_CRED", "root:openSesame")
 	viper.SetDefault("DB_NAME", schema.DB_NAME)
 	viper.SetDefault("NOCLOUD_ROOT_PASSWORD", "secret")
 	viper.SetDefault("SETTINGS_HOST", "settings:8000")
+	viper.SetDefault("EVENTS_HOST", "eventbus:8000")
 	viper.SetDefault("REDIS_HOST", "redis:6379")
 	viper.SetDefault("SSH_PRIVATE_KEY", "/private_key.rsa")
 	viper.SetDefault("AMI_HOST", "127.0.0.1:5038")
@@ -86,17 +103,21 @@ func init() {
 	viper.SetDefault("AMI_REQUIRED", "false")
 
 	viper.SetDefault("SIGNING_KEY", "seeeecreet")
+	viper.SetDefault("TRUSTED_PROXIES", strings.Join(http_server.DefaultTrustedProxies, ","))
 
 	port = viper.GetString("PORT")
+	restPort = viper.GetString("REST_PORT")
 
 	arangodbHost = viper.GetString("DB_HOST")
 	arangodbCred = viper.GetString("DB_CRED")
 	arangodbName = viper.GetString("DB_NAME")
 	nocloudRootPass = viper.GetString("NOCLOUD_ROOT_PASSWORD")
 	settingsHost = viper.GetString("SETTINGS_HOST")
+	eventsHost = viper.GetString("EVENTS_HOST")
 	redisHost = viper.GetString("REDIS_HOST")
 
 	SIGNING_KEY = []byte(viper.GetString("SIGNING_KEY"))
+	IDP_ASSERTION_KEY = []byte(viper.GetString("IDP_ASSERTION_KEY"))
 
 	amiHost = viper.GetString("AMI_HOST")
 	amiUser = viper.GetString("AMI_USERNAME")
@@ -107,6 +128,7 @@ func init() {
 
 	baseHost = viper.GetString("BASE_HOST")
 	appHost = viper.GetString("APP_HOST")
+	trustedProxies = strings.Split(viper.GetString("TRUSTED_PROXIES"), ",")
 }
 
 func SetupSettingsClient() (settingspb.SettingsServiceClient, *grpc.ClientConn) {
@@ -134,6 +156,9 @@ func main() {
 	})
 
 	auth.SetContext(log, rdb, SIGNING_KEY)
+	if err := http_server.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES", zap.Error(err))
+	}
 	s := grpc.NewServer(
 		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
 			grpc_zap.UnaryServerInterceptor(log),
@@ -173,10 +198,34 @@ func main() {
 	sessions_server := sessions.NewSessionsServer(log, rdb, db)
 	sspb.RegisterSessionsServiceServer(s, sessions_server)
 
-	accounts_server := accounting.NewAccountsServer(log, db, rdb, asteriskClient, baseHost, appHost)
+	accounts_server := accounting.NewAccountsServer(log, db, rdb, baseHost, appHost)
 	accounts_server.SIGNING_KEY = SIGNING_KEY
 	credentials.SetupSettingsClient(log.Named("Credentials"), sc, token)
+	if len(IDP_ASSERTION_KEY) == 0 || string(IDP_ASSERTION_KEY) == string(SIGNING_KEY) {
+		log.Warn("IDP_ASSERTION_KEY is not set or equals SIGNING_KEY, identity providers log in is disabled")
+	} else {
+		credentials.SetupIdentityAssertions(IDP_ASSERTION_KEY)
+	}
 	accounts_server.SetupSettingsClient(sc, token)
+
+	var smsProviders []sms.SMSProvider
+	if asteriskClient != nil {
+		smsProviders = append(smsProviders, sms.NewAsteriskProvider(asteriskClient))
+	}
+	if err = accounts_server.SetupSMSProviders(smsProviders...); err != nil {
+		log.Fatal("Failed to setup SMS providers", zap.Error(err))
+	}
+	if err = accounts_server.SetupKYCStore(nil); err != nil {
+		log.Error("Failed to setup KYC storage, document uploads are disabled", zap.Error(err))
+	}
+
+	eventsConn, err := grpc.Dial(eventsHost, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatal("Failed to connect to eventbus", zap.Error(err))
+	}
+	defer eventsConn.Close()
+	eventsClient := epb.NewEventsServiceClient(eventsConn)
+	accounts_server.SetupEventsClient(eventsClient, token)
 	err = accounts_server.EnsureRootExists(nocloudRootPass)
 	if err != nil {
 		log.Fatal("Couldn't ensure root Account(and Namespace) exist", zap.Error(err))
@@ -184,6 +233,7 @@ func main() {
 	pb.RegisterAccountsServiceServer(s, accounts_server)
 
 	namespaces_server := accounting.NewNamespacesServer(log, db)
+	namespaces_server.SetupEventsClient(eventsClient, token)
 	groups_server := account_groups.NewAccountGroupsServer(log, db)
 	pb.RegisterNamespacesServiceServer(s, namespaces_server)
 	pb.RegisterAccountGroupsServiceServer(s, groups_server)
@@ -193,5 +243,31 @@ func main() {
 
 	healthpb.RegisterInternalProbeServiceServer(s, NewHealthServer(log))
 
+	router := mux.NewRouter()
+	accounts_server.RegisterRoutes(router)
+	accounts_server.RegisterRecoveryRoutes(router)
+	accounts_server.RegisterPhoneVerificationRoutes(router)
+	accounts_server.RegisterImpersonationRoutes(router)
+	accounts_server.RegisterGDPRRoutes(router)
+	accounts_server.RegisterDeletionRoutes(router)
+	accounts_server.RegisterMergeRoutes(router)
+	accounts_server.RegisterTaxRoutes(router)
+	accounts_server.RegisterRiskRoutes(router)
+	accounts_server.RegisterKYCRoutes(router)
+	accounts_server.RegisterBillingProfileRoutes(router)
+	accounts_server.RegisterQuotaRoutes(router)
+	sessions_server.RegisterRoutes(router, SIGNING_KEY)
+	namespaces_server.RegisterRoutes(router, rdb, SIGNING_KEY)
+	handler := cors.New(cors.Options{
+		AllowedOrigins:   []string{"*"},
+		AllowedMethods:   []string{"GET", "POST", "OPTIONS", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"*"},
+		ExposedHeaders:   []string{"Nocloud-Impersonated-By", "Nocloud-Impersonation-Mode"},
+		AllowCredentials: true,
+	}).Handler(router)
+	go accounts_server.PurgeRoutine(context.Background())
+	go accounts_server.TaxIDRevalidationRoutine(context.Background())
+	go http_server.Serve(log, ":"+restPort, handler)
+
 	grpc_server.ServeGRPC(log, s, port)
 }
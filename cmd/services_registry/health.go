@@ -18,7 +18,11 @@ package main
 import (
 	"connectrpc.com/connect"
 	"context"
+	"fmt"
 	"github.com/slntopp/nocloud/pkg/instances"
+	"github.com/slntopp/nocloud/pkg/nocloud/drivers"
+	"strings"
+	"time"
 
 	pb "github.com/slntopp/nocloud-proto/health"
 	"github.com/slntopp/nocloud/pkg/services"
@@ -32,23 +36,54 @@ type HealthServer struct {
 	log  *zap.Logger
 	srv  *services.ServicesServer
 	isrv *instances.InstancesServer
+	drv  *drivers.Registry
 }
 
-func NewHealthServer(log *zap.Logger, srv *services.ServicesServer, isrv *instances.InstancesServer) *HealthServer {
+func NewHealthServer(log *zap.Logger, srv *services.ServicesServer, isrv *instances.InstancesServer, drv *drivers.Registry) *HealthServer {
 	return &HealthServer{
-		log: log, srv: srv, isrv: isrv,
+		log: log, srv: srv, isrv: isrv, drv: drv,
 	}
 }
 
 func (s *HealthServer) Service(_ context.Context, _ *connect.Request[pb.ProbeRequest]) (*connect.Response[pb.ServingStatus], error) {
-	return connect.NewResponse(&pb.ServingStatus{
+	res := &pb.ServingStatus{
 		Service: SERVICE,
 		Status:  pb.Status_SERVING,
-	}), nil
+	}
+	var unhealthy []string
+	for _, d := range s.drv.List() {
+		if !d.Healthy {
+			unhealthy = append(unhealthy, d.Type)
+		}
+	}
+	if len(unhealthy) > 0 {
+		errString := fmt.Sprintf("Unhealthy drivers: %s", strings.Join(unhealthy, ", "))
+		res.Status = pb.Status_HASERRS
+		res.Error = &errString
+	}
+	return connect.NewResponse(res), nil
 }
 
+// Routine reports every registered driver next to routines, so inventory is visible in health probe
 func (s *HealthServer) Routine(_ context.Context, _ *connect.Request[pb.ProbeRequest]) (*connect.Response[pb.RoutinesStatus], error) {
+	routines := s.isrv.RoutinesState()
+	for _, d := range s.drv.List() {
+		st := &pb.ServingStatus{
+			Service: SERVICE,
+			Status:  pb.Status_SERVING,
+		}
+		if !d.Healthy {
+			errString := d.LastError
+			st.Status = pb.Status_OFFLINE
+			st.Error = &errString
+		}
+		routines = append(routines, &pb.RoutineStatus{
+			Routine:       fmt.Sprintf("Driver %s (%s, %s)", d.Type, d.Endpoint, d.Source),
+			Status:        st,
+			LastExecution: time.Unix(d.LastProbe, 0).Format("2006-01-02T15:04:05Z07:00"),
+		})
+	}
 	return connect.NewResponse(&pb.RoutinesStatus{
-		Routines: s.isrv.RoutinesState(),
+		Routines: routines,
 	}), nil
 }
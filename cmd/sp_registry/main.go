@@ -19,12 +19,12 @@ import (
 	"context"
 	"github.com/go-redis/redis/v8"
 	amqp "github.com/rabbitmq/amqp091-go"
-	driverpb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
 	healthpb "github.com/slntopp/nocloud-proto/health"
 	sppb "github.com/slntopp/nocloud-proto/services_providers"
 	"github.com/slntopp/nocloud/pkg/nocloud"
 	"github.com/slntopp/nocloud/pkg/nocloud/auth"
 	"github.com/slntopp/nocloud/pkg/nocloud/connectdb"
+	driverreg "github.com/slntopp/nocloud/pkg/nocloud/drivers"
 	grpc_server "github.com/slntopp/nocloud/pkg/nocloud/grpc"
 	"github.com/slntopp/nocloud/pkg/nocloud/rabbitmq"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
@@ -123,25 +123,11 @@ func main() {
 	scCatServer := showcase_categories.NewCategoriesServer(log, db)
 
 	log.Debug("Got drivers", zap.Strings("drivers", drivers))
-	for _, driver := range drivers {
-		log.Info("Registering Driver", zap.String("driver", driver))
-		conn, err := grpc.Dial(driver, grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithDefaultCallOptions(
-				grpc.MaxCallRecvMsgSize(500*1024*1024),
-				grpc.MaxCallSendMsgSize(500*1024*1024),
-			),
-		)
-		if err != nil {
-			log.Fatal("Error registering driver", zap.String("driver", driver), zap.Error(err))
-		}
-		client := driverpb.NewDriverServiceClient(conn)
-		driver_type, err := client.GetType(context.Background(), &driverpb.GetTypeRequest{})
-		if err != nil {
-			log.Fatal("Error dialing driver and getting its type", zap.String("driver", driver), zap.Error(err))
-		}
-		server.RegisterDriver(driver_type.GetType(), client)
-		log.Info("Registered Driver", zap.String("driver", driver), zap.String("type", driver_type.GetType()))
-	}
+	// Drivers are shared with services registry through redis, so ones added there at runtime are used here too
+	driverRegistry := driverreg.NewRegistry(log, rdb, driverreg.DefaultConfig())
+	driverRegistry.AddStatic(context.Background(), drivers)
+	server.SetupDriverRegistry(driverRegistry)
+	go driverRegistry.Routine(context.Background())
 
 	log.Debug("Got extentions servers", zap.Strings("ext_servers", ext_servers))
 	for _, ext_server := range ext_servers {
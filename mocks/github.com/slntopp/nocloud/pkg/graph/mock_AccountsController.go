@@ -658,6 +658,65 @@ func (_c *MockAccountsController_List_Call) RunAndReturn(run func(context.Contex
 	return _c
 }
 
+// ListCredentials provides a mock function with given fields: ctx, acc
+func (_m *MockAccountsController) ListCredentials(ctx context.Context, acc graph.Account) ([]graph.CredentialsLink, error) {
+	ret := _m.Called(ctx, acc)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ListCredentials")
+	}
+
+	var r0 []graph.CredentialsLink
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, graph.Account) ([]graph.CredentialsLink, error)); ok {
+		return rf(ctx, acc)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, graph.Account) []graph.CredentialsLink); ok {
+		r0 = rf(ctx, acc)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]graph.CredentialsLink)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, graph.Account) error); ok {
+		r1 = rf(ctx, acc)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MockAccountsController_ListCredentials_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ListCredentials'
+type MockAccountsController_ListCredentials_Call struct {
+	*mock.Call
+}
+
+// ListCredentials is a helper method to define mock.On call
+//   - ctx context.Context
+//   - acc graph.Account
+func (_e *MockAccountsController_Expecter) ListCredentials(ctx interface{}, acc interface{}) *MockAccountsController_ListCredentials_Call {
+	return &MockAccountsController_ListCredentials_Call{Call: _e.mock.On("ListCredentials", ctx, acc)}
+}
+
+func (_c *MockAccountsController_ListCredentials_Call) Run(run func(ctx context.Context, acc graph.Account)) *MockAccountsController_ListCredentials_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(graph.Account))
+	})
+	return _c
+}
+
+func (_c *MockAccountsController_ListCredentials_Call) Return(_a0 []graph.CredentialsLink, _a1 error) *MockAccountsController_ListCredentials_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockAccountsController_ListCredentials_Call) RunAndReturn(run func(context.Context, graph.Account) ([]graph.CredentialsLink, error)) *MockAccountsController_ListCredentials_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // ListImproved provides a mock function with given fields: ctx, requester, depth, offset, limit, field, sort, filters
 func (_m *MockAccountsController) ListImproved(ctx context.Context, requester string, depth int32, offset uint64, limit uint64, field string, sort string, filters map[string]*structpb.Value) ([]graph.Account, int64, int64, error) {
 	ret := _m.Called(ctx, requester, depth, offset, limit, field, sort, filters)
@@ -787,6 +846,54 @@ func (_c *MockAccountsController_SetCredentials_Call) RunAndReturn(run func(cont
 	return _c
 }
 
+// UnlinkCredentials provides a mock function with given fields: ctx, acc, auth_type
+func (_m *MockAccountsController) UnlinkCredentials(ctx context.Context, acc graph.Account, auth_type string) error {
+	ret := _m.Called(ctx, acc, auth_type)
+
+	if len(ret) == 0 {
+		panic("no return value specified for UnlinkCredentials")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, graph.Account, string) error); ok {
+		r0 = rf(ctx, acc, auth_type)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockAccountsController_UnlinkCredentials_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'UnlinkCredentials'
+type MockAccountsController_UnlinkCredentials_Call struct {
+	*mock.Call
+}
+
+// UnlinkCredentials is a helper method to define mock.On call
+//   - ctx context.Context
+//   - acc graph.Account
+//   - auth_type string
+func (_e *MockAccountsController_Expecter) UnlinkCredentials(ctx interface{}, acc interface{}, auth_type interface{}) *MockAccountsController_UnlinkCredentials_Call {
+	return &MockAccountsController_UnlinkCredentials_Call{Call: _e.mock.On("UnlinkCredentials", ctx, acc, auth_type)}
+}
+
+func (_c *MockAccountsController_UnlinkCredentials_Call) Run(run func(ctx context.Context, acc graph.Account, auth_type string)) *MockAccountsController_UnlinkCredentials_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(graph.Account), args[2].(string))
+	})
+	return _c
+}
+
+func (_c *MockAccountsController_UnlinkCredentials_Call) Return(_a0 error) *MockAccountsController_UnlinkCredentials_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockAccountsController_UnlinkCredentials_Call) RunAndReturn(run func(context.Context, graph.Account, string) error) *MockAccountsController_UnlinkCredentials_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Update provides a mock function with given fields: ctx, acc, patch
 func (_m *MockAccountsController) Update(ctx context.Context, acc graph.Account, patch map[string]interface{}) error {
 	ret := _m.Called(ctx, acc, patch)
@@ -238,6 +238,54 @@ func (_c *MockNamespacesController_Join_Call) RunAndReturn(run func(context.Cont
 	return _c
 }
 
+// Leave provides a mock function with given fields: ctx, acc, ns
+func (_m *MockNamespacesController) Leave(ctx context.Context, acc graph.Account, ns graph.Namespace) error {
+	ret := _m.Called(ctx, acc, ns)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Leave")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, graph.Account, graph.Namespace) error); ok {
+		r0 = rf(ctx, acc, ns)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockNamespacesController_Leave_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Leave'
+type MockNamespacesController_Leave_Call struct {
+	*mock.Call
+}
+
+// Leave is a helper method to define mock.On call
+//   - ctx context.Context
+//   - acc graph.Account
+//   - ns graph.Namespace
+func (_e *MockNamespacesController_Expecter) Leave(ctx interface{}, acc interface{}, ns interface{}) *MockNamespacesController_Leave_Call {
+	return &MockNamespacesController_Leave_Call{Call: _e.mock.On("Leave", ctx, acc, ns)}
+}
+
+func (_c *MockNamespacesController_Leave_Call) Run(run func(ctx context.Context, acc graph.Account, ns graph.Namespace)) *MockNamespacesController_Leave_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(graph.Account), args[2].(graph.Namespace))
+	})
+	return _c
+}
+
+func (_c *MockNamespacesController_Leave_Call) Return(_a0 error) *MockNamespacesController_Leave_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockNamespacesController_Leave_Call) RunAndReturn(run func(context.Context, graph.Account, graph.Namespace) error) *MockNamespacesController_Leave_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Link provides a mock function with given fields: ctx, acc, ns, _a3, role
 func (_m *MockNamespacesController) Link(ctx context.Context, acc graph.Account, ns graph.Namespace, _a3 access.Level, role string) error {
 	ret := _m.Called(ctx, acc, ns, _a3, role)
@@ -87,6 +87,67 @@ func (_c *MockClient_Del_Call) RunAndReturn(run func(context.Context, ...string)
 	return _c
 }
 
+// Eval provides a mock function with given fields: ctx, script, keys, args
+func (_m *MockClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	var _ca []interface{}
+	_ca = append(_ca, ctx, script, keys)
+	_ca = append(_ca, args...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Eval")
+	}
+
+	var r0 *redis.Cmd
+	if rf, ok := ret.Get(0).(func(context.Context, string, []string, ...interface{}) *redis.Cmd); ok {
+		r0 = rf(ctx, script, keys, args...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*redis.Cmd)
+		}
+	}
+
+	return r0
+}
+
+// MockClient_Eval_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Eval'
+type MockClient_Eval_Call struct {
+	*mock.Call
+}
+
+// Eval is a helper method to define mock.On call
+//   - ctx context.Context
+//   - script string
+//   - keys []string
+//   - args ...interface{}
+func (_e *MockClient_Expecter) Eval(ctx interface{}, script interface{}, keys interface{}, args ...interface{}) *MockClient_Eval_Call {
+	return &MockClient_Eval_Call{Call: _e.mock.On("Eval",
+		append([]interface{}{ctx, script, keys}, args...)...)}
+}
+
+func (_c *MockClient_Eval_Call) Run(run func(ctx context.Context, script string, keys []string, args ...interface{})) *MockClient_Eval_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		variadicArgs := make([]interface{}, len(args)-3)
+		for i, a := range args[3:] {
+			if a != nil {
+				variadicArgs[i] = a.(interface{})
+			}
+		}
+		run(args[0].(context.Context), args[1].(string), args[2].([]string), variadicArgs...)
+	})
+	return _c
+}
+
+func (_c *MockClient_Eval_Call) Return(_a0 *redis.Cmd) *MockClient_Eval_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockClient_Eval_Call) RunAndReturn(run func(context.Context, string, []string, ...interface{}) *redis.Cmd) *MockClient_Eval_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Get provides a mock function with given fields: ctx, key
 func (_m *MockClient) Get(ctx context.Context, key string) *redis.StringCmd {
 	ret := _m.Called(ctx, key)
@@ -357,6 +418,65 @@ func (_c *MockClient_MGet_Call) RunAndReturn(run func(context.Context, ...string
 	return _c
 }
 
+// MSet provides a mock function with given fields: ctx, values
+func (_m *MockClient) MSet(ctx context.Context, values ...interface{}) *redis.StatusCmd {
+	var _ca []interface{}
+	_ca = append(_ca, ctx)
+	_ca = append(_ca, values...)
+	ret := _m.Called(_ca...)
+
+	if len(ret) == 0 {
+		panic("no return value specified for MSet")
+	}
+
+	var r0 *redis.StatusCmd
+	if rf, ok := ret.Get(0).(func(context.Context, ...interface{}) *redis.StatusCmd); ok {
+		r0 = rf(ctx, values...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*redis.StatusCmd)
+		}
+	}
+
+	return r0
+}
+
+// MockClient_MSet_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'MSet'
+type MockClient_MSet_Call struct {
+	*mock.Call
+}
+
+// MSet is a helper method to define mock.On call
+//   - ctx context.Context
+//   - values ...interface{}
+func (_e *MockClient_Expecter) MSet(ctx interface{}, values ...interface{}) *MockClient_MSet_Call {
+	return &MockClient_MSet_Call{Call: _e.mock.On("MSet",
+		append([]interface{}{ctx}, values...)...)}
+}
+
+func (_c *MockClient_MSet_Call) Run(run func(ctx context.Context, values ...interface{})) *MockClient_MSet_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		variadicArgs := make([]interface{}, len(args)-1)
+		for i, a := range args[1:] {
+			if a != nil {
+				variadicArgs[i] = a.(interface{})
+			}
+		}
+		run(args[0].(context.Context), variadicArgs...)
+	})
+	return _c
+}
+
+func (_c *MockClient_MSet_Call) Return(_a0 *redis.StatusCmd) *MockClient_MSet_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockClient_MSet_Call) RunAndReturn(run func(context.Context, ...interface{}) *redis.StatusCmd) *MockClient_MSet_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Options provides a mock function with given fields:
 func (_m *MockClient) Options() *redis.Options {
 	ret := _m.Called()
@@ -404,6 +524,104 @@ func (_c *MockClient_Options_Call) RunAndReturn(run func() *redis.Options) *Mock
 	return _c
 }
 
+// Ping provides a mock function with given fields: ctx
+func (_m *MockClient) Ping(ctx context.Context) *redis.StatusCmd {
+	ret := _m.Called(ctx)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Ping")
+	}
+
+	var r0 *redis.StatusCmd
+	if rf, ok := ret.Get(0).(func(context.Context) *redis.StatusCmd); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*redis.StatusCmd)
+		}
+	}
+
+	return r0
+}
+
+// MockClient_Ping_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Ping'
+type MockClient_Ping_Call struct {
+	*mock.Call
+}
+
+// Ping is a helper method to define mock.On call
+//   - ctx context.Context
+func (_e *MockClient_Expecter) Ping(ctx interface{}) *MockClient_Ping_Call {
+	return &MockClient_Ping_Call{Call: _e.mock.On("Ping", ctx)}
+}
+
+func (_c *MockClient_Ping_Call) Run(run func(ctx context.Context)) *MockClient_Ping_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context))
+	})
+	return _c
+}
+
+func (_c *MockClient_Ping_Call) Return(_a0 *redis.StatusCmd) *MockClient_Ping_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockClient_Ping_Call) RunAndReturn(run func(context.Context) *redis.StatusCmd) *MockClient_Ping_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Publish provides a mock function with given fields: ctx, channel, message
+func (_m *MockClient) Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd {
+	ret := _m.Called(ctx, channel, message)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Publish")
+	}
+
+	var r0 *redis.IntCmd
+	if rf, ok := ret.Get(0).(func(context.Context, string, interface{}) *redis.IntCmd); ok {
+		r0 = rf(ctx, channel, message)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*redis.IntCmd)
+		}
+	}
+
+	return r0
+}
+
+// MockClient_Publish_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Publish'
+type MockClient_Publish_Call struct {
+	*mock.Call
+}
+
+// Publish is a helper method to define mock.On call
+//   - ctx context.Context
+//   - channel string
+//   - message interface{}
+func (_e *MockClient_Expecter) Publish(ctx interface{}, channel interface{}, message interface{}) *MockClient_Publish_Call {
+	return &MockClient_Publish_Call{Call: _e.mock.On("Publish", ctx, channel, message)}
+}
+
+func (_c *MockClient_Publish_Call) Run(run func(ctx context.Context, channel string, message interface{})) *MockClient_Publish_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(string), args[2].(interface{}))
+	})
+	return _c
+}
+
+func (_c *MockClient_Publish_Call) Return(_a0 *redis.IntCmd) *MockClient_Publish_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockClient_Publish_Call) RunAndReturn(run func(context.Context, string, interface{}) *redis.IntCmd) *MockClient_Publish_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Set provides a mock function with given fields: ctx, key, value, expiration
 func (_m *MockClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
 	ret := _m.Called(ctx, key, value, expiration)
@@ -455,6 +673,7 @@ func (_c *MockClient_Set_Call) RunAndReturn(run func(context.Context, string, in
 	return _c
 }
 
+// SetNX provides a mock function with given fields: ctx, key, value, expiration
 func (_m *MockClient) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
 	ret := _m.Called(ctx, key, value, expiration)
 
@@ -474,30 +693,35 @@ func (_m *MockClient) SetNX(ctx context.Context, key string, value interface{},
 	return r0
 }
 
-func (_m *MockClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
-	_va := make([]interface{}, len(args))
-	for _i := range args {
-		_va[_i] = args[_i]
-	}
-	var _ca []interface{}
-	_ca = append(_ca, ctx, script, keys)
-	_ca = append(_ca, _va...)
-	ret := _m.Called(_ca...)
+// MockClient_SetNX_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SetNX'
+type MockClient_SetNX_Call struct {
+	*mock.Call
+}
 
-	if len(ret) == 0 {
-		panic("no return value specified for Eval")
-	}
+// SetNX is a helper method to define mock.On call
+//   - ctx context.Context
+//   - key string
+//   - value interface{}
+//   - expiration time.Duration
+func (_e *MockClient_Expecter) SetNX(ctx interface{}, key interface{}, value interface{}, expiration interface{}) *MockClient_SetNX_Call {
+	return &MockClient_SetNX_Call{Call: _e.mock.On("SetNX", ctx, key, value, expiration)}
+}
 
-	var r0 *redis.Cmd
-	if rf, ok := ret.Get(0).(func(context.Context, string, []string, ...interface{}) *redis.Cmd); ok {
-		r0 = rf(ctx, script, keys, args...)
-	} else {
-		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(*redis.Cmd)
-		}
-	}
+func (_c *MockClient_SetNX_Call) Run(run func(ctx context.Context, key string, value interface{}, expiration time.Duration)) *MockClient_SetNX_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(string), args[2].(interface{}), args[3].(time.Duration))
+	})
+	return _c
+}
 
-	return r0
+func (_c *MockClient_SetNX_Call) Return(_a0 *redis.BoolCmd) *MockClient_SetNX_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockClient_SetNX_Call) RunAndReturn(run func(context.Context, string, interface{}, time.Duration) *redis.BoolCmd) *MockClient_SetNX_Call {
+	_c.Call.Return(run)
+	return _c
 }
 
 // Subscribe provides a mock function with given fields: ctx, channels
@@ -45,12 +45,12 @@ import (
 	"github.com/slntopp/nocloud-proto/access"
 	pb "github.com/slntopp/nocloud-proto/billing"
 	dpb "github.com/slntopp/nocloud-proto/billing/descriptions"
-	driverpb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
 	elpb "github.com/slntopp/nocloud-proto/events_logging"
 	healthpb "github.com/slntopp/nocloud-proto/health"
 	statuspb "github.com/slntopp/nocloud-proto/statuses"
 	"github.com/slntopp/nocloud/pkg/graph"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/drivers"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	"github.com/wI2L/jsondiff"
 	"go.uber.org/zap"
@@ -111,7 +111,7 @@ type BillingServiceServer struct {
 	proc *healthpb.RoutineStatus
 	sus  *healthpb.RoutineStatus
 
-	drivers map[string]driverpb.DriverServiceClient
+	drivers *drivers.Registry
 
 	rootToken string
 
@@ -200,7 +200,7 @@ func (s *BillingServiceServer) SendEmailEvent(templateKey string, account string
 	return err
 }
 
-func NewBillingServiceServer(logger *zap.Logger, db driver.Database, conn rabbitmq.Connection, rdb redisdb.Client, drivers map[string]driverpb.DriverServiceClient, token string,
+func NewBillingServiceServer(logger *zap.Logger, db driver.Database, conn rabbitmq.Connection, rdb redisdb.Client, drivers *drivers.Registry, token string,
 	settingsClient settingspb.SettingsServiceClient, accClient registrypb.AccountsServiceClient, eventsClient epb.EventsServiceClient, instClient ccinstances.InstancesServiceClient,
 	nss graph.NamespacesController, plans graph.BillingPlansController, transactions graph.TransactionsController, invoices graph.InvoicesController,
 	records graph.RecordsController, currencies graph.CurrencyController, accounts graph.AccountsController, descriptions graph.DescriptionsController,
@@ -7,6 +7,7 @@ import (
 	"github.com/slntopp/nocloud-proto/access"
 	pb "github.com/slntopp/nocloud-proto/billing"
 	spb "github.com/slntopp/nocloud-proto/settings"
+	"github.com/slntopp/nocloud/pkg/nocloud/gc"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	sc "github.com/slntopp/nocloud/pkg/settings/client"
 	"go.uber.org/zap"
@@ -19,6 +20,7 @@ const (
 	roundingKey string = "billing-rounding"
 	suspKey     string = "global-suspend-conf"
 	invKey      string = "billing-invoices"
+	gcKey       string = "orphans-gc"
 )
 
 var _ctx context.Context
@@ -84,6 +86,18 @@ type InvoicesConf struct {
 	MustResetInvoiceNumberAt time.Time `json:"must_reset_invoice_number_at"`
 }
 
+type OrphansGCConf struct {
+	IsEnabled bool `json:"is_enabled"`
+	// Only report what would be done
+	DryRun   bool        `json:"dry_run"`
+	Policies gc.Policies `json:"policies"`
+	// Billing plan types which instances are bound to other instance through config.instance, e.g. VPN of VM
+	LinkedPlanTypes []string `json:"linked_plan_types"`
+	// Limit of suspended or deleted orphans per run, 0 is unlimited
+	MaxActions  int `json:"max_actions"`
+	HistoryDays int `json:"history_days"`
+}
+
 var (
 	routineSetting = &sc.Setting[RoutineConf]{
 		Value: RoutineConf{
@@ -176,6 +190,19 @@ var (
 		Description: "Suspend configuration",
 		Level:       access.Level_ADMIN,
 	}
+	gcSetting = &sc.Setting[OrphansGCConf]{
+		Value: OrphansGCConf{
+			IsEnabled:   true,
+			DryRun:      false,
+			Policies:    gc.DefaultPolicies(),
+			MaxActions:  100,
+			HistoryDays: 90,
+
+			LinkedPlanTypes: []string{"vpn"},
+		},
+		Description: "Orphans garbage collection run by daily cron: action per kind of orphan (report, suspend, delete or terminate_invoices), plan types of linked instances and dry run",
+		Level:       access.Level_ADMIN,
+	}
 )
 
 func MakeRoutineConf(log *zap.Logger, settingsClient *spb.SettingsServiceClient) (conf RoutineConf) {
@@ -242,3 +269,16 @@ func MakeInvoicesConf(log *zap.Logger, settingsClient *spb.SettingsServiceClient
 
 	return conf
 }
+
+func MakeOrphansGCConf(log *zap.Logger, settingsClient *spb.SettingsServiceClient) (conf OrphansGCConf) {
+	sc.Setup(log, _ctx, settingsClient)
+
+	if err := sc.Fetch(gcKey, &conf, gcSetting); err != nil {
+		conf = gcSetting.Value
+	}
+	if err := conf.Policies.Validate(); err != nil {
+		log.Warn("Invalid orphans GC policies, unsupported actions are reported only", zap.Error(err))
+	}
+
+	return conf
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/arangodb/go-driver"
 	"github.com/slntopp/nocloud-proto/access"
 	pb "github.com/slntopp/nocloud-proto/billing"
-	dpb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
 	epb "github.com/slntopp/nocloud-proto/events_logging"
 	hpb "github.com/slntopp/nocloud-proto/health"
 	"github.com/slntopp/nocloud/pkg/nocloud"
@@ -217,7 +216,7 @@ func (s *BillingServiceServer) dailyCronJobAction(ctx context.Context, log *zap.
 	s.DeleteExpiredBalanceInvoicesCronJob(ctx, log)
 	s.WhmcsInvoicesSyncerCronJob(ctx, log)
 	s.CollectSystemReport(ctx, log)
-	s.DeleteOrphanVPNInstances(ctx, log)
+	s.OrphansGCCronJob(ctx, log)
 }
 
 func (s *BillingServiceServer) cronPreflightChecks(ctx context.Context, log *zap.Logger) error {
@@ -244,11 +243,12 @@ func (s *BillingServiceServer) cronPreflightChecks(ctx context.Context, log *zap
 		}
 		return nil
 	})
-	for name, client := range s.drivers {
+	// Drivers are probed by registry routine, so only reported state is checked
+	for _, d := range s.drivers.List() {
 		errGroup.Go(func() error {
-			if _, err := client.GetType(ctx, &dpb.GetTypeRequest{}); err != nil {
-				log.Error("No connection with driver", zap.Error(err), zap.String("driver", name))
-				return fmt.Errorf("no connection with driver %s: %w", name, err)
+			if !d.Healthy {
+				log.Error("No connection with driver", zap.String("error", d.LastError), zap.String("driver", d.Type))
+				return fmt.Errorf("no connection with driver %s: %s", d.Type, d.LastError)
 			}
 			return nil
 		})
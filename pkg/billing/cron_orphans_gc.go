@@ -0,0 +1,233 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	pb "github.com/slntopp/nocloud-proto/billing"
+	epb "github.com/slntopp/nocloud-proto/events"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/gc"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/slntopp/nocloud/pkg/pubsub/services_registry"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OrphansGCCronJob finds orphaned instances, instances groups and provider resources and handles them by configured policies
+func (s *BillingServiceServer) OrphansGCCronJob(ctx context.Context, log *zap.Logger) {
+	log = log.Named("OrphansGCCronJob")
+	log.Info("Starting orphans GC cron job")
+
+	conf := MakeOrphansGCConf(log, &s.settingsClient)
+	if !conf.IsEnabled {
+		log.Info("Orphans GC is disabled")
+		return
+	}
+	run, err := s.collectOrphans(ctx, log, conf, conf.DryRun, schema.ROOT_ACCOUNT_KEY)
+	if err != nil {
+		log.Error("Failed to collect orphans", zap.Error(err))
+		return
+	}
+	log.Info("Finished orphans GC cron job", zap.String("run", run.Key), zap.Bool("dry_run", run.DryRun),
+		zap.Any("summary", run.Summary), zap.Int("applied", run.Applied), zap.Int("failed", run.Failed))
+}
+
+// findOrphans runs all finders, orphan matching several kinds is reported once under the first one
+func (s *BillingServiceServer) findOrphans(ctx context.Context, log *zap.Logger, conf OrphansGCConf) ([]gc.Finding, error) {
+	finders := []func(context.Context, driver.Database) ([]gc.Finding, error){
+		graph.FindDetachedInstances,
+		func(ctx context.Context, db driver.Database) ([]gc.Finding, error) {
+			return graph.FindLinkedDeletedInstances(ctx, db, conf.LinkedPlanTypes)
+		},
+		graph.FindDeletedBillableInstances,
+		graph.FindEmptyGroups,
+		graph.FindProviderOrphans,
+	}
+	seen := make(map[string]struct{})
+	res := make([]gc.Finding, 0)
+	for _, find := range finders {
+		findings, err := find(ctx, s.db)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range findings {
+			key := f.Entity + "/" + f.Uuid
+			if f.Kind == gc.ProviderOrphan {
+				key = f.Sp + "/" + key
+			}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			res = append(res, f)
+		}
+	}
+	log.Debug("Found orphans", zap.Int("count", len(res)))
+	return res, nil
+}
+
+// collectOrphans finds orphans, applies actions unless dry run and stores report of the run
+func (s *BillingServiceServer) collectOrphans(ctx context.Context, log *zap.Logger, conf OrphansGCConf, dryRun bool, requester string) (*graph.GCRun, error) {
+	run := &graph.GCRun{
+		Started:   time.Now().Unix(),
+		DryRun:    dryRun,
+		Requester: requester,
+	}
+	findings, err := s.findOrphans(ctx, log, conf)
+	if err != nil {
+		return nil, err
+	}
+	findings = gc.Plan(findings, conf.Policies, conf.MaxActions)
+	if !dryRun {
+		for i := range findings {
+			s.applyOrphanAction(ctx, log, &findings[i])
+			if findings[i].Applied {
+				run.Applied++
+			} else if findings[i].Error != "" {
+				run.Failed++
+			}
+		}
+	}
+	run.Findings, run.Summary = findings, gc.Summary(findings)
+	run.Finished = time.Now().Unix()
+
+	graph.GetEnsureCollection(log, ctx, s.db, schema.GC_RUNS_COL)
+	if run, err = graph.CreateGCRun(ctx, s.db, run); err != nil {
+		return nil, err
+	}
+
+	summary, _ := json.Marshal(run.Summary)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    "Cron",
+		Uuid:      "OrphansGC",
+		Scope:     "database",
+		Action:    "orphans_gc",
+		Requestor: requester,
+		Snapshot:  &elpb.Snapshot{Diff: string(summary)},
+		Ts:        run.Started,
+		Rc:        0,
+	})
+
+	if conf.HistoryDays > 0 {
+		if err := graph.PruneGCRuns(ctx, s.db, time.Now().AddDate(0, 0, -conf.HistoryDays).Unix()); err != nil {
+			log.Warn("Failed to prune orphans GC runs", zap.Error(err))
+		}
+	}
+	return run, nil
+}
+
+func (s *BillingServiceServer) applyOrphanAction(ctx context.Context, log *zap.Logger, f *gc.Finding) {
+	if f.Action == gc.Report || f.Skipped != "" {
+		return
+	}
+	log = log.With(zap.String("kind", string(f.Kind)), zap.String("uuid", f.Uuid), zap.String("action", string(f.Action)))
+
+	var err error
+	switch {
+	case f.Entity == schema.INSTANCES_COL && f.Action == gc.Suspend:
+		err = s.instanceCommandsPub(&epb.Event{
+			Uuid: f.Uuid,
+			Key:  services_registry.CommandInstanceInvoke,
+			Type: "suspend",
+		})
+	case f.Entity == schema.INSTANCES_COL && f.Action == gc.TerminateInvoices:
+		// Instance is deleted already, so it's billing what is left
+		for _, inv := range f.Refs {
+			req := connect.NewRequest(&pb.UpdateInvoiceStatusRequest{Uuid: inv, Status: pb.BillingStatus_TERMINATED})
+			if _, err = s.UpdateInvoiceStatus(ctx, req); err != nil {
+				break
+			}
+		}
+	case f.Entity == schema.INSTANCES_COL && f.Action == gc.Delete:
+		req := connect.NewRequest(&ipb.DeleteRequest{Uuid: f.Uuid})
+		req.Header().Set("Authorization", "Bearer "+ctx.Value(nocloud.NoCloudToken).(string))
+		_, err = s.instancesClient.Delete(ctx, req)
+	case f.Entity == schema.INSTANCES_GROUPS_COL && f.Action == gc.Delete:
+		err = s.services.IGController().SetStatus(ctx, &ipb.InstancesGroup{Uuid: f.Uuid}, statuspb.NoCloudStatus_DEL)
+	default:
+		err = fmt.Errorf("action %s is not supported for %s", f.Action, f.Entity)
+	}
+	if err != nil {
+		log.Error("Failed to apply orphans GC action", zap.Error(err))
+		f.Error = err.Error()
+		return
+	}
+	log.Info("Applied orphans GC action")
+	f.Applied = true
+}
+
+func (s *BillingServiceServer) RegisterOrphansGCRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/billing/gc/runs", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListGCRuns))).Methods("GET")
+	router.Handle("/billing/gc/runs/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGetGCRun))).Methods("GET")
+	router.Handle("/billing/gc/dry-run", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGCDryRun))).Methods("POST")
+}
+
+func (s *BillingServiceServer) HandleListGCRuns(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	if _, err := graph.CheckRootAccess(ctx, s.ca, access.Level_ADMIN); err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	limit, _ := strconv.Atoi(request.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	graph.GetEnsureCollection(s.log, ctx, s.db, schema.GC_RUNS_COL)
+	res, err := graph.ListGCRuns(ctx, s.db, limit)
+	if err != nil {
+		s.log.Error("Failed to list orphans GC runs", zap.Error(err))
+		http_server.WriteResult(writer, status.Error(codes.Internal, "Failed to list runs"))
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *BillingServiceServer) HandleGetGCRun(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	if _, err := graph.CheckRootAccess(ctx, s.ca, access.Level_ADMIN); err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	res, err := graph.GetGCRun(ctx, s.db, mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, status.Error(codes.NotFound, "Run not found"))
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+// HandleGCDryRun reports what GC would do with current policies, nothing is changed
+func (s *BillingServiceServer) HandleGCDryRun(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	requester, err := graph.CheckRootAccess(ctx, s.ca, access.Level_ADMIN)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	log := s.log.Named("GCDryRun")
+	res, err := s.collectOrphans(ctx, log, MakeOrphansGCConf(log, &s.settingsClient), true, requester)
+	if err != nil {
+		log.Error("Failed to collect orphans", zap.Error(err))
+		http_server.WriteResult(writer, status.Error(codes.Internal, "Failed to collect orphans"))
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
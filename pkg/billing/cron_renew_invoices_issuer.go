@@ -111,9 +111,9 @@ func (s *BillingServiceServer) InvoiceExpiringInstancesCronJob(ctx context.Conte
 					}
 				}
 				accountPools[acc.GetUuid()].Instances = append(accountPools[acc.GetUuid()].Instances, inst)
-				client, ok := s.drivers[ig.GetType()]
-				if !ok {
-					log.Error("Driver not found", zap.String("type", ig.GetType()))
+				client, err := s.drivers.Client(ig.GetType())
+				if err != nil {
+					log.Error("Driver not available", zap.String("type", ig.GetType()), zap.Error(err))
 					preErrs++
 					continue
 				}
@@ -159,7 +159,9 @@ func (s *PaymentGatewayServer) HandleViewInvoice(writer http.ResponseWriter, req
 		languageCode = account.GetLanguageCode()
 	}
 
-	if account.Data != nil {
+	if profile := graph.InvoiceBillingProfile(invoice.Invoice); profile != nil {
+		Buyer = buildBuyerSection(account.GetTitle(), profile.Data, languageCode)
+	} else if account.Data != nil {
 		Buyer = buildBuyerSection(account.GetTitle(), account.Data.AsMap(), languageCode)
 	}
 
@@ -279,7 +281,9 @@ func (s *PaymentGatewayServer) HandlePaymentAction(writer http.ResponseWriter, r
 		languageCode = account.GetLanguageCode()
 	}
 
-	if account.Data != nil {
+	if profile := graph.InvoiceBillingProfile(invoice.Invoice); profile != nil {
+		Buyer = buildBuyerSection(account.GetTitle(), profile.Data, languageCode)
+	} else if account.Data != nil {
 		Buyer = buildBuyerSection(account.GetTitle(), account.Data.AsMap(), languageCode)
 	}
 
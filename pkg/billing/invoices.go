@@ -34,6 +34,7 @@ import (
 	ipb "github.com/slntopp/nocloud-proto/instances"
 	"github.com/slntopp/nocloud/pkg/graph"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/drivers"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
@@ -626,9 +627,6 @@ func (s *BillingServiceServer) CreateInvoice(ctx context.Context, req *connect.R
 	if t.Account == "" {
 		return nil, status.Error(codes.InvalidArgument, "Missing account")
 	}
-	if t.Currency == nil {
-		t.Currency = defCurr
-	}
 	if t.Transactions == nil {
 		t.Transactions = []string{}
 	}
@@ -648,6 +646,32 @@ func (s *BillingServiceServer) CreateInvoice(ctx context.Context, req *connect.R
 		return nil, status.Error(codes.Internal, "Failed to get account")
 	}
 	tax := acc.GetTaxRate()
+	profile, err := graph.ResolveBillingProfile(ctx, s.db, acc.GetUuid(), t.GetInstances())
+	if err != nil {
+		log.Error("Failed to resolve billing profile, using account data", zap.Error(err))
+	}
+	if profile != nil {
+		tax = profile.TaxRate()
+	}
+	if t.Currency == nil {
+		t.Currency = defCurr
+		// Items without explicit currency are priced in default one, so converting them into profile currency
+		if profile != nil && profile.Currency != 0 && profile.Currency != defCurr.GetId() {
+			profCurr, err := s.currencies.Get(ctx, profile.Currency)
+			if err != nil {
+				log.Error("Failed to get billing profile currency", zap.Error(err))
+				return nil, status.Error(codes.Internal, "Failed to get billing profile currency")
+			}
+			to := graph.CurrencyToPb(profCurr)
+			for _, item := range t.GetItems() {
+				if item.Price, err = s.currencies.Convert(ctx, defCurr, to, item.GetPrice()); err != nil {
+					log.Error("Failed to convert invoice item price", zap.Error(err))
+					return nil, status.Error(codes.Internal, "Failed to convert invoice item price")
+				}
+			}
+			t.Currency = to
+		}
+	}
 	t.TaxOptions.TaxRate = tax
 
 	// Rounding invoice items
@@ -748,6 +772,7 @@ func (s *BillingServiceServer) CreateInvoice(ctx context.Context, req *connect.R
 	if t.Meta["creator"] == nil {
 		t.Meta["creator"] = structpb.NewStringValue(requester)
 	}
+	graph.SetInvoiceBillingProfile(t, profile)
 	if acc.GetPaymentsGateway() == "whmcs" || acc.GetPaymentsGateway() == "" {
 		t.Meta["whmcs_sync_required"] = structpb.NewBoolValue(true)
 	}
@@ -1069,6 +1094,13 @@ func formatInvoiceData(inv *pb.Invoice, accGroup *accpb.AccountGroup, invConf In
 	data["company_domain"] = structpb.NewStringValue(companyDomain)
 	data["company_name"] = structpb.NewStringValue(companyName)
 	data["invoice_html_contents"] = structpb.NewStringValue(InvoiceItemsHTML(inv))
+	if profile := graph.InvoiceBillingProfile(inv); profile != nil && len(profile.Emails) > 0 {
+		recipients := make([]*structpb.Value, len(profile.Emails))
+		for i, e := range profile.Emails {
+			recipients[i] = structpb.NewStringValue(e)
+		}
+		data["recipients"] = structpb.NewListValue(&structpb.ListValue{Values: recipients})
+	}
 	return data
 }
 
@@ -2207,10 +2239,10 @@ func (s *BillingServiceServer) CreateRenewalInvoice(ctx context.Context, _req *c
 
 	log = log.With(zap.String("driver", res.SP.GetType()))
 
-	client, ok := s.drivers[res.SP.GetType()]
-	if !ok {
-		log.Error("Error getting driver. Driver not registered")
-		return nil, status.Error(codes.Internal, "Error getting driver. Driver not registered")
+	client, err := s.drivers.Client(res.SP.GetType())
+	if err != nil {
+		log.Error("Error getting driver", zap.Error(err))
+		return nil, drivers.Status(err)
 	}
 
 	resp, err := client.GetExpiration(ctx, &driverpb.GetExpirationRequest{
@@ -288,9 +288,9 @@ const lastAutoPaymentAttemptKey = "last_auto_payment_attempt"
 const autoPaymentAttemptsKey = "auto_payment_attempts_count"
 
 func (s *BillingServiceServer) getInstanceExpiration(ctx context.Context, inst *instancespb.ResponseInstance) (int64, int64, error) {
-	client, ok := s.drivers[inst.Type]
-	if !ok {
-		return 0, 0, fmt.Errorf("driver not found for type: %s", inst.Type)
+	client, err := s.drivers.Client(inst.Type)
+	if err != nil {
+		return 0, 0, err
 	}
 	resp, err := client.GetExpiration(ctx, &vanilla.GetExpirationRequest{
 		Instance:         inst.Instance,
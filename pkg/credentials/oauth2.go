@@ -7,6 +7,7 @@ import (
 	"github.com/arangodb/go-driver"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	oauth2_config "github.com/slntopp/nocloud/pkg/oauth2/config"
+	"github.com/slntopp/nocloud/pkg/oauth2/idp"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
@@ -24,6 +25,30 @@ func init() {
 	}
 }
 
+// Key used to verify identity assertions issued by oauth2 service for upstream identity providers (OIDC, SAML)
+var identityAssertionKey []byte
+
+func SetupIdentityAssertions(key []byte) {
+	identityAssertionKey = key
+}
+
+// identityProviderSubject resolves subject out of identity assertion if credType belongs to upstream identity provider
+func identityProviderSubject(provider, token string) (string, bool) {
+	if identityAssertionKey == nil {
+		return "", false
+	}
+	if _, ok := cfg[provider]; ok {
+		return "", false
+	}
+	assertionProvider, subject, err := idp.ParseAssertion(identityAssertionKey, token)
+	if err != nil || assertionProvider != provider {
+		return "", false
+	}
+	return subject, true
+}
+
+const identityProviderAuthField = "idp_subject"
+
 type OAuth2Credentials struct {
 	AuthField string `json:"auth_field"`
 	AuthValue string `json:"auth_value"`
@@ -47,6 +72,10 @@ func NewOAuth2Credentials(data []string, credType string) (Credentials, error) {
 
 	oauth2TypeValue := oauth2Type[1]
 
+	if subject, ok := identityProviderSubject(oauth2TypeValue, token); ok {
+		return &OAuth2Credentials{AuthField: identityProviderAuthField, AuthValue: subject, AuthType: credType}, nil
+	}
+
 	oauth2TypeConfig, ok := cfg[oauth2TypeValue]
 
 	if !ok {
@@ -138,6 +167,10 @@ func (cred *OAuth2Credentials) Authorize(args ...string) bool {
 
 	oauth2TypeValue := oauth2Type[1]
 
+	if subject, ok := identityProviderSubject(oauth2TypeValue, token); ok {
+		return cred.AuthField == identityProviderAuthField && cred.AuthValue == subject
+	}
+
 	oauth2TypeConfig, ok := cfg[oauth2TypeValue]
 	if !ok {
 		cred.log.Error("Auth type is not presented", zap.String("type", oauth2TypeValue))
@@ -231,3 +264,19 @@ func (cred *OAuth2Credentials) FindByKey(ctx context.Context, col driver.Collect
 	_, err := col.ReadDocument(ctx, key, cred)
 	return err
 }
+
+// IdentityProviderCredentialsExist tells whether subject of upstream identity provider is linked to any account
+func IdentityProviderCredentialsExist(ctx context.Context, db driver.Database, credType, subject string) (bool, error) {
+	query := `FOR cred IN @@credentials FILTER cred.auth_type == @type && cred.auth_field == @field && cred.auth_value == @value LIMIT 1 RETURN cred._key`
+	c, err := db.Query(ctx, query, map[string]interface{}{
+		"type":         credType,
+		"field":        identityProviderAuthField,
+		"value":        subject,
+		"@credentials": schema.CREDENTIALS_COL,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	return c.HasMore(), nil
+}
@@ -104,6 +104,37 @@ func (s *DNSServer) Put(ctx context.Context, req *pb.Zone) (*pb.Result, error) {
 	return &pb.Result{Result: upd}, nil
 }
 
+type PTR struct {
+	TTL  int    `json:"ttl"`
+	Host string `json:"host"`
+}
+
+const hdelScript = `return redis.call("HDEL", KEYS[1], ARGV[1])`
+
+// SetPTR writes PTR record of location in reverse zone, empty host removes location.
+// Meant for services managing addresses, so access isn't checked
+func (s *DNSServer) SetPTR(ctx context.Context, zone, location, host string, ttl int) error {
+	key := KEYS_PREFIX + ":" + zone
+	if host == "" {
+		if err := s.rdb.Eval(ctx, hdelScript, []string{key}, location).Err(); err != nil {
+			s.log.Error("Error deleting PTR record in Redis", zap.String("zone", key), zap.String("location", location), zap.Error(err))
+			return err
+		}
+		return nil
+	}
+	record, err := json.Marshal(map[string][]PTR{
+		"ptr": {{TTL: ttl, Host: strings.TrimSuffix(host, ".") + "."}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.rdb.HSet(ctx, key, location, string(record)).Err(); err != nil {
+		s.log.Error("Error putting PTR record to Redis", zap.String("zone", key), zap.String("location", location), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 func (s *DNSServer) Delete(ctx context.Context, req *pb.Zone) (*pb.Result, error) {
 	access := ctx.Value(nocloud.NoCloudRootAccess).(int)
 	if access < 3 {
@@ -0,0 +1,229 @@
+package graph
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arangodb/go-driver"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+// AccountDataExport is everything stored about the account, as raw documents
+type AccountDataExport struct {
+	Account         map[string]any    `json:"account"`
+	Credentials     []CredentialsLink `json:"credentials"`
+	Notes           []map[string]any  `json:"notes"`
+	Consents        []map[string]any  `json:"consents"`
+	Namespaces      []map[string]any  `json:"namespaces"`
+	Instances       []map[string]any  `json:"instances"`
+	Invoices        []map[string]any  `json:"invoices"`
+	Transactions    []map[string]any  `json:"transactions"`
+	BillingProfiles []map[string]any  `json:"billing_profiles"`
+}
+
+const exportAccountData = `
+LET account = DOCUMENT(@account)
+LET credentials = (
+	FOR cred, edge IN 1 OUTBOUND account GRAPH @credentials_graph
+	RETURN {
+		type: edge.type,
+		key: cred._key,
+		role: edge.role,
+		identifier: NOT_NULL(cred.username, cred.email, cred.auth_value)
+	}
+)
+LET consents = (
+	FOR r IN @@consents FILTER r.account == account._key
+	RETURN MERGE(UNSET(r, "_id", "_rev"), { uuid: r._key })
+)
+LET namespaces = (
+	FOR ns, edge IN 1 OUTBOUND account GRAPH @permissions
+	FILTER IS_SAME_COLLECTION(@namespaces, ns)
+	RETURN MERGE(UNSET(ns, "_id", "_rev"), { uuid: ns._key, level: edge.level, role: edge.role })
+)
+LET instances = (
+	FOR node, edge, path IN 4 OUTBOUND account GRAPH @permissions
+	FILTER path.edges[0].role == @owner AND IS_SAME_COLLECTION(@instances, node)
+	RETURN MERGE(UNSET(node, "_id", "_rev", "data"), { uuid: node._key })
+)
+LET invoices = (
+	FOR i IN @@invoices FILTER i.account == account._key
+	RETURN MERGE(UNSET(i, "_id", "_rev"), { uuid: i._key })
+)
+LET transactions = (
+	FOR t IN @@transactions FILTER t.account == account._key
+	RETURN MERGE(UNSET(t, "_id", "_rev"), { uuid: t._key })
+)
+LET billing_profiles = (
+	FOR p IN @@billing_profiles FILTER p.account == account._key
+	RETURN MERGE(UNSET(p, "_id", "_rev"), { uuid: p._key })
+)
+RETURN {
+	account: MERGE(UNSET(account, "_id", "_rev", "admin_notes"), { uuid: account._key }),
+	credentials, consents, namespaces, instances, invoices, transactions, billing_profiles,
+	notes: NOT_NULL(account.admin_notes, [])
+}
+`
+
+// ExportAccountData gathers account document and everything linked to it for subject access request
+func ExportAccountData(ctx context.Context, db driver.Database, account string) (*AccountDataExport, error) {
+	c, err := db.Query(ctx, exportAccountData, map[string]interface{}{
+		"account":           driver.NewDocumentID(schema.ACCOUNTS_COL, account),
+		"credentials_graph": schema.CREDENTIALS_GRAPH.Name,
+		"permissions":       schema.PERMISSIONS_GRAPH.Name,
+		"namespaces":        schema.NAMESPACES_COL,
+		"instances":         schema.INSTANCES_COL,
+		"owner":             roles.OWNER,
+		"@consents":         schema.CONSENTS_COL,
+		"@invoices":         schema.INVOICES_COL,
+		"@transactions":     schema.TRANSACTIONS_COL,
+		"@billing_profiles": schema.BILLING_PROFILES_COL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var export AccountDataExport
+	if _, err = c.ReadDocument(ctx, &export); err != nil {
+		return nil, err
+	}
+	if export.Account == nil {
+		return nil, errors.New("account not found")
+	}
+	return &export, nil
+}
+
+const countActiveInstances = `
+FOR node, edge, path IN 4 OUTBOUND @account GRAPH @permissions
+	FILTER path.edges[0].role == @owner AND IS_SAME_COLLECTION(@instances, node)
+	FILTER node.status != @deleted
+	COLLECT WITH COUNT INTO n
+	RETURN n
+`
+
+// CountActiveInstances counts not deleted instances owned by account
+func CountActiveInstances(ctx context.Context, db driver.Database, account string) (int, error) {
+	c, err := db.Query(ctx, countActiveInstances, map[string]interface{}{
+		"account":     driver.NewDocumentID(schema.ACCOUNTS_COL, account),
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"instances":   schema.INSTANCES_COL,
+		"owner":       roles.OWNER,
+		"deleted":     statuspb.NoCloudStatus_DEL,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	var n int
+	_, err = c.ReadDocument(ctx, &n)
+	return n, err
+}
+
+const hasBillingRecords = `
+RETURN LENGTH(FOR i IN @@invoices FILTER i.account == @account LIMIT 1 RETURN 1)
+	+ LENGTH(FOR t IN @@transactions FILTER t.account == @account LIMIT 1 RETURN 1) > 0
+`
+
+// HasBillingRecords reports whether account has invoices or transactions, which must be retained
+func HasBillingRecords(ctx context.Context, db driver.Database, account string) (bool, error) {
+	c, err := db.Query(ctx, hasBillingRecords, map[string]interface{}{
+		"account":       account,
+		"@invoices":     schema.INVOICES_COL,
+		"@transactions": schema.TRANSACTIONS_COL,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	var has bool
+	_, err = c.ReadDocument(ctx, &has)
+	return has, err
+}
+
+// ErasureReport counts what was removed or anonymized
+type ErasureReport struct {
+	Credentials     int `json:"credentials"`
+	Namespaces      int `json:"namespaces"`
+	Invitations     int `json:"invitations"`
+	BillingProfiles int `json:"billing_profiles"`
+}
+
+// Single query, so erasure is applied atomically
+// Invoices, transactions and consents are kept untouched for retention, invoices keep own buyer snapshot
+// so billing profiles are removed
+const anonymizeAccount = `
+LET account = DOCUMENT(@account)
+LET email = LOWER(account.data.email)
+LET creds = (
+	FOR cred, edge IN 1 OUTBOUND account GRAPH @credentials_graph
+	RETURN { cred: cred._key, edge: edge._key }
+)
+LET removed_edges = (FOR c IN creds REMOVE c.edge IN @@cred_edges RETURN 1)
+LET removed_creds = (FOR c IN creds REMOVE c.cred IN @@credentials RETURN 1)
+LET namespaces = (
+	FOR ns, edge IN 1 OUTBOUND account GRAPH @permissions
+	FILTER IS_SAME_COLLECTION(@namespaces, ns) AND edge.role == @owner AND ns._key != @root_ns
+	UPDATE ns WITH { title: @title } IN @@namespaces
+	RETURN 1
+)
+LET invitations = (
+	FOR i IN @@invitations
+	FILTER i.account == account._key OR (email != null AND LOWER(i.email) == email)
+	UPDATE i WITH { email: null, token_hash: null } IN @@invitations OPTIONS { keepNull: false }
+	RETURN 1
+)
+LET billing_profiles = (
+	FOR p IN @@billing_profiles
+	FILTER p.account == account._key
+	REMOVE p IN @@billing_profiles
+	RETURN 1
+)
+UPDATE account WITH {
+	title: @title,
+	data: { erased: true },
+	admin_notes: [],
+	is_email_verified: false,
+	erased: @now,
+	retain_until: @retain_until
+} IN @@accounts OPTIONS { mergeObjects: false }
+RETURN {
+	credentials: LENGTH(removed_creds),
+	namespaces: LENGTH(namespaces),
+	invitations: LENGTH(invitations),
+	billing_profiles: LENGTH(billing_profiles)
+}
+`
+
+// AnonymizeAccount strips personal data and credentials from account, keeping the document so invoices and transactions stay valid
+func AnonymizeAccount(ctx context.Context, db driver.Database, account, title string, now, retainUntil int64) (*ErasureReport, error) {
+	c, err := db.Query(ctx, anonymizeAccount, map[string]interface{}{
+		"account":           driver.NewDocumentID(schema.ACCOUNTS_COL, account),
+		"credentials_graph": schema.CREDENTIALS_GRAPH.Name,
+		"permissions":       schema.PERMISSIONS_GRAPH.Name,
+		"namespaces":        schema.NAMESPACES_COL,
+		"owner":             roles.OWNER,
+		"root_ns":           schema.ROOT_NAMESPACE_KEY,
+		"title":             title,
+		"now":               now,
+		"retain_until":      retainUntil,
+		"@accounts":         schema.ACCOUNTS_COL,
+		"@credentials":      schema.CREDENTIALS_COL,
+		"@cred_edges":       schema.ACC2CRED,
+		"@namespaces":       schema.NAMESPACES_COL,
+		"@invitations":      schema.INVITATIONS_COL,
+		"@billing_profiles": schema.BILLING_PROFILES_COL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var report ErasureReport
+	if _, err = c.ReadDocument(ctx, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
@@ -0,0 +1,432 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/arangodb/go-driver"
+	pb "github.com/slntopp/nocloud-proto/billing"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+// AccountMerge describes what is moved from source account to target, either planned or done
+type AccountMerge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Credentials types moved to target
+	Credentials []string `json:"credentials"`
+	// Credentials types target already has, these are removed from source
+	DroppedCredentials []string `json:"dropped_credentials"`
+	Namespaces         []string `json:"namespaces"`
+	Services           []string `json:"services"`
+	InstancesGroups    []string `json:"instances_groups"`
+	Invoices           int      `json:"invoices"`
+	Transactions       int      `json:"transactions"`
+	Records            int      `json:"records"`
+	PromocodeUses      int      `json:"promocode_uses"`
+	Notes              int      `json:"notes"`
+	// Source balance in source currency and the amount it adds to target balance
+	SourceBalance    float64      `json:"source_balance"`
+	SourceCurrency   *pb.Currency `json:"source_currency"`
+	ConvertedBalance float64      `json:"converted_balance"`
+	TargetCurrency   *pb.Currency `json:"target_currency"`
+	// Either account is pending deletion or already purged
+	PendingDeletion bool `json:"-"`
+}
+
+var (
+	ErrMergePendingDeletion = errors.New("account is pending deletion")
+	ErrMergeConversion      = errors.New("cannot convert balance to target currency")
+)
+
+// BalanceConverter converts source balance to target currency, i.e. CurrencyController.Convert
+type BalanceConverter func(ctx context.Context, from *pb.Currency, to *pb.Currency, amount float64) (float64, error)
+
+// AccountRedirect is left for merged account, so references to its UUID can be resolved
+type AccountRedirect struct {
+	Source   string `json:"_key"`
+	Target   string `json:"target"`
+	MergedAt int64  `json:"merged_at"`
+	MergedBy string `json:"merged_by"`
+}
+
+// Collections holding documents with account field which follow account on merge
+var accountBoundCollections = []string{
+	schema.INVOICES_COL, schema.TRANSACTIONS_COL, schema.RECORDS_COL, schema.CONSENTS_COL, schema.INVITATIONS_COL,
+}
+
+const previewAccountMerge = `
+LET source = DOCUMENT(@source)
+LET target = DOCUMENT(@target)
+LET target_types = (FOR cred, edge IN 1 OUTBOUND target GRAPH @credentials_graph RETURN edge.type)
+LET credentials = (FOR cred, edge IN 1 OUTBOUND source GRAPH @credentials_graph RETURN edge.type)
+LET namespaces = (
+	FOR ns IN 1 OUTBOUND source GRAPH @permissions
+	FILTER IS_SAME_COLLECTION(@namespaces, ns)
+	RETURN ns._key
+)
+LET services = (
+	FOR node, edge, path IN 2 OUTBOUND source GRAPH @permissions
+	FILTER path.edges[0].role == @owner AND IS_SAME_COLLECTION(@services, node)
+	RETURN node._key
+)
+LET groups = (
+	FOR node, edge, path IN 3 OUTBOUND source GRAPH @permissions
+	FILTER path.edges[0].role == @owner AND IS_SAME_COLLECTION(@instances_groups, node)
+	RETURN node._key
+)
+RETURN {
+	source: source._key,
+	target: target._key,
+	credentials: MINUS(credentials, target_types),
+	dropped_credentials: INTERSECTION(credentials, target_types),
+	namespaces, services,
+	instances_groups: groups,
+	invoices: LENGTH(FOR d IN @@invoices FILTER d.account == source._key RETURN 1),
+	transactions: LENGTH(FOR d IN @@transactions FILTER d.account == source._key RETURN 1),
+	records: LENGTH(FOR d IN @@records FILTER d.account == source._key RETURN 1),
+	promocode_uses: LENGTH(FOR p IN @@promocodes FOR u IN NOT_NULL(p.uses, []) FILTER u.account == source._key RETURN 1),
+	notes: LENGTH(NOT_NULL(source.admin_notes, [])),
+	source_balance: NOT_NULL(source.balance, 0),
+	source_currency: source.currency,
+	target_currency: target.currency,
+	pending_deletion: source.deletion != null OR target.deletion != null
+}
+`
+
+// PreviewAccountMerge lists what MergeAccounts would move without changing anything
+func PreviewAccountMerge(ctx context.Context, db driver.Database, source, target string) (*AccountMerge, error) {
+	c, err := db.Query(ctx, previewAccountMerge, map[string]interface{}{
+		"source":            driver.NewDocumentID(schema.ACCOUNTS_COL, source),
+		"target":            driver.NewDocumentID(schema.ACCOUNTS_COL, target),
+		"credentials_graph": schema.CREDENTIALS_GRAPH.Name,
+		"permissions":       schema.PERMISSIONS_GRAPH.Name,
+		"namespaces":        schema.NAMESPACES_COL,
+		"services":          schema.SERVICES_COL,
+		"instances_groups":  schema.INSTANCES_GROUPS_COL,
+		"owner":             roles.OWNER,
+		"@invoices":         schema.INVOICES_COL,
+		"@transactions":     schema.TRANSACTIONS_COL,
+		"@records":          schema.RECORDS_COL,
+		"@promocodes":       schema.PROMOCODES_COL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var merge struct {
+		AccountMerge
+		PendingDeletion bool `json:"pending_deletion"`
+	}
+	if _, err = c.ReadDocument(ctx, &merge); err != nil {
+		return nil, err
+	}
+	if merge.Source == "" || merge.Target == "" {
+		return nil, errors.New("account not found")
+	}
+	merge.AccountMerge.PendingDeletion = merge.PendingDeletion
+	return &merge.AccountMerge, nil
+}
+
+// PlanAccountMerge previews merge and converts source balance, refusing accounts pending deletion
+func PlanAccountMerge(ctx context.Context, db driver.Database, source, target string, convert BalanceConverter) (*AccountMerge, error) {
+	merge, err := PreviewAccountMerge(ctx, db, source, target)
+	if err != nil {
+		return nil, err
+	}
+	if merge.PendingDeletion {
+		return nil, ErrMergePendingDeletion
+	}
+	if merge.SourceCurrency == nil {
+		merge.SourceCurrency = &pb.Currency{Id: schema.DEFAULT_CURRENCY_ID, Code: schema.DEFAULT_CURRENCY_NAME}
+	}
+	if merge.TargetCurrency == nil {
+		merge.TargetCurrency = &pb.Currency{Id: schema.DEFAULT_CURRENCY_ID, Code: schema.DEFAULT_CURRENCY_NAME}
+	}
+	if merge.SourceBalance != 0 {
+		merge.ConvertedBalance, err = convert(ctx, merge.SourceCurrency, merge.TargetCurrency, merge.SourceBalance)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMergeConversion, err)
+		}
+	}
+	return merge, nil
+}
+
+const unlinkSourceCredentials = `
+FOR cred, edge IN 1 OUTBOUND @source GRAPH @credentials_graph
+	REMOVE edge IN @@cred_edges
+	RETURN { key: cred._key, type: edge.type, role: edge.role, drop: edge.type IN @dropped }
+`
+
+const removeCredentials = `FOR key IN @keys REMOVE key IN @@credentials`
+
+const linkTargetCredentials = `
+FOR c IN @credentials
+	INSERT {
+		_key: CONCAT(c.type, "-", @target_key),
+		_from: @target,
+		_to: CONCAT(@credentials_col, "/", c.key),
+		type: c.type,
+		role: c.role
+	} IN @@cred_edges
+`
+
+const unlinkSourceNamespaces = `
+FOR ns, edge IN 1 OUTBOUND @source GRAPH @permissions
+	FILTER IS_SAME_COLLECTION(@namespaces, ns)
+	REMOVE edge IN @@acc2ns
+	RETURN { ns: ns._key, level: edge.level, role: edge.role }
+`
+
+// Namespaces shared with target keep the higher access level and ownership
+const linkTargetNamespaces = `
+FOR e IN @edges
+	UPSERT { _key: CONCAT(@target_key, "-", e.ns) }
+	INSERT {
+		_key: CONCAT(@target_key, "-", e.ns),
+		_from: @target,
+		_to: CONCAT(@namespaces, "/", e.ns),
+		level: e.level,
+		role: e.role
+	}
+	UPDATE {
+		level: MAX([OLD.level, e.level]),
+		role: OLD.role == @owner ? OLD.role : e.role
+	} IN @@acc2ns
+`
+
+const moveAccountBound = `
+FOR d IN @@col
+	FILTER d.account == @source_key
+	UPDATE d WITH { account: @target_key } IN @@col
+`
+
+// Target keeps own default billing profile, if it has one
+const moveBillingProfiles = `
+LET has_default = LENGTH(FOR p IN @@col FILTER p.account == @target_key AND p.default LIMIT 1 RETURN 1) > 0
+FOR p IN @@col
+	FILTER p.account == @source_key
+	UPDATE p WITH { account: @target_key, default: p.default AND NOT has_default } IN @@col
+`
+
+const movePromocodeUses = `
+FOR p IN @@promocodes
+	FILTER LENGTH(NOT_NULL(p.uses, [])[* FILTER CURRENT.account == @source_key]) > 0
+	UPDATE p WITH {
+		uses: p.uses[* RETURN CURRENT.account == @source_key ? MERGE(CURRENT, { account: @target_key }) : CURRENT]
+	} IN @@promocodes
+`
+
+const mergeIntoTarget = `
+LET source = DOCUMENT(@source)
+LET target = DOCUMENT(@target)
+UPDATE target WITH {
+	balance: NOT_NULL(target.balance, 0) + @balance,
+	admin_notes: APPEND(NOT_NULL(target.admin_notes, []), NOT_NULL(source.admin_notes, []))
+} IN @@accounts
+`
+
+const removeSourceAccount = `
+LET inbound = (
+	FOR v, edge IN 1 INBOUND @source GRAPH @permissions
+	REMOVE edge IN @@ns2acc
+)
+REMOVE @source_key IN @@accounts
+`
+
+const redirectSourceAccount = `
+LET chained = (
+	FOR r IN @@redirects
+	FILTER r.target == @redirect._key
+	UPDATE r WITH { target: @redirect.target } IN @@redirects
+)
+INSERT @redirect IN @@redirects
+`
+
+// MergeAccounts moves everything from source to target and replaces source with redirect, all in one transaction.
+// Balance is read and converted within the transaction, so payments made meanwhile aren't lost.
+func MergeAccounts(ctx context.Context, db driver.Database, source, target string, convert BalanceConverter, redirect AccountRedirect) (*AccountMerge, error) {
+	// Write collections are locked per document, so billing of other accounts isn't blocked by merge
+	trCtx, commit, abort, err := BeginTransactionEx(ctx, db, driver.TransactionCollections{
+		Write: append([]string{
+			schema.ACCOUNTS_COL, schema.CREDENTIALS_COL, schema.ACC2CRED, schema.ACC2NS, schema.NS2ACC,
+			schema.PROMOCODES_COL, schema.ACCOUNT_REDIRECTS_COL, schema.BILLING_PROFILES_COL,
+		}, accountBoundCollections...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	merge, err := PlanAccountMerge(trCtx, db, source, target, convert)
+	if err != nil {
+		abort(trCtx)
+		return nil, err
+	}
+	if err = mergeAccounts(trCtx, db, merge, redirect); err != nil {
+		abort(trCtx)
+		return nil, err
+	}
+	if err = commit(trCtx); err != nil {
+		return nil, err
+	}
+	return merge, nil
+}
+
+func mergeAccounts(ctx context.Context, db driver.Database, merge *AccountMerge, redirect AccountRedirect) error {
+	sourceID := driver.NewDocumentID(schema.ACCOUNTS_COL, merge.Source)
+	targetID := driver.NewDocumentID(schema.ACCOUNTS_COL, merge.Target)
+
+	type credentialLink struct {
+		Key  string `json:"key"`
+		Type string `json:"type"`
+		Role string `json:"role"`
+		Drop bool   `json:"drop"`
+	}
+	links, err := queryAll[credentialLink](ctx, db, unlinkSourceCredentials, map[string]interface{}{
+		"source":            sourceID,
+		"dropped":           merge.DroppedCredentials,
+		"credentials_graph": schema.CREDENTIALS_GRAPH.Name,
+		"@cred_edges":       schema.ACC2CRED,
+	})
+	if err != nil {
+		return err
+	}
+	dropped := []string{}
+	moved := make([]credentialLink, 0, len(links))
+	for _, link := range links {
+		if link.Drop {
+			dropped = append(dropped, link.Key)
+		} else {
+			moved = append(moved, link)
+		}
+	}
+	if err = execQuery(ctx, db, removeCredentials, map[string]interface{}{
+		"keys":         dropped,
+		"@credentials": schema.CREDENTIALS_COL,
+	}); err != nil {
+		return err
+	}
+	if err = execQuery(ctx, db, linkTargetCredentials, map[string]interface{}{
+		"credentials":     moved,
+		"target":          targetID,
+		"target_key":      merge.Target,
+		"credentials_col": schema.CREDENTIALS_COL,
+		"@cred_edges":     schema.ACC2CRED,
+	}); err != nil {
+		return err
+	}
+
+	edges, err := queryAll[map[string]interface{}](ctx, db, unlinkSourceNamespaces, map[string]interface{}{
+		"source":      sourceID,
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"namespaces":  schema.NAMESPACES_COL,
+		"@acc2ns":     schema.ACC2NS,
+	})
+	if err != nil {
+		return err
+	}
+	if err = execQuery(ctx, db, linkTargetNamespaces, map[string]interface{}{
+		"edges":      edges,
+		"target":     targetID,
+		"target_key": merge.Target,
+		"namespaces": schema.NAMESPACES_COL,
+		"owner":      roles.OWNER,
+		"@acc2ns":    schema.ACC2NS,
+	}); err != nil {
+		return err
+	}
+
+	for _, col := range accountBoundCollections {
+		if err = execQuery(ctx, db, moveAccountBound, map[string]interface{}{
+			"source_key": merge.Source,
+			"target_key": merge.Target,
+			"@col":       col,
+		}); err != nil {
+			return err
+		}
+	}
+	if err = execQuery(ctx, db, moveBillingProfiles, map[string]interface{}{
+		"source_key": merge.Source,
+		"target_key": merge.Target,
+		"@col":       schema.BILLING_PROFILES_COL,
+	}); err != nil {
+		return err
+	}
+	if err = execQuery(ctx, db, movePromocodeUses, map[string]interface{}{
+		"source_key":  merge.Source,
+		"target_key":  merge.Target,
+		"@promocodes": schema.PROMOCODES_COL,
+	}); err != nil {
+		return err
+	}
+
+	if err = execQuery(ctx, db, mergeIntoTarget, map[string]interface{}{
+		"source":    sourceID,
+		"target":    targetID,
+		"balance":   merge.ConvertedBalance,
+		"@accounts": schema.ACCOUNTS_COL,
+	}); err != nil {
+		return err
+	}
+	if err = execQuery(ctx, db, removeSourceAccount, map[string]interface{}{
+		"source":      sourceID,
+		"source_key":  merge.Source,
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"@ns2acc":     schema.NS2ACC,
+		"@accounts":   schema.ACCOUNTS_COL,
+	}); err != nil {
+		return err
+	}
+
+	redirect.Source, redirect.Target = merge.Source, merge.Target
+	return execQuery(ctx, db, redirectSourceAccount, map[string]interface{}{
+		"redirect":   redirect,
+		"@redirects": schema.ACCOUNT_REDIRECTS_COL,
+	})
+}
+
+// ResolveAccountRedirect returns account source was merged into, if any
+func ResolveAccountRedirect(ctx context.Context, db driver.Database, source string) (string, bool) {
+	c, err := db.Query(ctx, "RETURN DOCUMENT(@@redirects, @key).target", map[string]interface{}{
+		"key":        source,
+		"@redirects": schema.ACCOUNT_REDIRECTS_COL,
+	})
+	if err != nil {
+		return "", false
+	}
+	defer c.Close()
+
+	var target *string
+	if _, err = c.ReadDocument(ctx, &target); err != nil || target == nil {
+		return "", false
+	}
+	return *target, true
+}
+
+func queryAll[T any](ctx context.Context, db driver.Database, query string, vars map[string]interface{}) ([]T, error) {
+	c, err := db.Query(ctx, query, vars)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	result := []T{}
+	for c.HasMore() {
+		var item T
+		if _, err := c.ReadDocument(ctx, &item); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+func execQuery(ctx context.Context, db driver.Database, query string, vars map[string]interface{}) error {
+	c, err := db.Query(ctx, query, vars)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
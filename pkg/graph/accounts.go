@@ -55,6 +55,8 @@ type AccountsController interface {
 	UpdateCredentials(ctx context.Context, cred string, c credentials.Credentials) (err error)
 	GetAccountOrOwnerAccountIfPresent(ctx context.Context, id string) (Account, error)
 	GetCredentials(ctx context.Context, edge_col driver.Collection, acc Account, auth_type string) (key string, has_credentials bool)
+	ListCredentials(ctx context.Context, acc Account) ([]CredentialsLink, error)
+	UnlinkCredentials(ctx context.Context, acc Account, auth_type string) error
 	Authorize(ctx context.Context, auth_type string, args ...string) (Account, bool)
 	EnsureRootExists(passwd string) (err error)
 	InvalidateBalanceEvents(ctx context.Context, acc string) error
@@ -438,9 +440,71 @@ func (ctrl *accountsController) GetCredentials(ctx context.Context, edge_col dri
 	return key, true
 }
 
+// CredentialsLink describes Credentials linked to Account without secret data
+type CredentialsLink struct {
+	Type       string `json:"type"`
+	Key        string `json:"key"`
+	Role       string `json:"role"`
+	Identifier string `json:"identifier,omitempty"`
+}
+
+const listAccountCredentials = `
+FOR cred, edge IN 1 OUTBOUND @account
+GRAPH @credentials_graph
+SORT edge.type
+RETURN {
+	type: edge.type,
+	key: cred._key,
+	role: edge.role,
+	identifier: NOT_NULL(cred.username, cred.email, cred.auth_value)
+}
+`
+
+func (ctrl *accountsController) ListCredentials(ctx context.Context, acc Account) ([]CredentialsLink, error) {
+	c, err := ctrl.col.Database().Query(ctx, listAccountCredentials, map[string]interface{}{
+		"account":           acc.ID,
+		"credentials_graph": schema.CREDENTIALS_GRAPH.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var result []CredentialsLink
+	for c.HasMore() {
+		var link CredentialsLink
+		if _, err := c.ReadDocument(ctx, &link); err != nil {
+			return nil, err
+		}
+		result = append(result, link)
+	}
+	return result, nil
+}
+
+// Remove Credentials of given type and it's link to Account
+func (ctrl *accountsController) UnlinkCredentials(ctx context.Context, acc Account, auth_type string) error {
+	edge_col, err := ctrl.col.Database().Collection(ctx, schema.ACC2CRED)
+	if err != nil {
+		return err
+	}
+
+	var edge credentials.Link
+	if _, err = edge_col.ReadDocument(ctx, auth_type+"-"+acc.Key, &edge); err != nil {
+		return err
+	}
+	if _, err = edge_col.RemoveDocument(ctx, edge.Key); err != nil {
+		return err
+	}
+	if _, err = ctrl.cred.RemoveDocument(ctx, edge.To.Key()); err != nil && !driver.IsNotFoundGeneral(err) {
+		return err
+	}
+	return nil
+}
+
 // Return Account authorisable by this Credentials
 func authorisable(ctx context.Context, cred *credentials.Credentials, db driver.Database) (Account, bool) {
-	query := `FOR account IN 1 INBOUND @credentials GRAPH @credentials_graph RETURN account`
+	// Accounts pending deletion can't log in
+	query := `FOR account IN 1 INBOUND @credentials GRAPH @credentials_graph FILTER account.deletion == null RETURN account`
 	c, err := db.Query(ctx, query, map[string]interface{}{
 		"credentials":       cred,
 		"credentials_graph": schema.CREDENTIALS_GRAPH.Name,
@@ -0,0 +1,265 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	pb "github.com/slntopp/nocloud-proto/billing"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const InvoiceBillingProfileKey = "billing_profile"
+
+// BillingProfile is named legal buyer of account, data holds same billing fields as account data
+// (company, address, city, postal_code, country, tax_id, phone, tax_id_validation, tax_rate)
+type BillingProfile struct {
+	Key     string                 `json:"_key,omitempty"`
+	Account string                 `json:"account"`
+	Title   string                 `json:"title"`
+	Default bool                   `json:"default"`
+	Data    map[string]interface{} `json:"data"`
+	// Preferred currency id, 0 means account currency
+	Currency int32 `json:"currency,omitempty"`
+	// Invoice email recipients, account email is used if empty
+	Emails []string `json:"emails"`
+	// Services and instances groups this profile is selected for
+	Services        []string `json:"services"`
+	InstancesGroups []string `json:"instances_groups"`
+	Created         int64    `json:"created"`
+	Updated         int64    `json:"updated"`
+}
+
+func (p *BillingProfile) TaxRate() float64 {
+	rate, _ := p.Data["tax_rate"].(float64)
+	return rate
+}
+
+func (p *BillingProfile) key() string {
+	if p == nil {
+		return ""
+	}
+	return p.Key
+}
+
+func CreateBillingProfile(ctx context.Context, db driver.Database, p *BillingProfile) (*BillingProfile, error) {
+	col, err := db.Collection(ctx, schema.BILLING_PROFILES_COL)
+	if err != nil {
+		return nil, err
+	}
+	p.Created = time.Now().Unix()
+	p.Updated = p.Created
+	if p.Services == nil {
+		p.Services = []string{}
+	}
+	if p.InstancesGroups == nil {
+		p.InstancesGroups = []string{}
+	}
+	meta, err := col.CreateDocument(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	p.Key = meta.Key
+	return p, nil
+}
+
+func GetBillingProfile(ctx context.Context, db driver.Database, key string) (*BillingProfile, error) {
+	col, err := db.Collection(ctx, schema.BILLING_PROFILES_COL)
+	if err != nil {
+		return nil, err
+	}
+	var p BillingProfile
+	if _, err := col.ReadDocument(ctx, key, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdateBillingProfile saves editable fields, selections are changed with SelectBillingProfile only
+func UpdateBillingProfile(ctx context.Context, db driver.Database, p *BillingProfile) error {
+	col, err := db.Collection(ctx, schema.BILLING_PROFILES_COL)
+	if err != nil {
+		return err
+	}
+	p.Updated = time.Now().Unix()
+	_, err = col.UpdateDocument(ctx, p.Key, map[string]interface{}{
+		"title":    p.Title,
+		"data":     p.Data,
+		"currency": p.Currency,
+		"emails":   p.Emails,
+		"updated":  p.Updated,
+	})
+	return err
+}
+
+func DeleteBillingProfile(ctx context.Context, db driver.Database, key string) error {
+	col, err := db.Collection(ctx, schema.BILLING_PROFILES_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.RemoveDocument(ctx, key)
+	return err
+}
+
+const listBillingProfiles = `
+FOR p IN @@col
+	FILTER p.account == @account
+	SORT p.default DESC, p.created ASC
+	RETURN p
+`
+
+func ListBillingProfiles(ctx context.Context, db driver.Database, account string) ([]BillingProfile, error) {
+	return queryAll[BillingProfile](ctx, db, listBillingProfiles, map[string]interface{}{
+		"@col":    schema.BILLING_PROFILES_COL,
+		"account": account,
+	})
+}
+
+const setDefaultBillingProfile = `
+FOR p IN @@col
+	FILTER p.account == @account
+	UPDATE p WITH { default: p._key == @key } IN @@col
+`
+
+// SetDefaultBillingProfile makes profile the only default of account, empty key unsets default
+func SetDefaultBillingProfile(ctx context.Context, db driver.Database, account, key string) error {
+	return execQuery(ctx, db, setDefaultBillingProfile, map[string]interface{}{
+		"@col":    schema.BILLING_PROFILES_COL,
+		"account": account,
+		"key":     key,
+	})
+}
+
+const selectBillingProfile = `
+FOR p IN @@col
+	FILTER p.account == @account
+	LET rest = REMOVE_VALUE(p[@field] || [], @target)
+	UPDATE p WITH { [@field]: p._key == @key ? PUSH(rest, @target) : rest } IN @@col
+`
+
+// SelectBillingProfile binds service or instances group to profile, empty key falls back to default profile
+func SelectBillingProfile(ctx context.Context, db driver.Database, account, key string, isGroup bool, target string) error {
+	field := "services"
+	if isGroup {
+		field = "instances_groups"
+	}
+	return execQuery(ctx, db, selectBillingProfile, map[string]interface{}{
+		"@col":    schema.BILLING_PROFILES_COL,
+		"account": account,
+		"key":     key,
+		"field":   field,
+		"target":  target,
+	})
+}
+
+const resolveBillingProfile = `
+LET ig = @instance == "" ? null : FIRST(
+	FOR g IN 1 INBOUND CONCAT(@instances, "/", @instance) @@ig2inst
+	RETURN g._key
+)
+LET srv = ig == null ? null : FIRST(
+	FOR s IN 1 INBOUND CONCAT(@groups, "/", ig) @@srv2ig
+	RETURN s._key
+)
+FOR p IN @@col
+	FILTER p.account == @account
+	LET rank = ig != null && ig IN p.instances_groups ? 0 : (srv != null && srv IN p.services ? 1 : (p.default ? 2 : 3))
+	FILTER rank < 3
+	SORT rank
+	LIMIT 1
+	RETURN p
+`
+
+// ResolveBillingProfile picks profile selected for instances group of instance, then for its service,
+// then account default one. If linked instances resolve to different profiles, account default one is used.
+// Returns nil if account has none of them
+func ResolveBillingProfile(ctx context.Context, db driver.Database, account string, instances []string) (*BillingProfile, error) {
+	if exists, err := db.CollectionExists(ctx, schema.BILLING_PROFILES_COL); err != nil || !exists {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return resolveBillingProfileFor(ctx, db, account, "")
+	}
+
+	var resolved *BillingProfile
+	for i, instance := range instances {
+		p, err := resolveBillingProfileFor(ctx, db, account, instance)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && p.key() != resolved.key() {
+			return resolveBillingProfileFor(ctx, db, account, "")
+		}
+		resolved = p
+	}
+	return resolved, nil
+}
+
+func resolveBillingProfileFor(ctx context.Context, db driver.Database, account, instance string) (*BillingProfile, error) {
+	res, err := queryAll[BillingProfile](ctx, db, resolveBillingProfile, map[string]interface{}{
+		"@col":      schema.BILLING_PROFILES_COL,
+		"@ig2inst":  schema.IG2INST,
+		"@srv2ig":   schema.SERV2IG,
+		"instances": schema.INSTANCES_COL,
+		"groups":    schema.INSTANCES_GROUPS_COL,
+		"account":   account,
+		"instance":  instance,
+	})
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return &res[0], nil
+}
+
+// SetInvoiceBillingProfile stores buyer snapshot on invoice, so later profile changes don't alter issued invoices
+func SetInvoiceBillingProfile(inv *pb.Invoice, p *BillingProfile) {
+	if inv.Meta == nil {
+		inv.Meta = make(map[string]*structpb.Value)
+	}
+	if p == nil {
+		delete(inv.Meta, InvoiceBillingProfileKey)
+		return
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"uuid":   p.Key,
+		"title":  p.Title,
+		"data":   p.Data,
+		"emails": p.Emails,
+	})
+	if err != nil {
+		return
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	s, err := structpb.NewStruct(m)
+	if err != nil {
+		return
+	}
+	inv.Meta[InvoiceBillingProfileKey] = structpb.NewStructValue(s)
+}
+
+// InvoiceBillingProfile returns buyer snapshot stored on invoice, nil if invoice was issued to account data
+func InvoiceBillingProfile(inv *pb.Invoice) *BillingProfile {
+	s := inv.GetMeta()[InvoiceBillingProfileKey].GetStructValue()
+	if s == nil {
+		return nil
+	}
+	b, err := json.Marshal(s.AsMap())
+	if err != nil {
+		return nil
+	}
+	var snapshot struct {
+		Uuid   string                 `json:"uuid"`
+		Title  string                 `json:"title"`
+		Data   map[string]interface{} `json:"data"`
+		Emails []string               `json:"emails"`
+	}
+	if err = json.Unmarshal(b, &snapshot); err != nil {
+		return nil
+	}
+	return &BillingProfile{Key: snapshot.Uuid, Title: snapshot.Title, Data: snapshot.Data, Emails: snapshot.Emails}
+}
@@ -0,0 +1,103 @@
+package graph
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	pb "github.com/slntopp/nocloud-proto/billing"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// Cursor returning given profile, or nothing if it's nil
+func profileCursor(t *testing.T, p *BillingProfile) *driver_mocks.MockCursor {
+	cursor := driver_mocks.NewMockCursor(t)
+	if p != nil {
+		cursor.EXPECT().HasMore().Return(true).Once()
+		cursor.EXPECT().ReadDocument(mock.Anything, mock.Anything).Run(func(_ context.Context, result interface{}) {
+			*result.(*BillingProfile) = *p
+		}).Return(driver.DocumentMeta{}, nil).Once()
+	}
+	cursor.EXPECT().HasMore().Return(false).Once()
+	cursor.EXPECT().Close().Return(nil)
+	return cursor
+}
+
+func expectResolve(db *driver_mocks.MockDatabase, t *testing.T, instance string, p *BillingProfile) {
+	db.EXPECT().Query(mock.Anything, resolveBillingProfile, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["instance"] == instance
+	})).Return(profileCursor(t, p), nil).Once()
+}
+
+func TestResolveBillingProfile(t *testing.T) {
+	ctx := context.Background()
+	company := &BillingProfile{Key: "company"}
+	personal := &BillingProfile{Key: "personal", Default: true}
+
+	t.Run("same profile for every instance", func(t *testing.T) {
+		db := driver_mocks.NewMockDatabase(t)
+		db.EXPECT().CollectionExists(mock.Anything, schema.BILLING_PROFILES_COL).Return(true, nil)
+		expectResolve(db, t, "a", company)
+		expectResolve(db, t, "b", company)
+
+		p, err := ResolveBillingProfile(ctx, db, "acc", []string{"a", "b"})
+		require.NoError(t, err)
+		assert.Equal(t, "company", p.Key)
+	})
+
+	t.Run("instances resolve to different profiles", func(t *testing.T) {
+		db := driver_mocks.NewMockDatabase(t)
+		db.EXPECT().CollectionExists(mock.Anything, schema.BILLING_PROFILES_COL).Return(true, nil)
+		expectResolve(db, t, "a", company)
+		expectResolve(db, t, "b", personal)
+		expectResolve(db, t, "", personal)
+
+		p, err := ResolveBillingProfile(ctx, db, "acc", []string{"a", "b"})
+		require.NoError(t, err)
+		assert.Equal(t, "personal", p.Key)
+	})
+
+	t.Run("only some instances have profile", func(t *testing.T) {
+		db := driver_mocks.NewMockDatabase(t)
+		db.EXPECT().CollectionExists(mock.Anything, schema.BILLING_PROFILES_COL).Return(true, nil)
+		expectResolve(db, t, "a", nil)
+		expectResolve(db, t, "b", company)
+		expectResolve(db, t, "", nil)
+
+		p, err := ResolveBillingProfile(ctx, db, "acc", []string{"a", "b"})
+		require.NoError(t, err)
+		assert.Nil(t, p)
+	})
+
+	t.Run("no collection", func(t *testing.T) {
+		db := driver_mocks.NewMockDatabase(t)
+		db.EXPECT().CollectionExists(mock.Anything, schema.BILLING_PROFILES_COL).Return(false, nil)
+
+		p, err := ResolveBillingProfile(ctx, db, "acc", []string{"a"})
+		require.NoError(t, err)
+		assert.Nil(t, p)
+	})
+}
+
+func TestInvoiceBillingProfileSnapshot(t *testing.T) {
+	inv := &pb.Invoice{}
+	SetInvoiceBillingProfile(inv, &BillingProfile{
+		Key:    "company",
+		Title:  "Company",
+		Data:   map[string]interface{}{"company": "ACME", "tax_rate": 0.2},
+		Emails: []string{"billing@acme.test"},
+	})
+
+	p := InvoiceBillingProfile(inv)
+	require.NotNil(t, p)
+	assert.Equal(t, "company", p.Key)
+	assert.Equal(t, "ACME", p.Data["company"])
+	assert.Equal(t, []string{"billing@acme.test"}, p.Emails)
+
+	SetInvoiceBillingProfile(inv, nil)
+	assert.Nil(t, InvoiceBillingProfile(inv))
+}
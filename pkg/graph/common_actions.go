@@ -4,8 +4,11 @@ import (
 	"context"
 	"github.com/arangodb/go-driver"
 	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/nocloud"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type CommonActionsController interface {
@@ -13,6 +16,15 @@ type CommonActionsController interface {
 	AccessLevel(ctx context.Context, account string, node driver.DocumentID) (bool, access.Level)
 }
 
+// CheckRootAccess returns requester if it has at least given access level to root namespace, PermissionDenied error otherwise
+func CheckRootAccess(ctx context.Context, ca CommonActionsController, level access.Level) (string, error) {
+	requester, _ := ctx.Value(nocloud.NoCloudAccount).(string)
+	if !ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), level) {
+		return requester, status.Error(codes.PermissionDenied, "Not enough access rights")
+	}
+	return requester, nil
+}
+
 type Access struct {
 	From  driver.DocumentID `json:"_from"`
 	To    driver.DocumentID `json:"_to"`
@@ -0,0 +1,249 @@
+package graph
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arangodb/go-driver"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+var (
+	ErrPendingDeletion    = errors.New("already pending deletion")
+	ErrNotPendingDeletion = errors.New("not pending deletion")
+)
+
+// PendingDeletion is stored as deletion field of account or namespace document while grace period lasts
+type PendingDeletion struct {
+	RequestedAt int64  `json:"requested_at"`
+	RequestedBy string `json:"requested_by"`
+	PurgeAt     int64  `json:"purge_at"`
+	// Services suspended on deletion request, unsuspended back on restore
+	Services []string `json:"services,omitempty"`
+	// Account was already suspended before deletion request, so restore keeps it suspended
+	WasSuspended bool `json:"was_suspended,omitempty"`
+	// Set when purge anonymized the document instead of removing it
+	Purged int64 `json:"purged,omitempty"`
+}
+
+// DeletionRecord is kept in DeletionRecords after purge
+type DeletionRecord struct {
+	Entity      string `json:"entity"`
+	Uuid        string `json:"uuid"`
+	Title       string `json:"title"`
+	RequestedAt int64  `json:"requested_at"`
+	RequestedBy string `json:"requested_by"`
+	Purged      int64  `json:"purged"`
+	Mode        string `json:"mode"` // deleted or erased
+	// Removed documents IDs when deleted
+	Removed []string `json:"removed,omitempty"`
+	// What was anonymized when erased
+	Erasure *ErasureReport `json:"erasure,omitempty"`
+}
+
+const listOwnedServices = `
+FOR node, edge, path IN 1..2 OUTBOUND @from
+	GRAPH @permissions
+	FILTER path.edges[*].role ALL == @owner
+	FILTER IS_SAME_COLLECTION(@@services, node)
+	FILTER node.status NOT IN @skip
+	RETURN node._key
+`
+
+// ListOwnedActiveServices lists services owned by account or namespace which aren't suspended or deleted yet
+func ListOwnedActiveServices(ctx context.Context, db driver.Database, id driver.DocumentID) ([]string, error) {
+	return listOwnedServicesExcept(ctx, db, id, statuspb.NoCloudStatus_SUS, statuspb.NoCloudStatus_DEL)
+}
+
+// ListOwnedServices lists services owned by account or namespace which aren't deleted yet
+func ListOwnedServices(ctx context.Context, db driver.Database, id driver.DocumentID) ([]string, error) {
+	return listOwnedServicesExcept(ctx, db, id, statuspb.NoCloudStatus_DEL)
+}
+
+func listOwnedServicesExcept(ctx context.Context, db driver.Database, id driver.DocumentID, skip ...statuspb.NoCloudStatus) ([]string, error) {
+	c, err := db.Query(ctx, listOwnedServices, map[string]interface{}{
+		"from":        id,
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"owner":       roles.OWNER,
+		"skip":        skip,
+		"@services":   schema.SERVICES_COL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var services []string
+	for c.HasMore() {
+		var key string
+		if _, err := c.ReadDocument(ctx, &key); err != nil {
+			return nil, err
+		}
+		services = append(services, key)
+	}
+	return services, nil
+}
+
+const markForDeletion = `
+FOR n IN @@col
+	FILTER n._key == @key AND n.deletion == null
+	UPDATE n WITH { deletion: @deletion } IN @@col
+	RETURN 1
+`
+
+// MarkForDeletion sets deletion field, fails with ErrPendingDeletion if it's already set
+func MarkForDeletion(ctx context.Context, db driver.Database, id driver.DocumentID, deletion *PendingDeletion) error {
+	c, err := db.Query(ctx, markForDeletion, map[string]interface{}{
+		"key":      id.Key(),
+		"deletion": deletion,
+		"@col":     id.Collection(),
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !c.HasMore() {
+		return ErrPendingDeletion
+	}
+	return nil
+}
+
+// GetPendingDeletion returns nil if entity isn't pending deletion
+func GetPendingDeletion(ctx context.Context, db driver.Database, id driver.DocumentID) (*PendingDeletion, error) {
+	c, err := db.Query(ctx, "RETURN DOCUMENT(@id).deletion", map[string]interface{}{
+		"id": id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var deletion *PendingDeletion
+	if _, err = c.ReadDocument(ctx, &deletion); err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
+
+const clearDeletion = `
+FOR n IN @@col
+	FILTER n._key == @key AND n.deletion != null AND NOT n.deletion.purged
+	UPDATE n WITH { deletion: null } IN @@col OPTIONS { keepNull: false }
+	RETURN OLD.deletion
+`
+
+// ClearDeletion removes deletion mark and returns it, fails with ErrNotPendingDeletion if entity isn't pending or is already purged
+func ClearDeletion(ctx context.Context, db driver.Database, id driver.DocumentID) (*PendingDeletion, error) {
+	c, err := db.Query(ctx, clearDeletion, map[string]interface{}{
+		"key":  id.Key(),
+		"@col": id.Collection(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if !c.HasMore() {
+		return nil, ErrNotPendingDeletion
+	}
+
+	var deletion PendingDeletion
+	if _, err = c.ReadDocument(ctx, &deletion); err != nil {
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+const listDueForPurge = `
+FOR n IN @@col
+	FILTER n.deletion != null AND NOT n.deletion.purged AND n.deletion.purge_at <= @now
+	RETURN n._key
+`
+
+// ListDueForPurge lists keys of entities which grace period is over
+func ListDueForPurge(ctx context.Context, db driver.Database, col string, now int64) ([]string, error) {
+	c, err := db.Query(ctx, listDueForPurge, map[string]interface{}{
+		"now":  now,
+		"@col": col,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var keys []string
+	for c.HasMore() {
+		var key string
+		if _, err := c.ReadDocument(ctx, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+const claimPurge = `
+FOR n IN @@col
+	FILTER n._key == @key AND n.deletion != null AND NOT n.deletion.purged AND n.deletion.purge_at == @purge_at
+	UPDATE n WITH { deletion: { purge_at: @lease } } IN @@col
+	RETURN 1
+`
+
+// ClaimPurge atomically moves purge_at forward to lease, so only one replica purges the entity
+// Returns false if entity was restored or claimed by someone else since purgeAt was read. If purge fails, it's retried once lease is over
+func ClaimPurge(ctx context.Context, db driver.Database, id driver.DocumentID, purgeAt, lease int64) (bool, error) {
+	c, err := db.Query(ctx, claimPurge, map[string]interface{}{
+		"key":      id.Key(),
+		"purge_at": purgeAt,
+		"lease":    lease,
+		"@col":     id.Collection(),
+	})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	return c.HasMore(), nil
+}
+
+// SetPurged marks deletion as done for documents which are retained anonymized
+func SetPurged(ctx context.Context, db driver.Database, id driver.DocumentID, now int64) error {
+	c, err := db.Query(ctx, "UPDATE @key WITH { deletion: { purged: @now } } IN @@col", map[string]interface{}{
+		"key":  id.Key(),
+		"now":  now,
+		"@col": id.Collection(),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// PurgeRecursive deletes entity with everything it owns and returns IDs of removed documents
+func PurgeRecursive(ctx context.Context, db driver.Database, id driver.DocumentID) ([]string, error) {
+	nodes, err := listOwnedDeep(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = deleteRecursive(ctx, db, id); err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, 0, len(nodes.Nodes))
+	for _, node := range nodes.Nodes {
+		if node.Node != "" {
+			removed = append(removed, node.Node)
+		}
+	}
+	return removed, nil
+}
+
+// RecordDeletion stores what was removed by purge, DeletionRecords collection must exist
+func RecordDeletion(ctx context.Context, db driver.Database, rec *DeletionRecord) error {
+	col, err := db.Collection(ctx, schema.DELETION_RECORDS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.CreateDocument(ctx, rec)
+	return err
+}
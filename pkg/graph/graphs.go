@@ -521,6 +521,7 @@ func listAccounts[T Accessible](
 	var insert string
 	var accountGroupUuids []interface{}
 	var noGroup bool
+	var pendingDeletion bool
 
 	if field != "" && sort != "" {
 		if field == "data.date_create" {
@@ -582,6 +583,8 @@ func listAccounts[T Accessible](
 			bindVars["statuses"] = values
 		} else if key == "no_group" {
 			noGroup = val.GetBoolValue()
+		} else if key == "pending_deletion" {
+			pendingDeletion = val.GetBoolValue()
 		} else if key == "account_groups" {
 			accountGroupUuids = val.GetListValue().AsSlice()
 		} else if key == "currency" {
@@ -624,6 +627,8 @@ func listAccounts[T Accessible](
 		insert += ` FILTER ` + strings.Join(conditions, ` || `)
 	}
 
+	insert += deletionFilter(pendingDeletion)
+
 	q := fmt.Sprintf(listAccountsQuery, insert)
 	c, err := db.Query(ctx, q, bindVars)
 	if err != nil {
@@ -661,6 +666,7 @@ func listNamespaces[T Accessible](
 	}
 
 	var insert string
+	var pendingDeletion bool
 
 	if field != "" && sort != "" {
 		insert += fmt.Sprintf("SORT node.%s %s\n", field, sort)
@@ -680,8 +686,11 @@ func listNamespaces[T Accessible](
 			account := val.GetStringValue()
 			insert += ` FILTER path.vertices[-2]._key == @account`
 			bindVars["account"] = account
+		} else if key == "pending_deletion" {
+			pendingDeletion = val.GetBoolValue()
 		}
 	}
+	insert += deletionFilter(pendingDeletion)
 
 	log.Debug("ListWithAccess", zap.Any("vars", bindVars))
 	q := fmt.Sprintf(listObjectsWithFiltersOfKind, insert)
@@ -699,6 +708,14 @@ func listNamespaces[T Accessible](
 	return &result, nil
 }
 
+// Entities pending deletion are hidden unless explicitly requested
+func deletionFilter(pending bool) string {
+	if pending {
+		return ` FILTER node.deletion != null AND NOT node.deletion.purged`
+	}
+	return ` FILTER node.deletion == null`
+}
+
 func ensure[T any](p **T) {
 	if *p == nil {
 		*p = new(T)
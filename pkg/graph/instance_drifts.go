@@ -0,0 +1,197 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/arangodb/go-driver"
+	statepb "github.com/slntopp/nocloud-proto/states"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/nocloud/drift"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+// InstanceDrift is difference between stored instance and what its provider reports, kept while it's observed
+type InstanceDrift struct {
+	Key      string `json:"_key,omitempty"`
+	Instance string `json:"instance"`
+	Title    string `json:"title"`
+	Sp       string `json:"sp"`
+	drift.Difference
+
+	FirstSeen int64 `json:"first_seen"`
+	LastSeen  int64 `json:"last_seen"`
+	// Set once difference is no longer observed
+	Resolved int64 `json:"resolved"`
+
+	Corrected       int64  `json:"corrected,omitempty"`
+	CorrectedBy     string `json:"corrected_by,omitempty"`
+	CorrectionError string `json:"correction_error,omitempty"`
+}
+
+func InstanceDriftKey(instance string, d drift.Difference) string {
+	if d.Field != "" {
+		return instance + "-" + string(d.Kind) + "-" + d.Field
+	}
+	return instance + "-" + string(d.Kind)
+}
+
+const listDriftCandidates = `
+FOR group IN 1 INBOUND @sp
+GRAPH @permissions
+FILTER IS_SAME_COLLECTION(@groups, group)
+	FOR inst IN 1 OUTBOUND group
+	GRAPH @permissions
+	FILTER IS_SAME_COLLECTION(@instances, inst)
+	FILTER inst.status != @deleted || (inst.state != null && inst.state.state NOT IN [@state_deleted, @state_unknown])
+	RETURN {
+		uuid: inst._key, title: inst.title, status: inst.status,
+		state: inst.state.state, meta: inst.state.meta, resources: inst.resources
+	}
+`
+
+// DriftCandidate is instance as stored next to state last reported by driver
+type DriftCandidate struct {
+	Uuid      string                 `json:"uuid"`
+	Title     string                 `json:"title"`
+	Status    statuspb.NoCloudStatus `json:"status"`
+	State     statepb.NoCloudState   `json:"state"`
+	Meta      map[string]interface{} `json:"meta"`
+	Resources map[string]interface{} `json:"resources"`
+}
+
+// ListDriftCandidates returns instances of services provider, deleted ones only while driver still reports them
+func ListDriftCandidates(ctx context.Context, db driver.Database, sp string) ([]DriftCandidate, error) {
+	return queryAll[DriftCandidate](ctx, db, listDriftCandidates, map[string]interface{}{
+		"sp":            driver.NewDocumentID(schema.SERVICES_PROVIDERS_COL, sp),
+		"permissions":   schema.PERMISSIONS_GRAPH.Name,
+		"groups":        schema.INSTANCES_GROUPS_COL,
+		"instances":     schema.INSTANCES_COL,
+		"deleted":       statuspb.NoCloudStatus_DEL,
+		"state_deleted": statepb.NoCloudState_DELETED,
+		"state_unknown": statepb.NoCloudState_UNKNOWN,
+	})
+}
+
+const upsertInstanceDrift = `
+UPSERT { _key: @key }
+INSERT MERGE(@drift, { _key: @key, first_seen: @now, last_seen: @now, resolved: 0 })
+UPDATE MERGE(@drift, {
+	last_seen: @now, resolved: 0,
+	first_seen: OLD.resolved > 0 ? @now : OLD.first_seen,
+	corrected: OLD.resolved > 0 ? 0 : OLD.corrected,
+	correction_error: OLD.resolved > 0 ? "" : OLD.correction_error
+})
+IN @@col
+RETURN { drift: NEW, new: OLD == null || OLD.resolved > 0 }
+`
+
+type observedDrift struct {
+	Drift InstanceDrift `json:"drift"`
+	New   bool          `json:"new"`
+}
+
+// ObserveInstanceDrift stores difference seen at now, reports whether it wasn't open before
+func ObserveInstanceDrift(ctx context.Context, db driver.Database, d *InstanceDrift, now int64) (*InstanceDrift, bool, error) {
+	res, err := queryAll[observedDrift](ctx, db, upsertInstanceDrift, map[string]interface{}{
+		"@col": schema.INSTANCE_DRIFTS_COL,
+		"key":  InstanceDriftKey(d.Instance, d.Difference),
+		"drift": map[string]interface{}{
+			"instance": d.Instance,
+			"title":    d.Title,
+			"sp":       d.Sp,
+			"kind":     d.Kind,
+			"severity": d.Severity,
+			"field":    d.Field,
+			"expected": d.Expected,
+			"actual":   d.Actual,
+		},
+		"now": now,
+	})
+	if err != nil || len(res) == 0 {
+		return nil, false, err
+	}
+	return &res[0].Drift, res[0].New, nil
+}
+
+const resolveInstanceDrifts = `
+FOR d IN @@col
+	FILTER d.sp == @sp && d.resolved == 0 && d.last_seen < @since
+	UPDATE d WITH { resolved: @now } IN @@col
+	RETURN NEW
+`
+
+// ResolveInstanceDrifts closes open drifts of services provider not observed since given time
+func ResolveInstanceDrifts(ctx context.Context, db driver.Database, sp string, since, now int64) ([]InstanceDrift, error) {
+	return queryAll[InstanceDrift](ctx, db, resolveInstanceDrifts, map[string]interface{}{
+		"@col":  schema.INSTANCE_DRIFTS_COL,
+		"sp":    sp,
+		"since": since,
+		"now":   now,
+	})
+}
+
+func GetInstanceDrift(ctx context.Context, db driver.Database, key string) (*InstanceDrift, error) {
+	col, err := db.Collection(ctx, schema.INSTANCE_DRIFTS_COL)
+	if err != nil {
+		return nil, err
+	}
+	var d InstanceDrift
+	if _, err := col.ReadDocument(ctx, key, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func UpdateInstanceDrift(ctx context.Context, db driver.Database, d *InstanceDrift) error {
+	col, err := db.Collection(ctx, schema.INSTANCE_DRIFTS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.ReplaceDocument(ctx, d.Key, d)
+	return err
+}
+
+type InstanceDriftsFilter struct {
+	Sp       string
+	Instance string
+	Kind     string
+	// Include resolved drifts
+	All   bool
+	Limit int
+}
+
+const listInstanceDrifts = `
+FOR d IN @@col
+	FILTER @sp == "" || d.sp == @sp
+	FILTER @instance == "" || d.instance == @instance
+	FILTER @kind == "" || d.kind == @kind
+	FILTER @all || d.resolved == 0
+	SORT d.last_seen DESC
+	LIMIT @limit
+	RETURN d
+`
+
+func ListInstanceDrifts(ctx context.Context, db driver.Database, f InstanceDriftsFilter) ([]InstanceDrift, error) {
+	return queryAll[InstanceDrift](ctx, db, listInstanceDrifts, map[string]interface{}{
+		"@col":     schema.INSTANCE_DRIFTS_COL,
+		"sp":       f.Sp,
+		"instance": f.Instance,
+		"kind":     f.Kind,
+		"all":      f.All,
+		"limit":    f.Limit,
+	})
+}
+
+const pruneInstanceDrifts = `
+FOR d IN @@col
+	FILTER d.resolved > 0 && d.resolved < @before
+	REMOVE d IN @@col
+`
+
+// PruneInstanceDrifts removes drifts resolved before given time
+func PruneInstanceDrifts(ctx context.Context, db driver.Database, before int64) error {
+	return execQuery(ctx, db, pruneInstanceDrifts, map[string]interface{}{
+		"@col":   schema.INSTANCE_DRIFTS_COL,
+		"before": before,
+	})
+}
@@ -0,0 +1,92 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud/pkg/nocloud/placeholders"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+// InstanceTemplate is saved instance configuration, owned by account or namespace
+type InstanceTemplate struct {
+	Key         string `json:"_key,omitempty"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	// Accounts/<key> or Namespaces/<key>
+	Owner string `json:"owner"`
+	// Instance as JSON with proto field names: title, config, resources, product, addons and billing_plan uuid
+	Instance map[string]interface{} `json:"instance"`
+	Params   []placeholders.Param   `json:"params,omitempty"`
+	// Instance template was made from, if any
+	Source string `json:"source,omitempty"`
+
+	CreatedBy string `json:"created_by"`
+	Created   int64  `json:"created"`
+	Updated   int64  `json:"updated"`
+}
+
+func CreateInstanceTemplate(ctx context.Context, db driver.Database, tmpl *InstanceTemplate) (*InstanceTemplate, error) {
+	col, err := db.Collection(ctx, schema.INSTANCE_TEMPLATES_COL)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := col.CreateDocument(ctx, tmpl)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Key = meta.Key
+	return tmpl, nil
+}
+
+func GetInstanceTemplate(ctx context.Context, db driver.Database, key string) (*InstanceTemplate, error) {
+	col, err := db.Collection(ctx, schema.INSTANCE_TEMPLATES_COL)
+	if err != nil {
+		return nil, err
+	}
+	var tmpl InstanceTemplate
+	if _, err := col.ReadDocument(ctx, key, &tmpl); err != nil {
+		return nil, err
+	}
+	return &tmpl, nil
+}
+
+func UpdateInstanceTemplate(ctx context.Context, db driver.Database, tmpl *InstanceTemplate) error {
+	col, err := db.Collection(ctx, schema.INSTANCE_TEMPLATES_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.ReplaceDocument(ctx, tmpl.Key, tmpl)
+	return err
+}
+
+func DeleteInstanceTemplate(ctx context.Context, db driver.Database, key string) error {
+	col, err := db.Collection(ctx, schema.INSTANCE_TEMPLATES_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.RemoveDocument(ctx, key)
+	return err
+}
+
+const listInstanceTemplates = `
+LET namespaces = (
+	FOR node, edge IN 1 OUTBOUND @account GRAPH @permissions
+		FILTER IS_SAME_COLLECTION(@namespaces, node)
+		RETURN node._id
+)
+FOR t IN @@col
+	FILTER t.owner == @account || t.owner IN namespaces
+	SORT t.title ASC
+	RETURN t
+`
+
+// ListInstanceTemplates returns templates of account and of namespaces account is directly linked to
+func ListInstanceTemplates(ctx context.Context, db driver.Database, account driver.DocumentID) ([]InstanceTemplate, error) {
+	return queryAll[InstanceTemplate](ctx, db, listInstanceTemplates, map[string]interface{}{
+		"@col":        schema.INSTANCE_TEMPLATES_COL,
+		"account":     account,
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"namespaces":  schema.NAMESPACES_COL,
+	})
+}
@@ -0,0 +1,268 @@
+package graph
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arangodb/go-driver"
+	promopb "github.com/slntopp/nocloud-proto/billing/promocodes"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+const (
+	TransferPending = "pending"
+	// Accept is in progress, request can't be accepted, rejected or canceled meanwhile
+	TransferProcessing = "processing"
+	TransferAccepted   = "accepted"
+	TransferRejected   = "rejected"
+	TransferCanceled   = "canceled"
+	TransferExpired    = "expired"
+)
+
+const (
+	// Unpaid invoices of instance are moved to recipient
+	TransferInvoicesReassign = "reassign"
+	// Sender must pay invoices of instance before recipient can accept
+	TransferInvoicesSettle = "settle"
+)
+
+var ErrTransferNotPending = errors.New("transfer request is not pending")
+
+// InstanceTransfer is request to hand instance over to other account, made by sender and accepted by recipient
+type InstanceTransfer struct {
+	Key           string `json:"_key,omitempty"`
+	Instance      string `json:"instance"`
+	InstanceTitle string `json:"instance_title"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Invoices      string `json:"invoices"`
+	Comment       string `json:"comment,omitempty"`
+	Status        string `json:"status"`
+	// Last failed accept attempt
+	Error string `json:"error,omitempty"`
+
+	// Filled on accept
+	Addons              []string `json:"addons,omitempty"`
+	TransferredInvoices []string `json:"transferred_invoices,omitempty"`
+	PromocodesKept      []string `json:"promocodes_kept,omitempty"`
+	PromocodesDropped   []string `json:"promocodes_dropped,omitempty"`
+
+	CreatedBy  string `json:"created_by"`
+	Created    int64  `json:"created"`
+	Expires    int64  `json:"expires"`
+	ResolvedBy string `json:"resolved_by,omitempty"`
+	Resolved   int64  `json:"resolved,omitempty"`
+}
+
+func CreateInstanceTransfer(ctx context.Context, db driver.Database, tr *InstanceTransfer) (*InstanceTransfer, error) {
+	col, err := db.Collection(ctx, schema.INSTANCE_TRANSFERS_COL)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := col.CreateDocument(ctx, tr)
+	if err != nil {
+		return nil, err
+	}
+	tr.Key = meta.Key
+	return tr, nil
+}
+
+func GetInstanceTransfer(ctx context.Context, db driver.Database, key string) (*InstanceTransfer, error) {
+	col, err := db.Collection(ctx, schema.INSTANCE_TRANSFERS_COL)
+	if err != nil {
+		return nil, err
+	}
+	var tr InstanceTransfer
+	if _, err := col.ReadDocument(ctx, key, &tr); err != nil {
+		return nil, err
+	}
+	return &tr, nil
+}
+
+func UpdateInstanceTransfer(ctx context.Context, db driver.Database, tr *InstanceTransfer) error {
+	col, err := db.Collection(ctx, schema.INSTANCE_TRANSFERS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.ReplaceDocument(ctx, tr.Key, tr)
+	return err
+}
+
+const setInstanceTransferStatus = `
+FOR t IN @@col
+	FILTER t._key == @key && t.status == @from
+	UPDATE t WITH { status: @to, resolved_by: @by, resolved: @now } IN @@col
+	RETURN NEW
+`
+
+// SetInstanceTransferStatus moves request from one status to another, fails with ErrTransferNotPending if it's not in from status anymore
+func SetInstanceTransferStatus(ctx context.Context, db driver.Database, key, from, to, by string, now int64) (*InstanceTransfer, error) {
+	res, err := queryAll[InstanceTransfer](ctx, db, setInstanceTransferStatus, map[string]interface{}{
+		"@col": schema.INSTANCE_TRANSFERS_COL,
+		"key":  key,
+		"from": from,
+		"to":   to,
+		"by":   by,
+		"now":  now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrTransferNotPending
+	}
+	return &res[0], nil
+}
+
+const listInstanceTransfers = `
+FOR t IN @@col
+	FILTER t.from == @account || t.to == @account
+	FILTER @status == "" || t.status == @status
+	SORT t.created DESC
+	RETURN t
+`
+
+// ListInstanceTransfers returns requests account sent or received
+func ListInstanceTransfers(ctx context.Context, db driver.Database, account, status string) ([]InstanceTransfer, error) {
+	return queryAll[InstanceTransfer](ctx, db, listInstanceTransfers, map[string]interface{}{
+		"@col":    schema.INSTANCE_TRANSFERS_COL,
+		"account": account,
+		"status":  status,
+	})
+}
+
+const pendingTransfersOfInstance = `
+FOR t IN @@col
+	FILTER t.instance == @instance && t.status IN [@pending, @processing]
+	RETURN t
+`
+
+func PendingTransfersOfInstance(ctx context.Context, db driver.Database, instance string) ([]InstanceTransfer, error) {
+	return queryAll[InstanceTransfer](ctx, db, pendingTransfersOfInstance, map[string]interface{}{
+		"@col":       schema.INSTANCE_TRANSFERS_COL,
+		"instance":   instance,
+		"pending":    TransferPending,
+		"processing": TransferProcessing,
+	})
+}
+
+const expireInstanceTransfers = `
+FOR t IN @@col
+	FILTER t.status == @pending && t.expires <= @now
+	UPDATE t WITH { status: @expired, resolved: @now } IN @@col
+	RETURN NEW
+`
+
+// ExpireInstanceTransfers marks pending requests past their expiry as expired and returns them
+func ExpireInstanceTransfers(ctx context.Context, db driver.Database, now int64) ([]InstanceTransfer, error) {
+	return queryAll[InstanceTransfer](ctx, db, expireInstanceTransfers, map[string]interface{}{
+		"@col":    schema.INSTANCE_TRANSFERS_COL,
+		"pending": TransferPending,
+		"expired": TransferExpired,
+		"now":     now,
+	})
+}
+
+const staleInstanceTransfers = `
+FOR t IN @@col
+	FILTER t.status == @processing && t.resolved <= @before
+	RETURN t
+`
+
+// StaleInstanceTransfers returns requests stuck in processing since before, accept which started them has died
+func StaleInstanceTransfers(ctx context.Context, db driver.Database, before int64) ([]InstanceTransfer, error) {
+	return queryAll[InstanceTransfer](ctx, db, staleInstanceTransfers, map[string]interface{}{
+		"@col":       schema.INSTANCE_TRANSFERS_COL,
+		"processing": TransferProcessing,
+		"before":     before,
+	})
+}
+
+const recoverInstanceTransfer = `
+FOR t IN @@col
+	FILTER t._key == @key && t.status == @processing && t.resolved == @since
+	UPDATE t WITH {
+		status: @to, error: @error,
+		resolved_by: @to == @pending ? null : t.resolved_by,
+		resolved: @to == @pending ? null : @now
+	} IN @@col OPTIONS { keepNull: false }
+	RETURN NEW
+`
+
+// RecoverInstanceTransfer moves stale request out of processing, fails with ErrTransferNotPending if it was touched meanwhile.
+// Request returned to pending gets resolution reset
+func RecoverInstanceTransfer(ctx context.Context, db driver.Database, tr *InstanceTransfer, to, reason string, now int64) (*InstanceTransfer, error) {
+	res, err := queryAll[InstanceTransfer](ctx, db, recoverInstanceTransfer, map[string]interface{}{
+		"@col":       schema.INSTANCE_TRANSFERS_COL,
+		"key":        tr.Key,
+		"processing": TransferProcessing,
+		"pending":    TransferPending,
+		"since":      tr.Resolved,
+		"to":         to,
+		"error":      reason,
+		"now":        now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrTransferNotPending
+	}
+	return &res[0], nil
+}
+
+const rebindInstancePromocodes = `
+FOR p IN @@promos
+	FILTER IS_ARRAY(p.uses) && LENGTH(p.uses[* FILTER CURRENT.instance == @instance]) > 0
+	LET others = LENGTH(p.uses[* FILTER CURRENT.account == @account && CURRENT.instance != @instance])
+	LET keep = p.status NOT IN @inactive && (p.uses_per_user == null || p.uses_per_user <= 0 || others < p.uses_per_user)
+	LET uses = keep
+		? (FOR u IN p.uses RETURN u.instance == @instance ? MERGE(u, { account: @account }) : u)
+		: p.uses[* FILTER CURRENT.instance != @instance]
+	UPDATE p WITH { uses: uses } IN @@promos
+	RETURN { code: p.code, kept: keep }
+`
+
+// RebindInstancePromocodes moves promocode uses of instance to account.
+// Uses of inactive promocodes and ones account already used up to per user limit are dropped
+func RebindInstancePromocodes(ctx context.Context, db driver.Database, instance, account string) (kept []string, dropped []string, err error) {
+	res, err := queryAll[struct {
+		Code string `json:"code"`
+		Kept bool   `json:"kept"`
+	}](ctx, db, rebindInstancePromocodes, map[string]interface{}{
+		"@promos":  schema.PROMOCODES_COL,
+		"instance": instance,
+		"account":  account,
+		"inactive": []promopb.PromocodeStatus{promopb.PromocodeStatus_DELETED, promopb.PromocodeStatus_SUSPENDED},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, r := range res {
+		if r.Kept {
+			kept = append(kept, r.Code)
+		} else {
+			dropped = append(dropped, r.Code)
+		}
+	}
+	return kept, dropped, nil
+}
+
+const findAccountByEmail = `
+FOR a IN @@accounts
+	FILTER a.deletion == null && LOWER(a.data.email) == LOWER(@email)
+	LIMIT 1
+	RETURN a._key
+`
+
+// FindAccountByEmail returns key of account with given email, empty if there is none
+func FindAccountByEmail(ctx context.Context, db driver.Database, email string) (string, error) {
+	res, err := queryAll[string](ctx, db, findAccountByEmail, map[string]interface{}{
+		"@accounts": schema.ACCOUNTS_COL,
+		"email":     email,
+	})
+	if err != nil || len(res) == 0 {
+		return "", err
+	}
+	return res[0], nil
+}
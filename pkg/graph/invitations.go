@@ -0,0 +1,192 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"go.uber.org/zap"
+)
+
+type InvitationStatus string
+
+const (
+	InvitationPending  InvitationStatus = "pending"
+	InvitationAccepted InvitationStatus = "accepted"
+	InvitationDeclined InvitationStatus = "declined"
+	InvitationRevoked  InvitationStatus = "revoked"
+	InvitationExpired  InvitationStatus = "expired"
+)
+
+var ErrInvitationNotPending = errors.New("invitation is not pending or has expired")
+
+// Invitation to join namespace, recipient is identified by email or by account UUID
+type Invitation struct {
+	Uuid      string           `json:"uuid,omitempty"`
+	Namespace string           `json:"namespace"`
+	Email     string           `json:"email,omitempty"`
+	Account   string           `json:"account,omitempty"`
+	Level     access.Level     `json:"level"`
+	Role      string           `json:"role"`
+	InvitedBy string           `json:"invited_by"`
+	Status    InvitationStatus `json:"status"`
+	Created   int64            `json:"created"`
+	Expires   int64            `json:"expires"`
+	// Set when invitation is accepted, declined or revoked
+	ResolvedBy string `json:"resolved_by,omitempty"`
+	Resolved   int64  `json:"resolved,omitempty"`
+	// SHA-256 of the token sent in invitation email
+	TokenHash string `json:"token_hash,omitempty"`
+}
+
+type InvitationsFilter struct {
+	Namespace string
+	// Match invitations addressed to account or any of given emails
+	Account string
+	Emails  []string
+	Status  InvitationStatus
+}
+
+type InvitationsController interface {
+	Create(ctx context.Context, inv *Invitation) (*Invitation, error)
+	Get(ctx context.Context, uuid string) (*Invitation, error)
+	GetByToken(ctx context.Context, tokenHash string) (*Invitation, error)
+	List(ctx context.Context, filter InvitationsFilter) ([]*Invitation, error)
+	Resolve(ctx context.Context, uuid string, status InvitationStatus, by string) (*Invitation, error)
+}
+
+type invitationsController struct {
+	log *zap.Logger
+	col driver.Collection
+}
+
+func NewInvitationsController(logger *zap.Logger, db driver.Database) InvitationsController {
+	ctx := context.TODO()
+	log := logger.Named("InvitationsController")
+	col := GetEnsureCollection(log, ctx, db, schema.INVITATIONS_COL)
+	return &invitationsController{
+		log: log, col: col,
+	}
+}
+
+func (c *invitationsController) Create(ctx context.Context, inv *Invitation) (*Invitation, error) {
+	meta, err := c.col.CreateDocument(ctx, inv)
+	if err != nil {
+		c.log.Error("Failed to create document", zap.Error(err))
+		return nil, err
+	}
+	inv.Uuid = meta.Key
+	return inv, nil
+}
+
+// Pending invitations past expiry are reported as expired
+const invitationView = `MERGE(i, {
+	uuid: i._key,
+	status: i.status == @pending && i.expires < @now ? @expired : i.status
+})`
+
+func (c *invitationsController) Get(ctx context.Context, uuid string) (*Invitation, error) {
+	return c.getOne(ctx, "FILTER i._key == @key", map[string]interface{}{"key": uuid})
+}
+
+func (c *invitationsController) GetByToken(ctx context.Context, tokenHash string) (*Invitation, error) {
+	return c.getOne(ctx, "FILTER i.token_hash == @hash", map[string]interface{}{"hash": tokenHash})
+}
+
+func (c *invitationsController) getOne(ctx context.Context, filter string, vars map[string]interface{}) (*Invitation, error) {
+	list, err := c.query(ctx, "FOR i IN @@invitations "+filter+" LIMIT 1 RETURN "+invitationView, vars)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errors.New("invitation not found")
+	}
+	return list[0], nil
+}
+
+func (c *invitationsController) List(ctx context.Context, filter InvitationsFilter) ([]*Invitation, error) {
+	query := "FOR i IN @@invitations"
+	vars := map[string]interface{}{}
+
+	if filter.Namespace != "" {
+		query += " FILTER i.namespace == @namespace"
+		vars["namespace"] = filter.Namespace
+	}
+	if filter.Account != "" || len(filter.Emails) > 0 {
+		query += " FILTER i.account == @account OR LOWER(i.email) IN @emails"
+		vars["account"] = filter.Account
+		emails := make([]string, 0, len(filter.Emails))
+		for _, email := range filter.Emails {
+			if email != "" {
+				emails = append(emails, email)
+			}
+		}
+		vars["emails"] = emails
+	}
+	query += " LET inv = " + invitationView
+	if filter.Status != "" {
+		query += " FILTER inv.status == @status"
+		vars["status"] = filter.Status
+	}
+	query += " SORT inv.created DESC RETURN UNSET(inv, 'token_hash')"
+
+	return c.query(ctx, query, vars)
+}
+
+const resolveInvitation = `
+FOR i IN @@invitations
+	FILTER i._key == @key AND i.status == @pending AND i.expires >= @now
+	UPDATE i WITH { status: @status, resolved_by: @by, resolved: @now } IN @@invitations
+	RETURN MERGE(NEW, { uuid: NEW._key })
+`
+
+// Resolve moves pending invitation to the final status, fails if invitation isn't pending anymore
+func (c *invitationsController) Resolve(ctx context.Context, uuid string, status InvitationStatus, by string) (*Invitation, error) {
+	list, err := c.query(ctx, resolveInvitation, map[string]interface{}{
+		"key":    uuid,
+		"status": status,
+		"by":     by,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrInvitationNotPending
+	}
+	return list[0], nil
+}
+
+func (c *invitationsController) query(ctx context.Context, query string, vars map[string]interface{}) ([]*Invitation, error) {
+	vars["@invitations"] = schema.INVITATIONS_COL
+	// Arango rejects unused bind parameters
+	for name, value := range map[string]interface{}{
+		"now":     time.Now().Unix(),
+		"pending": InvitationPending,
+		"expired": InvitationExpired,
+	} {
+		if strings.Contains(query, "@"+name) {
+			vars[name] = value
+		}
+	}
+
+	cur, err := c.col.Database().Query(ctx, query, vars)
+	if err != nil {
+		c.log.Error("Failed to query invitations", zap.Error(err))
+		return nil, err
+	}
+	defer cur.Close()
+
+	var result []*Invitation
+	for cur.HasMore() {
+		var inv Invitation
+		if _, err := cur.ReadDocument(ctx, &inv); err != nil {
+			return nil, err
+		}
+		result = append(result, &inv)
+	}
+	return result, nil
+}
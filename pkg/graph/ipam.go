@@ -0,0 +1,252 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+// IPPool is IPv4 or IPv6 subnet of services provider addresses are given out from
+type IPPool struct {
+	Key     string `json:"_key,omitempty"`
+	Title   string `json:"title"`
+	Sp      string `json:"sp"`
+	CIDR    string `json:"cidr"`
+	Gateway string `json:"gateway,omitempty"`
+	Public  bool   `json:"public"`
+	// Never given out: single addresses, CIDRs or from-to ranges
+	Reserved []string `json:"reserved,omitempty"`
+	// Reverse zone PTR records go to, derived from CIDR if empty
+	PTRZone string `json:"ptr_zone,omitempty"`
+
+	Created int64 `json:"created"`
+	Updated int64 `json:"updated"`
+}
+
+// IPAllocation is address currently held by instance, key is made of pool and address so address can't be given out twice
+type IPAllocation struct {
+	Key      string `json:"_key,omitempty"`
+	Pool     string `json:"pool"`
+	Sp       string `json:"sp"`
+	Address  string `json:"address"`
+	Public   bool   `json:"public"`
+	Instance string `json:"instance"`
+	Account  string `json:"account"`
+	PTR      string `json:"ptr,omitempty"`
+
+	Allocated   int64  `json:"allocated"`
+	AllocatedBy string `json:"allocated_by"`
+}
+
+const (
+	IPReleased        = "released"
+	IPTransferred     = "transferred"
+	IPInstanceDeleted = "instance_deleted"
+)
+
+// IPHistoryEntry is period address was held by account's instance
+type IPHistoryEntry struct {
+	Key      string `json:"_key,omitempty"`
+	Address  string `json:"address"`
+	Pool     string `json:"pool"`
+	Instance string `json:"instance"`
+	Account  string `json:"account"`
+	From     int64  `json:"from"`
+	// 0 while address is held
+	To         int64  `json:"to"`
+	By         string `json:"by"`
+	ReleasedBy string `json:"released_by,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+func IPAllocationKey(pool, address string) string {
+	return pool + "-" + address
+}
+
+func CreateIPPool(ctx context.Context, db driver.Database, pool *IPPool) (*IPPool, error) {
+	col, err := db.Collection(ctx, schema.IP_POOLS_COL)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := col.CreateDocument(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	pool.Key = meta.Key
+	return pool, nil
+}
+
+func GetIPPool(ctx context.Context, db driver.Database, key string) (*IPPool, error) {
+	col, err := db.Collection(ctx, schema.IP_POOLS_COL)
+	if err != nil {
+		return nil, err
+	}
+	var pool IPPool
+	if _, err := col.ReadDocument(ctx, key, &pool); err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+func UpdateIPPool(ctx context.Context, db driver.Database, pool *IPPool) error {
+	col, err := db.Collection(ctx, schema.IP_POOLS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.ReplaceDocument(ctx, pool.Key, pool)
+	return err
+}
+
+func DeleteIPPool(ctx context.Context, db driver.Database, key string) error {
+	col, err := db.Collection(ctx, schema.IP_POOLS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.RemoveDocument(ctx, key)
+	return err
+}
+
+const listIPPools = `
+FOR p IN @@col
+	FILTER @sp == "" || p.sp == @sp
+	LET used = LENGTH(FOR a IN @@allocs FILTER a.pool == p._key RETURN 1)
+	SORT p.sp, p.cidr
+	RETURN MERGE(p, { used })
+`
+
+type IPPoolWithUsage struct {
+	IPPool
+	Used int `json:"used"`
+}
+
+// ListIPPools returns pools of services provider with allocated addresses count, all pools if sp is empty
+func ListIPPools(ctx context.Context, db driver.Database, sp string) ([]IPPoolWithUsage, error) {
+	return queryAll[IPPoolWithUsage](ctx, db, listIPPools, map[string]interface{}{
+		"@col":    schema.IP_POOLS_COL,
+		"@allocs": schema.IP_ADDRESSES_COL,
+		"sp":      sp,
+	})
+}
+
+func CreateIPAllocation(ctx context.Context, db driver.Database, alloc *IPAllocation) error {
+	col, err := db.Collection(ctx, schema.IP_ADDRESSES_COL)
+	if err != nil {
+		return err
+	}
+	alloc.Key = IPAllocationKey(alloc.Pool, alloc.Address)
+	_, err = col.CreateDocument(ctx, alloc)
+	return err
+}
+
+func GetIPAllocation(ctx context.Context, db driver.Database, key string) (*IPAllocation, error) {
+	col, err := db.Collection(ctx, schema.IP_ADDRESSES_COL)
+	if err != nil {
+		return nil, err
+	}
+	var alloc IPAllocation
+	if _, err := col.ReadDocument(ctx, key, &alloc); err != nil {
+		return nil, err
+	}
+	return &alloc, nil
+}
+
+func UpdateIPAllocation(ctx context.Context, db driver.Database, alloc *IPAllocation) error {
+	col, err := db.Collection(ctx, schema.IP_ADDRESSES_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.ReplaceDocument(ctx, alloc.Key, alloc)
+	return err
+}
+
+func DeleteIPAllocation(ctx context.Context, db driver.Database, key string) error {
+	col, err := db.Collection(ctx, schema.IP_ADDRESSES_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.RemoveDocument(ctx, key)
+	return err
+}
+
+const listIPAllocations = `
+FOR a IN @@col
+	FILTER @pool == "" || a.pool == @pool
+	FILTER @instance == "" || a.instance == @instance
+	SORT a.allocated ASC
+	RETURN a
+`
+
+// ListIPAllocations returns addresses held, filtered by pool and instance if set
+func ListIPAllocations(ctx context.Context, db driver.Database, pool, instance string) ([]IPAllocation, error) {
+	return queryAll[IPAllocation](ctx, db, listIPAllocations, map[string]interface{}{
+		"@col":     schema.IP_ADDRESSES_COL,
+		"pool":     pool,
+		"instance": instance,
+	})
+}
+
+const listGroupIPInstances = `
+FOR i IN 1 OUTBOUND @ig @@ig2inst
+	FILTER LENGTH(FOR a IN @@col FILTER a.instance == i._key LIMIT 1 RETURN 1) > 0
+	RETURN i._key
+`
+
+// ListGroupIPInstances returns instances of group holding addresses
+func ListGroupIPInstances(ctx context.Context, db driver.Database, ig string) ([]string, error) {
+	return queryAll[string](ctx, db, listGroupIPInstances, map[string]interface{}{
+		"ig":       driver.NewDocumentID(schema.INSTANCES_GROUPS_COL, ig),
+		"@ig2inst": schema.IG2INST,
+		"@col":     schema.IP_ADDRESSES_COL,
+	})
+}
+
+func OpenIPHistory(ctx context.Context, db driver.Database, entry *IPHistoryEntry) error {
+	col, err := db.Collection(ctx, schema.IP_HISTORY_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.CreateDocument(ctx, entry)
+	return err
+}
+
+const closeIPHistory = `
+FOR h IN @@col
+	FILTER h.pool == @pool && h.address == @address && h.to == 0
+	UPDATE h WITH { to: @now, released_by: @by, reason: @reason } IN @@col
+`
+
+// CloseIPHistory ends open holding period of address
+func CloseIPHistory(ctx context.Context, db driver.Database, pool, address, by, reason string, now int64) error {
+	return execQuery(ctx, db, closeIPHistory, map[string]interface{}{
+		"@col":    schema.IP_HISTORY_COL,
+		"pool":    pool,
+		"address": address,
+		"by":      by,
+		"reason":  reason,
+		"now":     now,
+	})
+}
+
+const listIPHistory = `
+FOR h IN @@col
+	FILTER @address == "" || h.address == @address
+	FILTER @instance == "" || h.instance == @instance
+	FILTER @account == "" || h.account == @account
+	FILTER @at == 0 || (h.from <= @at && (h.to == 0 || h.to > @at))
+	SORT h.from DESC
+	LIMIT @limit
+	RETURN h
+`
+
+// ListIPHistory answers who held address and when. With at set only periods covering that moment are returned
+func ListIPHistory(ctx context.Context, db driver.Database, address, instance, account string, at int64, limit int) ([]IPHistoryEntry, error) {
+	return queryAll[IPHistoryEntry](ctx, db, listIPHistory, map[string]interface{}{
+		"@col":     schema.IP_HISTORY_COL,
+		"address":  address,
+		"instance": instance,
+		"account":  account,
+		"at":       at,
+		"limit":    limit,
+	})
+}
@@ -0,0 +1,182 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/nocloud/kyc"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+)
+
+var ErrKYCDocumentReviewed = errors.New("document is already reviewed")
+
+var defaultKYCSettings = &sc.Setting[kyc.Config]{
+	Value:       kyc.DefaultConfig(),
+	Description: "KYC documents and rules",
+	Level:       access.Level_ADMIN,
+}
+
+// GetKYCSettings fetches KYC settings shared by registry, services and instances
+func GetKYCSettings(log *zap.Logger) kyc.Config {
+	var conf kyc.Config
+	if scErr := sc.Fetch(kyc.SettingsKey, &conf, defaultKYCSettings); scErr != nil {
+		log.Warn("Cannot fetch kyc settings", zap.Error(scErr))
+		conf = defaultKYCSettings.Value
+	}
+	return conf
+}
+
+type KYCDocument struct {
+	Key         string             `json:"_key,omitempty"`
+	Account     string             `json:"account"`
+	Type        string             `json:"type"`
+	Filename    string             `json:"filename"`
+	ContentType string             `json:"content_type"`
+	Size        int64              `json:"size"`
+	Sha256      string             `json:"sha256"`
+	BlobKey     string             `json:"blob_key"`
+	Status      kyc.DocumentStatus `json:"status"`
+	UploadedAt  int64              `json:"uploaded_at"`
+	UploadedBy  string             `json:"uploaded_by"`
+	ReviewedAt  int64              `json:"reviewed_at,omitempty"`
+	ReviewedBy  string             `json:"reviewed_by,omitempty"`
+	Comment     string             `json:"comment,omitempty"`
+}
+
+func CreateKYCDocument(ctx context.Context, db driver.Database, doc *KYCDocument) (*KYCDocument, error) {
+	col, err := db.Collection(ctx, schema.KYC_DOCUMENTS_COL)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := col.CreateDocument(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	doc.Key = meta.Key
+	return doc, nil
+}
+
+func GetKYCDocument(ctx context.Context, db driver.Database, key string) (*KYCDocument, error) {
+	col, err := db.Collection(ctx, schema.KYC_DOCUMENTS_COL)
+	if err != nil {
+		return nil, err
+	}
+	var doc KYCDocument
+	if _, err := col.ReadDocument(ctx, key, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+const listKYCDocuments = `
+FOR d IN @@col
+	FILTER d.account == @account
+	SORT d.uploaded_at DESC
+	RETURN d
+`
+
+func ListKYCDocuments(ctx context.Context, db driver.Database, account string) ([]KYCDocument, error) {
+	return queryAll[KYCDocument](ctx, db, listKYCDocuments, map[string]interface{}{
+		"@col":    schema.KYC_DOCUMENTS_COL,
+		"account": account,
+	})
+}
+
+const listPendingKYCDocuments = `
+FOR d IN @@col
+	FILTER d.status == @status
+	SORT d.uploaded_at ASC
+	RETURN d
+`
+
+// ListPendingKYCDocuments is reviewers queue, oldest first
+func ListPendingKYCDocuments(ctx context.Context, db driver.Database) ([]KYCDocument, error) {
+	return queryAll[KYCDocument](ctx, db, listPendingKYCDocuments, map[string]interface{}{
+		"@col":   schema.KYC_DOCUMENTS_COL,
+		"status": kyc.DocumentPending,
+	})
+}
+
+const reviewKYCDocument = `
+FOR d IN @@col
+	FILTER d._key == @key && d.status == @pending
+	UPDATE d WITH { status: @status, reviewed_by: @reviewer, reviewed_at: @now, comment: @comment } IN @@col
+	RETURN NEW
+`
+
+// ReviewKYCDocument approves or rejects pending document
+func ReviewKYCDocument(ctx context.Context, db driver.Database, key string, st kyc.DocumentStatus, reviewer, comment string) (*KYCDocument, error) {
+	docs, err := queryAll[KYCDocument](ctx, db, reviewKYCDocument, map[string]interface{}{
+		"@col":     schema.KYC_DOCUMENTS_COL,
+		"key":      key,
+		"pending":  kyc.DocumentPending,
+		"status":   st,
+		"reviewer": reviewer,
+		"comment":  comment,
+		"now":      time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, ErrKYCDocumentReviewed
+	}
+	return &docs[0], nil
+}
+
+// KYCSubject is account data KYC rules depend on
+type KYCSubject struct {
+	AccountGroup string     `json:"account_group"`
+	Country      string     `json:"country"`
+	State        *kyc.State `json:"kyc"`
+}
+
+const getKYCSubject = `
+LET a = DOCUMENT(@@accounts, @account)
+FILTER a != null
+RETURN { account_group: a.account_group, country: a.data.country, kyc: a.kyc }
+`
+
+func GetKYCSubject(ctx context.Context, db driver.Database, account string) (*KYCSubject, error) {
+	res, err := queryAll[KYCSubject](ctx, db, getKYCSubject, map[string]interface{}{
+		"@accounts": schema.ACCOUNTS_COL,
+		"account":   account,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, driver.ArangoError{HasError: true, Code: 404, ErrorMessage: "account not found"}
+	}
+	return &res[0], nil
+}
+
+func SetAccountKYC(ctx context.Context, db driver.Database, account string, state kyc.State) error {
+	col, err := db.Collection(ctx, schema.ACCOUNTS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.UpdateDocument(ctx, account, map[string]interface{}{"kyc": state})
+	return err
+}
+
+// KYCBlocks reports whether account can't order product of plan until KYC passes
+func KYCBlocks(ctx context.Context, db driver.Database, conf kyc.Config, account, plan, product string) (bool, error) {
+	subject, err := GetKYCSubject(ctx, db, account)
+	if err != nil {
+		return false, err
+	}
+	if !conf.Blocks(subject.AccountGroup, subject.Country, plan, product) {
+		return false, nil
+	}
+	// State may predate current rules
+	if subject.State == nil || subject.State.Status == kyc.NotRequired {
+		return len(conf.RequiredDocuments(subject.AccountGroup, subject.Country)) > 0, nil
+	}
+	return subject.State.Effective(time.Now()).Status != kyc.Verified, nil
+}
@@ -17,6 +17,7 @@ package graph
 
 import (
 	"context"
+	"errors"
 
 	"github.com/arangodb/go-driver"
 	"github.com/slntopp/nocloud-proto/access"
@@ -35,6 +36,7 @@ type NamespacesController interface {
 	Patch(ctx context.Context, uuid, title string) error
 	Link(ctx context.Context, acc Account, ns Namespace, access access.Level, role string) error
 	Join(ctx context.Context, acc Account, ns Namespace, access access.Level, role string) error
+	Leave(ctx context.Context, acc Account, ns Namespace) error
 	Delete(ctx context.Context, id string) error
 }
 
@@ -117,6 +119,51 @@ func (ctrl *namespacesController) Join(ctx context.Context, acc Account, ns Name
 	return acc.JoinNamespace(ctx, edge, ns, access, role)
 }
 
+var ErrLastOwner = errors.New("account is the last owner of namespace")
+
+const countOtherOwners = `
+FOR e IN @@edges
+	FILTER e._to == @ns AND e._from != @acc AND e.role == @owner
+	COLLECT WITH COUNT INTO n
+	RETURN n
+`
+
+// Leave unlinks account from namespace, last owner can't leave
+func (ctrl *namespacesController) Leave(ctx context.Context, acc Account, ns Namespace) error {
+	db := ctrl.col.Database()
+	edge, err := db.Collection(ctx, schema.ACC2NS)
+	if err != nil {
+		return err
+	}
+
+	var a Access
+	if _, err = edge.ReadDocument(ctx, acc.Key+"-"+ns.Key, &a); err != nil {
+		return err
+	}
+	if a.Role == roles.OWNER {
+		c, err := db.Query(ctx, countOtherOwners, map[string]interface{}{
+			"@edges": schema.ACC2NS,
+			"ns":     ns.ID,
+			"acc":    acc.ID,
+			"owner":  roles.OWNER,
+		})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		var owners int
+		if _, err = c.ReadDocument(ctx, &owners); err != nil {
+			return err
+		}
+		if owners == 0 {
+			return ErrLastOwner
+		}
+	}
+
+	_, err = edge.RemoveDocument(ctx, acc.Key+"-"+ns.Key)
+	return err
+}
+
 func (ns *Namespace) Delete(ctx context.Context, db driver.Database) error {
 	err := deleteRecursive(ctx, db, ns.ID)
 	if err != nil {
@@ -7,6 +7,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	"github.com/slntopp/nocloud/pkg/oauth2"
 	"strings"
 	"time"
@@ -18,12 +20,14 @@ import (
 type OAuthController struct {
 	log *zap.Logger
 	db  driver.Database
+	ca  CommonActionsController
 
 	clientsCol      driver.Collection
 	codesCol        driver.Collection
 	accessCol       driver.Collection
 	refreshCol      driver.Collection
 	interactionsCol driver.Collection
+	devicesCol      driver.Collection
 }
 
 type ArangoRepoOptions struct {
@@ -32,6 +36,7 @@ type ArangoRepoOptions struct {
 	AccessCollection       string
 	RefreshCollection      string
 	InteractionsCollection string
+	DevicesCollection      string
 }
 
 func DefaultArangoRepoOptions() ArangoRepoOptions {
@@ -41,6 +46,7 @@ func DefaultArangoRepoOptions() ArangoRepoOptions {
 		AccessCollection:       "OAuth2AccessTokens",
 		RefreshCollection:      "OAuth2RefreshTokens",
 		InteractionsCollection: "OAuth2Interactions",
+		DevicesCollection:      "OAuth2DeviceAuthorizations",
 	}
 }
 
@@ -73,15 +79,26 @@ func NewOAuthController(logger *zap.Logger, db driver.Database, opts *ArangoRepo
 	if err != nil {
 		log.Fatal("ensure interactions collection failed", zap.Error(err))
 	}
+	devices, err := ensureCollection(ctx, db, opts.DevicesCollection)
+	if err != nil {
+		log.Fatal("ensure device authorizations collection failed", zap.Error(err))
+	}
+	if _, _, err = devices.EnsurePersistentIndex(ctx, []string{"user_code"}, &driver.EnsurePersistentIndexOptions{
+		Unique: false, Sparse: true, InBackground: true, Name: "device-user-code",
+	}); err != nil {
+		log.Error("failed to ensure device user code index", zap.Error(err))
+	}
 
 	return &OAuthController{
 		log:             log,
 		db:              db,
+		ca:              NewCommonActionsController(log, db),
 		clientsCol:      clients,
 		codesCol:        codes,
 		accessCol:       access,
 		refreshCol:      refresh,
 		interactionsCol: interaction,
+		devicesCol:      devices,
 	}
 }
 
@@ -89,6 +106,9 @@ var _ oauth2.ClientStore = (*OAuthController)(nil)
 var _ oauth2.AuthorizationCodeStore = (*OAuthController)(nil)
 var _ oauth2.TokenStore = (*OAuthController)(nil)
 var _ oauth2.InteractionStore = (*OAuthController)(nil)
+var _ oauth2.DeviceAuthorizationStore = (*OAuthController)(nil)
+var _ oauth2.ClientRegistry = (*OAuthController)(nil)
+var _ oauth2.AdminChecker = (*OAuthController)(nil)
 
 type clientDoc struct {
 	Key          string   `json:"_key,omitempty"`
@@ -101,6 +121,10 @@ type clientDoc struct {
 	Public bool `json:"public,omitempty"`
 
 	Display map[string]any `json:"display,omitempty"`
+
+	Disabled     bool      `json:"disabled,omitempty"`
+	RegisteredBy string    `json:"registered_by,omitempty"`
+	CreatedAt    time.Time `json:"created_at,omitempty"`
 }
 
 func (d clientDoc) toClient() oauth2.Client {
@@ -115,6 +139,27 @@ func (d clientDoc) toClient() oauth2.Client {
 		AllowedScopes: d.AllowedScopes,
 		Public:        d.Public,
 		Display:       display,
+		Disabled:      d.Disabled,
+		RegisteredBy:  d.RegisteredBy,
+		CreatedAt:     d.CreatedAt.UTC(),
+	}
+}
+
+func toClientDoc(c oauth2.Client) clientDoc {
+	displayBytes, _ := json.Marshal(c.Display)
+	var display map[string]any
+	_ = json.Unmarshal(displayBytes, &display)
+	return clientDoc{
+		Key:           c.ID,
+		Secret:        c.Secret,
+		RedirectURIs:  c.RedirectURIs,
+		AllowedGrants: c.AllowedGrants,
+		AllowedScopes: c.AllowedScopes,
+		Public:        c.Public,
+		Display:       display,
+		Disabled:      c.Disabled,
+		RegisteredBy:  c.RegisteredBy,
+		CreatedAt:     c.CreatedAt.UTC(),
 	}
 }
 
@@ -130,9 +175,100 @@ func (r *OAuthController) GetClient(ctx context.Context, clientID string) (oauth
 		return oauth2.Client{}, err
 	}
 	d.Key = meta.Key
+	if d.Disabled {
+		return oauth2.Client{}, fmt.Errorf("client is disabled")
+	}
 	return d.toClient(), nil
 }
 
+func (r *OAuthController) CreateClient(ctx context.Context, c oauth2.Client) error {
+	log := r.log.Named("CreateClient")
+	if c.ID == "" {
+		return fmt.Errorf("missing client id")
+	}
+	if _, err := r.clientsCol.CreateDocument(ctx, toClientDoc(c)); err != nil {
+		log.Error("create client failed", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+const listClientsAQL = `
+FOR c IN @@clients
+  SORT c._key
+  RETURN c
+`
+
+func (r *OAuthController) ListClients(ctx context.Context) ([]oauth2.Client, error) {
+	log := r.log.Named("ListClients")
+
+	cur, err := r.db.Query(ctx, listClientsAQL, map[string]any{
+		"@clients": r.clientsCol.Name(),
+	})
+	if err != nil {
+		log.Error("list clients query failed", zap.Error(err))
+		return nil, err
+	}
+	defer cur.Close()
+
+	var result []oauth2.Client
+	for cur.HasMore() {
+		var d clientDoc
+		if _, err := cur.ReadDocument(ctx, &d); err != nil {
+			log.Error("list clients read failed", zap.Error(err))
+			return nil, err
+		}
+		result = append(result, d.toClient())
+	}
+	return result, nil
+}
+
+func (r *OAuthController) SetClientDisabled(ctx context.Context, clientID string, disabled bool) error {
+	log := r.log.Named("SetClientDisabled")
+	if clientID == "" {
+		return fmt.Errorf("missing client id")
+	}
+	if _, err := r.clientsCol.UpdateDocument(ctx, clientID, map[string]any{"disabled": disabled}); err != nil {
+		log.Error("update client failed", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// IsAdmin reports whether subject has root access to the root namespace
+const revokeClientTokensAQL = `
+FOR t IN @@col
+  FILTER t.client_id == @client && t.revoked != true
+  UPDATE t WITH { revoked: true } IN @@col
+`
+
+// RevokeClientTokens marks all access and refresh tokens issued to client revoked
+func (r *OAuthController) RevokeClientTokens(ctx context.Context, clientID string) error {
+	log := r.log.Named("RevokeClientTokens")
+	if clientID == "" {
+		return fmt.Errorf("missing client id")
+	}
+	for _, col := range []driver.Collection{r.accessCol, r.refreshCol} {
+		cur, err := r.db.Query(ctx, revokeClientTokensAQL, map[string]any{
+			"@col":   col.Name(),
+			"client": clientID,
+		})
+		if err != nil {
+			log.Error("revoke client tokens failed", zap.Error(err), zap.String("collection", col.Name()))
+			return err
+		}
+		_ = cur.Close()
+	}
+	return nil
+}
+
+func (r *OAuthController) IsAdmin(ctx context.Context, subject string) (bool, error) {
+	if subject == "" {
+		return false, nil
+	}
+	return r.ca.HasAccess(ctx, subject, driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), access.Level_ROOT), nil
+}
+
 func (r *OAuthController) ValidateClientSecret(ctx context.Context, clientID, clientSecret string) (bool, error) {
 	c, err := r.GetClient(ctx, clientID)
 	if err != nil {
@@ -535,6 +671,8 @@ type interactionDoc struct {
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
 	Consumed  bool      `json:"consumed"`
+
+	DeviceUserCode string `json:"device_user_code,omitempty"`
 }
 
 func toInteractionDoc(it oauth2.Interaction) interactionDoc {
@@ -550,6 +688,7 @@ func toInteractionDoc(it oauth2.Interaction) interactionDoc {
 		CreatedAt:       it.CreatedAt.UTC(),
 		ExpiresAt:       it.ExpiresAt.UTC(),
 		Consumed:        it.Consumed,
+		DeviceUserCode:  it.DeviceUserCode,
 	}
 }
 
@@ -565,6 +704,7 @@ func (d interactionDoc) toInteraction() oauth2.Interaction {
 		CreatedAt:       d.CreatedAt.UTC(),
 		ExpiresAt:       d.ExpiresAt.UTC(),
 		Consumed:        d.Consumed,
+		DeviceUserCode:  d.DeviceUserCode,
 	}
 }
 
@@ -705,6 +845,260 @@ RETURN NEW
 	return out.toInteraction(), nil
 }
 
+type deviceAuthorizationDoc struct {
+	Key string `json:"_key,omitempty"`
+
+	DeviceCode string `json:"device_code"`
+	UserCode   string `json:"user_code"`
+	ClientID   string `json:"client_id"`
+
+	RequestedScopes []string `json:"requested_scopes,omitempty"`
+	GrantedScopes   []string `json:"granted_scopes,omitempty"`
+	Subject         string   `json:"subject,omitempty"`
+
+	Status          string    `json:"status"`
+	IntervalSeconds int64     `json:"interval_seconds"`
+	IssuedAt        time.Time `json:"issued_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	LastPolledAt    time.Time `json:"last_polled_at,omitempty"`
+	Consumed        bool      `json:"consumed"`
+}
+
+func toDeviceAuthorizationDoc(da oauth2.DeviceAuthorization) deviceAuthorizationDoc {
+	return deviceAuthorizationDoc{
+		Key:             opaqueKey(da.DeviceCode),
+		DeviceCode:      da.DeviceCode,
+		UserCode:        da.UserCode,
+		ClientID:        da.ClientID,
+		RequestedScopes: da.RequestedScopes,
+		GrantedScopes:   da.GrantedScopes,
+		Subject:         da.Subject,
+		Status:          string(da.Status),
+		IntervalSeconds: int64(da.Interval / time.Second),
+		IssuedAt:        da.IssuedAt.UTC(),
+		ExpiresAt:       da.ExpiresAt.UTC(),
+		LastPolledAt:    da.LastPolledAt.UTC(),
+		Consumed:        da.Consumed,
+	}
+}
+
+func (d deviceAuthorizationDoc) toDeviceAuthorization() oauth2.DeviceAuthorization {
+	return oauth2.DeviceAuthorization{
+		DeviceCode:      d.DeviceCode,
+		UserCode:        d.UserCode,
+		ClientID:        d.ClientID,
+		RequestedScopes: d.RequestedScopes,
+		GrantedScopes:   d.GrantedScopes,
+		Subject:         d.Subject,
+		Status:          oauth2.DeviceAuthorizationStatus(d.Status),
+		Interval:        time.Duration(d.IntervalSeconds) * time.Second,
+		IssuedAt:        d.IssuedAt.UTC(),
+		ExpiresAt:       d.ExpiresAt.UTC(),
+		LastPolledAt:    d.LastPolledAt.UTC(),
+		Consumed:        d.Consumed,
+	}
+}
+
+// User codes are only unique among pending and not expired authorizations
+const createDeviceAuthorizationAQL = `
+LET nowTs = DATE_TIMESTAMP(@now)
+LET taken = FIRST(
+  FOR d IN @@devices
+    FILTER d.user_code == @doc.user_code
+    FILTER d.status == "pending"
+    FILTER DATE_TIMESTAMP(d.expires_at) > nowTs
+    RETURN 1
+)
+FILTER taken == null
+INSERT @doc IN @@devices
+RETURN NEW._key
+`
+
+func (r *OAuthController) CreateDeviceAuthorization(ctx context.Context, da oauth2.DeviceAuthorization) error {
+	log := r.log.Named("DeviceAuthorization.Create")
+
+	if da.DeviceCode == "" || da.UserCode == "" {
+		return fmt.Errorf("missing device or user code")
+	}
+
+	cur, err := r.db.Query(ctx, createDeviceAuthorizationAQL, map[string]any{
+		"@devices": r.devicesCol.Name(),
+		"doc":      toDeviceAuthorizationDoc(da),
+		"now":      time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error("create device authorization failed", zap.Error(err))
+		return err
+	}
+	defer cur.Close()
+
+	var key string
+	if _, err = cur.ReadDocument(ctx, &key); err != nil {
+		if driver.IsNoMoreDocuments(err) {
+			return fmt.Errorf("user code is already taken")
+		}
+		log.Error("create device authorization read failed", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+const getDeviceAuthorizationByUserCodeAQL = `
+FOR d IN @@devices
+  FILTER d.user_code == @user_code
+  SORT d.issued_at DESC
+  LIMIT 1
+  RETURN d
+`
+
+func (r *OAuthController) GetDeviceAuthorizationByUserCode(ctx context.Context, userCode string) (oauth2.DeviceAuthorization, error) {
+	log := r.log.Named("DeviceAuthorization.GetByUserCode")
+
+	cur, err := r.db.Query(ctx, getDeviceAuthorizationByUserCodeAQL, map[string]any{
+		"@devices":  r.devicesCol.Name(),
+		"user_code": userCode,
+	})
+	if err != nil {
+		log.Error("get device authorization query failed", zap.Error(err))
+		return oauth2.DeviceAuthorization{}, err
+	}
+	defer cur.Close()
+
+	var d deviceAuthorizationDoc
+	if _, err = cur.ReadDocument(ctx, &d); err != nil {
+		if driver.IsNoMoreDocuments(err) {
+			return oauth2.DeviceAuthorization{}, oauth2.ErrDeviceAuthorizationNotFound
+		}
+		log.Error("get device authorization read failed", zap.Error(err))
+		return oauth2.DeviceAuthorization{}, err
+	}
+	return d.toDeviceAuthorization(), nil
+}
+
+const resolveDeviceAuthorizationAQL = `
+LET nowTs = DATE_TIMESTAMP(@now)
+FOR d IN @@devices
+  FILTER d.user_code == @user_code
+  FILTER d.status == "pending"
+  FILTER DATE_TIMESTAMP(d.expires_at) > nowTs
+  LIMIT 1
+  UPDATE d WITH { status: @status, subject: @subject, granted_scopes: @scopes } IN @@devices
+  RETURN NEW._key
+`
+
+func (r *OAuthController) ResolveDeviceAuthorization(ctx context.Context, userCode, subject string, scopes []string, status oauth2.DeviceAuthorizationStatus) error {
+	log := r.log.Named("DeviceAuthorization.Resolve")
+
+	if status != oauth2.DeviceAuthorizationApproved && status != oauth2.DeviceAuthorizationDenied {
+		return fmt.Errorf("invalid device authorization status: %s", status)
+	}
+
+	cur, err := r.db.Query(ctx, resolveDeviceAuthorizationAQL, map[string]any{
+		"@devices":  r.devicesCol.Name(),
+		"user_code": userCode,
+		"status":    string(status),
+		"subject":   subject,
+		"scopes":    scopes,
+		"now":       time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error("resolve device authorization failed", zap.Error(err))
+		return err
+	}
+	defer cur.Close()
+
+	var key string
+	if _, err = cur.ReadDocument(ctx, &key); err != nil {
+		if driver.IsNoMoreDocuments(err) {
+			return oauth2.ErrDeviceAuthorizationNotFound
+		}
+		log.Error("resolve device authorization read failed", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+const pollDeviceAuthorizationAQL = `
+LET doc = DOCUMENT(@@devices, @key)
+FILTER doc != null
+LET polled = doc.last_polled_at ? DATE_TIMESTAMP(doc.last_polled_at) : null
+LET tooSoon = polled != null && polled > 0 && DATE_TIMESTAMP(@now) - polled < doc.interval_seconds * 1000
+UPDATE doc WITH {
+  last_polled_at: @now,
+  interval_seconds: tooSoon ? doc.interval_seconds + @step : doc.interval_seconds
+} IN @@devices
+RETURN OLD
+`
+
+func (r *OAuthController) PollDeviceAuthorization(ctx context.Context, deviceCode string, now time.Time) (oauth2.DeviceAuthorization, error) {
+	log := r.log.Named("DeviceAuthorization.Poll")
+
+	if deviceCode == "" {
+		return oauth2.DeviceAuthorization{}, fmt.Errorf("missing device code")
+	}
+
+	cur, err := r.db.Query(ctx, pollDeviceAuthorizationAQL, map[string]any{
+		"@devices": r.devicesCol.Name(),
+		"key":      opaqueKey(deviceCode),
+		"now":      now.UTC(),
+		"step":     int64(oauth2.SlowDownStep / time.Second),
+	})
+	if err != nil {
+		log.Error("poll device authorization failed", zap.Error(err))
+		return oauth2.DeviceAuthorization{}, err
+	}
+	defer cur.Close()
+
+	var d deviceAuthorizationDoc
+	if _, err = cur.ReadDocument(ctx, &d); err != nil {
+		if driver.IsNoMoreDocuments(err) {
+			return oauth2.DeviceAuthorization{}, oauth2.ErrDeviceAuthorizationNotFound
+		}
+		log.Error("poll device authorization read failed", zap.Error(err))
+		return oauth2.DeviceAuthorization{}, err
+	}
+	if d.DeviceCode != deviceCode {
+		return oauth2.DeviceAuthorization{}, oauth2.ErrDeviceAuthorizationNotFound
+	}
+	return d.toDeviceAuthorization(), nil
+}
+
+const consumeDeviceAuthorizationAQL = `
+LET doc = DOCUMENT(@@devices, @key)
+FILTER doc != null
+FILTER doc.status == "approved"
+FILTER doc.consumed != true
+UPDATE doc WITH { consumed: true } IN @@devices
+RETURN NEW
+`
+
+func (r *OAuthController) ConsumeDeviceAuthorization(ctx context.Context, deviceCode string) (oauth2.DeviceAuthorization, error) {
+	log := r.log.Named("DeviceAuthorization.Consume")
+
+	cur, err := r.db.Query(ctx, consumeDeviceAuthorizationAQL, map[string]any{
+		"@devices": r.devicesCol.Name(),
+		"key":      opaqueKey(deviceCode),
+	})
+	if err != nil {
+		log.Error("consume device authorization failed", zap.Error(err))
+		return oauth2.DeviceAuthorization{}, err
+	}
+	defer cur.Close()
+
+	var d deviceAuthorizationDoc
+	if _, err = cur.ReadDocument(ctx, &d); err != nil {
+		if driver.IsNoMoreDocuments(err) {
+			return oauth2.DeviceAuthorization{}, fmt.Errorf("device authorization already consumed")
+		}
+		log.Error("consume device authorization read failed", zap.Error(err))
+		return oauth2.DeviceAuthorization{}, err
+	}
+	if d.DeviceCode != deviceCode {
+		return oauth2.DeviceAuthorization{}, oauth2.ErrDeviceAuthorizationNotFound
+	}
+	return d.toDeviceAuthorization(), nil
+}
+
 func ensureCollection(ctx context.Context, db driver.Database, name string) (driver.Collection, error) {
 	col, err := db.Collection(ctx, name)
 	if err == nil {
@@ -0,0 +1,233 @@
+package graph
+
+import (
+	"context"
+	"strings"
+
+	"github.com/arangodb/go-driver"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/nocloud/gc"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+const findDetachedInstances = `
+FOR inst IN @@instances
+	FILTER inst.status != @deleted
+	LET ig = FIRST(FOR g IN 1 INBOUND inst GRAPH @permissions FILTER IS_SAME_COLLECTION(@groups, g) RETURN g)
+	LET srv = ig ? FIRST(FOR s IN 1 INBOUND ig GRAPH @permissions FILTER IS_SAME_COLLECTION(@services, s) RETURN s) : null
+	LET acc = srv ? FIRST(
+		FOR node, edge, path IN 1..2 INBOUND srv GRAPH @permissions
+		FILTER IS_SAME_COLLECTION(@accounts, node) AND path.edges[-1].role == @owner
+		SORT LENGTH(path.edges)
+		RETURN node
+	) : null
+	LET kind = (!ig || ig.status == @deleted) ? @no_group
+		: (!srv || srv.status == @deleted) ? @no_service
+		: (!acc || acc.deletion.purged > 0) ? @no_account : null
+	FILTER kind != null
+	LET reason = kind == @no_group ? (ig ? CONCAT("instances group ", ig._key, " is deleted") : "no instances group")
+		: kind == @no_service ? (srv ? CONCAT("service ", srv._key, " is deleted") : CONCAT("instances group ", ig._key, " has no service"))
+		: (acc ? CONCAT("account ", acc._key, " is purged") : CONCAT("service ", srv._key, " has no owner account"))
+	RETURN {
+		kind, reason, entity: @entity, uuid: inst._key, title: inst.title,
+		sp: ig ? FIRST(FOR p IN 1 OUTBOUND ig GRAPH @permissions FILTER IS_SAME_COLLECTION(@sps, p) RETURN p._key) : null
+	}
+`
+
+// FindDetachedInstances finds active instances whose instances group, service or owner account no longer exists
+func FindDetachedInstances(ctx context.Context, db driver.Database) ([]gc.Finding, error) {
+	return queryAll[gc.Finding](ctx, db, findDetachedInstances, map[string]interface{}{
+		"@instances":  schema.INSTANCES_COL,
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"groups":      schema.INSTANCES_GROUPS_COL,
+		"services":    schema.SERVICES_COL,
+		"accounts":    schema.ACCOUNTS_COL,
+		"sps":         schema.SERVICES_PROVIDERS_COL,
+		"owner":       roles.OWNER,
+		"deleted":     statuspb.NoCloudStatus_DEL,
+		"no_group":    gc.NoGroup,
+		"no_service":  gc.NoService,
+		"no_account":  gc.NoAccount,
+		"entity":      schema.INSTANCES_COL,
+	})
+}
+
+const findLinkedDeletedInstances = `
+FOR inst IN @@instances
+	FILTER inst.status != @deleted
+	FILTER IS_STRING(inst.config.instance) && inst.config.instance != ""
+	LET plan = DOCUMENT(@@plans, inst.billing_plan.uuid)
+	FILTER plan && LOWER(plan.type) IN @types
+	LET linked = DOCUMENT(@@instances, inst.config.instance)
+	FILTER !linked || linked.status == @deleted
+	RETURN {
+		kind: linked ? @linked_deleted : @linked_missing, entity: @entity, uuid: inst._key, title: inst.title,
+		reason: CONCAT("linked instance ", inst.config.instance, linked ? " is deleted" : " doesn't exist"),
+		refs: [inst.config.instance]
+	}
+`
+
+// FindLinkedDeletedInstances finds active instances of given plan types bound through config.instance to deleted ones,
+// or to ones which don't exist
+func FindLinkedDeletedInstances(ctx context.Context, db driver.Database, planTypes []string) ([]gc.Finding, error) {
+	types := make([]string, len(planTypes))
+	for i, t := range planTypes {
+		types[i] = strings.ToLower(t)
+	}
+	return queryAll[gc.Finding](ctx, db, findLinkedDeletedInstances, map[string]interface{}{
+		"@instances":     schema.INSTANCES_COL,
+		"@plans":         schema.BILLING_PLANS_COL,
+		"types":          types,
+		"deleted":        statuspb.NoCloudStatus_DEL,
+		"linked_deleted": gc.LinkedDeleted,
+		"linked_missing": gc.LinkedMissing,
+		"entity":         schema.INSTANCES_COL,
+	})
+}
+
+const findDeletedBillableInstances = `
+FOR inv IN @@invoices
+	FILTER inv.status IN @open && IS_ARRAY(inv.instances)
+	FOR id IN inv.instances
+		LET inst = DOCUMENT(@@instances, id)
+		FILTER inst && inst.status == @deleted
+		COLLECT uuid = id, title = inst.title INTO refs = inv._key
+		RETURN {
+			kind: @kind, entity: @entity, uuid, title, refs,
+			reason: CONCAT("deleted instance has ", LENGTH(refs), " open invoices")
+		}
+`
+
+// FindDeletedBillableInstances finds deleted instances still included into unpaid or draft invoices
+func FindDeletedBillableInstances(ctx context.Context, db driver.Database) ([]gc.Finding, error) {
+	return queryAll[gc.Finding](ctx, db, findDeletedBillableInstances, map[string]interface{}{
+		"@invoices":  schema.INVOICES_COL,
+		"@instances": schema.INSTANCES_COL,
+		"open":       []billingpb.BillingStatus{billingpb.BillingStatus_UNPAID, billingpb.BillingStatus_DRAFT},
+		"deleted":    statuspb.NoCloudStatus_DEL,
+		"kind":       gc.DeletedBillable,
+		"entity":     schema.INSTANCES_COL,
+	})
+}
+
+const findEmptyGroups = `
+FOR ig IN @@groups
+	FILTER ig.status != @deleted && ig.status != @init
+	LET active = LENGTH(
+		FOR i IN 1 OUTBOUND ig GRAPH @permissions
+		FILTER IS_SAME_COLLECTION(@instances, i) && i.status != @deleted
+		RETURN 1
+	)
+	FILTER active == 0
+	RETURN {
+		kind: @kind, entity: @entity, uuid: ig._key, title: ig.title, reason: "no active instances",
+		sp: FIRST(FOR p IN 1 OUTBOUND ig GRAPH @permissions FILTER IS_SAME_COLLECTION(@sps, p) RETURN p._key)
+	}
+`
+
+// FindEmptyGroups finds active instances groups without active instances
+func FindEmptyGroups(ctx context.Context, db driver.Database) ([]gc.Finding, error) {
+	return queryAll[gc.Finding](ctx, db, findEmptyGroups, map[string]interface{}{
+		"@groups":     schema.INSTANCES_GROUPS_COL,
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"instances":   schema.INSTANCES_COL,
+		"sps":         schema.SERVICES_PROVIDERS_COL,
+		"deleted":     statuspb.NoCloudStatus_DEL,
+		"init":        statuspb.NoCloudStatus_INIT,
+		"kind":        gc.EmptyGroup,
+		"entity":      schema.INSTANCES_GROUPS_COL,
+	})
+}
+
+const findProviderOrphans = `
+FOR sp IN @@sps
+	FILTER sp.status != @deleted && IS_ARRAY(sp.state.meta.resources)
+	FOR r IN sp.state.meta.resources
+		LET inst = IS_STRING(r.instance) && r.instance != "" ? DOCUMENT(@@instances, r.instance) : null
+		FILTER !inst || inst.status == @deleted
+		RETURN {
+			kind: @kind, entity: "provider", uuid: TO_STRING(r.id), title: r.title, sp: sp._key,
+			reason: r.instance ? CONCAT("instance ", r.instance, inst ? " is deleted" : " doesn't exist") : "not bound to instance",
+			refs: r.instance ? [r.instance] : []
+		}
+`
+
+// FindProviderOrphans finds resources drivers report in services provider state meta under "resources"
+// as [{ id, title, instance }], which have no active instance
+func FindProviderOrphans(ctx context.Context, db driver.Database) ([]gc.Finding, error) {
+	return queryAll[gc.Finding](ctx, db, findProviderOrphans, map[string]interface{}{
+		"@sps":       schema.SERVICES_PROVIDERS_COL,
+		"@instances": schema.INSTANCES_COL,
+		"deleted":    statuspb.NoCloudStatus_DEL,
+		"kind":       gc.ProviderOrphan,
+	})
+}
+
+// GCRun is report of one orphans collection, nothing is changed on dry runs
+type GCRun struct {
+	Key       string `json:"_key,omitempty"`
+	Started   int64  `json:"started"`
+	Finished  int64  `json:"finished"`
+	DryRun    bool   `json:"dry_run"`
+	Requester string `json:"requester"`
+
+	Summary  map[gc.Kind]int `json:"summary"`
+	Applied  int             `json:"applied"`
+	Failed   int             `json:"failed"`
+	Findings []gc.Finding    `json:"findings,omitempty"`
+}
+
+func CreateGCRun(ctx context.Context, db driver.Database, run *GCRun) (*GCRun, error) {
+	col, err := db.Collection(ctx, schema.GC_RUNS_COL)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := col.CreateDocument(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	run.Key = meta.Key
+	return run, nil
+}
+
+func GetGCRun(ctx context.Context, db driver.Database, key string) (*GCRun, error) {
+	col, err := db.Collection(ctx, schema.GC_RUNS_COL)
+	if err != nil {
+		return nil, err
+	}
+	var run GCRun
+	if _, err := col.ReadDocument(ctx, key, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+const listGCRuns = `
+FOR r IN @@col
+	SORT r.started DESC
+	LIMIT @limit
+	RETURN UNSET(r, "findings")
+`
+
+// ListGCRuns returns latest runs without findings
+func ListGCRuns(ctx context.Context, db driver.Database, limit int) ([]GCRun, error) {
+	return queryAll[GCRun](ctx, db, listGCRuns, map[string]interface{}{
+		"@col":  schema.GC_RUNS_COL,
+		"limit": limit,
+	})
+}
+
+const pruneGCRuns = `
+FOR r IN @@col
+	FILTER r.started < @before
+	REMOVE r IN @@col
+`
+
+func PruneGCRuns(ctx context.Context, db driver.Database, before int64) error {
+	return execQuery(ctx, db, pruneGCRuns, map[string]interface{}{
+		"@col":   schema.GC_RUNS_COL,
+		"before": before,
+	})
+}
@@ -0,0 +1,98 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/arangodb/go-driver"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/nocloud/placement"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+// PlacementMeta is stored in services provider meta under placement key
+type PlacementMeta struct {
+	Region   string           `json:"region"`
+	Weight   int              `json:"weight"`
+	Capacity placement.Limits `json:"capacity"`
+}
+
+type placementCandidate struct {
+	Uuid             string              `json:"uuid"`
+	Title            string              `json:"title"`
+	Meta             *PlacementMeta      `json:"placement"`
+	Locations        []string            `json:"locations"`
+	Load             placement.Resources `json:"load"`
+	AccountInstances int                 `json:"account_instances"`
+}
+
+const listPlacementCandidates = `
+LET account_groups = (
+	FOR node, edge, path IN 3 OUTBOUND @account GRAPH @permissions
+	FILTER path.edges[0].role == @owner AND IS_SAME_COLLECTION(@groups, node)
+	RETURN node._id
+)
+FOR sp IN 1 INBOUND @plan @@sp2bp
+	FILTER LENGTH(@sps) == 0 OR sp._key IN @sps
+	LET insts = (
+		FOR ig IN 1 INBOUND sp @@ig2sp
+		FOR i IN 1 OUTBOUND ig @@ig2inst
+		FILTER i.status != @deleted
+		RETURN { ig: ig._id, res: i.resources }
+	)
+	RETURN {
+		uuid: sp._key,
+		title: sp.title,
+		placement: sp.meta.placement,
+		locations: sp.locations[*].id,
+		load: {
+			instances: LENGTH(insts),
+			cpu: SUM(insts[*].res.cpu),
+			ram: SUM(insts[*].res.ram),
+			disk: SUM(insts[*].res.drive_size)
+		},
+		account_instances: LENGTH(FOR x IN insts FILTER x.ig IN account_groups RETURN 1)
+	}
+`
+
+// PlacementCandidates lists services providers bound to plan with their current load,
+// sps narrows the list if not empty
+func PlacementCandidates(ctx context.Context, db driver.Database, plan, account string, sps []string) ([]*placement.Candidate, error) {
+	if sps == nil {
+		sps = []string{}
+	}
+	res, err := queryAll[placementCandidate](ctx, db, listPlacementCandidates, map[string]interface{}{
+		"account":     driver.NewDocumentID(schema.ACCOUNTS_COL, account),
+		"plan":        driver.NewDocumentID(schema.BILLING_PLANS_COL, plan),
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"groups":      schema.INSTANCES_GROUPS_COL,
+		"owner":       roles.OWNER,
+		"deleted":     statuspb.NoCloudStatus_DEL,
+		"sps":         sps,
+		"@sp2bp":      schema.SP2BP,
+		"@ig2sp":      schema.IG2SP,
+		"@ig2inst":    schema.IG2INST,
+	})
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]*placement.Candidate, len(res))
+	for i, r := range res {
+		c := &placement.Candidate{
+			UUID:             r.Uuid,
+			Title:            r.Title,
+			Regions:          r.Locations,
+			Load:             r.Load,
+			AccountInstances: r.AccountInstances,
+		}
+		if r.Meta != nil {
+			c.Weight = r.Meta.Weight
+			c.Limits = r.Meta.Capacity
+			if r.Meta.Region != "" {
+				c.Regions = append(c.Regions, r.Meta.Region)
+			}
+		}
+		candidates[i] = c
+	}
+	return candidates, nil
+}
@@ -0,0 +1,156 @@
+package graph
+
+import (
+	"context"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/nocloud/quota"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// QuotaSubject is account data quotas are resolved and checked against
+type QuotaSubject struct {
+	Account      string       `json:"account"`
+	AccountGroup string       `json:"account_group"`
+	Namespace    string       `json:"namespace"`
+	Overrides    quota.Limits `json:"overrides"`
+	Usage        quota.Usage  `json:"usage"`
+}
+
+func (q *QuotaSubject) Limits(conf quota.Config) quota.Limits {
+	return conf.Resolve(q.AccountGroup, q.Namespace, q.Overrides)
+}
+
+const getQuotaSubject = `
+LET account = DOCUMENT(@account)
+FILTER account != null
+LET ns = FIRST(
+	FOR node, edge IN 1 OUTBOUND account GRAPH @permissions
+	FILTER edge.role == @owner AND IS_SAME_COLLECTION(@namespaces, node)
+	RETURN node._key
+)
+LET services = (
+	FOR node, edge, path IN 2 OUTBOUND account GRAPH @permissions
+	FILTER path.edges[0].role == @owner AND IS_SAME_COLLECTION(@services, node)
+	FILTER node.status != @deleted
+	RETURN 1
+)
+LET resources = (
+	FOR node, edge, path IN 4 OUTBOUND account GRAPH @permissions
+	FILTER path.edges[0].role == @owner AND IS_SAME_COLLECTION(@instances, node)
+	FILTER node.status != @deleted
+	RETURN node.resources
+)
+LET spend = SUM(
+	FOR t IN @@transactions
+	FILTER t.account == account._key AND t.processed AND t.proc >= @since AND t.total > 0
+	RETURN t.total
+)
+RETURN {
+	account: account._key,
+	account_group: NOT_NULL(account.account_group, account.accountGroup, ""),
+	namespace: NOT_NULL(ns, ""),
+	overrides: NOT_NULL(account.quota, {}),
+	usage: {
+		instances: LENGTH(resources),
+		cpu: SUM(resources[*].cpu),
+		ram: SUM(resources[*].ram),
+		disk: SUM(resources[*].drive_size),
+		services: LENGTH(services),
+		monthly_spend: spend
+	}
+}
+`
+
+func GetQuotaSubject(ctx context.Context, db driver.Database, account string) (*QuotaSubject, error) {
+	res, err := queryAll[QuotaSubject](ctx, db, getQuotaSubject, map[string]interface{}{
+		"account":       driver.NewDocumentID(schema.ACCOUNTS_COL, account),
+		"permissions":   schema.PERMISSIONS_GRAPH.Name,
+		"owner":         roles.OWNER,
+		"namespaces":    schema.NAMESPACES_COL,
+		"services":      schema.SERVICES_COL,
+		"instances":     schema.INSTANCES_COL,
+		"deleted":       statuspb.NoCloudStatus_DEL,
+		"since":         quota.MonthStart(time.Now()).Unix(),
+		"@transactions": schema.TRANSACTIONS_COL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, driver.ArangoError{HasError: true, Code: 404, ErrorMessage: "account not found"}
+	}
+	return &res[0], nil
+}
+
+const setAccountQuota = `
+UPDATE @key WITH { quota: @quota } IN @@accounts OPTIONS { mergeObjects: false }
+`
+
+// SetAccountQuota replaces account's own limits, empty limits remove overrides
+func SetAccountQuota(ctx context.Context, db driver.Database, account string, limits quota.Limits) error {
+	var value interface{} = limits
+	if len(limits) == 0 {
+		value = nil
+	}
+	return execQuery(ctx, db, setAccountQuota, map[string]interface{}{
+		"key":       account,
+		"quota":     value,
+		"@accounts": schema.ACCOUNTS_COL,
+	})
+}
+
+const getOwnerAccount = `
+FOR node, edge, path IN 1..4 INBOUND @node GRAPH @permissions
+FILTER IS_SAME_COLLECTION(@accounts, node) AND path.edges[-1].role == @owner
+SORT LENGTH(path.edges)
+LIMIT 1
+RETURN node._key
+`
+
+// OwnerAccount finds closest account owning namespace, service, instances group or instance
+func OwnerAccount(ctx context.Context, db driver.Database, node driver.DocumentID) (string, error) {
+	res, err := queryAll[string](ctx, db, getOwnerAccount, map[string]interface{}{
+		"node":        node,
+		"permissions": schema.PERMISSIONS_GRAPH.Name,
+		"accounts":    schema.ACCOUNTS_COL,
+		"owner":       roles.OWNER,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 0 {
+		return "", driver.ArangoError{HasError: true, Code: 404, ErrorMessage: "owner not found"}
+	}
+	return res[0], nil
+}
+
+// ResourcesUsage converts instance resources into quota usage of one instance
+func ResourcesUsage(resources map[string]*structpb.Value) quota.Usage {
+	return quota.Usage{
+		quota.Instances: 1,
+		quota.CPU:       resources["cpu"].GetNumberValue(),
+		quota.RAM:       resources["ram"].GetNumberValue(),
+		quota.Disk:      resources["drive_size"].GetNumberValue(),
+	}
+}
+
+// CheckQuota returns quota.ExceededError if account can't take delta, zero delta checks current usage
+func CheckQuota(ctx context.Context, db driver.Database, conf quota.Config, account string, delta quota.Usage) error {
+	subject, err := GetQuotaSubject(ctx, db, account)
+	if err != nil {
+		return err
+	}
+	limits := subject.Limits(conf)
+	if len(limits) == 0 {
+		return nil
+	}
+	if len(delta) == 0 {
+		return limits.Over(subject.Usage)
+	}
+	return limits.Check(subject.Usage, delta)
+}
@@ -0,0 +1,168 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud/pkg/nocloud/risk"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+type RiskReview struct {
+	Approved   bool   `json:"approved"`
+	Comment    string `json:"comment,omitempty"`
+	ReviewedBy string `json:"reviewed_by"`
+	ReviewedAt int64  `json:"reviewed_at"`
+}
+
+// RiskProfile is stored as account's risk field
+type RiskProfile struct {
+	// Highest score and strictest decision over all stages
+	Score      int              `json:"score"`
+	Decision   risk.Decision    `json:"decision"`
+	Signup     *risk.Assessment `json:"signup,omitempty"`
+	FirstOrder *risk.Assessment `json:"first_order,omitempty"`
+	Review     *RiskReview      `json:"review,omitempty"`
+}
+
+// Add merges stage assessment into profile
+func (p *RiskProfile) Add(a *risk.Assessment) {
+	switch a.Stage {
+	case risk.StageSignup:
+		p.Signup = a
+	case risk.StageFirstOrder:
+		p.FirstOrder = a
+	}
+	// New findings reopen earlier review
+	if a.Decision != risk.Approve {
+		p.Review = nil
+	}
+	p.Score = max(p.Score, a.Score)
+	if p.Decision == "" {
+		p.Decision = risk.Approve
+	}
+	p.Decision = risk.Stricter(p.Decision, a.Decision)
+}
+
+// Effective is decision still in force, review overrides assessment
+func (p *RiskProfile) Effective() risk.Decision {
+	if p == nil || p.Decision == "" {
+		return risk.Approve
+	}
+	if p.Review != nil && p.Review.Approved {
+		return risk.Approve
+	}
+	return p.Decision
+}
+
+// RiskInput fills contact and billing data from account data, client data is set by caller
+func RiskInput(stage risk.Stage, account string, data map[string]interface{}) *risk.Input {
+	in := &risk.Input{Stage: stage, Account: account}
+	if data == nil {
+		return in
+	}
+	in.Email, _ = data["email"].(string)
+	in.BillingCountry, _ = data["country"].(string)
+	if phone, ok := data["phone_new"].(map[string]interface{}); ok {
+		number, _ := phone["phone_number"].(string)
+		cc, _ := phone["phone_cc"].(string)
+		if number != "" {
+			in.Phone = cc + number
+		}
+	}
+	return in
+}
+
+const getAccountRisk = `RETURN DOCUMENT(@@accounts, @account).risk`
+
+func GetAccountRisk(ctx context.Context, db driver.Database, account string) (*RiskProfile, error) {
+	c, err := db.Query(ctx, getAccountRisk, map[string]interface{}{
+		"@accounts": schema.ACCOUNTS_COL,
+		"account":   account,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	var profile *RiskProfile
+	if _, err := c.ReadDocument(ctx, &profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func SetAccountRisk(ctx context.Context, db driver.Database, account string, profile *RiskProfile) error {
+	col, err := db.Collection(ctx, schema.ACCOUNTS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.UpdateDocument(ctx, account, map[string]interface{}{"risk": profile})
+	return err
+}
+
+const listHeldAccounts = `
+FOR a IN @@accounts
+	FILTER a.deletion == null
+	FILTER a.risk.decision == "hold" && a.risk.review == null
+	SORT a.risk.score DESC
+	RETURN { uuid: a._key, title: a.title, risk: a.risk }
+`
+
+type HeldAccount struct {
+	Uuid  string       `json:"uuid"`
+	Title string       `json:"title"`
+	Risk  *RiskProfile `json:"risk"`
+}
+
+// ListHeldAccounts returns manual review queue
+func ListHeldAccounts(ctx context.Context, db driver.Database) ([]HeldAccount, error) {
+	return queryAll[HeldAccount](ctx, db, listHeldAccounts, map[string]interface{}{
+		"@accounts": schema.ACCOUNTS_COL,
+	})
+}
+
+const countAccountsByEmail = `
+FOR a IN @@accounts
+	FILTER a._key != @exclude && a.deletion == null
+	FILTER LOWER(a.data.email) == @email
+	COLLECT WITH COUNT INTO count
+	RETURN count
+`
+
+const countAccountsByPhone = `
+FOR a IN @@accounts
+	FILTER a._key != @exclude && a.deletion == null
+	FILTER a.data.phone_new != null
+	FILTER CONCAT(a.data.phone_new.phone_cc, a.data.phone_new.phone_number) == @phone
+	COLLECT WITH COUNT INTO count
+	RETURN count
+`
+
+type riskLookup struct {
+	db driver.Database
+}
+
+// NewRiskDuplicateLookup finds accounts sharing email or phone
+func NewRiskDuplicateLookup(db driver.Database) risk.DuplicateLookup {
+	return &riskLookup{db: db}
+}
+
+func (l *riskLookup) count(ctx context.Context, query, key, value, exclude string) (int, error) {
+	res, err := queryAll[int](ctx, l.db, query, map[string]interface{}{
+		"@accounts": schema.ACCOUNTS_COL,
+		key:         value,
+		"exclude":   exclude,
+	})
+	if err != nil || len(res) == 0 {
+		return 0, err
+	}
+	return res[0], nil
+}
+
+func (l *riskLookup) CountByEmail(ctx context.Context, email, exclude string) (int, error) {
+	return l.count(ctx, countAccountsByEmail, "email", email, exclude)
+}
+
+func (l *riskLookup) CountByPhone(ctx context.Context, phone, exclude string) (int, error) {
+	return l.count(ctx, countAccountsByPhone, "phone", phone, exclude)
+}
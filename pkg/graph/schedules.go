@@ -0,0 +1,201 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+// InstanceSchedule runs action on instance by cron expression
+type InstanceSchedule struct {
+	Key      string `json:"_key,omitempty"`
+	Instance string `json:"instance"`
+	// start, stop, reboot or snapshot, mapped to driver method by settings
+	Action   string                 `json:"action"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	Cron     string                 `json:"cron"`
+	Timezone string                 `json:"timezone,omitempty"`
+	Enabled  bool                   `json:"enabled"`
+
+	NextRun    int64  `json:"next_run"`
+	LastRun    int64  `json:"last_run,omitempty"`
+	LastStatus string `json:"last_status,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+	// Consecutive failed runs
+	Failures int `json:"failures"`
+
+	CreatedBy string `json:"created_by"`
+	Created   int64  `json:"created"`
+	Updated   int64  `json:"updated"`
+}
+
+const (
+	ScheduleRunSucceeded = "succeeded"
+	ScheduleRunFailed    = "failed"
+	// Instance state didn't allow run, e.g. suspended
+	ScheduleRunSkipped = "skipped"
+)
+
+type ScheduleRun struct {
+	Key      string `json:"_key,omitempty"`
+	Schedule string `json:"schedule"`
+	Instance string `json:"instance"`
+	Action   string `json:"action"`
+	Method   string `json:"method"`
+	// Account schedule was run as
+	Account  string `json:"account"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Started  int64  `json:"started"`
+	Finished int64  `json:"finished"`
+}
+
+func CreateInstanceSchedule(ctx context.Context, db driver.Database, sched *InstanceSchedule) (*InstanceSchedule, error) {
+	col, err := db.Collection(ctx, schema.INSTANCE_SCHEDULES_COL)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := col.CreateDocument(ctx, sched)
+	if err != nil {
+		return nil, err
+	}
+	sched.Key = meta.Key
+	return sched, nil
+}
+
+func GetInstanceSchedule(ctx context.Context, db driver.Database, key string) (*InstanceSchedule, error) {
+	col, err := db.Collection(ctx, schema.INSTANCE_SCHEDULES_COL)
+	if err != nil {
+		return nil, err
+	}
+	var sched InstanceSchedule
+	if _, err := col.ReadDocument(ctx, key, &sched); err != nil {
+		return nil, err
+	}
+	return &sched, nil
+}
+
+func UpdateInstanceSchedule(ctx context.Context, db driver.Database, sched *InstanceSchedule) error {
+	col, err := db.Collection(ctx, schema.INSTANCE_SCHEDULES_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.ReplaceDocument(ctx, sched.Key, sched)
+	return err
+}
+
+func DeleteInstanceSchedule(ctx context.Context, db driver.Database, key string) error {
+	col, err := db.Collection(ctx, schema.INSTANCE_SCHEDULES_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.RemoveDocument(ctx, key)
+	return err
+}
+
+const listInstanceSchedules = `
+FOR s IN @@col
+	FILTER s.instance == @instance
+	SORT s.created ASC
+	RETURN s
+`
+
+func ListInstanceSchedules(ctx context.Context, db driver.Database, instance string) ([]InstanceSchedule, error) {
+	return queryAll[InstanceSchedule](ctx, db, listInstanceSchedules, map[string]interface{}{
+		"@col":     schema.INSTANCE_SCHEDULES_COL,
+		"instance": instance,
+	})
+}
+
+const listDueSchedules = `
+FOR s IN @@col
+	FILTER s.enabled && s.next_run > 0 && s.next_run <= @now
+	SORT s.next_run ASC
+	LIMIT @limit
+	RETURN s
+`
+
+// ListDueSchedules returns enabled schedules which next run has come, oldest first
+func ListDueSchedules(ctx context.Context, db driver.Database, now int64, limit int) ([]InstanceSchedule, error) {
+	return queryAll[InstanceSchedule](ctx, db, listDueSchedules, map[string]interface{}{
+		"@col":  schema.INSTANCE_SCHEDULES_COL,
+		"now":   now,
+		"limit": limit,
+	})
+}
+
+const claimScheduleRun = `
+FOR s IN @@col
+	FILTER s._key == @key AND s.enabled AND s.next_run == @next_run
+	UPDATE s WITH { next_run: @next } IN @@col
+	RETURN 1
+`
+
+// ClaimScheduleRun atomically moves next_run forward, so only one replica runs the schedule.
+// Returns false if schedule was changed or claimed by someone else since nextRun was read
+func ClaimScheduleRun(ctx context.Context, db driver.Database, key string, nextRun, next int64) (bool, error) {
+	c, err := db.Query(ctx, claimScheduleRun, map[string]interface{}{
+		"@col":     schema.INSTANCE_SCHEDULES_COL,
+		"key":      key,
+		"next_run": nextRun,
+		"next":     next,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	return c.HasMore(), nil
+}
+
+func RecordScheduleRun(ctx context.Context, db driver.Database, run *ScheduleRun) error {
+	col, err := db.Collection(ctx, schema.SCHEDULE_RUNS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.CreateDocument(ctx, run)
+	return err
+}
+
+const listScheduleRuns = `
+FOR r IN @@col
+	FILTER r.schedule == @schedule
+	SORT r.started DESC
+	LIMIT @limit
+	RETURN r
+`
+
+func ListScheduleRuns(ctx context.Context, db driver.Database, schedule string, limit int) ([]ScheduleRun, error) {
+	return queryAll[ScheduleRun](ctx, db, listScheduleRuns, map[string]interface{}{
+		"@col":     schema.SCHEDULE_RUNS_COL,
+		"schedule": schedule,
+		"limit":    limit,
+	})
+}
+
+const pruneScheduleRuns = `
+FOR r IN @@col
+	FILTER r.started < @before
+	REMOVE r IN @@col
+`
+
+// PruneScheduleRuns drops history older than before
+func PruneScheduleRuns(ctx context.Context, db driver.Database, before int64) error {
+	return execQuery(ctx, db, pruneScheduleRuns, map[string]interface{}{
+		"@col":   schema.SCHEDULE_RUNS_COL,
+		"before": before,
+	})
+}
+
+const deleteSchedulesOfInstance = `
+FOR s IN @@col
+	FILTER s.instance == @instance
+	REMOVE s IN @@col
+`
+
+func DeleteSchedulesOfInstance(ctx context.Context, db driver.Database, instance string) error {
+	return execQuery(ctx, db, deleteSchedulesOfInstance, map[string]interface{}{
+		"@col":     schema.INSTANCE_SCHEDULES_COL,
+		"instance": instance,
+	})
+}
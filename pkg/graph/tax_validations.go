@@ -0,0 +1,73 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+)
+
+// TaxIDValidation is single VAT ID check kept for audits
+type TaxIDValidation struct {
+	Key                string `json:"_key,omitempty"`
+	Account            string `json:"account"`
+	Country            string `json:"country"`
+	TaxID              string `json:"tax_id"`
+	Valid              bool   `json:"valid"`
+	Name               string `json:"name,omitempty"`
+	Address            string `json:"address,omitempty"`
+	ConsultationNumber string `json:"consultation_number,omitempty"`
+	CheckedAt          int64  `json:"checked_at"`
+	Source             string `json:"source"`
+	Error              string `json:"error,omitempty"`
+	// Account or "system" for scheduled re-validation
+	Requester string `json:"requester,omitempty"`
+}
+
+func RecordTaxIDValidation(ctx context.Context, db driver.Database, rec *TaxIDValidation) error {
+	col, err := db.Collection(ctx, schema.TAX_ID_VALIDATIONS_COL)
+	if err != nil {
+		return err
+	}
+	_, err = col.CreateDocument(ctx, rec)
+	return err
+}
+
+const listTaxIDValidations = `
+FOR v IN @@col
+	FILTER v.account == @account
+	SORT v.checked_at DESC
+	LIMIT @limit
+	RETURN v
+`
+
+func ListTaxIDValidations(ctx context.Context, db driver.Database, account string, limit int) ([]TaxIDValidation, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	return queryAll[TaxIDValidation](ctx, db, listTaxIDValidations, map[string]interface{}{
+		"@col":    schema.TAX_ID_VALIDATIONS_COL,
+		"account": account,
+		"limit":   limit,
+	})
+}
+
+const listTaxIDsToRevalidate = `
+FOR a IN @@accounts
+	FILTER a.deletion == null
+	FILTER a.data.tax_id != null && a.data.tax_id != ""
+	LET v = a.data.tax_id_validation
+	FILTER v == null || v.checked_at < @before || (v.pending == true && v.checked_at < @retry_before)
+	LIMIT @limit
+	RETURN a._key
+`
+
+// ListTaxIDsToRevalidate returns accounts with VAT ID never checked, checked before given time or left pending before retryBefore
+func ListTaxIDsToRevalidate(ctx context.Context, db driver.Database, before, retryBefore int64, limit int) ([]string, error) {
+	return queryAll[string](ctx, db, listTaxIDsToRevalidate, map[string]interface{}{
+		"@accounts":    schema.ACCOUNTS_COL,
+		"before":       before,
+		"retry_before": retryBefore,
+		"limit":        limit,
+	})
+}
@@ -0,0 +1,569 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	go_sync "sync"
+	"sync/atomic"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/arangodb/go-driver"
+	"github.com/cskr/pubsub"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	stpb "github.com/slntopp/nocloud-proto/states"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/slntopp/nocloud/pkg/nocloud/worker"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	bulkSettingsKey = "bulk-operations"
+	// Job ids start with it, so services Stream can tell them from services
+	BulkJobPrefix = "bulk-"
+	bulkJobKey    = "bulk-jobs:%s"
+	bulkCancelKey = "bulk-jobs:%s:cancel"
+	// Progress is published to redis, so Stream on any replica can follow job running on another one
+	bulkProgressChannel = "bulk-jobs:%s:progress"
+	bulkTopicPrefix     = "bulk/"
+)
+
+const (
+	BulkJobRunning   = "running"
+	BulkJobCompleted = "completed"
+	BulkJobCanceled  = "canceled"
+
+	BulkItemPending   = "pending"
+	BulkItemSucceeded = "succeeded"
+	BulkItemFailed    = "failed"
+	BulkItemCanceled  = "canceled"
+)
+
+var bulkActions = []string{"invoke", "update", "transfer", "delete", "detach", "attach"}
+
+type BulkConf struct {
+	DefaultConcurrency int `json:"default_concurrency"`
+	MaxConcurrency     int `json:"max_concurrency"`
+	MaxItems           int `json:"max_items"`
+	// Hours finished job status is kept
+	RetentionHours int `json:"retention_hours"`
+}
+
+var defaultBulkSettings = &sc.Setting[BulkConf]{
+	Value: BulkConf{
+		DefaultConcurrency: 5,
+		MaxConcurrency:     20,
+		MaxItems:           1000,
+		RetentionHours:     24,
+	},
+	Description: "Bulk instances operations: concurrency, max instances per job and job status retention",
+	Level:       accesspb.Level_ADMIN,
+}
+
+type BulkRequest struct {
+	Action string `json:"action"`
+	// Either list of instances or filters as in instances List
+	Uuids   []string               `json:"uuids"`
+	Filters map[string]interface{} `json:"filters"`
+	// invoke: method, params; update: instance patch; transfer: account or ig
+	Params      map[string]interface{} `json:"params"`
+	Concurrency int                    `json:"concurrency"`
+}
+
+type BulkItem struct {
+	Uuid     string `json:"uuid"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Finished int64  `json:"finished,omitempty"`
+}
+
+type BulkJob struct {
+	ID        string     `json:"id"`
+	Action    string     `json:"action"`
+	Requester string     `json:"requester"`
+	Status    string     `json:"status"`
+	Total     int        `json:"total"`
+	Done      int        `json:"done"`
+	Succeeded int        `json:"succeeded"`
+	Failed    int        `json:"failed"`
+	Items     []BulkItem `json:"items"`
+	Created   int64      `json:"created"`
+	Updated   int64      `json:"updated"`
+	Finished  int64      `json:"finished,omitempty"`
+}
+
+// BulkProgress is published on every job change
+type BulkProgress struct {
+	Action    string `json:"action"`
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Done      int    `json:"done"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+}
+
+// bulkRun is job running on this replica
+type bulkRun struct {
+	mu  go_sync.Mutex
+	job *BulkJob
+	// Set on cancel, job takes no more instances but ones in progress aren't interrupted
+	stopped atomic.Bool
+}
+
+// SetupStatesPubSub sets states pubsub bulk jobs progress is published to
+func (s *InstancesServer) SetupStatesPubSub(ps *pubsub.PubSub) {
+	s.ps = ps
+}
+
+func getBulkSettings(log *zap.Logger) BulkConf {
+	var conf BulkConf
+	if scErr := sc.Fetch(bulkSettingsKey, &conf, defaultBulkSettings); scErr != nil {
+		log.Warn("Cannot fetch bulk operations settings", zap.Error(scErr))
+		conf = defaultBulkSettings.Value
+	}
+	return conf
+}
+
+// bulkTargets resolves instances job runs on, filters are applied with requester's access as in List
+func (s *InstancesServer) bulkTargets(ctx context.Context, req *BulkRequest) ([]string, error) {
+	if len(req.Uuids) > 0 {
+		uuids := slices.Clone(req.Uuids)
+		slices.Sort(uuids)
+		return slices.Compact(uuids), nil
+	}
+	if len(req.Filters) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Either uuids or filters are required")
+	}
+	filters, err := structpb.NewStruct(req.Filters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Malformed filters")
+	}
+	res, err := s.List(ctx, connect.NewRequest(&pb.ListInstancesRequest{Filters: filters.GetFields()}))
+	if err != nil {
+		return nil, err
+	}
+	uuids := make([]string, 0, len(res.Msg.GetPool()))
+	for _, item := range res.Msg.GetPool() {
+		if item.GetInstance().GetUuid() != "" {
+			uuids = append(uuids, item.GetInstance().GetUuid())
+		}
+	}
+	return uuids, nil
+}
+
+func stringParam(params map[string]interface{}, key string) string {
+	v, _ := params[key].(string)
+	return v
+}
+
+// bulkAction runs action on one instance through the same handler single requests use
+func (s *InstancesServer) bulkAction(ctx context.Context, action, id string, params map[string]interface{}) error {
+	var err error
+	switch action {
+	case "invoke":
+		args, _ := params["params"].(map[string]interface{})
+		fields, convErr := structpb.NewStruct(args)
+		if convErr != nil {
+			return convErr
+		}
+		_, err = s.Invoke(ctx, connect.NewRequest(&pb.InvokeRequest{Uuid: id, Method: stringParam(params, "method"), Params: fields.GetFields()}))
+	case "update":
+		patch, _ := json.Marshal(params["instance"])
+		inst := &pb.Instance{}
+		if err := protojson.Unmarshal(patch, inst); err != nil {
+			return fmt.Errorf("malformed instance patch: %w", err)
+		}
+		inst.Uuid = id
+		_, err = s.Update(ctx, connect.NewRequest(&pb.UpdateRequest{Instance: inst}))
+	case "transfer":
+		req := &pb.TransferInstanceRequest{Uuid: id, DoNotTransferInvoices: true}
+		if acc := stringParam(params, "account"); acc != "" {
+			req.Account = &acc
+		}
+		if ig := stringParam(params, "ig"); ig != "" {
+			req.Ig = &ig
+		}
+		_, err = s.TransferInstance(ctx, connect.NewRequest(req))
+	case "delete":
+		_, err = s.Delete(ctx, connect.NewRequest(&pb.DeleteRequest{Uuid: id}))
+	case "detach":
+		_, err = s.Detach(ctx, connect.NewRequest(&pb.DeleteRequest{Uuid: id}))
+	case "attach":
+		_, err = s.Attach(ctx, connect.NewRequest(&pb.DeleteRequest{Uuid: id}))
+	default:
+		err = fmt.Errorf("unsupported action %s", action)
+	}
+	return err
+}
+
+func validateBulkParams(req *BulkRequest) error {
+	switch req.Action {
+	case "invoke":
+		if stringParam(req.Params, "method") == "" {
+			return errors.New("params.method is required")
+		}
+	case "update":
+		if _, ok := req.Params["instance"].(map[string]interface{}); !ok {
+			return errors.New("params.instance is required")
+		}
+	case "transfer":
+		if (stringParam(req.Params, "account") == "") == (stringParam(req.Params, "ig") == "") {
+			return errors.New("exactly one of params.account and params.ig is required")
+		}
+	}
+	return nil
+}
+
+// StartBulkJob resolves instances and runs action on them in background, returns job right away
+func (s *InstancesServer) StartBulkJob(ctx context.Context, req *BulkRequest) (*BulkJob, error) {
+	log := s.log.Named("StartBulkJob")
+	requester, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(bulkActions, req.Action) {
+		return nil, status.Errorf(codes.InvalidArgument, "Unsupported action %s", req.Action)
+	}
+	if err := validateBulkParams(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	conf := getBulkSettings(log)
+	targets, err := s.bulkTargets(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "No instances match")
+	}
+	if conf.MaxItems > 0 && len(targets) > conf.MaxItems {
+		return nil, status.Errorf(codes.InvalidArgument, "Job has %d instances, at most %d allowed", len(targets), conf.MaxItems)
+	}
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = conf.DefaultConcurrency
+	}
+	concurrency = max(min(concurrency, conf.MaxConcurrency, len(targets)), 1)
+
+	now := time.Now().Unix()
+	job := &BulkJob{
+		ID:        BulkJobPrefix + uuid.New().String(),
+		Action:    req.Action,
+		Requester: requester,
+		Status:    BulkJobRunning,
+		Total:     len(targets),
+		Items:     make([]BulkItem, len(targets)),
+		Created:   now,
+		Updated:   now,
+	}
+	for i, id := range targets {
+		job.Items[i] = BulkItem{Uuid: id, Status: BulkItemPending}
+	}
+
+	// Job outlives request, but keeps requester so every item passes usual access checks
+	jobCtx := context.WithoutCancel(ctx)
+	run := &bulkRun{job: job}
+	s.bulkJobs.Store(job.ID, run)
+	s.saveBulkJob(ctx, log, run, conf)
+
+	params, _ := json.Marshal(req)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.INSTANCES_COL,
+		Uuid:      job.ID,
+		Scope:     "bulk",
+		Action:    req.Action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        now,
+		Snapshot:  &elpb.Snapshot{Diff: string(params)},
+	})
+
+	go s.runBulkJob(jobCtx, log.With(zap.String("job", job.ID)), conf, run, req, concurrency)
+	return job, nil
+}
+
+func (s *InstancesServer) runBulkJob(ctx context.Context, log *zap.Logger, conf BulkConf, run *bulkRun, req *BulkRequest, concurrency int) {
+	defer s.bulkJobs.Delete(run.job.ID)
+	log.Info("Bulk job started", zap.String("action", req.Action), zap.Int("total", run.job.Total), zap.Int("concurrency", concurrency))
+
+	w := worker.NewWorker(concurrency, 0)
+	for i := range run.job.Items {
+		w.Add(func() error {
+			id := run.job.Items[i].Uuid
+			if s.bulkCanceled(ctx, run) {
+				s.finishBulkItem(ctx, log, conf, run, i, BulkItemCanceled, nil)
+				return nil
+			}
+			err := s.bulkAction(ctx, req.Action, id, req.Params)
+			st := BulkItemSucceeded
+			if err != nil {
+				st = BulkItemFailed
+				log.Warn("Bulk item failed", zap.String("instance", id), zap.Error(err))
+			}
+			s.finishBulkItem(ctx, log, conf, run, i, st, err)
+			return nil
+		})
+	}
+	w.Start()
+
+	run.mu.Lock()
+	run.job.Status = BulkJobCompleted
+	if slices.ContainsFunc(run.job.Items, func(item BulkItem) bool { return item.Status == BulkItemCanceled }) {
+		run.job.Status = BulkJobCanceled
+	}
+	run.job.Finished = time.Now().Unix()
+	run.mu.Unlock()
+	s.saveBulkJob(ctx, log, run, conf)
+	log.Info("Bulk job finished", zap.Int("succeeded", run.job.Succeeded), zap.Int("failed", run.job.Failed))
+}
+
+func (s *InstancesServer) finishBulkItem(ctx context.Context, log *zap.Logger, conf BulkConf, run *bulkRun, i int, st string, err error) {
+	run.mu.Lock()
+	item := &run.job.Items[i]
+	item.Status, item.Finished = st, time.Now().Unix()
+	if err != nil {
+		item.Error = err.Error()
+	}
+	run.job.Done++
+	switch st {
+	case BulkItemSucceeded:
+		run.job.Succeeded++
+	case BulkItemFailed:
+		run.job.Failed++
+	}
+	run.mu.Unlock()
+	s.saveBulkJob(ctx, log, run, conf)
+}
+
+// saveBulkJob stores job status for any replica to read and publishes progress for Stream subscribers
+func (s *InstancesServer) saveBulkJob(ctx context.Context, log *zap.Logger, run *bulkRun, conf BulkConf) {
+	// Status must be stored even if request which started or canceled job is gone
+	ctx = context.WithoutCancel(ctx)
+	run.mu.Lock()
+	run.job.Updated = time.Now().Unix()
+	data, err := json.Marshal(run.job)
+	progress, _ := json.Marshal(BulkProgress{
+		Action:    run.job.Action,
+		Status:    run.job.Status,
+		Total:     run.job.Total,
+		Done:      run.job.Done,
+		Succeeded: run.job.Succeeded,
+		Failed:    run.job.Failed,
+	})
+	run.mu.Unlock()
+	if err != nil {
+		log.Error("Failed to marshal bulk job", zap.Error(err))
+		return
+	}
+
+	retention := time.Duration(max(conf.RetentionHours, 1)) * time.Hour
+	if err := s.rdb.Set(ctx, fmt.Sprintf(bulkJobKey, run.job.ID), data, retention).Err(); err != nil {
+		log.Warn("Failed to store bulk job", zap.Error(err))
+	}
+	if err := s.rdb.Publish(ctx, fmt.Sprintf(bulkProgressChannel, run.job.ID), progress).Err(); err != nil {
+		log.Warn("Failed to publish bulk job progress", zap.Error(err))
+	}
+}
+
+// publishBulkProgress passes progress to local Stream subscribers
+func (s *InstancesServer) publishBulkProgress(id string, p *BulkProgress) {
+	if s.ps == nil {
+		return
+	}
+	state := stpb.NoCloudState_RUNNING
+	if p.Status != BulkJobRunning {
+		state = stpb.NoCloudState_STOPPED
+	}
+	meta, _ := structpb.NewStruct(map[string]interface{}{
+		"action":    p.Action,
+		"status":    p.Status,
+		"total":     p.Total,
+		"done":      p.Done,
+		"succeeded": p.Succeeded,
+		"failed":    p.Failed,
+	})
+	s.ps.TryPub(&stpb.ObjectState{
+		Uuid:  id,
+		State: &stpb.State{State: state, Meta: meta.GetFields()},
+	}, bulkTopicPrefix+id)
+}
+
+// relayBulkProgress forwards progress of job, wherever it runs, to local Stream subscribers until job finishes.
+// Single relay is kept per job
+func (s *InstancesServer) relayBulkProgress(log *zap.Logger, id string, retention time.Duration) {
+	if _, relayed := s.bulkRelays.LoadOrStore(id, true); relayed {
+		return
+	}
+	go func() {
+		defer s.bulkRelays.Delete(id)
+		ctx, cancel := context.WithTimeout(context.Background(), retention)
+		defer cancel()
+		sub := s.rdb.Subscribe(ctx, fmt.Sprintf(bulkProgressChannel, id))
+		defer sub.Close()
+
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var p BulkProgress
+				if err := json.Unmarshal([]byte(msg.Payload), &p); err != nil {
+					log.Warn("Malformed bulk job progress", zap.String("job", id), zap.Error(err))
+					continue
+				}
+				s.publishBulkProgress(id, &p)
+				if p.Status != BulkJobRunning {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// bulkCanceled checks local stop flag, then flag set by replica cancel request was received on
+func (s *InstancesServer) bulkCanceled(ctx context.Context, run *bulkRun) bool {
+	if run.stopped.Load() {
+		return true
+	}
+	if s.rdb.Get(ctx, fmt.Sprintf(bulkCancelKey, run.job.ID)).Err() == nil {
+		run.stopped.Store(true)
+		return true
+	}
+	return false
+}
+
+func (s *InstancesServer) loadBulkJob(ctx context.Context, id string) (*BulkJob, error) {
+	data, err := s.rdb.Get(ctx, fmt.Sprintf(bulkJobKey, id)).Bytes()
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Job not found")
+	}
+	var job BulkJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, status.Error(codes.Internal, "Malformed job status")
+	}
+	return &job, nil
+}
+
+func (s *InstancesServer) GetBulkJob(ctx context.Context, id string) (*BulkJob, error) {
+	if _, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN); err != nil {
+		return nil, err
+	}
+	return s.loadBulkJob(ctx, id)
+}
+
+// CancelBulkJob stops job from taking new instances, ones in progress finish
+func (s *InstancesServer) CancelBulkJob(ctx context.Context, id string) (*BulkJob, error) {
+	log := s.log.Named("CancelBulkJob")
+	requester, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	job, err := s.loadBulkJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != BulkJobRunning {
+		return nil, status.Error(codes.FailedPrecondition, "Job is already finished")
+	}
+	// Job may run on another replica, it checks the flag before every instance
+	if err := s.rdb.Set(ctx, fmt.Sprintf(bulkCancelKey, id), requester, time.Duration(max(getBulkSettings(log).RetentionHours, 1))*time.Hour).Err(); err != nil {
+		log.Error("Failed to cancel bulk job", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to cancel job")
+	}
+	if run, ok := s.bulkJobs.Load(id); ok {
+		run.(*bulkRun).stopped.Store(true)
+	}
+	log.Info("Bulk job canceled", zap.String("job", id), zap.String("requester", requester))
+	return job, nil
+}
+
+// BulkStreamSource lets services Stream follow bulk job progress by job id
+func (s *InstancesServer) BulkStreamSource(ctx context.Context, requester, id string) ([]string, error) {
+	if !s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), accesspb.Level_ADMIN) {
+		return nil, errors.New("failed access check")
+	}
+	job, err := s.loadBulkJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == BulkJobRunning {
+		s.relayBulkProgress(s.log.Named("BulkStream"), id, time.Duration(max(getBulkSettings(s.log).RetentionHours, 1))*time.Hour)
+	}
+	return []string{bulkTopicPrefix + id}, nil
+}
+
+func (s *InstancesServer) RegisterBulkRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/instances/bulk", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleStartBulkJob))).Methods("POST")
+	router.Handle("/instances/bulk/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGetBulkJob))).Methods("GET")
+	router.Handle("/instances/bulk/{id}/cancel", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCancelBulkJob))).Methods("POST")
+}
+
+func (s *InstancesServer) HandleStartBulkJob(writer http.ResponseWriter, request *http.Request) {
+	var req BulkRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.StartBulkJob(request.Context(), &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusAccepted, res)
+}
+
+func (s *InstancesServer) HandleGetBulkJob(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.GetBulkJob(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleCancelBulkJob(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.CancelBulkJob(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
@@ -0,0 +1,64 @@
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	"github.com/go-redis/redis/v8"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	redisdb_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func liveContext(ctx context.Context) bool {
+	return ctx.Err() == nil
+}
+
+func TestCancelBulkJobStopsLocalRun(t *testing.T) {
+	job := &BulkJob{ID: BulkJobPrefix + "job", Status: BulkJobRunning}
+	data, err := json.Marshal(job)
+	require.NoError(t, err)
+
+	rdb := redisdb_mocks.NewMockClient(t)
+	rdb.EXPECT().Get(mock.Anything, fmt.Sprintf(bulkJobKey, job.ID)).Return(redis.NewStringResult(string(data), nil))
+	rdb.EXPECT().Set(mock.Anything, fmt.Sprintf(bulkCancelKey, job.ID), "admin", mock.Anything).Return(redis.NewStatusResult("OK", nil))
+	ca := graph_mocks.NewMockCommonActionsController(t)
+	ca.EXPECT().HasAccess(mock.Anything, "admin", driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), accesspb.Level_ADMIN).Return(true)
+	s := &InstancesServer{log: zap.NewNop(), rdb: rdb, ca: ca}
+
+	run := &bulkRun{job: job}
+	s.bulkJobs.Store(job.ID, run)
+
+	ctx := context.WithValue(context.Background(), nocloud.NoCloudAccount, "admin")
+	_, err = s.CancelBulkJob(ctx, job.ID)
+	require.NoError(t, err)
+
+	// Flag is checked before redis, so no more lookups are expected
+	assert.True(t, run.stopped.Load())
+	assert.True(t, s.bulkCanceled(ctx, run))
+}
+
+func TestSaveBulkJobOutlivesRequest(t *testing.T) {
+	job := &BulkJob{ID: BulkJobPrefix + "job", Action: "start", Status: BulkJobRunning, Total: 2, Done: 1, Succeeded: 1}
+	rdb := redisdb_mocks.NewMockClient(t)
+	rdb.EXPECT().Set(mock.MatchedBy(liveContext), fmt.Sprintf(bulkJobKey, job.ID), mock.Anything, mock.Anything).
+		Return(redis.NewStatusResult("OK", nil)).Once()
+	rdb.EXPECT().Publish(mock.MatchedBy(liveContext), fmt.Sprintf(bulkProgressChannel, job.ID), mock.MatchedBy(func(payload []byte) bool {
+		var p BulkProgress
+		return json.Unmarshal(payload, &p) == nil && p.Status == BulkJobRunning && p.Done == 1 && p.Total == 2
+	})).Return(redis.NewIntResult(1, nil)).Once()
+	s := &InstancesServer{log: zap.NewNop(), rdb: rdb}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.saveBulkJob(ctx, zap.NewNop(), &bulkRun{job: job}, BulkConf{RetentionHours: 1})
+}
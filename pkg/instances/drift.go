@@ -0,0 +1,416 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	go_sync "sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	epb "github.com/slntopp/nocloud-proto/events"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	spb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/drift"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	driftKey          = "instance-drift"
+	driftLockKey      = "instances-drift-lock"
+	driftCheckLockKey = "instances-drift-check-lock:"
+	driftCheckLockTTL = 10 * time.Minute
+)
+
+const releaseDriftCheckLockScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+  return redis.call("del", KEYS[1])
+end
+return 0
+`
+
+type DriftConf struct {
+	// Frequency in seconds
+	Frequency int `json:"frequency"`
+	// Share resources may differ by without being reported
+	Tolerance float64 `json:"tolerance"`
+	// Kinds of drift corrected without admin
+	AutoCorrect []string `json:"auto_correct"`
+	// Kind of drift -> driver method correcting it
+	Corrections map[string]string `json:"corrections"`
+	// Seconds drift has to persist before auto-correction, so transitions in progress aren't touched
+	Grace int `json:"grace"`
+	// Lowest severity admins are notified about, empty disables notifications
+	NotifySeverity string `json:"notify_severity"`
+	HistoryDays    int    `json:"history_days"`
+}
+
+var defaultDriftSettings = &sc.Setting[DriftConf]{
+	Value: DriftConf{
+		Frequency:   900,
+		Tolerance:   0.01,
+		AutoCorrect: []string{},
+		Corrections: map[string]string{
+			string(drift.RunningWhileSuspended): "suspend",
+			string(drift.SuspendedWhileActive):  "unsuspend",
+		},
+		Grace:          600,
+		NotifySeverity: string(drift.Critical),
+		HistoryDays:    30,
+	},
+	Description: "Drift detection between stored instances and driver reported state: frequency, tolerance, auto-corrected kinds and correcting methods",
+	Level:       accesspb.Level_ADMIN,
+}
+
+func getDriftSettings(log *zap.Logger) DriftConf {
+	var conf DriftConf
+	if scErr := sc.Fetch(driftKey, &conf, defaultDriftSettings); scErr != nil {
+		log.Warn("Cannot fetch drift detection settings", zap.Error(scErr))
+		conf = defaultDriftSettings.Value
+	}
+	return conf
+}
+
+func numbers(m map[string]interface{}) map[string]float64 {
+	res := make(map[string]float64, len(m))
+	for k, v := range m {
+		if n, ok := v.(float64); ok {
+			res[k] = n
+		}
+	}
+	return res
+}
+
+// observe puts stored instance next to what driver reported. Drivers report actual resources in state meta under "resources"
+func observe(c *graph.DriftCandidate) drift.Observed {
+	reported, _ := c.Meta["resources"].(map[string]interface{})
+	return drift.Observed{
+		Status:    c.Status.String(),
+		State:     c.State.String(),
+		Resources: numbers(c.Resources),
+		Reported:  numbers(reported),
+	}
+}
+
+func (s *InstancesServer) DriftRoutine(_ctx context.Context, wg *go_sync.WaitGroup) {
+	defer wg.Done()
+	ctx := context.WithoutCancel(_ctx)
+	log := s.log.Named("DriftRoutine")
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_DRIFTS_COL)
+
+start:
+	conf := getDriftSettings(log)
+	frequency := time.Duration(max(conf.Frequency, 60)) * time.Second
+
+	upd := make(chan bool, 1)
+	go sc.Subscribe([]string{driftKey}, upd)
+
+	log.Info("Got Configuration", zap.Any("conf", conf))
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+
+	for {
+		locked, err := s.rdb.SetNX(ctx, driftLockKey, time.Now().Unix(), frequency/2).Result()
+		if err != nil {
+			log.Error("Error acquiring drift lock", zap.Error(err))
+		} else if locked {
+			s.detectDrift(ctx, log, conf, "")
+		}
+
+		select {
+		case <-_ctx.Done():
+			log.Info("Context is done. Quitting")
+			return
+		case <-ticker.C:
+			continue
+		case <-upd:
+			log.Info("New Configuration Received, restarting Routine")
+			ticker.Stop()
+			goto start
+		}
+	}
+}
+
+// detectDrift compares instances of services provider, or of all of them if sp is empty
+func (s *InstancesServer) detectDrift(ctx context.Context, log *zap.Logger, conf DriftConf, sp string) {
+	sps := []string{sp}
+	if sp == "" {
+		pool, err := s.sp_ctrl.List(ctx, schema.ROOT_ACCOUNT_KEY, true)
+		if err != nil {
+			log.Error("Failed to get ServicesProviders", zap.Error(err))
+			return
+		}
+		sps = sps[:0]
+		for _, p := range pool {
+			if p.GetStatus() != spb.NoCloudStatus_DEL {
+				sps = append(sps, p.GetUuid())
+			}
+		}
+	}
+	for _, sp := range sps {
+		s.detectSpDrift(ctx, log.With(zap.String("sp", sp)), conf, sp)
+	}
+	if conf.HistoryDays > 0 {
+		if err := graph.PruneInstanceDrifts(ctx, s.db, time.Now().AddDate(0, 0, -conf.HistoryDays).Unix()); err != nil {
+			log.Warn("Error pruning resolved drifts", zap.Error(err))
+		}
+	}
+}
+
+// detectSpDrift compares stored instances with state last pushed by driver. Driver isn't queried here:
+// state comes from monitoring pushes through states pubsub into inst.state, so instance that vanished
+// from provider without DELETED being pushed isn't reported as missing
+func (s *InstancesServer) detectSpDrift(ctx context.Context, log *zap.Logger, conf DriftConf, sp string) {
+	candidates, err := graph.ListDriftCandidates(ctx, s.db, sp)
+	if err != nil {
+		log.Error("Error listing instances", zap.Error(err))
+		return
+	}
+	now := time.Now().Unix()
+	var found int
+	for i := range candidates {
+		c := &candidates[i]
+		for _, diff := range drift.Classify(observe(c), conf.Tolerance) {
+			d, isNew, err := graph.ObserveInstanceDrift(ctx, s.db, &graph.InstanceDrift{
+				Instance: c.Uuid, Title: c.Title, Sp: sp, Difference: diff,
+			}, now)
+			if err != nil || d == nil {
+				log.Error("Error storing drift", zap.String("instance", c.Uuid), zap.Error(err))
+				continue
+			}
+			found++
+			if isNew {
+				s.reportDrift(log, conf, d, "drift_detected", schema.ROOT_ACCOUNT_KEY)
+			}
+			if d.Corrected == 0 && slices.Contains(conf.AutoCorrect, string(d.Kind)) && now-d.FirstSeen >= int64(conf.Grace) {
+				_ = s.correctDrift(ctx, log, conf, d, schema.ROOT_ACCOUNT_KEY)
+			}
+		}
+	}
+
+	resolved, err := graph.ResolveInstanceDrifts(ctx, s.db, sp, now, now)
+	if err != nil {
+		log.Error("Error resolving drifts", zap.Error(err))
+	}
+	for i := range resolved {
+		s.reportDrift(log, conf, &resolved[i], "drift_resolved", schema.ROOT_ACCOUNT_KEY)
+	}
+	log.Debug("Drift detection finished", zap.Int("instances", len(candidates)), zap.Int("open", found), zap.Int("resolved", len(resolved)))
+}
+
+// reportDrift logs drift to instance's events and notifies admins about severe new ones
+func (s *InstancesServer) reportDrift(log *zap.Logger, conf DriftConf, d *graph.InstanceDrift, action, requester string) {
+	diff, _ := json.Marshal(d)
+	event := &elpb.Event{
+		Entity:    schema.INSTANCES_COL,
+		Uuid:      d.Instance,
+		Scope:     "driver",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot:  &elpb.Snapshot{Diff: string(diff)},
+	}
+	if action == "drift_corrected" && d.CorrectionError != "" {
+		event.Rc = 1
+	}
+	nocloud.Log(log, event)
+
+	if action != "drift_detected" || s.events == nil || conf.NotifySeverity == "" || !d.Severity.AtLeast(drift.Severity(conf.NotifySeverity)) {
+		return
+	}
+	if err := s.events(&epb.Event{
+		Type: "email",
+		Uuid: schema.ROOT_ACCOUNT_KEY,
+		Key:  "instance_drift",
+		Data: map[string]*structpb.Value{
+			"instance":       structpb.NewStringValue(d.Instance),
+			"instance_title": structpb.NewStringValue(d.Title),
+			"sp":             structpb.NewStringValue(d.Sp),
+			"kind":           structpb.NewStringValue(string(d.Kind)),
+			"severity":       structpb.NewStringValue(string(d.Severity)),
+			"field":          structpb.NewStringValue(d.Field),
+			"expected":       structpb.NewStringValue(d.Expected),
+			"actual":         structpb.NewStringValue(d.Actual),
+		},
+		Ts: time.Now().Unix(),
+	}); err != nil {
+		log.Error("Failed to publish drift notification", zap.String("drift", d.Key), zap.Error(err))
+	}
+}
+
+// correctDrift invokes driver method configured for kind of drift as root
+func (s *InstancesServer) correctDrift(ctx context.Context, log *zap.Logger, conf DriftConf, d *graph.InstanceDrift, requester string) error {
+	method := conf.Corrections[string(d.Kind)]
+	if method == "" {
+		return status.Errorf(codes.FailedPrecondition, "No correction configured for %s", d.Kind)
+	}
+	log = log.With(zap.String("drift", d.Key), zap.String("method", method))
+	log.Info("Correcting drift")
+
+	_, err := s.Invoke(rootContext(ctx), connect.NewRequest(&pb.InvokeRequest{Uuid: d.Instance, Method: method}))
+	d.Corrected, d.CorrectedBy, d.CorrectionError = time.Now().Unix(), requester, ""
+	if err != nil {
+		log.Warn("Drift correction failed", zap.Error(err))
+		d.CorrectionError = err.Error()
+	}
+	if err := graph.UpdateInstanceDrift(ctx, s.db, d); err != nil {
+		log.Error("Error updating drift", zap.Error(err))
+	}
+	s.reportDrift(log, conf, d, "drift_corrected", requester)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Correction failed: %v", err)
+	}
+	return nil
+}
+
+func (s *InstancesServer) ListInstanceDrifts(ctx context.Context, filter graph.InstanceDriftsFilter) ([]graph.InstanceDrift, error) {
+	log := s.log.Named("ListInstanceDrifts")
+	if _, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN); err != nil {
+		return nil, err
+	}
+	if filter.Limit <= 0 || filter.Limit > 1000 {
+		filter.Limit = 1000
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_DRIFTS_COL)
+	res, err := graph.ListInstanceDrifts(ctx, s.db, filter)
+	if err != nil {
+		log.Error("Error listing drifts", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing drifts")
+	}
+	return res, nil
+}
+
+// CheckDrift runs detection right away, for services provider if set.
+// Same scope isn't checked twice at once, lock is released as soon as detection is done
+func (s *InstancesServer) CheckDrift(ctx context.Context, sp string) ([]graph.InstanceDrift, error) {
+	log := s.log.Named("CheckDrift")
+	if _, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN); err != nil {
+		return nil, err
+	}
+	if sp != "" {
+		if _, err := s.sp_ctrl.Get(ctx, sp); err != nil {
+			return nil, status.Error(codes.NotFound, "Services provider not found")
+		}
+	}
+	key, token := driftCheckLockKey+sp, uuid.New().String()
+	locked, err := s.rdb.SetNX(ctx, key, token, driftCheckLockTTL).Result()
+	if err != nil {
+		log.Error("Error acquiring drift check lock", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error acquiring drift check lock")
+	}
+	if !locked {
+		return nil, status.Error(codes.Aborted, "Drift check is already running, try again later")
+	}
+	defer func() {
+		if err := s.rdb.Eval(context.WithoutCancel(ctx), releaseDriftCheckLockScript, []string{key}, token).Err(); err != nil {
+			log.Warn("Failed to release drift check lock", zap.String("key", key), zap.Error(err))
+		}
+	}()
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_DRIFTS_COL)
+	s.detectDrift(context.WithoutCancel(ctx), log, getDriftSettings(log), sp)
+	return s.ListInstanceDrifts(ctx, graph.InstanceDriftsFilter{Sp: sp})
+}
+
+// CorrectInstanceDrift applies correction of open drift on admin's request, regardless of auto-correction settings
+func (s *InstancesServer) CorrectInstanceDrift(ctx context.Context, id string) (*graph.InstanceDrift, error) {
+	log := s.log.Named("CorrectInstanceDrift")
+	requester, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	d, err := graph.GetInstanceDrift(ctx, s.db, id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Drift not found")
+	}
+	if d.Resolved > 0 {
+		return nil, status.Error(codes.FailedPrecondition, "Drift is already resolved")
+	}
+	if err := s.correctDrift(ctx, log, getDriftSettings(log), d, requester); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+func (s *InstancesServer) RegisterDriftRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/instances/drift", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListInstanceDrifts))).Methods("GET")
+	router.Handle("/instances/drift/check", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCheckDrift))).Methods("POST")
+	router.Handle("/instances/drift/{id}/correct", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCorrectInstanceDrift))).Methods("POST")
+}
+
+func (s *InstancesServer) HandleListInstanceDrifts(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	all, _ := strconv.ParseBool(q.Get("all"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	res, err := s.ListInstanceDrifts(request.Context(), graph.InstanceDriftsFilter{
+		Sp:       q.Get("sp"),
+		Instance: q.Get("instance"),
+		Kind:     q.Get("kind"),
+		All:      all,
+		Limit:    limit,
+	})
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleCheckDrift(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Sp string `json:"sp"`
+	}
+	if request.ContentLength != 0 {
+		if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+			http.Error(writer, "Malformed request body", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := s.CheckDrift(request.Context(), req.Sp)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleCorrectInstanceDrift(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.CorrectInstanceDrift(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
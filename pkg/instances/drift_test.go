@@ -0,0 +1,52 @@
+package instances
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	redisdb_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckDriftSkipsRunningCheck(t *testing.T) {
+	rdb := redisdb_mocks.NewMockClient(t)
+	rdb.EXPECT().SetNX(mock.Anything, driftCheckLockKey, mock.Anything, driftCheckLockTTL).Return(redis.NewBoolResult(false, nil)).Once()
+	s, ctx := rootAdminServer(t, driver_mocks.NewMockDatabase(t))
+	s.rdb = rdb
+
+	// Another check holds the lock, nothing is detected
+	_, err := s.CheckDrift(ctx, "")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestCheckDriftReleasesLock(t *testing.T) {
+	var token interface{}
+	rdb := redisdb_mocks.NewMockClient(t)
+	rdb.EXPECT().SetNX(mock.Anything, driftCheckLockKey, mock.Anything, driftCheckLockTTL).Run(func(_ context.Context, _ string, value interface{}, _ time.Duration) {
+		token = value
+	}).Return(redis.NewBoolResult(true, nil)).Once()
+	rdb.EXPECT().Eval(mock.Anything, releaseDriftCheckLockScript, []string{driftCheckLockKey}, mock.MatchedBy(func(v interface{}) bool {
+		return v == token
+	})).Return(redis.NewCmdResult(int64(1), nil)).Once()
+
+	db := driver_mocks.NewMockDatabase(t)
+	db.EXPECT().CollectionExists(mock.Anything, schema.INSTANCE_DRIFTS_COL).Return(true, nil)
+	db.EXPECT().Collection(mock.Anything, schema.INSTANCE_DRIFTS_COL).Return(driver_mocks.NewMockCollection(t), nil)
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(nil, assert.AnError)
+	sp := graph_mocks.NewMockServicesProvidersController(t)
+	sp.EXPECT().List(mock.Anything, schema.ROOT_ACCOUNT_KEY, true).Return(nil, assert.AnError)
+
+	s, ctx := rootAdminServer(t, db)
+	s.rdb, s.sp_ctrl = rdb, sp
+
+	_, err := s.CheckDrift(ctx, "")
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
@@ -0,0 +1,837 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/ipam"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const ipamKey = "ipam"
+
+type IPAMConf struct {
+	// Write PTR records to DNS zones
+	PushPTR bool `json:"push_ptr"`
+	PTRTTL  int  `json:"ptr_ttl"`
+	// Attempts to take free address if it was taken concurrently
+	AllocateRetries int `json:"allocate_retries"`
+}
+
+var defaultIPAMSettings = &sc.Setting[IPAMConf]{
+	Value: IPAMConf{
+		PushPTR:         true,
+		PTRTTL:          3600,
+		AllocateRetries: 5,
+	},
+	Description: "IP address management: whether PTR records are pushed to DNS, their TTL and allocation retries",
+	Level:       accesspb.Level_ADMIN,
+}
+
+func getIPAMSettings(log *zap.Logger) IPAMConf {
+	var conf IPAMConf
+	if scErr := sc.Fetch(ipamKey, &conf, defaultIPAMSettings); scErr != nil {
+		log.Warn("Cannot fetch ipam settings", zap.Error(scErr))
+		conf = defaultIPAMSettings.Value
+	}
+	return conf
+}
+
+type AllocateIPRequest struct {
+	// Pool to take address from, pools of instance's services provider are tried otherwise
+	Pool    string `json:"pool"`
+	Version int    `json:"version"`
+	Public  *bool  `json:"public"`
+	// Exact address to take, next free one otherwise
+	Address string `json:"address"`
+	PTR     string `json:"ptr"`
+}
+
+type parsedPool struct {
+	*graph.IPPool
+	prefix   netip.Prefix
+	reserved []ipam.Range
+}
+
+// parsePool validates pool, gateway is reserved implicitly
+func parsePool(pool *graph.IPPool) (*parsedPool, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(pool.CIDR))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr: %w", err)
+	}
+	res := &parsedPool{IPPool: pool, prefix: prefix.Masked()}
+	for _, r := range pool.Reserved {
+		rng, err := ipam.ParseRange(r)
+		if err != nil {
+			return nil, err
+		}
+		res.reserved = append(res.reserved, rng)
+	}
+	if pool.Gateway != "" {
+		gw, err := netip.ParseAddr(pool.Gateway)
+		if err != nil || !res.prefix.Contains(gw) {
+			return nil, fmt.Errorf("gateway %s is not in %s", pool.Gateway, pool.CIDR)
+		}
+		res.reserved = append(res.reserved, ipam.Range{From: gw, To: gw})
+	}
+	return res, nil
+}
+
+func (p *parsedPool) zone() string {
+	if p.PTRZone != "" {
+		return p.PTRZone
+	}
+	return ipam.ReverseZone(p.prefix)
+}
+
+func (s *InstancesServer) logIPEvent(log *zap.Logger, entity, uuid, action, requester string, diff any) {
+	data, _ := json.Marshal(diff)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    entity,
+		Uuid:      uuid,
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot:  &elpb.Snapshot{Diff: string(data)},
+	})
+}
+
+// pushPTR writes PTR record of address to reverse zone served by DNS, empty ptr removes it
+func (s *InstancesServer) pushPTR(ctx context.Context, conf IPAMConf, pool *parsedPool, address, ptr string) error {
+	if !conf.PushPTR {
+		return nil
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return err
+	}
+	zone := pool.zone()
+	loc, ok := ipam.Location(addr, zone)
+	if !ok {
+		return fmt.Errorf("address %s is not in zone %s", address, zone)
+	}
+	return s.dns_srv.SetPTR(ctx, zone, loc, ptr, conf.PTRTTL)
+}
+
+func validPTR(ptr string) bool {
+	ptr = strings.TrimSuffix(ptr, ".")
+	if ptr == "" || len(ptr) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(ptr, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkOverlap rejects pool which subnet overlaps subnet of other pool, same address could be given out twice otherwise
+func (s *InstancesServer) checkOverlap(ctx context.Context, log *zap.Logger, pool *parsedPool) error {
+	pools, err := graph.ListIPPools(ctx, s.db, "")
+	if err != nil {
+		log.Error("Error listing pools", zap.Error(err))
+		return status.Error(codes.Internal, "Error checking pools overlap")
+	}
+	for _, p := range pools {
+		if p.Key == pool.Key {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p.CIDR)
+		if err != nil {
+			log.Warn("Pool has invalid cidr", zap.String("pool", p.Key), zap.String("cidr", p.CIDR))
+			continue
+		}
+		if prefix.Overlaps(pool.prefix) {
+			return status.Errorf(codes.AlreadyExists, "Subnet %s overlaps %s of pool %s", pool.prefix, p.CIDR, p.Key)
+		}
+	}
+	return nil
+}
+
+func (s *InstancesServer) CreateIPPool(ctx context.Context, pool *graph.IPPool) (*graph.IPPool, error) {
+	log := s.log.Named("CreateIPPool")
+	requester, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	if pool.Sp == "" {
+		return nil, status.Error(codes.InvalidArgument, "Services provider is required")
+	}
+	if _, err := s.sp_ctrl.Get(ctx, pool.Sp); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Services provider not found")
+	}
+	parsed, err := parsePool(pool)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	pool.CIDR = parsed.prefix.String()
+	pool.Key = ""
+	pool.Created = time.Now().Unix()
+	pool.Updated = pool.Created
+
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_POOLS_COL)
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_ADDRESSES_COL)
+	if err := s.checkOverlap(ctx, log, parsed); err != nil {
+		return nil, err
+	}
+	if pool, err = graph.CreateIPPool(ctx, s.db, pool); err != nil {
+		log.Error("Error creating pool", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error creating pool")
+	}
+	s.logIPEvent(log, schema.IP_POOLS_COL, pool.Key, "create", requester, pool)
+	return pool, nil
+}
+
+func (s *InstancesServer) ListIPPools(ctx context.Context, sp string) ([]graph.IPPoolWithUsage, error) {
+	log := s.log.Named("ListIPPools")
+	if _, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN); err != nil {
+		return nil, err
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_POOLS_COL)
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_ADDRESSES_COL)
+	res, err := graph.ListIPPools(ctx, s.db, sp)
+	if err != nil {
+		log.Error("Error listing pools", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing pools")
+	}
+	return res, nil
+}
+
+func (s *InstancesServer) GetIPPool(ctx context.Context, id string) (*graph.IPPool, error) {
+	if _, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN); err != nil {
+		return nil, err
+	}
+	pool, err := graph.GetIPPool(ctx, s.db, id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Pool not found")
+	}
+	return pool, nil
+}
+
+// UpdateIPPool changes pool settings, subnet and services provider can't be changed while addresses are allocated
+// and allocated addresses can't be reserved
+func (s *InstancesServer) UpdateIPPool(ctx context.Context, id string, req *graph.IPPool) (*graph.IPPool, error) {
+	log := s.log.Named("UpdateIPPool")
+	requester, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := graph.GetIPPool(ctx, s.db, id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Pool not found")
+	}
+	allocs, err := graph.ListIPAllocations(ctx, s.db, id, "")
+	if err != nil {
+		log.Error("Error listing allocations", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error updating pool")
+	}
+	if len(allocs) > 0 && ((req.CIDR != "" && req.CIDR != pool.CIDR) || (req.Sp != "" && req.Sp != pool.Sp)) {
+		return nil, status.Error(codes.FailedPrecondition, "Pool has allocated addresses, subnet and services provider can't be changed")
+	}
+	req.Key, req.Created, req.Updated = pool.Key, pool.Created, time.Now().Unix()
+	if req.Sp == "" {
+		req.Sp = pool.Sp
+	}
+	if req.CIDR == "" {
+		req.CIDR = pool.CIDR
+	}
+	parsed, err := parsePool(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req.CIDR = parsed.prefix.String()
+	for _, alloc := range allocs {
+		addr, err := netip.ParseAddr(alloc.Address)
+		if err == nil && errors.Is(ipam.Check(parsed.prefix, parsed.reserved, addr), ipam.ErrReserved) {
+			return nil, status.Errorf(codes.FailedPrecondition, "Address %s is allocated to instance %s, it can't be reserved", alloc.Address, alloc.Instance)
+		}
+	}
+	if err := s.checkOverlap(ctx, log, parsed); err != nil {
+		return nil, err
+	}
+	if err := graph.UpdateIPPool(ctx, s.db, req); err != nil {
+		log.Error("Error updating pool", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error updating pool")
+	}
+	s.logIPEvent(log, schema.IP_POOLS_COL, req.Key, "update", requester, req)
+	return req, nil
+}
+
+func (s *InstancesServer) DeleteIPPool(ctx context.Context, id string) error {
+	log := s.log.Named("DeleteIPPool")
+	requester, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN)
+	if err != nil {
+		return err
+	}
+	allocs, err := graph.ListIPAllocations(ctx, s.db, id, "")
+	if err != nil {
+		log.Error("Error listing allocations", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting pool")
+	}
+	if len(allocs) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "Pool has %d allocated addresses", len(allocs))
+	}
+	if err := graph.DeleteIPPool(ctx, s.db, id); err != nil {
+		return status.Error(codes.NotFound, "Pool not found")
+	}
+	s.logIPEvent(log, schema.IP_POOLS_COL, id, "delete", requester, nil)
+	return nil
+}
+
+func (s *InstancesServer) ListPoolAddresses(ctx context.Context, id string) ([]graph.IPAllocation, error) {
+	log := s.log.Named("ListPoolAddresses")
+	if _, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN); err != nil {
+		return nil, err
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_ADDRESSES_COL)
+	res, err := graph.ListIPAllocations(ctx, s.db, id, "")
+	if err != nil {
+		log.Error("Error listing allocations", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing addresses")
+	}
+	return res, nil
+}
+
+// candidatePools returns pools address may be taken from for instance
+func (s *InstancesServer) candidatePools(ctx context.Context, instance string, req *AllocateIPRequest) ([]*parsedPool, error) {
+	if req.Pool != "" {
+		pool, err := graph.GetIPPool(ctx, s.db, req.Pool)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, "Pool not found")
+		}
+		parsed, err := parsePool(pool)
+		if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "Pool is misconfigured: %v", err)
+		}
+		return []*parsedPool{parsed}, nil
+	}
+	group, err := s.ctrl.GetGroup(ctx, driver.NewDocumentID(schema.INSTANCES_COL, instance).String())
+	if err != nil || group.SP == nil {
+		return nil, status.Error(codes.FailedPrecondition, "Instance is not linked to services provider")
+	}
+	pools, err := graph.ListIPPools(ctx, s.db, group.SP.GetUuid())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error listing pools")
+	}
+	res := make([]*parsedPool, 0, len(pools))
+	for i := range pools {
+		parsed, err := parsePool(&pools[i].IPPool)
+		if err != nil {
+			continue
+		}
+		if req.Version == 4 && !parsed.prefix.Addr().Is4() || req.Version == 6 && !parsed.prefix.Addr().Is6() {
+			continue
+		}
+		if req.Public != nil && *req.Public != parsed.Public {
+			continue
+		}
+		res = append(res, parsed)
+	}
+	if len(res) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "No matching pools for instance's services provider")
+	}
+	return res, nil
+}
+
+// allocateFrom takes address from pool, retrying if free address was taken concurrently
+func (s *InstancesServer) allocateFrom(ctx context.Context, conf IPAMConf, pool *parsedPool, alloc *graph.IPAllocation, address string) error {
+	if address != "" {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, "Invalid address")
+		}
+		if err := ipam.Check(pool.prefix, pool.reserved, addr); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		alloc.Address = addr.String()
+		if err := graph.CreateIPAllocation(ctx, s.db, alloc); err != nil {
+			if driver.IsConflict(err) {
+				return status.Error(codes.AlreadyExists, "Address is already allocated")
+			}
+			return err
+		}
+		return nil
+	}
+
+	allocs, err := graph.ListIPAllocations(ctx, s.db, pool.Key, "")
+	if err != nil {
+		return err
+	}
+	used := make(map[netip.Addr]struct{}, len(allocs))
+	for _, a := range allocs {
+		if addr, err := netip.ParseAddr(a.Address); err == nil {
+			used[addr] = struct{}{}
+		}
+	}
+	for i := 0; i <= conf.AllocateRetries; i++ {
+		addr, err := ipam.NextFree(pool.prefix, pool.reserved, used)
+		if err != nil {
+			return err
+		}
+		alloc.Address = addr.String()
+		err = graph.CreateIPAllocation(ctx, s.db, alloc)
+		if err == nil {
+			return nil
+		}
+		if !driver.IsConflict(err) {
+			return err
+		}
+		used[addr] = struct{}{}
+	}
+	return ipam.ErrExhausted
+}
+
+// AllocateIP binds address to instance, opening its holding period in history
+func (s *InstancesServer) AllocateIP(ctx context.Context, instance string, req *AllocateIPRequest) (*graph.IPAllocation, error) {
+	log := s.log.Named("AllocateIP").With(zap.String("instance", instance))
+	requester, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	if req.PTR != "" && !validPTR(req.PTR) {
+		return nil, status.Error(codes.InvalidArgument, "Invalid PTR hostname")
+	}
+	conf := getIPAMSettings(log)
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_ADDRESSES_COL)
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_HISTORY_COL)
+
+	account, err := graph.OwnerAccount(ctx, s.db, driver.NewDocumentID(schema.INSTANCES_COL, instance))
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Instance owner not found")
+	}
+	pools, err := s.candidatePools(ctx, instance, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var alloc *graph.IPAllocation
+	for _, pool := range pools {
+		alloc = &graph.IPAllocation{
+			Pool:        pool.Key,
+			Sp:          pool.Sp,
+			Public:      pool.Public,
+			Instance:    instance,
+			Account:     account,
+			PTR:         req.PTR,
+			Allocated:   time.Now().Unix(),
+			AllocatedBy: requester,
+		}
+		if err = s.allocateFrom(ctx, conf, pool, alloc, req.Address); err == nil {
+			break
+		}
+		if !errors.Is(err, ipam.ErrExhausted) {
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			log.Error("Error allocating address", zap.String("pool", pool.Key), zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error allocating address")
+		}
+	}
+	if err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	if err := graph.OpenIPHistory(ctx, s.db, &graph.IPHistoryEntry{
+		Address:  alloc.Address,
+		Pool:     alloc.Pool,
+		Instance: instance,
+		Account:  account,
+		From:     alloc.Allocated,
+		By:       requester,
+	}); err != nil {
+		log.Error("Error recording address history", zap.Error(err))
+	}
+	if alloc.PTR != "" {
+		for _, pool := range pools {
+			if pool.Key != alloc.Pool {
+				continue
+			}
+			if err := s.pushPTR(ctx, conf, pool, alloc.Address, alloc.PTR); err != nil {
+				log.Error("Error pushing PTR record", zap.Error(err))
+			}
+		}
+	}
+	s.logIPEvent(log, schema.INSTANCES_COL, instance, "ip_allocate", requester, alloc)
+	return alloc, nil
+}
+
+// release removes allocation, its PTR record and closes holding period
+func (s *InstancesServer) release(ctx context.Context, log *zap.Logger, conf IPAMConf, alloc *graph.IPAllocation, by, reason string) error {
+	if err := graph.DeleteIPAllocation(ctx, s.db, alloc.Key); err != nil {
+		return err
+	}
+	if err := graph.CloseIPHistory(ctx, s.db, alloc.Pool, alloc.Address, by, reason, time.Now().Unix()); err != nil {
+		log.Error("Error closing address history", zap.String("address", alloc.Address), zap.Error(err))
+	}
+	if alloc.PTR == "" {
+		return nil
+	}
+	pool, err := graph.GetIPPool(ctx, s.db, alloc.Pool)
+	if err != nil {
+		return nil
+	}
+	if parsed, err := parsePool(pool); err == nil {
+		if err := s.pushPTR(ctx, conf, parsed, alloc.Address, ""); err != nil {
+			log.Error("Error removing PTR record", zap.String("address", alloc.Address), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (s *InstancesServer) instanceAllocation(ctx context.Context, instance, address string) (*graph.IPAllocation, error) {
+	allocs, err := graph.ListIPAllocations(ctx, s.db, "", instance)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error listing addresses")
+	}
+	for i := range allocs {
+		if allocs[i].Address == address {
+			return &allocs[i], nil
+		}
+	}
+	return nil, status.Error(codes.NotFound, "Address is not allocated to instance")
+}
+
+func (s *InstancesServer) ReleaseIP(ctx context.Context, instance, address string) error {
+	log := s.log.Named("ReleaseIP").With(zap.String("instance", instance), zap.String("address", address))
+	requester, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN)
+	if err != nil {
+		return err
+	}
+	alloc, err := s.instanceAllocation(ctx, instance, address)
+	if err != nil {
+		return err
+	}
+	if err := s.release(ctx, log, getIPAMSettings(log), alloc, requester, graph.IPReleased); err != nil {
+		log.Error("Error releasing address", zap.Error(err))
+		return status.Error(codes.Internal, "Error releasing address")
+	}
+	s.logIPEvent(log, schema.INSTANCES_COL, instance, "ip_release", requester, alloc)
+	return nil
+}
+
+// releaseInstanceIPs gives addresses of deleted instance back to pools
+func (s *InstancesServer) releaseInstanceIPs(ctx context.Context, log *zap.Logger, instance, by string) {
+	allocs, err := graph.ListIPAllocations(ctx, s.db, "", instance)
+	if err != nil {
+		log.Warn("Error listing instance addresses", zap.Error(err))
+		return
+	}
+	if len(allocs) == 0 {
+		return
+	}
+	conf := getIPAMSettings(log)
+	for i := range allocs {
+		if err := s.release(ctx, log, conf, &allocs[i], by, graph.IPInstanceDeleted); err != nil {
+			log.Error("Error releasing address", zap.String("address", allocs[i].Address), zap.Error(err))
+		}
+	}
+	s.logIPEvent(log, schema.INSTANCES_COL, instance, "ip_release", by, allocs)
+}
+
+// reassignInstanceIPs moves addresses of transferred instance to new owner, starting new holding periods
+func (s *InstancesServer) reassignInstanceIPs(ctx context.Context, log *zap.Logger, instance, account, by string) {
+	allocs, err := graph.ListIPAllocations(ctx, s.db, "", instance)
+	if err != nil {
+		log.Warn("Error listing instance addresses", zap.Error(err))
+		return
+	}
+	now := time.Now().Unix()
+	for i := range allocs {
+		alloc := &allocs[i]
+		if alloc.Account == account {
+			continue
+		}
+		if err := graph.CloseIPHistory(ctx, s.db, alloc.Pool, alloc.Address, by, graph.IPTransferred, now); err != nil {
+			log.Error("Error closing address history", zap.String("address", alloc.Address), zap.Error(err))
+		}
+		alloc.Account = account
+		if err := graph.UpdateIPAllocation(ctx, s.db, alloc); err != nil {
+			log.Error("Error updating allocation", zap.String("address", alloc.Address), zap.Error(err))
+		}
+		if err := graph.OpenIPHistory(ctx, s.db, &graph.IPHistoryEntry{
+			Address:  alloc.Address,
+			Pool:     alloc.Pool,
+			Instance: instance,
+			Account:  account,
+			From:     now,
+			By:       by,
+		}); err != nil {
+			log.Error("Error recording address history", zap.String("address", alloc.Address), zap.Error(err))
+		}
+	}
+}
+
+// reassignGroupIPs moves addresses of group instances to account owning group after transfer
+func (s *InstancesServer) reassignGroupIPs(ctx context.Context, log *zap.Logger, ig, by string) {
+	owner, err := graph.OwnerAccount(ctx, s.db, driver.NewDocumentID(schema.INSTANCES_GROUPS_COL, ig))
+	if err != nil {
+		log.Warn("Error resolving group owner", zap.String("ig", ig), zap.Error(err))
+		return
+	}
+	instances, err := graph.ListGroupIPInstances(ctx, s.db, ig)
+	if err != nil {
+		log.Warn("Error listing group addresses", zap.String("ig", ig), zap.Error(err))
+		return
+	}
+	for _, instance := range instances {
+		s.reassignInstanceIPs(ctx, log, instance, owner, by)
+	}
+}
+
+func (s *InstancesServer) ListInstanceIPs(ctx context.Context, instance string) ([]graph.IPAllocation, error) {
+	log := s.log.Named("ListInstanceIPs")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	if _, err := s.ctrl.GetWithAccess(ctx, driver.NewDocumentID(schema.ACCOUNTS_COL, requester), instance); err != nil {
+		return nil, status.Error(codes.NotFound, "Instance not found")
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_ADDRESSES_COL)
+	res, err := graph.ListIPAllocations(ctx, s.db, "", instance)
+	if err != nil {
+		log.Error("Error listing addresses", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing addresses")
+	}
+	return res, nil
+}
+
+// SetIPPTR sets reverse DNS name of instance address, instance managers can do it themselves
+func (s *InstancesServer) SetIPPTR(ctx context.Context, instance, address, ptr string) (*graph.IPAllocation, error) {
+	log := s.log.Named("SetIPPTR").With(zap.String("instance", instance), zap.String("address", address))
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	inst, err := s.ctrl.GetWithAccess(ctx, driver.NewDocumentID(schema.ACCOUNTS_COL, requester), instance)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Instance not found")
+	}
+	if inst.GetAccess().GetLevel() < accesspb.Level_MGMT {
+		return nil, status.Error(codes.PermissionDenied, "Access denied")
+	}
+	if ptr != "" && !validPTR(ptr) {
+		return nil, status.Error(codes.InvalidArgument, "Invalid PTR hostname")
+	}
+	alloc, err := s.instanceAllocation(ctx, instance, address)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := graph.GetIPPool(ctx, s.db, alloc.Pool)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, "Pool of address not found")
+	}
+	parsed, err := parsePool(pool)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Pool is misconfigured: %v", err)
+	}
+	if err := s.pushPTR(ctx, getIPAMSettings(log), parsed, alloc.Address, ptr); err != nil {
+		log.Error("Error pushing PTR record", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error updating DNS")
+	}
+	alloc.PTR = ptr
+	if err := graph.UpdateIPAllocation(ctx, s.db, alloc); err != nil {
+		log.Error("Error updating allocation", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error updating allocation")
+	}
+	s.logIPEvent(log, schema.INSTANCES_COL, instance, "ip_ptr", requester, alloc)
+	return alloc, nil
+}
+
+// IPHistory answers who held address when, used for abuse reports
+func (s *InstancesServer) IPHistory(ctx context.Context, address, instance, account string, at int64) ([]graph.IPHistoryEntry, error) {
+	log := s.log.Named("IPHistory")
+	if _, err := graph.CheckRootAccess(ctx, s.ca, accesspb.Level_ADMIN); err != nil {
+		return nil, err
+	}
+	if address != "" {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid address")
+		}
+		address = addr.String()
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.IP_HISTORY_COL)
+	res, err := graph.ListIPHistory(ctx, s.db, address, instance, account, at, 1000)
+	if err != nil {
+		log.Error("Error listing history", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing address history")
+	}
+	return res, nil
+}
+
+func (s *InstancesServer) RegisterIPAMRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/ipam/pools", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListIPPools))).Methods("GET")
+	router.Handle("/ipam/pools", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCreateIPPool))).Methods("POST")
+	router.Handle("/ipam/pools/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGetIPPool))).Methods("GET")
+	router.Handle("/ipam/pools/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleUpdateIPPool))).Methods("PUT")
+	router.Handle("/ipam/pools/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleDeleteIPPool))).Methods("DELETE")
+	router.Handle("/ipam/pools/{id}/addresses", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListPoolAddresses))).Methods("GET")
+	router.Handle("/ipam/history", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleIPHistory))).Methods("GET")
+	router.Handle("/instances/{uuid}/ips", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListInstanceIPs))).Methods("GET")
+	router.Handle("/instances/{uuid}/ips", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleAllocateIP))).Methods("POST")
+	router.Handle("/instances/{uuid}/ips/{address}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleReleaseIP))).Methods("DELETE")
+	router.Handle("/instances/{uuid}/ips/{address}/ptr", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleSetIPPTR))).Methods("PUT")
+}
+
+func (s *InstancesServer) HandleListIPPools(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListIPPools(request.Context(), request.URL.Query().Get("sp"))
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleCreateIPPool(writer http.ResponseWriter, request *http.Request) {
+	var req graph.IPPool
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.CreateIPPool(request.Context(), &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *InstancesServer) HandleGetIPPool(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.GetIPPool(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleUpdateIPPool(writer http.ResponseWriter, request *http.Request) {
+	var req graph.IPPool
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.UpdateIPPool(request.Context(), mux.Vars(request)["id"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleDeleteIPPool(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.DeleteIPPool(request.Context(), mux.Vars(request)["id"]))
+}
+
+func (s *InstancesServer) HandleListPoolAddresses(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListPoolAddresses(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleIPHistory(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	var at int64
+	if v := q.Get("at"); v != "" {
+		var err error
+		if at, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(writer, "Malformed at, unix time expected", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := s.IPHistory(request.Context(), q.Get("address"), q.Get("instance"), q.Get("account"), at)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleListInstanceIPs(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListInstanceIPs(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleAllocateIP(writer http.ResponseWriter, request *http.Request) {
+	var req AllocateIPRequest
+	if request.ContentLength != 0 {
+		if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+			http.Error(writer, "Malformed request body", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := s.AllocateIP(request.Context(), mux.Vars(request)["uuid"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *InstancesServer) HandleReleaseIP(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	http_server.WriteResult(writer, s.ReleaseIP(request.Context(), vars["uuid"], vars["address"]))
+}
+
+func (s *InstancesServer) HandleSetIPPTR(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		PTR string `json:"ptr"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(request)
+	res, err := s.SetIPPTR(request.Context(), vars["uuid"], vars["address"], req.PTR)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
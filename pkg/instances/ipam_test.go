@@ -0,0 +1,66 @@
+package instances
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func rootAdminServer(t *testing.T, db *driver_mocks.MockDatabase) (*InstancesServer, context.Context) {
+	ca := graph_mocks.NewMockCommonActionsController(t)
+	ca.EXPECT().HasAccess(mock.Anything, "admin", driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), accesspb.Level_ADMIN).Return(true)
+	return &InstancesServer{log: zap.NewNop(), db: db, ca: ca}, context.WithValue(context.Background(), nocloud.NoCloudAccount, "admin")
+}
+
+func expectPool(t *testing.T, db *driver_mocks.MockDatabase, pool graph.IPPool) {
+	col := driver_mocks.NewMockCollection(t)
+	col.EXPECT().ReadDocument(mock.Anything, pool.Key, mock.Anything).Run(func(_ context.Context, _ string, result interface{}) {
+		*result.(*graph.IPPool) = pool
+	}).Return(driver.DocumentMeta{}, nil)
+	db.EXPECT().Collection(mock.Anything, schema.IP_POOLS_COL).Return(col, nil).Once()
+}
+
+func TestUpdateIPPoolKeepsAllocatedUnreserved(t *testing.T) {
+	db := driver_mocks.NewMockDatabase(t)
+	expectPool(t, db, graph.IPPool{Key: "pool", Sp: "sp", CIDR: "10.0.0.0/24"})
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["pool"] == "pool"
+	})).Return(documentsCursor(t, graph.IPAllocation{Pool: "pool", Address: "10.0.0.10", Instance: "inst"}), nil).Once()
+	s, ctx := rootAdminServer(t, db)
+
+	_, err := s.UpdateIPPool(ctx, "pool", &graph.IPPool{Title: "pool", Reserved: []string{"10.0.0.1-10.0.0.20"}})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestUpdateIPPoolRejectsOverlap(t *testing.T) {
+	db := driver_mocks.NewMockDatabase(t)
+	expectPool(t, db, graph.IPPool{Key: "pool", Sp: "sp", CIDR: "10.0.0.0/24"})
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["pool"] == "pool"
+	})).Return(documentsCursor[graph.IPAllocation](t), nil).Once()
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["sp"] == ""
+	})).Return(documentsCursor(t,
+		graph.IPPoolWithUsage{IPPool: graph.IPPool{Key: "pool", CIDR: "10.0.0.0/24"}},
+		graph.IPPoolWithUsage{IPPool: graph.IPPool{Key: "other", CIDR: "10.0.1.0/24"}},
+	), nil).Once()
+	s, ctx := rootAdminServer(t, db)
+
+	// Own subnet doesn't count, widened one runs into other pool
+	_, err := s.UpdateIPPool(ctx, "pool", &graph.IPPool{Title: "pool", CIDR: "10.0.0.0/23"})
+	require.Error(t, err)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
@@ -318,9 +318,9 @@ func (s *InstancesServer) monitoringAction(ctx context.Context, _log *zap.Logger
 	log.Debug("Got IGs for monitoring", zap.Int("length", len(iGroups)))
 	log.Debug("Got addons for monitoring", zap.Int("addons", len(addons)))
 
-	client, ok := s.drivers[sp.GetType()]
-	if !ok {
-		log.Error("Driver is not registered", zap.String("type", sp.GetType()))
+	client, err := s.drivers.Client(sp.GetType())
+	if err != nil {
+		log.Error("Skipping monitoring", zap.Error(err))
 		return
 	}
 
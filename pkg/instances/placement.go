@@ -0,0 +1,230 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/placement"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const placementKey = "placement"
+
+// Response header createWithAutoAssign puts decision into
+const PlacementDecisionHeader = "X-Placement-Decision"
+
+type PlacementConf struct {
+	Strategy string             `json:"strategy"`
+	Affinity placement.Affinity `json:"affinity"`
+	// Account data fields holding preferred region, checked in order
+	RegionFields []string `json:"region_fields"`
+}
+
+var defaultPlacementSettings = &sc.Setting[PlacementConf]{
+	Value: PlacementConf{
+		Strategy:     placement.DefaultStrategy,
+		RegionFields: []string{"region", "location"},
+	},
+	Description: "Services provider placement for automatically assigned instances. Strategies: least_instances, least_resources, weighted_round_robin. Affinity: affinity, anti_affinity or empty",
+	Level:       accesspb.Level_ADMIN,
+}
+
+var placementEngine = placement.NewEngine()
+
+func getPlacementSettings(log *zap.Logger) PlacementConf {
+	var conf PlacementConf
+	if scErr := sc.Fetch(placementKey, &conf, defaultPlacementSettings); scErr != nil {
+		log.Warn("Cannot fetch placement settings", zap.Error(scErr))
+		conf = defaultPlacementSettings.Value
+	}
+	return conf
+}
+
+func instanceResources(inst *pb.Instance) placement.Resources {
+	res := inst.GetResources()
+	return placement.Resources{
+		Instances: 1,
+		CPU:       res["cpu"].GetNumberValue(),
+		RAM:       res["ram"].GetNumberValue(),
+		Disk:      res["drive_size"].GetNumberValue(),
+	}
+}
+
+func accountRegions(acc graph.Account, fields []string) []string {
+	if acc.GetData() == nil {
+		return nil
+	}
+	data := acc.GetData().AsMap()
+	var regions []string
+	for _, f := range fields {
+		if v, _ := data[f].(string); strings.TrimSpace(v) != "" {
+			regions = append(regions, strings.TrimSpace(v))
+		}
+	}
+	return regions
+}
+
+// place picks services provider for instance of account, sp restricts candidates to it if set.
+// Preview doesn't record the pick, so it doesn't affect following placements
+func (s *InstancesServer) place(ctx context.Context, log *zap.Logger, acc graph.Account, inst *pb.Instance, sp string, req *placement.Request, preview bool) (*placement.Decision, error) {
+	plan := inst.GetBillingPlan().GetUuid()
+	if plan == "" {
+		if sp != "" {
+			return explicit(sp, "no billing plan given"), nil
+		}
+		return nil, status.Error(codes.InvalidArgument, "Billing plan is required for automatic assignment")
+	}
+	var only []string
+	if sp != "" {
+		only = []string{sp}
+	}
+	candidates, err := graph.PlacementCandidates(ctx, s.db, plan, acc.GetUuid(), only)
+	if err != nil {
+		log.Error("Failed to list placement candidates", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to list services providers")
+	}
+
+	decide := placementEngine.Place
+	if preview {
+		decide = placementEngine.Preview
+	}
+	decision, err := decide(req, candidates)
+	switch {
+	case errors.Is(err, placement.ErrUnknownStrategy):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, placement.ErrNoCandidates) && sp != "":
+		// Keep honoring explicitly requested services provider not bound to plan
+		return explicit(sp, "services provider doesn't offer plan "+plan), nil
+	case errors.Is(err, placement.ErrNoCandidates):
+		return decision, status.Errorf(codes.FailedPrecondition, "No services provider offers plan %s", plan)
+	case errors.Is(err, placement.ErrNoCapacity):
+		return decision, status.Error(codes.ResourceExhausted, "No services provider has capacity for instance")
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if sp != "" {
+		decision.Explanation = append([]string{"services provider requested explicitly"}, decision.Explanation...)
+	}
+	log.Info("Placement decided", zap.String("account", acc.GetUuid()), zap.Bool("preview", preview), zap.Any("decision", decision))
+	return decision, nil
+}
+
+func explicit(sp, reason string) *placement.Decision {
+	return &placement.Decision{
+		Chosen:      sp,
+		Strategy:    "explicit",
+		Explanation: []string{"services provider requested explicitly, " + reason},
+	}
+}
+
+func (s *InstancesServer) placementRequest(log *zap.Logger, acc graph.Account, inst *pb.Instance) *placement.Request {
+	conf := getPlacementSettings(log)
+	return &placement.Request{
+		Strategy:  conf.Strategy,
+		Resources: instanceResources(inst),
+		Regions:   accountRegions(acc, conf.RegionFields),
+		Affinity:  conf.Affinity,
+	}
+}
+
+type PlacementPreviewRequest struct {
+	Account   string              `json:"account"`
+	Plan      string              `json:"plan"`
+	Sp        string              `json:"sp"`
+	Resources placement.Resources `json:"resources"`
+	// Override settings for preview
+	Strategy string              `json:"strategy"`
+	Regions  []string            `json:"regions"`
+	Affinity *placement.Affinity `json:"affinity"`
+}
+
+// PreviewPlacement explains where instance would be placed without creating it
+func (s *InstancesServer) PreviewPlacement(ctx context.Context, req *PlacementPreviewRequest) (*placement.Decision, error) {
+	log := s.log.Named("PreviewPlacement")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	if !s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), accesspb.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights")
+	}
+	if req.Account == "" {
+		req.Account = requester
+	}
+	acc, err := s.acc_ctrl.Get(ctx, req.Account)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	inst := &pb.Instance{BillingPlan: &billingpb.Plan{Uuid: req.Plan}}
+	preq := s.placementRequest(log, acc, inst)
+	preq.Resources = req.Resources
+	preq.Resources.Instances = 1
+	if req.Strategy != "" {
+		preq.Strategy = req.Strategy
+	}
+	if req.Regions != nil {
+		preq.Regions = req.Regions
+	}
+	if req.Affinity != nil {
+		preq.Affinity = *req.Affinity
+	}
+	decision, err := s.place(ctx, log, acc, inst, req.Sp, preq, true)
+	if err != nil && decision == nil {
+		return nil, err
+	}
+	// Failed decision is still worth explaining
+	return decision, nil
+}
+
+func (s *InstancesServer) RegisterPlacementRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/instances/placement/preview", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandlePreviewPlacement))).Methods("POST")
+	router.Handle("/instances/placement/strategies", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListPlacementStrategies))).Methods("GET")
+}
+
+func (s *InstancesServer) HandlePreviewPlacement(writer http.ResponseWriter, request *http.Request) {
+	var req PlacementPreviewRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.PreviewPlacement(request.Context(), &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleListPlacementStrategies(writer http.ResponseWriter, _ *http.Request) {
+	http_server.WriteJSON(writer, http.StatusOK, placementEngine.Strategies())
+}
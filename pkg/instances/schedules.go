@@ -0,0 +1,480 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	go_sync "sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	stpb "github.com/slntopp/nocloud-proto/states"
+	spb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schedule"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	schedulesKey     = "instance-schedules"
+	schedulesLockKey = "instances-schedules-lock"
+)
+
+type SchedulesConf struct {
+	// Seconds between checks for due schedules
+	Frequency int `json:"frequency"`
+	// Schedule action -> driver method invoked
+	Actions map[string]string `json:"actions"`
+	// Schedule is disabled after this many consecutive failures, 0 never disables
+	MaxFailures int `json:"max_failures"`
+	// Days run history is kept
+	HistoryDays int `json:"history_days"`
+	// Schedules run per check at most
+	BatchSize int `json:"batch_size"`
+}
+
+var defaultSchedulesSettings = &sc.Setting[SchedulesConf]{
+	Value: SchedulesConf{
+		Frequency: 60,
+		Actions: map[string]string{
+			"start":    "start",
+			"stop":     "stop",
+			"reboot":   "reboot",
+			"snapshot": "snapshot_create",
+		},
+		MaxFailures: 5,
+		HistoryDays: 30,
+		BatchSize:   100,
+	},
+	Description: "Instance scheduled actions: check frequency, actions to driver methods mapping, failures before schedule is disabled and run history retention",
+	Level:       accesspb.Level_ADMIN,
+}
+
+func getSchedulesSettings(log *zap.Logger) SchedulesConf {
+	var conf SchedulesConf
+	if scErr := sc.Fetch(schedulesKey, &conf, defaultSchedulesSettings); scErr != nil {
+		log.Warn("Cannot fetch schedules settings", zap.Error(scErr))
+		conf = defaultSchedulesSettings.Value
+	}
+	return conf
+}
+
+type ScheduleRequest struct {
+	Action   string                 `json:"action"`
+	Cron     string                 `json:"cron"`
+	Timezone string                 `json:"timezone"`
+	Params   map[string]interface{} `json:"params"`
+	Enabled  *bool                  `json:"enabled"`
+}
+
+// nextRun computes unix time of next run after t, 0 if expression never fires again
+func nextRun(expr, timezone string, t time.Time) (int64, error) {
+	c, err := schedule.Parse(expr)
+	if err != nil {
+		return 0, err
+	}
+	loc := time.UTC
+	if timezone != "" {
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return 0, fmt.Errorf("unknown timezone %s", timezone)
+		}
+	}
+	next := c.Next(t.In(loc))
+	if next.IsZero() {
+		return 0, nil
+	}
+	return next.Unix(), nil
+}
+
+// applyScheduleRequest validates request and updates schedule with it
+func applyScheduleRequest(conf SchedulesConf, sched *graph.InstanceSchedule, req *ScheduleRequest) error {
+	if req.Action != "" {
+		sched.Action = req.Action
+	}
+	if _, ok := conf.Actions[sched.Action]; !ok {
+		return status.Errorf(codes.InvalidArgument, "Unsupported action %s", sched.Action)
+	}
+	if req.Cron != "" {
+		sched.Cron = req.Cron
+	}
+	if req.Timezone != "" {
+		sched.Timezone = req.Timezone
+	}
+	if req.Params != nil {
+		sched.Params = req.Params
+	}
+	if req.Enabled != nil {
+		sched.Enabled = *req.Enabled
+	}
+	next, err := nextRun(sched.Cron, sched.Timezone, time.Now())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if next == 0 {
+		return status.Error(codes.InvalidArgument, "Schedule never fires")
+	}
+	sched.NextRun = next
+	sched.Updated = time.Now().Unix()
+	return nil
+}
+
+// scheduleAccess checks requester can manage instance, schedules are managed with the same access as instance itself
+func (s *InstancesServer) scheduleAccess(ctx context.Context, instance string) (string, error) {
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	inst, err := s.ctrl.GetWithAccess(ctx, driver.NewDocumentID(schema.ACCOUNTS_COL, requester), instance)
+	if err != nil {
+		return requester, status.Error(codes.NotFound, "Instance not found")
+	}
+	if inst.GetAccess().GetLevel() < accesspb.Level_MGMT {
+		return requester, status.Error(codes.PermissionDenied, "Access denied")
+	}
+	return requester, nil
+}
+
+func (s *InstancesServer) getSchedule(ctx context.Context, id string) (*graph.InstanceSchedule, string, error) {
+	sched, err := graph.GetInstanceSchedule(ctx, s.db, id)
+	if err != nil {
+		return nil, "", status.Error(codes.NotFound, "Schedule not found")
+	}
+	requester, err := s.scheduleAccess(ctx, sched.Instance)
+	if err != nil {
+		return nil, requester, err
+	}
+	return sched, requester, nil
+}
+
+func (s *InstancesServer) ListSchedules(ctx context.Context, instance string) ([]graph.InstanceSchedule, error) {
+	log := s.log.Named("ListSchedules")
+	if _, err := s.scheduleAccess(ctx, instance); err != nil {
+		return nil, err
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_SCHEDULES_COL)
+	res, err := graph.ListInstanceSchedules(ctx, s.db, instance)
+	if err != nil {
+		log.Error("Error listing schedules", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing schedules")
+	}
+	return res, nil
+}
+
+func (s *InstancesServer) CreateSchedule(ctx context.Context, instance string, req *ScheduleRequest) (*graph.InstanceSchedule, error) {
+	log := s.log.Named("CreateSchedule")
+	requester, err := s.scheduleAccess(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	if req.Cron == "" || req.Action == "" {
+		return nil, status.Error(codes.InvalidArgument, "Action and cron are required")
+	}
+	sched := &graph.InstanceSchedule{
+		Instance:  instance,
+		Enabled:   true,
+		CreatedBy: requester,
+		Created:   time.Now().Unix(),
+	}
+	if err := applyScheduleRequest(getSchedulesSettings(log), sched, req); err != nil {
+		return nil, err
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_SCHEDULES_COL)
+	if sched, err = graph.CreateInstanceSchedule(ctx, s.db, sched); err != nil {
+		log.Error("Error creating schedule", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error creating schedule")
+	}
+	s.logScheduleEvent(log, sched, "schedule_create", requester)
+	return sched, nil
+}
+
+func (s *InstancesServer) UpdateSchedule(ctx context.Context, id string, req *ScheduleRequest) (*graph.InstanceSchedule, error) {
+	log := s.log.Named("UpdateSchedule")
+	sched, requester, err := s.getSchedule(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyScheduleRequest(getSchedulesSettings(log), sched, req); err != nil {
+		return nil, err
+	}
+	if req.Enabled != nil && *req.Enabled {
+		sched.Failures = 0
+	}
+	if err := graph.UpdateInstanceSchedule(ctx, s.db, sched); err != nil {
+		log.Error("Error updating schedule", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error updating schedule")
+	}
+	s.logScheduleEvent(log, sched, "schedule_update", requester)
+	return sched, nil
+}
+
+func (s *InstancesServer) DeleteSchedule(ctx context.Context, id string) error {
+	log := s.log.Named("DeleteSchedule")
+	sched, requester, err := s.getSchedule(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := graph.DeleteInstanceSchedule(ctx, s.db, id); err != nil {
+		log.Error("Error deleting schedule", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting schedule")
+	}
+	s.logScheduleEvent(log, sched, "schedule_delete", requester)
+	return nil
+}
+
+func (s *InstancesServer) ListScheduleRuns(ctx context.Context, id string) ([]graph.ScheduleRun, error) {
+	log := s.log.Named("ListScheduleRuns")
+	if _, _, err := s.getSchedule(ctx, id); err != nil {
+		return nil, err
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.SCHEDULE_RUNS_COL)
+	res, err := graph.ListScheduleRuns(ctx, s.db, id, 100)
+	if err != nil {
+		log.Error("Error listing schedule runs", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing schedule runs")
+	}
+	return res, nil
+}
+
+func (s *InstancesServer) logScheduleEvent(log *zap.Logger, sched *graph.InstanceSchedule, action, requester string) {
+	diff, _ := json.Marshal(sched)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.INSTANCES_COL,
+		Uuid:      sched.Instance,
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot:  &elpb.Snapshot{Diff: string(diff)},
+	})
+}
+
+// ScheduleRoutine runs due schedules, only replica holding lock runs them
+func (s *InstancesServer) ScheduleRoutine(_ctx context.Context, wg *go_sync.WaitGroup) {
+	defer wg.Done()
+	ctx := context.WithoutCancel(_ctx)
+	log := s.log.Named("ScheduleRoutine")
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_SCHEDULES_COL)
+	graph.GetEnsureCollection(log, ctx, s.db, schema.SCHEDULE_RUNS_COL)
+
+start:
+	conf := getSchedulesSettings(log)
+	frequency := time.Duration(max(conf.Frequency, 10)) * time.Second
+
+	upd := make(chan bool, 1)
+	go sc.Subscribe([]string{schedulesKey}, upd)
+
+	log.Info("Got Configuration", zap.Any("conf", conf))
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+
+	for {
+		locked, err := s.rdb.SetNX(ctx, schedulesLockKey, time.Now().Unix(), frequency/2).Result()
+		if err != nil {
+			log.Error("Error acquiring schedules lock", zap.Error(err))
+		} else if locked {
+			s.runDueSchedules(ctx, log, conf)
+		}
+
+		select {
+		case <-_ctx.Done():
+			log.Info("Context is done. Quitting")
+			return
+		case <-ticker.C:
+			continue
+		case <-upd:
+			log.Info("New Configuration Received, restarting Routine")
+			ticker.Stop()
+			goto start
+		}
+	}
+}
+
+func (s *InstancesServer) runDueSchedules(ctx context.Context, log *zap.Logger, conf SchedulesConf) {
+	now := time.Now()
+	due, err := graph.ListDueSchedules(ctx, s.db, now.Unix(), max(conf.BatchSize, 1))
+	if err != nil {
+		log.Error("Error listing due schedules", zap.Error(err))
+		return
+	}
+	for i := range due {
+		s.runSchedule(ctx, log, conf, &due[i])
+	}
+	if conf.HistoryDays > 0 {
+		if err := graph.PruneScheduleRuns(ctx, s.db, now.AddDate(0, 0, -conf.HistoryDays).Unix()); err != nil {
+			log.Warn("Error pruning schedule runs", zap.Error(err))
+		}
+	}
+}
+
+func (s *InstancesServer) runSchedule(ctx context.Context, log *zap.Logger, conf SchedulesConf, sched *graph.InstanceSchedule) {
+	log = log.With(zap.String("schedule", sched.Key), zap.String("instance", sched.Instance), zap.String("action", sched.Action))
+
+	// Next run is counted from now, runs missed while scheduler was down aren't caught up
+	next, err := nextRun(sched.Cron, sched.Timezone, time.Now())
+	if err != nil {
+		log.Warn("Error computing next run, schedule will be disabled", zap.Error(err))
+		next = 0
+	}
+	claimed, err := graph.ClaimScheduleRun(ctx, s.db, sched.Key, sched.NextRun, next)
+	if err != nil {
+		log.Error("Error claiming schedule run", zap.Error(err))
+		return
+	}
+	if !claimed {
+		log.Debug("Schedule run is claimed by another replica or schedule was changed")
+		return
+	}
+	sched.NextRun = next
+
+	run := &graph.ScheduleRun{
+		Schedule: sched.Key,
+		Instance: sched.Instance,
+		Action:   sched.Action,
+		Method:   conf.Actions[sched.Action],
+		Started:  time.Now().Unix(),
+	}
+
+	inst, err := s.ctrl.Get(ctx, sched.Instance)
+	if err != nil || inst.GetStatus() == spb.NoCloudStatus_DEL {
+		log.Info("Instance is gone, removing its schedules")
+		if err := graph.DeleteSchedulesOfInstance(ctx, s.db, sched.Instance); err != nil {
+			log.Error("Error removing schedules", zap.Error(err))
+		}
+		return
+	}
+
+	switch {
+	case run.Method == "":
+		run.Status, run.Error = graph.ScheduleRunFailed, "action is no longer supported"
+	case inst.GetState().GetState() == stpb.NoCloudState_SUSPENDED || inst.GetStatus() == spb.NoCloudStatus_SUS:
+		run.Status, run.Error = graph.ScheduleRunSkipped, "instance is suspended"
+	default:
+		run.Account, err = graph.OwnerAccount(ctx, s.db, driver.NewDocumentID(schema.INSTANCES_COL, sched.Instance))
+		if err != nil {
+			run.Status, run.Error = graph.ScheduleRunFailed, "instance owner not found"
+			break
+		}
+		params, _ := structpb.NewStruct(sched.Params)
+		// Run as owner, so schedule can't do more than owner could do by hand
+		_, err = s.Invoke(context.WithValue(ctx, nocloud.NoCloudAccount, run.Account), connect.NewRequest(&pb.InvokeRequest{
+			Uuid:   sched.Instance,
+			Method: run.Method,
+			Params: params.GetFields(),
+		}))
+		if err != nil {
+			run.Status, run.Error = graph.ScheduleRunFailed, err.Error()
+		} else {
+			run.Status = graph.ScheduleRunSucceeded
+		}
+	}
+	run.Finished = time.Now().Unix()
+
+	if err := graph.RecordScheduleRun(ctx, s.db, run); err != nil {
+		log.Error("Error recording schedule run", zap.Error(err))
+	}
+
+	sched.LastRun, sched.LastStatus, sched.LastError = run.Started, run.Status, run.Error
+	if run.Status == graph.ScheduleRunFailed {
+		sched.Failures++
+		log.Warn("Scheduled action failed", zap.String("error", run.Error), zap.Int("failures", sched.Failures))
+		if conf.MaxFailures > 0 && sched.Failures >= conf.MaxFailures {
+			log.Warn("Disabling schedule after repeated failures")
+			sched.Enabled = false
+		}
+	} else {
+		sched.Failures = 0
+	}
+	if sched.NextRun == 0 {
+		sched.Enabled = false
+	}
+	if err := graph.UpdateInstanceSchedule(ctx, s.db, sched); err != nil {
+		log.Error("Error updating schedule", zap.Error(err))
+	}
+}
+
+func (s *InstancesServer) RegisterScheduleRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/instances/{uuid}/schedules", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListSchedules))).Methods("GET")
+	router.Handle("/instances/{uuid}/schedules", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCreateSchedule))).Methods("POST")
+	router.Handle("/instances/schedules/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleUpdateSchedule))).Methods("PUT")
+	router.Handle("/instances/schedules/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleDeleteSchedule))).Methods("DELETE")
+	router.Handle("/instances/schedules/{id}/runs", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListScheduleRuns))).Methods("GET")
+}
+
+func (s *InstancesServer) HandleListSchedules(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListSchedules(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleCreateSchedule(writer http.ResponseWriter, request *http.Request) {
+	var req ScheduleRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.CreateSchedule(request.Context(), mux.Vars(request)["uuid"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *InstancesServer) HandleUpdateSchedule(writer http.ResponseWriter, request *http.Request) {
+	var req ScheduleRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.UpdateSchedule(request.Context(), mux.Vars(request)["id"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleDeleteSchedule(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.DeleteSchedule(request.Context(), mux.Vars(request)["id"]))
+}
+
+func (s *InstancesServer) HandleListScheduleRuns(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListScheduleRuns(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
@@ -17,6 +17,7 @@ package instances
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"slices"
@@ -25,18 +26,17 @@ import (
 	"time"
 
 	"connectrpc.com/connect"
-	billingpb "github.com/slntopp/nocloud-proto/billing"
+	"github.com/cskr/pubsub"
 	"github.com/slntopp/nocloud-proto/health"
 	rpb "github.com/slntopp/nocloud-proto/registry/accounts"
 	servicespb "github.com/slntopp/nocloud-proto/services"
-	"github.com/slntopp/nocloud/pkg/nocloud/payments"
 	"github.com/slntopp/nocloud/pkg/nocloud/rabbitmq"
 	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
 	"github.com/slntopp/nocloud/pkg/nocloud/roles"
 	"github.com/slntopp/nocloud/pkg/nocloud/sync"
-	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/proto"
 
+	epb "github.com/slntopp/nocloud-proto/events"
 	elpb "github.com/slntopp/nocloud-proto/events_logging"
 	"github.com/slntopp/nocloud-proto/notes"
 
@@ -46,8 +46,10 @@ import (
 	pb "github.com/slntopp/nocloud-proto/instances"
 	stpb "github.com/slntopp/nocloud-proto/states"
 	spb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/dns"
 	"github.com/slntopp/nocloud/pkg/graph"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/drivers"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	s "github.com/slntopp/nocloud/pkg/states"
 	st "github.com/slntopp/nocloud/pkg/statuses"
@@ -69,9 +71,13 @@ type InstancesServer struct {
 	acc_ctrl   graph.AccountsController
 	inv_ctrl   graph.InvoicesController
 	curr_ctrl  graph.CurrencyController
+	bp_ctrl    graph.BillingPlansController
 	ca         graph.CommonActionsController
 
-	drivers map[string]driverpb.DriverServiceClient
+	drivers *drivers.Registry
+
+	// Reverse zones PTR records are pushed to
+	dns_srv *dns.DNSServer
 
 	db driver.Database
 
@@ -80,6 +86,16 @@ type InstancesServer struct {
 	monitoring *health.RoutineStatus
 
 	spSyncers map[string]*go_sync.Mutex
+
+	// States pubsub, bulk jobs progress is published to it
+	ps *pubsub.PubSub
+	// Bulk jobs running on this replica by id
+	bulkJobs go_sync.Map
+	// Jobs which progress is relayed from redis to local Stream subscribers
+	bulkRelays go_sync.Map
+
+	// Publishes notifications to events queue
+	events func(event *epb.Event) error
 }
 
 func NewInstancesServiceServer(logger *zap.Logger, db driver.Database, rbmq rabbitmq.Connection, rdb redisdb.Client) *InstancesServer {
@@ -92,6 +108,7 @@ func NewInstancesServiceServer(logger *zap.Logger, db driver.Database, rbmq rabb
 	acc_ctrl := graph.NewAccountsController(logger, db)
 	inv_ctrl := graph.NewInvoicesController(logger, db)
 	curr_ctrl := graph.NewCurrencyController(logger, db)
+	bp_ctrl := graph.NewBillingPlansController(logger, db)
 	ca := graph.NewCommonActionsController(logger, db)
 
 	log.Debug("Setting up StatesPubSub")
@@ -130,9 +147,12 @@ func NewInstancesServiceServer(logger *zap.Logger, db driver.Database, rbmq rabb
 		acc_ctrl:   acc_ctrl,
 		inv_ctrl:   inv_ctrl,
 		curr_ctrl:  curr_ctrl,
+		bp_ctrl:    bp_ctrl,
 		ca:         ca,
-		drivers:    make(map[string]driverpb.DriverServiceClient),
+		drivers:    drivers.NewRegistry(log, nil, drivers.DefaultConfig()),
 		rdb:        rdb,
+		dns_srv:    dns.NewDNSServer(log, rdb),
+		events:     newEventsPublisher(log, rbmq),
 		monitoring: &health.RoutineStatus{
 			Routine: "Monitoring",
 			Status: &health.ServingStatus{
@@ -146,8 +166,9 @@ func NewInstancesServiceServer(logger *zap.Logger, db driver.Database, rbmq rabb
 
 const nebulaIGType = "ione"
 
-func (s *InstancesServer) RegisterDriver(type_key string, client driverpb.DriverServiceClient) {
-	s.drivers[type_key] = client
+// SetupDriverRegistry shares drivers registry, so drivers added at runtime are visible to the server
+func (s *InstancesServer) SetupDriverRegistry(reg *drivers.Registry) {
+	s.drivers = reg
 }
 
 var methodsToSync = []string{
@@ -196,10 +217,10 @@ func (s *InstancesServer) Invoke(ctx context.Context, _req *connect.Request[pb.I
 		return nil, status.Error(codes.Unavailable, "Machine is suspended. Functionality is limited")
 	}
 
-	client, ok := s.drivers[r.SP.Type]
-	if !ok {
-		log.Error("Failed to get driver", zap.String("type", r.SP.Type))
-		return nil, status.Error(codes.NotFound, "Driver not found")
+	client, err := s.drivers.Client(r.SP.Type)
+	if err != nil {
+		log.Error("Failed to get driver", zap.String("type", r.SP.Type), zap.Error(err))
+		return nil, drivers.Status(err)
 	}
 	invoke, err := client.Invoke(ctx, &driverpb.InvokeRequest{
 		Instance:         instance.Instance,
@@ -322,6 +343,8 @@ func (s *InstancesServer) Delete(ctx context.Context, _req *connect.Request[pb.D
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	s.releaseInstanceIPs(ctx, log, req.GetUuid(), requestor)
+
 	var event = &elpb.Event{
 		Entity:    schema.INSTANCES_COL,
 		Uuid:      req.GetUuid(),
@@ -359,6 +382,12 @@ func (s *InstancesServer) Create(ctx context.Context, _req *connect.Request[pb.C
 		req.Instance.Data = nil
 	}
 
+	if requester != schema.ROOT_ACCOUNT_KEY {
+		if err := s.checkKYC(ctx, log, requester, req.GetInstance()); err != nil {
+			return nil, err
+		}
+	}
+
 	if req.AutoAssign {
 		return s.createWithAutoAssign(ctx, req, requester)
 	}
@@ -388,6 +417,17 @@ func (s *InstancesServer) Create(ctx context.Context, _req *connect.Request[pb.C
 		return nil, status.Error(codes.InvalidArgument, "can't create instance with imported IG")
 	}
 
+	if requester != schema.ROOT_ACCOUNT_KEY {
+		owner, err := graph.OwnerAccount(ctx, s.db, igId)
+		if err != nil {
+			log.Error("Failed to get instances group owner", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error checking quota")
+		}
+		if err := s.checkQuota(ctx, log, owner, graph.ResourcesUsage(req.GetInstance().GetResources())); err != nil {
+			return nil, err
+		}
+	}
+
 	newId, err := s.ctrl.Create(ctx, igId, sp.GetUuid(), req.GetInstance())
 	if err != nil {
 		log.Error("Failed to create instance", zap.Error(err))
@@ -415,6 +455,18 @@ func (s *InstancesServer) createWithAutoAssign(ctx context.Context, req *pb.Crea
 		return nil, fmt.Errorf("failed to get account: %w", err)
 	}
 
+	if requester != schema.ROOT_ACCOUNT_KEY {
+		if err := s.checkQuota(ctx, log, account, graph.ResourcesUsage(req.GetInstance().GetResources())); err != nil {
+			return nil, err
+		}
+	}
+
+	decision, err := s.place(ctx, log, acc, req.GetInstance(), req.GetSp(), s.placementRequest(log, acc, req.GetInstance()), false)
+	if err != nil {
+		log.Warn("Failed to place instance", zap.Error(err), zap.Any("decision", decision))
+		return nil, err
+	}
+
 	srvResp, err := s.srv_ctrl.List(ctx, requester, &servicespb.ListRequest{
 		Filters: map[string]*structpb.Value{
 			"account": structpb.NewStringValue(account),
@@ -467,7 +519,7 @@ func (s *InstancesServer) createWithAutoAssign(ctx context.Context, req *pb.Crea
 	}
 
 	// Find instance group or create
-	sp, err := s.sp_ctrl.Get(ctx, req.GetSp())
+	sp, err := s.sp_ctrl.Get(ctx, decision.Chosen)
 	if err != nil {
 		log.Error("Failed to get service provider", zap.Error(err))
 		return nil, fmt.Errorf("failed to obtain service provider: %w", err)
@@ -524,10 +576,23 @@ func (s *InstancesServer) createWithAutoAssign(ctx context.Context, req *pb.Crea
 		return nil, fmt.Errorf("failed to up new instance: %w", err)
 	}
 
-	return connect.NewResponse(&pb.CreateResponse{
+	resp := connect.NewResponse(&pb.CreateResponse{
 		Id:     newId,
 		Result: true,
-	}), nil
+	})
+	explanation, _ := json.Marshal(decision)
+	resp.Header().Set(PlacementDecisionHeader, string(explanation))
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.INSTANCES_COL,
+		Uuid:      newId,
+		Scope:     "database",
+		Action:    "placement",
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot:  &elpb.Snapshot{Diff: string(explanation)},
+	})
+	return resp, nil
 }
 
 func (s *InstancesServer) Update(ctx context.Context, _req *connect.Request[pb.UpdateRequest]) (*connect.Response[pb.UpdateResponse], error) {
@@ -555,6 +620,16 @@ func (s *InstancesServer) Update(ctx context.Context, _req *connect.Request[pb.U
 				zap.String("uuid", instance.GetUuid()), zap.String("requestor", requestor))
 			req.Instance.Data = nil
 		}
+		if delta := resourcesDelta(instance.Instance, req.GetInstance()); delta != nil {
+			owner, err := graph.OwnerAccount(ctx, s.db, driver.NewDocumentID(schema.INSTANCES_COL, instance.GetUuid()))
+			if err != nil {
+				log.Error("Failed to get instance owner", zap.Error(err))
+				return nil, status.Error(codes.Internal, "Error checking quota")
+			}
+			if err := s.checkQuota(ctx, log, owner, delta); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	err = s.ctrl.UpdateWithPatch(ctx, "", req.GetInstance(), instance.Instance)
@@ -699,6 +774,7 @@ func (s *InstancesServer) TransferIG(ctx context.Context, _req *connect.Request[
 	if err != nil {
 		return nil, err
 	}
+	s.reassignGroupIPs(ctx, log, igId.Key(), requestor)
 
 	return connect.NewResponse(&pb.TransferIGResponse{
 		Result: true,
@@ -781,11 +857,17 @@ func (s *InstancesServer) TransferInstance(ctx context.Context, _req *connect.Re
 			log.Error("Failed to commit transaction", zap.Error(err))
 			return nil, fmt.Errorf("Failed to perform transfer. Try again later")
 		}
+		s.reassignInstanceIPs(ctx, log, req.GetUuid(), req.GetAccount(), requester)
 	} else if req.Ig != nil {
 		if err := s.transferToIG(ctx, log, req.GetUuid(), req.GetIg()); err != nil {
 			log.Error("Failed to transfer to IG", zap.Error(err))
 			return nil, fmt.Errorf("Failed to transfer to IG. Error: " + err.Error())
 		}
+		if owner, err := graph.OwnerAccount(ctx, s.db, driver.NewDocumentID(schema.INSTANCES_GROUPS_COL, req.GetIg())); err != nil {
+			log.Warn("Error resolving new owner, addresses kept", zap.Error(err))
+		} else {
+			s.reassignInstanceIPs(ctx, log, req.GetUuid(), owner, requester)
+		}
 	}
 
 	if req.GetDoNotTransferInvoices() {
@@ -808,77 +890,12 @@ func (s *InstancesServer) TransferInstance(ctx context.Context, _req *connect.Re
 		log.Error("Failed to get instance owner", zap.Error(err))
 		return nil, fmt.Errorf(errTmpl, err)
 	}
-	// Transfer invoices (Ignoring PAID, TERM, CANCELLED and RETURNED invoices and take only that contains target instance and other instances that target account owns)
-	invoices, err := s.inv_ctrl.List(ctx, accOwner.GetUuid())
+	transferred, err := s.transferInvoices(ctx, log, req.GetUuid(), accOwner.GetUuid(), acc)
 	if err != nil {
-		log.Error("Failed to list invoices", zap.Error(err))
 		return nil, fmt.Errorf(errTmpl, err)
 	}
-	transferred := make([]*graph.Invoice, 0)
-outer:
-	for _, inv := range invoices {
-		if inv.GetAccount() != accOwner.GetUuid() {
-			log.Warn("Got invoice from other account. Must be incorrect List method filter", zap.String("account", inv.GetAccount()))
-			continue
-		}
-		if inv.GetStatus() == billingpb.BillingStatus_PAID || inv.GetStatus() == billingpb.BillingStatus_RETURNED ||
-			inv.GetStatus() == billingpb.BillingStatus_CANCELED || inv.GetStatus() == billingpb.BillingStatus_TERMINATED {
-			continue
-		}
-		foundInstance := false
-		for _, i := range inv.GetInstances() {
-			if i == "" {
-				continue
-			}
-			if i == req.GetUuid() {
-				foundInstance = true
-				continue
-			}
-			if !s.ca.HasAccess(ctx, acc.GetUuid(), driver.NewDocumentID(schema.INSTANCES_COL, i), accesspb.Level_ADMIN) {
-				continue outer
-			}
-		}
-		if !foundInstance {
-			continue
-		}
-		if err = s.inv_ctrl.Transfer(ctx, inv.GetUuid(), acc.GetUuid(), acc.Currency); err != nil {
-			log.Error("Failed to transfer invoice", zap.Error(err))
-			return nil, fmt.Errorf(errTmpl, err)
-		}
-		if inv, err = s.inv_ctrl.Get(ctx, inv.GetUuid()); err != nil {
-			log.Error("Failed to get invoice", zap.Error(err))
-			return nil, fmt.Errorf(errTmpl, err)
-		}
-		transferred = append(transferred, inv)
-	}
-	// Sync with payment gateway
-	gw := payments.GetPaymentGateway(acc.GetPaymentsGateway())
-	_z := 0
-	var success = &_z
-	g := errgroup.Group{}
-	m := &go_sync.Mutex{}
-	for _, trInv := range transferred {
-		invoice := trInv
-		g.Go(func() error {
-			if err = gw.CreateInvoice(ctx, invoice.Invoice); err != nil {
-				return err
-			}
-			m.Lock()
-			*success = *success + 1
-			m.Unlock()
-			return nil
-		})
-	}
-	if err = g.Wait(); err != nil {
-		// If gateway data is untouched, then abort transferring
-		if *success == 0 {
-			return nil, fmt.Errorf(errTmpl, err)
-		}
-		log.Error("FATAL: Failed to sync with payment gateway, but managed to process some gateway invoices",
-			zap.Error(err), zap.Int("processed", *success), zap.Int("total", len(transferred)))
-	}
 
-	log.Info("Finished transfer. Invoices were transferred", zap.Int("count", *success))
+	log.Info("Finished transfer. Invoices were transferred", zap.Int("count", len(transferred)))
 	return connect.NewResponse(&pb.TransferInstanceResponse{
 		Result: true,
 	}), nil
@@ -2025,6 +2042,7 @@ func (s *InstancesServer) processNebulaIG(ctx context.Context, log *zap.Logger,
 	return nil
 }
 
+// processIGsIPs only adjusts IP counters of groups, addresses themselves are tracked by IPAM allocations
 func processIGsIPs(ig *pb.InstancesGroup, inst *pb.Instance, decrease bool) *pb.InstancesGroup {
 	if ig == nil {
 		return nil
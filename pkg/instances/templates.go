@@ -0,0 +1,450 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	spb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/placeholders"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Instance fields kept in templates and clones, everything else belongs to particular instance
+var templateFields = []string{"title", "config", "resources", "product", "addons", "billing_plan"}
+
+type TemplateRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// Template is owned by namespace if set, by requester otherwise
+	Namespace string `json:"namespace"`
+	// Instance to take configuration from
+	Instance string `json:"instance"`
+	// Configuration for template made from scratch, Instance JSON
+	Config map[string]interface{} `json:"config"`
+	Params []placeholders.Param   `json:"params"`
+}
+
+type DeployRequest struct {
+	Ig        string            `json:"ig"`
+	Params    map[string]string `json:"params"`
+	Promocode string            `json:"promocode"`
+}
+
+type CloneRequest struct {
+	// Instances group to clone into, the same as source if empty
+	Ig    string `json:"ig"`
+	Title string `json:"title"`
+}
+
+type CreatedInstance struct {
+	Uuid string `json:"uuid"`
+}
+
+// cleanTemplate keeps only template fields, billing plan is referenced by uuid so current plan is used on deploy
+func cleanTemplate(src map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(templateFields))
+	for _, f := range templateFields {
+		if v, ok := src[f]; ok && v != nil {
+			res[f] = v
+		}
+	}
+	if plan, ok := res["billing_plan"].(map[string]interface{}); ok {
+		res["billing_plan"] = map[string]interface{}{"uuid": plan["uuid"]}
+	}
+	return res
+}
+
+func instanceToTemplate(inst *pb.Instance) (map[string]interface{}, error) {
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(inst)
+	if err != nil {
+		return nil, err
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return cleanTemplate(res), nil
+}
+
+func templateToInstance(tmpl map[string]interface{}) (*pb.Instance, error) {
+	data, err := json.Marshal(cleanTemplate(tmpl))
+	if err != nil {
+		return nil, err
+	}
+	inst := &pb.Instance{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, inst); err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// templateAccess checks requester has level of access to template owner, templates of account are available to account only
+func (s *InstancesServer) templateAccess(ctx context.Context, requester, owner string, level accesspb.Level) bool {
+	if owner == driver.NewDocumentID(schema.ACCOUNTS_COL, requester).String() {
+		return true
+	}
+	if !strings.HasPrefix(owner, schema.NAMESPACES_COL+"/") {
+		return false
+	}
+	return s.ca.HasAccess(ctx, requester, driver.DocumentID(owner), level)
+}
+
+func (s *InstancesServer) getTemplate(ctx context.Context, id string, level accesspb.Level) (*graph.InstanceTemplate, string, error) {
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	tmpl, err := graph.GetInstanceTemplate(ctx, s.db, id)
+	if err != nil || !s.templateAccess(ctx, requester, tmpl.Owner, level) {
+		return nil, requester, status.Error(codes.NotFound, "Template not found")
+	}
+	return tmpl, requester, nil
+}
+
+// sourceInstance reads instance requester manages, which configuration is copied
+func (s *InstancesServer) sourceInstance(ctx context.Context, requester, uuid string) (*graph.Instance, error) {
+	inst, err := s.ctrl.GetWithAccess(ctx, driver.NewDocumentID(schema.ACCOUNTS_COL, requester), uuid)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Instance not found")
+	}
+	if inst.GetAccess().GetLevel() < accesspb.Level_MGMT {
+		return nil, status.Error(codes.PermissionDenied, "Access denied")
+	}
+	return &inst, nil
+}
+
+func (s *InstancesServer) applyTemplateRequest(ctx context.Context, requester string, tmpl *graph.InstanceTemplate, req *TemplateRequest) error {
+	if req.Title != "" {
+		tmpl.Title = req.Title
+	}
+	if req.Description != "" {
+		tmpl.Description = req.Description
+	}
+	switch {
+	case req.Instance != "":
+		inst, err := s.sourceInstance(ctx, requester, req.Instance)
+		if err != nil {
+			return err
+		}
+		if tmpl.Instance, err = instanceToTemplate(inst.Instance); err != nil {
+			return status.Error(codes.Internal, "Error reading instance configuration")
+		}
+		tmpl.Source = req.Instance
+	case req.Config != nil:
+		tmpl.Instance = cleanTemplate(req.Config)
+	}
+	if req.Params != nil {
+		tmpl.Params = req.Params
+	}
+	if tmpl.Title == "" {
+		return status.Error(codes.InvalidArgument, "Title is required")
+	}
+	if len(tmpl.Instance) == 0 {
+		return status.Error(codes.InvalidArgument, "Either instance or config is required")
+	}
+	for _, p := range tmpl.Params {
+		if p.Key == "" {
+			return status.Error(codes.InvalidArgument, "Param key is required")
+		}
+	}
+	if _, err := templateToInstance(tmpl.Instance); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid instance config: %v", err)
+	}
+	return nil
+}
+
+func (s *InstancesServer) logTemplateEvent(log *zap.Logger, tmpl *graph.InstanceTemplate, action, requester string) {
+	diff, _ := json.Marshal(tmpl)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.INSTANCE_TEMPLATES_COL,
+		Uuid:      tmpl.Key,
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot:  &elpb.Snapshot{Diff: string(diff)},
+	})
+}
+
+func (s *InstancesServer) CreateInstanceTemplate(ctx context.Context, req *TemplateRequest) (*graph.InstanceTemplate, error) {
+	log := s.log.Named("CreateInstanceTemplate")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	owner := driver.NewDocumentID(schema.ACCOUNTS_COL, requester).String()
+	if req.Namespace != "" {
+		owner = driver.NewDocumentID(schema.NAMESPACES_COL, req.Namespace).String()
+		if !s.templateAccess(ctx, requester, owner, accesspb.Level_ADMIN) {
+			return nil, status.Error(codes.PermissionDenied, "Not enough access rights to namespace")
+		}
+	}
+	now := time.Now().Unix()
+	tmpl := &graph.InstanceTemplate{
+		Owner:     owner,
+		CreatedBy: requester,
+		Created:   now,
+		Updated:   now,
+	}
+	if err := s.applyTemplateRequest(ctx, requester, tmpl, req); err != nil {
+		return nil, err
+	}
+
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_TEMPLATES_COL)
+	tmpl, err := graph.CreateInstanceTemplate(ctx, s.db, tmpl)
+	if err != nil {
+		log.Error("Error creating template", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error creating template")
+	}
+	s.logTemplateEvent(log, tmpl, "create", requester)
+	return tmpl, nil
+}
+
+func (s *InstancesServer) ListInstanceTemplates(ctx context.Context) ([]graph.InstanceTemplate, error) {
+	log := s.log.Named("ListInstanceTemplates")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_TEMPLATES_COL)
+	res, err := graph.ListInstanceTemplates(ctx, s.db, driver.NewDocumentID(schema.ACCOUNTS_COL, requester))
+	if err != nil {
+		log.Error("Error listing templates", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing templates")
+	}
+	return res, nil
+}
+
+func (s *InstancesServer) GetInstanceTemplate(ctx context.Context, id string) (*graph.InstanceTemplate, error) {
+	tmpl, _, err := s.getTemplate(ctx, id, accesspb.Level_READ)
+	return tmpl, err
+}
+
+func (s *InstancesServer) UpdateInstanceTemplate(ctx context.Context, id string, req *TemplateRequest) (*graph.InstanceTemplate, error) {
+	log := s.log.Named("UpdateInstanceTemplate")
+	tmpl, requester, err := s.getTemplate(ctx, id, accesspb.Level_ADMIN)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.applyTemplateRequest(ctx, requester, tmpl, req); err != nil {
+		return nil, err
+	}
+	tmpl.Updated = time.Now().Unix()
+	if err := graph.UpdateInstanceTemplate(ctx, s.db, tmpl); err != nil {
+		log.Error("Error updating template", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error updating template")
+	}
+	s.logTemplateEvent(log, tmpl, "update", requester)
+	return tmpl, nil
+}
+
+func (s *InstancesServer) DeleteInstanceTemplate(ctx context.Context, id string) error {
+	log := s.log.Named("DeleteInstanceTemplate")
+	tmpl, requester, err := s.getTemplate(ctx, id, accesspb.Level_ADMIN)
+	if err != nil {
+		return err
+	}
+	if err := graph.DeleteInstanceTemplate(ctx, s.db, id); err != nil {
+		log.Error("Error deleting template", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting template")
+	}
+	s.logTemplateEvent(log, tmpl, "delete", requester)
+	return nil
+}
+
+// DeployInstanceTemplate creates instance from template with placeholders filled in. Create does all usual checks
+func (s *InstancesServer) DeployInstanceTemplate(ctx context.Context, id string, req *DeployRequest) (*CreatedInstance, error) {
+	tmpl, _, err := s.getTemplate(ctx, id, accesspb.Level_READ)
+	if err != nil {
+		return nil, err
+	}
+	if req.Ig == "" {
+		return nil, status.Error(codes.InvalidArgument, "Instances group is required")
+	}
+	values, err := placeholders.Resolve(tmpl.Instance, tmpl.Params, req.Params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	rendered, _ := placeholders.Render(tmpl.Instance, values).(map[string]interface{})
+	inst, err := templateToInstance(rendered)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid instance config: %v", err)
+	}
+	return s.createFrom(ctx, req.Ig, inst, req.Promocode)
+}
+
+// CloneInstance creates instance with configuration of given one, billed from current state of its plan
+func (s *InstancesServer) CloneInstance(ctx context.Context, uuid string, req *CloneRequest) (*CreatedInstance, error) {
+	log := s.log.Named("CloneInstance")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	src, err := s.sourceInstance(ctx, requester, uuid)
+	if err != nil {
+		return nil, err
+	}
+	ig := req.Ig
+	if ig == "" {
+		group, err := s.ctrl.GetGroup(ctx, driver.NewDocumentID(schema.INSTANCES_COL, uuid).String())
+		if err != nil || group.Group == nil {
+			log.Error("Failed to get instances group", zap.Error(err))
+			return nil, status.Error(codes.FailedPrecondition, "Instance is not linked to instances group")
+		}
+		ig = group.Group.GetUuid()
+	}
+	conf, err := instanceToTemplate(src.Instance)
+	if err != nil {
+		log.Error("Failed to read instance configuration", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error reading instance configuration")
+	}
+	inst, err := templateToInstance(conf)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error reading instance configuration")
+	}
+	inst.Title = req.Title
+	if inst.Title == "" {
+		inst.Title = src.GetTitle() + " (clone)"
+	}
+	return s.createFrom(ctx, ig, inst, "")
+}
+
+// createFrom creates instance of template or clone configuration
+// Configuration holds only billing plan uuid, so current plan is attached, otherwise it would be validated as dynamic one
+func (s *InstancesServer) createFrom(ctx context.Context, ig string, inst *pb.Instance, promocode string) (*CreatedInstance, error) {
+	if uuid := inst.GetBillingPlan().GetUuid(); uuid != "" {
+		plan, err := s.bp_ctrl.Get(ctx, &billingpb.Plan{Uuid: uuid})
+		if err != nil {
+			s.log.Named("createFrom").Warn("Failed to get billing plan", zap.String("plan", uuid), zap.Error(err))
+			return nil, status.Error(codes.FailedPrecondition, "Billing plan not found")
+		}
+		if plan.GetStatus() == spb.NoCloudStatus_DEL {
+			return nil, status.Error(codes.FailedPrecondition, "Billing plan is deleted")
+		}
+		inst.BillingPlan = plan.Plan
+	}
+	req := &pb.CreateRequest{Ig: ig, Instance: inst}
+	if promocode != "" {
+		req.Promocode = &promocode
+	}
+	resp, err := s.Create(ctx, connect.NewRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	return &CreatedInstance{Uuid: resp.Msg.GetId()}, nil
+}
+
+func (s *InstancesServer) RegisterTemplateRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/instances/templates", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListInstanceTemplates))).Methods("GET")
+	router.Handle("/instances/templates", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCreateInstanceTemplate))).Methods("POST")
+	router.Handle("/instances/templates/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGetInstanceTemplate))).Methods("GET")
+	router.Handle("/instances/templates/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleUpdateInstanceTemplate))).Methods("PUT")
+	router.Handle("/instances/templates/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleDeleteInstanceTemplate))).Methods("DELETE")
+	router.Handle("/instances/templates/{id}/deploy", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleDeployInstanceTemplate))).Methods("POST")
+	router.Handle("/instances/{uuid}/clone", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCloneInstance))).Methods("POST")
+}
+
+func (s *InstancesServer) HandleListInstanceTemplates(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListInstanceTemplates(request.Context())
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleCreateInstanceTemplate(writer http.ResponseWriter, request *http.Request) {
+	var req TemplateRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.CreateInstanceTemplate(request.Context(), &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *InstancesServer) HandleGetInstanceTemplate(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.GetInstanceTemplate(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleUpdateInstanceTemplate(writer http.ResponseWriter, request *http.Request) {
+	var req TemplateRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.UpdateInstanceTemplate(request.Context(), mux.Vars(request)["id"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleDeleteInstanceTemplate(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.DeleteInstanceTemplate(request.Context(), mux.Vars(request)["id"]))
+}
+
+func (s *InstancesServer) HandleDeployInstanceTemplate(writer http.ResponseWriter, request *http.Request) {
+	var req DeployRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.DeployInstanceTemplate(request.Context(), mux.Vars(request)["id"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *InstancesServer) HandleCloneInstance(writer http.ResponseWriter, request *http.Request) {
+	var req CloneRequest
+	if request.ContentLength != 0 {
+		if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+			http.Error(writer, "Malformed request body", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := s.CloneInstance(request.Context(), mux.Vars(request)["uuid"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
@@ -0,0 +1,183 @@
+package instances
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	spb "github.com/slntopp/nocloud-proto/statuses"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCleanTemplate(t *testing.T) {
+	res := cleanTemplate(map[string]interface{}{
+		"uuid":      "inst",
+		"title":     "vm",
+		"status":    "UP",
+		"state":     map[string]interface{}{"state": "RUNNING"},
+		"data":      map[string]interface{}{"vmid": 100.0},
+		"access":    map[string]interface{}{"level": "ROOT"},
+		"config":    map[string]interface{}{"template_id": 1.0},
+		"resources": map[string]interface{}{"cpu": 2.0},
+		"product":   "small",
+		"addons":    nil,
+		"billing_plan": map[string]interface{}{
+			"uuid": "plan", "title": "Plan", "kind": "STATIC",
+			"products": map[string]interface{}{"small": map[string]interface{}{"price": 10.0}},
+		},
+	})
+
+	assert.Equal(t, map[string]interface{}{
+		"title":        "vm",
+		"config":       map[string]interface{}{"template_id": 1.0},
+		"resources":    map[string]interface{}{"cpu": 2.0},
+		"product":      "small",
+		"billing_plan": map[string]interface{}{"uuid": "plan"},
+	}, res)
+}
+
+func testSourceInstance() *pb.Instance {
+	product := "small"
+	return &pb.Instance{
+		Uuid:      "src",
+		Title:     "vm",
+		Status:    spb.NoCloudStatus_UP,
+		Access:    &accesspb.Access{Level: accesspb.Level_ROOT},
+		Config:    map[string]*structpb.Value{"template_id": structpb.NewNumberValue(1)},
+		Resources: map[string]*structpb.Value{"cpu": structpb.NewNumberValue(2)},
+		Data:      map[string]*structpb.Value{"vmid": structpb.NewNumberValue(100)},
+		Product:   &product,
+		BillingPlan: &billingpb.Plan{
+			Uuid: "plan", Title: "Plan", Kind: billingpb.PlanKind_STATIC,
+			Products: map[string]*billingpb.Product{"small": {Price: 10}},
+		},
+	}
+}
+
+func TestInstanceToTemplate(t *testing.T) {
+	tmpl, err := instanceToTemplate(testSourceInstance())
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"title", "config", "resources", "product", "billing_plan"}, slices.Collect(maps.Keys(tmpl)))
+	assert.Equal(t, map[string]interface{}{"uuid": "plan"}, tmpl["billing_plan"])
+
+	inst, err := templateToInstance(tmpl)
+	require.NoError(t, err)
+	assert.Empty(t, inst.GetUuid())
+	assert.Nil(t, inst.GetData())
+	assert.Equal(t, spb.NoCloudStatus(0), inst.GetStatus())
+	assert.Equal(t, "small", inst.GetProduct())
+	assert.Equal(t, 2.0, inst.GetResources()["cpu"].GetNumberValue())
+	// Plan is loaded on create, template keeps only the reference
+	assert.Equal(t, "plan", inst.GetBillingPlan().GetUuid())
+	assert.Empty(t, inst.GetBillingPlan().GetProducts())
+}
+
+// cloneController serves source instance and records created one, other calls panic
+type cloneController struct {
+	graph.InstancesController
+	src     *pb.Instance
+	created *pb.Instance
+	group   driver.DocumentID
+}
+
+func (c *cloneController) GetWithAccess(_ context.Context, _ driver.DocumentID, id string) (graph.Instance, error) {
+	if id != c.src.GetUuid() {
+		return graph.Instance{}, assert.AnError
+	}
+	return graph.Instance{Instance: c.src}, nil
+}
+
+func (c *cloneController) GetGroup(context.Context, string) (*graph.GroupWithSP, error) {
+	return &graph.GroupWithSP{Group: &pb.InstancesGroup{Uuid: "src-ig"}}, nil
+}
+
+func (c *cloneController) Create(_ context.Context, group driver.DocumentID, _ string, i *pb.Instance) (string, error) {
+	c.group, c.created = group, i
+	return "clone", nil
+}
+
+// groupsController grants admin access to any group, other calls panic
+type groupsController struct {
+	graph.InstancesGroupsController
+}
+
+func (groupsController) GetWithAccess(_ context.Context, _ driver.DocumentID, id string) (graph.InstancesGroup, error) {
+	return graph.InstancesGroup{InstancesGroup: &pb.InstancesGroup{Uuid: id, Access: &accesspb.Access{Level: accesspb.Level_ADMIN}}}, nil
+}
+
+func (groupsController) GetSP(context.Context, string) (graph.ServicesProvider, error) {
+	return graph.ServicesProvider{ServicesProvider: &sppb.ServicesProvider{Uuid: "sp"}}, nil
+}
+
+func cloneServer(t *testing.T, plan *billingpb.Plan, planErr error) (*InstancesServer, *cloneController) {
+	ctrl := &cloneController{src: testSourceInstance()}
+	bp := graph_mocks.NewMockBillingPlansController(t)
+	bp.EXPECT().Get(mock.Anything, mock.MatchedBy(func(p *billingpb.Plan) bool {
+		return p.GetUuid() == "plan"
+	})).Return(&graph.BillingPlan{Plan: plan}, planErr)
+	return &InstancesServer{log: zap.NewNop(), ctrl: ctrl, ig_ctrl: groupsController{}, bp_ctrl: bp}, ctrl
+}
+
+func TestCloneInstance(t *testing.T) {
+	ctx := context.WithValue(context.Background(), nocloud.NoCloudAccount, schema.ROOT_ACCOUNT_KEY)
+	current := &billingpb.Plan{
+		Uuid: "plan", Title: "Plan v2", Kind: billingpb.PlanKind_STATIC,
+		Products: map[string]*billingpb.Product{"small": {Price: 12}},
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		s, ctrl := cloneServer(t, current, nil)
+
+		res, err := s.CloneInstance(ctx, "src", &CloneRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "clone", res.Uuid)
+		assert.Equal(t, driver.NewDocumentID(schema.INSTANCES_GROUPS_COL, "src-ig"), ctrl.group)
+		assert.Equal(t, "vm (clone)", ctrl.created.GetTitle())
+		assert.Empty(t, ctrl.created.GetUuid())
+		assert.Nil(t, ctrl.created.GetData())
+		// Current state of the plan is billed, not the one copied from source
+		assert.Same(t, current, ctrl.created.GetBillingPlan())
+	})
+
+	t.Run("title and group", func(t *testing.T) {
+		s, ctrl := cloneServer(t, current, nil)
+
+		_, err := s.CloneInstance(ctx, "src", &CloneRequest{Ig: "other-ig", Title: "copy"})
+		require.NoError(t, err)
+		assert.Equal(t, driver.NewDocumentID(schema.INSTANCES_GROUPS_COL, "other-ig"), ctrl.group)
+		assert.Equal(t, "copy", ctrl.created.GetTitle())
+	})
+
+	t.Run("plan deleted", func(t *testing.T) {
+		s, ctrl := cloneServer(t, &billingpb.Plan{Uuid: "plan", Status: spb.NoCloudStatus_DEL}, nil)
+
+		_, err := s.CloneInstance(ctx, "src", &CloneRequest{})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Nil(t, ctrl.created)
+	})
+
+	t.Run("plan not found", func(t *testing.T) {
+		s, ctrl := cloneServer(t, nil, assert.AnError)
+
+		_, err := s.CloneInstance(ctx, "src", &CloneRequest{})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Nil(t, ctrl.created)
+	})
+}
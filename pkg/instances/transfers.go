@@ -0,0 +1,645 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	go_sync "sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	amqp "github.com/rabbitmq/amqp091-go"
+	accesspb "github.com/slntopp/nocloud-proto/access"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	epb "github.com/slntopp/nocloud-proto/events"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/payments"
+	"github.com/slntopp/nocloud/pkg/nocloud/rabbitmq"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	transfersKey     = "instance-transfers"
+	transfersLockKey = "instances-transfers-lock"
+)
+
+type TransfersConf struct {
+	// Seconds between checks for expired requests
+	Frequency int `json:"frequency"`
+	// Hours request stays pending if sender didn't set other
+	TTLHours int `json:"ttl_hours"`
+	// Longest lifetime sender can set
+	MaxTTLHours int `json:"max_ttl_hours"`
+	// Invoices policy used if sender didn't set one, reassign or settle
+	Invoices string `json:"invoices"`
+	// Minutes after which request left in processing by interrupted accept is recovered
+	ProcessingTimeout int `json:"processing_timeout"`
+}
+
+var defaultTransfersSettings = &sc.Setting[TransfersConf]{
+	Value: TransfersConf{
+		Frequency:   300,
+		TTLHours:    72,
+		MaxTTLHours: 720,
+		Invoices:    graph.TransferInvoicesReassign,
+
+		ProcessingTimeout: 30,
+	},
+	Description: "Instance transfers between accounts: expiry check frequency, default and max request lifetime, default unpaid invoices policy (reassign or settle) and minutes after which interrupted accept is recovered",
+	Level:       accesspb.Level_ADMIN,
+}
+
+func getTransfersSettings(log *zap.Logger) TransfersConf {
+	var conf TransfersConf
+	if scErr := sc.Fetch(transfersKey, &conf, defaultTransfersSettings); scErr != nil {
+		log.Warn("Cannot fetch transfers settings", zap.Error(scErr))
+		conf = defaultTransfersSettings.Value
+	}
+	return conf
+}
+
+type TransferRequest struct {
+	// Recipient account uuid or email
+	To string `json:"to"`
+	// reassign or settle
+	Invoices string `json:"invoices"`
+	TTLHours int    `json:"ttl_hours"`
+	Comment  string `json:"comment"`
+}
+
+// newEventsPublisher publishes events straight to events queue, as billing does
+func newEventsPublisher(log *zap.Logger, rbmq rabbitmq.Connection) func(event *epb.Event) error {
+	return func(event *epb.Event) error {
+		ch, err := rbmq.Channel()
+		if err != nil {
+			log.Error("Failed to open a events channel", zap.Error(err))
+			return err
+		}
+		defer ch.Close()
+		body, err := proto.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return ch.PublishWithContext(context.Background(), "", "events", false, false, amqp.Publishing{
+			ContentType: "text/plain", Body: body,
+		})
+	}
+}
+
+func (s *InstancesServer) notifyTransfer(log *zap.Logger, tr *graph.InstanceTransfer, key string, accounts ...string) {
+	if s.events == nil {
+		return
+	}
+	data := map[string]*structpb.Value{
+		"transfer":       structpb.NewStringValue(tr.Key),
+		"instance":       structpb.NewStringValue(tr.Instance),
+		"instance_title": structpb.NewStringValue(tr.InstanceTitle),
+		"from":           structpb.NewStringValue(tr.From),
+		"to":             structpb.NewStringValue(tr.To),
+		"status":         structpb.NewStringValue(tr.Status),
+		"expires":        structpb.NewNumberValue(float64(tr.Expires)),
+	}
+	for _, acc := range accounts {
+		if err := s.events(&epb.Event{
+			Type: "email",
+			Uuid: acc,
+			Key:  key,
+			Data: data,
+			Ts:   time.Now().Unix(),
+		}); err != nil {
+			log.Error("Failed to publish transfer notification", zap.String("key", key), zap.String("account", acc), zap.Error(err))
+		}
+	}
+}
+
+func (s *InstancesServer) logTransferEvent(log *zap.Logger, tr *graph.InstanceTransfer, action, requester string) {
+	diff, _ := json.Marshal(tr)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.INSTANCES_COL,
+		Uuid:      tr.Instance,
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot:  &elpb.Snapshot{Diff: string(diff)},
+	})
+}
+
+func rootContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, nocloud.NoCloudAccount, schema.ROOT_ACCOUNT_KEY)
+}
+
+func invoiceSettled(inv *graph.Invoice) bool {
+	switch inv.GetStatus() {
+	case billingpb.BillingStatus_PAID, billingpb.BillingStatus_RETURNED, billingpb.BillingStatus_CANCELED, billingpb.BillingStatus_TERMINATED:
+		return true
+	}
+	return false
+}
+
+// unpaidInvoices returns invoices of account including instance which are still to be paid
+func (s *InstancesServer) unpaidInvoices(ctx context.Context, account, instance string) ([]*graph.Invoice, error) {
+	invoices, err := s.inv_ctrl.List(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*graph.Invoice, 0)
+	for _, inv := range invoices {
+		if inv.GetAccount() != account || invoiceSettled(inv) {
+			continue
+		}
+		for _, i := range inv.GetInstances() {
+			if i == instance {
+				res = append(res, inv)
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// transferInvoices moves unpaid invoices of instance from previous owner to acc and syncs them with acc's payments gateway.
+// Invoices also including instances acc has no access to are left as is
+func (s *InstancesServer) transferInvoices(ctx context.Context, log *zap.Logger, instance, from string, acc graph.Account) ([]string, error) {
+	invoices, err := s.unpaidInvoices(ctx, from, instance)
+	if err != nil {
+		log.Error("Failed to list invoices", zap.Error(err))
+		return nil, err
+	}
+	transferred := make([]*graph.Invoice, 0)
+outer:
+	for _, inv := range invoices {
+		for _, i := range inv.GetInstances() {
+			if i == "" || i == instance {
+				continue
+			}
+			if !s.ca.HasAccess(ctx, acc.GetUuid(), driver.NewDocumentID(schema.INSTANCES_COL, i), accesspb.Level_ADMIN) {
+				continue outer
+			}
+		}
+		if err = s.inv_ctrl.Transfer(ctx, inv.GetUuid(), acc.GetUuid(), acc.Currency); err != nil {
+			log.Error("Failed to transfer invoice", zap.Error(err))
+			return nil, err
+		}
+		if inv, err = s.inv_ctrl.Get(ctx, inv.GetUuid()); err != nil {
+			log.Error("Failed to get invoice", zap.Error(err))
+			return nil, err
+		}
+		transferred = append(transferred, inv)
+	}
+	// Sync with payment gateway
+	gw := payments.GetPaymentGateway(acc.GetPaymentsGateway())
+	success := 0
+	g := errgroup.Group{}
+	m := &go_sync.Mutex{}
+	for _, trInv := range transferred {
+		invoice := trInv
+		g.Go(func() error {
+			if err := gw.CreateInvoice(ctx, invoice.Invoice); err != nil {
+				return err
+			}
+			m.Lock()
+			success++
+			m.Unlock()
+			return nil
+		})
+	}
+	if err = g.Wait(); err != nil {
+		// If gateway data is untouched, then abort transferring
+		if success == 0 {
+			return nil, err
+		}
+		log.Error("FATAL: Failed to sync with payment gateway, but managed to process some gateway invoices",
+			zap.Error(err), zap.Int("processed", success), zap.Int("total", len(transferred)))
+	}
+	res := make([]string, 0, len(transferred))
+	for _, inv := range transferred {
+		res = append(res, inv.GetUuid())
+	}
+	return res, nil
+}
+
+func (s *InstancesServer) CreateInstanceTransfer(ctx context.Context, instance string, req *TransferRequest) (*graph.InstanceTransfer, error) {
+	log := s.log.Named("CreateInstanceTransfer")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log = log.With(zap.String("instance", instance), zap.String("requester", requester))
+	conf := getTransfersSettings(log)
+
+	inst, err := s.ctrl.GetWithAccess(ctx, driver.NewDocumentID(schema.ACCOUNTS_COL, requester), instance)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Instance not found")
+	}
+	if inst.GetAccess().GetLevel() < accesspb.Level_ADMIN {
+		return nil, status.Error(codes.PermissionDenied, "Access denied")
+	}
+	owner, err := s.ctrl.GetInstanceOwner(ctx, instance)
+	if err != nil {
+		log.Error("Failed to get instance owner", zap.Error(err))
+		return nil, status.Error(codes.FailedPrecondition, "Instance owner not found")
+	}
+
+	to := strings.TrimSpace(req.To)
+	if strings.Contains(to, "@") {
+		if to, err = graph.FindAccountByEmail(ctx, s.db, to); err != nil {
+			log.Error("Failed to find account by email", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error looking up recipient")
+		}
+	}
+	if to == "" {
+		return nil, status.Error(codes.InvalidArgument, "Recipient not found")
+	}
+	if _, err = s.acc_ctrl.Get(rootContext(ctx), to); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Recipient not found")
+	}
+	if to == owner.GetUuid() {
+		return nil, status.Error(codes.InvalidArgument, "Recipient already owns instance")
+	}
+
+	invoices := req.Invoices
+	if invoices == "" {
+		invoices = conf.Invoices
+	}
+	if invoices != graph.TransferInvoicesReassign && invoices != graph.TransferInvoicesSettle {
+		return nil, status.Errorf(codes.InvalidArgument, "Unknown invoices policy %s", invoices)
+	}
+	ttl := req.TTLHours
+	if ttl <= 0 {
+		ttl = conf.TTLHours
+	}
+	if conf.MaxTTLHours > 0 && ttl > conf.MaxTTLHours {
+		return nil, status.Errorf(codes.InvalidArgument, "Request can't live longer than %d hours", conf.MaxTTLHours)
+	}
+
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_TRANSFERS_COL)
+	pending, err := graph.PendingTransfersOfInstance(ctx, s.db, instance)
+	if err != nil {
+		log.Error("Failed to list pending transfers", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error creating transfer request")
+	}
+	if len(pending) > 0 {
+		return nil, status.Errorf(codes.AlreadyExists, "Instance already has pending transfer request %s", pending[0].Key)
+	}
+
+	now := time.Now()
+	tr, err := graph.CreateInstanceTransfer(ctx, s.db, &graph.InstanceTransfer{
+		Instance:      instance,
+		InstanceTitle: inst.GetTitle(),
+		From:          owner.GetUuid(),
+		To:            to,
+		Invoices:      invoices,
+		Comment:       req.Comment,
+		Status:        graph.TransferPending,
+		CreatedBy:     requester,
+		Created:       now.Unix(),
+		Expires:       now.Add(time.Duration(ttl) * time.Hour).Unix(),
+	})
+	if err != nil {
+		log.Error("Failed to create transfer request", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error creating transfer request")
+	}
+	s.logTransferEvent(log, tr, "transfer_request", requester)
+	s.notifyTransfer(log, tr, "instance_transfer_request", tr.To)
+	return tr, nil
+}
+
+func (s *InstancesServer) ListInstanceTransfers(ctx context.Context, st string) ([]graph.InstanceTransfer, error) {
+	log := s.log.Named("ListInstanceTransfers")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_TRANSFERS_COL)
+	res, err := graph.ListInstanceTransfers(ctx, s.db, requester, st)
+	if err != nil {
+		log.Error("Error listing transfers", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing transfer requests")
+	}
+	return res, nil
+}
+
+// getPendingTransfer returns request which is still waiting for decision
+func (s *InstancesServer) getPendingTransfer(ctx context.Context, id string) (*graph.InstanceTransfer, error) {
+	tr, err := graph.GetInstanceTransfer(ctx, s.db, id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Transfer request not found")
+	}
+	if tr.Status != graph.TransferPending {
+		return nil, status.Errorf(codes.FailedPrecondition, "Transfer request is %s", tr.Status)
+	}
+	if tr.Expires <= time.Now().Unix() {
+		return nil, status.Error(codes.FailedPrecondition, "Transfer request is expired")
+	}
+	return tr, nil
+}
+
+// resolveTransfer moves request out of pending, reporting conflict if it was resolved concurrently
+func (s *InstancesServer) resolveTransfer(ctx context.Context, log *zap.Logger, tr *graph.InstanceTransfer, to, requester string) (*graph.InstanceTransfer, error) {
+	res, err := graph.SetInstanceTransferStatus(ctx, s.db, tr.Key, graph.TransferPending, to, requester, time.Now().Unix())
+	if errors.Is(err, graph.ErrTransferNotPending) {
+		return nil, status.Error(codes.Aborted, "Transfer request was resolved meanwhile")
+	}
+	if err != nil {
+		log.Error("Failed to update transfer request", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error updating transfer request")
+	}
+	return res, nil
+}
+
+func (s *InstancesServer) RejectInstanceTransfer(ctx context.Context, id string) (*graph.InstanceTransfer, error) {
+	log := s.log.Named("RejectInstanceTransfer")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	tr, err := s.getPendingTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if tr.To != requester {
+		return nil, status.Error(codes.PermissionDenied, "Only recipient can reject transfer request")
+	}
+	if tr, err = s.resolveTransfer(ctx, log, tr, graph.TransferRejected, requester); err != nil {
+		return nil, err
+	}
+	s.logTransferEvent(log, tr, "transfer_reject", requester)
+	s.notifyTransfer(log, tr, "instance_transfer_rejected", tr.From)
+	return tr, nil
+}
+
+func (s *InstancesServer) CancelInstanceTransfer(ctx context.Context, id string) (*graph.InstanceTransfer, error) {
+	log := s.log.Named("CancelInstanceTransfer")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	tr, err := s.getPendingTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if tr.From != requester && tr.CreatedBy != requester &&
+		!s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.INSTANCES_COL, tr.Instance), accesspb.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "Only sender can cancel transfer request")
+	}
+	if tr, err = s.resolveTransfer(ctx, log, tr, graph.TransferCanceled, requester); err != nil {
+		return nil, err
+	}
+	s.logTransferEvent(log, tr, "transfer_cancel", requester)
+	s.notifyTransfer(log, tr, "instance_transfer_canceled", tr.To)
+	return tr, nil
+}
+
+// AcceptInstanceTransfer moves instance to recipient. Both parties agreed, so transfer itself runs as root.
+// Unpaid invoices are reassigned to recipient or must be paid by sender beforehand, depending on request policy.
+// Promocode uses are moved to recipient if their limits allow it, addons live on instance and move with it
+func (s *InstancesServer) AcceptInstanceTransfer(ctx context.Context, id string) (*graph.InstanceTransfer, error) {
+	log := s.log.Named("AcceptInstanceTransfer")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	tr, err := s.getPendingTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if tr.To != requester {
+		return nil, status.Error(codes.PermissionDenied, "Only recipient can accept transfer request")
+	}
+	log = log.With(zap.String("transfer", tr.Key), zap.String("instance", tr.Instance), zap.String("from", tr.From), zap.String("to", tr.To))
+	rootCtx := rootContext(ctx)
+
+	owner, err := s.ctrl.GetInstanceOwner(rootCtx, tr.Instance)
+	if err != nil || owner.GetUuid() != tr.From {
+		return nil, status.Error(codes.FailedPrecondition, "Instance owner has changed since request was made")
+	}
+	unpaid, err := s.unpaidInvoices(rootCtx, tr.From, tr.Instance)
+	if err != nil {
+		log.Error("Failed to list invoices", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error checking instance invoices")
+	}
+	if tr.Invoices == graph.TransferInvoicesSettle && len(unpaid) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "Sender has %d unpaid invoices for this instance, they must be paid first", len(unpaid))
+	}
+	inst, err := s.ctrl.Get(rootCtx, tr.Instance)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Instance not found")
+	}
+
+	if tr, err = s.resolveTransfer(ctx, log, tr, graph.TransferProcessing, requester); err != nil {
+		return nil, err
+	}
+	to := tr.To
+	_, err = s.TransferInstance(rootCtx, connect.NewRequest(&pb.TransferInstanceRequest{
+		Uuid:                  tr.Instance,
+		Account:               &to,
+		DoNotTransferInvoices: true,
+	}))
+	if err != nil {
+		log.Error("Failed to transfer instance", zap.Error(err))
+		tr.Status, tr.Error, tr.ResolvedBy, tr.Resolved = graph.TransferPending, err.Error(), "", 0
+		if uErr := graph.UpdateInstanceTransfer(context.WithoutCancel(ctx), s.db, tr); uErr != nil {
+			// Request stays in processing, routine returns it to pending once processing timeout passes
+			log.Error("Failed to return request to pending", zap.Error(uErr))
+			return nil, status.Error(codes.Internal, "Failed to transfer instance and to return request to pending")
+		}
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	// Instance is moved already, failures below are recorded on request, but don't revert it
+	tr.Error = ""
+	tr.Addons = inst.GetAddons()
+	if tr.Invoices == graph.TransferInvoicesReassign && len(unpaid) > 0 {
+		acc, err := s.acc_ctrl.Get(rootCtx, tr.To)
+		if err == nil {
+			tr.TransferredInvoices, err = s.transferInvoices(rootCtx, log, tr.Instance, tr.From, acc)
+		}
+		if err != nil {
+			log.Error("Failed to reassign invoices", zap.Error(err))
+			tr.Error = "Instance was transferred, but failed to reassign invoices: " + err.Error()
+		}
+	}
+	if tr.PromocodesKept, tr.PromocodesDropped, err = graph.RebindInstancePromocodes(rootCtx, s.db, tr.Instance, tr.To); err != nil {
+		log.Error("Failed to rebind promocodes", zap.Error(err))
+		tr.Error = strings.TrimSpace(tr.Error + " Failed to re-evaluate promocodes: " + err.Error())
+	}
+	tr.Status = graph.TransferAccepted
+	tr.Resolved = time.Now().Unix()
+	if err := graph.UpdateInstanceTransfer(context.WithoutCancel(ctx), s.db, tr); err != nil {
+		// Request stays in processing, routine marks it accepted once processing timeout passes
+		log.Error("Failed to update transfer request", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Instance was transferred, but failed to update transfer request")
+	}
+
+	log.Info("Instance transferred", zap.Int("invoices", len(tr.TransferredInvoices)),
+		zap.Strings("promocodes_dropped", tr.PromocodesDropped))
+	s.logTransferEvent(log, tr, "transfer_accept", requester)
+	s.notifyTransfer(log, tr, "instance_transfer_accepted", tr.From, tr.To)
+	return tr, nil
+}
+
+// recoverStaleTransfers settles requests left in processing by accept which was interrupted.
+// Request is accepted if instance reached recipient, otherwise it's returned to pending or expired
+func (s *InstancesServer) recoverStaleTransfers(ctx context.Context, log *zap.Logger, conf TransfersConf) {
+	now := time.Now().Unix()
+	timeout := int64(max(conf.ProcessingTimeout, 1)) * 60
+	stale, err := graph.StaleInstanceTransfers(ctx, s.db, now-timeout)
+	if err != nil {
+		log.Error("Error listing stale transfer requests", zap.Error(err))
+		return
+	}
+	for i := range stale {
+		tr := &stale[i]
+		owner, err := s.ctrl.GetInstanceOwner(rootContext(ctx), tr.Instance)
+		if err != nil {
+			log.Warn("Failed to get instance owner, leaving transfer request in processing", zap.String("transfer", tr.Key), zap.Error(err))
+			continue
+		}
+
+		to, reason, action := graph.TransferPending, "Accept was interrupted", ""
+		switch {
+		case owner.GetUuid() == tr.To:
+			to, reason, action = graph.TransferAccepted, "Accept was interrupted after instance was transferred", "transfer_accept"
+		case tr.Expires <= now:
+			to, action = graph.TransferExpired, "transfer_expire"
+		}
+		res, err := graph.RecoverInstanceTransfer(ctx, s.db, tr, to, reason, now)
+		if errors.Is(err, graph.ErrTransferNotPending) {
+			continue
+		}
+		if err != nil {
+			log.Error("Failed to recover transfer request", zap.String("transfer", tr.Key), zap.Error(err))
+			continue
+		}
+		log.Info("Recovered stale transfer request", zap.String("transfer", tr.Key), zap.String("status", to))
+
+		switch action {
+		case "transfer_accept":
+			s.logTransferEvent(log, res, action, schema.ROOT_ACCOUNT_KEY)
+			s.notifyTransfer(log, res, "instance_transfer_accepted", res.From, res.To)
+		case "transfer_expire":
+			s.logTransferEvent(log, res, action, schema.ROOT_ACCOUNT_KEY)
+			s.notifyTransfer(log, res, "instance_transfer_expired", res.From, res.To)
+		}
+	}
+}
+
+// TransferRoutine expires pending transfer requests and recovers stale ones, only replica holding lock does it
+func (s *InstancesServer) TransferRoutine(_ctx context.Context, wg *go_sync.WaitGroup) {
+	defer wg.Done()
+	ctx := context.WithoutCancel(_ctx)
+	log := s.log.Named("TransferRoutine")
+	graph.GetEnsureCollection(log, ctx, s.db, schema.INSTANCE_TRANSFERS_COL)
+
+start:
+	conf := getTransfersSettings(log)
+	frequency := time.Duration(max(conf.Frequency, 10)) * time.Second
+
+	upd := make(chan bool, 1)
+	go sc.Subscribe([]string{transfersKey}, upd)
+
+	log.Info("Got Configuration", zap.Any("conf", conf))
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+
+	for {
+		locked, err := s.rdb.SetNX(ctx, transfersLockKey, time.Now().Unix(), frequency/2).Result()
+		if err != nil {
+			log.Error("Error acquiring transfers lock", zap.Error(err))
+		} else if locked {
+			expired, err := graph.ExpireInstanceTransfers(ctx, s.db, time.Now().Unix())
+			if err != nil {
+				log.Error("Error expiring transfer requests", zap.Error(err))
+			}
+			for i := range expired {
+				s.logTransferEvent(log, &expired[i], "transfer_expire", schema.ROOT_ACCOUNT_KEY)
+				s.notifyTransfer(log, &expired[i], "instance_transfer_expired", expired[i].From, expired[i].To)
+			}
+			s.recoverStaleTransfers(ctx, log, conf)
+		}
+
+		select {
+		case <-_ctx.Done():
+			log.Info("Context is done. Quitting")
+			return
+		case <-ticker.C:
+			continue
+		case <-upd:
+			log.Info("New Configuration Received, restarting Routine")
+			ticker.Stop()
+			goto start
+		}
+	}
+}
+
+func (s *InstancesServer) RegisterTransferRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/instances/{uuid}/transfers", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCreateInstanceTransfer))).Methods("POST")
+	router.Handle("/instances/transfers", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListInstanceTransfers))).Methods("GET")
+	router.Handle("/instances/transfers/{id}/{action:accept|reject|cancel}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleResolveInstanceTransfer))).Methods("POST")
+}
+
+func (s *InstancesServer) HandleCreateInstanceTransfer(writer http.ResponseWriter, request *http.Request) {
+	var req TransferRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.CreateInstanceTransfer(request.Context(), mux.Vars(request)["uuid"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *InstancesServer) HandleListInstanceTransfers(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListInstanceTransfers(request.Context(), request.URL.Query().Get("status"))
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *InstancesServer) HandleResolveInstanceTransfer(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	var (
+		res *graph.InstanceTransfer
+		err error
+	)
+	switch vars["action"] {
+	case "accept":
+		res, err = s.AcceptInstanceTransfer(request.Context(), vars["id"])
+	case "reject":
+		res, err = s.RejectInstanceTransfer(request.Context(), vars["id"])
+	case "cancel":
+		res, err = s.CancelInstanceTransfer(request.Context(), vars["id"])
+	default:
+		err = status.Errorf(codes.InvalidArgument, "Unknown action %s", vars["action"])
+	}
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
@@ -0,0 +1,86 @@
+package instances
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	accountspb "github.com/slntopp/nocloud-proto/registry/accounts"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+)
+
+// ownersController knows only instance owners, other calls panic
+type ownersController struct {
+	graph.InstancesController
+	owners map[string]string
+}
+
+func (c *ownersController) GetInstanceOwner(_ context.Context, uuid string) (graph.Account, error) {
+	owner, ok := c.owners[uuid]
+	if !ok {
+		return graph.Account{}, assert.AnError
+	}
+	return graph.Account{Account: &accountspb.Account{Uuid: owner}}, nil
+}
+
+// Cursor returning given documents
+func documentsCursor[T any](t *testing.T, docs ...T) *driver_mocks.MockCursor {
+	cursor := driver_mocks.NewMockCursor(t)
+	for _, doc := range docs {
+		cursor.EXPECT().HasMore().Return(true).Once()
+		cursor.EXPECT().ReadDocument(mock.Anything, mock.Anything).Run(func(_ context.Context, result interface{}) {
+			*result.(*T) = doc
+		}).Return(driver.DocumentMeta{}, nil).Once()
+	}
+	cursor.EXPECT().HasMore().Return(false).Once()
+	cursor.EXPECT().Close().Return(nil)
+	return cursor
+}
+
+func TestRecoverStaleTransfers(t *testing.T) {
+	now := time.Now().Unix()
+	transferred := graph.InstanceTransfer{Key: "transferred", Instance: "a", From: "sender", To: "recipient",
+		Status: graph.TransferProcessing, Resolved: now - 3600, Expires: now + 3600}
+	interrupted := graph.InstanceTransfer{Key: "interrupted", Instance: "b", From: "sender", To: "recipient",
+		Status: graph.TransferProcessing, Resolved: now - 3600, Expires: now + 3600}
+	expired := graph.InstanceTransfer{Key: "expired", Instance: "c", From: "sender", To: "recipient",
+		Status: graph.TransferProcessing, Resolved: now - 3600, Expires: now - 60}
+
+	db := driver_mocks.NewMockDatabase(t)
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		before, ok := vars["before"].(int64)
+		return ok && before <= now-30*60
+	})).Return(documentsCursor(t, transferred, interrupted, expired), nil).Once()
+	expectRecover := func(tr graph.InstanceTransfer, to string) {
+		db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+			return vars["key"] == tr.Key && vars["to"] == to && vars["since"] == tr.Resolved
+		})).Return(documentsCursor(t, tr), nil).Once()
+	}
+	expectRecover(transferred, graph.TransferAccepted)
+	expectRecover(interrupted, graph.TransferPending)
+	expectRecover(expired, graph.TransferExpired)
+
+	ctrl := &ownersController{owners: map[string]string{"a": "recipient", "b": "sender", "c": "sender"}}
+
+	s := &InstancesServer{log: zap.NewNop(), db: db, ctrl: ctrl}
+	s.recoverStaleTransfers(context.Background(), zap.NewNop(), TransfersConf{ProcessingTimeout: 30})
+}
+
+func TestRecoverStaleTransfersKeepsUnknownOwner(t *testing.T) {
+	now := time.Now().Unix()
+	tr := graph.InstanceTransfer{Key: "stale", Instance: "a", From: "sender", To: "recipient",
+		Status: graph.TransferProcessing, Resolved: now - 3600, Expires: now + 3600}
+
+	db := driver_mocks.NewMockDatabase(t)
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(documentsCursor(t, tr), nil).Once()
+	ctrl := &ownersController{}
+
+	// Nothing else is queried, request stays in processing until owner is known
+	s := &InstancesServer{log: zap.NewNop(), db: db, ctrl: ctrl}
+	s.recoverStaleTransfers(context.Background(), zap.NewNop(), TransfersConf{ProcessingTimeout: 30})
+}
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/impersonation"
 	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
 	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
 	"go.uber.org/zap"
@@ -113,6 +114,16 @@ func JWT_AUTH_MIDDLEWARE(ctx context.Context) (context.Context, error) {
 		ctx = context.WithValue(ctx, nocloud.NoCloudSession, sid)
 	}
 
+	actor, err := impersonation.Verify(rdb, token, uuid)
+	if err != nil {
+		log.Debug("Impersonation check failed", zap.Any("error", err))
+		return ctx, status.Error(codes.Unauthenticated, "Impersonation is expired, ended or invalid")
+	}
+	if actor != nil {
+		impersonation.Audit(log, actor, uuid, "admin", int32(codes.PermissionDenied))
+		return ctx, status.Error(codes.PermissionDenied, "Impersonated sessions have no access to admin API")
+	}
+
 	var exp int64
 	if token["expires"] != nil {
 		exp = int64(token["expires"].(float64))
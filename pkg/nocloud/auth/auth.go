@@ -23,6 +23,7 @@ import (
 	healthpb "github.com/slntopp/nocloud-proto/health"
 	sppb "github.com/slntopp/nocloud-proto/services_providers"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/impersonation"
 	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
 	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
 	"go.uber.org/zap"
@@ -75,6 +76,16 @@ func JWT_STREAM_INTERCEPTOR(srv interface{}, stream grpc.ServerStream, info *grp
 		return err
 	}
 
+	if actor := impersonation.FromContext(ctx); actor != nil {
+		account := ctx.Value(nocloud.NoCloudAccount).(string)
+		if !actor.Allows(info.FullMethod) {
+			impersonation.Audit(l, actor, account, info.FullMethod, int32(codes.PermissionDenied))
+			return status.Error(codes.PermissionDenied, "Not allowed in impersonated session")
+		}
+		impersonation.Audit(l, actor, account, info.FullMethod, int32(codes.OK))
+		_ = stream.SetHeader(metadata.New(actor.Headers()))
+	}
+
 	return handler(srv, &grpc_middleware.WrappedServerStream{
 		ServerStream:   stream,
 		WrappedContext: ctx,
@@ -138,9 +149,27 @@ func JWT_AUTH_INTERCEPTOR(ctx context.Context, req interface{}, info *grpc.Unary
 
 	go handleLogActivity(ctx)
 
+	if actor := impersonation.FromContext(ctx); actor != nil {
+		return handleImpersonated(ctx, l, actor, req, info, handler)
+	}
+
 	return handler(ctx, req)
 }
 
+// Impersonated calls are limited by mode and every one of them is audited
+func handleImpersonated(ctx context.Context, l *zap.Logger, actor *impersonation.Actor, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	account := ctx.Value(nocloud.NoCloudAccount).(string)
+	if !actor.Allows(info.FullMethod) {
+		impersonation.Audit(l, actor, account, info.FullMethod, int32(codes.PermissionDenied))
+		return nil, status.Error(codes.PermissionDenied, "Not allowed in impersonated session")
+	}
+	_ = grpc.SetHeader(ctx, metadata.New(actor.Headers()))
+
+	res, err := handler(ctx, req)
+	impersonation.Audit(l, actor, account, info.FullMethod, int32(status.Code(err)))
+	return res, err
+}
+
 func JWT_AUTH_MIDDLEWARE(ctx context.Context) (context.Context, error) {
 	l := log.Named("Middleware")
 	tokenString, err := grpc_auth.AuthFromMD(ctx, "bearer")
@@ -183,6 +212,15 @@ func JWT_AUTH_MIDDLEWARE(ctx context.Context) (context.Context, error) {
 		ctx = context.WithValue(ctx, nocloud.NoCloudSession, sid)
 	}
 
+	actor, err := impersonation.Verify(rdb, token, uuid)
+	if err != nil {
+		log.Debug("Impersonation check failed", zap.Any("error", err))
+		return ctx, status.Error(codes.Unauthenticated, "Impersonation is expired, ended or invalid")
+	}
+	if actor != nil {
+		ctx = context.WithValue(ctx, nocloud.NoCloudActor, actor)
+	}
+
 	var exp int64
 	if token["expires"] != nil {
 		exp = int64(token["expires"].(float64))
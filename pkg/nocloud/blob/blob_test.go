@@ -0,0 +1,51 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := store.Put(ctx, "acc/doc.pdf", strings.NewReader("content"))
+	if err != nil || n != 7 {
+		t.Fatalf("Put: %d, %v", n, err)
+	}
+
+	r, err := store.Get(ctx, "acc/doc.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "content" {
+		t.Fatalf("unexpected content %q", data)
+	}
+
+	if err := store.Delete(ctx, "acc/doc.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "acc/doc.pdf"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFileStore_RejectsEscapingKeys(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "/etc/passwd", "../x", "a/../../x", "a//b", "a\\b"} {
+		if _, err := store.Put(context.Background(), key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("key %q: expected ErrInvalidKey, got %v", key, err)
+		}
+	}
+}
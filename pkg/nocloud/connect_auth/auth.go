@@ -9,6 +9,7 @@ import (
 	healthpb "github.com/slntopp/nocloud-proto/health"
 	sppb "github.com/slntopp/nocloud-proto/services_providers"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/impersonation"
 	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
 	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
 	"go.uber.org/zap"
@@ -113,10 +114,37 @@ func (i *Interceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
 
 		go i.handleLogActivity(ctx)
 
+		if actor := impersonation.FromContext(ctx); actor != nil {
+			return i.handleImpersonated(ctx, actor, req, next)
+		}
+
 		return next(ctx, req)
 	})
 }
 
+// Impersonated calls are limited by mode and every one of them is audited
+func (i *Interceptor) handleImpersonated(ctx context.Context, actor *impersonation.Actor, req connect.AnyRequest, next connect.UnaryFunc) (connect.AnyResponse, error) {
+	account := ctx.Value(nocloud.NoCloudAccount).(string)
+	procedure := req.Spec().Procedure
+	if !actor.Allows(procedure) {
+		impersonation.Audit(i.log, actor, account, procedure, int32(connect.CodePermissionDenied))
+		return nil, connect.NewError(connect.CodePermissionDenied, errors.New("not allowed in impersonated session"))
+	}
+
+	res, err := next(ctx, req)
+	var rc int32
+	if err != nil {
+		rc = int32(connect.CodeOf(err))
+	}
+	impersonation.Audit(i.log, actor, account, procedure, rc)
+	if res != nil {
+		for k, v := range actor.Headers() {
+			res.Header().Set(k, v)
+		}
+	}
+	return res, err
+}
+
 func (i *Interceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
 	i.log.Debug("WrapStreamingClient")
 	return next
@@ -144,6 +172,19 @@ func (i *Interceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) co
 			return err
 		}
 
+		if actor := impersonation.FromContext(ctx); actor != nil {
+			account := ctx.Value(nocloud.NoCloudAccount).(string)
+			procedure := shc.Spec().Procedure
+			if !actor.Allows(procedure) {
+				impersonation.Audit(l, actor, account, procedure, int32(connect.CodePermissionDenied))
+				return connect.NewError(connect.CodePermissionDenied, errors.New("not allowed in impersonated session"))
+			}
+			impersonation.Audit(l, actor, account, procedure, 0)
+			for k, v := range actor.Headers() {
+				shc.ResponseHeader().Set(k, v)
+			}
+		}
+
 		return next(ctx, shc)
 	}
 }
@@ -185,6 +226,15 @@ func (i *Interceptor) JwtAuthMiddleware(ctx context.Context, tokenString string)
 		ctx = context.WithValue(ctx, nocloud.NoCloudSession, sid)
 	}
 
+	actor, err := impersonation.Verify(i.rdb, token, uuid)
+	if err != nil {
+		i.log.Debug("Impersonation check failed", zap.Any("error", err))
+		return ctx, status.Error(codes.Unauthenticated, "Impersonation is expired, ended or invalid")
+	}
+	if actor != nil {
+		ctx = context.WithValue(ctx, nocloud.NoCloudActor, actor)
+	}
+
 	var exp int64
 	if token["expires"] != nil {
 		exp = int64(token["expires"].(float64))
@@ -0,0 +1,139 @@
+package drift
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Kind of difference between what is stored and what provider reports
+type Kind string
+
+const (
+	// Provider reports instance as deleted while it's expected to exist
+	Missing Kind = "missing"
+	// Instance is deleted here, but provider still has it
+	AliveWhileDeleted Kind = "alive_while_deleted"
+	// Instance is suspended here, but provider runs it
+	RunningWhileSuspended Kind = "running_while_suspended"
+	// Instance is active here, but provider keeps it suspended
+	SuspendedWhileActive Kind = "suspended_while_active"
+	// Provider reports failure
+	Failed Kind = "failed"
+	// Provider can't tell state of instance
+	Unknown Kind = "unknown"
+	// Resource provider reports differs from stored one
+	ResourceMismatch Kind = "resource_mismatch"
+)
+
+type Severity string
+
+const (
+	Info     Severity = "info"
+	Warning  Severity = "warning"
+	Critical Severity = "critical"
+)
+
+var severityOrder = map[Severity]int{Info: 0, Warning: 1, Critical: 2}
+
+// AtLeast reports whether s is as severe as o or more
+func (s Severity) AtLeast(o Severity) bool {
+	return severityOrder[s] >= severityOrder[o]
+}
+
+// Statuses and states are names of NoCloudStatus and NoCloudState values, e.g. "SUS" and "RUNNING"
+const (
+	StatusDeleted  = "DEL"
+	StatusDetached = "DETACHED"
+	StatusSuspend  = "SUS"
+	StatusInit     = "INIT"
+
+	StateDeleted   = "DELETED"
+	StateRunning   = "RUNNING"
+	StateStopped   = "STOPPED"
+	StateSuspended = "SUSPENDED"
+	StateFailure   = "FAILURE"
+	StateUnknown   = "UNKNOWN"
+)
+
+// States of instance still being provisioned or changed, nothing is compared while in them
+var transitional = map[string]bool{"INIT": true, "PENDING": true, "OPERATION": true, "": true}
+
+// Observed is stored instance next to data reported by driver
+type Observed struct {
+	// Status stored in database
+	Status string
+	// State reported by driver
+	State string
+	// Stored resources
+	Resources map[string]float64
+	// Resources reported by driver, only keys present here are compared
+	Reported map[string]float64
+}
+
+type Difference struct {
+	Kind     Kind     `json:"kind"`
+	Severity Severity `json:"severity"`
+	// Resource name for resource mismatches
+	Field    string `json:"field,omitempty"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// Classify compares stored instance with driver data. Resource values differing by no more than tolerance share are equal
+func Classify(o Observed, tolerance float64) []Difference {
+	if o.Status == StatusDetached || o.Status == StatusInit || transitional[o.State] {
+		return nil
+	}
+	diff := func(kind Kind, sev Severity) []Difference {
+		return []Difference{{Kind: kind, Severity: sev, Expected: o.Status, Actual: o.State}}
+	}
+
+	if o.Status == StatusDeleted {
+		if o.State == StateDeleted || o.State == StateUnknown {
+			return nil
+		}
+		return diff(AliveWhileDeleted, Critical)
+	}
+	switch o.State {
+	case StateDeleted:
+		return diff(Missing, Critical)
+	case StateFailure:
+		return diff(Failed, Warning)
+	case StateUnknown:
+		return diff(Unknown, Info)
+	case StateRunning:
+		if o.Status == StatusSuspend {
+			return diff(RunningWhileSuspended, Warning)
+		}
+	case StateSuspended:
+		if o.Status != StatusSuspend {
+			return diff(SuspendedWhileActive, Warning)
+		}
+	}
+
+	var res []Difference
+	keys := make([]string, 0, len(o.Reported))
+	for k := range o.Reported {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		expected, ok := o.Resources[k]
+		if !ok {
+			continue
+		}
+		actual := o.Reported[k]
+		if math.Abs(expected-actual) <= tolerance*math.Max(math.Abs(expected), math.Abs(actual)) {
+			continue
+		}
+		res = append(res, Difference{
+			Kind:     ResourceMismatch,
+			Severity: Warning,
+			Field:    k,
+			Expected: fmt.Sprint(expected),
+			Actual:   fmt.Sprint(actual),
+		})
+	}
+	return res
+}
@@ -0,0 +1,54 @@
+package drift
+
+import "testing"
+
+func TestClassifyState(t *testing.T) {
+	cases := []struct {
+		status, state string
+		want          Kind
+	}{
+		{"UP", "RUNNING", ""},
+		{"UP", "STOPPED", ""},
+		{"UP", "DELETED", Missing},
+		{"SUS", "RUNNING", RunningWhileSuspended},
+		{"SUS", "SUSPENDED", ""},
+		{"UP", "SUSPENDED", SuspendedWhileActive},
+		{"DEL", "RUNNING", AliveWhileDeleted},
+		{"DEL", "DELETED", ""},
+		{"UP", "FAILURE", Failed},
+		{"UP", "PENDING", ""},
+		{"DETACHED", "DELETED", ""},
+	}
+	for _, c := range cases {
+		res := Classify(Observed{Status: c.status, State: c.state}, 0)
+		var got Kind
+		if len(res) > 0 {
+			got = res[0].Kind
+		}
+		if got != c.want {
+			t.Errorf("%s/%s: got %q, want %q", c.status, c.state, got, c.want)
+		}
+	}
+}
+
+func TestClassifyResources(t *testing.T) {
+	o := Observed{
+		Status:    "UP",
+		State:     "RUNNING",
+		Resources: map[string]float64{"cpu": 2, "ram": 2048, "drive_size": 20480},
+		Reported:  map[string]float64{"cpu": 4, "ram": 2040, "ips_public": 1},
+	}
+	res := Classify(o, 0.01)
+	if len(res) != 1 || res[0].Field != "cpu" || res[0].Expected != "2" || res[0].Actual != "4" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	if res := Classify(o, 0); len(res) != 2 {
+		t.Fatalf("expected ram mismatch without tolerance, got %+v", res)
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	if !Critical.AtLeast(Warning) || Info.AtLeast(Warning) || !Warning.AtLeast(Warning) {
+		t.Fatal("unexpected severity order")
+	}
+}
@@ -0,0 +1,441 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	driverpb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrNotRegistered = errors.New("driver is not registered")
+	ErrUnhealthy     = errors.New("driver is unhealthy")
+)
+
+// UnavailableError tells which driver can't be used and why, wraps ErrNotRegistered or ErrUnhealthy
+type UnavailableError struct {
+	Type   string
+	Reason string
+	Err    error
+}
+
+func (e *UnavailableError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%s: %s", e.Err, e.Type)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Err, e.Type, e.Reason)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Registered endpoints are kept in redis hash endpoint -> source. It's the source of truth for every replica
+// and service, so drivers removed or re-pointed through API stay so
+const endpointsKey = "drivers:endpoints"
+
+// Environment endpoints ever seeded into endpointsKey, so ones removed through API aren't seeded again on restart
+const seededKey = "drivers:seeded"
+
+const (
+	SourceEnv  = "env"
+	SourceAPI  = "api"
+	SourceSelf = "self"
+)
+
+// Info is driver state shown in inventory
+type Info struct {
+	Type      string `json:"type"`
+	Endpoint  string `json:"endpoint"`
+	Source    string `json:"source"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+	// Unix timestamps
+	RegisteredAt int64 `json:"registered_at"`
+	LastProbe    int64 `json:"last_probe"`
+	LastSeen     int64 `json:"last_seen"`
+}
+
+type entry struct {
+	Info
+	conn   *grpc.ClientConn
+	client driverpb.DriverServiceClient
+}
+
+type Config struct {
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// Consecutive failed probes after which driver is marked unhealthy
+	FailureThreshold int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ProbeInterval:    30 * time.Second,
+		ProbeTimeout:     5 * time.Second,
+		FailureThreshold: 2,
+	}
+}
+
+// Registry keeps driver connections by type. Safe for concurrent use
+type Registry struct {
+	log  *zap.Logger
+	rdb  redisdb.Client
+	conf Config
+
+	mu      sync.RWMutex
+	entries map[string]*entry
+	// endpoint -> type of registered drivers
+	endpoints map[string]string
+
+	// Stored endpoints and seeded set, used instead of redis if rdb is nil
+	local  map[string]string
+	seeded map[string]bool
+}
+
+// NewRegistry creates registry, rdb may be nil to keep runtime endpoints in memory only
+func NewRegistry(log *zap.Logger, rdb redisdb.Client, conf Config) *Registry {
+	return &Registry{
+		log:       log.Named("Drivers"),
+		rdb:       rdb,
+		conf:      conf,
+		entries:   map[string]*entry{},
+		endpoints: map[string]string{},
+		local:     map[string]string{},
+		seeded:    map[string]bool{},
+	}
+}
+
+func dial(endpoint string) (*grpc.ClientConn, error) {
+	return grpc.Dial(endpoint,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(500*1024*1024),
+			grpc.MaxCallSendMsgSize(500*1024*1024),
+		),
+	)
+}
+
+// Add dials endpoint, asks driver its type and registers it, replacing previous driver of the same type.
+// Registration is stored, so it's picked up by other replicas and kept over restarts
+func (r *Registry) Add(ctx context.Context, endpoint, source string) (*Info, error) {
+	info, replaced, err := r.register(ctx, endpoint, source, true)
+	if err != nil {
+		return nil, err
+	}
+	r.store(ctx, endpoint, source)
+	if replaced != "" {
+		r.forget(ctx, replaced)
+	}
+	return info, nil
+}
+
+// register connects driver and puts it into inventory. Driver of the same type registered at other endpoint
+// is replaced only if replace is set, its endpoint is returned then
+func (r *Registry) register(ctx context.Context, endpoint, source string, replace bool) (*Info, string, error) {
+	conn, err := dial(endpoint)
+	if err != nil {
+		return nil, "", fmt.Errorf("dial %s: %w", endpoint, err)
+	}
+	client := driverpb.NewDriverServiceClient(conn)
+
+	pctx, cancel := context.WithTimeout(ctx, r.conf.ProbeTimeout)
+	defer cancel()
+	res, err := client.GetType(pctx, &driverpb.GetTypeRequest{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", fmt.Errorf("get type of %s: %w", endpoint, err)
+	}
+
+	now := time.Now().Unix()
+	e := &entry{
+		Info: Info{
+			Type:         res.GetType(),
+			Endpoint:     endpoint,
+			Source:       source,
+			Healthy:      true,
+			RegisteredAt: now,
+			LastProbe:    now,
+			LastSeen:     now,
+		},
+		conn:   conn,
+		client: client,
+	}
+
+	r.mu.Lock()
+	old := r.entries[e.Type]
+	if old != nil && old.Endpoint != endpoint && !replace {
+		r.mu.Unlock()
+		_ = conn.Close()
+		return nil, "", fmt.Errorf("driver of type %s is already registered at %s", e.Type, old.Endpoint)
+	}
+	r.entries[e.Type] = e
+	r.endpoints[endpoint] = e.Type
+	var replaced string
+	if old != nil && old.Endpoint != endpoint {
+		delete(r.endpoints, old.Endpoint)
+		replaced = old.Endpoint
+	}
+	r.mu.Unlock()
+
+	if old != nil {
+		_ = old.conn.Close()
+	}
+	r.log.Info("Registered Driver", zap.String("endpoint", endpoint), zap.String("type", e.Type), zap.String("source", source))
+	info := e.Info
+	return &info, replaced, nil
+}
+
+// unregister drops driver of type from inventory, unless it was re-registered at other endpoint meanwhile
+func (r *Registry) unregister(typ, endpoint string) bool {
+	r.mu.Lock()
+	e, ok := r.entries[typ]
+	ok = ok && (endpoint == "" || e.Endpoint == endpoint)
+	if ok {
+		delete(r.entries, typ)
+		delete(r.endpoints, e.Endpoint)
+	}
+	r.mu.Unlock()
+	if ok {
+		_ = e.conn.Close()
+	}
+	return ok
+}
+
+// Remove unregisters driver of type, closes its connection and drops it from stored endpoints
+func (r *Registry) Remove(ctx context.Context, typ string) error {
+	r.mu.RLock()
+	e, ok := r.entries[typ]
+	var endpoint string
+	if ok {
+		endpoint = e.Endpoint
+	}
+	r.mu.RUnlock()
+	if !ok || !r.unregister(typ, endpoint) {
+		return ErrNotRegistered
+	}
+	r.forget(ctx, endpoint)
+	r.log.Info("Removed Driver", zap.String("type", typ), zap.String("endpoint", endpoint))
+	return nil
+}
+
+func (r *Registry) stored(ctx context.Context) (map[string]string, error) {
+	if r.rdb != nil {
+		return r.rdb.HGetAll(ctx, endpointsKey).Result()
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make(map[string]string, len(r.local))
+	for endpoint, source := range r.local {
+		res[endpoint] = source
+	}
+	return res, nil
+}
+
+func (r *Registry) store(ctx context.Context, endpoint, source string) {
+	if r.rdb == nil {
+		r.mu.Lock()
+		r.local[endpoint] = source
+		r.mu.Unlock()
+		return
+	}
+	if err := r.rdb.HSet(ctx, endpointsKey, endpoint, source).Err(); err != nil {
+		r.log.Warn("Failed to store driver endpoint", zap.String("endpoint", endpoint), zap.Error(err))
+	}
+}
+
+const forgetEndpoint = `return redis.call('HDEL', KEYS[1], ARGV[1])`
+
+func (r *Registry) forget(ctx context.Context, endpoint string) {
+	if r.rdb == nil {
+		r.mu.Lock()
+		delete(r.local, endpoint)
+		r.mu.Unlock()
+		return
+	}
+	if err := r.rdb.Eval(ctx, forgetEndpoint, []string{endpointsKey}, endpoint).Err(); err != nil {
+		r.log.Warn("Failed to forget driver endpoint", zap.String("endpoint", endpoint), zap.Error(err))
+	}
+}
+
+const seedEndpoint = `
+if redis.call('SADD', KEYS[2], ARGV[1]) == 1 then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0`
+
+// seed stores environment endpoint, unless it was seeded before
+func (r *Registry) seed(ctx context.Context, endpoint string) {
+	if r.rdb == nil {
+		r.mu.Lock()
+		if !r.seeded[endpoint] {
+			r.seeded[endpoint] = true
+			r.local[endpoint] = SourceEnv
+		}
+		r.mu.Unlock()
+		return
+	}
+	if err := r.rdb.Eval(ctx, seedEndpoint, []string{endpointsKey, seededKey}, endpoint, SourceEnv).Err(); err != nil {
+		r.log.Warn("Failed to seed driver endpoint", zap.String("endpoint", endpoint), zap.Error(err))
+	}
+}
+
+// Client returns client of healthy driver, errors wrap ErrNotRegistered or ErrUnhealthy
+func (r *Registry) Client(typ string) (driverpb.DriverServiceClient, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entries[typ]
+	if !ok {
+		return nil, &UnavailableError{Type: typ, Err: ErrNotRegistered}
+	}
+	if !e.Healthy {
+		return nil, &UnavailableError{Type: typ, Reason: e.LastError, Err: ErrUnhealthy}
+	}
+	return e.client, nil
+}
+
+// Status converts Client error into gRPC status
+func Status(err error) error {
+	var ue *UnavailableError
+	if !errors.As(err, &ue) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if errors.Is(err, ErrNotRegistered) {
+		return status.Errorf(codes.InvalidArgument, "Driver of type '%s' not registered", ue.Type)
+	}
+	return status.Errorf(codes.Unavailable, "Driver of type '%s' is unhealthy: %s", ue.Type, ue.Reason)
+}
+
+// List returns inventory sorted by type
+func (r *Registry) List() []Info {
+	r.mu.RLock()
+	res := make([]Info, 0, len(r.entries))
+	for _, e := range r.entries {
+		res = append(res, e.Info)
+	}
+	r.mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Type < res[j].Type })
+	return res
+}
+
+// Probe asks every driver its type. Failed drivers get connection reset so next probe reconnects
+func (r *Registry) Probe(ctx context.Context) {
+	r.mu.RLock()
+	entries := make([]*entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, r.conf.ProbeTimeout)
+			res, err := e.client.GetType(pctx, &driverpb.GetTypeRequest{})
+			cancel()
+			if err == nil && res.GetType() != e.Type {
+				err = fmt.Errorf("endpoint now serves driver of type %s", res.GetType())
+			}
+			r.report(e, err)
+			if err != nil {
+				e.conn.ResetConnectBackoff()
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (r *Registry) report(e *entry, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().Unix()
+	e.LastProbe = now
+	if err == nil {
+		if !e.Healthy {
+			r.log.Info("Driver recovered", zap.String("type", e.Type), zap.String("endpoint", e.Endpoint))
+		}
+		e.Healthy, e.Failures, e.LastError, e.LastSeen = true, 0, "", now
+		return
+	}
+	e.Failures++
+	e.LastError = err.Error()
+	if e.Healthy && e.Failures >= r.conf.FailureThreshold {
+		e.Healthy = false
+		r.log.Warn("Driver marked unhealthy", zap.String("type", e.Type), zap.String("endpoint", e.Endpoint), zap.Error(err))
+	}
+}
+
+// AddStatic seeds endpoints from environment into stored ones and registers them. Seeding is done once,
+// stored endpoints win afterwards. Ones unreachable now are retried by Routine
+func (r *Registry) AddStatic(ctx context.Context, endpoints []string) {
+	for _, endpoint := range endpoints {
+		r.seed(ctx, endpoint)
+	}
+	r.Sync(ctx)
+}
+
+// Sync makes inventory match stored endpoints: drops drivers removed or re-pointed elsewhere
+// and registers stored ones missing here
+func (r *Registry) Sync(ctx context.Context) {
+	stored, err := r.stored(ctx)
+	if err != nil {
+		r.log.Warn("Failed to load driver endpoints", zap.Error(err))
+		return
+	}
+
+	r.mu.RLock()
+	var missing []string
+	removed := map[string]string{}
+	for endpoint := range stored {
+		if _, ok := r.endpoints[endpoint]; !ok {
+			missing = append(missing, endpoint)
+		}
+	}
+	for typ, e := range r.entries {
+		if _, ok := stored[e.Endpoint]; !ok {
+			removed[typ] = e.Endpoint
+		}
+	}
+	r.mu.RUnlock()
+
+	for typ, endpoint := range removed {
+		if r.unregister(typ, endpoint) {
+			r.log.Info("Driver is no longer stored, removed", zap.String("type", typ), zap.String("endpoint", endpoint))
+		}
+	}
+	sort.Strings(missing)
+	for _, endpoint := range missing {
+		if _, _, err := r.register(ctx, endpoint, stored[endpoint], false); err != nil {
+			r.log.Warn("Failed to register stored driver", zap.String("endpoint", endpoint), zap.Error(err))
+		}
+	}
+}
+
+// Routine probes drivers and syncs runtime endpoints until ctx is done
+func (r *Registry) Routine(ctx context.Context) {
+	ticker := time.NewTicker(r.conf.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		r.Sync(ctx)
+		r.Probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
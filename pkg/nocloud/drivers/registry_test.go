@@ -0,0 +1,126 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	driverpb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
+	redisdb_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+type fakeDriver struct {
+	driverpb.UnimplementedDriverServiceServer
+	typ string
+}
+
+func (d *fakeDriver) GetType(context.Context, *driverpb.GetTypeRequest) (*driverpb.GetTypeResponse, error) {
+	return &driverpb.GetTypeResponse{Type: d.typ}, nil
+}
+
+// Serves driver of given type, returns its endpoint
+func serveDriver(t *testing.T, typ string) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	driverpb.RegisterDriverServiceServer(s, &fakeDriver{typ: typ})
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+func endpointOf(r *Registry, typ string) string {
+	for _, info := range r.List() {
+		if info.Type == typ {
+			return info.Endpoint
+		}
+	}
+	return ""
+}
+
+func TestRemovedStaticDriverStaysRemoved(t *testing.T) {
+	ctx := context.Background()
+	endpoint := serveDriver(t, "ione")
+	r := NewRegistry(zap.NewNop(), nil, DefaultConfig())
+
+	r.AddStatic(ctx, []string{endpoint})
+	assert.Equal(t, endpoint, endpointOf(r, "ione"))
+
+	require.NoError(t, r.Remove(ctx, "ione"))
+	r.Sync(ctx)
+	r.AddStatic(ctx, []string{endpoint})
+
+	_, err := r.Client("ione")
+	assert.True(t, errors.Is(err, ErrNotRegistered))
+}
+
+func TestRepointedDriverIsKept(t *testing.T) {
+	ctx := context.Background()
+	env := serveDriver(t, "ione")
+	api := serveDriver(t, "ione")
+	r := NewRegistry(zap.NewNop(), nil, DefaultConfig())
+
+	r.AddStatic(ctx, []string{env})
+	_, err := r.Add(ctx, api, SourceAPI)
+	require.NoError(t, err)
+
+	r.Sync(ctx)
+	assert.Equal(t, api, endpointOf(r, "ione"))
+	stored, err := r.stored(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{api: SourceAPI}, stored)
+}
+
+func TestUnreachableStaticDriverIsRetried(t *testing.T) {
+	ctx := context.Background()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	endpoint := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	conf := DefaultConfig()
+	conf.ProbeTimeout = 200 * time.Millisecond
+	r := NewRegistry(zap.NewNop(), nil, conf)
+	r.AddStatic(ctx, []string{endpoint})
+	assert.Empty(t, r.List())
+
+	lis, err = net.Listen("tcp", endpoint)
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	driverpb.RegisterDriverServiceServer(s, &fakeDriver{typ: "ione"})
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	r.Sync(ctx)
+	assert.Equal(t, endpoint, endpointOf(r, "ione"))
+}
+
+func TestSyncFollowsStoredEndpoints(t *testing.T) {
+	ctx := context.Background()
+	endpoint := serveDriver(t, "ione")
+	rdb := redisdb_mocks.NewMockClient(t)
+	rdb.EXPECT().Eval(mock.Anything, seedEndpoint, []string{endpointsKey, seededKey}, endpoint, SourceEnv).
+		Return(redis.NewCmdResult(int64(0), nil)).Once()
+	rdb.EXPECT().HGetAll(mock.Anything, endpointsKey).
+		Return(redis.NewStringStringMapResult(map[string]string{endpoint: SourceAPI}, nil)).Once()
+	r := NewRegistry(zap.NewNop(), rdb, DefaultConfig())
+
+	// Already seeded, stored registration wins
+	r.AddStatic(ctx, []string{endpoint})
+	require.Len(t, r.List(), 1)
+	assert.Equal(t, SourceAPI, r.List()[0].Source)
+
+	// Removed on another replica, nothing is forgotten here
+	rdb.EXPECT().HGetAll(mock.Anything, endpointsKey).
+		Return(redis.NewStringStringMapResult(map[string]string{}, nil)).Once()
+	r.Sync(ctx)
+	assert.Empty(t, r.List())
+}
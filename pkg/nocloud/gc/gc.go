@@ -0,0 +1,134 @@
+package gc
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Kind of orphan found
+type Kind string
+
+const (
+	// Instance whose instances group is gone or deleted
+	NoGroup Kind = "no_group"
+	// Instance whose service is gone or deleted
+	NoService Kind = "no_service"
+	// Instance without owner account, or owned by purged one
+	NoAccount Kind = "no_account"
+	// Instance bound to another instance which is deleted, e.g. VPN of deleted VM
+	LinkedDeleted Kind = "linked_deleted"
+	// Instance bound to another instance which doesn't exist, binding may be broken rather than instance orphaned
+	LinkedMissing Kind = "linked_missing"
+	// Deleted instance still having open invoices
+	DeletedBillable Kind = "deleted_billable"
+	// Active instances group without active instances
+	EmptyGroup Kind = "empty_group"
+	// Resource driver reports on provider without NoCloud instance
+	ProviderOrphan Kind = "provider_orphan"
+)
+
+var Kinds = []Kind{NoGroup, NoService, NoAccount, LinkedDeleted, LinkedMissing, DeletedBillable, EmptyGroup, ProviderOrphan}
+
+// Action taken on orphan
+type Action string
+
+const (
+	Report  Action = "report"
+	Suspend Action = "suspend"
+	Delete  Action = "delete"
+	// Terminates open invoices of deleted instance
+	TerminateInvoices Action = "terminate_invoices"
+)
+
+// Actions possible per kind. Instances without group can't be suspended as there is no provider to invoke,
+// instances bound to missing ones and provider resources can only be reported
+var supported = map[Kind][]Action{
+	NoGroup:         {Report, Delete},
+	NoService:       {Report, Suspend, Delete},
+	NoAccount:       {Report, Suspend, Delete},
+	LinkedDeleted:   {Report, Suspend, Delete},
+	LinkedMissing:   {Report},
+	DeletedBillable: {Report, TerminateInvoices},
+	EmptyGroup:      {Report, Delete},
+	ProviderOrphan:  {Report},
+}
+
+func Supported(k Kind, a Action) bool {
+	return slices.Contains(supported[k], a)
+}
+
+// Policies map kind of orphan to action taken on it, unset kinds are reported
+type Policies map[Kind]Action
+
+// DefaultPolicies only report, actions are enabled by admin per kind
+func DefaultPolicies() Policies {
+	p := make(Policies, len(Kinds))
+	for _, k := range Kinds {
+		p[k] = Report
+	}
+	return p
+}
+
+func (p Policies) Validate() error {
+	for k, a := range p {
+		if _, ok := supported[k]; !ok {
+			return fmt.Errorf("unknown kind %s", k)
+		}
+		if !Supported(k, a) {
+			return fmt.Errorf("action %s is not supported for %s", a, k)
+		}
+	}
+	return nil
+}
+
+// ActionFor returns action policy sets for kind, report if unset or unsupported
+func (p Policies) ActionFor(k Kind) Action {
+	if a, ok := p[k]; ok && Supported(k, a) {
+		return a
+	}
+	return Report
+}
+
+type Finding struct {
+	Kind   Kind   `json:"kind"`
+	Entity string `json:"entity"`
+	Uuid   string `json:"uuid"`
+	Title  string `json:"title,omitempty"`
+	Sp     string `json:"sp,omitempty"`
+	Reason string `json:"reason"`
+	// Related documents, e.g. open invoices of deleted instance
+	Refs []string `json:"refs,omitempty"`
+
+	Action  Action `json:"action"`
+	Applied bool   `json:"applied"`
+	// Why action wasn't applied
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Plan assigns actions to findings by policies. Not more than limit findings get destructive actions, 0 is unlimited
+func Plan(findings []Finding, p Policies, limit int) []Finding {
+	var n int
+	for i := range findings {
+		f := &findings[i]
+		f.Action = p.ActionFor(f.Kind)
+		if f.Action == Report {
+			continue
+		}
+		if limit > 0 && n >= limit {
+			f.Skipped = "actions limit per run reached"
+			continue
+		}
+		n++
+	}
+	return findings
+}
+
+// Summary counts findings by kind
+func Summary(findings []Finding) map[Kind]int {
+	res := make(map[Kind]int)
+	for _, f := range findings {
+		res[f.Kind]++
+	}
+	return res
+}
@@ -0,0 +1,57 @@
+package gc
+
+import "testing"
+
+func TestPolicies(t *testing.T) {
+	if err := DefaultPolicies().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Policies{LinkedMissing: Delete}).Validate(); err == nil {
+		t.Fatal("expected instances bound to missing ones to be report only")
+	}
+	if err := (Policies{ProviderOrphan: Delete}).Validate(); err == nil {
+		t.Fatal("expected provider orphans to be report only")
+	}
+	if err := (Policies{DeletedBillable: TerminateInvoices}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range Kinds {
+		if a := DefaultPolicies().ActionFor(k); a != Report {
+			t.Fatalf("%s should be reported by default, got %s", k, a)
+		}
+	}
+	if err := (Policies{"foo": Report}).Validate(); err == nil {
+		t.Fatal("expected unknown kind error")
+	}
+	p := Policies{NoGroup: Suspend, NoService: Delete}
+	if a := p.ActionFor(NoGroup); a != Report {
+		t.Fatalf("unsupported action should fall back to report, got %s", a)
+	}
+	if a := p.ActionFor(NoService); a != Delete {
+		t.Fatalf("got %s", a)
+	}
+	if a := p.ActionFor(EmptyGroup); a != Report {
+		t.Fatalf("unset kind should be reported, got %s", a)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	findings := []Finding{
+		{Kind: LinkedDeleted, Uuid: "a"},
+		{Kind: EmptyGroup, Uuid: "b"},
+		{Kind: LinkedDeleted, Uuid: "c"},
+	}
+	res := Plan(findings, Policies{LinkedDeleted: Delete}, 1)
+	if res[0].Action != Delete || res[0].Skipped != "" {
+		t.Fatalf("unexpected %+v", res[0])
+	}
+	if res[1].Action != Report {
+		t.Fatalf("unexpected %+v", res[1])
+	}
+	if res[2].Action != Delete || res[2].Skipped == "" {
+		t.Fatalf("expected limit to skip %+v", res[2])
+	}
+	if s := Summary(res); s[LinkedDeleted] != 2 || s[EmptyGroup] != 1 {
+		t.Fatalf("unexpected summary %v", s)
+	}
+}
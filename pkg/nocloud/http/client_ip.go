@@ -0,0 +1,153 @@
+package http_server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Private and loopback networks, NoCloud services are deployed behind proxies living there
+var DefaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+var (
+	trustedMu      sync.RWMutex
+	trustedProxies = mustParseCIDRs(DefaultTrustedProxies)
+)
+
+// SetTrustedProxies replaces networks whose X-Forwarded-For entries are trusted
+func SetTrustedProxies(cidrs []string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	trustedMu.Lock()
+	trustedProxies = nets
+	trustedMu.Unlock()
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	trustedMu.RLock()
+	defer trustedMu.RUnlock()
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// resolveClientIP walks forwarded chain from the closest hop, the first untrusted address is the client.
+// Entries left of it could be sent by the client itself, so they are never used
+func resolveClientIP(peerAddr string, forwarded []string, realIP string) string {
+	peerAddr = hostOf(peerAddr)
+	if !isTrustedProxy(peerAddr) {
+		return peerAddr
+	}
+
+	var chain []string
+	for _, header := range forwarded {
+		for _, ip := range strings.Split(header, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, hostOf(ip))
+			}
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !isTrustedProxy(chain[i]) {
+			return chain[i]
+		}
+	}
+	if len(chain) > 0 {
+		return chain[0]
+	}
+	if realIP = strings.TrimSpace(realIP); realIP != "" {
+		return realIP
+	}
+	return peerAddr
+}
+
+// ClientIPHeader carries client address resolved by apiserver_web, as gRPC metadata it's x-client-ip
+const ClientIPHeader = "X-Client-Ip"
+
+// ClientIP resolves address of the client that has sent the HTTP request, to be used on the edge
+func ClientIP(r *http.Request) string {
+	return resolveClientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"), r.Header.Get("X-Real-IP"))
+}
+
+// HeaderClientIP resolves client address of request received from another NoCloud service, i.e. by connect handlers.
+// ClientIPHeader is only taken from trusted proxies, as anyone else could set it
+func HeaderClientIP(header http.Header, peerAddr string) string {
+	if ip := strings.TrimSpace(header.Get(ClientIPHeader)); ip != "" && isTrustedProxy(hostOf(peerAddr)) {
+		return ip
+	}
+	return resolveClientIP(peerAddr, header.Values("X-Forwarded-For"), header.Get("X-Real-IP"))
+}
+
+// GRPCClientIP resolves address of the client that has sent the gRPC request, directly or through grpc-gateway
+func GRPCClientIP(ctx context.Context) string {
+	var peerAddr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		peerAddr = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var realIP string
+	if v := md.Get("x-real-ip"); len(v) > 0 {
+		realIP = v[0]
+	}
+	if peerAddr == "" {
+		// In-process calls have no peer, so there is nobody to trust the headers of
+		return ""
+	}
+	if v := md.Get(strings.ToLower(ClientIPHeader)); len(v) > 0 && strings.TrimSpace(v[0]) != "" && isTrustedProxy(hostOf(peerAddr)) {
+		return strings.TrimSpace(v[0])
+	}
+	return resolveClientIP(peerAddr, md.Get("x-forwarded-for"), realIP)
+}
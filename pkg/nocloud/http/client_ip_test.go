@@ -0,0 +1,111 @@
+package http_server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{"direct client", "203.0.113.7:5555", nil, "", "203.0.113.7"},
+		{"direct client spoofing header", "203.0.113.7:5555", []string{"1.1.1.1"}, "1.1.1.1", "203.0.113.7"},
+		{"behind proxy", "10.0.0.2:80", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"spoofed leftmost entry", "10.0.0.2:80", []string{"1.1.1.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"chain of proxies", "10.0.0.2:80", []string{"1.1.1.1, 203.0.113.7, 172.17.0.3"}, "", "203.0.113.7"},
+		{"multiple headers", "10.0.0.2:80", []string{"1.1.1.1", "203.0.113.7"}, "", "203.0.113.7"},
+		{"only proxies", "10.0.0.2:80", []string{"192.168.1.10, 10.0.0.5"}, "", "192.168.1.10"},
+		{"real ip from proxy", "10.0.0.2:80", nil, "203.0.113.7", "203.0.113.7"},
+		{"no headers behind proxy", "10.0.0.2:80", nil, "", "10.0.0.2"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tc.realIP != "" {
+				r.Header.Set("X-Real-IP", tc.realIP)
+			}
+			if got := ClientIP(r); got != tc.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGRPCClientIP(t *testing.T) {
+	withPeer := func(ctx context.Context, addr string) context.Context {
+		tcp, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return peer.NewContext(ctx, &peer.Peer{Addr: tcp})
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-forwarded-for", "1.1.1.1, 203.0.113.7"))
+	if got := GRPCClientIP(withPeer(ctx, "172.18.0.4:8000")); got != "203.0.113.7" {
+		t.Errorf("through gateway = %q, want 203.0.113.7", got)
+	}
+	if got := GRPCClientIP(withPeer(ctx, "198.51.100.1:8000")); got != "198.51.100.1" {
+		t.Errorf("untrusted peer = %q, want 198.51.100.1", got)
+	}
+	if got := GRPCClientIP(ctx); got != "" {
+		t.Errorf("no peer = %q, want empty", got)
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	defer func() { _ = SetTrustedProxies(DefaultTrustedProxies) }()
+
+	if err := SetTrustedProxies([]string{"not a cidr"}); err == nil {
+		t.Fatal("expected error for malformed CIDR")
+	}
+	if err := SetTrustedProxies([]string{"198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:80"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if got := ClientIP(r); got != "10.0.0.2" {
+		t.Errorf("ClientIP() from untrusted proxy = %q, want 10.0.0.2", got)
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	header := http.Header{}
+	header.Set(ClientIPHeader, "203.0.113.7")
+	header.Set("X-Forwarded-For", "198.51.100.9")
+
+	if got := HeaderClientIP(header, "10.0.0.2:8000"); got != "203.0.113.7" {
+		t.Errorf("from trusted proxy = %q, want 203.0.113.7", got)
+	}
+	// Only apiserver_web and other trusted hops may set client address
+	if got := HeaderClientIP(header, "198.51.100.1:8000"); got != "198.51.100.1" {
+		t.Errorf("from untrusted peer = %q, want 198.51.100.1", got)
+	}
+
+	md := metadata.Pairs("x-client-ip", "203.0.113.7")
+	ctx := peer.NewContext(metadata.NewIncomingContext(context.Background(), md), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("172.18.0.4"), Port: 8000}})
+	if got := GRPCClientIP(ctx); got != "203.0.113.7" {
+		t.Errorf("gRPC from trusted proxy = %q, want 203.0.113.7", got)
+	}
+	ctx = peer.NewContext(metadata.NewIncomingContext(context.Background(), md), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 8000}})
+	if got := GRPCClientIP(ctx); got != "198.51.100.1" {
+		t.Errorf("gRPC from untrusted peer = %q, want 198.51.100.1", got)
+	}
+}
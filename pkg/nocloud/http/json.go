@@ -0,0 +1,42 @@
+package http_server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func WriteJSON(writer http.ResponseWriter, code int, body any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	_ = json.NewEncoder(writer).Encode(body)
+}
+
+var statusCodes = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.FailedPrecondition: http.StatusConflict,
+	codes.Aborted:            http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// WriteResult writes {"result": true} or maps gRPC status of err to HTTP error
+func WriteResult(writer http.ResponseWriter, err error) {
+	if err == nil {
+		WriteJSON(writer, http.StatusOK, map[string]any{"result": true})
+		return
+	}
+	st, _ := status.FromError(err)
+	code, ok := statusCodes[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	http.Error(writer, st.Message(), code)
+}
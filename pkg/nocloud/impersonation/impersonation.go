@@ -0,0 +1,225 @@
+package impersonation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"go.uber.org/zap"
+)
+
+type Mode string
+
+const (
+	ReadOnly  Mode = "read"
+	ReadWrite Mode = "write"
+)
+
+// Headers set on every response to impersonated calls, so UI can show the banner
+const (
+	HeaderActor = "nocloud-impersonated-by"
+	HeaderMode  = "nocloud-impersonation-mode"
+)
+
+// Actor is the content of act claim
+type Actor struct {
+	// Admin account UUID
+	Sub string `json:"sub"`
+	// Impersonation grant ID, grant can be ended before token expires
+	ID     string `json:"id"`
+	Mode   Mode   `json:"mode"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (a *Actor) Claims() map[string]any {
+	claims := map[string]any{
+		"sub":  a.Sub,
+		"id":   a.ID,
+		"mode": string(a.Mode),
+	}
+	if a.Reason != "" {
+		claims["reason"] = a.Reason
+	}
+	return claims
+}
+
+// FromClaims extracts actor from token claims, returns nil if token isn't impersonated
+func FromClaims(claims map[string]any) (*Actor, error) {
+	raw, ok := claims[nocloud.NOCLOUD_ACT_CLAIM]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	act, ok := raw.(map[string]any)
+	if !ok {
+		return nil, errors.New("act claim isn't an object")
+	}
+	a := &Actor{}
+	a.Sub, _ = act["sub"].(string)
+	a.ID, _ = act["id"].(string)
+	mode, _ := act["mode"].(string)
+	a.Mode = Mode(mode)
+	a.Reason, _ = act["reason"].(string)
+
+	if a.Sub == "" || a.ID == "" {
+		return nil, errors.New("act claim has no subject or grant ID")
+	}
+	if a.Mode != ReadOnly && a.Mode != ReadWrite {
+		return nil, fmt.Errorf("unknown impersonation mode: %s", mode)
+	}
+	return a, nil
+}
+
+func FromContext(ctx context.Context) *Actor {
+	a, _ := ctx.Value(nocloud.NoCloudActor).(*Actor)
+	return a
+}
+
+func (a *Actor) Headers() map[string]string {
+	return map[string]string{
+		HeaderActor: a.Sub,
+		HeaderMode:  string(a.Mode),
+	}
+}
+
+// Methods never allowed to be called on behalf of account, since they either issue tokens or change credentials
+var forbidden = []string{
+	"/nocloud.registry.AccountsService/Token",
+	"/nocloud.registry.AccountsService/SetCredentials",
+	"/nocloud.registry.AccountsService/Delete",
+}
+
+// REST paths never allowed to be called on behalf of account
+var forbiddenPaths = []string{
+	"/accounts/credentials",
+	"/accounts/password",
+	"/accounts/impersonate",
+	"/sessions/revoke",
+}
+
+var readPrefixes = []string{
+	"Get", "List", "Show", "Count", "Search", "Fetch", "Probe", "Stream", "Estimate", "Preview", "Describe", "Test",
+}
+
+// IsReadOnly reports whether gRPC method doesn't change anything, judging by its name
+func IsReadOnly(fullMethod string) bool {
+	name := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	for _, prefix := range readPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether gRPC method can be called with impersonated token
+func (a *Actor) Allows(fullMethod string) bool {
+	for _, method := range forbidden {
+		if method == fullMethod {
+			return false
+		}
+	}
+	return a.Mode == ReadWrite || IsReadOnly(fullMethod)
+}
+
+// AllowsHTTP reports whether REST request can be made with impersonated token
+func (a *Actor) AllowsHTTP(method, path string) bool {
+	for _, prefix := range forbiddenPaths {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return a.Mode == ReadWrite
+}
+
+type grant struct {
+	Actor   *Actor `json:"actor"`
+	Account string `json:"account"`
+	Created int64  `json:"created"`
+}
+
+func grantKey(id string) string {
+	return "impersonation:" + id
+}
+
+// Grant stores impersonation grant, tokens carrying its ID are valid until grant expires or is ended
+func Grant(rdb redisdb.Client, a *Actor, account string, ttl time.Duration) error {
+	data, err := json.Marshal(grant{Actor: a, Account: account, Created: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	return rdb.Set(context.Background(), grantKey(a.ID), data, ttl).Err()
+}
+
+// Check verifies that grant exists and was issued for this admin and account
+func Check(rdb redisdb.Client, a *Actor, account string) error {
+	raw, err := rdb.Get(context.Background(), grantKey(a.ID)).Result()
+	if err != nil {
+		return fmt.Errorf("impersonation grant not found: %w", err)
+	}
+	var g grant
+	if err := json.Unmarshal([]byte(raw), &g); err != nil {
+		return err
+	}
+	if g.Actor == nil || g.Actor.Sub != a.Sub || g.Actor.Mode != a.Mode || g.Account != account {
+		return errors.New("impersonation grant doesn't match token")
+	}
+	return nil
+}
+
+// Verify extracts actor from token claims and checks its grant, returns nil if token isn't impersonated
+func Verify(rdb redisdb.Client, claims map[string]any, account string) (*Actor, error) {
+	a, err := FromClaims(claims)
+	if err != nil || a == nil {
+		return nil, err
+	}
+	if err := Check(rdb, a, account); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// End revokes impersonation grant, returns account it was issued for
+func End(rdb redisdb.Client, id string) (*Actor, string, error) {
+	raw, err := rdb.Get(context.Background(), grantKey(id)).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("impersonation grant not found: %w", err)
+	}
+	var g grant
+	if err := json.Unmarshal([]byte(raw), &g); err != nil {
+		return nil, "", err
+	}
+	return g.Actor, g.Account, rdb.Del(context.Background(), grantKey(id)).Err()
+}
+
+// Audit records call made on behalf of account to events_logging
+// rc is gRPC status code, or HTTP status code for REST calls
+func Audit(log *zap.Logger, a *Actor, account, method string, rc int32) {
+	diff, _ := json.Marshal(map[string]any{
+		"impersonation": a.ID,
+		"mode":          a.Mode,
+		"reason":        a.Reason,
+	})
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      account,
+		Scope:     "impersonation",
+		Action:    method,
+		Rc:        rc,
+		Requestor: a.Sub,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: string(diff),
+		},
+	})
+}
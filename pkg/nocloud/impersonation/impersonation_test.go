@@ -0,0 +1,105 @@
+package impersonation
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	redis "github.com/go-redis/redis/v8"
+	redisdb_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromClaims(t *testing.T) {
+	actor := &Actor{Sub: "admin", ID: "grant", Mode: ReadOnly, Reason: "ticket"}
+
+	t.Run("not impersonated", func(t *testing.T) {
+		a, err := FromClaims(map[string]any{"sub": "acc"})
+		assert.NoError(t, err)
+		assert.Nil(t, a)
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		a, err := FromClaims(map[string]any{nocloud.NOCLOUD_ACT_CLAIM: actor.Claims()})
+		require.NoError(t, err)
+		assert.Equal(t, actor, a)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for name, act := range map[string]any{
+			"not an object": "admin",
+			"no grant":      map[string]any{"sub": "admin", "mode": "read"},
+			"unknown mode":  map[string]any{"sub": "admin", "id": "grant", "mode": "root"},
+		} {
+			_, err := FromClaims(map[string]any{nocloud.NOCLOUD_ACT_CLAIM: act})
+			assert.Error(t, err, name)
+		}
+	})
+}
+
+func TestAllows(t *testing.T) {
+	read := &Actor{Mode: ReadOnly}
+	write := &Actor{Mode: ReadWrite}
+
+	assert.True(t, read.Allows("/nocloud.registry.AccountsService/Get"))
+	assert.False(t, read.Allows("/nocloud.registry.AccountsService/Update"))
+	assert.True(t, write.Allows("/nocloud.registry.AccountsService/Update"))
+
+	for _, method := range forbidden {
+		assert.False(t, write.Allows(method), method)
+	}
+}
+
+func TestAllowsHTTP(t *testing.T) {
+	read := &Actor{Mode: ReadOnly}
+	write := &Actor{Mode: ReadWrite}
+
+	assert.True(t, read.AllowsHTTP("GET", "/billing/invoices"))
+	assert.False(t, read.AllowsHTTP("POST", "/billing/invoices"))
+	assert.True(t, write.AllowsHTTP("POST", "/billing/invoices"))
+
+	assert.False(t, write.AllowsHTTP("GET", "/accounts/credentials"))
+	assert.False(t, write.AllowsHTTP("POST", "/accounts/impersonate/end"))
+}
+
+func TestCheck(t *testing.T) {
+	actor := &Actor{Sub: "admin", ID: "grant", Mode: ReadOnly}
+	stored, err := json.Marshal(grant{Actor: actor, Account: "acc"})
+	require.NoError(t, err)
+
+	cases := []struct {
+		name    string
+		actor   *Actor
+		account string
+		wantErr bool
+	}{
+		{"matching grant", actor, "acc", false},
+		{"other account", actor, "other", true},
+		{"other admin", &Actor{Sub: "other", ID: "grant", Mode: ReadOnly}, "acc", true},
+		{"escalated mode", &Actor{Sub: "admin", ID: "grant", Mode: ReadWrite}, "acc", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rdb := redisdb_mocks.NewMockClient(t)
+			rdb.EXPECT().Get(mock.Anything, grantKey("grant")).Return(redis.NewStringResult(string(stored), nil))
+
+			err := Check(rdb, tc.actor, tc.account)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("ended grant", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().Get(mock.Anything, grantKey("grant")).Return(redis.NewStringResult("", redis.Nil))
+
+		err := Check(rdb, actor, "acc")
+		assert.True(t, errors.Is(err, redis.Nil))
+	})
+}
@@ -0,0 +1,164 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"strings"
+)
+
+var (
+	ErrExhausted    = errors.New("no free addresses left in pool")
+	ErrInvalidRange = errors.New("invalid address range")
+	ErrOutOfPool    = errors.New("address is out of pool")
+	ErrReserved     = errors.New("address is reserved")
+)
+
+// Addresses looked at while searching for free one, IPv6 pools are too large to walk through entirely
+const maxScan = 1 << 20
+
+// Range is inclusive range of addresses
+type Range struct {
+	From netip.Addr
+	To   netip.Addr
+}
+
+func (r Range) Contains(a netip.Addr) bool {
+	return r.From.Compare(a) <= 0 && a.Compare(r.To) <= 0
+}
+
+func (r Range) String() string {
+	if r.From == r.To {
+		return r.From.String()
+	}
+	return r.From.String() + "-" + r.To.String()
+}
+
+// ParseRange accepts single address, CIDR or from-to range
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return Range{}, fmt.Errorf("%w: %v", ErrInvalidRange, err)
+		}
+		return Range{From: p.Masked().Addr(), To: LastAddr(p)}, nil
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	a, err := netip.ParseAddr(strings.TrimSpace(from))
+	if err != nil {
+		return Range{}, fmt.Errorf("%w: %v", ErrInvalidRange, err)
+	}
+	b := a
+	if isRange {
+		if b, err = netip.ParseAddr(strings.TrimSpace(to)); err != nil {
+			return Range{}, fmt.Errorf("%w: %v", ErrInvalidRange, err)
+		}
+	}
+	if a.Is4() != b.Is4() || a.Compare(b) > 0 {
+		return Range{}, fmt.Errorf("%w: %s", ErrInvalidRange, s)
+	}
+	return Range{From: a, To: b}, nil
+}
+
+// LastAddr returns last address of prefix
+func LastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// Usable returns range of addresses can be given out, network and broadcast addresses of IPv4 subnets are excluded
+func Usable(p netip.Prefix) Range {
+	r := Range{From: p.Masked().Addr(), To: LastAddr(p)}
+	if p.Addr().Is4() && p.Bits() < 31 {
+		r.From, r.To = r.From.Next(), r.To.Prev()
+	}
+	return r
+}
+
+// Size returns number of usable addresses in prefix
+func Size(p netip.Prefix) *big.Int {
+	r := Usable(p)
+	from, to := new(big.Int).SetBytes(r.From.AsSlice()), new(big.Int).SetBytes(r.To.AsSlice())
+	return to.Sub(to, from).Add(to, big.NewInt(1))
+}
+
+// Check reports whether address can be allocated from prefix
+func Check(p netip.Prefix, reserved []Range, a netip.Addr) error {
+	if !p.Contains(a) || !Usable(p).Contains(a) {
+		return ErrOutOfPool
+	}
+	for _, r := range reserved {
+		if r.Contains(a) {
+			return ErrReserved
+		}
+	}
+	return nil
+}
+
+// NextFree returns lowest address of prefix which is neither reserved nor used
+func NextFree(p netip.Prefix, reserved []Range, used map[netip.Addr]struct{}) (netip.Addr, error) {
+	r := Usable(p)
+	a := r.From
+	for i := 0; i < maxScan && a.IsValid() && a.Compare(r.To) <= 0; i++ {
+		skipped := false
+		for _, res := range reserved {
+			if res.Contains(a) {
+				a, skipped = res.To.Next(), true
+				break
+			}
+		}
+		if skipped {
+			continue
+		}
+		if _, ok := used[a]; !ok {
+			return a, nil
+		}
+		a = a.Next()
+	}
+	return netip.Addr{}, ErrExhausted
+}
+
+// ReverseName returns PTR owner name of address, without trailing dot
+func ReverseName(a netip.Addr) string {
+	b := a.Unmap().AsSlice()
+	var labels []string
+	if len(b) == 4 {
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(b[i]))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa"
+	}
+	const hex = "0123456789abcdef"
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[b[i]&0xf]), string(hex[b[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
+
+// ReverseZone returns reverse zone prefix belongs to, prefix length is rounded down to octet for IPv4 and nibble for IPv6
+func ReverseZone(p netip.Prefix) string {
+	step := 4
+	if p.Addr().Is4() {
+		step = 8
+	}
+	labels := strings.Split(ReverseName(p.Masked().Addr()), ".")
+	total := p.Addr().BitLen() / step
+	keep := p.Bits() / step
+	// Drop labels for bits below zone boundary, keep arpa suffix
+	return strings.Join(labels[total-keep:], ".")
+}
+
+// Location returns part of reverse name of address relative to zone
+func Location(a netip.Addr, zone string) (string, bool) {
+	name := ReverseName(a)
+	if !strings.HasSuffix(name, "."+zone) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "."+zone), true
+}
@@ -0,0 +1,92 @@
+package ipam
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	r, err := ParseRange("10.0.0.8/30")
+	if err != nil || r.String() != "10.0.0.8-10.0.0.11" {
+		t.Fatalf("got %v %v", r, err)
+	}
+	if r, _ = ParseRange("2001:db8::1"); r.String() != "2001:db8::1" {
+		t.Fatalf("got %v", r)
+	}
+	for _, s := range []string{"10.0.0.5-10.0.0.1", "10.0.0.1-2001:db8::1", "foo"} {
+		if _, err := ParseRange(s); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("ParseRange(%q) = %v", s, err)
+		}
+	}
+}
+
+func TestNextFree(t *testing.T) {
+	p := netip.MustParsePrefix("192.0.2.0/29")
+	reserved := []Range{{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}}
+	used := map[netip.Addr]struct{}{netip.MustParseAddr("192.0.2.3"): {}}
+
+	a, err := NextFree(p, reserved, used)
+	if err != nil || a.String() != "192.0.2.4" {
+		t.Fatalf("got %v %v", a, err)
+	}
+	used[netip.MustParseAddr("192.0.2.4")] = struct{}{}
+	used[netip.MustParseAddr("192.0.2.5")] = struct{}{}
+	used[netip.MustParseAddr("192.0.2.6")] = struct{}{}
+	// .7 is broadcast
+	if _, err := NextFree(p, reserved, used); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("expected exhausted, got %v", err)
+	}
+
+	a, err = NextFree(netip.MustParsePrefix("2001:db8::/64"), nil, nil)
+	if err != nil || a.String() != "2001:db8::" {
+		t.Fatalf("got %v %v", a, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := netip.MustParsePrefix("192.0.2.0/24")
+	reserved := []Range{{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.1")}}
+	cases := map[string]error{
+		"192.0.2.10":  nil,
+		"192.0.2.1":   ErrReserved,
+		"192.0.2.255": ErrOutOfPool,
+		"192.0.3.1":   ErrOutOfPool,
+	}
+	for addr, want := range cases {
+		if err := Check(p, reserved, netip.MustParseAddr(addr)); !errors.Is(err, want) {
+			t.Errorf("Check(%s) = %v, want %v", addr, err, want)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	if s := Size(netip.MustParsePrefix("192.0.2.0/24")); s.Int64() != 254 {
+		t.Fatalf("got %v", s)
+	}
+	if s := Size(netip.MustParsePrefix("192.0.2.0/31")); s.Int64() != 2 {
+		t.Fatalf("got %v", s)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	if n := ReverseName(netip.MustParseAddr("192.0.2.10")); n != "10.2.0.192.in-addr.arpa" {
+		t.Fatalf("got %s", n)
+	}
+	if n := ReverseName(netip.MustParseAddr("2001:db8::1")); n != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa" {
+		t.Fatalf("got %s", n)
+	}
+	if z := ReverseZone(netip.MustParsePrefix("192.0.2.0/24")); z != "2.0.192.in-addr.arpa" {
+		t.Fatalf("got %s", z)
+	}
+	if z := ReverseZone(netip.MustParsePrefix("198.51.100.0/22")); z != "51.198.in-addr.arpa" {
+		t.Fatalf("got %s", z)
+	}
+	if z := ReverseZone(netip.MustParsePrefix("2001:db8::/48")); z != "0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa" {
+		t.Fatalf("got %s", z)
+	}
+	loc, ok := Location(netip.MustParseAddr("192.0.2.10"), "2.0.192.in-addr.arpa")
+	if !ok || loc != "10" {
+		t.Fatalf("got %s %v", loc, ok)
+	}
+}
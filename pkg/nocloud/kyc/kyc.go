@@ -0,0 +1,184 @@
+package kyc
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+const SettingsKey = "kyc"
+
+type Status string
+
+const (
+	// No rule requires documents from the account
+	NotRequired Status = "not_required"
+	// Some required documents are not uploaded or were rejected
+	Required Status = "required"
+	// All required documents are uploaded, some wait for review
+	Pending  Status = "pending"
+	Verified Status = "verified"
+	// Verification is older than validity period
+	Expired Status = "expired"
+)
+
+type DocumentStatus string
+
+const (
+	DocumentPending  DocumentStatus = "pending"
+	DocumentApproved DocumentStatus = "approved"
+	DocumentRejected DocumentStatus = "rejected"
+)
+
+// Rule requires documents from accounts of group located in one of countries, empty matches all
+type Rule struct {
+	AccountGroup string   `json:"account_group"`
+	Countries    []string `json:"countries"`
+	Documents    []string `json:"documents"`
+	// Products unavailable until KYC passes, either product key, plan/product or plan/*, * blocks all
+	Products []string `json:"products"`
+}
+
+func (r Rule) matches(group, country string) bool {
+	if r.AccountGroup != "" && r.AccountGroup != group {
+		return false
+	}
+	if len(r.Countries) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.Countries, func(c string) bool {
+		return strings.EqualFold(c, country)
+	})
+}
+
+type Config struct {
+	// Directory of local blob store
+	StoragePath string `json:"storage_path"`
+	MaxSize     int64  `json:"max_size"` // bytes
+	// Accepted MIME types of uploads
+	ContentTypes []string `json:"content_types"`
+	// Days verification stays valid
+	ValidityDays int    `json:"validity_days"`
+	Rules        []Rule `json:"rules"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		StoragePath:  "/var/lib/nocloud/kyc",
+		MaxSize:      10 << 20,
+		ContentTypes: []string{"application/pdf", "image/jpeg", "image/png"},
+		ValidityDays: 365,
+		Rules:        []Rule{},
+	}
+}
+
+func (c Config) AllowsContentType(contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	return slices.Contains(c.ContentTypes, strings.TrimSpace(strings.ToLower(contentType)))
+}
+
+// RequiredDocuments merges document types of all rules matching account
+func (c Config) RequiredDocuments(group, country string) []string {
+	var docs []string
+	for _, r := range c.Rules {
+		if !r.matches(group, country) {
+			continue
+		}
+		for _, d := range r.Documents {
+			if !slices.Contains(docs, d) {
+				docs = append(docs, d)
+			}
+		}
+	}
+	return docs
+}
+
+// Blocks reports whether product of plan is unavailable for account until KYC passes
+func (c Config) Blocks(group, country, plan, product string) bool {
+	for _, r := range c.Rules {
+		if !r.matches(group, country) {
+			continue
+		}
+		for _, p := range r.Products {
+			if p == "*" || p == product || p == plan+"/*" || p == plan+"/"+product {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Document is what status evaluation needs to know about uploaded document
+type Document struct {
+	Type       string
+	Status     DocumentStatus
+	UploadedAt int64
+	ReviewedAt int64
+}
+
+// State is stored on account as kyc field
+type State struct {
+	Status     Status   `json:"status"`
+	Missing    []string `json:"missing,omitempty"`
+	Rejected   []string `json:"rejected,omitempty"`
+	VerifiedAt int64    `json:"verified_at,omitempty"`
+	ExpiresAt  int64    `json:"expires_at,omitempty"`
+	UpdatedAt  int64    `json:"updated_at"`
+}
+
+// Evaluate derives account state from the latest document of each required type
+func Evaluate(required []string, docs []Document, validity time.Duration, now time.Time) State {
+	st := State{Status: NotRequired, UpdatedAt: now.Unix()}
+	if len(required) == 0 {
+		return st
+	}
+
+	latest := map[string]Document{}
+	for _, d := range docs {
+		if prev, ok := latest[d.Type]; !ok || d.UploadedAt >= prev.UploadedAt {
+			latest[d.Type] = d
+		}
+	}
+
+	pending := false
+	for _, t := range required {
+		d, ok := latest[t]
+		switch {
+		case !ok:
+			st.Missing = append(st.Missing, t)
+		case d.Status == DocumentRejected:
+			st.Rejected = append(st.Rejected, t)
+		case d.Status == DocumentPending:
+			pending = true
+		case d.Status == DocumentApproved:
+			st.VerifiedAt = max(st.VerifiedAt, d.ReviewedAt)
+		}
+	}
+
+	switch {
+	case len(st.Missing) > 0 || len(st.Rejected) > 0:
+		st.Status = Required
+		st.VerifiedAt = 0
+	case pending:
+		st.Status = Pending
+		st.VerifiedAt = 0
+	default:
+		st.Status = Verified
+		if validity > 0 {
+			st.ExpiresAt = st.VerifiedAt + int64(validity/time.Second)
+		}
+	}
+	return st.Effective(now)
+}
+
+// Effective accounts for expiry since the state was stored
+func (s State) Effective(now time.Time) State {
+	if s.Status == Verified && s.ExpiresAt > 0 && now.Unix() >= s.ExpiresAt {
+		s.Status = Expired
+	}
+	return s
+}
+
+func (s State) Passed() bool {
+	return s.Status == Verified || s.Status == NotRequired
+}
@@ -0,0 +1,85 @@
+package kyc
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRules(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Rules = []Rule{
+		{AccountGroup: "business", Documents: []string{"company_registration", "id"}, Products: []string{"plan-1/*"}},
+		{Countries: []string{"us"}, Documents: []string{"id", "proof_of_address"}, Products: []string{"dedicated"}},
+	}
+
+	if docs := conf.RequiredDocuments("business", "US"); !slices.Equal(docs, []string{"company_registration", "id", "proof_of_address"}) {
+		t.Fatalf("unexpected documents %v", docs)
+	}
+	if docs := conf.RequiredDocuments("private", "PL"); len(docs) != 0 {
+		t.Fatalf("expected no documents, got %v", docs)
+	}
+
+	cases := []struct {
+		group, country, plan, product string
+		want                          bool
+	}{
+		{"business", "PL", "plan-1", "vps", true},
+		{"business", "PL", "plan-2", "vps", false},
+		{"private", "US", "plan-2", "dedicated", true},
+		{"private", "PL", "plan-2", "dedicated", false},
+	}
+	for _, tc := range cases {
+		if got := conf.Blocks(tc.group, tc.country, tc.plan, tc.product); got != tc.want {
+			t.Errorf("Blocks(%+v) = %v", tc, got)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	required := []string{"id", "company_registration"}
+	validity := 24 * time.Hour
+
+	st := Evaluate(nil, nil, validity, now)
+	if st.Status != NotRequired || !st.Passed() {
+		t.Fatalf("expected not required, got %+v", st)
+	}
+
+	st = Evaluate(required, []Document{{Type: "id", Status: DocumentPending, UploadedAt: 1}}, validity, now)
+	if st.Status != Required || !slices.Equal(st.Missing, []string{"company_registration"}) {
+		t.Fatalf("expected missing registration, got %+v", st)
+	}
+
+	docs := []Document{
+		{Type: "id", Status: DocumentRejected, UploadedAt: 1, ReviewedAt: 2},
+		{Type: "id", Status: DocumentApproved, UploadedAt: 3, ReviewedAt: 500},
+		{Type: "company_registration", Status: DocumentPending, UploadedAt: 4},
+	}
+	st = Evaluate(required, docs, validity, now)
+	if st.Status != Pending {
+		t.Fatalf("expected pending, got %+v", st)
+	}
+
+	docs[2].Status, docs[2].ReviewedAt = DocumentApproved, now.Unix()-10
+	st = Evaluate(required, docs, validity, now)
+	if st.Status != Verified || st.VerifiedAt != now.Unix()-10 || st.ExpiresAt != now.Unix()-10+86400 {
+		t.Fatalf("expected verified, got %+v", st)
+	}
+	if st.Effective(now.Add(25*time.Hour)).Status != Expired {
+		t.Fatal("expected verification to expire")
+	}
+
+	docs = append(docs, Document{Type: "id", Status: DocumentRejected, UploadedAt: 5, ReviewedAt: 6})
+	st = Evaluate(required, docs, validity, now)
+	if st.Status != Required || !slices.Equal(st.Rejected, []string{"id"}) {
+		t.Fatalf("latest rejected document must reopen verification, got %+v", st)
+	}
+}
+
+func TestAllowsContentType(t *testing.T) {
+	conf := DefaultConfig()
+	if !conf.AllowsContentType("application/pdf; charset=binary") || conf.AllowsContentType("text/html") {
+		t.Fatal("unexpected content type handling")
+	}
+}
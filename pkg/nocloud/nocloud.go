@@ -33,6 +33,9 @@ const NOCLOUD_LOG_LEVEL = zapcore.DebugLevel - 1
 const NOCLOUD_SESSION_CLAIM = "session"
 const NOCLOUD_NOSESSION_CLAIM = "nosession"
 
+// Identity of the admin acting on behalf of the account, see RFC 8693
+const NOCLOUD_ACT_CLAIM = "act"
+
 type ContextKey string
 
 const NoCloudAccount = ContextKey("account")
@@ -42,6 +45,7 @@ const NoCloudRootAccess = ContextKey("root_access")
 const NoCloudSp = ContextKey("sp")
 const NoCloudInstance = ContextKey("instance")
 const NoCloudToken = ContextKey("token")
+const NoCloudActor = ContextKey("actor")
 const TestFromCreate = ContextKey("test_from_create")
 
 func Log(log *zap.Logger, event *pb.Event) {
@@ -0,0 +1,107 @@
+package placeholders
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var ErrMissing = errors.New("missing placeholder value")
+
+// Placeholders look like {{ hostname }}, names are letters, digits, _ and -
+var pattern = regexp.MustCompile(`{{\s*([A-Za-z0-9_-]+)\s*}}`)
+
+// Param describes placeholder template user fills in
+type Param struct {
+	Key         string `json:"key"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Default     string `json:"default,omitempty"`
+	Required    bool   `json:"required"`
+}
+
+// Find returns sorted unique placeholder names used in strings of v, v being decoded JSON
+func Find(v any) []string {
+	seen := map[string]struct{}{}
+	walk(v, func(s string) string {
+		for _, m := range pattern.FindAllStringSubmatch(s, -1) {
+			seen[m[1]] = struct{}{}
+		}
+		return s
+	})
+	res := make([]string, 0, len(seen))
+	for k := range seen {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Resolve fills values missing in given with defaults of params.
+// Placeholders used in v but not described in params are required
+func Resolve(v any, params []Param, given map[string]string) (map[string]string, error) {
+	res := make(map[string]string, len(given))
+	for k, val := range given {
+		res[k] = val
+	}
+	described := map[string]struct{}{}
+	var missing []string
+	for _, p := range params {
+		described[p.Key] = struct{}{}
+		if _, ok := res[p.Key]; ok {
+			continue
+		}
+		if p.Required {
+			missing = append(missing, p.Key)
+			continue
+		}
+		res[p.Key] = p.Default
+	}
+	for _, k := range Find(v) {
+		if _, ok := described[k]; ok {
+			continue
+		}
+		if _, ok := res[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%w: %s", ErrMissing, strings.Join(missing, ", "))
+	}
+	return res, nil
+}
+
+// Render returns copy of v with placeholders replaced by values, unknown placeholders are kept as is
+func Render(v any, values map[string]string) any {
+	return walk(v, func(s string) string {
+		return pattern.ReplaceAllStringFunc(s, func(m string) string {
+			if val, ok := values[pattern.FindStringSubmatch(m)[1]]; ok {
+				return val
+			}
+			return m
+		})
+	})
+}
+
+func walk(v any, f func(string) string) any {
+	switch val := v.(type) {
+	case string:
+		return f(val)
+	case map[string]any:
+		res := make(map[string]any, len(val))
+		for k, item := range val {
+			res[k] = walk(item, f)
+		}
+		return res
+	case []any:
+		res := make([]any, len(val))
+		for i, item := range val {
+			res[i] = walk(item, f)
+		}
+		return res
+	}
+	return v
+}
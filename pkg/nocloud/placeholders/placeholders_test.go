@@ -0,0 +1,63 @@
+package placeholders
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func config() map[string]any {
+	return map[string]any{
+		"title": "web-{{ hostname }}",
+		"config": map[string]any{
+			"hostname": "{{hostname}}.example.com",
+			"ssh_keys": []any{"{{ ssh_key }}"},
+			"password": "{{password}}",
+			"cpu":      2.0,
+		},
+	}
+}
+
+func TestFind(t *testing.T) {
+	if got := Find(config()); !reflect.DeepEqual(got, []string{"hostname", "password", "ssh_key"}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	params := []Param{
+		{Key: "hostname", Required: true},
+		{Key: "ssh_key", Default: ""},
+	}
+	_, err := Resolve(config(), params, map[string]string{})
+	if !errors.Is(err, ErrMissing) || err.Error() != "missing placeholder value: hostname, password" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	values, err := Resolve(config(), params, map[string]string{"hostname": "node1", "password": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"hostname": "node1", "password": "secret", "ssh_key": ""}; !reflect.DeepEqual(values, want) {
+		t.Fatalf("got %v", values)
+	}
+}
+
+func TestRender(t *testing.T) {
+	src := config()
+	got := Render(src, map[string]string{"hostname": "node1", "ssh_key": "ssh-ed25519 AAA"}).(map[string]any)
+	want := map[string]any{
+		"title": "web-node1",
+		"config": map[string]any{
+			"hostname": "node1.example.com",
+			"ssh_keys": []any{"ssh-ed25519 AAA"},
+			"password": "{{password}}",
+			"cpu":      2.0,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v", got)
+	}
+	if src["title"] != "web-{{ hostname }}" {
+		t.Fatal("source was modified")
+	}
+}
@@ -0,0 +1,315 @@
+package placement
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoCandidates    = errors.New("no services providers offer requested plan")
+	ErrNoCapacity      = errors.New("no services provider has enough capacity")
+	ErrUnknownStrategy = errors.New("unknown placement strategy")
+)
+
+// Resources of instance or sum of them, ram and disk in MB as in instance resources
+type Resources struct {
+	Instances int     `json:"instances"`
+	CPU       float64 `json:"cpu"`
+	RAM       float64 `json:"ram"`
+	Disk      float64 `json:"disk"`
+}
+
+func (r Resources) Add(o Resources) Resources {
+	return Resources{r.Instances + o.Instances, r.CPU + o.CPU, r.RAM + o.RAM, r.Disk + o.Disk}
+}
+
+// Limits are capacity of services provider, zero means unlimited
+type Limits Resources
+
+// Exceeded names first resource usage goes over, empty if it fits
+func (l Limits) Exceeded(usage Resources) string {
+	switch {
+	case l.Instances > 0 && usage.Instances > l.Instances:
+		return fmt.Sprintf("instances %d > %d", usage.Instances, l.Instances)
+	case l.CPU > 0 && usage.CPU > l.CPU:
+		return fmt.Sprintf("cpu %g > %g", usage.CPU, l.CPU)
+	case l.RAM > 0 && usage.RAM > l.RAM:
+		return fmt.Sprintf("ram %g > %g", usage.RAM, l.RAM)
+	case l.Disk > 0 && usage.Disk > l.Disk:
+		return fmt.Sprintf("disk %g > %g", usage.Disk, l.Disk)
+	}
+	return ""
+}
+
+// Utilization is highest share of limited resources in use, 0 if nothing is limited
+func (l Limits) Utilization(usage Resources) float64 {
+	var u float64
+	share := func(used, limit float64) {
+		if limit > 0 {
+			u = max(u, used/limit)
+		}
+	}
+	share(float64(usage.Instances), float64(l.Instances))
+	share(usage.CPU, l.CPU)
+	share(usage.RAM, l.RAM)
+	share(usage.Disk, l.Disk)
+	return u
+}
+
+type Candidate struct {
+	UUID  string `json:"uuid"`
+	Title string `json:"title"`
+	// Region and location ids services provider serves, matched case-insensitively
+	Regions []string `json:"regions"`
+	Weight  int      `json:"weight"`
+	Limits  Limits   `json:"limits"`
+	// Current usage by all accounts
+	Load Resources `json:"load"`
+	// Instances of requesting account already placed there
+	AccountInstances int `json:"account_instances"`
+}
+
+func (c *Candidate) InRegion(regions []string) bool {
+	return slices.ContainsFunc(c.Regions, func(r string) bool {
+		return slices.ContainsFunc(regions, func(p string) bool { return strings.EqualFold(r, p) })
+	})
+}
+
+type Affinity string
+
+const (
+	NoAffinity Affinity = ""
+	// Prefer services providers account already uses
+	Together Affinity = "affinity"
+	// Prefer services providers account doesn't use yet
+	Apart Affinity = "anti_affinity"
+)
+
+type Request struct {
+	Strategy  string    `json:"strategy"`
+	Resources Resources `json:"resources"`
+	// Preferred regions in order, e.g. from account data
+	Regions  []string `json:"regions"`
+	Affinity Affinity `json:"affinity"`
+}
+
+// Score of candidate, lower is better
+type Score struct {
+	UUID     string  `json:"uuid"`
+	Title    string  `json:"title"`
+	Score    float64 `json:"score"`
+	Rejected string  `json:"rejected,omitempty"`
+	Note     string  `json:"note,omitempty"`
+}
+
+type Decision struct {
+	Chosen      string   `json:"chosen"`
+	Strategy    string   `json:"strategy"`
+	Explanation []string `json:"explanation"`
+	Scores      []Score  `json:"scores"`
+}
+
+func (d *Decision) explain(format string, args ...any) {
+	d.Explanation = append(d.Explanation, fmt.Sprintf(format, args...))
+}
+
+// Strategy orders candidates which passed capacity, region and affinity filtering
+type Strategy interface {
+	Name() string
+	// Score returns lower-is-better score and short reason
+	Score(req *Request, c *Candidate) (float64, string)
+	// Picked is called with chosen candidate, for stateful strategies
+	Picked(c *Candidate, all []*Candidate)
+}
+
+type leastInstances struct{}
+
+func (leastInstances) Name() string { return "least_instances" }
+func (leastInstances) Score(_ *Request, c *Candidate) (float64, string) {
+	return float64(c.Load.Instances), fmt.Sprintf("%d instances", c.Load.Instances)
+}
+func (leastInstances) Picked(*Candidate, []*Candidate) {}
+
+type leastResources struct{}
+
+func (leastResources) Name() string { return "least_resources" }
+func (leastResources) Score(req *Request, c *Candidate) (float64, string) {
+	if u := c.Limits.Utilization(c.Load.Add(req.Resources)); u > 0 {
+		return u, fmt.Sprintf("%.0f%% utilized after placement", u*100)
+	}
+	// Without limits compare raw sums, RAM and disk are in MB so CPU gets same order of magnitude
+	sum := c.Load.CPU*1024 + c.Load.RAM + c.Load.Disk/10
+	return sum, fmt.Sprintf("cpu %g, ram %g, disk %g in use", c.Load.CPU, c.Load.RAM, c.Load.Disk)
+}
+func (leastResources) Picked(*Candidate, []*Candidate) {}
+
+// weightedRoundRobin is smooth weighted round-robin, state is per process
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func (*weightedRoundRobin) Name() string { return "weighted_round_robin" }
+func (w *weightedRoundRobin) Score(_ *Request, c *Candidate) (float64, string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Score must be read before Picked updates, higher current weight goes first
+	return -float64(w.current[c.UUID] + weight(c)), fmt.Sprintf("weight %d", weight(c))
+}
+func (w *weightedRoundRobin) Picked(c *Candidate, all []*Candidate) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	total := 0
+	for _, o := range all {
+		w.current[o.UUID] += weight(o)
+		total += weight(o)
+	}
+	w.current[c.UUID] -= total
+}
+
+func weight(c *Candidate) int {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// Engine holds strategies by name, register custom ones with Register
+type Engine struct {
+	mu         sync.RWMutex
+	strategies map[string]Strategy
+	fallback   string
+}
+
+const DefaultStrategy = "least_instances"
+
+func NewEngine() *Engine {
+	e := &Engine{strategies: map[string]Strategy{}, fallback: DefaultStrategy}
+	e.Register(leastInstances{})
+	e.Register(leastResources{})
+	e.Register(&weightedRoundRobin{current: map[string]int{}})
+	return e
+}
+
+func (e *Engine) Register(s Strategy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.strategies[s.Name()] = s
+}
+
+func (e *Engine) Strategies() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	names := make([]string, 0, len(e.strategies))
+	for n := range e.strategies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Place picks candidate for request. Capacity is a hard limit, region and affinity narrow
+// candidates only while some remain, strategy orders what is left
+func (e *Engine) Place(req *Request, candidates []*Candidate) (*Decision, error) {
+	return e.decide(req, candidates, true)
+}
+
+// Preview decides same as Place would, but pick isn't recorded, so stateful strategies aren't advanced
+func (e *Engine) Preview(req *Request, candidates []*Candidate) (*Decision, error) {
+	return e.decide(req, candidates, false)
+}
+
+func (e *Engine) decide(req *Request, candidates []*Candidate, record bool) (*Decision, error) {
+	name := req.Strategy
+	if name == "" {
+		name = e.fallback
+	}
+	e.mu.RLock()
+	strategy, ok := e.strategies[name]
+	e.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, name)
+	}
+
+	d := &Decision{Strategy: name}
+	if len(candidates) == 0 {
+		return d, ErrNoCandidates
+	}
+
+	scores := map[string]*Score{}
+	for _, c := range candidates {
+		scores[c.UUID] = &Score{UUID: c.UUID, Title: c.Title}
+	}
+
+	var fitting []*Candidate
+	for _, c := range candidates {
+		if reason := c.Limits.Exceeded(c.Load.Add(req.Resources)); reason != "" {
+			scores[c.UUID].Rejected = "capacity: " + reason
+			continue
+		}
+		fitting = append(fitting, c)
+	}
+	d.explain("%d of %d services providers have capacity", len(fitting), len(candidates))
+
+	pool := fitting
+	if len(req.Regions) > 0 && len(pool) > 0 {
+		var inRegion []*Candidate
+		for _, c := range pool {
+			if c.InRegion(req.Regions) {
+				inRegion = append(inRegion, c)
+			} else {
+				scores[c.UUID].Note = "outside preferred region"
+			}
+		}
+		if len(inRegion) > 0 {
+			pool = inRegion
+			d.explain("%d in preferred region %s", len(inRegion), strings.Join(req.Regions, ", "))
+		} else {
+			d.explain("none in preferred region %s, ignoring preference", strings.Join(req.Regions, ", "))
+		}
+	}
+
+	if req.Affinity != NoAffinity && len(pool) > 0 {
+		var matching []*Candidate
+		for _, c := range pool {
+			if (c.AccountInstances > 0) == (req.Affinity == Together) {
+				matching = append(matching, c)
+			} else if scores[c.UUID].Note == "" {
+				scores[c.UUID].Note = "excluded by " + string(req.Affinity)
+			}
+		}
+		if len(matching) > 0 {
+			pool = matching
+			d.explain("%d match %s", len(matching), req.Affinity)
+		} else {
+			d.explain("none match %s, ignoring it", req.Affinity)
+		}
+	}
+
+	var best *Candidate
+	for _, c := range pool {
+		score, note := strategy.Score(req, c)
+		sc := scores[c.UUID]
+		sc.Score, sc.Note = score, note
+		if best == nil || score < scores[best.UUID].Score ||
+			(score == scores[best.UUID].Score && c.UUID < best.UUID) {
+			best = c
+		}
+	}
+	for _, c := range candidates {
+		d.Scores = append(d.Scores, *scores[c.UUID])
+	}
+	if best == nil {
+		return d, ErrNoCapacity
+	}
+	if record {
+		strategy.Picked(best, pool)
+	}
+	d.Chosen = best.UUID
+	d.explain("picked %s by %s (%s)", best.Title, name, scores[best.UUID].Note)
+	return d, nil
+}
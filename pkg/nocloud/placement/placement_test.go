@@ -0,0 +1,95 @@
+package placement
+
+import (
+	"errors"
+	"testing"
+)
+
+func candidates() []*Candidate {
+	return []*Candidate{
+		{UUID: "a", Title: "A", Regions: []string{"eu-west"}, Weight: 3, Load: Resources{Instances: 10, CPU: 20}},
+		{UUID: "b", Title: "B", Regions: []string{"us-east"}, Weight: 1, Load: Resources{Instances: 2, CPU: 4}, AccountInstances: 1},
+		{UUID: "c", Title: "C", Regions: []string{"EU-West"}, Limits: Limits{Instances: 5}, Load: Resources{Instances: 5}},
+	}
+}
+
+func TestPlace_Capacity(t *testing.T) {
+	d, err := NewEngine().Place(&Request{Resources: Resources{Instances: 1}}, candidates())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Chosen != "b" {
+		t.Fatalf("expected least loaded b, got %s: %v", d.Chosen, d.Explanation)
+	}
+	for _, s := range d.Scores {
+		if s.UUID == "c" && s.Rejected == "" {
+			t.Fatal("c must be rejected by capacity")
+		}
+	}
+
+	full := []*Candidate{{UUID: "x", Limits: Limits{CPU: 2}, Load: Resources{CPU: 2}}}
+	if _, err := NewEngine().Place(&Request{Resources: Resources{Instances: 1, CPU: 1}}, full); !errors.Is(err, ErrNoCapacity) {
+		t.Fatalf("expected ErrNoCapacity, got %v", err)
+	}
+}
+
+func TestPlace_RegionAndAffinity(t *testing.T) {
+	e := NewEngine()
+	d, err := e.Place(&Request{Resources: Resources{Instances: 1}, Regions: []string{"eu-west"}}, candidates())
+	if err != nil || d.Chosen != "a" {
+		t.Fatalf("expected a in preferred region, got %s, %v", d.Chosen, err)
+	}
+	d, err = e.Place(&Request{Resources: Resources{Instances: 1}, Regions: []string{"ap-south"}}, candidates())
+	if err != nil || d.Chosen != "b" {
+		t.Fatalf("unknown region must be ignored, got %s, %v", d.Chosen, err)
+	}
+	d, err = e.Place(&Request{Resources: Resources{Instances: 1}, Affinity: Apart}, candidates())
+	if err != nil || d.Chosen != "a" {
+		t.Fatalf("anti affinity must avoid b, got %s, %v", d.Chosen, err)
+	}
+}
+
+func TestPlace_WeightedRoundRobin(t *testing.T) {
+	e := NewEngine()
+	cs := candidates()[:2]
+	picked := map[string]int{}
+	for i := 0; i < 8; i++ {
+		d, err := e.Place(&Request{Strategy: "weighted_round_robin"}, cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[d.Chosen]++
+	}
+	if picked["a"] != 6 || picked["b"] != 2 {
+		t.Fatalf("expected 3:1 split, got %v", picked)
+	}
+	if _, err := e.Place(&Request{Strategy: "random"}, cs); !errors.Is(err, ErrUnknownStrategy) {
+		t.Fatalf("expected ErrUnknownStrategy, got %v", err)
+	}
+}
+
+func TestPreview_DoesNotAdvanceRoundRobin(t *testing.T) {
+	e := NewEngine()
+	cs := candidates()[:2]
+	req := &Request{Strategy: "weighted_round_robin"}
+	first, err := e.Preview(req, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		d, err := e.Preview(req, cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Chosen != first.Chosen {
+			t.Fatalf("preview changed pick from %s to %s", first.Chosen, d.Chosen)
+		}
+	}
+	placed, err := e.Place(req, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placed.Chosen != first.Chosen {
+		t.Fatalf("expected placement to match preview %s, got %s", first.Chosen, placed.Chosen)
+	}
+}
@@ -0,0 +1,169 @@
+package quota
+
+import (
+	"fmt"
+	"time"
+)
+
+const SettingsKey = "quotas"
+
+type Resource string
+
+const (
+	Instances Resource = "instances"
+	CPU       Resource = "cpu"
+	RAM       Resource = "ram"  // MB
+	Disk      Resource = "disk" // MB
+	Services  Resource = "services"
+	// Sum of transactions processed since month start, in account currency
+	MonthlySpend Resource = "monthly_spend"
+)
+
+var Resources = []Resource{Instances, CPU, RAM, Disk, Services, MonthlySpend}
+
+// Limits maps resource to its limit. Resources missing are unlimited on this level and inherited from the level below
+type Limits map[Resource]float64
+
+// Merge returns limits with override taking precedence per resource, negative override removes limit
+func (l Limits) Merge(override Limits) Limits {
+	res := Limits{}
+	for r, v := range l {
+		res[r] = v
+	}
+	for r, v := range override {
+		if v < 0 {
+			delete(res, r)
+			continue
+		}
+		res[r] = v
+	}
+	return res
+}
+
+type Usage map[Resource]float64
+
+func (u Usage) Add(delta Usage) Usage {
+	res := Usage{}
+	for r, v := range u {
+		res[r] = v
+	}
+	for r, v := range delta {
+		res[r] += v
+	}
+	return res
+}
+
+type Config struct {
+	// Applied to every account
+	Default Limits `json:"default"`
+	// Account group uuid -> limits, override Default
+	Groups map[string]Limits `json:"groups"`
+	// Namespace uuid -> limits, override group limits
+	Namespaces map[string]Limits `json:"namespaces"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Default:    Limits{},
+		Groups:     map[string]Limits{},
+		Namespaces: map[string]Limits{},
+	}
+}
+
+// Resolve merges limits for account of group in namespace with account's own overrides, most specific wins
+func (c Config) Resolve(group, namespace string, account Limits) Limits {
+	res := Limits{}.Merge(c.Default)
+	if group != "" {
+		res = res.Merge(c.Groups[group])
+	}
+	if namespace != "" {
+		res = res.Merge(c.Namespaces[namespace])
+	}
+	return res.Merge(account)
+}
+
+// ExceededError tells which resource would go over its limit
+type ExceededError struct {
+	Resource  Resource
+	Used      float64
+	Requested float64
+	Limit     float64
+}
+
+func (e *ExceededError) Error() string {
+	if e.Resource == MonthlySpend {
+		return fmt.Sprintf("quota exceeded: monthly spend %g reached limit %g", e.Used, e.Limit)
+	}
+	return fmt.Sprintf("quota exceeded: %s %g in use, %g requested, limit %g", e.Resource, e.Used, e.Requested, e.Limit)
+}
+
+// Check returns ExceededError if adding delta to usage goes over any limit. Only resources delta grows are checked,
+// so shrinking or unrelated changes pass even if account is already over quota. Monthly spend can't be requested,
+// it's checked whenever delta grows anything
+func (l Limits) Check(usage, delta Usage) error {
+	grows := false
+	for _, r := range Resources {
+		if delta[r] <= 0 {
+			continue
+		}
+		grows = true
+		limit, ok := l[r]
+		if !ok {
+			continue
+		}
+		if usage[r]+delta[r] > limit {
+			return &ExceededError{Resource: r, Used: usage[r], Requested: delta[r], Limit: limit}
+		}
+	}
+	if limit, ok := l[MonthlySpend]; ok && grows && usage[MonthlySpend] >= limit {
+		return &ExceededError{Resource: MonthlySpend, Used: usage[MonthlySpend], Limit: limit}
+	}
+	return nil
+}
+
+type Item struct {
+	Resource Resource `json:"resource"`
+	Used     float64  `json:"used"`
+	// Nil if unlimited
+	Limit *float64 `json:"limit"`
+	// Share of limit in use, nil if unlimited
+	Utilization *float64 `json:"utilization,omitempty"`
+}
+
+// Report lists usage against limits for every resource
+func Report(l Limits, usage Usage) []Item {
+	items := make([]Item, 0, len(Resources))
+	for _, r := range Resources {
+		item := Item{Resource: r, Used: usage[r]}
+		if limit, ok := l[r]; ok {
+			item.Limit = &limit
+			u := 1.0
+			if limit > 0 {
+				u = usage[r] / limit
+			}
+			item.Utilization = &u
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// MonthStart is beginning of month t is in, monthly spend is counted since it
+func MonthStart(t time.Time) time.Time {
+	y, m, _ := t.Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+}
+
+// Over returns ExceededError for first resource usage already exceeds, monthly spend counts once limit is reached
+func (l Limits) Over(usage Usage) error {
+	for _, r := range Resources {
+		limit, ok := l[r]
+		if !ok {
+			continue
+		}
+		if usage[r] > limit || (r == MonthlySpend && usage[r] >= limit) {
+			return &ExceededError{Resource: r, Used: usage[r], Limit: limit}
+		}
+	}
+	return nil
+}
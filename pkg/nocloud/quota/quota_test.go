@@ -0,0 +1,76 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Default = Limits{Instances: 5, CPU: 8}
+	conf.Groups["business"] = Limits{Instances: 50, Services: 10}
+	conf.Namespaces["ns"] = Limits{CPU: 64}
+
+	l := conf.Resolve("business", "ns", Limits{Services: -1, RAM: 4096})
+	want := Limits{Instances: 50, CPU: 64, RAM: 4096}
+	if len(l) != len(want) {
+		t.Fatalf("unexpected limits %v", l)
+	}
+	for r, v := range want {
+		if l[r] != v {
+			t.Errorf("%s = %g, want %g", r, l[r], v)
+		}
+	}
+
+	if l := conf.Resolve("", "", nil); l[Instances] != 5 || l[CPU] != 8 {
+		t.Fatalf("expected default limits, got %v", l)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l := Limits{Instances: 2, CPU: 4, MonthlySpend: 100}
+	usage := Usage{Instances: 1, CPU: 2, MonthlySpend: 50}
+
+	if err := l.Check(usage, Usage{Instances: 1, CPU: 2}); err != nil {
+		t.Fatalf("expected to fit, got %v", err)
+	}
+
+	var exceeded *ExceededError
+	err := l.Check(usage, Usage{Instances: 1, CPU: 4})
+	if !errors.As(err, &exceeded) || exceeded.Resource != CPU {
+		t.Fatalf("expected cpu exceeded, got %v", err)
+	}
+
+	// Shrinking is allowed while over quota
+	over := Usage{Instances: 3, CPU: 8}
+	if err := l.Check(over, Usage{CPU: -2}); err != nil {
+		t.Fatalf("expected shrink to pass, got %v", err)
+	}
+
+	usage[MonthlySpend] = 100
+	err = l.Check(usage, Usage{RAM: 1024})
+	if !errors.As(err, &exceeded) || exceeded.Resource != MonthlySpend {
+		t.Fatalf("expected monthly spend exceeded, got %v", err)
+	}
+
+	err = l.Over(over)
+	if !errors.As(err, &exceeded) || exceeded.Resource != Instances {
+		t.Fatalf("expected instances over quota, got %v", err)
+	}
+	if err := l.Over(Usage{Instances: 2, CPU: 4}); err != nil {
+		t.Fatalf("expected usage at limit to pass, got %v", err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	items := Report(Limits{Instances: 4}, Usage{Instances: 1, CPU: 3})
+	if len(items) != len(Resources) {
+		t.Fatalf("expected item per resource, got %d", len(items))
+	}
+	if items[0].Limit == nil || *items[0].Utilization != 0.25 {
+		t.Fatalf("unexpected instances item %+v", items[0])
+	}
+	if items[1].Limit != nil || items[1].Used != 3 {
+		t.Fatalf("unexpected cpu item %+v", items[1])
+	}
+}
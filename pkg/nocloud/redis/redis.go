@@ -20,6 +20,7 @@ type Client interface {
 	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
 	Options() *redis.Options
 	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
 	Ping(ctx context.Context) *redis.StatusCmd
 }
 
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/impersonation"
 	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
 	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
 	"go.uber.org/zap"
@@ -63,10 +64,44 @@ func (i *interceptor) JwtMiddleWare(handler http.Handler) http.Handler {
 
 		go i.handleLogActivity(ctx)
 
+		if actor := impersonation.FromContext(ctx); actor != nil {
+			i.serveImpersonated(w, r.WithContext(ctx), actor, handler)
+			return
+		}
+
 		handler.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Impersonated requests are limited by mode and every one of them is audited
+func (i *interceptor) serveImpersonated(w http.ResponseWriter, r *http.Request, actor *impersonation.Actor, handler http.Handler) {
+	account := r.Context().Value(nocloud.NoCloudAccount).(string)
+	method := r.Method + " " + r.URL.Path
+	if !actor.AllowsHTTP(r.Method, r.URL.Path) {
+		impersonation.Audit(i.log, actor, account, method, http.StatusForbidden)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("not allowed in impersonated session"))
+		return
+	}
+	for k, v := range actor.Headers() {
+		w.Header().Set(k, v)
+	}
+
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	handler.ServeHTTP(rec, r)
+	impersonation.Audit(i.log, actor, account, method, int32(rec.code))
+}
+
 func (i *interceptor) jwtAuthMiddleware(ctx context.Context, tokenString string) (context.Context, error) {
 	l := i.log.Named("Middleware")
 
@@ -104,6 +139,15 @@ func (i *interceptor) jwtAuthMiddleware(ctx context.Context, tokenString string)
 		ctx = context.WithValue(ctx, nocloud.NoCloudSession, sid)
 	}
 
+	actor, err := impersonation.Verify(i.rdb, token, uuid)
+	if err != nil {
+		i.log.Debug("Impersonation check failed", zap.Any("error", err))
+		return ctx, status.Error(codes.Unauthenticated, "Impersonation is expired, ended or invalid")
+	}
+	if actor != nil {
+		ctx = context.WithValue(ctx, nocloud.NoCloudActor, actor)
+	}
+
 	var exp int64
 	if token["expires"] != nil {
 		exp = int64(token["expires"].(float64))
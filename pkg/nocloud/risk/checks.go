@@ -0,0 +1,192 @@
+package risk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pariz/gountries"
+)
+
+// Commonly abused throwaway mail providers, extended via Config.DisposableDomains
+var disposableDomains = []string{
+	"10minutemail.com", "20minutemail.com", "33mail.com", "guerrillamail.com",
+	"guerrillamail.net", "guerrillamailblock.com", "sharklasers.com", "grr.la",
+	"mailinator.com", "mailinator.net", "maildrop.cc", "mailnesia.com",
+	"yopmail.com", "yopmail.net", "trashmail.com", "trashmail.de",
+	"temp-mail.org", "tempmail.com", "tempmail.net", "tempail.com",
+	"throwawaymail.com", "getnada.com", "dispostable.com", "fakeinbox.com",
+	"mohmal.com", "emailondeck.com", "mintemail.com", "spamgourmet.com",
+	"mytemp.email", "tempr.email", "discard.email", "mailcatch.com",
+	"burnermail.io", "inboxkitten.com", "tmail.ws", "moakt.com",
+	"1secmail.com", "1secmail.net", "1secmail.org", "emailfake.com",
+}
+
+type disposableEmail struct {
+	score   int
+	domains map[string]struct{}
+}
+
+// NewDisposableEmailCheck fires for addresses at throwaway providers and their subdomains
+func NewDisposableEmailCheck(score int, extra []string) Check {
+	c := &disposableEmail{score: score, domains: map[string]struct{}{}}
+	for _, d := range append(disposableDomains, extra...) {
+		c.domains[strings.ToLower(strings.TrimSpace(d))] = struct{}{}
+	}
+	return c
+}
+
+func (c *disposableEmail) Name() string {
+	return "disposable_email"
+}
+
+func (c *disposableEmail) Evaluate(_ context.Context, in *Input) (*Reason, error) {
+	domain := EmailDomain(in.Email)
+	for domain != "" {
+		if _, ok := c.domains[domain]; ok {
+			return &Reason{Score: c.score, Detail: domain}, nil
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return nil, nil
+}
+
+type countryMismatch struct {
+	score int
+}
+
+// NewCountryMismatchCheck fires if IP country differs from billing country
+func NewCountryMismatchCheck(score int) Check {
+	return &countryMismatch{score: score}
+}
+
+func (c *countryMismatch) Name() string {
+	return "country_mismatch"
+}
+
+var countries = gountries.New()
+
+// Billing country may be stored as alpha-2, alpha-3 or name
+func countryCode(country string) string {
+	country = strings.TrimSpace(country)
+	upper := strings.ToUpper(country)
+	if len(upper) == 2 || len(upper) == 3 {
+		if c, err := countries.FindCountryByAlpha(upper); err == nil {
+			return strings.ToUpper(c.Alpha2)
+		}
+	}
+	if c, err := countries.FindCountryByName(country); err == nil {
+		return strings.ToUpper(c.Alpha2)
+	}
+	return upper
+}
+
+func (c *countryMismatch) Evaluate(_ context.Context, in *Input) (*Reason, error) {
+	ip := strings.ToUpper(strings.TrimSpace(in.IPCountry))
+	billing := countryCode(in.BillingCountry)
+	// XX and T1 are unknown and Tor for Cloudflare
+	if ip == "" || billing == "" || ip == "XX" || ip == "T1" || ip == billing {
+		return nil, nil
+	}
+	return &Reason{Score: c.score, Detail: fmt.Sprintf("ip country %s, billing country %s", ip, billing)}, nil
+}
+
+// Counter counts events per key within sliding window started by the first event
+type Counter interface {
+	Incr(ctx context.Context, key string, window time.Duration) (int64, error)
+}
+
+type velocity struct {
+	name    string
+	score   int
+	limit   int64
+	window  time.Duration
+	counter Counter
+	key     func(in *Input) string
+}
+
+// NewIPVelocityCheck fires when more than limit screenings of the same stage come from one IP within window
+func NewIPVelocityCheck(counter Counter, limit int, window time.Duration, score int) Check {
+	return &velocity{
+		name: "ip_velocity", score: score, limit: int64(limit), window: window, counter: counter,
+		key: func(in *Input) string { return in.IP },
+	}
+}
+
+// NewDeviceVelocityCheck fires when more than limit screenings of the same stage come from one device within window
+func NewDeviceVelocityCheck(counter Counter, limit int, window time.Duration, score int) Check {
+	return &velocity{
+		name: "device_velocity", score: score, limit: int64(limit), window: window, counter: counter,
+		key: func(in *Input) string { return in.Device },
+	}
+}
+
+func (c *velocity) Name() string {
+	return c.name
+}
+
+func (c *velocity) Evaluate(ctx context.Context, in *Input) (*Reason, error) {
+	key := c.key(in)
+	if key == "" {
+		return nil, nil
+	}
+	count, err := c.counter.Incr(ctx, fmt.Sprintf("risk:%s:%s:%s", c.name, in.Stage, key), c.window)
+	if err != nil {
+		return nil, err
+	}
+	if count <= c.limit {
+		return nil, nil
+	}
+	return &Reason{Score: c.score, Detail: fmt.Sprintf("%d %s attempts from %s within %s", count, in.Stage, key, c.window)}, nil
+}
+
+// DuplicateLookup counts other accounts using the same contacts
+type DuplicateLookup interface {
+	CountByEmail(ctx context.Context, email, exclude string) (int, error)
+	CountByPhone(ctx context.Context, phone, exclude string) (int, error)
+}
+
+type duplicate struct {
+	name   string
+	score  int
+	value  func(in *Input) string
+	lookup func(ctx context.Context, value, exclude string) (int, error)
+}
+
+func NewDuplicateEmailCheck(lookup DuplicateLookup, score int) Check {
+	return &duplicate{
+		name: "duplicate_email", score: score, lookup: lookup.CountByEmail,
+		value: func(in *Input) string { return strings.ToLower(strings.TrimSpace(in.Email)) },
+	}
+}
+
+func NewDuplicatePhoneCheck(lookup DuplicateLookup, score int) Check {
+	return &duplicate{
+		name: "duplicate_phone", score: score, lookup: lookup.CountByPhone,
+		value: func(in *Input) string { return in.Phone },
+	}
+}
+
+func (c *duplicate) Name() string {
+	return c.name
+}
+
+func (c *duplicate) Evaluate(ctx context.Context, in *Input) (*Reason, error) {
+	value := c.value(in)
+	if value == "" {
+		return nil, nil
+	}
+	count, err := c.lookup(ctx, value, in.Account)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	return &Reason{Score: c.score, Detail: fmt.Sprintf("used by %d other account(s)", count)}, nil
+}
@@ -0,0 +1,102 @@
+package risk
+
+import (
+	"context"
+	"time"
+
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+)
+
+const SettingsKey = "signup-risk"
+
+// Config is stored in settings under SettingsKey, scores of 0 disable the check
+type Config struct {
+	Enabled    bool       `json:"enabled"`
+	Thresholds Thresholds `json:"thresholds"`
+
+	DisposableEmailScore int `json:"disposable_email_score"`
+	// Appended to built-in list of disposable providers
+	DisposableDomains []string `json:"disposable_domains"`
+
+	CountryMismatchScore int `json:"country_mismatch_score"`
+	// Incoming metadata key edge proxy puts client country to
+	CountryHeader string `json:"country_header"`
+	// Incoming metadata key client puts device fingerprint to
+	DeviceHeader string `json:"device_header"`
+
+	IPLimit        int   `json:"ip_limit"`
+	DeviceLimit    int   `json:"device_limit"`
+	VelocityWindow int64 `json:"velocity_window"` // seconds
+	VelocityScore  int   `json:"velocity_score"`
+
+	DuplicateEmailScore int `json:"duplicate_email_score"`
+	DuplicatePhoneScore int `json:"duplicate_phone_score"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Enabled:              true,
+		Thresholds:           Thresholds{Verify: 40, Hold: 80},
+		DisposableEmailScore: 50,
+		DisposableDomains:    []string{},
+		CountryMismatchScore: 20,
+		CountryHeader:        "cf-ipcountry",
+		DeviceHeader:         "x-device-id",
+		IPLimit:              3,
+		DeviceLimit:          2,
+		VelocityWindow:       86400,
+		VelocityScore:        40,
+		DuplicateEmailScore:  40,
+		DuplicatePhoneScore:  40,
+	}
+}
+
+// Pipeline builds checks enabled in config
+func (c Config) Pipeline(counter Counter, lookup DuplicateLookup) *Pipeline {
+	var checks []Check
+	if c.DisposableEmailScore > 0 {
+		checks = append(checks, NewDisposableEmailCheck(c.DisposableEmailScore, c.DisposableDomains))
+	}
+	if c.CountryMismatchScore > 0 {
+		checks = append(checks, NewCountryMismatchCheck(c.CountryMismatchScore))
+	}
+	if counter != nil && c.VelocityScore > 0 {
+		window := time.Duration(max(c.VelocityWindow, 60)) * time.Second
+		if c.IPLimit > 0 {
+			checks = append(checks, NewIPVelocityCheck(counter, c.IPLimit, window, c.VelocityScore))
+		}
+		if c.DeviceLimit > 0 {
+			checks = append(checks, NewDeviceVelocityCheck(counter, c.DeviceLimit, window, c.VelocityScore))
+		}
+	}
+	if lookup != nil {
+		if c.DuplicateEmailScore > 0 {
+			checks = append(checks, NewDuplicateEmailCheck(lookup, c.DuplicateEmailScore))
+		}
+		if c.DuplicatePhoneScore > 0 {
+			checks = append(checks, NewDuplicatePhoneCheck(lookup, c.DuplicatePhoneScore))
+		}
+	}
+	return NewPipeline(c.Thresholds, checks...)
+}
+
+const incrScript = `
+local v = redis.call("INCR", KEYS[1])
+if v == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return v
+`
+
+type redisCounter struct {
+	rdb redisdb.Client
+}
+
+// NewRedisCounter counts in redis, keys expire with the window
+func NewRedisCounter(rdb redisdb.Client) Counter {
+	return &redisCounter{rdb: rdb}
+}
+
+func (c *redisCounter) Incr(ctx context.Context, key string, window time.Duration) (int64, error) {
+	return c.rdb.Eval(ctx, incrScript, []string{key}, window.Milliseconds()).Int64()
+}
@@ -0,0 +1,138 @@
+package risk
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Stage string
+
+const (
+	StageSignup     Stage = "signup"
+	StageFirstOrder Stage = "first_order"
+)
+
+type Decision string
+
+const (
+	Approve Decision = "approve"
+	// Account must pass phone verification before ordering
+	Verify Decision = "verify"
+	// Account is locked until manual review
+	Hold Decision = "hold"
+)
+
+var decisionWeight = map[Decision]int{Approve: 0, Verify: 1, Hold: 2}
+
+// Stricter returns the most restrictive of two decisions
+func Stricter(a, b Decision) Decision {
+	if decisionWeight[b] > decisionWeight[a] {
+		return b
+	}
+	return a
+}
+
+// Input is everything known about the account at the moment of screening
+type Input struct {
+	Stage   Stage
+	Account string
+	Email   string
+	// Phone as country code followed by number, digits only
+	Phone string
+	IP    string
+	// Country of the IP as reported by edge proxy, ISO 3166 alpha-2
+	IPCountry      string
+	BillingCountry string
+	Device         string
+}
+
+type Reason struct {
+	Check  string `json:"check"`
+	Score  int    `json:"score"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Check is single screening rule, returns nil Reason if rule didn't fire
+type Check interface {
+	Name() string
+	Evaluate(ctx context.Context, in *Input) (*Reason, error)
+}
+
+type Thresholds struct {
+	// Score from which phone verification is required
+	Verify int `json:"verify"`
+	// Score from which account is held for manual review
+	Hold int `json:"hold"`
+}
+
+func (t Thresholds) Decide(score int) Decision {
+	switch {
+	case t.Hold > 0 && score >= t.Hold:
+		return Hold
+	case t.Verify > 0 && score >= t.Verify:
+		return Verify
+	}
+	return Approve
+}
+
+type Assessment struct {
+	Stage       Stage    `json:"stage"`
+	Score       int      `json:"score"`
+	Decision    Decision `json:"decision"`
+	Reasons     []Reason `json:"reasons"`
+	IP          string   `json:"ip,omitempty"`
+	Device      string   `json:"device,omitempty"`
+	EvaluatedAt int64    `json:"evaluated_at"`
+	// Checks which failed to run, screening doesn't block on them
+	Errors []string `json:"errors,omitempty"`
+}
+
+type Pipeline struct {
+	checks     []Check
+	thresholds Thresholds
+}
+
+func NewPipeline(thresholds Thresholds, checks ...Check) *Pipeline {
+	return &Pipeline{checks: checks, thresholds: thresholds}
+}
+
+// Evaluate runs all checks and sums scores of fired ones
+func (p *Pipeline) Evaluate(ctx context.Context, in *Input) *Assessment {
+	a := &Assessment{
+		Stage:       in.Stage,
+		Reasons:     []Reason{},
+		IP:          in.IP,
+		Device:      in.Device,
+		EvaluatedAt: time.Now().Unix(),
+	}
+	for _, check := range p.checks {
+		reason, err := check.Evaluate(ctx, in)
+		if err != nil {
+			a.Errors = append(a.Errors, check.Name()+": "+err.Error())
+			continue
+		}
+		if reason == nil {
+			continue
+		}
+		if reason.Check == "" {
+			reason.Check = check.Name()
+		}
+		a.Score += reason.Score
+		a.Reasons = append(a.Reasons, *reason)
+	}
+	sort.SliceStable(a.Reasons, func(i, j int) bool {
+		return a.Reasons[i].Score > a.Reasons[j].Score
+	})
+	a.Decision = p.thresholds.Decide(a.Score)
+	return a
+}
+
+func EmailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(email[at+1:])), ".")
+}
@@ -0,0 +1,100 @@
+package risk
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type memCounter map[string]int64
+
+func (c memCounter) Incr(_ context.Context, key string, _ time.Duration) (int64, error) {
+	c[key]++
+	return c[key], nil
+}
+
+type fakeLookup struct {
+	emails map[string]int
+	phones map[string]int
+	err    error
+}
+
+func (l *fakeLookup) CountByEmail(_ context.Context, email, _ string) (int, error) {
+	return l.emails[email], l.err
+}
+
+func (l *fakeLookup) CountByPhone(_ context.Context, phone, _ string) (int, error) {
+	return l.phones[phone], l.err
+}
+
+func TestThresholdsDecide(t *testing.T) {
+	th := Thresholds{Verify: 40, Hold: 80}
+	cases := map[int]Decision{0: Approve, 39: Approve, 40: Verify, 79: Verify, 80: Hold, 200: Hold}
+	for score, want := range cases {
+		if got := th.Decide(score); got != want {
+			t.Errorf("Decide(%d) = %s, want %s", score, got, want)
+		}
+	}
+	if got := (Thresholds{}).Decide(1000); got != Approve {
+		t.Errorf("zero thresholds must approve, got %s", got)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	conf := DefaultConfig()
+	lookup := &fakeLookup{emails: map[string]int{"taken@example.com": 1}, phones: map[string]int{}}
+	counter := memCounter{}
+	p := conf.Pipeline(counter, lookup)
+
+	clean := p.Evaluate(context.Background(), &Input{
+		Stage: StageSignup, Email: "user@example.com", IP: "10.0.0.1", IPCountry: "PL", BillingCountry: "Poland",
+	})
+	if clean.Decision != Approve || clean.Score != 0 || len(clean.Reasons) != 0 {
+		t.Fatalf("expected clean approve, got %+v", clean)
+	}
+
+	disposable := p.Evaluate(context.Background(), &Input{
+		Stage: StageSignup, Email: "x@eu.mailinator.com", IP: "10.0.0.2", IPCountry: "US", BillingCountry: "PL",
+	})
+	if disposable.Score != 70 || disposable.Decision != Verify {
+		t.Fatalf("expected disposable and mismatch to require verification, got %+v", disposable)
+	}
+	if disposable.Reasons[0].Check != "disposable_email" {
+		t.Fatalf("reasons must be ordered by score, got %+v", disposable.Reasons)
+	}
+
+	duplicate := p.Evaluate(context.Background(), &Input{
+		Stage: StageSignup, Email: "taken@example.com", IP: "10.0.0.3", IPCountry: "US", BillingCountry: "PL",
+		Device: "dev",
+	})
+	if duplicate.Score != 60 || duplicate.Decision != Verify {
+		t.Fatalf("unexpected assessment %+v", duplicate)
+	}
+
+	for i := 0; i < conf.IPLimit; i++ {
+		p.Evaluate(context.Background(), &Input{Stage: StageSignup, IP: "10.0.0.9"})
+	}
+	burst := p.Evaluate(context.Background(), &Input{Stage: StageSignup, IP: "10.0.0.9"})
+	if burst.Score != conf.VelocityScore {
+		t.Fatalf("expected velocity to fire, got %+v", burst)
+	}
+	other := p.Evaluate(context.Background(), &Input{Stage: StageFirstOrder, IP: "10.0.0.9"})
+	if other.Score != 0 {
+		t.Fatalf("velocity must be counted per stage, got %+v", other)
+	}
+}
+
+func TestPipeline_CheckErrorsDoNotBlock(t *testing.T) {
+	p := NewPipeline(Thresholds{Verify: 1}, NewDuplicateEmailCheck(&fakeLookup{err: errors.New("db down")}, 50))
+	a := p.Evaluate(context.Background(), &Input{Email: "a@b.c"})
+	if a.Decision != Approve || len(a.Errors) != 1 {
+		t.Fatalf("expected approve with recorded error, got %+v", a)
+	}
+}
+
+func TestStricter(t *testing.T) {
+	if Stricter(Approve, Hold) != Hold || Stricter(Hold, Verify) != Hold || Stricter(Verify, Approve) != Verify {
+		t.Fatal("unexpected ordering")
+	}
+}
@@ -0,0 +1,169 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidExpression = errors.New("invalid cron expression")
+
+var aliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type field struct {
+	min, max int
+	names    map[string]int
+}
+
+var fields = []field{
+	{0, 59, nil},
+	{0, 23, nil},
+	{1, 31, nil},
+	{1, 12, map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}},
+	// 7 is Sunday too
+	{0, 7, map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}},
+}
+
+// Cron is parsed standard 5 field expression: minute hour day-of-month month day-of-week
+type Cron struct {
+	expr   string
+	sets   [5]uint64
+	domAny bool
+	dowAny bool
+}
+
+func (c *Cron) String() string {
+	return c.expr
+}
+
+// Parse accepts numbers, names of months and weekdays, *, ranges, steps, lists and @daily-like aliases
+func Parse(expr string) (*Cron, error) {
+	spec := strings.TrimSpace(expr)
+	if a, ok := aliases[strings.ToLower(spec)]; ok {
+		spec = a
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("%w: expected %d fields, got %d", ErrInvalidExpression, len(fields), len(parts))
+	}
+	c := &Cron{expr: strings.TrimSpace(expr)}
+	for i, part := range parts {
+		set, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("%w: field %d %q: %v", ErrInvalidExpression, i+1, part, err)
+		}
+		c.sets[i] = set
+	}
+	if c.sets[4]&(1<<7) != 0 {
+		c.sets[4] |= 1
+	}
+	c.domAny = parts[2] == "*" || strings.HasPrefix(parts[2], "*/")
+	c.dowAny = parts[4] == "*" || strings.HasPrefix(parts[4], "*/")
+	return c, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%d out of range %d-%d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+func parseField(s string, f field) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", stepStr)
+			}
+		}
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = parseValue(a, f); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(b, f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("empty range %q", rng)
+			}
+		default:
+			v, err := parseValue(rng, f)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if !hasStep {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *Cron) has(i, v int) bool {
+	return c.sets[i]&(1<<v) != 0
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom, dow := c.has(2, t.Day()), c.has(4, int(t.Weekday()))
+	// As in cron, if both are restricted either matching is enough
+	if !c.domAny && !c.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns first time strictly after t expression matches, in t's location. Zero time if none within 5 years
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.has(3, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.has(1, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.has(0, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
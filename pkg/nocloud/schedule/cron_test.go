@@ -0,0 +1,54 @@
+package schedule
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := Parse(expr); !errors.Is(err, ErrInvalidExpression) {
+			t.Errorf("Parse(%q) = %v, expected invalid expression", expr, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Wednesday
+	from := time.Date(2024, 5, 15, 10, 30, 0, 0, time.UTC)
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 5, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 22 * * *", time.Date(2024, 5, 15, 22, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 5, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 3 * * sun", time.Date(2024, 5, 19, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2024, 5, 19, 3, 0, 0, 0, time.UTC)},
+		{"0 19 * * mon-fri", time.Date(2024, 5, 15, 19, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week when both are set
+		{"0 0 20 * mon", time.Date(2024, 5, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tc := range cases {
+		c, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.expr, err)
+		}
+		if got := c.Next(from); !got.Equal(tc.want) {
+			t.Errorf("Next(%q) = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestNextInLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*3600)
+	c, _ := Parse("0 2 * * *")
+	got := c.Next(time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC).In(loc))
+	if want := time.Date(2024, 5, 15, 23, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got.UTC(), want)
+	}
+}
@@ -21,6 +21,8 @@ const (
 	ACC2NS             = ACCOUNTS_COL + "2" + NAMESPACES_COL
 	ACC2CRED           = ACCOUNTS_COL + "2" + CREDENTIALS_COL
 
+	ACCOUNT_REDIRECTS_COL = "AccountRedirects"
+
 	ROOT_ACCOUNT_KEY = "0"
 )
 
@@ -33,6 +35,8 @@ const (
 	NAMESPACES_COL = "Namespaces"
 	NS2ACC         = NAMESPACES_COL + "2" + ACCOUNTS_COL
 
+	INVITATIONS_COL = "Invitations"
+
 	ROOT_NAMESPACE_KEY = "0"
 )
 
@@ -71,7 +75,20 @@ const (
 )
 
 const (
-	CONSENTS_COL = "Consents"
+	CONSENTS_COL           = "Consents"
+	DELETION_RECORDS_COL   = "DeletionRecords"
+	TAX_ID_VALIDATIONS_COL = "TaxIDValidations"
+	KYC_DOCUMENTS_COL      = "KYCDocuments"
+	BILLING_PROFILES_COL   = "BillingProfiles"
+	INSTANCE_SCHEDULES_COL = "InstanceSchedules"
+	SCHEDULE_RUNS_COL      = "ScheduleRuns"
+	INSTANCE_TRANSFERS_COL = "InstanceTransfers"
+	INSTANCE_TEMPLATES_COL = "InstanceTemplates"
+	IP_POOLS_COL           = "IPPools"
+	IP_ADDRESSES_COL       = "IPAddresses"
+	IP_HISTORY_COL         = "IPHistory"
+	INSTANCE_DRIFTS_COL    = "InstanceDrifts"
+	GC_RUNS_COL            = "GCRuns"
 )
 
 type NoCloudGraphSchema struct {
@@ -0,0 +1,184 @@
+package sessions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slntopp/nocloud-proto/sessions"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+)
+
+// Metadata is stored next to the session, since Session message has no room for it
+type Metadata struct {
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Country   string `json:"country,omitempty"`
+	City      string `json:"city,omitempty"`
+	// Credentials type used to log in
+	Method string `json:"method,omitempty"`
+	Device string `json:"device,omitempty"`
+	// Seconds of inactivity after which session is revoked by Check, 0 disables
+	IdleTimeout int64 `json:"idle_timeout,omitempty"`
+}
+
+const knownDeviceTTL = 180 * 24 * time.Hour
+
+func metadataKey(user, sid string) string {
+	return fmt.Sprintf("sessions-meta:%s:%s", user, sid)
+}
+
+// DeviceFingerprint identifies client by user agent and country, so both new browser and new location count as unknown device
+func DeviceFingerprint(userAgent, country string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(userAgent)) + "|" + strings.ToUpper(country)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func StoreMetadata(rdb redisdb.Client, user string, session *sessions.Session, meta Metadata) error {
+	if meta.Device == "" {
+		meta.Device = DeviceFingerprint(meta.UserAgent, meta.Country)
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	var ret time.Duration = 0
+	if session.Expires != nil {
+		ret = time.Until(session.Expires.AsTime())
+	}
+	return rdb.Set(context.Background(), metadataKey(user, session.GetId()), data, ret).Err()
+}
+
+// GetMetadata returns metadata of given user sessions by session ID
+func GetMetadata(rdb redisdb.Client, user string, sids ...string) (map[string]Metadata, error) {
+	result := make(map[string]Metadata, len(sids))
+	if len(sids) == 0 {
+		return result, nil
+	}
+	keys := make([]string, len(sids))
+	for i, sid := range sids {
+		keys[i] = metadataKey(user, sid)
+	}
+	data, err := rdb.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range data {
+		raw, ok := d.(string)
+		if !ok {
+			continue
+		}
+		var meta Metadata
+		if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+			return nil, fmt.Errorf("invalid metadata: %s | %v", keys[i], err)
+		}
+		result[sids[i]] = meta
+	}
+	return result, nil
+}
+
+// Known devices of the user are kept in one hash of device to last seen time, so they're never looked up by pattern
+func devicesKey(user string) string {
+	return fmt.Sprintf("sessions-devices:%s", user)
+}
+
+// rememberDeviceScript drops devices not seen for ARGV[3] seconds, stores ARGV[1] as seen at ARGV[2]
+// Returns 1 if device is new while other devices are known
+const rememberDeviceScript = `
+local cutoff = tonumber(ARGV[2]) - tonumber(ARGV[3])
+local entries = redis.call('HGETALL', KEYS[1])
+local known, others = false, 0
+for i = 1, #entries, 2 do
+	if tonumber(entries[i + 1]) < cutoff then
+		redis.call('HDEL', KEYS[1], entries[i])
+	elseif entries[i] == ARGV[1] then
+		known = true
+	else
+		others = others + 1
+	end
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+if not known and others > 0 then return 1 end
+return 0
+`
+
+// RememberDevice marks device as known for the user
+// Returns true if device wasn't seen before and user has logged in from other devices already
+func RememberDevice(rdb redisdb.Client, user, device string) (bool, error) {
+	unknown, err := rdb.Eval(context.Background(), rememberDeviceScript, []string{devicesKey(user)},
+		device, time.Now().Unix(), int64(knownDeviceTTL/time.Second)).Int()
+	if err != nil {
+		return false, err
+	}
+	return unknown == 1, nil
+}
+
+// RevokeAll revokes every session of the user except listed ones, returns IDs of revoked sessions
+func RevokeAll(rdb redisdb.Client, user string, except ...string) ([]string, error) {
+	list, err := Get(rdb, user)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []string
+	for _, session := range list {
+		if contains(except, session.GetId()) {
+			continue
+		}
+		if err := Revoke(rdb, user, session.GetId()); err != nil {
+			return revoked, err
+		}
+		revoked = append(revoked, session.GetId())
+	}
+	return revoked, nil
+}
+
+// EnforceLimit revokes oldest sessions of the user so that no more than limit are left, keep is never revoked
+func EnforceLimit(rdb redisdb.Client, user string, limit int, keep string) ([]string, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	list, err := Get(rdb, user)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) <= limit {
+		return nil, nil
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].GetCreated().AsTime().Before(list[j].GetCreated().AsTime())
+	})
+	var evicted []string
+	for _, session := range list {
+		if len(list)-len(evicted) <= limit {
+			break
+		}
+		if session.GetId() == keep {
+			continue
+		}
+		if err := Revoke(rdb, user, session.GetId()); err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, session.GetId())
+	}
+	return evicted, nil
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ForgetDevices removes devices remembered for the user
+func ForgetDevices(rdb redisdb.Client, user string) error {
+	return rdb.Del(context.Background(), devicesKey(user)).Err()
+}
@@ -2,6 +2,7 @@ package sessions
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
 	"strconv"
@@ -48,18 +49,19 @@ func Store(rdb redisdb.Client, user string, session *sessions.Session) error {
 func Check(rdb redisdb.Client, user, sid string) error {
 	key := fmt.Sprintf("sessions:%s:%s", user, sid)
 
-	cmd := rdb.Get(context.Background(), key)
-	if cmd.Err() != nil {
-		return cmd.Err()
-	}
-
-	data, err := cmd.Bytes()
+	// Session, it's metadata and last activity are read at once to check idle timeout without extra round trips
+	values, err := rdb.MGet(context.Background(), key, metadataKey(user, sid), activityKey(user, sid)).Result()
 	if err != nil {
 		return err
 	}
 
+	data, ok := values[0].(string)
+	if !ok {
+		return fmt.Errorf("session not found")
+	}
+
 	session := &sessions.Session{}
-	err = proto.Unmarshal(data, session)
+	err = proto.Unmarshal([]byte(data), session)
 
 	if err != nil {
 		return err
@@ -69,11 +71,32 @@ func Check(rdb redisdb.Client, user, sid string) error {
 		return fmt.Errorf("session expired")
 	}
 
+	var meta Metadata
+	if raw, ok := values[1].(string); ok {
+		_ = json.Unmarshal([]byte(raw), &meta)
+	}
+	if meta.IdleTimeout > 0 {
+		last := session.GetCreated().AsTime().Unix()
+		if raw, ok := values[2].(string); ok {
+			if ts, err := strconv.ParseInt(raw, 10, 64); err == nil && ts > last {
+				last = ts
+			}
+		}
+		if time.Now().Unix()-last > meta.IdleTimeout {
+			_ = Revoke(rdb, user, sid)
+			return fmt.Errorf("session idle timeout")
+		}
+	}
+
 	return nil
 }
 
+func activityKey(user, sid string) string {
+	return fmt.Sprintf("sessions-activity:%s:%s", user, sid)
+}
+
 func LogActivity(rdb redisdb.Client, user, sid string, exp int64) error {
-	return rdb.Set(context.Background(), fmt.Sprintf("sessions-activity:%s:%s", user, sid), time.Now().Unix(), time.Until(time.Unix(exp, 0))).Err()
+	return rdb.Set(context.Background(), activityKey(user, sid), time.Now().Unix(), time.Until(time.Unix(exp, 0))).Err()
 }
 
 func GetActivity(rdb redisdb.Client, user string) (map[string]*timestamppb.Timestamp, error) {
@@ -133,5 +156,5 @@ func Get(rdb redisdb.Client, user string) ([]*sessions.Session, error) {
 
 func Revoke(rdb redisdb.Client, user, sid string) error {
 	key := fmt.Sprintf("sessions:%s:%s", user, sid)
-	return rdb.Del(context.Background(), key).Err()
+	return rdb.Del(context.Background(), key, metadataKey(user, sid), activityKey(user, sid)).Err()
 }
@@ -0,0 +1,140 @@
+package sessions
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/slntopp/nocloud-proto/sessions"
+	redisdb_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func marshalSession(t *testing.T, id string, created time.Time) string {
+	data, err := proto.Marshal(&sessions.Session{Id: id, Client: "test", Created: timestamppb.New(created)})
+	require.NoError(t, err)
+	return string(data)
+}
+
+func marshalMetadata(t *testing.T, meta Metadata) string {
+	data, err := json.Marshal(meta)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestDeviceFingerprint(t *testing.T) {
+	assert.Equal(t, DeviceFingerprint("Mozilla/5.0", "de"), DeviceFingerprint(" mozilla/5.0 ", "DE"))
+	assert.NotEqual(t, DeviceFingerprint("Mozilla/5.0", "DE"), DeviceFingerprint("Mozilla/5.0", "FR"))
+	assert.Len(t, DeviceFingerprint("", ""), 16)
+}
+
+func TestCheckIdleTimeout(t *testing.T) {
+	const user, sid = "acc", "sid"
+	keys := []interface{}{"sessions:acc:sid", metadataKey(user, sid), activityKey(user, sid)}
+	session := marshalSession(t, sid, time.Now().Add(-time.Hour))
+	meta := marshalMetadata(t, Metadata{IdleTimeout: 600})
+
+	t.Run("recently active", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		activity := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+		rdb.EXPECT().MGet(mock.Anything, keys...).Return(redis.NewSliceResult([]interface{}{session, meta, activity}, nil))
+
+		assert.NoError(t, Check(rdb, user, sid))
+	})
+
+	t.Run("idle for too long", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		activity := strconv.FormatInt(time.Now().Add(-30*time.Minute).Unix(), 10)
+		rdb.EXPECT().MGet(mock.Anything, keys...).Return(redis.NewSliceResult([]interface{}{session, meta, activity}, nil))
+		rdb.EXPECT().Del(mock.Anything, keys...).Return(redis.NewIntResult(3, nil))
+
+		assert.EqualError(t, Check(rdb, user, sid), "session idle timeout")
+	})
+
+	t.Run("no activity since creation", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().MGet(mock.Anything, keys...).Return(redis.NewSliceResult([]interface{}{session, meta, nil}, nil))
+		rdb.EXPECT().Del(mock.Anything, keys...).Return(redis.NewIntResult(3, nil))
+
+		assert.Error(t, Check(rdb, user, sid))
+	})
+
+	t.Run("timeout disabled", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().MGet(mock.Anything, keys...).Return(redis.NewSliceResult([]interface{}{session, nil, nil}, nil))
+
+		assert.NoError(t, Check(rdb, user, sid))
+	})
+}
+
+func TestEnforceLimit(t *testing.T) {
+	const user = "acc"
+	now := time.Now()
+	keys := []string{"sessions:acc:a", "sessions:acc:b", "sessions:acc:c"}
+
+	rdb := redisdb_mocks.NewMockClient(t)
+	rdb.EXPECT().Keys(mock.Anything, "sessions:acc:*").Return(redis.NewStringSliceResult(keys, nil))
+	rdb.EXPECT().MGet(mock.Anything, "sessions:acc:a", "sessions:acc:b", "sessions:acc:c").Return(redis.NewSliceResult([]interface{}{
+		marshalSession(t, "a", now.Add(-3*time.Hour)),
+		marshalSession(t, "b", now.Add(-2*time.Hour)),
+		marshalSession(t, "c", now.Add(-time.Hour)),
+	}, nil))
+	rdb.EXPECT().Del(mock.Anything, "sessions:acc:b", metadataKey(user, "b"), activityKey(user, "b")).Return(redis.NewIntResult(3, nil))
+
+	// Oldest session is the current one, so the next oldest is evicted instead
+	evicted, err := EnforceLimit(rdb, user, 2, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, evicted)
+}
+
+func TestEnforceLimitDisabled(t *testing.T) {
+	rdb := redisdb_mocks.NewMockClient(t)
+
+	evicted, err := EnforceLimit(rdb, "acc", 0, "")
+	assert.NoError(t, err)
+	assert.Empty(t, evicted)
+}
+
+func TestRememberDevice(t *testing.T) {
+	ttl := int64(knownDeviceTTL / time.Second)
+	cases := map[string]struct {
+		result int64
+		isNew  bool
+	}{
+		"first or known device": {result: 0, isNew: false},
+		"another device":        {result: 1, isNew: true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rdb := redisdb_mocks.NewMockClient(t)
+			rdb.EXPECT().Eval(mock.Anything, rememberDeviceScript, []string{"sessions-devices:acc"}, "dev", mock.Anything, ttl).
+				Return(redis.NewCmdResult(tc.result, nil))
+
+			isNew, err := RememberDevice(rdb, "acc", "dev")
+			require.NoError(t, err)
+			assert.Equal(t, tc.isNew, isNew)
+		})
+	}
+
+	t.Run("redis failure", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().Eval(mock.Anything, rememberDeviceScript, []string{"sessions-devices:acc"}, "dev", mock.Anything, ttl).
+			Return(redis.NewCmdResult(nil, redis.ErrClosed))
+
+		_, err := RememberDevice(rdb, "acc", "dev")
+		assert.Error(t, err)
+	})
+}
+
+func TestForgetDevices(t *testing.T) {
+	rdb := redisdb_mocks.NewMockClient(t)
+	rdb.EXPECT().Del(mock.Anything, "sessions-devices:acc").Return(redis.NewIntResult(1, nil))
+
+	assert.NoError(t, ForgetDevices(rdb, "acc"))
+}
@@ -0,0 +1,109 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// CommandRunner runs shell command on Asterisk host, satisfied by *ssh.Client
+type CommandRunner interface {
+	RunCommand(command string) (string, error)
+}
+
+// AsteriskProvider sends messages through chan_dongle modems of Asterisk server
+type AsteriskProvider struct {
+	runner CommandRunner
+	// Path to asterisk binary, command is run with sudo
+	binary string
+	seq    atomic.Int64
+}
+
+const defaultAsteriskBinary = "/usr/sbin/asterisk"
+
+func NewAsteriskProvider(runner CommandRunner) *AsteriskProvider {
+	return &AsteriskProvider{runner: runner, binary: defaultAsteriskBinary}
+}
+
+func (p *AsteriskProvider) Name() string {
+	return "asterisk"
+}
+
+type Device struct {
+	ID    string
+	State string
+}
+
+// ParseDevices parses output of "dongle show devices"
+func ParseDevices(content string) ([]Device, error) {
+	lines := strings.Split(content, "\n")
+	if len(lines) < 2 {
+		return nil, errors.New("no data")
+	}
+	var devices []Device
+	for i, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("not enough fields on line %d", i+2)
+		}
+		devices = append(devices, Device{
+			ID:    fields[0],
+			State: strings.ToLower(fields[2]),
+		})
+	}
+	return devices, nil
+}
+
+func (p *AsteriskProvider) Send(_ context.Context, msg Message) (Result, error) {
+	to, err := NormalizeNumber(msg.To)
+	if err != nil {
+		return Result{}, err
+	}
+	// Body is passed inside single quoted shell argument
+	if strings.ContainsAny(msg.Body, "'\n\r") {
+		return Result{}, errors.New("message body contains unsupported characters")
+	}
+
+	resp, err := p.runner.RunCommand(fmt.Sprintf(`sudo %s -rx "dongle show devices"`, p.binary))
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to get available devices: %w", err)
+	}
+	devices, err := ParseDevices(resp)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to parse devices: %w", err)
+	}
+	var available string
+	for _, device := range devices {
+		if device.State == "free" {
+			available = device.ID
+			break
+		}
+	}
+	if available == "" {
+		return Result{}, errors.New("no free dongle device")
+	}
+
+	resp, err = p.runner.RunCommand(fmt.Sprintf(`sudo %s -rx 'dongle sms %s %s %s'`, p.binary, available, to, msg.Body))
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to send sms: %w, response: %s", err, resp)
+	}
+	if strings.Contains(strings.ToLower(resp), "error") {
+		return Result{}, fmt.Errorf("dongle rejected sms: %s", strings.TrimSpace(resp))
+	}
+
+	// chan_dongle only queues message and doesn't report delivery back to CLI
+	return Result{
+		Provider: p.Name(),
+		ID:       fmt.Sprintf("%s-%d", available, p.seq.Add(1)),
+		Status:   StatusQueued,
+	}, nil
+}
+
+func (p *AsteriskProvider) Status(_ context.Context, _ string) (DeliveryStatus, error) {
+	return StatusUnknown, nil
+}
@@ -0,0 +1,62 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Fake is in-memory SMSProvider for tests and development setups
+type Fake struct {
+	name string
+
+	mu       sync.Mutex
+	sent     []Message
+	statuses map[string]DeliveryStatus
+	// Err is returned by Send if set
+	Err error
+}
+
+func NewFake(name string) *Fake {
+	return &Fake{name: name, statuses: map[string]DeliveryStatus{}}
+}
+
+func (f *Fake) Name() string {
+	return f.name
+}
+
+func (f *Fake) Send(_ context.Context, msg Message) (Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return Result{}, f.Err
+	}
+	f.sent = append(f.sent, msg)
+	id := fmt.Sprintf("%d", len(f.sent))
+	f.statuses[id] = StatusSent
+	return Result{Provider: f.name, ID: id, Status: StatusSent}, nil
+}
+
+func (f *Fake) Status(_ context.Context, id string) (DeliveryStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st, ok := f.statuses[id]
+	if !ok {
+		return StatusUnknown, fmt.Errorf("message not found: %s", id)
+	}
+	return st, nil
+}
+
+// SetStatus simulates delivery report
+func (f *Fake) SetStatus(id string, st DeliveryStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[id] = st
+}
+
+// Sent returns copy of messages sent so far
+func (f *Fake) Sent() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Message(nil), f.sent...)
+}
@@ -0,0 +1,202 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HTTPConfig describes generic HTTP SMS API
+// $TO, $BODY and $ID placeholders are replaced with values escaped according to ContentType
+type HTTPConfig struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method"` // POST by default
+	Headers map[string]string `json:"headers"`
+
+	ContentType  string `json:"content_type"` // application/json by default
+	BodyTemplate string `json:"body_template"`
+
+	// Dot separated path to message ID in JSON response
+	IDField string `json:"id_field"`
+
+	// Optional delivery status endpoint, queried with GET
+	StatusURL   string `json:"status_url"`
+	StatusField string `json:"status_field"`
+	// Maps provider specific status values to DeliveryStatus
+	StatusMap map[string]DeliveryStatus `json:"status_map"`
+
+	Timeout int64 `json:"timeout"` // seconds
+}
+
+type HTTPProvider struct {
+	conf   HTTPConfig
+	client *http.Client
+}
+
+func NewHTTPProvider(conf HTTPConfig) (*HTTPProvider, error) {
+	if conf.Name == "" {
+		return nil, errors.New("http sms provider name is required")
+	}
+	if _, err := url.ParseRequestURI(conf.URL); err != nil {
+		return nil, fmt.Errorf("http sms provider %s: invalid url: %w", conf.Name, err)
+	}
+	if conf.Method == "" {
+		conf.Method = http.MethodPost
+	}
+	if conf.ContentType == "" {
+		conf.ContentType = "application/json"
+	}
+	timeout := 10 * time.Second
+	if conf.Timeout > 0 {
+		timeout = time.Duration(conf.Timeout) * time.Second
+	}
+	return &HTTPProvider{conf: conf, client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (p *HTTPProvider) Name() string {
+	return p.conf.Name
+}
+
+func (p *HTTPProvider) escapeBody(v string) string {
+	switch {
+	case strings.Contains(p.conf.ContentType, "json"):
+		b, _ := json.Marshal(v)
+		return string(b[1 : len(b)-1])
+	case strings.Contains(p.conf.ContentType, "x-www-form-urlencoded"):
+		return url.QueryEscape(v)
+	default:
+		return v
+	}
+}
+
+func replace(template string, escape func(string) string, values map[string]string) string {
+	pairs := make([]string, 0, len(values)*2)
+	for k, v := range values {
+		pairs = append(pairs, k, escape(v))
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+func (p *HTTPProvider) Send(ctx context.Context, msg Message) (Result, error) {
+	to, err := NormalizeNumber(msg.To)
+	if err != nil {
+		return Result{}, err
+	}
+	values := map[string]string{"$TO": to, "$BODY": msg.Body}
+
+	reqURL := replace(p.conf.URL, url.QueryEscape, values)
+	var body io.Reader
+	if p.conf.BodyTemplate != "" {
+		body = strings.NewReader(replace(p.conf.BodyTemplate, p.escapeBody, values))
+	}
+	req, err := http.NewRequestWithContext(ctx, p.conf.Method, reqURL, body)
+	if err != nil {
+		return Result{}, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", p.conf.ContentType)
+	}
+	for k, v := range p.conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	data, err := p.do(req)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Provider: p.Name(), Status: StatusSent}
+	if p.conf.IDField != "" {
+		id, ok := lookup(data, p.conf.IDField)
+		if !ok {
+			return Result{}, fmt.Errorf("message id is missing in response")
+		}
+		result.ID = id
+	}
+	if p.conf.StatusField != "" {
+		if st, ok := lookup(data, p.conf.StatusField); ok {
+			result.Status = p.mapStatus(st)
+		}
+	}
+	return result, nil
+}
+
+func (p *HTTPProvider) Status(ctx context.Context, id string) (DeliveryStatus, error) {
+	if p.conf.StatusURL == "" || id == "" {
+		return StatusUnknown, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, replace(p.conf.StatusURL, url.QueryEscape, map[string]string{"$ID": id}), nil)
+	if err != nil {
+		return StatusUnknown, err
+	}
+	for k, v := range p.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	data, err := p.do(req)
+	if err != nil {
+		return StatusUnknown, err
+	}
+	st, ok := lookup(data, p.conf.StatusField)
+	if !ok {
+		return StatusUnknown, nil
+	}
+	return p.mapStatus(st), nil
+}
+
+func (p *HTTPProvider) do(req *http.Request) (map[string]any, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+	data := map[string]any{}
+	// Non JSON responses are fine as long as no fields are to be read from them
+	_ = json.Unmarshal(raw, &data)
+	return data, nil
+}
+
+func (p *HTTPProvider) mapStatus(value string) DeliveryStatus {
+	if st, ok := p.conf.StatusMap[value]; ok {
+		return st
+	}
+	switch st := DeliveryStatus(strings.ToLower(value)); st {
+	case StatusQueued, StatusSent, StatusDelivered, StatusFailed:
+		return st
+	}
+	return StatusUnknown
+}
+
+// lookup reads scalar value by dot separated path
+func lookup(data map[string]any, path string) (string, bool) {
+	var cur any = data
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if cur, ok = m[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := cur.(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
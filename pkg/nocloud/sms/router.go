@@ -0,0 +1,131 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Config describes provider chains, HTTP providers are created from it and
+// providers built elsewhere (e.g. Asterisk) are passed to NewRouter directly
+type Config struct {
+	HTTP []HTTPConfig `json:"http"`
+	// Calling code prefix (digits only, e.g. "375") to provider names in failover order
+	Routes map[string][]string `json:"routes"`
+	// Providers used when no route matches, all providers in registration order if empty
+	Default []string `json:"default"`
+}
+
+// Router picks providers by destination country and fails over to the next provider on error
+// It implements SMSProvider itself, message IDs it returns are prefixed with provider name
+type Router struct {
+	providers map[string]SMSProvider
+	order     []string
+	routes    map[string][]string
+	fallback  []string
+}
+
+func NewRouter(conf Config, providers ...SMSProvider) (*Router, error) {
+	r := &Router{
+		providers: map[string]SMSProvider{},
+		routes:    map[string][]string{},
+	}
+	for _, hc := range conf.HTTP {
+		p, err := NewHTTPProvider(hc)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	for _, p := range providers {
+		if _, ok := r.providers[p.Name()]; ok {
+			return nil, fmt.Errorf("duplicate sms provider: %s", p.Name())
+		}
+		r.providers[p.Name()] = p
+		r.order = append(r.order, p.Name())
+	}
+
+	check := func(names []string) error {
+		for _, name := range names {
+			if _, ok := r.providers[name]; !ok {
+				return fmt.Errorf("unknown sms provider: %s", name)
+			}
+		}
+		return nil
+	}
+	for prefix, names := range conf.Routes {
+		if err := check(names); err != nil {
+			return nil, err
+		}
+		r.routes[strings.TrimPrefix(prefix, "+")] = names
+	}
+	if err := check(conf.Default); err != nil {
+		return nil, err
+	}
+	r.fallback = conf.Default
+	if len(r.fallback) == 0 {
+		r.fallback = r.order
+	}
+	return r, nil
+}
+
+func (r *Router) Name() string {
+	return "router"
+}
+
+// Chain returns provider names for the number, longest matching prefix wins
+func (r *Router) Chain(number string) []string {
+	digits := strings.TrimPrefix(number, "+")
+	best := -1
+	var chain []string
+	for prefix, names := range r.routes {
+		if strings.HasPrefix(digits, prefix) && len(prefix) > best {
+			best = len(prefix)
+			chain = names
+		}
+	}
+	if chain == nil {
+		return r.fallback
+	}
+	return chain
+}
+
+func (r *Router) Send(ctx context.Context, msg Message) (Result, error) {
+	to, err := NormalizeNumber(msg.To)
+	if err != nil {
+		return Result{}, err
+	}
+	msg.To = to
+
+	chain := r.Chain(to)
+	if len(chain) == 0 {
+		return Result{}, ErrNoProviders
+	}
+	sendErr := &SendError{Attempts: map[string]error{}}
+	for _, name := range chain {
+		if ctx.Err() != nil {
+			break
+		}
+		res, err := r.providers[name].Send(ctx, msg)
+		if err != nil {
+			sendErr.Attempts[name] = err
+			continue
+		}
+		res.Provider = name
+		res.ID = name + ":" + res.ID
+		return res, nil
+	}
+	return Result{}, sendErr
+}
+
+func (r *Router) Status(ctx context.Context, id string) (DeliveryStatus, error) {
+	name, providerID, ok := strings.Cut(id, ":")
+	if !ok {
+		return StatusUnknown, fmt.Errorf("malformed message id: %s", id)
+	}
+	p, ok := r.providers[name]
+	if !ok {
+		return StatusUnknown, fmt.Errorf("unknown sms provider: %s", name)
+	}
+	return p.Status(ctx, providerID)
+}
@@ -0,0 +1,69 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type DeliveryStatus string
+
+const (
+	StatusQueued    DeliveryStatus = "queued"
+	StatusSent      DeliveryStatus = "sent"
+	StatusDelivered DeliveryStatus = "delivered"
+	StatusFailed    DeliveryStatus = "failed"
+	StatusUnknown   DeliveryStatus = "unknown"
+)
+
+type Message struct {
+	// Phone number in E.164 format, e.g. +375291234567
+	To   string
+	Body string
+}
+
+type Result struct {
+	// Provider which has accepted the message
+	Provider string
+	// Message ID, unique within the provider
+	ID     string
+	Status DeliveryStatus
+}
+
+type SMSProvider interface {
+	Name() string
+	Send(ctx context.Context, msg Message) (Result, error)
+	// Status returns current delivery status of the message sent by this provider
+	Status(ctx context.Context, id string) (DeliveryStatus, error)
+}
+
+var ErrNoProviders = errors.New("no sms providers available")
+var ErrInvalidNumber = errors.New("invalid phone number")
+
+// NormalizeNumber returns number in +<digits> form
+func NormalizeNumber(number string) (string, error) {
+	digits := strings.TrimPrefix(strings.TrimSpace(number), "+")
+	if len(digits) < 5 || len(digits) > 15 {
+		return "", ErrInvalidNumber
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return "", ErrInvalidNumber
+		}
+	}
+	return "+" + digits, nil
+}
+
+// SendError is returned when every provider has failed, holds error of each attempt
+type SendError struct {
+	Attempts map[string]error
+}
+
+func (e *SendError) Error() string {
+	parts := make([]string, 0, len(e.Attempts))
+	for name, err := range e.Attempts {
+		parts = append(parts, fmt.Sprintf("%s: %v", name, err))
+	}
+	return "failed to send sms: " + strings.Join(parts, "; ")
+}
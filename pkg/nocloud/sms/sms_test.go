@@ -0,0 +1,131 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouter_FailoverAndRouting(t *testing.T) {
+	primary, backup, local := NewFake("primary"), NewFake("backup"), NewFake("local")
+	r, err := NewRouter(Config{
+		Routes:  map[string][]string{"375": {"local", "primary"}},
+		Default: []string{"primary", "backup"},
+	}, primary, backup, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := r.Send(context.Background(), Message{To: "+375291234567", Body: "code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Provider != "local" || len(local.Sent()) != 1 {
+		t.Fatalf("expected message routed to local provider, got %+v", res)
+	}
+
+	primary.Err = errors.New("down")
+	res, err = r.Send(context.Background(), Message{To: "48123456789", Body: "code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Provider != "backup" || res.ID != "backup:1" {
+		t.Fatalf("expected failover to backup, got %+v", res)
+	}
+	backup.SetStatus("1", StatusDelivered)
+	if st, err := r.Status(context.Background(), res.ID); err != nil || st != StatusDelivered {
+		t.Fatalf("unexpected status %s, err: %v", st, err)
+	}
+
+	backup.Err = errors.New("down too")
+	_, err = r.Send(context.Background(), Message{To: "48123456789", Body: "code"})
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || len(sendErr.Attempts) != 2 {
+		t.Fatalf("expected both attempts to be reported, got %v", err)
+	}
+
+	if _, err = NewRouter(Config{Default: []string{"missing"}}, primary); err == nil {
+		t.Fatal("unknown provider accepted")
+	}
+}
+
+type runner struct {
+	commands []string
+	devices  string
+}
+
+func (r *runner) RunCommand(command string) (string, error) {
+	r.commands = append(r.commands, command)
+	if strings.Contains(command, "show devices") {
+		return r.devices, nil
+	}
+	return "[dongle1] SMS queued for send with id 0x1", nil
+}
+
+func TestAsteriskProvider_Send(t *testing.T) {
+	rn := &runner{devices: "ID           Group State      RSSI Mode Submode Provider Name\n" +
+		"dongle0      0     Busy       20   0    0       MTS\n" +
+		"dongle1      0     Free       25   0    0       A1\n"}
+	p := NewAsteriskProvider(rn)
+
+	res, err := p.Send(context.Background(), Message{To: "375291234567", Body: "Code: 123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != StatusQueued || !strings.HasPrefix(res.ID, "dongle1-") {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if last := rn.commands[len(rn.commands)-1]; !strings.Contains(last, "dongle sms dongle1 +375291234567 Code: 123456") {
+		t.Fatalf("unexpected command: %s", last)
+	}
+
+	if _, err = p.Send(context.Background(), Message{To: "375291234567", Body: "'; reboot; '"}); err == nil {
+		t.Fatal("body with quotes accepted")
+	}
+	if _, err = p.Send(context.Background(), Message{To: "+37529; reboot", Body: "x"}); err == nil {
+		t.Fatal("malformed number accepted")
+	}
+}
+
+func TestHTTPProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(`{"state":"DLVRD"}`))
+			return
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["to"] != "+375291234567" || body["text"] != `say "hi"` {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"result":{"id":42}}`))
+	}))
+	defer srv.Close()
+
+	p, err := NewHTTPProvider(HTTPConfig{
+		Name:         "gw",
+		URL:          srv.URL + "/send",
+		BodyTemplate: `{"to":"$TO","text":"$BODY"}`,
+		IDField:      "result.id",
+		StatusURL:    srv.URL + "/status?id=$ID",
+		StatusField:  "state",
+		StatusMap:    map[string]DeliveryStatus{"DLVRD": StatusDelivered},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.Send(context.Background(), Message{To: "375291234567", Body: `say "hi"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != "42" {
+		t.Fatalf("unexpected id: %s", res.ID)
+	}
+	if st, err := p.Status(context.Background(), res.ID); err != nil || st != StatusDelivered {
+		t.Fatalf("unexpected status %s, err: %v", st, err)
+	}
+}
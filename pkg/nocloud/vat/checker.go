@@ -0,0 +1,218 @@
+package vat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable means registry couldn't answer, result is unknown rather than invalid
+var ErrUnavailable = errors.New("vat: validation service unavailable")
+
+type Result struct {
+	Country string `json:"country"`
+	Number  string `json:"number"`
+	Valid   bool   `json:"valid"`
+	// Registered trader data, as returned by registry
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+	// Proof of the check, returned by VIES when requester VAT number is given
+	ConsultationNumber string    `json:"consultation_number,omitempty"`
+	CheckedAt          time.Time `json:"checked_at"`
+	// Checker which produced the result, or "format" if number was rejected locally
+	Source string `json:"source"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Checker interface {
+	Name() string
+	// Check queries registry with normalized country code and number
+	Check(ctx context.Context, country, number string) (*Result, error)
+}
+
+// Check normalizes number, rejects it locally if format or checksum is wrong and queries checker otherwise
+func Check(ctx context.Context, checker Checker, country, number string) (*Result, error) {
+	country, number = Normalize(country, number)
+	if err := Validate(country, number); err != nil {
+		return &Result{
+			Country:   country,
+			Number:    number,
+			CheckedAt: time.Now(),
+			Source:    "format",
+			Error:     err.Error(),
+		}, nil
+	}
+	return checker.Check(ctx, country, number)
+}
+
+// Stub accepts every number passing local rules, for development setups and tests
+type Stub struct {
+	mu        sync.Mutex
+	overrides map[string]bool
+	// Err is returned by Check if set
+	Err error
+}
+
+func NewStub() *Stub {
+	return &Stub{overrides: map[string]bool{}}
+}
+
+func (s *Stub) Name() string {
+	return "stub"
+}
+
+// Set forces result for the number
+func (s *Stub) Set(country, number string, valid bool) {
+	country, number = Normalize(country, number)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides[country+number] = valid
+}
+
+func (s *Stub) Check(_ context.Context, country, number string) (*Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	valid, ok := s.overrides[country+number]
+	if !ok {
+		valid = Validate(country, number) == nil
+	}
+	return &Result{
+		Country:            country,
+		Number:             number,
+		Valid:              valid,
+		ConsultationNumber: "STUB-" + randomHex(8),
+		CheckedAt:          time.Now(),
+		Source:             s.Name(),
+	}, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+const DefaultViesURL = "https://ec.europa.eu/taxation_customs/vies/rest-api/check-vat-number"
+
+// ViesConfig describes VIES REST API or compatible endpoint
+type ViesConfig struct {
+	URL string `json:"url"`
+	// Own VAT number, VIES returns consultation number only if it's set
+	RequesterCountry string `json:"requester_country"`
+	RequesterNumber  string `json:"requester_number"`
+	Timeout          int64  `json:"timeout"` // seconds
+}
+
+type ViesChecker struct {
+	conf   ViesConfig
+	client *http.Client
+}
+
+func NewViesChecker(conf ViesConfig) (*ViesChecker, error) {
+	if conf.URL == "" {
+		conf.URL = DefaultViesURL
+	}
+	if _, err := url.ParseRequestURI(conf.URL); err != nil {
+		return nil, fmt.Errorf("vies: invalid url: %w", err)
+	}
+	timeout := 15 * time.Second
+	if conf.Timeout > 0 {
+		timeout = time.Duration(conf.Timeout) * time.Second
+	}
+	conf.RequesterCountry, conf.RequesterNumber = Normalize(conf.RequesterCountry, conf.RequesterNumber)
+	return &ViesChecker{conf: conf, client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (v *ViesChecker) Name() string {
+	return "vies"
+}
+
+type viesRequest struct {
+	CountryCode              string `json:"countryCode"`
+	VatNumber                string `json:"vatNumber"`
+	RequesterMemberStateCode string `json:"requesterMemberStateCode,omitempty"`
+	RequesterNumber          string `json:"requesterNumber,omitempty"`
+}
+
+type viesResponse struct {
+	Valid             bool   `json:"valid"`
+	Name              string `json:"name"`
+	Address           string `json:"address"`
+	RequestIdentifier string `json:"requestIdentifier"`
+	UserError         string `json:"userError"`
+	ErrorWrappers     []struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	} `json:"errorWrappers"`
+}
+
+func (v *ViesChecker) Check(ctx context.Context, country, number string) (*Result, error) {
+	body, _ := json.Marshal(viesRequest{
+		CountryCode:              country,
+		VatNumber:                number,
+		RequesterMemberStateCode: v.conf.RequesterCountry,
+		RequesterNumber:          v.conf.RequesterNumber,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	var r viesResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%w: malformed response (status %d)", ErrUnavailable, res.StatusCode)
+	}
+	if len(r.ErrorWrappers) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, r.ErrorWrappers[0].Error)
+	}
+	// Member state or VIES itself is down, answer says nothing about the number
+	if r.UserError != "" && r.UserError != "VALID" && r.UserError != "INVALID" {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, r.UserError)
+	}
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("%w: status %d", ErrUnavailable, res.StatusCode)
+	}
+
+	return &Result{
+		Country:            country,
+		Number:             number,
+		Valid:              r.Valid,
+		Name:               clean(r.Name),
+		Address:            clean(r.Address),
+		ConsultationNumber: r.RequestIdentifier,
+		CheckedAt:          time.Now(),
+		Source:             v.Name(),
+	}, nil
+}
+
+// VIES returns "---" when member state doesn't share trader data
+func clean(s string) string {
+	if s == "---" {
+		return ""
+	}
+	return s
+}
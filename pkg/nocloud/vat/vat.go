@@ -0,0 +1,270 @@
+package vat
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedCountry = errors.New("vat: unsupported country")
+	ErrInvalidFormat      = errors.New("vat: invalid format")
+	ErrInvalidChecksum    = errors.New("vat: invalid checksum")
+)
+
+type rule struct {
+	format *regexp.Regexp
+	// Optional, countries without published or stable algorithm are checked by format only
+	checksum func(number string) bool
+}
+
+// Rules for EU member states, keyed by VIES country code (Greece is EL)
+var rules = map[string]rule{
+	"AT": {regexp.MustCompile(`^U\d{8}$`), checkAT},
+	"BE": {regexp.MustCompile(`^[01]\d{9}$`), checkBE},
+	"BG": {regexp.MustCompile(`^\d{9,10}$`), nil},
+	"CY": {regexp.MustCompile(`^\d{8}[A-Z]$`), nil},
+	"CZ": {regexp.MustCompile(`^\d{8,10}$`), nil},
+	"DE": {regexp.MustCompile(`^\d{9}$`), checkDE},
+	"DK": {regexp.MustCompile(`^\d{8}$`), checkDK},
+	"EE": {regexp.MustCompile(`^\d{9}$`), nil},
+	"EL": {regexp.MustCompile(`^\d{9}$`), checkEL},
+	"ES": {regexp.MustCompile(`^[A-Z0-9]\d{7}[A-Z0-9]$`), nil},
+	"FI": {regexp.MustCompile(`^\d{8}$`), checkFI},
+	"FR": {regexp.MustCompile(`^[A-HJ-NP-Z0-9]{2}\d{9}$`), checkFR},
+	"HR": {regexp.MustCompile(`^\d{11}$`), nil},
+	"HU": {regexp.MustCompile(`^\d{8}$`), checkHU},
+	"IE": {regexp.MustCompile(`^(\d{7}[A-W][A-I]?|\d[A-Z+*]\d{5}[A-W])$`), nil},
+	"IT": {regexp.MustCompile(`^\d{11}$`), checkIT},
+	"LT": {regexp.MustCompile(`^(\d{9}|\d{12})$`), nil},
+	"LU": {regexp.MustCompile(`^\d{8}$`), checkLU},
+	"LV": {regexp.MustCompile(`^\d{11}$`), nil},
+	"MT": {regexp.MustCompile(`^\d{8}$`), nil},
+	"NL": {regexp.MustCompile(`^\d{9}B\d{2}$`), checkNL},
+	"PL": {regexp.MustCompile(`^\d{10}$`), checkPL},
+	"PT": {regexp.MustCompile(`^\d{9}$`), checkPT},
+	"RO": {regexp.MustCompile(`^\d{2,10}$`), nil},
+	"SE": {regexp.MustCompile(`^\d{10}01$`), checkSE},
+	"SI": {regexp.MustCompile(`^\d{8}$`), checkSI},
+	"SK": {regexp.MustCompile(`^\d{10}$`), checkSK},
+}
+
+// CountryCode maps ISO 3166 alpha-2 code to the one used in VAT numbers
+func CountryCode(country string) string {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if country == "GR" {
+		return "EL"
+	}
+	return country
+}
+
+// Normalize strips separators and country prefix from number
+func Normalize(country, number string) (string, string) {
+	country = CountryCode(country)
+	var b strings.Builder
+	for _, r := range strings.ToUpper(number) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '+' || r == '*' {
+			b.WriteRune(r)
+		}
+	}
+	number = b.String()
+	if country != "" && strings.HasPrefix(number, country) {
+		number = number[len(country):]
+	} else if country == "EL" && strings.HasPrefix(number, "GR") {
+		number = number[2:]
+	}
+	// Old Belgian numbers had 9 digits
+	if country == "BE" && len(number) == 9 {
+		number = "0" + number
+	}
+	return country, number
+}
+
+// Supported reports whether country has VAT number rules, i.e. is EU member state
+func Supported(country string) bool {
+	_, ok := rules[CountryCode(country)]
+	return ok
+}
+
+// Validate checks format and checksum of normalized number
+func Validate(country, number string) error {
+	r, ok := rules[CountryCode(country)]
+	if !ok {
+		return ErrUnsupportedCountry
+	}
+	if !r.format.MatchString(number) {
+		return ErrInvalidFormat
+	}
+	if r.checksum != nil && !r.checksum(number) {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+func digits(s string) []int {
+	d := make([]int, len(s))
+	for i, r := range s {
+		d[i] = int(r - '0')
+	}
+	return d
+}
+
+func weighted(d []int, weights ...int) int {
+	sum := 0
+	for i, w := range weights {
+		sum += d[i] * w
+	}
+	return sum
+}
+
+func luhn(s string) bool {
+	sum := 0
+	d := digits(s)
+	for i := len(d) - 1; i >= 0; i-- {
+		v := d[i]
+		if (len(d)-1-i)%2 == 1 {
+			v *= 2
+			if v > 9 {
+				v -= 9
+			}
+		}
+		sum += v
+	}
+	return sum%10 == 0
+}
+
+func checkAT(n string) bool {
+	d := digits(n[1:])
+	sum := 0
+	for i := 0; i < 7; i++ {
+		v := d[i]
+		if i%2 == 1 {
+			v *= 2
+			v = v/10 + v%10
+		}
+		sum += v
+	}
+	return (10-(sum+4)%10)%10 == d[7]
+}
+
+func checkBE(n string) bool {
+	base, _ := strconv.Atoi(n[:8])
+	check, _ := strconv.Atoi(n[8:])
+	return 97-base%97 == check
+}
+
+// ISO 7064 Mod 11,10
+func checkDE(n string) bool {
+	d := digits(n)
+	product := 10
+	for i := 0; i < 8; i++ {
+		sum := (d[i] + product) % 10
+		if sum == 0 {
+			sum = 10
+		}
+		product = (2 * sum) % 11
+	}
+	check := 11 - product
+	if check == 10 {
+		check = 0
+	}
+	return check == d[8]
+}
+
+func checkDK(n string) bool {
+	return weighted(digits(n), 2, 7, 6, 5, 4, 3, 2, 1)%11 == 0
+}
+
+func checkEL(n string) bool {
+	d := digits(n)
+	return weighted(d, 256, 128, 64, 32, 16, 8, 4, 2)%11%10 == d[8]
+}
+
+func checkFI(n string) bool {
+	return weighted(digits(n), 7, 9, 10, 5, 8, 4, 2, 1)%11 == 0
+}
+
+// Only numeric keys can be verified, alphanumeric ones are checked by format
+func checkFR(n string) bool {
+	key, err := strconv.Atoi(n[:2])
+	if err != nil {
+		return true
+	}
+	siren, _ := strconv.Atoi(n[2:])
+	return (12+3*(siren%97))%97 == key
+}
+
+func checkHU(n string) bool {
+	d := digits(n)
+	return (10-weighted(d, 9, 7, 3, 1, 9, 7, 3)%10)%10 == d[7]
+}
+
+func checkIT(n string) bool {
+	return n[:7] != "0000000" && luhn(n)
+}
+
+func checkLU(n string) bool {
+	base, _ := strconv.Atoi(n[:6])
+	check, _ := strconv.Atoi(n[6:])
+	return base%89 == check
+}
+
+// Either legacy mod 11 or ISO 7064 Mod 97,10 over the whole number with NL prefix
+func checkNL(n string) bool {
+	d := digits(n[:9])
+	if weighted(d, 9, 8, 7, 6, 5, 4, 3, 2)%11 == d[8] {
+		return true
+	}
+	rem := 0
+	for _, r := range "NL" + n {
+		var v int
+		if r >= 'A' && r <= 'Z' {
+			v = int(r-'A') + 10
+			rem = (rem*100 + v) % 97
+		} else {
+			v = int(r - '0')
+			rem = (rem*10 + v) % 97
+		}
+	}
+	return rem == 1
+}
+
+func checkPL(n string) bool {
+	d := digits(n)
+	check := weighted(d, 6, 5, 7, 2, 3, 4, 5, 6, 7) % 11
+	return check != 10 && check == d[9]
+}
+
+func checkPT(n string) bool {
+	d := digits(n)
+	check := 11 - weighted(d, 9, 8, 7, 6, 5, 4, 3, 2)%11
+	if check > 9 {
+		check = 0
+	}
+	return check == d[8]
+}
+
+func checkSE(n string) bool {
+	return luhn(n[:10])
+}
+
+func checkSI(n string) bool {
+	d := digits(n)
+	if d[0] == 0 {
+		return false
+	}
+	check := 11 - weighted(d, 8, 7, 6, 5, 4, 3, 2)%11
+	if check == 11 {
+		return false
+	}
+	if check == 10 {
+		check = 0
+	}
+	return check == d[7]
+}
+
+func checkSK(n string) bool {
+	v, _ := strconv.ParseInt(n, 10, 64)
+	return n[0] != '0' && v%11 == 0
+}
@@ -0,0 +1,126 @@
+package vat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []struct{ country, number string }{
+		{"AT", "U13585627"},
+		{"BE", "0403019261"},
+		{"DE", "136695976"},
+		{"DK", "13585628"},
+		{"GR", "094259216"},
+		{"FI", "20774740"},
+		{"FR", "40303265045"},
+		{"HU", "12892312"},
+		{"IT", "00743110157"},
+		{"LU", "15027442"},
+		{"NL", "004495445B01"},
+		{"PL", "8567346215"},
+		{"PT", "501964843"},
+		{"SE", "123456789701"},
+		{"SI", "50223054"},
+		{"SK", "2022749619"},
+	}
+	for _, tc := range valid {
+		country, number := Normalize(tc.country, tc.number)
+		if err := Validate(country, number); err != nil {
+			t.Errorf("%s %s: expected valid, got %v", tc.country, tc.number, err)
+		}
+	}
+
+	invalid := []struct {
+		country, number string
+		err             error
+	}{
+		{"DE", "136695977", ErrInvalidChecksum},
+		{"PL", "8567346216", ErrInvalidChecksum},
+		{"IT", "00743110158", ErrInvalidChecksum},
+		{"NL", "004495446B01", ErrInvalidChecksum},
+		{"DE", "12345", ErrInvalidFormat},
+		{"AT", "13585627", ErrInvalidFormat},
+		{"US", "123456789", ErrUnsupportedCountry},
+	}
+	for _, tc := range invalid {
+		country, number := Normalize(tc.country, tc.number)
+		if err := Validate(country, number); !errors.Is(err, tc.err) {
+			t.Errorf("%s %s: expected %v, got %v", tc.country, tc.number, tc.err, err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cases := []struct{ country, number, wantCountry, wantNumber string }{
+		{"de", "DE 136.695.976", "DE", "136695976"},
+		{"GR", "EL-094259216", "EL", "094259216"},
+		{"GR", "GR094259216", "EL", "094259216"},
+		{"BE", "403019261", "BE", "0403019261"},
+		{"NL", "nl004495445b01", "NL", "004495445B01"},
+	}
+	for _, tc := range cases {
+		country, number := Normalize(tc.country, tc.number)
+		if country != tc.wantCountry || number != tc.wantNumber {
+			t.Errorf("Normalize(%q, %q) = %q, %q", tc.country, tc.number, country, number)
+		}
+	}
+}
+
+func TestCheck_RejectsLocallyBeforeQuerying(t *testing.T) {
+	stub := NewStub()
+	stub.Err = errors.New("must not be called")
+
+	res, err := Check(context.Background(), stub, "DE", "136695977")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Valid || res.Source != "format" || res.Error == "" {
+		t.Fatalf("expected local rejection, got %+v", res)
+	}
+}
+
+func TestViesChecker(t *testing.T) {
+	var got viesRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		switch got.VatNumber {
+		case "136695976":
+			_, _ = w.Write([]byte(`{"valid":true,"name":"ACME GmbH","address":"---","requestIdentifier":"WAPIAAAAX1","userError":"VALID"}`))
+		case "8567346215":
+			_, _ = w.Write([]byte(`{"valid":false,"userError":"MS_UNAVAILABLE"}`))
+		default:
+			_, _ = w.Write([]byte(`{"valid":false,"userError":"INVALID"}`))
+		}
+	}))
+	defer srv.Close()
+
+	checker, err := NewViesChecker(ViesConfig{URL: srv.URL, RequesterCountry: "PL", RequesterNumber: "PL8567346215"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Check(context.Background(), checker, "DE", "DE136695976")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Valid || res.ConsultationNumber != "WAPIAAAAX1" || res.Name != "ACME GmbH" || res.Address != "" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if got.RequesterMemberStateCode != "PL" || got.RequesterNumber != "8567346215" {
+		t.Fatalf("requester not sent, got %+v", got)
+	}
+
+	if _, err = Check(context.Background(), checker, "PL", "8567346215"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+
+	res, err = Check(context.Background(), checker, "DK", "13585628")
+	if err != nil || res.Valid {
+		t.Fatalf("expected invalid result, got %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,493 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DeviceCodeGrantType is grant type of RFC 8628 device authorization grant
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+type DeviceAuthorizationStatus string
+
+const (
+	DeviceAuthorizationPending  DeviceAuthorizationStatus = "pending"
+	DeviceAuthorizationApproved DeviceAuthorizationStatus = "approved"
+	DeviceAuthorizationDenied   DeviceAuthorizationStatus = "denied"
+)
+
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ClientID   string
+
+	RequestedScopes []string
+	GrantedScopes   []string
+	Subject         string
+
+	Status       DeviceAuthorizationStatus
+	Interval     time.Duration
+	IssuedAt     time.Time
+	ExpiresAt    time.Time
+	LastPolledAt time.Time
+	Consumed     bool
+}
+
+type DeviceAuthorizationStore interface {
+	CreateDeviceAuthorization(ctx context.Context, da DeviceAuthorization) error
+	GetDeviceAuthorizationByUserCode(ctx context.Context, userCode string) (DeviceAuthorization, error)
+	// ResolveDeviceAuthorization moves pending authorization into approved or denied status
+	ResolveDeviceAuthorization(ctx context.Context, userCode, subject string, scopes []string, status DeviceAuthorizationStatus) error
+	// PollDeviceAuthorization returns authorization as it was before this poll and remembers poll time.
+	// When polled sooner than interval it raises stored interval by SlowDownStep, see RFC 8628 section 3.5
+	PollDeviceAuthorization(ctx context.Context, deviceCode string, now time.Time) (DeviceAuthorization, error)
+	// ConsumeDeviceAuthorization marks approved authorization as consumed, fails if it was consumed before
+	ConsumeDeviceAuthorization(ctx context.Context, deviceCode string) (DeviceAuthorization, error)
+}
+
+// SlowDownStep is added to device code polling interval on each slow_down error
+const SlowDownStep = 5 * time.Second
+
+// PolledTooSoon tells whether poll at now came before interval passed since previous one
+func (da DeviceAuthorization) PolledTooSoon(now time.Time) bool {
+	return !da.LastPolledAt.IsZero() && now.Sub(da.LastPolledAt.UTC()) < da.Interval
+}
+
+// Excludes vowels and look-alike characters, see RFC 8628 section 6.1
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+const userCodeLength = 8
+
+func generateUserCode() (string, error) {
+	out := make([]byte, 0, userCodeLength)
+	buf := make([]byte, userCodeLength*2)
+	for len(out) < userCodeLength {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// Reject bytes which would skew distribution
+			if int(b) >= 256-(256%len(userCodeAlphabet)) {
+				continue
+			}
+			out = append(out, userCodeAlphabet[int(b)%len(userCodeAlphabet)])
+			if len(out) == userCodeLength {
+				break
+			}
+		}
+	}
+	return formatUserCode(string(out)), nil
+}
+
+func formatUserCode(code string) string {
+	half := len(code) / 2
+	return code[:half] + "-" + code[half:]
+}
+
+// normalizeUserCode makes user input comparable with stored user code
+// Case, dashes and spaces are ignored
+func normalizeUserCode(code string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(code) {
+		if strings.ContainsRune(userCodeAlphabet, c) {
+			b.WriteRune(c)
+		}
+	}
+	if b.Len() != userCodeLength {
+		return ""
+	}
+	return formatUserCode(b.String())
+}
+
+func (s *Server) handleDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	s.setNoStoreHeaders(w)
+
+	if err := s.parseFormWithLimit(w, r); err != nil {
+		return
+	}
+
+	if strings.TrimSpace(s.cfg.DeviceVerificationURL) == "" {
+		writeJSONOAuthError(w, oauthErr("server_error", "device_verification_url is not configured", http.StatusInternalServerError))
+		return
+	}
+
+	// Devices are usually not able to keep secrets, so public clients are allowed here
+	client, err := s.authenticateClientForTokenLikeEndpoints(ctx, r, authClientOpts{
+		AllowPublic: true,
+	})
+	if err != nil {
+		writeJSONOAuthError(w, err)
+		return
+	}
+
+	if !grantAllowed(client.AllowedGrants, DeviceCodeGrantType) {
+		writeJSONOAuthError(w, oauthErr("unauthorized_client", "client is not allowed to use device_code", http.StatusBadRequest))
+		return
+	}
+
+	scopes := parseScopes(r.Form.Get("scope"))
+	if !scopesAllowed(client.AllowedScopes, scopes) {
+		writeJSONOAuthError(w, oauthErr("invalid_scope", "requested scope is not allowed for this client", http.StatusBadRequest))
+		return
+	}
+
+	deviceCode, err := randomURLSafeString(48)
+	if err != nil {
+		s.log.Error("failed to generate device code", zap.Error(err))
+		writeJSONOAuthError(w, oauthErr("server_error", "failed to generate device code", http.StatusInternalServerError))
+		return
+	}
+
+	now := time.Now().UTC()
+	da := DeviceAuthorization{
+		DeviceCode:      deviceCode,
+		ClientID:        client.ID,
+		RequestedScopes: cloneStrings(scopes),
+		Status:          DeviceAuthorizationPending,
+		Interval:        s.cfg.DevicePollInterval,
+		IssuedAt:        now,
+		ExpiresAt:       now.Add(s.cfg.DeviceCodeTTL),
+	}
+
+	// User codes are short, so collision with another pending authorization is possible
+	const attempts = 3
+	for i := 0; i < attempts; i++ {
+		da.UserCode, err = generateUserCode()
+		if err != nil {
+			break
+		}
+		if err = s.deps.Devices.CreateDeviceAuthorization(ctx, da); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		s.log.Error("failed to store device authorization", zap.Error(err))
+		writeJSONOAuthError(w, oauthErr("server_error", "failed to start device authorization", http.StatusInternalServerError))
+		return
+	}
+
+	complete, _ := url.Parse(s.cfg.DeviceVerificationURL)
+	q := complete.Query()
+	q.Set(s.cfg.DeviceUserCodeParam, da.UserCode)
+	complete.RawQuery = q.Encode()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"device_code":               da.DeviceCode,
+		"user_code":                 da.UserCode,
+		"verification_uri":          s.cfg.DeviceVerificationURL,
+		"verification_uri_complete": complete.String(),
+		"expires_in":                int64(s.cfg.DeviceCodeTTL.Seconds()),
+		"interval":                  int64(da.Interval.Seconds()),
+	})
+}
+
+type deviceInteractionRequest struct {
+	UserCode string `json:"user_code"`
+}
+
+// handleDeviceInteraction is called by verification page once user entered the code
+// It starts regular consent interaction, bound to the device authorization
+func (s *Server) handleDeviceInteraction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	s.setNoStoreHeaders(w)
+
+	if s.deps.Interactions == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "interaction store is not configured",
+		})
+		return
+	}
+
+	subject, ok, err := s.deps.Authorization.Subject(ctx, r)
+	if err != nil {
+		s.log.Error("failed to resolve subject", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "failed to resolve subject",
+		})
+		return
+	}
+	if !ok || subject == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{
+			"error": "login_required", "error_description": "user is not logged in",
+		})
+		return
+	}
+
+	var body deviceInteractionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"error": "invalid_request", "error_description": "failed to parse json body",
+		})
+		return
+	}
+	userCode := normalizeUserCode(body.UserCode)
+	if userCode == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"error": "invalid_request", "error_description": "malformed user_code",
+		})
+		return
+	}
+
+	da, err := s.deps.Devices.GetDeviceAuthorizationByUserCode(ctx, userCode)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]any{
+			"error": "not_found", "error_description": "unknown user_code",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	if da.Status != DeviceAuthorizationPending || da.ExpiresAt.UTC().Before(now) {
+		writeJSON(w, http.StatusGone, map[string]any{
+			"error": "expired_token", "error_description": "user_code expired or already used",
+		})
+		return
+	}
+
+	client, err := s.deps.Clients.GetClient(ctx, da.ClientID)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"error": "unauthorized_client", "error_description": "unknown client",
+		})
+		return
+	}
+
+	existing, err := s.deps.Authorization.ConsentedScopes(ctx, subject, client.ID)
+	if err != nil {
+		s.log.Error("failed to resolve consented scopes", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "failed to resolve consent",
+		})
+		return
+	}
+
+	itID, err := randomURLSafeString(32)
+	if err != nil {
+		s.log.Error("failed to generate interaction id", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "failed to start interaction",
+		})
+		return
+	}
+
+	expires := now.Add(s.interactionTTL())
+	if da.ExpiresAt.Before(expires) {
+		expires = da.ExpiresAt.UTC()
+	}
+	it := Interaction{
+		ID:              itID,
+		ClientID:        client.ID,
+		Subject:         subject,
+		RequestedScopes: cloneStrings(da.RequestedScopes),
+		ExistingScopes:  cloneStrings(existing),
+		CreatedAt:       now,
+		ExpiresAt:       expires,
+		DeviceUserCode:  da.UserCode,
+	}
+	if err := s.deps.Interactions.CreateInteraction(ctx, it); err != nil {
+		s.log.Error("failed to store interaction", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "failed to start interaction",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"interaction_id": itID,
+	})
+}
+
+// confirmDeviceInteraction resolves device authorization bound to consumed interaction
+// Unlike authorization code flow, there is nothing to redirect to, so result is returned as json
+func (s *Server) confirmDeviceInteraction(w http.ResponseWriter, r *http.Request, it Interaction, body confirmInteractionRequest) {
+	ctx := r.Context()
+	log := s.log.With(zap.String("interaction_id", it.ID), zap.String("client_id", it.ClientID))
+
+	now := time.Now().UTC()
+	if it.ExpiresAt.UTC().Before(now) {
+		writeJSON(w, http.StatusGone, map[string]any{
+			"error": "interaction_expired", "error_description": "interaction expired or consumed",
+		})
+		return
+	}
+
+	subject, ok, err := s.deps.Authorization.Subject(ctx, r)
+	if err != nil {
+		log.Error("failed to resolve subject", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "failed to resolve subject",
+		})
+		return
+	}
+	if !ok || subject == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{
+			"error": "login_required", "error_description": "user is not logged in",
+		})
+		return
+	}
+	if subject != it.Subject {
+		log.Warn("Subject mismatch", zap.String("expected_subject", it.Subject), zap.String("actual_subject", subject))
+		writeJSON(w, http.StatusForbidden, map[string]any{
+			"error": "access_denied", "error_description": "subject mismatch",
+		})
+		return
+	}
+
+	if s.deps.Devices == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "device authorization store is not configured",
+		})
+		return
+	}
+
+	if !body.Approve {
+		if err := s.deps.Devices.ResolveDeviceAuthorization(ctx, it.DeviceUserCode, subject, nil, DeviceAuthorizationDenied); err != nil {
+			log.Error("Failed to deny device authorization", zap.Error(err))
+			writeJSON(w, http.StatusGone, map[string]any{
+				"error": "expired_token", "error_description": "device authorization expired or already resolved",
+			})
+			return
+		}
+		log.Info("User denied device authorization", zap.String("subject", subject))
+		writeJSON(w, http.StatusOK, map[string]any{"status": DeviceAuthorizationDenied})
+		return
+	}
+
+	client, err := s.deps.Clients.GetClient(ctx, it.ClientID)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"error": "unauthorized_client", "error_description": "unknown client",
+		})
+		return
+	}
+
+	approved := uniqueStrings(body.Scopes)
+	if len(approved) == 0 {
+		approved = uniqueStrings(it.RequestedScopes)
+	}
+	if !isSubset(approved, it.RequestedScopes) || !scopesAllowed(client.AllowedScopes, approved) {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"error": "invalid_scope", "error_description": "approved scopes must be subset of requested and allowed scopes",
+		})
+		return
+	}
+
+	if err := s.deps.Authorization.SaveConsent(ctx, it.Subject, it.ClientID, unionStrings(it.ExistingScopes, approved)); err != nil {
+		log.Error("Failed to save consent", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "failed to save consent",
+		})
+		return
+	}
+
+	if err := s.deps.Devices.ResolveDeviceAuthorization(ctx, it.DeviceUserCode, subject, approved, DeviceAuthorizationApproved); err != nil {
+		log.Error("Failed to approve device authorization", zap.Error(err))
+		writeJSON(w, http.StatusGone, map[string]any{
+			"error": "expired_token", "error_description": "device authorization expired or already resolved",
+		})
+		return
+	}
+
+	log.Info("Device authorization approved", zap.String("subject", subject), zap.Strings("approved_scopes", approved))
+	writeJSON(w, http.StatusOK, map[string]any{"status": DeviceAuthorizationApproved})
+}
+
+func (s *Server) handleTokenDeviceCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	deviceCode := strings.TrimSpace(r.Form.Get("device_code"))
+	if deviceCode == "" {
+		writeJSONOAuthError(w, oauthErr("invalid_request", "missing device_code", http.StatusBadRequest))
+		return
+	}
+
+	client, err := s.authenticateClientForTokenLikeEndpoints(ctx, r, authClientOpts{
+		AllowPublic: true,
+	})
+	if err != nil {
+		writeJSONOAuthError(w, err)
+		return
+	}
+
+	if !grantAllowed(client.AllowedGrants, DeviceCodeGrantType) {
+		writeJSONOAuthError(w, oauthErr("unauthorized_client", "client is not allowed to use device_code", http.StatusBadRequest))
+		return
+	}
+
+	now := time.Now().UTC()
+	da, err := s.deps.Devices.PollDeviceAuthorization(ctx, deviceCode, now)
+	if err != nil || da.ClientID != client.ID || da.Consumed {
+		writeJSONOAuthError(w, oauthErr("invalid_grant", "invalid device_code", http.StatusBadRequest))
+		return
+	}
+
+	if da.ExpiresAt.UTC().Before(now) {
+		writeJSONOAuthError(w, oauthErr("expired_token", "device_code expired", http.StatusBadRequest))
+		return
+	}
+
+	switch da.Status {
+	case DeviceAuthorizationPending:
+		// Poll has already raised stored interval by SlowDownStep for following polls
+		if da.PolledTooSoon(now) {
+			writeJSONOAuthError(w, oauthErr("slow_down", "polling too frequently", http.StatusBadRequest))
+			return
+		}
+		writeJSONOAuthError(w, oauthErr("authorization_pending", "user has not yet completed authorization", http.StatusBadRequest))
+		return
+	case DeviceAuthorizationDenied:
+		writeJSONOAuthError(w, oauthErr("access_denied", "user denied authorization", http.StatusBadRequest))
+		return
+	case DeviceAuthorizationApproved:
+	default:
+		writeJSONOAuthError(w, oauthErr("invalid_grant", "invalid device_code", http.StatusBadRequest))
+		return
+	}
+
+	da, err = s.deps.Devices.ConsumeDeviceAuthorization(ctx, deviceCode)
+	if err != nil {
+		writeJSONOAuthError(w, oauthErr("invalid_grant", "device_code was already used", http.StatusBadRequest))
+		return
+	}
+
+	access, err := s.deps.Authorization.IssueAccessToken(s.cfg.AccessTokenTTL, client.ID, da.Subject, da.GrantedScopes)
+	if err != nil {
+		s.log.Error("failed to issue access token", zap.Error(err))
+		writeJSONOAuthError(w, oauthErr("server_error", "failed to issue access token", http.StatusInternalServerError))
+		return
+	}
+	if err := s.deps.Tokens.SaveAccessToken(ctx, access); err != nil {
+		s.log.Error("failed to store access token", zap.Error(err))
+		writeJSONOAuthError(w, oauthErr("server_error", "failed to store access token", http.StatusInternalServerError))
+		return
+	}
+
+	var refresh *RefreshToken
+	if s.issueRefreshToken() && grantAllowed(client.AllowedGrants, "refresh_token") {
+		rt, e := s.issueRefreshTokenValue(now, client.ID, da.Subject, da.GrantedScopes, "")
+		if e != nil {
+			s.log.Error("failed to issue refresh token", zap.Error(e))
+			writeJSONOAuthError(w, oauthErr("server_error", "failed to issue refresh token", http.StatusInternalServerError))
+			return
+		}
+		if e := s.deps.Tokens.SaveRefreshToken(ctx, rt); e != nil {
+			s.log.Error("failed to store refresh token", zap.Error(e))
+			writeJSONOAuthError(w, oauthErr("server_error", "failed to store refresh token", http.StatusInternalServerError))
+			return
+		}
+		refresh = &rt
+	}
+
+	writeTokenResponse(w, access, refresh)
+}
+
+// ErrDeviceAuthorizationNotFound is returned by stores when device or user code is unknown
+var ErrDeviceAuthorizationNotFound = errors.New("device authorization not found")
@@ -0,0 +1,587 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud-proto/registry"
+	"github.com/slntopp/nocloud-proto/registry/accounts"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/auth"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/slntopp/nocloud/pkg/oauth2/idp"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// NamespaceJoiner adds account to namespace, used to apply IdP group mapping
+type NamespaceJoiner interface {
+	JoinNamespace(ctx context.Context, account, namespace string, level access.Level) error
+}
+
+// IdentityLookup tells whether identity is linked to an account already, so only new ones are provisioned
+type IdentityLookup interface {
+	IdentityExists(ctx context.Context, credType, subject string) (bool, error)
+}
+
+type idpState struct {
+	StateInfo
+	Provider  string
+	RequestID string // SAML AuthnRequest ID
+	Nonce     string // OIDC nonce, must be returned in ID token
+}
+
+// Login may end on another replica, so states are kept in redis
+const (
+	idpStateTTL         = 15 * time.Minute
+	idpStateKeyTemplate = "oauth2:idp:state:%s"
+	// Accepted SAML assertions are remembered until they expire, so captured responses can't be replayed
+	samlAssertionKeyTemplate = "oauth2:idp:saml-assertion:%s:%s"
+)
+
+const popStateScript = `
+local v = redis.call('GET', KEYS[1])
+if v then redis.call('DEL', KEYS[1]) end
+return v
+`
+
+// IdentityProvidersHandler serves generic OIDC and SAML providers configured through settings
+// Unlike other handlers it reads configuration on every request, so providers can be added at runtime
+type IdentityProvidersHandler struct {
+	log          *zap.Logger
+	regClient    registry.AccountsServiceClient
+	rdb          redisdb.Client
+	signingKey   []byte
+	assertionKey []byte
+	namespaces   NamespaceJoiner
+	identities   IdentityLookup
+}
+
+func NewIdentityProvidersHandler(log *zap.Logger, regClient registry.AccountsServiceClient, rdb redisdb.Client, signingKey, assertionKey []byte, namespaces NamespaceJoiner, identities IdentityLookup) *IdentityProvidersHandler {
+	return &IdentityProvidersHandler{
+		log:          log.Named("IdentityProviders"),
+		regClient:    regClient,
+		rdb:          rdb,
+		signingKey:   signingKey,
+		assertionKey: assertionKey,
+		namespaces:   namespaces,
+		identities:   identities,
+	}
+}
+
+func (h *IdentityProvidersHandler) Setup(router *mux.Router) {
+	router.HandleFunc("/oauth/idp", h.handleList).Methods(http.MethodGet)
+	router.HandleFunc("/oauth/idp/{provider}/sign_in", h.handleStart("sign_in"))
+	router.HandleFunc("/oauth/idp/{provider}/link", h.handleStart("link"))
+	router.HandleFunc("/oauth/idp/{provider}/checkout", h.handleOIDCCheckout).Methods(http.MethodGet)
+	router.HandleFunc("/oauth/idp/{provider}/acs", h.handleSAMLACS).Methods(http.MethodPost)
+	router.HandleFunc("/oauth/idp/{provider}/metadata", h.handleSAMLMetadata).Methods(http.MethodGet)
+}
+
+func (h *IdentityProvidersHandler) settings() idp.Settings {
+	var conf idp.Settings
+	if err := sc.Fetch(idp.SettingsKey, &conf, &sc.Setting[idp.Settings]{
+		Value:       idp.DefaultSettings,
+		Description: "Upstream identity providers (generic OIDC and SAML 2.0) used to log in",
+		Level:       access.Level_ADMIN,
+	}); err != nil {
+		h.log.Error("Failed to fetch identity providers settings", zap.Error(err))
+	}
+	return conf
+}
+
+func (h *IdentityProvidersHandler) provider(r *http.Request) (string, idp.ProviderConfig, error) {
+	key := mux.Vars(r)["provider"]
+	conf, ok := h.settings().Providers[key]
+	if !ok || !conf.Enabled {
+		return "", idp.ProviderConfig{}, fmt.Errorf("identity provider %s not found", key)
+	}
+	if err := conf.Validate(key); err != nil {
+		return "", idp.ProviderConfig{}, fmt.Errorf("identity provider %s is misconfigured: %w", key, err)
+	}
+	return key, conf, nil
+}
+
+func (h *IdentityProvidersHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	var result []map[string]string
+	for key, conf := range h.settings().Providers {
+		if !conf.Enabled || conf.Validate(key) != nil {
+			continue
+		}
+		result = append(result, map[string]string{
+			"key":          key,
+			"type":         conf.Type,
+			"display_name": conf.DisplayName,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i]["key"] < result[j]["key"] })
+
+	marshal, _ := json.Marshal(result)
+	w.Write(marshal)
+}
+
+func (h *IdentityProvidersHandler) putState(ctx context.Context, state string, s *idpState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// NX keeps state of login in progress from being overwritten
+	ok, err := h.rdb.SetNX(ctx, fmt.Sprintf(idpStateKeyTemplate, state), data, idpStateTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("state is already in use")
+	}
+	return nil
+}
+
+// popState takes state out of redis, so each one is used at most once
+func (h *IdentityProvidersHandler) popState(ctx context.Context, state, provider string) (*idpState, bool) {
+	if state == "" {
+		return nil, false
+	}
+	data, err := h.rdb.Eval(ctx, popStateScript, []string{fmt.Sprintf(idpStateKeyTemplate, state)}).Text()
+	if err != nil {
+		if err != redis.Nil {
+			h.log.Error("Failed to get state", zap.Error(err))
+		}
+		return nil, false
+	}
+	var s idpState
+	if err := json.Unmarshal([]byte(data), &s); err != nil || s.Provider != provider {
+		return nil, false
+	}
+	return &s, true
+}
+
+// rememberAssertion fails if assertion was accepted before
+func (h *IdentityProvidersHandler) rememberAssertion(ctx context.Context, provider string, a idp.SAMLAssertion) error {
+	ttl := time.Until(a.NotOnOrAfter)
+	if ttl <= 0 {
+		return fmt.Errorf("assertion expired")
+	}
+	ok, err := h.rdb.SetNX(ctx, fmt.Sprintf(samlAssertionKeyTemplate, provider, a.ID), time.Now().Unix(), ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("assertion %s was already used", a.ID)
+	}
+	return nil
+}
+
+func (h *IdentityProvidersHandler) handleStart(method string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := h.log.Named(method)
+		key, conf, err := h.provider(r)
+		if err != nil {
+			log.Warn("Failed to get provider", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		state, redirect := r.FormValue("state"), r.FormValue("redirect")
+		if state == "" {
+			http.Error(w, "state is required", http.StatusBadRequest)
+			return
+		}
+
+		s := &idpState{
+			StateInfo: StateInfo{RedirectUrl: redirect, Method: method},
+			Provider:  key,
+		}
+		if method == "link" {
+			authHeaderSplit := strings.Split(r.Header.Get("Authorization"), " ")
+			if len(authHeaderSplit) != 2 || strings.ToLower(authHeaderSplit[0]) != "bearer" {
+				http.Error(w, "bearer token is required", http.StatusUnauthorized)
+				return
+			}
+			s.Token = authHeaderSplit[1]
+		}
+
+		var redirectTo string
+		switch conf.Type {
+		case idp.TypeOIDC:
+			d, err := idp.Discover(r.Context(), conf.OIDC.Issuer)
+			if err != nil {
+				log.Error("Failed to discover issuer", zap.String("provider", key), zap.Error(err))
+				http.Error(w, "identity provider is unavailable", http.StatusBadGateway)
+				return
+			}
+			if s.Nonce, err = idp.NewNonce(); err != nil {
+				log.Error("Failed to generate nonce", zap.Error(err))
+				http.Error(w, "failed to start authentication", http.StatusInternalServerError)
+				return
+			}
+			redirectTo = conf.OIDC.OAuth2Config(d).AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", s.Nonce))
+		case idp.TypeSAML:
+			redirectTo, s.RequestID, err = conf.SAML.NewAuthnRequestURL(state)
+			if err != nil {
+				log.Error("Failed to build AuthnRequest", zap.String("provider", key), zap.Error(err))
+				http.Error(w, "failed to build authentication request", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := h.putState(r.Context(), state, s); err != nil {
+			log.Error("Failed to store state", zap.Error(err))
+			http.Error(w, "failed to start authentication", http.StatusConflict)
+			return
+		}
+
+		marshal, _ := json.Marshal(map[string]string{
+			"url": redirectTo,
+		})
+		w.Write(marshal)
+	}
+}
+
+func (h *IdentityProvidersHandler) handleOIDCCheckout(w http.ResponseWriter, r *http.Request) {
+	log := h.log.Named("checkout")
+	key, conf, err := h.provider(r)
+	if err != nil || conf.Type != idp.TypeOIDC {
+		log.Warn("Failed to get provider", zap.Error(err))
+		http.Error(w, "identity provider not found", http.StatusNotFound)
+		return
+	}
+
+	state, code := r.FormValue("state"), r.FormValue("code")
+	s, ok := h.popState(r.Context(), state, key)
+	if !ok {
+		log.Debug("Unknown state", zap.String("state", state))
+		http.Error(w, "unknown state", http.StatusBadRequest)
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		h.redirectError(w, r, s, e)
+		return
+	}
+
+	ctx := r.Context()
+	d, err := idp.Discover(ctx, conf.OIDC.Issuer)
+	if err != nil {
+		log.Error("Failed to discover issuer", zap.String("provider", key), zap.Error(err))
+		h.redirectError(w, r, s, "provider_unavailable")
+		return
+	}
+	token, err := conf.OIDC.OAuth2Config(d).Exchange(ctx, code)
+	if err != nil {
+		log.Error("Failed to get token from exchange", zap.String("provider", key), zap.Error(err))
+		h.redirectError(w, r, s, "exchange_failed")
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		log.Error("Token response has no ID token", zap.String("provider", key))
+		h.redirectError(w, r, s, "invalid_id_token")
+		return
+	}
+	claims, err := idp.VerifyIDToken(ctx, d, conf.OIDC.ClientID, rawIDToken, s.Nonce)
+	if err != nil {
+		log.Error("Failed to verify ID token", zap.String("provider", key), zap.Error(err))
+		h.redirectError(w, r, s, "invalid_id_token")
+		return
+	}
+	info, err := idp.UserInfo(ctx, d, token)
+	if err != nil {
+		log.Error("Failed to get user info", zap.String("provider", key), zap.Error(err))
+		h.redirectError(w, r, s, "userinfo_failed")
+		return
+	}
+	// Userinfo only adds claims to verified ones and must be about the same user, see OpenID Connect Core 1.0, section 5.3.2
+	if info["sub"] != claims["sub"] {
+		log.Error("Userinfo subject mismatch", zap.String("provider", key))
+		h.redirectError(w, r, s, "userinfo_failed")
+		return
+	}
+	for k, v := range info {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+
+	id, err := idp.MapClaims(key, conf, claims, "")
+	if err != nil {
+		log.Error("Failed to map claims", zap.String("provider", key), zap.Error(err))
+		h.redirectError(w, r, s, "invalid_claims")
+		return
+	}
+	h.complete(w, r, conf, s, id)
+}
+
+func (h *IdentityProvidersHandler) handleSAMLACS(w http.ResponseWriter, r *http.Request) {
+	log := h.log.Named("acs")
+	key, conf, err := h.provider(r)
+	if err != nil || conf.Type != idp.TypeSAML {
+		log.Warn("Failed to get provider", zap.Error(err))
+		http.Error(w, "identity provider not found", http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	// IdP-initiated login is not supported, RelayState must hold the state of started login
+	s, ok := h.popState(r.Context(), r.PostForm.Get("RelayState"), key)
+	if !ok {
+		log.Debug("Unknown state")
+		http.Error(w, "unknown state", http.StatusBadRequest)
+		return
+	}
+
+	assertion, err := conf.SAML.ParseResponse(r.PostForm.Get("SAMLResponse"), s.RequestID, time.Now())
+	if err != nil {
+		log.Warn("Failed to verify SAML response", zap.String("provider", key), zap.Error(err))
+		h.redirectError(w, r, s, "invalid_response")
+		return
+	}
+	if err := h.rememberAssertion(r.Context(), key, assertion); err != nil {
+		log.Warn("SAML assertion rejected", zap.String("provider", key), zap.Error(err))
+		h.redirectError(w, r, s, "invalid_response")
+		return
+	}
+
+	id, err := idp.MapClaims(key, conf, assertion.Claims(), assertion.NameID)
+	if err != nil {
+		log.Error("Failed to map claims", zap.String("provider", key), zap.Error(err))
+		h.redirectError(w, r, s, "invalid_claims")
+		return
+	}
+	h.complete(w, r, conf, s, id)
+}
+
+func (h *IdentityProvidersHandler) handleSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	_, conf, err := h.provider(r)
+	if err != nil || conf.Type != idp.TypeSAML {
+		http.Error(w, "identity provider not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(conf.SAML.Metadata())
+}
+
+func (h *IdentityProvidersHandler) redirectError(w http.ResponseWriter, r *http.Request, s *idpState, code string) {
+	if s.RedirectUrl == "" {
+		http.Error(w, code, http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s?error=%s", s.RedirectUrl, url.QueryEscape(code)), http.StatusSeeOther)
+}
+
+// complete signs in or links account with verified identity
+func (h *IdentityProvidersHandler) complete(w http.ResponseWriter, r *http.Request, conf idp.ProviderConfig, s *idpState, id idp.Identity) {
+	log := h.log.With(zap.String("provider", id.Provider), zap.String("subject", id.Subject))
+	credType := idp.CredentialsType(id.Provider)
+
+	assertion, err := idp.IssueAssertion(h.assertionKey, id)
+	if err != nil {
+		log.Error("Failed to issue identity assertion", zap.Error(err))
+		h.redirectError(w, r, s, "internal")
+		return
+	}
+	creds := &accounts.Credentials{
+		Type: credType,
+		Data: []string{assertion},
+	}
+
+	rootToken, err := auth.MakeToken(schema.ROOT_ACCOUNT_KEY)
+	if err != nil {
+		log.Error("Failed create token", zap.Error(err))
+		h.redirectError(w, r, s, "internal")
+		return
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+rootToken)
+
+	if s.Method == "link" {
+		acc, err := h.accountFromToken(s.Token)
+		if err != nil {
+			log.Error("Failed to get token", zap.Error(err))
+			h.redirectError(w, r, s, "invalid_token")
+			return
+		}
+
+		resp, err := h.regClient.SetCredentials(ctx, &accounts.SetCredentialsRequest{
+			Account: acc,
+			Auth:    creds,
+		})
+		if err != nil || !resp.GetResult() {
+			log.Error("Failed set creds", zap.Error(err))
+			h.redirectError(w, r, s, "link_failed")
+			return
+		}
+		if err := h.addOAuthType(ctx, acc, credType); err != nil {
+			log.Error("Failed to update account", zap.Error(err))
+		}
+		h.applyGroups(ctx, log, conf, acc, id)
+
+		http.Redirect(w, r, fmt.Sprintf("%s?token=%s", s.RedirectUrl, s.Token), http.StatusSeeOther)
+		return
+	}
+
+	tokenRequest := &accounts.TokenRequest{
+		Auth: creds,
+		Exp:  int32(time.Now().Unix() + int64(time.Hour.Seconds()*2160)),
+	}
+	resp, err := h.regClient.Token(ctx, tokenRequest)
+	if err != nil {
+		// Only identities no account is linked to are provisioned, anything else is a failed login
+		if status.Code(err) != codes.Unauthenticated {
+			log.Error("Failed get token", zap.Error(err))
+			h.redirectError(w, r, s, "internal")
+			return
+		}
+		exists, lookupErr := h.identities.IdentityExists(ctx, credType, id.Subject)
+		if lookupErr != nil {
+			log.Error("Failed to look up identity", zap.Error(lookupErr))
+			h.redirectError(w, r, s, "internal")
+			return
+		}
+		if exists {
+			log.Info("Account linked to identity can't log in", zap.Error(err))
+			h.redirectError(w, r, s, "account_unavailable")
+			return
+		}
+		if !conf.JIT {
+			log.Info("Account not found and JIT provisioning is disabled", zap.Error(err))
+			h.redirectError(w, r, s, "account_not_found")
+			return
+		}
+
+		namespace := conf.Namespace
+		if namespace == "" {
+			namespace = schema.ROOT_NAMESPACE_KEY
+		}
+		list, _ := structpb.NewList([]interface{}{
+			credType,
+		})
+		data := &structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"oauth_types": structpb.NewListValue(list),
+				"name":        structpb.NewStringValue(id.GivenName),
+				"lastname":    structpb.NewStringValue(id.FamilyName),
+				"email":       structpb.NewStringValue(id.Email),
+			},
+		}
+		title := id.Name
+		if title == "" {
+			title = id.Subject
+		}
+		if _, err := h.regClient.Create(ctx, &accounts.CreateRequest{
+			Title:     title,
+			Namespace: namespace,
+			Data:      data,
+			Auth:      creds,
+		}); err != nil {
+			log.Error("Failed create account", zap.Error(err))
+			h.redirectError(w, r, s, "provisioning_failed")
+			return
+		}
+		log.Info("Account provisioned")
+
+		resp, err = h.regClient.Token(ctx, tokenRequest)
+		if err != nil {
+			log.Error("Failed get token", zap.Error(err))
+			h.redirectError(w, r, s, "internal")
+			return
+		}
+	}
+
+	if acc, err := h.accountFromToken(resp.GetToken()); err == nil {
+		h.applyGroups(ctx, log, conf, acc, id)
+	} else {
+		log.Error("Failed to parse issued token", zap.Error(err))
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("%s?token=%s", s.RedirectUrl, resp.GetToken()), http.StatusSeeOther)
+}
+
+func (h *IdentityProvidersHandler) accountFromToken(token string) (string, error) {
+	ncToken, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return h.signingKey, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !ncToken.Valid {
+		return "", fmt.Errorf("token is invalid")
+	}
+	claims, ok := ncToken.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", fmt.Errorf("unexpected claims")
+	}
+	acc, ok := claims[nocloud.NOCLOUD_ACCOUNT_CLAIM].(string)
+	if !ok || acc == "" {
+		return "", fmt.Errorf("token has no account")
+	}
+	return acc, nil
+}
+
+func (h *IdentityProvidersHandler) addOAuthType(ctx context.Context, acc, credType string) error {
+	get, err := h.regClient.Get(ctx, &accounts.GetRequest{
+		Uuid: acc,
+	})
+	if err != nil {
+		return err
+	}
+
+	if get.GetData() == nil {
+		get.Data = &structpb.Struct{}
+	}
+	if get.GetData().GetFields() == nil {
+		get.Data.Fields = map[string]*structpb.Value{}
+	}
+
+	current, ok := get.GetData().GetFields()["oauth_types"]
+	if !ok {
+		list, _ := structpb.NewList([]interface{}{
+			credType,
+		})
+		get.Data.Fields["oauth_types"] = structpb.NewListValue(list)
+	} else {
+		for _, v := range current.GetListValue().GetValues() {
+			if v.GetStringValue() == credType {
+				return nil
+			}
+		}
+		current.GetListValue().Values = append(current.GetListValue().GetValues(), structpb.NewStringValue(credType))
+	}
+
+	_, err = h.regClient.Update(ctx, get)
+	return err
+}
+
+// applyGroups joins account to namespaces mapped from IdP groups
+// Memberships are only added: existing ones keep their level and role, removing account from IdP group doesn't revoke access
+func (h *IdentityProvidersHandler) applyGroups(ctx context.Context, log *zap.Logger, conf idp.ProviderConfig, acc string, id idp.Identity) {
+	if h.namespaces == nil {
+		return
+	}
+	for ns, level := range idp.NamespacesFor(id.Groups, conf.Groups) {
+		if err := h.namespaces.JoinNamespace(ctx, acc, ns, access.Level(level)); err != nil {
+			log.Error("Failed to join namespace", zap.String("namespace", ns), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package idp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Identity assertions are short-lived tokens oauth2 service hands to registry as credentials data
+// They prove that upstream provider has verified the identity, since SAML has no token registry could check by itself
+const assertionAudience = "nocloud-identity-assertion"
+const assertionTTL = 2 * time.Minute
+
+func IssueAssertion(key []byte, id Identity) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"aud":   assertionAudience,
+		"idp":   id.Provider,
+		"sub":   id.Subject,
+		"email": id.Email,
+		"iat":   now.Unix(),
+		"exp":   now.Add(assertionTTL).Unix(),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(key)
+}
+
+// ParseAssertion validates identity assertion and returns provider and subject it was issued for
+func ParseAssertion(key []byte, assertion string) (provider string, subject string, err error) {
+	token, err := jwt.Parse(assertion, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", "", fmt.Errorf("invalid assertion")
+	}
+	if !claims.VerifyAudience(assertionAudience, true) {
+		return "", "", fmt.Errorf("invalid assertion audience")
+	}
+	provider, _ = claims["idp"].(string)
+	subject, _ = claims["sub"].(string)
+	if provider == "" || subject == "" {
+		return "", "", fmt.Errorf("assertion lacks provider or subject")
+	}
+	return provider, subject, nil
+}
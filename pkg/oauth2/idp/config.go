@@ -0,0 +1,242 @@
+package idp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SettingsKey is the settings key holding upstream identity providers configuration
+const SettingsKey = "identity-providers"
+
+const (
+	TypeOIDC = "oidc"
+	TypeSAML = "saml"
+)
+
+// Settings is stored in settings service under SettingsKey, so providers can be changed at runtime
+type Settings struct {
+	Providers map[string]ProviderConfig `json:"providers"`
+}
+
+type ProviderConfig struct {
+	Type        string `json:"type"` // oidc or saml
+	Enabled     bool   `json:"enabled"`
+	DisplayName string `json:"display_name"`
+
+	// Just-in-time provisioning, account is created on first login if enabled
+	JIT bool `json:"jit"`
+	// Namespace new accounts are created in, root namespace if empty
+	Namespace string `json:"namespace"`
+
+	Claims ClaimMapping `json:"claims"`
+	// Maps IdP group to namespace membership
+	Groups []GroupMapping `json:"groups"`
+
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+	SAML *SAMLConfig `json:"saml,omitempty"`
+}
+
+// ClaimMapping tells which claim (or SAML attribute) holds which account field
+type ClaimMapping struct {
+	Subject    string `json:"subject"`
+	Email      string `json:"email"`
+	Name       string `json:"name"`
+	GivenName  string `json:"given_name"`
+	FamilyName string `json:"family_name"`
+	Groups     string `json:"groups"`
+}
+
+type GroupMapping struct {
+	Group     string `json:"group"`
+	Namespace string `json:"namespace"`
+	// Access level granted to the namespace, see access.Level
+	Access int32 `json:"access"`
+}
+
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+type SAMLConfig struct {
+	// SP side
+	EntityID string `json:"entity_id"`
+	ACSURL   string `json:"acs_url"`
+
+	// IdP side
+	IdPEntityID    string `json:"idp_entity_id"`
+	IdPSSOURL      string `json:"idp_sso_url"`
+	IdPCertificate string `json:"idp_certificate"` // PEM or base64 DER
+
+	// Allowed clock skew in seconds when checking assertion conditions
+	ClockSkew int64 `json:"clock_skew"`
+}
+
+var DefaultSettings = Settings{
+	Providers: map[string]ProviderConfig{},
+}
+
+var providerKeyRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// CredentialsType returns credentials type accounts of this provider are stored with
+// Provider key can not contain dashes, since credentials type is split by them
+func CredentialsType(provider string) string {
+	return "oauth2-" + provider
+}
+
+func (c ProviderConfig) Validate(key string) error {
+	if !providerKeyRe.MatchString(key) {
+		return fmt.Errorf("provider key must match %s", providerKeyRe.String())
+	}
+	switch c.Type {
+	case TypeOIDC:
+		if c.OIDC == nil || c.OIDC.Issuer == "" || c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "" {
+			return fmt.Errorf("oidc issuer, client_id and redirect_url are required")
+		}
+	case TypeSAML:
+		if c.SAML == nil || c.SAML.EntityID == "" || c.SAML.ACSURL == "" || c.SAML.IdPSSOURL == "" || c.SAML.IdPCertificate == "" {
+			return fmt.Errorf("saml entity_id, acs_url, idp_sso_url and idp_certificate are required")
+		}
+	default:
+		return fmt.Errorf("unknown provider type: %s", c.Type)
+	}
+	return nil
+}
+
+func (m ClaimMapping) withDefaults(providerType string) ClaimMapping {
+	def := ClaimMapping{
+		Subject: "sub", Email: "email", Name: "name",
+		GivenName: "given_name", FamilyName: "family_name", Groups: "groups",
+	}
+	if providerType == TypeSAML {
+		// Subject of SAML assertion is NameID unless mapped to an attribute
+		def.Subject = ""
+	}
+	if m.Subject != "" {
+		def.Subject = m.Subject
+	}
+	if m.Email != "" {
+		def.Email = m.Email
+	}
+	if m.Name != "" {
+		def.Name = m.Name
+	}
+	if m.GivenName != "" {
+		def.GivenName = m.GivenName
+	}
+	if m.FamilyName != "" {
+		def.FamilyName = m.FamilyName
+	}
+	if m.Groups != "" {
+		def.Groups = m.Groups
+	}
+	return def
+}
+
+// Identity is a verified user identity received from upstream provider
+type Identity struct {
+	Provider   string
+	Subject    string
+	Email      string
+	Name       string
+	GivenName  string
+	FamilyName string
+	Groups     []string
+}
+
+// MapClaims builds Identity out of raw claims according to provider claim mapping
+// Claims values may be strings or lists of strings (SAML attributes are always lists)
+func MapClaims(provider string, conf ProviderConfig, claims map[string]any, nameID string) (Identity, error) {
+	m := conf.Claims.withDefaults(conf.Type)
+	id := Identity{
+		Provider:   provider,
+		Subject:    nameID,
+		Email:      claimString(claims, m.Email),
+		Name:       claimString(claims, m.Name),
+		GivenName:  claimString(claims, m.GivenName),
+		FamilyName: claimString(claims, m.FamilyName),
+		Groups:     claimStrings(claims, m.Groups),
+	}
+	if m.Subject != "" {
+		id.Subject = claimString(claims, m.Subject)
+	}
+	if id.Subject == "" {
+		return Identity{}, fmt.Errorf("subject claim is missing")
+	}
+	if id.Name == "" {
+		id.Name = strings.TrimSpace(id.GivenName + " " + id.FamilyName)
+	}
+	if id.Name == "" {
+		id.Name = id.Email
+	}
+	return id, nil
+}
+
+// NamespacesFor returns namespaces identity should be member of with access levels
+// When several groups map to one namespace, the highest level wins
+func NamespacesFor(groups []string, mapping []GroupMapping) map[string]int32 {
+	in := make(map[string]struct{}, len(groups))
+	for _, g := range groups {
+		in[g] = struct{}{}
+	}
+	result := map[string]int32{}
+	for _, m := range mapping {
+		if _, ok := in[m.Group]; !ok || m.Namespace == "" {
+			continue
+		}
+		if lvl, ok := result[m.Namespace]; !ok || m.Access > lvl {
+			result[m.Namespace] = m.Access
+		}
+	}
+	return result
+}
+
+func claimString(claims map[string]any, key string) string {
+	if key == "" {
+		return ""
+	}
+	switch v := claims[key].(type) {
+	case string:
+		return v
+	case []string:
+		if len(v) > 0 {
+			return v[0]
+		}
+	case []any:
+		if len(v) > 0 {
+			if s, ok := v[0].(string); ok {
+				return s
+			}
+		}
+	case fmt.Stringer:
+		return v.String()
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func claimStrings(claims map[string]any, key string) []string {
+	if key == "" {
+		return nil
+	}
+	switch v := claims[key].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
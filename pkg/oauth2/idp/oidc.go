@@ -0,0 +1,326 @@
+package idp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+// Discovery is a subset of OpenID Provider Metadata
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+const discoveryTTL = time.Hour
+
+type cachedDiscovery struct {
+	d       Discovery
+	fetched time.Time
+}
+
+var (
+	discoveryMu    sync.Mutex
+	discoveryCache = map[string]cachedDiscovery{}
+)
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// Discover fetches issuer metadata from /.well-known/openid-configuration
+// Results are cached for an hour
+func Discover(ctx context.Context, issuer string) (Discovery, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	discoveryMu.Lock()
+	c, ok := discoveryCache[issuer]
+	discoveryMu.Unlock()
+	if ok && time.Since(c.fetched) < discoveryTTL {
+		return c.d, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return Discovery{}, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Discovery{}, fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Discovery{}, fmt.Errorf("discovery document request failed with status %d", resp.StatusCode)
+	}
+
+	var d Discovery
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&d); err != nil {
+		return Discovery{}, fmt.Errorf("failed to decode discovery document: %w", err)
+	}
+	// OpenID Connect Discovery 1.0, section 4.3
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return Discovery{}, fmt.Errorf("issuer mismatch: expected %s, got %s", issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.UserInfoEndpoint == "" || d.JWKSURI == "" {
+		return Discovery{}, fmt.Errorf("discovery document lacks required endpoints")
+	}
+
+	discoveryMu.Lock()
+	discoveryCache[issuer] = cachedDiscovery{d: d, fetched: time.Now()}
+	discoveryMu.Unlock()
+	return d, nil
+}
+
+// OAuth2Config builds authorization code flow config out of discovered metadata
+func (c *OIDCConfig) OAuth2Config(d Discovery) *oauth2.Config {
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	return &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  c.RedirectURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthorizationEndpoint,
+			TokenURL: d.TokenEndpoint,
+		},
+	}
+}
+
+// UserInfo requests claims of the token owner from userinfo endpoint
+func UserInfo(ctx context.Context, d Discovery, token *oauth2.Token) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.UserInfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	token.SetAuthHeader(req)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request userinfo: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo request failed with status %d", resp.StatusCode)
+	}
+
+	claims := map[string]any{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode userinfo: %w", err)
+	}
+	return claims, nil
+}
+
+// JSONWebKey is a public key of JWK Set, only RSA and EC keys are supported
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	N string `json:"n"`
+	E string `json:"e"`
+
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// PublicKey decodes key material, returns *rsa.PublicKey or *ecdsa.PublicKey
+func (k JSONWebKey) PublicKey() (any, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 2 || exp.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+type cachedJWKS struct {
+	keys    []JSONWebKey
+	fetched time.Time
+}
+
+var (
+	jwksMu    sync.Mutex
+	jwksCache = map[string]cachedJWKS{}
+)
+
+// JWKS fetches signing keys of the issuer, results are cached like discovery documents
+// Cache is bypassed with refresh, so rotated keys are picked up
+func JWKS(ctx context.Context, uri string, refresh bool) ([]JSONWebKey, error) {
+	jwksMu.Lock()
+	c, ok := jwksCache[uri]
+	jwksMu.Unlock()
+	if ok && !refresh && time.Since(c.fetched) < discoveryTTL {
+		return c.keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request failed with status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	jwksMu.Lock()
+	jwksCache[uri] = cachedJWKS{keys: set.Keys, fetched: time.Now()}
+	jwksMu.Unlock()
+	return set.Keys, nil
+}
+
+// NewNonce generates value binding ID token to the login it was requested for
+func NewNonce() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// idTokenAlgs are accepted ID token signing algorithms, symmetric ones aren't as JWKS holds public keys only
+var idTokenAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// VerifyIDToken checks ID token signature against issuer JWKS and its claims, see OpenID Connect Core 1.0, section 3.1.3.7
+// Returns verified claims
+func VerifyIDToken(ctx context.Context, d Discovery, clientID, raw, nonce string) (map[string]any, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(idTokenAlgs))
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := findKey(ctx, d.JWKSURI, kid, t.Method.Alg(), false)
+		if err != nil {
+			// Key might have been rotated since JWKS was cached
+			key, err = findKey(ctx, d.JWKSURI, kid, t.Method.Alg(), true)
+		}
+		return key, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != strings.TrimSuffix(d.Issuer, "/") {
+		return nil, fmt.Errorf("ID token issuer mismatch: %s", iss)
+	}
+	if !claims.VerifyAudience(clientID, true) {
+		return nil, fmt.Errorf("ID token is not issued to %s", clientID)
+	}
+	if aud, ok := claims["aud"].([]any); ok && len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != clientID {
+			return nil, fmt.Errorf("ID token authorized party mismatch: %s", azp)
+		}
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("ID token has no expiration")
+	}
+	if got, _ := claims["nonce"].(string); nonce == "" || got != nonce {
+		return nil, fmt.Errorf("ID token nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func findKey(ctx context.Context, uri, kid, alg string, refresh bool) (any, error) {
+	keys, err := JWKS(ctx, uri, refresh)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if kid != "" && k.Kid != kid {
+			continue
+		}
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+		key, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if alg[0] != 'R' && alg[0] != 'P' {
+				continue
+			}
+		case *ecdsa.PublicKey:
+			if alg[0] != 'E' {
+				continue
+			}
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key %q found", kid)
+}
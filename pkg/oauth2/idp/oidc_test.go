@@ -0,0 +1,163 @@
+package idp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testIssuer = "https://idp.example.com"
+const testClientID = "nocloud"
+
+func rsaJWK(kid string, key *rsa.PublicKey) JSONWebKey {
+	return JSONWebKey{
+		Kty: "RSA", Kid: kid, Use: "sig",
+		N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) JSONWebKey {
+	return JSONWebKey{
+		Kty: "EC", Kid: kid, Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y: base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func testJWKS(t *testing.T, keys ...JSONWebKey) Discovery {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(srv.Close)
+	return Discovery{Issuer: testIssuer, JWKSURI: srv.URL}
+}
+
+func testClaims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   testIssuer,
+		"sub":   "user-42",
+		"aud":   testClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+		"email": "user@example.com",
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(method, claims)
+	tok.Header["kid"] = kid
+	raw, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := testJWKS(t, rsaJWK("k1", &key.PublicKey))
+	ctx := context.Background()
+
+	claims, err := VerifyIDToken(ctx, d, testClientID, signToken(t, jwt.SigningMethodRS256, "k1", key, testClaims("n-1")), "n-1")
+	if err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if claims["sub"] != "user-42" || claims["email"] != "user@example.com" {
+		t.Fatalf("unexpected claims: %v", claims)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]func() (string, string){
+		"nonce mismatch": func() (string, string) {
+			return signToken(t, jwt.SigningMethodRS256, "k1", key, testClaims("n-1")), "n-2"
+		},
+		"no nonce": func() (string, string) {
+			c := testClaims("")
+			delete(c, "nonce")
+			return signToken(t, jwt.SigningMethodRS256, "k1", key, c), ""
+		},
+		"foreign audience": func() (string, string) {
+			c := testClaims("n-1")
+			c["aud"] = "someone-else"
+			return signToken(t, jwt.SigningMethodRS256, "k1", key, c), "n-1"
+		},
+		"foreign authorized party": func() (string, string) {
+			c := testClaims("n-1")
+			c["aud"] = []string{testClientID, "someone-else"}
+			c["azp"] = "someone-else"
+			return signToken(t, jwt.SigningMethodRS256, "k1", key, c), "n-1"
+		},
+		"issuer mismatch": func() (string, string) {
+			c := testClaims("n-1")
+			c["iss"] = "https://evil.example.com"
+			return signToken(t, jwt.SigningMethodRS256, "k1", key, c), "n-1"
+		},
+		"expired": func() (string, string) {
+			c := testClaims("n-1")
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+			return signToken(t, jwt.SigningMethodRS256, "k1", key, c), "n-1"
+		},
+		"signed by other key": func() (string, string) {
+			return signToken(t, jwt.SigningMethodRS256, "k1", other, testClaims("n-1")), "n-1"
+		},
+		"unknown key id": func() (string, string) {
+			return signToken(t, jwt.SigningMethodRS256, "k2", key, testClaims("n-1")), "n-1"
+		},
+		"symmetric algorithm": func() (string, string) {
+			return signToken(t, jwt.SigningMethodHS256, "k1", []byte("secret"), testClaims("n-1")), "n-1"
+		},
+		"tampered payload": func() (string, string) {
+			raw := signToken(t, jwt.SigningMethodRS256, "k1", key, testClaims("n-1"))
+			parts := strings.Split(raw, ".")
+			c := testClaims("n-1")
+			c["sub"] = "admin"
+			payload, _ := json.Marshal(c)
+			parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+			return strings.Join(parts, "."), "n-1"
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			raw, nonce := tc()
+			if _, err := VerifyIDToken(ctx, d, testClientID, raw, nonce); err == nil {
+				t.Fatal("token accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenEC(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := testJWKS(t, ecJWK("ec", &key.PublicKey))
+
+	raw := signToken(t, jwt.SigningMethodES256, "ec", key, testClaims("n-1"))
+	if _, err := VerifyIDToken(context.Background(), d, testClientID, raw, "n-1"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	nsSAMLP = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsSAML  = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	samlStatusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	bindingRedirect   = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingPOST       = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+)
+
+const defaultClockSkew = 90 * time.Second
+
+// NewAuthnRequestURL builds HTTP-Redirect binding URL of AuthnRequest
+// Returned request ID must be checked against InResponseTo of the response
+func (c *SAMLConfig) NewAuthnRequestURL(relayState string) (redirect string, requestID string, err error) {
+	idBytes := make([]byte, 20)
+	if _, err = rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	// IDs must not start with a digit, see xsd:ID
+	requestID = "id-" + hex.EncodeToString(idBytes)
+
+	var doc bytes.Buffer
+	doc.WriteString(`<samlp:AuthnRequest xmlns:samlp="` + nsSAMLP + `" xmlns:saml="` + nsSAML + `"`)
+	doc.WriteString(` ID="` + requestID + `" Version="2.0"`)
+	doc.WriteString(` IssueInstant="` + time.Now().UTC().Format(time.RFC3339) + `"`)
+	doc.WriteString(` Destination="` + xmlEscape(c.IdPSSOURL) + `"`)
+	doc.WriteString(` ProtocolBinding="` + bindingPOST + `"`)
+	doc.WriteString(` AssertionConsumerServiceURL="` + xmlEscape(c.ACSURL) + `">`)
+	doc.WriteString(`<saml:Issuer>` + xmlEscape(c.EntityID) + `</saml:Issuer>`)
+	doc.WriteString(`<samlp:NameIDPolicy AllowCreate="true"/>`)
+	doc.WriteString(`</samlp:AuthnRequest>`)
+
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err = fw.Write(doc.Bytes()); err != nil {
+		return "", "", err
+	}
+	if err = fw.Close(); err != nil {
+		return "", "", err
+	}
+
+	u, err := url.Parse(c.IdPSSOURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid idp_sso_url: %w", err)
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if relayState != "" {
+		q.Set("RelayState", relayState)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), requestID, nil
+}
+
+// Metadata renders SP metadata document for IdP administrators
+func (c *SAMLConfig) Metadata() []byte {
+	var doc bytes.Buffer
+	doc.WriteString(xml.Header)
+	doc.WriteString(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="` + xmlEscape(c.EntityID) + `">`)
+	doc.WriteString(`<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="` + nsSAMLP + `">`)
+	doc.WriteString(`<md:NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified</md:NameIDFormat>`)
+	doc.WriteString(`<md:AssertionConsumerService Binding="` + bindingPOST + `" Location="` + xmlEscape(c.ACSURL) + `" index="0" isDefault="true"/>`)
+	doc.WriteString(`</md:SPSSODescriptor>`)
+	doc.WriteString(`</md:EntityDescriptor>`)
+	return doc.Bytes()
+}
+
+// SAMLAssertion holds data of verified assertion
+type SAMLAssertion struct {
+	// ID of assertion, same assertion must not be accepted twice
+	ID         string
+	Issuer     string
+	NameID     string
+	Attributes map[string][]string
+	// Time assertion can't be used after, replay protection must hold its ID until then
+	NotOnOrAfter time.Time
+}
+
+// Claims converts attributes to claims map used by MapClaims
+func (a SAMLAssertion) Claims() map[string]any {
+	claims := make(map[string]any, len(a.Attributes))
+	for k, v := range a.Attributes {
+		list := make([]any, len(v))
+		for i := range v {
+			list[i] = v[i]
+		}
+		claims[k] = list
+	}
+	return claims
+}
+
+// ParseResponse verifies base64 encoded SAMLResponse received through HTTP-POST binding
+// Either the Response or the Assertion must be signed by IdP certificate
+// Only data covered by a verified signature is returned
+func (c *SAMLConfig) ParseResponse(encoded string, expectedRequestID string, now time.Time) (SAMLAssertion, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return SAMLAssertion{}, fmt.Errorf("malformed SAMLResponse encoding: %w", err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return SAMLAssertion{}, fmt.Errorf("malformed SAMLResponse: %w", err)
+	}
+	root := doc.Root()
+	if root == nil || !is(root, nsSAMLP, "Response") {
+		return SAMLAssertion{}, errors.New("SAMLResponse root must be samlp:Response")
+	}
+
+	// Duplicate IDs make it possible to wrap signed content into another document
+	ids := map[string]int{}
+	for _, el := range append(root.FindElements(".//*"), root) {
+		if id := el.SelectAttrValue("ID", ""); id != "" {
+			ids[id]++
+		}
+	}
+	for id, count := range ids {
+		if count > 1 {
+			return SAMLAssertion{}, fmt.Errorf("duplicate ID: %s", id)
+		}
+	}
+
+	cert, err := ParseCertificate(c.IdPCertificate)
+	if err != nil {
+		return SAMLAssertion{}, err
+	}
+	validation := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{cert},
+	})
+	validation.Clock = dsig.NewFakeClockAt(now)
+
+	if child(root, nsSAML, "EncryptedAssertion") != nil {
+		return SAMLAssertion{}, errors.New("encrypted assertions are not supported")
+	}
+	if len(children(root, nsSAML, "Assertion")) != 1 {
+		return SAMLAssertion{}, errors.New("exactly one assertion expected")
+	}
+
+	// From here on only elements returned by validation are read, they hold nothing but signed content
+	responseSigned := child(root, dsig.Namespace, dsig.SignatureTag) != nil
+	if responseSigned {
+		if root, err = validation.Validate(root); err != nil {
+			return SAMLAssertion{}, fmt.Errorf("response signature: %w", err)
+		}
+	}
+	assertion := child(root, nsSAML, "Assertion")
+	if assertion == nil {
+		return SAMLAssertion{}, errors.New("assertion is not covered by response signature")
+	}
+	if child(assertion, dsig.Namespace, dsig.SignatureTag) != nil {
+		if assertion, err = validation.Validate(assertion); err != nil {
+			return SAMLAssertion{}, fmt.Errorf("assertion signature: %w", err)
+		}
+	} else if !responseSigned {
+		return SAMLAssertion{}, errors.New("neither response nor assertion is signed")
+	}
+
+	status := child(root, nsSAMLP, "Status")
+	if status == nil {
+		return SAMLAssertion{}, errors.New("response status is missing")
+	}
+	if code := child(status, nsSAMLP, "StatusCode"); code == nil || code.SelectAttrValue("Value", "") != samlStatusSuccess {
+		return SAMLAssertion{}, errors.New("authentication was not successful")
+	}
+	if dest := root.SelectAttrValue("Destination", ""); dest != "" && dest != c.ACSURL {
+		return SAMLAssertion{}, errors.New("response destination mismatch")
+	}
+	if irt := root.SelectAttrValue("InResponseTo", ""); expectedRequestID != "" && irt != "" && irt != expectedRequestID {
+		return SAMLAssertion{}, errors.New("response InResponseTo mismatch")
+	}
+
+	skew := defaultClockSkew
+	if c.ClockSkew > 0 {
+		skew = time.Duration(c.ClockSkew) * time.Second
+	}
+
+	id := assertion.SelectAttrValue("ID", "")
+	if id == "" {
+		return SAMLAssertion{}, errors.New("assertion ID is missing")
+	}
+	issuer := child(assertion, nsSAML, "Issuer")
+	if issuer == nil {
+		return SAMLAssertion{}, errors.New("assertion issuer is missing")
+	}
+	if c.IdPEntityID != "" && strings.TrimSpace(issuer.Text()) != c.IdPEntityID {
+		return SAMLAssertion{}, errors.New("assertion issuer mismatch")
+	}
+
+	subject := child(assertion, nsSAML, "Subject")
+	if subject == nil {
+		return SAMLAssertion{}, errors.New("assertion subject is missing")
+	}
+	nameID := child(subject, nsSAML, "NameID")
+	if nameID == nil || strings.TrimSpace(nameID.Text()) == "" {
+		return SAMLAssertion{}, errors.New("assertion NameID is missing")
+	}
+	notOnOrAfter, err := checkSubjectConfirmation(subject, c.ACSURL, expectedRequestID, now, skew)
+	if err != nil {
+		return SAMLAssertion{}, err
+	}
+
+	if conditions := child(assertion, nsSAML, "Conditions"); conditions != nil {
+		until, err := checkTimeWindow(conditions.SelectAttrValue("NotBefore", ""), conditions.SelectAttrValue("NotOnOrAfter", ""), now, skew)
+		if err != nil {
+			return SAMLAssertion{}, fmt.Errorf("conditions: %w", err)
+		}
+		if !until.IsZero() && until.Before(notOnOrAfter) {
+			notOnOrAfter = until
+		}
+		for _, ar := range children(conditions, nsSAML, "AudienceRestriction") {
+			matched := false
+			for _, aud := range children(ar, nsSAML, "Audience") {
+				if strings.TrimSpace(aud.Text()) == c.EntityID {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return SAMLAssertion{}, errors.New("assertion audience mismatch")
+			}
+		}
+	}
+
+	result := SAMLAssertion{
+		ID:           id,
+		Issuer:       strings.TrimSpace(issuer.Text()),
+		NameID:       strings.TrimSpace(nameID.Text()),
+		Attributes:   map[string][]string{},
+		NotOnOrAfter: notOnOrAfter.Add(skew),
+	}
+	for _, st := range children(assertion, nsSAML, "AttributeStatement") {
+		for _, attr := range children(st, nsSAML, "Attribute") {
+			name := attr.SelectAttrValue("Name", "")
+			for _, v := range children(attr, nsSAML, "AttributeValue") {
+				result.Attributes[name] = append(result.Attributes[name], strings.TrimSpace(v.Text()))
+			}
+			if fn := attr.SelectAttrValue("FriendlyName", ""); fn != "" && fn != name {
+				result.Attributes[fn] = result.Attributes[name]
+			}
+		}
+	}
+	return result, nil
+}
+
+// checkSubjectConfirmation returns NotOnOrAfter of first valid bearer confirmation, bearer assertions must have one
+func checkSubjectConfirmation(subject *etree.Element, acs, requestID string, now time.Time, skew time.Duration) (time.Time, error) {
+	for _, sc := range children(subject, nsSAML, "SubjectConfirmation") {
+		if sc.SelectAttrValue("Method", "") != "urn:oasis:names:tc:SAML:2.0:cm:bearer" {
+			continue
+		}
+		data := child(sc, nsSAML, "SubjectConfirmationData")
+		if data == nil {
+			continue
+		}
+		if r := data.SelectAttrValue("Recipient", ""); r != "" && r != acs {
+			continue
+		}
+		if irt := data.SelectAttrValue("InResponseTo", ""); requestID != "" && irt != "" && irt != requestID {
+			continue
+		}
+		until, err := checkTimeWindow(data.SelectAttrValue("NotBefore", ""), data.SelectAttrValue("NotOnOrAfter", ""), now, skew)
+		if err != nil || until.IsZero() {
+			continue
+		}
+		return until, nil
+	}
+	return time.Time{}, errors.New("no valid bearer subject confirmation")
+}
+
+// checkTimeWindow returns parsed NotOnOrAfter, zero if it's not set
+func checkTimeWindow(notBefore, notOnOrAfter string, now time.Time, skew time.Duration) (time.Time, error) {
+	if notBefore != "" {
+		t, err := time.Parse(time.RFC3339, notBefore)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("malformed NotBefore: %w", err)
+		}
+		if now.Add(skew).Before(t) {
+			return time.Time{}, errors.New("not yet valid")
+		}
+	}
+	if notOnOrAfter == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, notOnOrAfter)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed NotOnOrAfter: %w", err)
+	}
+	if !now.Add(-skew).Before(t) {
+		return time.Time{}, errors.New("expired")
+	}
+	return t, nil
+}
+
+func is(el *etree.Element, ns, tag string) bool {
+	return el.Tag == tag && el.NamespaceURI() == ns
+}
+
+func child(el *etree.Element, ns, tag string) *etree.Element {
+	for _, c := range el.ChildElements() {
+		if is(c, ns, tag) {
+			return c
+		}
+	}
+	return nil
+}
+
+func children(el *etree.Element, ns, tag string) []*etree.Element {
+	var res []*etree.Element
+	for _, c := range el.ChildElements() {
+		if is(c, ns, tag) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// ParseCertificate accepts PEM or bare base64 DER certificate, as found in IdP metadata
+func ParseCertificate(data string) (*x509.Certificate, error) {
+	data = strings.TrimSpace(data)
+	if block, _ := pem.Decode([]byte(data)); block != nil {
+		return x509.ParseCertificate(block.Bytes)
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+	if err != nil {
+		return nil, fmt.Errorf("certificate is neither PEM nor base64 DER: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,200 @@
+package idp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const testACS = "https://app.example.com/oauth/idp/corp/acs"
+const testSP = "https://app.example.com/saml/corp"
+
+type testKeyStore struct {
+	key  *rsa.PrivateKey
+	cert []byte
+}
+
+func (ks *testKeyStore) GetKeyPair() (*rsa.PrivateKey, []byte, error) {
+	return ks.key, ks.cert, nil
+}
+
+func testCertificate(t *testing.T) (*testKeyStore, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeyStore{key: key, cert: der}, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func testAssertion(now time.Time, email string) string {
+	nb := now.Add(-time.Minute).UTC().Format(time.RFC3339)
+	na := now.Add(5 * time.Minute).UTC().Format(time.RFC3339)
+	return `<saml:Assertion xmlns:saml="` + nsSAML + `" ID="a1" Version="2.0" IssueInstant="` + nb + `">` +
+		`<saml:Issuer>https://idp.example.com</saml:Issuer>` +
+		`SIGNATURE` +
+		`<saml:Subject><saml:NameID>user-42</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">` +
+		`<saml:SubjectConfirmationData InResponseTo="req-1" Recipient="` + testACS + `" NotOnOrAfter="` + na + `"/>` +
+		`</saml:SubjectConfirmation></saml:Subject>` +
+		`<saml:Conditions NotBefore="` + nb + `" NotOnOrAfter="` + na + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + testSP + `</saml:Audience></saml:AudienceRestriction>` +
+		`</saml:Conditions>` +
+		`<saml:AttributeStatement>` +
+		`<saml:Attribute Name="email"><saml:AttributeValue>` + email + `</saml:AttributeValue></saml:Attribute>` +
+		`<saml:Attribute Name="groups"><saml:AttributeValue>admins</saml:AttributeValue><saml:AttributeValue>devs</saml:AttributeValue></saml:Attribute>` +
+		`</saml:AttributeStatement>` +
+		`</saml:Assertion>`
+}
+
+// signAssertion produces enveloped signature of root element the way IdPs do, with exclusive canonicalization
+func signAssertion(t *testing.T, ks *testKeyStore, assertion string) string {
+	t.Helper()
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(strings.Replace(assertion, "SIGNATURE", "", 1)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := dsig.NewDefaultSigningContext(ks)
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signed, err := ctx.SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := etree.NewDocument()
+	out.SetRoot(signed)
+	res, err := out.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func testResponse(assertion string) string {
+	return base64.StdEncoding.EncodeToString([]byte(
+		`<samlp:Response xmlns:samlp="` + nsSAMLP + `" ID="r1" Version="2.0" InResponseTo="req-1" Destination="` + testACS + `">` +
+			`<samlp:Status><samlp:StatusCode Value="` + samlStatusSuccess + `"/></samlp:Status>` +
+			assertion +
+			`</samlp:Response>`))
+}
+
+func TestParseResponse(t *testing.T) {
+	ks, cert := testCertificate(t)
+	conf := &SAMLConfig{
+		EntityID:       testSP,
+		ACSURL:         testACS,
+		IdPEntityID:    "https://idp.example.com",
+		IdPSSOURL:      "https://idp.example.com/sso",
+		IdPCertificate: cert,
+	}
+	now := time.Now()
+	signed := signAssertion(t, ks, testAssertion(now, "user@example.com"))
+
+	t.Run("valid", func(t *testing.T) {
+		a, err := conf.ParseResponse(testResponse(signed), "req-1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.NameID != "user-42" {
+			t.Errorf("unexpected NameID: %s", a.NameID)
+		}
+		if a.ID != "a1" || !a.NotOnOrAfter.After(now) {
+			t.Errorf("unexpected replay data: %s %s", a.ID, a.NotOnOrAfter)
+		}
+		if got := a.Attributes["groups"]; len(got) != 2 || got[0] != "admins" || got[1] != "devs" {
+			t.Errorf("unexpected groups: %v", got)
+		}
+
+		id, err := MapClaims("corp", ProviderConfig{Type: TypeSAML}, a.Claims(), a.NameID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.Subject != "user-42" || id.Email != "user@example.com" || len(id.Groups) != 2 {
+			t.Errorf("unexpected identity: %+v", id)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := strings.Replace(signed, "user@example.com", "admin@example.com", 1)
+		if _, err := conf.ParseResponse(testResponse(tampered), "req-1", now); err == nil {
+			t.Fatal("tampered assertion accepted")
+		}
+	})
+
+	t.Run("wrong request", func(t *testing.T) {
+		if _, err := conf.ParseResponse(testResponse(signed), "req-2", now); err == nil {
+			t.Fatal("response to another request accepted")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		if _, err := conf.ParseResponse(testResponse(signed), "req-1", now.Add(time.Hour)); err == nil {
+			t.Fatal("expired assertion accepted")
+		}
+	})
+
+	t.Run("signed by another key", func(t *testing.T) {
+		other, _ := testCertificate(t)
+		forged := signAssertion(t, other, testAssertion(now, "user@example.com"))
+		if _, err := conf.ParseResponse(testResponse(forged), "req-1", now); err == nil {
+			t.Fatal("assertion signed by unknown certificate accepted")
+		}
+	})
+
+	t.Run("response signed", func(t *testing.T) {
+		unsigned := strings.Replace(testAssertion(now, "user@example.com"), "SIGNATURE", "", 1)
+		raw, _ := base64.StdEncoding.DecodeString(testResponse(unsigned))
+		signed := signAssertion(t, ks, string(raw))
+		a, err := conf.ParseResponse(base64.StdEncoding.EncodeToString([]byte(signed)), "req-1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Attributes["email"][0] != "user@example.com" {
+			t.Errorf("unexpected attributes: %v", a.Attributes)
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		unsigned := strings.Replace(testAssertion(now, "user@example.com"), "SIGNATURE", "", 1)
+		if _, err := conf.ParseResponse(testResponse(unsigned), "req-1", now); err == nil {
+			t.Fatal("unsigned assertion accepted")
+		}
+	})
+
+	t.Run("wrapped", func(t *testing.T) {
+		evil := strings.Replace(testAssertion(now, "admin@example.com"), "SIGNATURE", "", 1)
+		if _, err := conf.ParseResponse(testResponse(evil+signed), "req-1", now); err == nil {
+			t.Fatal("wrapped assertion accepted")
+		}
+	})
+}
+
+func TestNamespacesFor(t *testing.T) {
+	got := NamespacesFor([]string{"admins", "devs"}, []GroupMapping{
+		{Group: "devs", Namespace: "ns-1", Access: 1},
+		{Group: "admins", Namespace: "ns-1", Access: 3},
+		{Group: "ops", Namespace: "ns-2", Access: 1},
+	})
+	if len(got) != 1 || got["ns-1"] != 3 {
+		t.Fatalf("unexpected namespaces: %v", got)
+	}
+}
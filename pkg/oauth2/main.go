@@ -6,6 +6,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	"github.com/slntopp/nocloud-proto/registry"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
 	"github.com/slntopp/nocloud/pkg/oauth2/config"
 	"github.com/slntopp/nocloud/pkg/oauth2/handlers"
 	"go.uber.org/zap"
@@ -15,8 +16,14 @@ import (
 type OAuth2Server struct {
 	router         *mux.Router
 	registryClient registry.AccountsServiceClient
+	namespaces     handlers.NamespaceJoiner
 	signingKey     []byte
 
+	// Identity providers are only served when assertion key is set up
+	rdb          redisdb.Client
+	assertionKey []byte
+	identities   handlers.IdentityLookup
+
 	log *zap.Logger
 }
 
@@ -34,6 +41,18 @@ func (s *OAuth2Server) SetupRegistryClient(registryClient registry.AccountsServi
 	s.registryClient = registryClient
 }
 
+func (s *OAuth2Server) SetupNamespaceJoiner(namespaces handlers.NamespaceJoiner) {
+	s.namespaces = namespaces
+}
+
+// SetupIdentityProviders enables generic OIDC and SAML providers. Identity assertions are signed with assertionKey,
+// so they can't be mistaken for auth tokens
+func (s *OAuth2Server) SetupIdentityProviders(rdb redisdb.Client, assertionKey []byte, identities handlers.IdentityLookup) {
+	s.rdb = rdb
+	s.assertionKey = assertionKey
+	s.identities = identities
+}
+
 func (s *OAuth2Server) registerOAuthHandlers() {
 	cfg, err := config.Config()
 	s.log.Debug("Read config", zap.Any("cfg", cfg))
@@ -51,6 +70,10 @@ func (s *OAuth2Server) registerOAuthHandlers() {
 		handler.Setup(s.log.Named(key), s.router, conf, s.registryClient, s.signingKey)
 	}
 
+	if s.assertionKey != nil {
+		handlers.NewIdentityProvidersHandler(s.log, s.registryClient, s.rdb, s.signingKey, s.assertionKey, s.namespaces, s.identities).Setup(s.router)
+	}
+
 }
 
 func (s *OAuth2Server) Start(port string, corsAllowed []string, d Dependencies) {
@@ -0,0 +1,319 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ClientRegistry is used by dynamic client registration (RFC 7591) and clients administration
+type ClientRegistry interface {
+	CreateClient(ctx context.Context, c Client) error
+	ListClients(ctx context.Context) ([]Client, error)
+	SetClientDisabled(ctx context.Context, clientID string, disabled bool) error
+	// RevokeClientTokens revokes all access and refresh tokens issued to client
+	RevokeClientTokens(ctx context.Context, clientID string) error
+}
+
+type AdminChecker interface {
+	IsAdmin(ctx context.Context, subject string) (bool, error)
+}
+
+var registrableGrants = []string{"authorization_code", "refresh_token", "client_credentials", DeviceCodeGrantType}
+
+type clientRegistrationRequest struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope"`
+	ClientName              string   `json:"client_name"`
+	ClientURI               string   `json:"client_uri"`
+	LogoURI                 string   `json:"logo_uri"`
+}
+
+func (s *Server) handleRegisterClient(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	s.setNoStoreHeaders(w)
+
+	registeredBy, err := s.authorizeRegistration(ctx, r)
+	if err != nil {
+		writeJSONOAuthError(w, err)
+		return
+	}
+
+	var body clientRegistrationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)).Decode(&body); err != nil {
+		writeJSONOAuthError(w, oauthErr("invalid_client_metadata", "failed to parse json body", http.StatusBadRequest))
+		return
+	}
+
+	client, err := buildRegisteredClient(body, s.cfg.RegistrationAllowedScopes)
+	if err != nil {
+		writeJSONOAuthError(w, err)
+		return
+	}
+
+	client.ID, err = randomURLSafeString(24)
+	if err != nil {
+		s.log.Error("failed to generate client id", zap.Error(err))
+		writeJSONOAuthError(w, oauthErr("server_error", "failed to register client", http.StatusInternalServerError))
+		return
+	}
+	if !client.Public {
+		client.Secret, err = randomURLSafeString(32)
+		if err != nil {
+			s.log.Error("failed to generate client secret", zap.Error(err))
+			writeJSONOAuthError(w, oauthErr("server_error", "failed to register client", http.StatusInternalServerError))
+			return
+		}
+	}
+	client.RegisteredBy = registeredBy
+	client.CreatedAt = time.Now().UTC()
+
+	if err := s.deps.Registry.CreateClient(ctx, client); err != nil {
+		s.log.Error("failed to store client", zap.Error(err))
+		writeJSONOAuthError(w, oauthErr("server_error", "failed to register client", http.StatusInternalServerError))
+		return
+	}
+	s.log.Info("Client registered", zap.String("client_id", client.ID), zap.String("registered_by", registeredBy))
+
+	authMethod := body.TokenEndpointAuthMethod
+	if authMethod == "" {
+		authMethod = "client_secret_basic"
+	}
+	resp := map[string]any{
+		"client_id":                  client.ID,
+		"client_id_issued_at":        client.CreatedAt.Unix(),
+		"redirect_uris":              client.RedirectURIs,
+		"grant_types":                client.AllowedGrants,
+		"response_types":             []string{"code"},
+		"token_endpoint_auth_method": authMethod,
+		"scope":                      strings.Join(client.AllowedScopes, " "),
+		"client_name":                client.Display.Name,
+		"client_uri":                 client.Display.WebsiteURL,
+		"logo_uri":                   client.Display.LogoURL,
+	}
+	if !client.Public {
+		resp["client_secret"] = client.Secret
+		resp["client_secret_expires_at"] = 0
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// authorizeRegistration accepts either one of configured initial access tokens or logged in admin
+// Returns who registers the client
+func (s *Server) authorizeRegistration(ctx context.Context, r *http.Request) (string, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = strings.TrimSpace(token)
+		for _, allowed := range s.cfg.RegistrationInitialTokens {
+			if allowed != "" && subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+				return "dynamic", nil
+			}
+		}
+	}
+
+	if s.deps.Admins != nil {
+		subject, ok, err := s.deps.Authorization.Subject(ctx, r)
+		if err != nil {
+			s.log.Warn("failed to resolve subject", zap.Error(err))
+		}
+		if ok && subject != "" {
+			admin, err := s.deps.Admins.IsAdmin(ctx, subject)
+			if err != nil {
+				s.log.Error("failed to check admin access", zap.Error(err))
+				return "", oauthErr("server_error", "failed to check access", http.StatusInternalServerError)
+			}
+			if admin {
+				return subject, nil
+			}
+		}
+	}
+
+	return "", oauthErr("invalid_token", "valid initial access token required", http.StatusUnauthorized)
+}
+
+// buildRegisteredClient validates registration metadata, scopes are limited to allowedScopes
+// Client without scopes is allowed any of them, so empty allow-list rejects registration
+func buildRegisteredClient(req clientRegistrationRequest, allowedScopes []string) (Client, error) {
+	if len(allowedScopes) == 0 {
+		return Client{}, oauthErr("invalid_client_metadata", "no scopes are allowed for registered clients", http.StatusBadRequest)
+	}
+	c := Client{
+		RedirectURIs:  uniqueStrings(req.RedirectURIs),
+		AllowedGrants: uniqueStrings(req.GrantTypes),
+		AllowedScopes: registrableScopes(parseScopes(req.Scope), allowedScopes),
+		Display: ClientDisplay{
+			Name:       strings.TrimSpace(req.ClientName),
+			LogoURL:    strings.TrimSpace(req.LogoURI),
+			WebsiteURL: strings.TrimSpace(req.ClientURI),
+		},
+	}
+	if len(c.AllowedGrants) == 0 {
+		c.AllowedGrants = []string{"authorization_code"}
+	}
+	for _, g := range c.AllowedGrants {
+		if !grantAllowed(registrableGrants, g) {
+			return Client{}, oauthErr("invalid_client_metadata", "unsupported grant_type: "+g, http.StatusBadRequest)
+		}
+	}
+	for _, rt := range req.ResponseTypes {
+		if rt != "code" {
+			return Client{}, oauthErr("invalid_client_metadata", "unsupported response_type: "+rt, http.StatusBadRequest)
+		}
+	}
+
+	switch req.TokenEndpointAuthMethod {
+	case "", "client_secret_basic", "client_secret_post":
+	case "none":
+		c.Public = true
+	default:
+		return Client{}, oauthErr("invalid_client_metadata", "unsupported token_endpoint_auth_method", http.StatusBadRequest)
+	}
+	if c.Public && grantAllowed(c.AllowedGrants, "client_credentials") {
+		return Client{}, oauthErr("invalid_client_metadata", "public clients can not use client_credentials", http.StatusBadRequest)
+	}
+
+	if grantAllowed(c.AllowedGrants, "authorization_code") && len(c.RedirectURIs) == 0 {
+		return Client{}, oauthErr("invalid_redirect_uri", "redirect_uris are required for authorization_code", http.StatusBadRequest)
+	}
+	for _, ru := range c.RedirectURIs {
+		u, err := url.Parse(ru)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return Client{}, oauthErr("invalid_redirect_uri", "invalid redirect_uri: "+ru, http.StatusBadRequest)
+		}
+	}
+
+	if len(c.AllowedScopes) == 0 {
+		return Client{}, oauthErr("invalid_client_metadata", "none of requested scopes is allowed", http.StatusBadRequest)
+	}
+
+	return c, nil
+}
+
+// registrableScopes intersects requested scopes with allowed ones, all allowed scopes are given if none requested
+func registrableScopes(requested, allowed []string) []string {
+	allowed = uniqueStrings(allowed)
+	if len(requested) == 0 {
+		return allowed
+	}
+	res := make([]string, 0, len(requested))
+	for _, sc := range uniqueStrings(requested) {
+		if slices.Contains(allowed, sc) {
+			res = append(res, sc)
+		}
+	}
+	return res
+}
+
+// requireAdmin writes error and returns false if request was not made by admin
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	ctx := r.Context()
+	subject, ok, err := s.deps.Authorization.Subject(ctx, r)
+	if err != nil || !ok || subject == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{
+			"error": "login_required", "error_description": "user is not logged in",
+		})
+		return false
+	}
+	admin, err := s.deps.Admins.IsAdmin(ctx, subject)
+	if err != nil {
+		s.log.Error("failed to check admin access", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "failed to check access",
+		})
+		return false
+	}
+	if !admin {
+		writeJSON(w, http.StatusForbidden, map[string]any{
+			"error": "access_denied", "error_description": "not enough access rights",
+		})
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleListClients(w http.ResponseWriter, r *http.Request) {
+	s.setNoStoreHeaders(w)
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	clients, err := s.deps.Registry.ListClients(r.Context())
+	if err != nil {
+		s.log.Error("failed to list clients", zap.Error(err))
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
+			"error": "server_error", "error_description": "failed to list clients",
+		})
+		return
+	}
+
+	// Secrets are never exposed here
+	out := make([]map[string]any, 0, len(clients))
+	for _, c := range clients {
+		item := map[string]any{
+			"client_id":     c.ID,
+			"redirect_uris": c.RedirectURIs,
+			"grant_types":   c.AllowedGrants,
+			"scopes":        c.AllowedScopes,
+			"public":        c.Public,
+			"disabled":      c.Disabled,
+			"registered_by": c.RegisteredBy,
+			"display":       c.Display,
+		}
+		if !c.CreatedAt.IsZero() {
+			item["created_at"] = c.CreatedAt.Format(time.RFC3339Nano)
+		}
+		out = append(out, item)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"clients": out})
+}
+
+func (s *Server) handleSetClientDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.setNoStoreHeaders(w)
+		if !s.requireAdmin(w, r) {
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		if strings.TrimSpace(id) == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]any{
+				"error": "invalid_request", "error_description": "missing client id",
+			})
+			return
+		}
+
+		if err := s.deps.Registry.SetClientDisabled(r.Context(), id, disabled); err != nil {
+			s.log.Error("failed to update client", zap.Error(err), zap.String("client_id", id))
+			writeJSON(w, http.StatusNotFound, map[string]any{
+				"error": "not_found", "error_description": "client not found",
+			})
+			return
+		}
+		// Disabled client can't authenticate anymore, but tokens it got before must stop working too
+		if disabled {
+			if err := s.deps.Registry.RevokeClientTokens(r.Context(), id); err != nil {
+				s.log.Error("failed to revoke client tokens", zap.Error(err), zap.String("client_id", id))
+				writeJSON(w, http.StatusInternalServerError, map[string]any{
+					"error": "server_error", "error_description": "failed to revoke client tokens",
+				})
+				return
+			}
+		}
+		s.log.Info("Client status changed", zap.String("client_id", id), zap.Bool("disabled", disabled))
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"client_id": id,
+			"disabled":  disabled,
+		})
+	}
+}
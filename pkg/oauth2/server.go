@@ -45,6 +45,19 @@ type Config struct {
 	MaxBodyBytes int64 `yaml:"max_body_bytes"`
 
 	AllowPublicClientsOnTokenEndpoint *bool `yaml:"allow_public_clients_on_token_endpoint"`
+
+	DeviceAuthorizationPath string        `yaml:"device_authorization_path"`
+	DeviceInteractionPath   string        `yaml:"device_interaction_path"`
+	DeviceVerificationURL   string        `yaml:"device_verification_url"`
+	DeviceUserCodeParam     string        `yaml:"device_user_code_param"`
+	DeviceCodeTTL           time.Duration `yaml:"device_code_ttl"`
+	DevicePollInterval      time.Duration `yaml:"device_poll_interval"`
+
+	RegistrationPath          string   `yaml:"registration_path"`
+	RegistrationInitialTokens []string `yaml:"registration_initial_tokens"`
+	// Scopes registered clients may get, requested scope is intersected with it
+	RegistrationAllowedScopes []string `yaml:"registration_allowed_scopes"`
+	ClientsAdminPath          string   `yaml:"clients_admin_path"`
 }
 
 type Dependencies struct {
@@ -53,6 +66,12 @@ type Dependencies struct {
 	Tokens        TokenStore
 	Authorization AuthorizationService
 	Interactions  InteractionStore
+
+	// Optional. Device authorization grant routes are registered only if set
+	Devices DeviceAuthorizationStore
+	// Optional. Dynamic registration and clients admin routes are registered only if set
+	Registry ClientRegistry
+	Admins   AdminChecker
 }
 
 type Server struct {
@@ -99,6 +118,10 @@ type Client struct {
 	AllowedScopes []string
 	Public        bool          // Should be false by default
 	Display       ClientDisplay `json:"display"`
+
+	Disabled     bool
+	RegisteredBy string // Subject or "dynamic" for clients created through registration endpoint
+	CreatedAt    time.Time
 }
 
 type ClientStore interface {
@@ -172,6 +195,10 @@ type Interaction struct {
 	CreatedAt       time.Time
 	ExpiresAt       time.Time
 	Consumed        bool
+
+	// Set when interaction was started by device authorization grant verification
+	// Confirming such interaction resolves the device authorization instead of issuing a code
+	DeviceUserCode string
 }
 
 type InteractionStore interface {
@@ -232,8 +259,21 @@ func (s *Server) registerRoutes(r *mux.Router, base string) {
 	r.HandleFunc(base+s.cfg.TokenPath, s.handleToken).Methods(http.MethodPost)
 	r.HandleFunc(base+s.cfg.IntrospectPath, s.handleIntrospect).Methods(http.MethodPost)
 	r.HandleFunc(base+s.cfg.RevokePath, s.handleRevoke).Methods(http.MethodPost)
+	if s.deps.Devices != nil {
+		r.HandleFunc(base+s.cfg.DeviceAuthorizationPath, s.handleDeviceAuthorization).Methods(http.MethodPost)
+		// Must be registered before interaction by id route
+		r.HandleFunc(base+s.cfg.InteractionPath+s.cfg.DeviceInteractionPath, s.handleDeviceInteraction).Methods(http.MethodPost)
+	}
 	r.HandleFunc(base+s.cfg.InteractionPath+"/{id}", s.handleGetInteraction).Methods(http.MethodGet)
 	r.HandleFunc(base+s.cfg.InteractionPath+"/{id}"+s.cfg.InteractionConfirmPath, s.handleConfirmInteraction).Methods(http.MethodPost)
+	if s.deps.Registry != nil {
+		r.HandleFunc(base+s.cfg.RegistrationPath, s.handleRegisterClient).Methods(http.MethodPost)
+		if s.deps.Admins != nil {
+			r.HandleFunc(base+s.cfg.ClientsAdminPath, s.handleListClients).Methods(http.MethodGet)
+			r.HandleFunc(base+s.cfg.ClientsAdminPath+"/{id}/disable", s.handleSetClientDisabled(true)).Methods(http.MethodPost)
+			r.HandleFunc(base+s.cfg.ClientsAdminPath+"/{id}/enable", s.handleSetClientDisabled(false)).Methods(http.MethodPost)
+		}
+	}
 }
 
 func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
@@ -424,6 +464,9 @@ func (s *Server) handleGetInteraction(w http.ResponseWriter, r *http.Request) {
 		"created_at":       it.CreatedAt.Format(time.RFC3339Nano),
 		"expires_at":       it.ExpiresAt.Format(time.RFC3339Nano),
 	}
+	if it.DeviceUserCode != "" {
+		resp["user_code"] = it.DeviceUserCode
+	}
 
 	writeJSON(w, http.StatusOK, resp)
 }
@@ -468,6 +511,11 @@ func (s *Server) handleConfirmInteraction(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if it.DeviceUserCode != "" {
+		s.confirmDeviceInteraction(w, r, it, body)
+		return
+	}
+
 	now := time.Now().UTC()
 	// No need to check it.Consumed
 	// If it was successfully consumed, then it was not consumed before and we can proceed
@@ -585,6 +633,12 @@ func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
 		s.handleTokenRefreshToken(w, r)
 	case "client_credentials":
 		s.handleTokenClientCredentials(w, r)
+	case DeviceCodeGrantType:
+		if s.deps.Devices == nil {
+			writeJSONOAuthError(w, oauthErr("unsupported_grant_type", "unsupported grant_type", http.StatusBadRequest))
+			return
+		}
+		s.handleTokenDeviceCode(w, r)
 	default:
 		writeJSONOAuthError(w, oauthErr("unsupported_grant_type", "unsupported grant_type", http.StatusBadRequest))
 	}
@@ -1352,6 +1406,28 @@ func applyDefaults(cfg *Config) {
 	if cfg.InteractionTTL <= 0 {
 		cfg.InteractionTTL = 5 * time.Minute
 	}
+
+	if cfg.DeviceAuthorizationPath == "" {
+		cfg.DeviceAuthorizationPath = "/device_authorization"
+	}
+	if cfg.DeviceInteractionPath == "" {
+		cfg.DeviceInteractionPath = "/device"
+	}
+	if cfg.DeviceUserCodeParam == "" {
+		cfg.DeviceUserCodeParam = "user_code"
+	}
+	if cfg.DeviceCodeTTL <= 0 {
+		cfg.DeviceCodeTTL = 10 * time.Minute
+	}
+	if cfg.DevicePollInterval <= 0 {
+		cfg.DevicePollInterval = 5 * time.Second
+	}
+	if cfg.RegistrationPath == "" {
+		cfg.RegistrationPath = "/register"
+	}
+	if cfg.ClientsAdminPath == "" {
+		cfg.ClientsAdminPath = "/clients"
+	}
 }
 
 func (s *Server) issueRefreshToken() bool {
@@ -18,17 +18,18 @@ package registry
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	redis "github.com/go-redis/redis/v8"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
 	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
-	"github.com/slntopp/nocloud/pkg/nocloud/ssh"
+	"github.com/slntopp/nocloud/pkg/nocloud/sms"
 	"google.golang.org/protobuf/types/known/structpb"
 	"math/rand"
 	"slices"
 	"strings"
 	"time"
 
+	epb "github.com/slntopp/nocloud-proto/events"
 	elpb "github.com/slntopp/nocloud-proto/events_logging"
 	"github.com/slntopp/nocloud-proto/notes"
 	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
@@ -41,8 +42,11 @@ import (
 	"github.com/slntopp/nocloud/pkg/credentials"
 	"github.com/slntopp/nocloud/pkg/graph"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/blob"
+	"github.com/slntopp/nocloud/pkg/nocloud/risk"
 	"github.com/slntopp/nocloud/pkg/nocloud/roles"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/slntopp/nocloud/pkg/nocloud/vat"
 
 	pb "github.com/slntopp/nocloud-proto/registry"
 	accountspb "github.com/slntopp/nocloud-proto/registry/accounts"
@@ -76,22 +80,33 @@ func init() {
 
 type AccountsServiceServer struct {
 	pb.UnimplementedAccountsServiceServer
-	db      driver.Database
-	ctrl    graph.AccountsController
-	ns_ctrl graph.NamespacesController
-	ca      graph.CommonActionsController
+	db       driver.Database
+	ctrl     graph.AccountsController
+	ns_ctrl  graph.NamespacesController
+	ca       graph.CommonActionsController
+	cur_ctrl graph.CurrencyController
 
 	log         *zap.Logger
 	SIGNING_KEY []byte
 
-	rdb          redisdb.Client
-	asteriskConn *ssh.Client
+	rdb         redisdb.Client
+	smsProvider sms.SMSProvider
+	kycStore    blob.Store
 
 	baseHost string
 	appHost  string
+
+	eventsClient epb.EventsServiceClient
+	eventsCtx    context.Context
+
+	// Authorized with internal token, used for calls made on behalf of the system
+	internalCtx context.Context
+
+	// Builds VAT ID checker, newVatChecker is used if not set
+	vatChecker vatCheckerFactory
 }
 
-func NewAccountsServer(log *zap.Logger, db driver.Database, rdb redisdb.Client, asteriskConn *ssh.Client, baseHost string, appHost string) *AccountsServiceServer {
+func NewAccountsServer(log *zap.Logger, db driver.Database, rdb redisdb.Client, baseHost string, appHost string) *AccountsServiceServer {
 	return &AccountsServiceServer{
 		log: log, db: db,
 		ctrl: graph.NewAccountsController(
@@ -103,10 +118,12 @@ func NewAccountsServer(log *zap.Logger, db driver.Database, rdb redisdb.Client,
 		ca: graph.NewCommonActionsController(
 			log.Named("CommonActionsController"), db,
 		),
-		rdb:          rdb,
-		asteriskConn: asteriskConn,
-		baseHost:     baseHost,
-		appHost:      appHost,
+		cur_ctrl: graph.NewCurrencyController(
+			log.Named("CurrencyController"), db,
+		),
+		rdb:      rdb,
+		baseHost: baseHost,
+		appHost:  appHost,
 	}
 }
 
@@ -116,6 +133,9 @@ func (s *AccountsServiceServer) SetupSettingsClient(settingsClient settingspb.Se
 			context.Background(), "authorization", "bearer "+internal_token,
 		), &settingsClient,
 	)
+	s.internalCtx = metadata.AppendToOutgoingContext(
+		context.Background(), "authorization", "bearer "+internal_token,
+	)
 	var settings AccountPostCreateSettings
 	if scErr := sc.Fetch(accountPostCreateSettingsKey, &settings, defaultSettings); scErr != nil {
 		s.log.Warn("Cannot fetch settings", zap.Error(scErr))
@@ -127,6 +147,48 @@ func (s *AccountsServiceServer) SetupSettingsClient(settingsClient settingspb.Se
 	}
 }
 
+func (s *AccountsServiceServer) SetupEventsClient(eventsClient epb.EventsServiceClient, internal_token string) {
+	s.eventsClient = eventsClient
+	s.eventsCtx = metadata.AppendToOutgoingContext(
+		context.Background(), "authorization", "bearer "+internal_token,
+	)
+}
+
+func (s *AccountsServiceServer) sendEmail(account, key string, data map[string]*structpb.Value) {
+	publishEmail(s.eventsCtx, s.log, s.eventsClient, account, key, data)
+}
+
+// Publish email event to eventbus, does nothing if events client is not set up
+func publishEmail(ctx context.Context, log *zap.Logger, client epb.EventsServiceClient, account, key string, data map[string]*structpb.Value) {
+	if client == nil {
+		log.Warn("Events client is not set up, email is not sent", zap.String("key", key))
+		return
+	}
+	if _, err := client.Publish(ctx, &epb.Event{
+		Type: "email",
+		Uuid: account,
+		Key:  key,
+		Data: data,
+		Ts:   time.Now().Unix(),
+	}); err != nil {
+		log.Error("Failed to publish email event", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// Publish email event for recipient without account, Uuid is the address itself and mailer delivers to it directly
+func publishEmailToAddress(ctx context.Context, log *zap.Logger, client epb.EventsServiceClient, address, key string, data map[string]*structpb.Value) {
+	if address == "" {
+		log.Warn("No address to send email to", zap.String("key", key))
+		return
+	}
+	withAddress := make(map[string]*structpb.Value, len(data)+1)
+	for k, v := range data {
+		withAddress[k] = v
+	}
+	withAddress["to"] = structpb.NewStringValue(address)
+	publishEmail(ctx, log, client, address, key, withAddress)
+}
+
 func ContainsOnlyDigits(s string) bool {
 	if s == "" {
 		return false
@@ -149,9 +211,12 @@ const emailVerificationDataKeyTemplate = "registry-email-verification-%s"
 const phoneNumberRequestsCountKeyTemplate = "registry-phone-number-requests-%s"
 
 type VerificationData struct {
-	Code    string `json:"code"`
-	Sent    int64  `json:"sent"`
-	Expires int64  `json:"expires"`
+	Code     string `json:"code"`
+	Sent     int64  `json:"sent"`
+	Expires  int64  `json:"expires"`
+	Attempts int    `json:"attempts"`
+	// Message ID returned by SMS provider, used to track delivery
+	MessageID string `json:"message_id,omitempty"`
 }
 type PhoneRequestsCount struct {
 	Phone string `json:"phone"`
@@ -162,11 +227,6 @@ func generateCode() string {
 	return fmt.Sprintf("%06d", rand.Intn(1000000))
 }
 
-type Record struct {
-	ID    string
-	State string
-}
-
 func getRedisParsed[T any](rdb redisdb.Client, key string, result *T, def T) error {
 	res, err := rdb.Get(context.Background(), key).Result()
 	if err != nil {
@@ -193,29 +253,6 @@ func setRedis[T any](rdb redisdb.Client, key string, value T) error {
 	return nil
 }
 
-func parseDevices(content string) ([]Record, error) {
-	lines := strings.Split(content, "\n")
-	if len(lines) < 2 {
-		return nil, errors.New("no data")
-	}
-	var records []Record
-	for i, line := range lines[1:] {
-		if strings.TrimSpace(line) == "" {
-			continue
-		}
-		fields := strings.Fields(line)
-		if len(fields) < 3 {
-			return nil, fmt.Errorf("not enough fields on line %d", i+2)
-		}
-		record := Record{
-			ID:    fields[0],
-			State: strings.ToLower(fields[2]),
-		}
-		records = append(records, record)
-	}
-	return records, nil
-}
-
 func (s *AccountsServiceServer) ChangeAccountGroup(ctx context.Context, req *accountspb.ChangeAccountGroupRequest) (*accountspb.ChangeAccountGroupResponse, error) {
 	log := s.log.Named("ChangeAccountGroup")
 
@@ -427,6 +464,7 @@ func (s *AccountsServiceServer) Verify(ctx context.Context, req *pb.Verification
 
 	now := time.Now().Unix()
 	if req.Type == pb.VerificationType_PHONE {
+		phoneConf := getPhoneVerificationSettings(log)
 
 		if !hasPhone || phone.Number == "" || phone.CountryCode == "" || !ContainsOnlyDigits(accountPhone) {
 			return nil, fmt.Errorf("phone not found or invalid")
@@ -440,61 +478,39 @@ func (s *AccountsServiceServer) Verify(ctx context.Context, req *pb.Verification
 				log.Error("Failed to get phone's data from redis", zap.Error(err))
 				return nil, fmt.Errorf("failed to get phone's data")
 			}
-			if phoneData.Count >= 5 {
+			if phoneData.Count >= phoneConf.NumberRequestsLimit {
 				return nil, fmt.Errorf("Too many requests. Try again later or contact support.")
 			}
 
-			if now-vData.Sent < 150 {
+			if now-vData.Sent < phoneConf.ResendInterval {
 				return nil, fmt.Errorf("Too many requests. Try again later.")
 			}
-
-			code := generateCode()
-			vData.Code = code
-			vData.Expires = now + 600
-			vData.Sent = now
-			if err = setRedis(s.rdb, fmt.Sprintf(phoneVerificationDataKeyTemplate, acc.GetUuid()), vData); err != nil {
-				log.Error("Failed to save verification data", zap.Error(err))
-				return nil, fmt.Errorf("internal error")
+			if s.smsProvider == nil {
+				log.Error("No SMS provider configured")
+				return nil, fmt.Errorf("couldn't perform your request at the moment. Try again later")
 			}
 
-			resp, err := s.asteriskConn.RunCommand(`sudo /usr/sbin/asterisk -rx "dongle show devices"`)
-			if err != nil {
-				log.Error("failed to get available devices", zap.Error(err))
-				return nil, fmt.Errorf("internal error")
-			}
-			log.Debug("Show devices response", zap.String("response", resp))
-			devices, err := parseDevices(resp)
+			code := generateCode()
+			res, err := s.smsProvider.Send(ctx, sms.Message{
+				To:   "+" + strings.TrimPrefix(accountPhone, "+"),
+				Body: strings.ReplaceAll(phoneConf.MessageTemplate, "$CODE", code),
+			})
 			if err != nil {
-				log.Error("failed to obtain available devices")
-				return nil, fmt.Errorf("internal error")
-			}
-			log.Debug("Parsed devices", zap.Any("devices", devices))
-			var available string
-			for _, device := range devices {
-				if device.State == "free" {
-					available = device.ID
-					break
-				}
-			}
-			if available == "" {
-				log.Error("No available device")
+				log.Error("failed to send sms", zap.Error(err))
 				return nil, fmt.Errorf("couldn't perform your request at the moment. Try again later")
 			}
-			log.Debug("Chosen Asterisk device", zap.String("device", available))
+			log.Debug("SMS sent", zap.String("provider", res.Provider), zap.String("id", res.ID), zap.String("status", string(res.Status)))
 
-			to := accountPhone
-			if !strings.HasPrefix(to, "+") {
-				to = "+" + to
+			vData = VerificationData{
+				Code:      code,
+				Sent:      now,
+				Expires:   now + phoneConf.CodeTTL,
+				MessageID: res.ID,
 			}
-
-			smsBody := fmt.Sprintf("Ваш код верификации ЛК: %s. Хостинг-провайдер support.by", code)
-			command := fmt.Sprintf(`sudo /usr/sbin/asterisk -rx 'dongle sms %s %s %s'`, available, to, smsBody)
-			resp, err = s.asteriskConn.RunCommand(command)
-			if err != nil {
-				log.Error("failed to send sms", zap.Error(err), zap.Any("response", resp))
+			if err = setRedis(s.rdb, fmt.Sprintf(phoneVerificationDataKeyTemplate, acc.GetUuid()), vData); err != nil {
+				log.Error("Failed to save verification data", zap.Error(err))
 				return nil, fmt.Errorf("internal error")
 			}
-			log.Debug("Send SMS response", zap.Any("response", resp))
 
 			phoneData.Count++
 			if err = setRedis(s.rdb, fmt.Sprintf(phoneNumberRequestsCountKeyTemplate, strings.TrimPrefix(accountPhone, "+")), phoneData); err != nil {
@@ -508,13 +524,24 @@ func (s *AccountsServiceServer) Verify(ctx context.Context, req *pb.Verification
 				log.Error("No saved code")
 				return nil, fmt.Errorf("can't approve. You must request code first")
 			}
-			if vData.Code != req.GetSecureCode() || now > vData.Expires {
+			if now > vData.Expires {
+				return nil, fmt.Errorf("code expired. Request new one")
+			}
+			if vData.Attempts >= phoneConf.MaxAttempts {
+				return nil, fmt.Errorf("too many attempts. Request new code")
+			}
+			if vData.Code != req.GetSecureCode() {
+				vData.Attempts++
+				if err = setRedis(s.rdb, fmt.Sprintf(phoneVerificationDataKeyTemplate, acc.GetUuid()), vData); err != nil {
+					log.Error("Failed to save verification data", zap.Error(err))
+				}
 				return nil, fmt.Errorf("invalid code")
 			}
 			if err = s.ctrl.Update(ctx, acc, map[string]interface{}{"is_phone_verified": true}); err != nil {
 				log.Error("Failed to update account", zap.Error(err))
 				return nil, fmt.Errorf("internal error")
 			}
+			s.rdb.Del(ctx, fmt.Sprintf(phoneVerificationDataKeyTemplate, acc.GetUuid()))
 			nocloud.Log(log, &elpb.Event{
 				Entity:    schema.ACCOUNTS_COL,
 				Uuid:      acc.GetUuid(),
@@ -530,7 +557,17 @@ func (s *AccountsServiceServer) Verify(ctx context.Context, req *pb.Verification
 			log.Info("Phone was successfully verified")
 		}
 	} else if req.Type == pb.VerificationType_EMAIL {
-		return nil, fmt.Errorf("email verification currently disabled")
+		if req.Action == pb.VerificationAction_BEGIN {
+			if err = s.RequestEmailVerification(ctx, acc, http_server.GRPCClientIP(ctx)); err != nil {
+				return nil, err
+			}
+		}
+		if req.Action == pb.VerificationAction_APPROVE {
+			if err = s.verifyEmail(ctx, req.GetSecureCode(), acc.GetUuid()); err != nil {
+				return nil, err
+			}
+			log.Info("Email was successfully verified")
+		}
 	} else {
 		return nil, fmt.Errorf("unsupported verification type")
 	}
@@ -677,6 +714,13 @@ func (s *AccountsServiceServer) Get(ctx context.Context, request *accountspb.Get
 
 	log.Debug("Retrieving account", zap.String("uuid", requested))
 	acc, err := s.ctrl.GetWithAccess(ctx, requestorId, requested)
+	// Merged accounts are resolved to the account they were merged into
+	if err != nil {
+		if target, ok := graph.ResolveAccountRedirect(ctx, s.db, requested); ok {
+			log.Debug("Account was merged, resolving redirect", zap.String("target", target))
+			acc, err = s.ctrl.GetWithAccess(ctx, requestorId, target)
+		}
+	}
 	if err != nil || acc.Access == nil {
 		log.Debug("Error getting account", zap.Any("error", err))
 		return nil, status.Error(codes.NotFound, "Account not found")
@@ -875,6 +919,11 @@ func (s *AccountsServiceServer) Token(ctx context.Context, request *accountspb.T
 		log.Error("Failed to store session", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Failed to issue token: session")
 	}
+	method := "sudo"
+	if requestor == nil || request.Uuid == nil {
+		method = request.GetAuth().GetType()
+	}
+	s.onSessionCreated(ctx, log, acc, session, method)
 
 	claims := jwt.MapClaims{}
 	claims[nocloud.NOCLOUD_ACCOUNT_CLAIM] = acc.Key
@@ -1010,8 +1059,11 @@ func (s *AccountsServiceServer) Create(ctx context.Context, request *accountspb.
 		return nil, status.Error(codes.AlreadyExists, "Such username also exists")
 	}
 
+	var taxCheck *vat.Result
 	if request.Data != nil {
 		m := request.Data.AsMap()
+		delete(m, taxIDValidationKey)
+		taxCheck = s.validateTaxID(ctx, log, m, false)
 		applyTaxRate(m)
 		normalizeDateCreate(m, true)
 		structMap, _ := structpb.NewStruct(m)
@@ -1037,6 +1089,7 @@ func (s *AccountsServiceServer) Create(ctx context.Context, request *accountspb.
 		return nil, status.Error(codes.Internal, "Error while creating account")
 	}
 	res := &accountspb.CreateResponse{Uuid: acc.Key}
+	s.recordTaxIDValidation(ctx, log, acc.Key, requestor, taxCheck)
 
 	if request.Access != nil && access.Level(*request.Access) < access_lvl {
 		access_lvl = access.Level(*request.Access)
@@ -1151,8 +1204,11 @@ func (s *AccountsServiceServer) SignUp(ctx context.Context, request *accountspb.
 		accStatus = accountspb.AccountStatus_LOCK
 	}
 
+	var taxCheck *vat.Result
 	if request.Data != nil {
 		m := request.Data.AsMap()
+		delete(m, taxIDValidationKey)
+		taxCheck = s.validateTaxID(ctx, log, m, false)
 		applyTaxRate(m)
 		normalizeDateCreate(m, true)
 		structMap, _ := structpb.NewStruct(m)
@@ -1163,6 +1219,12 @@ func (s *AccountsServiceServer) SignUp(ctx context.Context, request *accountspb.
 		structMap, _ := structpb.NewStruct(m)
 		request.Data = structMap
 	}
+
+	assessment := s.screenSignup(ctx, log, request.GetData().AsMap())
+	if assessment != nil && assessment.Decision == risk.Hold {
+		accStatus = accountspb.AccountStatus_LOCK
+	}
+
 	creationAccount := accountspb.Account{
 		Title:           request.Title,
 		Currency:        request.Currency,
@@ -1178,6 +1240,8 @@ func (s *AccountsServiceServer) SignUp(ctx context.Context, request *accountspb.
 		return nil, status.Error(codes.Internal, "Error while creating account")
 	}
 	res := &accountspb.CreateResponse{Uuid: acc.Key}
+	s.recordTaxIDValidation(ctx, log, acc.Key, acc.Key, taxCheck)
+	s.storeRiskAssessment(ctx, log, acc, assessment)
 
 	if request.Access != nil && access.Level(*request.Access) < access_lvl {
 		access_lvl = access.Level(*request.Access)
@@ -1275,6 +1339,7 @@ func (s *AccountsServiceServer) Update(ctx context.Context, request *accountspb.
 	}
 
 	var requestData map[string]any
+	var taxCheck *vat.Result
 	if request.Data == nil {
 		log.Debug("Data patch is not present, skipping")
 	} else {
@@ -1286,8 +1351,11 @@ func (s *AccountsServiceServer) Update(ctx context.Context, request *accountspb.
 		} else {
 			// Remove phone keys from request data
 			delete(requestData, "phone_new")
+			// Validation outcome is set by registry only
+			delete(requestData, taxIDValidationKey)
 			log.Debug("Merging data")
 			mergedData := MergeMaps(acc.Data.AsMap(), requestData)
+			taxCheck = s.validateTaxID(ctx, log, mergedData, false)
 			applyTaxRate(mergedData)
 			normalizeDateCreate(mergedData, false)
 			patch["data"] = mergedData
@@ -1305,6 +1373,7 @@ func (s *AccountsServiceServer) Update(ctx context.Context, request *accountspb.
 		log.Debug("Error updating account", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Error while updating account")
 	}
+	s.recordTaxIDValidation(ctx, log, acc.Key, requestor, taxCheck)
 
 	return &accountspb.UpdateResponse{Result: true}, nil
 }
@@ -1373,10 +1442,19 @@ func (s *AccountsServiceServer) Delete(ctx context.Context, request *accountspb.
 		return nil, status.Error(codes.PermissionDenied, "NoAccess")
 	}
 
-	err = acc.Delete(ctx, s.db)
+	if acc.Key == schema.ROOT_ACCOUNT_KEY {
+		return nil, status.Error(codes.PermissionDenied, "Root account cannot be deleted")
+	}
+
+	// Account is purged by PurgeRoutine once grace period is over, or right away if there is none
+	if getSoftDeleteSettings(log).GracePeriod <= 0 {
+		// Invoices and transactions must be retained, so accounts with billing records are anonymized instead
+		err = s.purgeAccount(ctx, log, acc.Key, &graph.PendingDeletion{RequestedAt: time.Now().Unix(), RequestedBy: requestor})
+	} else {
+		err = s.markAccountForDeletion(ctx, log, acc, requestor)
+	}
 	if err != nil {
-		log.Debug("Error deleting account and it's children", zap.Error(err))
-		return nil, status.Error(codes.Internal, "Error deleting account")
+		return nil, err
 	}
 
 	return &accountspb.DeleteResponse{Result: true}, nil
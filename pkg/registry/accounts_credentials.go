@@ -0,0 +1,290 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	accountspb "github.com/slntopp/nocloud-proto/registry/accounts"
+	"github.com/slntopp/nocloud/pkg/credentials"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const credentialsBase = "/accounts/credentials"
+
+// Kinds of sign-in methods presented to the user
+const (
+	CredentialsKindPassword     = "password"
+	CredentialsKindOAuth2       = "oauth2"
+	CredentialsKindWHMCS        = "whmcs"
+	CredentialsKindAPIKey       = "api_key"
+	CredentialsKindSecondFactor = "second_factor"
+	CredentialsKindOther        = "other"
+)
+
+const credentialsChangedEmail = "credentials_changed"
+
+type CredentialsMethod struct {
+	Type       string `json:"type"`
+	Kind       string `json:"kind"`
+	Identifier string `json:"identifier,omitempty"`
+	// Primary methods can be used to sign in on their own, account must always keep at least one of them
+	Primary bool `json:"primary"`
+}
+
+type credentialsAuth struct {
+	Type string   `json:"type"`
+	Data []string `json:"data"`
+}
+
+type linkCredentialsRequest struct {
+	Auth credentialsAuth `json:"auth"`
+	// Reauth must be valid for one of already linked methods
+	Reauth credentialsAuth `json:"reauth"`
+}
+
+type unlinkCredentialsRequest struct {
+	// Reauth must be valid for one of linked methods, so stolen session can't strip account protection
+	Reauth credentialsAuth `json:"reauth"`
+}
+
+func credentialsKind(authType string) (kind string, primary bool) {
+	switch {
+	case authType == "standard":
+		return CredentialsKindPassword, true
+	case authType == "whmcs":
+		return CredentialsKindWHMCS, true
+	case strings.HasPrefix(authType, "oauth2"):
+		return CredentialsKindOAuth2, true
+	case strings.HasPrefix(authType, "api-key"):
+		return CredentialsKindAPIKey, false
+	case strings.HasPrefix(authType, "totp"), strings.HasPrefix(authType, "2fa"):
+		return CredentialsKindSecondFactor, false
+	default:
+		return CredentialsKindOther, false
+	}
+}
+
+func makeCredentialsMethods(links []graph.CredentialsLink) []CredentialsMethod {
+	methods := make([]CredentialsMethod, 0, len(links))
+	for _, link := range links {
+		kind, primary := credentialsKind(link.Type)
+		method := CredentialsMethod{Type: link.Type, Kind: kind, Primary: primary}
+		// Never expose what is used as a secret
+		if kind != CredentialsKindAPIKey && kind != CredentialsKindSecondFactor {
+			method.Identifier = link.Identifier
+		}
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+func (s *AccountsServiceServer) RegisterRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	subRouter := router.PathPrefix(credentialsBase).Subrouter()
+	subRouter.Handle("", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListCredentials))).Methods("GET")
+	subRouter.Handle("", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleLinkCredentials))).Methods("POST")
+	subRouter.Handle("/{type}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleUnlinkCredentials))).Methods("DELETE")
+}
+
+func (s *AccountsServiceServer) HandleListCredentials(writer http.ResponseWriter, request *http.Request) {
+	log := s.log.Named("ListCredentials")
+	ctx := request.Context()
+	requester, _ := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	acc, err := s.ctrl.Get(ctx, requester)
+	if err != nil {
+		http.Error(writer, "Account not found", http.StatusNotFound)
+		return
+	}
+	links, err := s.ctrl.ListCredentials(ctx, acc)
+	if err != nil {
+		log.Error("Failed to list credentials", zap.Error(err))
+		http.Error(writer, "Failed to list credentials", http.StatusInternalServerError)
+		return
+	}
+
+	http_server.WriteJSON(writer, http.StatusOK, map[string]any{
+		"credentials": makeCredentialsMethods(links),
+	})
+}
+
+func (s *AccountsServiceServer) HandleLinkCredentials(writer http.ResponseWriter, request *http.Request) {
+	log := s.log.Named("LinkCredentials")
+	ctx := request.Context()
+	requester, _ := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	var req linkCredentialsRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := credentials.Determine(req.Auth.Type); !ok {
+		http.Error(writer, "Unsupported credentials type", http.StatusBadRequest)
+		return
+	}
+
+	acc, err := s.ctrl.Get(ctx, requester)
+	if err != nil {
+		http.Error(writer, "Account not found", http.StatusNotFound)
+		return
+	}
+
+	if !s.reauthenticate(ctx, log, acc, req.Reauth) {
+		http.Error(writer, "Re-authentication failed", http.StatusUnauthorized)
+		return
+	}
+
+	edge, err := s.db.Collection(ctx, schema.ACC2CRED)
+	if err != nil {
+		log.Error("Failed to get credentials edge collection", zap.Error(err))
+		http.Error(writer, "Failed to link credentials", http.StatusInternalServerError)
+		return
+	}
+	if _, has := s.ctrl.GetCredentials(ctx, edge, acc, req.Auth.Type); has {
+		http.Error(writer, "Credentials of this type are already linked", http.StatusConflict)
+		return
+	}
+
+	cred, err := credentials.MakeCredentials(&accountspb.Credentials{Type: req.Auth.Type, Data: req.Auth.Data}, log)
+	if err != nil {
+		log.Debug("Error creating new credentials", zap.String("type", req.Auth.Type), zap.Error(err))
+		http.Error(writer, "Invalid credentials data", http.StatusBadRequest)
+		return
+	}
+	if cred.Find(ctx, s.db) {
+		http.Error(writer, "Credentials are already used by another account", http.StatusConflict)
+		return
+	}
+
+	if err = s.ctrl.SetCredentials(ctx, acc, edge, cred, roles.OWNER); err != nil {
+		log.Error("Failed to set credentials", zap.String("type", req.Auth.Type), zap.Error(err))
+		http.Error(writer, "Failed to link credentials", http.StatusInternalServerError)
+		return
+	}
+
+	s.credentialsChanged(ctx, acc, "credentials_link", req.Auth.Type)
+	http_server.WriteJSON(writer, http.StatusOK, map[string]any{"result": true})
+}
+
+// reauthenticate checks fresh credentials of the account itself
+func (s *AccountsServiceServer) reauthenticate(ctx context.Context, log *zap.Logger, acc graph.Account, reauth credentialsAuth) bool {
+	if reauth.Type == "" || len(reauth.Data) == 0 {
+		return false
+	}
+	reauthAcc, ok := s.ctrl.Authorize(ctx, reauth.Type, reauth.Data...)
+	if !ok || reauthAcc.Key != acc.Key {
+		log.Warn("Re-authentication failed", zap.String("account", acc.Key), zap.String("type", reauth.Type))
+		return false
+	}
+	return true
+}
+
+func (s *AccountsServiceServer) HandleUnlinkCredentials(writer http.ResponseWriter, request *http.Request) {
+	log := s.log.Named("UnlinkCredentials")
+	ctx := request.Context()
+	requester, _ := ctx.Value(nocloud.NoCloudAccount).(string)
+	authType := mux.Vars(request)["type"]
+
+	var req unlinkCredentialsRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+
+	acc, err := s.ctrl.Get(ctx, requester)
+	if err != nil {
+		http.Error(writer, "Account not found", http.StatusNotFound)
+		return
+	}
+	if !s.reauthenticate(ctx, log, acc, req.Reauth) {
+		http.Error(writer, "Re-authentication failed", http.StatusUnauthorized)
+		return
+	}
+	links, err := s.ctrl.ListCredentials(ctx, acc)
+	if err != nil {
+		log.Error("Failed to list credentials", zap.Error(err))
+		http.Error(writer, "Failed to unlink credentials", http.StatusInternalServerError)
+		return
+	}
+
+	var target *CredentialsMethod
+	primaryCount := 0
+	methods := makeCredentialsMethods(links)
+	for i := range methods {
+		if methods[i].Primary {
+			primaryCount++
+		}
+		if methods[i].Type == authType {
+			target = &methods[i]
+		}
+	}
+	if target == nil {
+		http.Error(writer, "Credentials not found", http.StatusNotFound)
+		return
+	}
+	if target.Primary && primaryCount <= 1 {
+		http.Error(writer, "Cannot remove the last sign-in method", http.StatusConflict)
+		return
+	}
+
+	if err = s.ctrl.UnlinkCredentials(ctx, acc, authType); err != nil {
+		log.Error("Failed to unlink credentials", zap.String("type", authType), zap.Error(err))
+		http.Error(writer, "Failed to unlink credentials", http.StatusInternalServerError)
+		return
+	}
+
+	s.credentialsChanged(ctx, acc, "credentials_unlink", authType)
+	http_server.WriteJSON(writer, http.StatusOK, map[string]any{"result": true})
+}
+
+// Log change of sign-in methods and notify account owner about it
+func (s *AccountsServiceServer) credentialsChanged(ctx context.Context, acc graph.Account, action, authType string) {
+	requester, _ := ctx.Value(nocloud.NoCloudAccount).(string)
+	kind, _ := credentialsKind(authType)
+
+	nocloud.Log(s.log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      acc.Key,
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: "Type: " + authType,
+		},
+	})
+
+	s.sendEmail(acc.Key, credentialsChangedEmail, map[string]*structpb.Value{
+		"action": structpb.NewStringValue(action),
+		"type":   structpb.NewStringValue(authType),
+		"kind":   structpb.NewStringValue(kind),
+	})
+}
@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	pb "github.com/slntopp/nocloud-proto/registry/accounts"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+)
+
+func testAccount(key string) graph.Account {
+	return graph.Account{
+		Account:      &pb.Account{Uuid: key},
+		DocumentMeta: driver.DocumentMeta{Key: key},
+	}
+}
+
+func unlinkRequest(authType, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodDelete, credentialsBase+"/"+authType, strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"type": authType})
+	return req.WithContext(context.WithValue(req.Context(), nocloud.NoCloudAccount, "acc"))
+}
+
+func TestMakeCredentialsMethodsHidesSecrets(t *testing.T) {
+	methods := makeCredentialsMethods([]graph.CredentialsLink{
+		{Type: "standard", Identifier: "user"},
+		{Type: "api-key", Identifier: "secret"},
+		{Type: "totp", Identifier: "seed"},
+	})
+
+	assert.Equal(t, []CredentialsMethod{
+		{Type: "standard", Kind: CredentialsKindPassword, Identifier: "user", Primary: true},
+		{Type: "api-key", Kind: CredentialsKindAPIKey},
+		{Type: "totp", Kind: CredentialsKindSecondFactor},
+	}, methods)
+}
+
+func TestHandleUnlinkCredentials(t *testing.T) {
+	acc := testAccount("acc")
+	links := []graph.CredentialsLink{
+		{Type: "standard", Identifier: "user"},
+		{Type: "totp"},
+	}
+	reauth := `{"reauth": {"type": "standard", "data": ["user", "pass"]}}`
+
+	t.Run("without re-authentication", func(t *testing.T) {
+		ctrl := graph_mocks.NewMockAccountsController(t)
+		ctrl.EXPECT().Get(mock.Anything, "acc").Return(acc, nil)
+		s := &AccountsServiceServer{ctrl: ctrl, log: zap.NewNop()}
+
+		rec := httptest.NewRecorder()
+		s.HandleUnlinkCredentials(rec, unlinkRequest("totp", `{}`))
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		ctrl.AssertNotCalled(t, "UnlinkCredentials", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("re-authenticated as another account", func(t *testing.T) {
+		ctrl := graph_mocks.NewMockAccountsController(t)
+		ctrl.EXPECT().Get(mock.Anything, "acc").Return(acc, nil)
+		ctrl.EXPECT().Authorize(mock.Anything, "standard", "user", "pass").Return(testAccount("other"), true)
+		s := &AccountsServiceServer{ctrl: ctrl, log: zap.NewNop()}
+
+		rec := httptest.NewRecorder()
+		s.HandleUnlinkCredentials(rec, unlinkRequest("totp", reauth))
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		ctrl.AssertNotCalled(t, "UnlinkCredentials", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("last primary method", func(t *testing.T) {
+		ctrl := graph_mocks.NewMockAccountsController(t)
+		ctrl.EXPECT().Get(mock.Anything, "acc").Return(acc, nil)
+		ctrl.EXPECT().Authorize(mock.Anything, "standard", "user", "pass").Return(acc, true)
+		ctrl.EXPECT().ListCredentials(mock.Anything, acc).Return(links, nil)
+		s := &AccountsServiceServer{ctrl: ctrl, log: zap.NewNop()}
+
+		rec := httptest.NewRecorder()
+		s.HandleUnlinkCredentials(rec, unlinkRequest("standard", reauth))
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		ctrl.AssertNotCalled(t, "UnlinkCredentials", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("second factor", func(t *testing.T) {
+		ctrl := graph_mocks.NewMockAccountsController(t)
+		ctrl.EXPECT().Get(mock.Anything, "acc").Return(acc, nil)
+		ctrl.EXPECT().Authorize(mock.Anything, "standard", "user", "pass").Return(acc, true)
+		ctrl.EXPECT().ListCredentials(mock.Anything, acc).Return(links, nil)
+		ctrl.EXPECT().UnlinkCredentials(mock.Anything, acc, "totp").Return(nil)
+		s := &AccountsServiceServer{ctrl: ctrl, log: zap.NewNop()}
+
+		rec := httptest.NewRecorder()
+		s.HandleUnlinkCredentials(rec, unlinkRequest("totp", reauth))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"result": true}`, rec.Body.String())
+	})
+}
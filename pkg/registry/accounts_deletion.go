@@ -0,0 +1,357 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	servicespb "github.com/slntopp/nocloud-proto/services"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const softDeleteSettingsKey = "soft-delete"
+
+type SoftDeleteSettings struct {
+	// Days entity stays pending deletion and can be restored, deleted immediately if 0
+	GracePeriod int `json:"grace_period"`
+	// Seconds between purge runs
+	PurgeFrequency int64 `json:"purge_frequency"`
+}
+
+var defaultSoftDeleteSettings = &sc.Setting[SoftDeleteSettings]{
+	Value: SoftDeleteSettings{
+		GracePeriod:    30,
+		PurgeFrequency: 3600,
+	},
+	Description: "Grace period for deleted accounts and namespaces",
+	Level:       access.Level_ADMIN,
+}
+
+func getSoftDeleteSettings(log *zap.Logger) SoftDeleteSettings {
+	var conf SoftDeleteSettings
+	if scErr := sc.Fetch(softDeleteSettingsKey, &conf, defaultSoftDeleteSettings); scErr != nil {
+		log.Warn("Cannot fetch soft-delete settings", zap.Error(scErr))
+		conf = defaultSoftDeleteSettings.Value
+	}
+	return conf
+}
+
+// Suspends or unsuspends services, errors are only logged so single broken service doesn't block deletion
+func setServicesSuspended(ctx context.Context, log *zap.Logger, services []string, suspend bool) {
+	for _, service := range services {
+		var err error
+		if suspend {
+			_, err = servicesClient.Suspend(ctx, &servicespb.SuspendRequest{Uuid: service})
+		} else {
+			_, err = servicesClient.Unsuspend(ctx, &servicespb.UnsuspendRequest{Uuid: service})
+		}
+		if err != nil {
+			log.Error("Error changing Service suspension", zap.String("service", service), zap.Bool("suspend", suspend), zap.Error(err))
+		}
+	}
+}
+
+// teardownServices undeploys and deletes owned services through services service, so drivers terminate instances before owner is removed or anonymized
+func teardownServices(ctx context.Context, log *zap.Logger, db driver.Database, owner driver.DocumentID) error {
+	services, err := graph.ListOwnedServices(ctx, db, owner)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		// Suspended services can't be undeployed, fails if service isn't suspended
+		if _, err := servicesClient.Unsuspend(ctx, &servicespb.UnsuspendRequest{Uuid: service}); err != nil {
+			log.Debug("Service wasn't unsuspended", zap.String("service", service), zap.Error(err))
+		}
+		if _, err := servicesClient.Down(ctx, &servicespb.DownRequest{Uuid: service}); err != nil {
+			return fmt.Errorf("undeploy service %s: %w", service, err)
+		}
+		res, err := servicesClient.Delete(ctx, &servicespb.DeleteRequest{Uuid: service})
+		if err != nil {
+			return fmt.Errorf("delete service %s: %w", service, err)
+		}
+		if !res.GetResult() {
+			return fmt.Errorf("delete service %s: %s", service, res.GetError())
+		}
+	}
+	return nil
+}
+
+func logDeletionEvent(log *zap.Logger, id driver.DocumentID, action, requester string, diff any) {
+	data, _ := json.Marshal(diff)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    id.Collection(),
+		Uuid:      id.Key(),
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: string(data),
+		},
+	})
+}
+
+// markAccountForDeletion suspends account with its services and blocks logins until grace period is over
+func (s *AccountsServiceServer) markAccountForDeletion(ctx context.Context, log *zap.Logger, acc graph.Account, requester string) error {
+	conf := getSoftDeleteSettings(log)
+	now := time.Now()
+
+	deletion := &graph.PendingDeletion{
+		RequestedAt:  now.Unix(),
+		RequestedBy:  requester,
+		PurgeAt:      now.AddDate(0, 0, conf.GracePeriod).Unix(),
+		WasSuspended: acc.GetSuspended(),
+	}
+
+	services, err := graph.ListOwnedActiveServices(ctx, s.db, acc.ID)
+	if err != nil {
+		log.Error("Error listing Services to suspend", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting account")
+	}
+	deletion.Services = services
+
+	if err = graph.MarkForDeletion(ctx, s.db, acc.ID, deletion); err != nil {
+		if errors.Is(err, graph.ErrPendingDeletion) {
+			return status.Error(codes.FailedPrecondition, "Account is already pending deletion")
+		}
+		log.Error("Error marking account for deletion", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting account")
+	}
+
+	setServicesSuspended(s.internalCtx, log, services, true)
+	if !deletion.WasSuspended {
+		if err := s.ctrl.Update(ctx, acc, map[string]interface{}{"suspended": true}); err != nil {
+			log.Error("Error suspending account", zap.Error(err))
+		}
+	}
+	s.revokeAllSessions(log, acc.Key)
+
+	logDeletionEvent(log, acc.ID, "deletion_requested", requester, deletion)
+	s.sendEmail(acc.Key, "account_deletion_scheduled", map[string]*structpb.Value{
+		"purge_at": structpb.NewNumberValue(float64(deletion.PurgeAt)),
+	})
+	return nil
+}
+
+// RestoreAccount cancels pending deletion, unsuspending everything suspended by it
+func (s *AccountsServiceServer) RestoreAccount(ctx context.Context, uuid string) error {
+	log := s.log.Named("RestoreAccount")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("account", uuid))
+
+	acc, err := s.ctrl.Get(ctx, uuid)
+	if err != nil {
+		log.Debug("Error getting account", zap.Error(err))
+		return status.Error(codes.NotFound, "Account not found")
+	}
+	if !s.ca.HasAccess(ctx, requester, acc.ID, access.Level_ADMIN) {
+		return status.Error(codes.PermissionDenied, "NoAccess")
+	}
+
+	deletion, err := graph.ClearDeletion(ctx, s.db, acc.ID)
+	if err != nil {
+		if errors.Is(err, graph.ErrNotPendingDeletion) {
+			return status.Error(codes.FailedPrecondition, "Account is not pending deletion")
+		}
+		log.Error("Error clearing deletion mark", zap.Error(err))
+		return status.Error(codes.Internal, "Error restoring account")
+	}
+
+	if !deletion.WasSuspended {
+		if err := s.ctrl.Update(ctx, acc, map[string]interface{}{"suspended": false}); err != nil {
+			log.Error("Error unsuspending account", zap.Error(err))
+		}
+	}
+	setServicesSuspended(s.internalCtx, log, deletion.Services, false)
+
+	logDeletionEvent(log, acc.ID, "restored", requester, deletion)
+	s.sendEmail(acc.Key, "account_restored", nil)
+	return nil
+}
+
+// purgeAccount deletes account services through their controllers, then deletes account with everything it owns
+// Accounts with billing records are anonymized instead
+func (s *AccountsServiceServer) purgeAccount(ctx context.Context, log *zap.Logger, account string, deletion *graph.PendingDeletion) error {
+	acc, err := s.ctrl.Get(ctx, account)
+	if err != nil {
+		log.Error("Error getting account", zap.String("account", account), zap.Error(err))
+		return status.Error(codes.NotFound, "Account not found")
+	}
+	now := time.Now().Unix()
+	record := &graph.DeletionRecord{
+		Entity:      schema.ACCOUNTS_COL,
+		Uuid:        acc.Key,
+		Title:       acc.GetTitle(),
+		RequestedAt: deletion.RequestedAt,
+		RequestedBy: deletion.RequestedBy,
+		Purged:      now,
+	}
+
+	// Purge is retried by PurgeRoutine if any instance couldn't be terminated
+	if err = teardownServices(s.internalCtx, log, s.db, acc.ID); err != nil {
+		log.Error("Error deleting owned Services", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting account services")
+	}
+
+	// Invoices and transactions must be retained, so such accounts are anonymized instead
+	hasBilling, err := graph.HasBillingRecords(ctx, s.db, acc.Key)
+	if err != nil {
+		log.Error("Error checking billing records", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting account")
+	}
+	if hasBilling {
+		if record.Erasure, err = s.eraseAccount(ctx, log, acc.Key, deletion.RequestedBy); err != nil {
+			return err
+		}
+		if err = graph.SetPurged(ctx, s.db, acc.ID, now); err != nil {
+			log.Error("Error marking account as purged", zap.Error(err))
+		}
+		record.Mode = "erased"
+	} else {
+		if record.Removed, err = graph.PurgeRecursive(ctx, s.db, acc.ID); err != nil {
+			log.Error("Error deleting account and it's children", zap.Error(err))
+			return status.Error(codes.Internal, "Error deleting account")
+		}
+		s.revokeAllSessions(log, acc.Key)
+		record.Mode = "deleted"
+	}
+
+	recordDeletion(ctx, log, s.db, record)
+	return nil
+}
+
+func recordDeletion(ctx context.Context, log *zap.Logger, db driver.Database, record *graph.DeletionRecord) {
+	if err := graph.RecordDeletion(ctx, db, record); err != nil {
+		log.Error("Error storing deletion record", zap.Any("record", record), zap.Error(err))
+	}
+	logDeletionEvent(log, driver.NewDocumentID(record.Entity, record.Uuid), "purged", record.RequestedBy, record)
+}
+
+// PurgeRoutine deletes accounts and namespaces which grace period is over
+func (s *AccountsServiceServer) PurgeRoutine(ctx context.Context) {
+	log := s.log.Named("PurgeRoutine")
+	graph.GetEnsureCollection(log, ctx, s.db, schema.DELETION_RECORDS_COL)
+
+start:
+	conf := getSoftDeleteSettings(log)
+	frequency := time.Duration(max(conf.PurgeFrequency, 60)) * time.Second
+
+	upd := make(chan bool, 1)
+	go sc.Subscribe([]string{softDeleteSettingsKey}, upd)
+
+	log.Info("Got Configuration", zap.Any("conf", conf))
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+
+	for {
+		s.purgeDue(ctx, log, frequency)
+
+		select {
+		case <-ctx.Done():
+			log.Info("Context is done. Quitting")
+			return
+		case <-ticker.C:
+			continue
+		case <-upd:
+			log.Info("New Configuration Received, restarting Routine")
+			ticker.Stop()
+			goto start
+		}
+	}
+}
+
+// claimPurge reads pending deletion and claims it until lease, so entity is purged by single replica
+func claimPurge(ctx context.Context, log *zap.Logger, db driver.Database, id driver.DocumentID, lease int64) *graph.PendingDeletion {
+	deletion, err := graph.GetPendingDeletion(ctx, db, id)
+	if err != nil || deletion == nil {
+		return nil
+	}
+	claimed, err := graph.ClaimPurge(ctx, db, id, deletion.PurgeAt, lease)
+	if err != nil {
+		log.Error("Error claiming purge", zap.String("id", id.String()), zap.Error(err))
+		return nil
+	}
+	if !claimed {
+		return nil
+	}
+	return deletion
+}
+
+func (s *AccountsServiceServer) purgeDue(ctx context.Context, log *zap.Logger, lease time.Duration) {
+	now := time.Now().Unix()
+	until := now + int64(lease.Seconds())
+
+	accounts, err := graph.ListDueForPurge(ctx, s.db, schema.ACCOUNTS_COL, now)
+	if err != nil {
+		log.Error("Error listing accounts to purge", zap.Error(err))
+	}
+	for _, key := range accounts {
+		deletion := claimPurge(ctx, log, s.db, driver.NewDocumentID(schema.ACCOUNTS_COL, key), until)
+		if deletion == nil {
+			continue
+		}
+		if err := s.purgeAccount(ctx, log, key, deletion); err != nil {
+			log.Error("Error purging account", zap.String("account", key), zap.Error(err))
+		}
+	}
+
+	namespaces, err := graph.ListDueForPurge(ctx, s.db, schema.NAMESPACES_COL, now)
+	if err != nil {
+		log.Error("Error listing namespaces to purge", zap.Error(err))
+	}
+	for _, key := range namespaces {
+		deletion := claimPurge(ctx, log, s.db, driver.NewDocumentID(schema.NAMESPACES_COL, key), until)
+		if deletion == nil {
+			continue
+		}
+		ns, err := s.ns_ctrl.Get(ctx, key)
+		if err != nil {
+			log.Error("Error getting namespace", zap.String("namespace", key), zap.Error(err))
+			continue
+		}
+		if err := purgeNamespace(ctx, s.internalCtx, log, s.db, ns, deletion); err != nil {
+			log.Error("Error purging namespace", zap.String("namespace", key), zap.Error(err))
+		}
+	}
+}
+
+func (s *AccountsServiceServer) RegisterDeletionRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/{uuid}/restore", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleRestoreAccount))).Methods("POST")
+}
+
+func (s *AccountsServiceServer) HandleRestoreAccount(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.RestoreAccount(request.Context(), mux.Vars(request)["uuid"]))
+}
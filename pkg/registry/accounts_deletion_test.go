@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud-proto/access"
+	accountspb "github.com/slntopp/nocloud-proto/registry/accounts"
+	servicespb "github.com/slntopp/nocloud-proto/services"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+type fakeServices struct {
+	servicespb.ServicesServiceClient
+	calls       []string
+	downErr     error
+	deleteError string
+}
+
+func (f *fakeServices) Unsuspend(_ context.Context, req *servicespb.UnsuspendRequest, _ ...grpc.CallOption) (*servicespb.UnsuspendResponse, error) {
+	f.calls = append(f.calls, "unsuspend:"+req.GetUuid())
+	return &servicespb.UnsuspendResponse{}, nil
+}
+
+func (f *fakeServices) Down(_ context.Context, req *servicespb.DownRequest, _ ...grpc.CallOption) (*servicespb.DownResponse, error) {
+	f.calls = append(f.calls, "down:"+req.GetUuid())
+	return &servicespb.DownResponse{}, f.downErr
+}
+
+func (f *fakeServices) Delete(_ context.Context, req *servicespb.DeleteRequest, _ ...grpc.CallOption) (*servicespb.DeleteResponse, error) {
+	f.calls = append(f.calls, "delete:"+req.GetUuid())
+	return &servicespb.DeleteResponse{Result: f.deleteError == "", Error: f.deleteError}, nil
+}
+
+func useServicesClient(t *testing.T, client servicespb.ServicesServiceClient) {
+	prev := servicesClient
+	servicesClient = client
+	t.Cleanup(func() { servicesClient = prev })
+}
+
+// Cursor returning given keys one by one
+func keysCursor(t *testing.T, keys ...string) *driver_mocks.MockCursor {
+	cursor := driver_mocks.NewMockCursor(t)
+	for _, key := range keys {
+		cursor.EXPECT().HasMore().Return(true).Once()
+		cursor.EXPECT().ReadDocument(mock.Anything, mock.Anything).Run(func(_ context.Context, result interface{}) {
+			*result.(*string) = key
+		}).Return(driver.DocumentMeta{}, nil).Once()
+	}
+	cursor.EXPECT().HasMore().Return(false).Once()
+	cursor.EXPECT().Close().Return(nil)
+	return cursor
+}
+
+func TestDeleteRootAccount(t *testing.T) {
+	root := testAccount(schema.ROOT_ACCOUNT_KEY)
+	root.ID = driver.NewDocumentID(schema.ACCOUNTS_COL, schema.ROOT_ACCOUNT_KEY)
+	ctrl := graph_mocks.NewMockAccountsController(t)
+	ctrl.EXPECT().Get(mock.Anything, schema.ROOT_ACCOUNT_KEY).Return(root, nil)
+	ca := graph_mocks.NewMockCommonActionsController(t)
+	ca.EXPECT().HasAccess(mock.Anything, schema.ROOT_ACCOUNT_KEY, root.ID, access.Level_ADMIN).Return(true)
+	s := &AccountsServiceServer{ctrl: ctrl, ca: ca, log: zap.NewNop()}
+
+	_, err := s.Delete(requesterContext(schema.ROOT_ACCOUNT_KEY), &accountspb.DeleteRequest{Uuid: schema.ROOT_ACCOUNT_KEY})
+	assert.Error(t, err)
+}
+
+func TestTeardownServices(t *testing.T) {
+	owner := driver.NewDocumentID(schema.ACCOUNTS_COL, "acc")
+
+	t.Run("deleted through services service", func(t *testing.T) {
+		services := &fakeServices{}
+		useServicesClient(t, services)
+		db := driver_mocks.NewMockDatabase(t)
+		db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(keysCursor(t, "a", "b"), nil)
+
+		require.NoError(t, teardownServices(context.Background(), zap.NewNop(), db, owner))
+		assert.Equal(t, []string{"unsuspend:a", "down:a", "delete:a", "unsuspend:b", "down:b", "delete:b"}, services.calls)
+	})
+
+	t.Run("undeploy failed", func(t *testing.T) {
+		services := &fakeServices{downErr: errors.New("driver is down")}
+		useServicesClient(t, services)
+		db := driver_mocks.NewMockDatabase(t)
+		db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(keysCursor(t, "a", "b"), nil)
+
+		// Owner must not be purged while instances are still running
+		assert.Error(t, teardownServices(context.Background(), zap.NewNop(), db, owner))
+		assert.Equal(t, []string{"unsuspend:a", "down:a"}, services.calls)
+	})
+
+	t.Run("delete rejected", func(t *testing.T) {
+		services := &fakeServices{deleteError: "cannot delete Service, status: PROC"}
+		useServicesClient(t, services)
+		db := driver_mocks.NewMockDatabase(t)
+		db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(keysCursor(t, "a"), nil)
+
+		assert.Error(t, teardownServices(context.Background(), zap.NewNop(), db, owner))
+	})
+}
+
+func TestPurgeDueSkipsClaimedEntities(t *testing.T) {
+	db := driver_mocks.NewMockDatabase(t)
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["@col"] == schema.ACCOUNTS_COL && vars["now"] != nil
+	})).Return(keysCursor(t, "acc"), nil).Once()
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["id"] != nil
+	})).Return(singleDocumentCursor(t, graph.PendingDeletion{RequestedBy: "acc", PurgeAt: 1}), nil).Once()
+
+	// Another replica has moved purge_at already, so nothing is updated
+	claimed := driver_mocks.NewMockCursor(t)
+	claimed.EXPECT().HasMore().Return(false)
+	claimed.EXPECT().Close().Return(nil)
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["purge_at"] == int64(1) && vars["lease"].(int64) > time.Now().Unix()
+	})).Return(claimed, nil).Once()
+
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.MatchedBy(func(vars map[string]interface{}) bool {
+		return vars["@col"] == schema.NAMESPACES_COL
+	})).Return(keysCursor(t), nil).Once()
+
+	// Account controller has no expectations, so purge attempt fails the test
+	s := &AccountsServiceServer{db: db, ctrl: graph_mocks.NewMockAccountsController(t), log: zap.NewNop()}
+	s.purgeDue(context.Background(), zap.NewNop(), time.Hour)
+}
@@ -0,0 +1,406 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/impersonation"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const gdprSettingsKey = "gdpr"
+
+type GDPRSettings struct {
+	// Seconds export archive is available for download
+	ExportTTL int64 `json:"export_ttl"`
+	// Years invoices and transactions of erased account are retained for
+	RetentionYears int `json:"retention_years"`
+	// Title erased accounts and their namespaces get
+	ErasedTitle string `json:"erased_title"`
+}
+
+var defaultGDPRSettings = &sc.Setting[GDPRSettings]{
+	Value: GDPRSettings{
+		ExportTTL:      24 * 3600,
+		RetentionYears: 5,
+		ErasedTitle:    "Deleted account",
+	},
+	Description: "Account data export and erasure",
+	Level:       access.Level_ADMIN,
+}
+
+func getGDPRSettings(log *zap.Logger) GDPRSettings {
+	var conf GDPRSettings
+	if scErr := sc.Fetch(gdprSettingsKey, &conf, defaultGDPRSettings); scErr != nil {
+		log.Warn("Cannot fetch gdpr settings", zap.Error(scErr))
+		conf = defaultGDPRSettings.Value
+	}
+	return conf
+}
+
+type ExportJobStatus string
+
+const (
+	ExportRunning ExportJobStatus = "running"
+	ExportDone    ExportJobStatus = "done"
+	ExportFailed  ExportJobStatus = "failed"
+)
+
+type ExportJob struct {
+	Id        string          `json:"id"`
+	Account   string          `json:"account"`
+	Requester string          `json:"requester"`
+	Status    ExportJobStatus `json:"status"`
+	Created   int64           `json:"created"`
+	Finished  int64           `json:"finished,omitempty"`
+	Size      int             `json:"size,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+const (
+	exportJobKeyTemplate     = "registry-gdpr-export-job-%s"
+	exportArchiveKeyTemplate = "registry-gdpr-export-archive-%s"
+	exportLockKeyTemplate    = "registry-gdpr-export-lock-%s"
+	exportTimeout            = 10 * time.Minute
+)
+
+func (s *AccountsServiceServer) canManageAccountData(ctx context.Context, requester, account string) bool {
+	return requester == account || s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.ACCOUNTS_COL, account), access.Level_ADMIN)
+}
+
+func (s *AccountsServiceServer) saveExportJob(job *ExportJob, ttl time.Duration) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(context.Background(), fmt.Sprintf(exportJobKeyTemplate, job.Id), data, ttl).Err()
+}
+
+// ExportAccountData starts job gathering account data into zip archive, returns job to poll
+func (s *AccountsServiceServer) ExportAccountData(ctx context.Context, account string) (*ExportJob, error) {
+	log := s.log.Named("ExportAccountData")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	if !s.canManageAccountData(ctx, requester, account) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	conf := getGDPRSettings(log)
+	ttl := time.Duration(conf.ExportTTL) * time.Second
+
+	locked, err := s.rdb.SetNX(ctx, fmt.Sprintf(exportLockKeyTemplate, account), requester, exportTimeout).Result()
+	if err != nil {
+		log.Error("Failed to acquire export lock", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to start export")
+	}
+	if !locked {
+		return nil, status.Error(codes.AlreadyExists, "Export is already running for this account")
+	}
+
+	job := &ExportJob{
+		Id:        uuid.New().String(),
+		Account:   account,
+		Requester: requester,
+		Status:    ExportRunning,
+		Created:   time.Now().Unix(),
+	}
+	if err = s.saveExportJob(job, ttl); err != nil {
+		log.Error("Failed to save export job", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to start export")
+	}
+
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      account,
+		Scope:     "database",
+		Action:    "data_export_requested",
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: "Job: " + job.Id,
+		},
+	})
+
+	go s.runExport(log, *job, ttl)
+	return job, nil
+}
+
+func (s *AccountsServiceServer) runExport(log *zap.Logger, job ExportJob, ttl time.Duration) {
+	log = log.With(zap.String("job", job.Id), zap.String("account", job.Account))
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	defer s.rdb.Del(context.Background(), fmt.Sprintf(exportLockKeyTemplate, job.Account))
+
+	archive, err := s.buildExportArchive(ctx, job.Account)
+	job.Finished = time.Now().Unix()
+	if err == nil {
+		err = s.rdb.Set(context.Background(), fmt.Sprintf(exportArchiveKeyTemplate, job.Id), archive, ttl).Err()
+	}
+	if err != nil {
+		log.Error("Failed to export account data", zap.Error(err))
+		job.Status, job.Error = ExportFailed, "Failed to export account data"
+	} else {
+		job.Status, job.Size = ExportDone, len(archive)
+	}
+	if err := s.saveExportJob(&job, ttl); err != nil {
+		log.Error("Failed to save export job", zap.Error(err))
+		return
+	}
+
+	if job.Status == ExportDone {
+		s.sendEmail(job.Account, "account_data_export_ready", map[string]*structpb.Value{
+			"job":     structpb.NewStringValue(job.Id),
+			"expires": structpb.NewNumberValue(float64(job.Finished + int64(ttl.Seconds()))),
+		})
+	}
+}
+
+type exportedSession struct {
+	Id       string            `json:"id"`
+	Client   string            `json:"client"`
+	Created  int64             `json:"created"`
+	Expires  int64             `json:"expires"`
+	Metadata sessions.Metadata `json:"metadata"`
+}
+
+func (s *AccountsServiceServer) buildExportArchive(ctx context.Context, account string) ([]byte, error) {
+	graph.GetEnsureCollection(s.log, ctx, s.db, schema.BILLING_PROFILES_COL)
+	data, err := graph.ExportAccountData(ctx, s.db, account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather data: %w", err)
+	}
+
+	list, err := sessions.Get(s.rdb, account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	ids := make([]string, len(list))
+	for i, session := range list {
+		ids[i] = session.GetId()
+	}
+	meta, err := sessions.GetMetadata(s.rdb, account, ids...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions metadata: %w", err)
+	}
+	exported := make([]exportedSession, len(list))
+	for i, session := range list {
+		exported[i] = exportedSession{
+			Id:       session.GetId(),
+			Client:   session.GetClient(),
+			Created:  session.GetCreated().GetSeconds(),
+			Expires:  session.GetExpires().GetSeconds(),
+			Metadata: meta[session.GetId()],
+		}
+	}
+
+	files := []struct {
+		name string
+		body any
+	}{
+		{"account.json", data.Account},
+		{"credentials.json", data.Credentials},
+		{"sessions.json", exported},
+		{"consents.json", data.Consents},
+		{"notes.json", data.Notes},
+		{"namespaces.json", data.Namespaces},
+		{"instances.json", data.Instances},
+		{"invoices.json", data.Invoices},
+		{"transactions.json", data.Transactions},
+		{"billing_profiles.json", data.BillingProfiles},
+	}
+
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, file := range files {
+		f, err := w.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(file.body); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", file.name, err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *AccountsServiceServer) GetExportJob(ctx context.Context, id string) (*ExportJob, error) {
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	var job ExportJob
+	raw, err := s.rdb.Get(ctx, fmt.Sprintf(exportJobKeyTemplate, id)).Bytes()
+	if err != nil || json.Unmarshal(raw, &job) != nil {
+		return nil, status.Error(codes.NotFound, "Export not found or expired")
+	}
+	if job.Requester != requester && !s.canManageAccountData(ctx, requester, job.Account) {
+		return nil, status.Error(codes.NotFound, "Export not found or expired")
+	}
+	return &job, nil
+}
+
+// EraseAccount anonymizes personal data of the account, invoices and transactions are kept for retention period
+func (s *AccountsServiceServer) EraseAccount(ctx context.Context, account string) (*graph.ErasureReport, error) {
+	log := s.log.Named("EraseAccount")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	if impersonation.FromContext(ctx) != nil {
+		return nil, status.Error(codes.PermissionDenied, "Not allowed in impersonated session")
+	}
+	if account == schema.ROOT_ACCOUNT_KEY {
+		return nil, status.Error(codes.PermissionDenied, "Root account cannot be erased")
+	}
+	if requester != account && !s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), access.Level_ROOT) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+
+	active, err := graph.CountActiveInstances(ctx, s.db, account)
+	if err != nil {
+		log.Error("Failed to count instances", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to erase account")
+	}
+	if active > 0 {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Account has %d active instances, they must be deleted first", active))
+	}
+
+	return s.eraseAccount(ctx, log, account, requester)
+}
+
+func (s *AccountsServiceServer) eraseAccount(ctx context.Context, log *zap.Logger, account, requester string) (*graph.ErasureReport, error) {
+	conf := getGDPRSettings(log)
+	now := time.Now()
+	title := fmt.Sprintf("%s %s", conf.ErasedTitle, account[:min(8, len(account))])
+	graph.GetEnsureCollection(log, ctx, s.db, schema.BILLING_PROFILES_COL)
+
+	report, err := graph.AnonymizeAccount(ctx, s.db, account, title, now.Unix(), now.AddDate(conf.RetentionYears, 0, 0).Unix())
+	if err != nil {
+		log.Error("Failed to anonymize account", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to erase account")
+	}
+
+	s.revokeAllSessions(log, account)
+	if err := sessions.ForgetDevices(s.rdb, account); err != nil {
+		log.Warn("Failed to forget devices", zap.Error(err))
+	}
+	s.rdb.Del(ctx,
+		fmt.Sprintf(phoneVerificationDataKeyTemplate, account),
+		fmt.Sprintf(emailVerificationDataKeyTemplate, account),
+	)
+
+	diff, _ := json.Marshal(report)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      account,
+		Scope:     "database",
+		Action:    "erased",
+		Rc:        0,
+		Requestor: requester,
+		Ts:        now.Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: string(diff),
+		},
+	})
+	return report, nil
+}
+
+func (s *AccountsServiceServer) RegisterGDPRRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/{uuid}/export", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleExportAccountData))).Methods("POST")
+	router.Handle("/accounts/{uuid}/erase", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleEraseAccount))).Methods("POST")
+	router.Handle("/accounts/exports/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGetExportJob))).Methods("GET")
+	router.Handle("/accounts/exports/{id}/download", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleDownloadExport))).Methods("GET")
+}
+
+func (s *AccountsServiceServer) HandleExportAccountData(writer http.ResponseWriter, request *http.Request) {
+	job, err := s.ExportAccountData(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusAccepted, job)
+}
+
+func (s *AccountsServiceServer) HandleGetExportJob(writer http.ResponseWriter, request *http.Request) {
+	job, err := s.GetExportJob(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, job)
+}
+
+func (s *AccountsServiceServer) HandleDownloadExport(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	job, err := s.GetExportJob(ctx, mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	if job.Status != ExportDone {
+		http.Error(writer, "Export is not ready", http.StatusConflict)
+		return
+	}
+	archive, err := s.rdb.Get(ctx, fmt.Sprintf(exportArchiveKeyTemplate, job.Id)).Bytes()
+	if err != nil {
+		http.Error(writer, "Export not found or expired", http.StatusNotFound)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/zip")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="account-%s-%s.zip"`, job.Account, time.Unix(job.Finished, 0).Format("20060102")))
+	_, _ = writer.Write(archive)
+}
+
+func (s *AccountsServiceServer) HandleEraseAccount(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Confirm bool `json:"confirm"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil || !req.Confirm {
+		http.Error(writer, "Erasure must be confirmed", http.StatusBadRequest)
+		return
+	}
+	report, err := s.EraseAccount(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, report)
+}
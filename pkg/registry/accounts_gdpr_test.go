@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	redis "github.com/go-redis/redis/v8"
+	"github.com/slntopp/nocloud-proto/access"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	redisdb_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/impersonation"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func requesterContext(requester string) context.Context {
+	return context.WithValue(context.Background(), nocloud.NoCloudAccount, requester)
+}
+
+// Cursor returning single document, written into result with JSON round trip
+func singleDocumentCursor(t *testing.T, doc any) *driver_mocks.MockCursor {
+	raw, err := json.Marshal(doc)
+	require.NoError(t, err)
+	cursor := driver_mocks.NewMockCursor(t)
+	cursor.EXPECT().ReadDocument(mock.Anything, mock.Anything).Run(func(_ context.Context, result interface{}) {
+		require.NoError(t, json.Unmarshal(raw, result))
+	}).Return(driver.DocumentMeta{}, nil)
+	cursor.EXPECT().Close().Return(nil)
+	return cursor
+}
+
+func TestGetExportJob(t *testing.T) {
+	job, err := json.Marshal(ExportJob{Id: "job", Account: "acc", Requester: "acc", Status: ExportDone})
+	require.NoError(t, err)
+	key := fmt.Sprintf(exportJobKeyTemplate, "job")
+
+	t.Run("requester", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().Get(mock.Anything, key).Return(redis.NewStringResult(string(job), nil))
+		s := &AccountsServiceServer{rdb: rdb, log: zap.NewNop()}
+
+		res, err := s.GetExportJob(requesterContext("acc"), "job")
+		require.NoError(t, err)
+		assert.Equal(t, ExportDone, res.Status)
+	})
+
+	t.Run("stranger", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().Get(mock.Anything, key).Return(redis.NewStringResult(string(job), nil))
+		ca := graph_mocks.NewMockCommonActionsController(t)
+		ca.EXPECT().HasAccess(mock.Anything, "other", driver.NewDocumentID(schema.ACCOUNTS_COL, "acc"), access.Level_ADMIN).Return(false)
+		s := &AccountsServiceServer{rdb: rdb, ca: ca, log: zap.NewNop()}
+
+		// Existence of someone else's export is not revealed
+		_, err := s.GetExportJob(requesterContext("other"), "job")
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().Get(mock.Anything, key).Return(redis.NewStringResult("", redis.Nil))
+		s := &AccountsServiceServer{rdb: rdb, log: zap.NewNop()}
+
+		_, err := s.GetExportJob(requesterContext("acc"), "job")
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+func TestBuildExportArchive(t *testing.T) {
+	db := driver_mocks.NewMockDatabase(t)
+	db.EXPECT().CollectionExists(mock.Anything, schema.BILLING_PROFILES_COL).Return(true, nil)
+	db.EXPECT().Collection(mock.Anything, schema.BILLING_PROFILES_COL).Return(nil, nil)
+	db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(singleDocumentCursor(t, graph.AccountDataExport{
+		Account:         map[string]any{"uuid": "acc", "title": "Jane"},
+		Invoices:        []map[string]any{{"uuid": "inv"}},
+		BillingProfiles: []map[string]any{{"uuid": "bp", "title": "Jane Ltd"}},
+	}), nil)
+	rdb := redisdb_mocks.NewMockClient(t)
+	rdb.EXPECT().Keys(mock.Anything, "sessions:acc:*").Return(redis.NewStringSliceResult(nil, nil))
+	rdb.EXPECT().MGet(mock.Anything).Return(redis.NewSliceResult(nil, nil))
+	s := &AccountsServiceServer{db: db, rdb: rdb, log: zap.NewNop()}
+
+	archive, err := s.buildExportArchive(context.Background(), "acc")
+	require.NoError(t, err)
+
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+	files := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		body, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		_ = rc.Close()
+		files[f.Name] = string(body)
+	}
+
+	assert.Len(t, files, 10)
+	assert.JSONEq(t, `{"uuid": "acc", "title": "Jane"}`, files["account.json"])
+	assert.JSONEq(t, `[{"uuid": "inv"}]`, files["invoices.json"])
+	assert.JSONEq(t, `[{"uuid": "bp", "title": "Jane Ltd"}]`, files["billing_profiles.json"])
+	assert.JSONEq(t, `[]`, files["sessions.json"])
+}
+
+func TestEraseAccountGuards(t *testing.T) {
+	rootNs := driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY)
+
+	t.Run("impersonated session", func(t *testing.T) {
+		s := &AccountsServiceServer{log: zap.NewNop()}
+		ctx := context.WithValue(requesterContext("acc"), nocloud.NoCloudActor, &impersonation.Actor{Sub: "admin", ID: "grant", Mode: impersonation.ReadWrite})
+
+		_, err := s.EraseAccount(ctx, "acc")
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("root account", func(t *testing.T) {
+		s := &AccountsServiceServer{log: zap.NewNop()}
+
+		_, err := s.EraseAccount(requesterContext(schema.ROOT_ACCOUNT_KEY), schema.ROOT_ACCOUNT_KEY)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("other account without root access", func(t *testing.T) {
+		ca := graph_mocks.NewMockCommonActionsController(t)
+		ca.EXPECT().HasAccess(mock.Anything, "admin", rootNs, access.Level_ROOT).Return(false)
+		s := &AccountsServiceServer{ca: ca, log: zap.NewNop()}
+
+		_, err := s.EraseAccount(requesterContext("admin"), "acc")
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("active instances", func(t *testing.T) {
+		db := driver_mocks.NewMockDatabase(t)
+		db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(singleDocumentCursor(t, 2), nil)
+		s := &AccountsServiceServer{db: db, log: zap.NewNop()}
+
+		_, err := s.EraseAccount(requesterContext("acc"), "acc")
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+}
@@ -0,0 +1,242 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/impersonation"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const impersonationSettingsKey = "impersonation"
+
+type ImpersonationSettings struct {
+	DefaultTTL int64 `json:"default_ttl"` // seconds
+	MaxTTL     int64 `json:"max_ttl"`     // seconds
+	// Allow admins to request write mode, otherwise impersonated sessions are always read-only
+	AllowWrite    bool `json:"allow_write"`
+	RequireReason bool `json:"require_reason"`
+}
+
+var defaultImpersonationSettings = &sc.Setting[ImpersonationSettings]{
+	Value: ImpersonationSettings{
+		DefaultTTL:    900,
+		MaxTTL:        3600,
+		AllowWrite:    true,
+		RequireReason: false,
+	},
+	Description: "Admin impersonation (log in as customer)",
+	Level:       access.Level_ROOT,
+}
+
+type ImpersonateRequest struct {
+	Account string `json:"account"`
+	Write   bool   `json:"write"`
+	TTL     int64  `json:"ttl"` // seconds, default from settings if 0
+	Reason  string `json:"reason"`
+}
+
+type ImpersonateResponse struct {
+	Token         string             `json:"token"`
+	Account       string             `json:"account"`
+	Impersonation string             `json:"impersonation"`
+	Mode          impersonation.Mode `json:"mode"`
+	Expires       int64              `json:"expires"`
+}
+
+// Impersonate issues short-lived token for the account, carrying requester identity in act claim
+func (s *AccountsServiceServer) Impersonate(ctx context.Context, req *ImpersonateRequest) (*ImpersonateResponse, error) {
+	log := s.log.Named("Impersonate")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("account", req.Account), zap.Bool("write", req.Write))
+
+	if impersonation.FromContext(ctx) != nil {
+		return nil, status.Error(codes.PermissionDenied, "Cannot impersonate from impersonated session")
+	}
+	rootNs := driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY)
+	if !s.ca.HasAccess(ctx, requester, rootNs, access.Level_ROOT) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to impersonate")
+	}
+	if req.Account == "" || req.Account == requester {
+		return nil, status.Error(codes.InvalidArgument, "Account to impersonate must be set and differ from requester")
+	}
+
+	var conf ImpersonationSettings
+	if scErr := sc.Fetch(impersonationSettingsKey, &conf, defaultImpersonationSettings); scErr != nil {
+		log.Warn("Cannot fetch impersonation settings", zap.Error(scErr))
+		conf = defaultImpersonationSettings.Value
+	}
+	if conf.RequireReason && req.Reason == "" {
+		return nil, status.Error(codes.InvalidArgument, "Reason is required")
+	}
+	mode := impersonation.ReadOnly
+	if req.Write {
+		if !conf.AllowWrite {
+			return nil, status.Error(codes.PermissionDenied, "Write mode impersonation is disabled")
+		}
+		mode = impersonation.ReadWrite
+	}
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = conf.DefaultTTL
+	}
+	if conf.MaxTTL > 0 && ttl > conf.MaxTTL {
+		ttl = conf.MaxTTL
+	}
+
+	acc, err := s.ctrl.Get(ctx, req.Account)
+	if err != nil {
+		log.Debug("Failed to get account", zap.Error(err))
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	// Admins can't be impersonated, otherwise it'd be a way to gain their access
+	ok, lvl := s.ca.AccessLevel(ctx, acc.Key, rootNs)
+	if !ok {
+		lvl = access.Level_NONE
+	}
+	if lvl >= access.Level_ADMIN {
+		return nil, status.Error(codes.PermissionDenied, "Cannot impersonate admin account")
+	}
+
+	actor := &impersonation.Actor{
+		Sub:    requester,
+		ID:     uuid.New().String(),
+		Mode:   mode,
+		Reason: req.Reason,
+	}
+	if err := impersonation.Grant(s.rdb, actor, acc.Key, time.Duration(ttl)*time.Second); err != nil {
+		log.Error("Failed to store impersonation grant", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to issue token")
+	}
+
+	exp := time.Now().Unix() + ttl
+	claims := jwt.MapClaims{}
+	claims[nocloud.NOCLOUD_ACCOUNT_CLAIM] = acc.Key
+	claims[nocloud.NOCLOUD_NOSESSION_CLAIM] = true
+	claims[nocloud.NOCLOUD_ROOT_CLAIM] = lvl
+	claims[nocloud.NOCLOUD_ACT_CLAIM] = actor.Claims()
+	claims["expires"] = exp
+	claims["exp"] = exp
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.SIGNING_KEY)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to issue token")
+	}
+
+	diff, _ := json.Marshal(map[string]any{
+		"impersonation": actor.ID,
+		"mode":          mode,
+		"reason":        req.Reason,
+		"expires":       exp,
+	})
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      acc.Key,
+		Scope:     "impersonation",
+		Action:    "impersonate",
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: string(diff),
+		},
+	})
+
+	return &ImpersonateResponse{
+		Token:         token,
+		Account:       acc.Key,
+		Impersonation: actor.ID,
+		Mode:          mode,
+		Expires:       exp,
+	}, nil
+}
+
+// EndImpersonation invalidates impersonated token before it expires
+func (s *AccountsServiceServer) EndImpersonation(ctx context.Context, id string) error {
+	log := s.log.Named("EndImpersonation")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	if impersonation.FromContext(ctx) != nil {
+		return status.Error(codes.PermissionDenied, "Cannot end impersonation from impersonated session")
+	}
+	rootNs := driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY)
+	if !s.ca.HasAccess(ctx, requester, rootNs, access.Level_ROOT) {
+		return status.Error(codes.PermissionDenied, "Not enough access rights")
+	}
+
+	actor, account, err := impersonation.End(s.rdb, id)
+	if err != nil {
+		log.Debug("Failed to end impersonation", zap.Error(err))
+		return status.Error(codes.NotFound, "Impersonation not found or already expired")
+	}
+
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      account,
+		Scope:     "impersonation",
+		Action:    "impersonation_ended",
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: fmt.Sprintf("Impersonation: %s, Admin: %s", id, actor.Sub),
+		},
+	})
+	return nil
+}
+
+func (s *AccountsServiceServer) RegisterImpersonationRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	subRouter := router.PathPrefix("/accounts/impersonate").Subrouter()
+	subRouter.Handle("", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleImpersonate))).Methods("POST")
+	subRouter.Handle("/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleEndImpersonation))).Methods("DELETE")
+}
+
+func (s *AccountsServiceServer) HandleImpersonate(writer http.ResponseWriter, request *http.Request) {
+	var req ImpersonateRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.Impersonate(request.Context(), &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *AccountsServiceServer) HandleEndImpersonation(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.EndImpersonation(request.Context(), mux.Vars(request)["id"]))
+}
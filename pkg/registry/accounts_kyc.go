@@ -0,0 +1,386 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/blob"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/kyc"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// SetupKYCStore sets blob store for KYC documents, local filesystem store from settings is used if nil
+// Settings client must be set up before
+func (s *AccountsServiceServer) SetupKYCStore(store blob.Store) error {
+	if store == nil {
+		var err error
+		if store, err = blob.NewFileStore(graph.GetKYCSettings(s.log).StoragePath); err != nil {
+			return fmt.Errorf("failed to set up kyc store: %w", err)
+		}
+	}
+	s.kycStore = store
+	return nil
+}
+
+// refreshKYC re-evaluates account KYC state from its documents and current rules
+func (s *AccountsServiceServer) refreshKYC(ctx context.Context, conf kyc.Config, account string) (*graph.KYCSubject, error) {
+	subject, err := graph.GetKYCSubject(ctx, s.db, account)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := graph.ListKYCDocuments(ctx, s.db, account)
+	if err != nil {
+		return nil, err
+	}
+	evaluated := make([]kyc.Document, len(docs))
+	for i, d := range docs {
+		evaluated[i] = kyc.Document{Type: d.Type, Status: d.Status, UploadedAt: d.UploadedAt, ReviewedAt: d.ReviewedAt}
+	}
+	required := conf.RequiredDocuments(subject.AccountGroup, subject.Country)
+	state := kyc.Evaluate(required, evaluated, time.Duration(conf.ValidityDays)*24*time.Hour, time.Now())
+	if err := graph.SetAccountKYC(ctx, s.db, account, state); err != nil {
+		return nil, err
+	}
+	subject.State = &state
+	return subject, nil
+}
+
+type KYCStatusResponse struct {
+	State     *kyc.State          `json:"state"`
+	Required  []string            `json:"required"`
+	Documents []graph.KYCDocument `json:"documents"`
+}
+
+// GetKYCStatus returns account KYC state with required and uploaded documents
+func (s *AccountsServiceServer) GetKYCStatus(ctx context.Context, account string) (*KYCStatusResponse, error) {
+	log := s.log.Named("GetKYCStatus")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	if !s.canManageAccountData(ctx, requester, account) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.KYC_DOCUMENTS_COL)
+
+	conf := graph.GetKYCSettings(log)
+	subject, err := s.refreshKYC(ctx, conf, account)
+	if err != nil {
+		log.Error("Error evaluating KYC", zap.String("account", account), zap.Error(err))
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	docs, err := graph.ListKYCDocuments(ctx, s.db, account)
+	if err != nil {
+		log.Error("Error listing KYC documents", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing KYC documents")
+	}
+	return &KYCStatusResponse{
+		State:     subject.State,
+		Required:  conf.RequiredDocuments(subject.AccountGroup, subject.Country),
+		Documents: docs,
+	}, nil
+}
+
+type KYCUpload struct {
+	Type        string
+	Filename    string
+	ContentType string
+	Body        io.Reader
+}
+
+// UploadKYCDocument stores document for review, account owners may only upload types their rules require
+func (s *AccountsServiceServer) UploadKYCDocument(ctx context.Context, account string, upload *KYCUpload) (*graph.KYCDocument, error) {
+	log := s.log.Named("UploadKYCDocument")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("account", account), zap.String("type", upload.Type))
+
+	if !s.canManageAccountData(ctx, requester, account) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	if s.kycStore == nil {
+		return nil, status.Error(codes.Unavailable, "KYC storage is not configured")
+	}
+	conf := graph.GetKYCSettings(log)
+	if !conf.AllowsContentType(upload.ContentType) {
+		return nil, status.Errorf(codes.InvalidArgument, "Content type %s is not allowed", upload.ContentType)
+	}
+	subject, err := graph.GetKYCSubject(ctx, s.db, account)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	required := conf.RequiredDocuments(subject.AccountGroup, subject.Country)
+	isAdmin := s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.ACCOUNTS_COL, account), access.Level_ADMIN)
+	if upload.Type == "" || (!isAdmin && !slices.Contains(required, upload.Type)) {
+		return nil, status.Errorf(codes.InvalidArgument, "Document type must be one of %v", required)
+	}
+
+	graph.GetEnsureCollection(log, ctx, s.db, schema.KYC_DOCUMENTS_COL)
+	blobKey := account + "/" + uuid.New().String() + filepath.Ext(filepath.Base(upload.Filename))
+	hash := sha256.New()
+	limited := io.LimitReader(io.TeeReader(upload.Body, hash), conf.MaxSize+1)
+	size, err := s.kycStore.Put(ctx, blobKey, limited)
+	if err != nil {
+		log.Error("Error storing document", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error storing document")
+	}
+	if size > conf.MaxSize {
+		_ = s.kycStore.Delete(ctx, blobKey)
+		return nil, status.Errorf(codes.InvalidArgument, "Document exceeds %d bytes", conf.MaxSize)
+	}
+
+	doc, err := graph.CreateKYCDocument(ctx, s.db, &graph.KYCDocument{
+		Account:     account,
+		Type:        upload.Type,
+		Filename:    filepath.Base(upload.Filename),
+		ContentType: upload.ContentType,
+		Size:        size,
+		Sha256:      hex.EncodeToString(hash.Sum(nil)),
+		BlobKey:     blobKey,
+		Status:      kyc.DocumentPending,
+		UploadedAt:  time.Now().Unix(),
+		UploadedBy:  requester,
+	})
+	if err != nil {
+		_ = s.kycStore.Delete(ctx, blobKey)
+		log.Error("Error saving document", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error saving document")
+	}
+	if _, err := s.refreshKYC(ctx, conf, account); err != nil {
+		log.Error("Error evaluating KYC", zap.String("account", account), zap.Error(err))
+	}
+	logKYCEvent(log, doc, "uploaded", requester)
+	return doc, nil
+}
+
+// logKYCEvent logs document upload or review, document content is never included
+func logKYCEvent(log *zap.Logger, doc *graph.KYCDocument, action, requester string) {
+	snapshot, _ := json.Marshal(doc)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.KYC_DOCUMENTS_COL,
+		Uuid:      doc.Key,
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: string(snapshot),
+		},
+	})
+}
+
+// OpenKYCDocument returns document and its content, caller must close reader
+func (s *AccountsServiceServer) OpenKYCDocument(ctx context.Context, id string) (*graph.KYCDocument, io.ReadCloser, error) {
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	doc, err := graph.GetKYCDocument(ctx, s.db, id)
+	if err != nil {
+		return nil, nil, status.Error(codes.NotFound, "Document not found")
+	}
+	if !s.canManageAccountData(ctx, requester, doc.Account) {
+		return nil, nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	if s.kycStore == nil {
+		return nil, nil, status.Error(codes.Unavailable, "KYC storage is not configured")
+	}
+	r, err := s.kycStore.Get(ctx, doc.BlobKey)
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, nil, status.Error(codes.NotFound, "Document content is missing")
+		}
+		s.log.Error("Error reading document", zap.String("document", id), zap.Error(err))
+		return nil, nil, status.Error(codes.Internal, "Error reading document")
+	}
+	return doc, r, nil
+}
+
+type KYCReviewRequest struct {
+	Approved bool   `json:"approved"`
+	Comment  string `json:"comment"`
+}
+
+type KYCReviewResponse struct {
+	Document *graph.KYCDocument `json:"document"`
+	State    *kyc.State         `json:"state"`
+}
+
+// ReviewKYCDocument approves or rejects pending document and re-evaluates account KYC state
+func (s *AccountsServiceServer) ReviewKYCDocument(ctx context.Context, id string, req *KYCReviewRequest) (*KYCReviewResponse, error) {
+	log := s.log.Named("ReviewKYCDocument")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("document", id), zap.Any("request", req))
+
+	doc, err := graph.GetKYCDocument(ctx, s.db, id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Document not found")
+	}
+	if requester == doc.Account {
+		return nil, status.Error(codes.PermissionDenied, "Cannot review own documents")
+	}
+	// Namespace admins of the account aren't reviewers, only platform admins are
+	rootNs := driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY)
+	if !s.ca.HasAccess(ctx, requester, rootNs, access.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "NoAccess")
+	}
+	if !req.Approved && req.Comment == "" {
+		return nil, status.Error(codes.InvalidArgument, "Rejection requires comment")
+	}
+
+	st := kyc.DocumentRejected
+	if req.Approved {
+		st = kyc.DocumentApproved
+	}
+	doc, err = graph.ReviewKYCDocument(ctx, s.db, id, st, requester, req.Comment)
+	if err != nil {
+		if errors.Is(err, graph.ErrKYCDocumentReviewed) {
+			return nil, status.Error(codes.FailedPrecondition, "Document is already reviewed")
+		}
+		log.Error("Error reviewing document", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error reviewing document")
+	}
+
+	prev, _ := graph.GetKYCSubject(ctx, s.db, doc.Account)
+	subject, err := s.refreshKYC(ctx, graph.GetKYCSettings(log), doc.Account)
+	if err != nil {
+		log.Error("Error evaluating KYC", zap.String("account", doc.Account), zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error evaluating KYC")
+	}
+	logKYCEvent(log, doc, "reviewed", requester)
+
+	if !req.Approved {
+		s.sendEmail(doc.Account, "kyc_document_rejected", map[string]*structpb.Value{
+			"type":    structpb.NewStringValue(doc.Type),
+			"comment": structpb.NewStringValue(req.Comment),
+		})
+	} else if subject.State.Status == kyc.Verified && (prev == nil || prev.State == nil || prev.State.Status != kyc.Verified) {
+		s.sendEmail(doc.Account, "kyc_verified", map[string]*structpb.Value{
+			"expires_at": structpb.NewNumberValue(float64(subject.State.ExpiresAt)),
+		})
+	}
+	return &KYCReviewResponse{Document: doc, State: subject.State}, nil
+}
+
+// ListPendingKYCDocuments is reviewers queue
+func (s *AccountsServiceServer) ListPendingKYCDocuments(ctx context.Context) ([]graph.KYCDocument, error) {
+	log := s.log.Named("ListPendingKYCDocuments")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	rootNs := driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY)
+	if !s.ca.HasAccess(ctx, requester, rootNs, access.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "NoAccess")
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.KYC_DOCUMENTS_COL)
+	docs, err := graph.ListPendingKYCDocuments(ctx, s.db)
+	if err != nil {
+		log.Error("Error listing documents", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing documents")
+	}
+	return docs, nil
+}
+
+func (s *AccountsServiceServer) RegisterKYCRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/{uuid}/kyc", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGetKYCStatus))).Methods("GET")
+	router.Handle("/accounts/{uuid}/kyc/documents", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleUploadKYCDocument))).Methods("POST")
+	router.Handle("/kyc/pending", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListPendingKYC))).Methods("GET")
+	router.Handle("/kyc/documents/{id}/file", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleDownloadKYCDocument))).Methods("GET")
+	router.Handle("/kyc/documents/{id}/review", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleReviewKYCDocument))).Methods("POST")
+}
+
+func (s *AccountsServiceServer) HandleGetKYCStatus(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.GetKYCStatus(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+// Expects multipart form with type and file fields
+func (s *AccountsServiceServer) HandleUploadKYCDocument(writer http.ResponseWriter, request *http.Request) {
+	file, header, err := request.FormFile("file")
+	if err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	res, err := s.UploadKYCDocument(request.Context(), mux.Vars(request)["uuid"], &KYCUpload{
+		Type:        request.FormValue("type"),
+		Filename:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Body:        file,
+	})
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *AccountsServiceServer) HandleDownloadKYCDocument(writer http.ResponseWriter, request *http.Request) {
+	doc, r, err := s.OpenKYCDocument(request.Context(), mux.Vars(request)["id"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	defer r.Close()
+	writer.Header().Set("Content-Type", doc.ContentType)
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", doc.Filename))
+	writer.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(writer, r)
+}
+
+func (s *AccountsServiceServer) HandleReviewKYCDocument(writer http.ResponseWriter, request *http.Request) {
+	var req KYCReviewRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.ReviewKYCDocument(request.Context(), mux.Vars(request)["id"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *AccountsServiceServer) HandleListPendingKYC(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListPendingKYCDocuments(request.Context())
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
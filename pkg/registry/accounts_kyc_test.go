@@ -0,0 +1,35 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud-proto/access"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReviewKYCDocumentRequiresPlatformAdmin(t *testing.T) {
+	col := driver_mocks.NewMockCollection(t)
+	col.EXPECT().ReadDocument(mock.Anything, "doc", mock.Anything).Run(func(_ context.Context, _ string, result interface{}) {
+		*result.(*graph.KYCDocument) = graph.KYCDocument{Key: "doc", Account: "client"}
+	}).Return(driver.DocumentMeta{}, nil)
+	db := driver_mocks.NewMockDatabase(t)
+	db.EXPECT().Collection(mock.Anything, schema.KYC_DOCUMENTS_COL).Return(col, nil)
+
+	// Reseller administrating client's namespace has no access to root namespace
+	ca := graph_mocks.NewMockCommonActionsController(t)
+	ca.EXPECT().HasAccess(mock.Anything, "reseller", driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), access.Level_ADMIN).Return(false)
+	s := &AccountsServiceServer{db: db, ca: ca, log: zap.NewNop()}
+
+	_, err := s.ReviewKYCDocument(requesterContext("reseller"), "doc", &KYCReviewRequest{Approved: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/impersonation"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type MergeAccountsRequest struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Only report what would be moved
+	DryRun bool `json:"dry_run"`
+}
+
+type MergeAccountsResponse struct {
+	*graph.AccountMerge
+	DryRun bool `json:"dry_run"`
+}
+
+// MergeAccounts moves everything owned by source account to target and leaves redirect in place of source
+func (s *AccountsServiceServer) MergeAccounts(ctx context.Context, req *MergeAccountsRequest) (*MergeAccountsResponse, error) {
+	log := s.log.Named("MergeAccounts")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.Any("request", req))
+
+	if impersonation.FromContext(ctx) != nil {
+		return nil, status.Error(codes.PermissionDenied, "Cannot merge accounts from impersonated session")
+	}
+	rootNs := driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY)
+	if !s.ca.HasAccess(ctx, requester, rootNs, access.Level_ROOT) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to merge accounts")
+	}
+	if req.Source == "" || req.Target == "" || req.Source == req.Target {
+		return nil, status.Error(codes.InvalidArgument, "Source and target must be set and differ")
+	}
+	if req.Source == schema.ROOT_ACCOUNT_KEY {
+		return nil, status.Error(codes.InvalidArgument, "Root account cannot be merged")
+	}
+
+	source, err := s.ctrl.Get(ctx, req.Source)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Source account not found")
+	}
+	target, err := s.ctrl.Get(ctx, req.Target)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Target account not found")
+	}
+
+	res := &MergeAccountsResponse{DryRun: req.DryRun}
+	if req.DryRun {
+		res.AccountMerge, err = graph.PlanAccountMerge(ctx, s.db, source.Key, target.Key, s.cur_ctrl.Convert)
+	} else {
+		graph.GetEnsureCollection(log, ctx, s.db, schema.ACCOUNT_REDIRECTS_COL)
+		graph.GetEnsureCollection(log, ctx, s.db, schema.BILLING_PROFILES_COL)
+		res.AccountMerge, err = graph.MergeAccounts(ctx, s.db, source.Key, target.Key, s.cur_ctrl.Convert, graph.AccountRedirect{
+			MergedAt: time.Now().Unix(),
+			MergedBy: requester,
+		})
+	}
+	switch {
+	case errors.Is(err, graph.ErrMergePendingDeletion):
+		return nil, status.Error(codes.FailedPrecondition, "Cannot merge account pending deletion")
+	case errors.Is(err, graph.ErrMergeConversion):
+		log.Warn("Failed to convert balance", zap.Error(err))
+		return nil, status.Error(codes.FailedPrecondition, "No exchange rate between source and target currencies")
+	case err != nil:
+		log.Error("Failed to merge accounts", zap.Error(err), zap.Bool("dry_run", req.DryRun))
+		return nil, status.Error(codes.Internal, "Failed to merge accounts")
+	}
+	if req.DryRun {
+		return res, nil
+	}
+
+	s.revokeAllSessions(log, source.Key)
+
+	diff, _ := json.Marshal(res)
+	for _, acc := range []string{source.Key, target.Key} {
+		nocloud.Log(log, &elpb.Event{
+			Entity:    schema.ACCOUNTS_COL,
+			Uuid:      acc,
+			Scope:     "database",
+			Action:    "merged",
+			Rc:        0,
+			Requestor: requester,
+			Ts:        time.Now().Unix(),
+			Snapshot: &elpb.Snapshot{
+				Diff: string(diff),
+			},
+		})
+	}
+	return res, nil
+}
+
+func (s *AccountsServiceServer) RegisterMergeRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/merge", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleMergeAccounts))).Methods("POST")
+}
+
+func (s *AccountsServiceServer) HandleMergeAccounts(writer http.ResponseWriter, request *http.Request) {
+	var req MergeAccountsRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.MergeAccounts(request.Context(), &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud-proto/access"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type mergeFixture struct {
+	srv *AccountsServiceServer
+	db  *driver_mocks.MockDatabase
+	cur *graph_mocks.MockCurrencyController
+}
+
+func newMergeFixture(t *testing.T) *mergeFixture {
+	f := &mergeFixture{
+		db:  driver_mocks.NewMockDatabase(t),
+		cur: graph_mocks.NewMockCurrencyController(t),
+	}
+	ca := graph_mocks.NewMockCommonActionsController(t)
+	ca.EXPECT().HasAccess(mock.Anything, "admin", driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY), access.Level_ROOT).Return(true)
+	ctrl := graph_mocks.NewMockAccountsController(t)
+	ctrl.EXPECT().Get(mock.Anything, "src").Return(testAccount("src"), nil)
+	ctrl.EXPECT().Get(mock.Anything, "dst").Return(testAccount("dst"), nil)
+
+	f.srv = &AccountsServiceServer{db: f.db, ca: ca, ctrl: ctrl, cur_ctrl: f.cur, log: zap.NewNop()}
+	return f
+}
+
+func TestMergeAccountsDryRunConvertsBalance(t *testing.T) {
+	f := newMergeFixture(t)
+	f.db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(singleDocumentCursor(t, map[string]any{
+		"source":          "src",
+		"target":          "dst",
+		"source_balance":  10,
+		"source_currency": map[string]any{"id": 2, "code": "EUR"},
+	}), nil)
+	f.cur.EXPECT().Convert(mock.Anything, mock.Anything, mock.Anything, 10.0).Return(11.5, nil)
+
+	res, err := f.srv.MergeAccounts(requesterContext("admin"), &MergeAccountsRequest{Source: "src", Target: "dst", DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, 11.5, res.ConvertedBalance)
+	assert.Equal(t, "EUR", res.SourceCurrency.GetCode())
+	assert.Equal(t, int32(schema.DEFAULT_CURRENCY_ID), res.TargetCurrency.GetId())
+}
+
+func TestMergeAccountsPendingDeletion(t *testing.T) {
+	f := newMergeFixture(t)
+	f.db.EXPECT().CollectionExists(mock.Anything, schema.ACCOUNT_REDIRECTS_COL).Return(true, nil)
+	f.db.EXPECT().Collection(mock.Anything, schema.ACCOUNT_REDIRECTS_COL).Return(nil, nil)
+	f.db.EXPECT().CollectionExists(mock.Anything, schema.BILLING_PROFILES_COL).Return(true, nil)
+	f.db.EXPECT().Collection(mock.Anything, schema.BILLING_PROFILES_COL).Return(nil, nil)
+	// Only documents written are locked, billing collections are never locked exclusively
+	f.db.EXPECT().BeginTransaction(mock.Anything, mock.MatchedBy(func(cols driver.TransactionCollections) bool {
+		return len(cols.Exclusive) == 0 && slices.Contains(cols.Write, schema.INVOICES_COL) && slices.Contains(cols.Write, schema.BILLING_PROFILES_COL)
+	}), mock.Anything).Return(driver.TransactionID("tr"), nil)
+	f.db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(singleDocumentCursor(t, map[string]any{
+		"source":           "src",
+		"target":           "dst",
+		"source_balance":   10,
+		"pending_deletion": true,
+	}), nil)
+	f.db.EXPECT().AbortTransaction(mock.Anything, driver.TransactionID("tr"), mock.Anything).Return(nil)
+
+	_, err := f.srv.MergeAccounts(requesterContext("admin"), &MergeAccountsRequest{Source: "src", Target: "dst"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestMergeAccountsSameAccount(t *testing.T) {
+	ca := graph_mocks.NewMockCommonActionsController(t)
+	ca.EXPECT().HasAccess(mock.Anything, "admin", mock.Anything, access.Level_ROOT).Return(true)
+	s := &AccountsServiceServer{ca: ca, log: zap.NewNop()}
+
+	_, err := s.MergeAccounts(requesterContext("admin"), &MergeAccountsRequest{Source: "src", Target: "src"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
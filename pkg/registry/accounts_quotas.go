@@ -0,0 +1,131 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/quota"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var defaultQuotaSettings = &sc.Setting[quota.Config]{
+	Value:       quota.DefaultConfig(),
+	Description: "Account quotas: default, per account group and per namespace limits of instances, cpu, ram, disk, services and monthly_spend",
+	Level:       access.Level_ADMIN,
+}
+
+type QuotaReport struct {
+	Account      string       `json:"account"`
+	AccountGroup string       `json:"account_group"`
+	Namespace    string       `json:"namespace"`
+	Overrides    quota.Limits `json:"overrides"`
+	Items        []quota.Item `json:"items"`
+}
+
+// GetQuotaReport shows account usage against its effective limits
+func (s *AccountsServiceServer) GetQuotaReport(ctx context.Context, account string) (*QuotaReport, error) {
+	log := s.log.Named("GetQuotaReport")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	if !s.canManageAccountData(ctx, requester, account) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+
+	var conf quota.Config
+	if scErr := sc.Fetch(quota.SettingsKey, &conf, defaultQuotaSettings); scErr != nil {
+		log.Warn("Cannot fetch quota settings", zap.Error(scErr))
+		conf = defaultQuotaSettings.Value
+	}
+	subject, err := graph.GetQuotaSubject(ctx, s.db, account)
+	if err != nil {
+		log.Error("Error getting quota usage", zap.String("account", account), zap.Error(err))
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	return &QuotaReport{
+		Account:      account,
+		AccountGroup: subject.AccountGroup,
+		Namespace:    subject.Namespace,
+		Overrides:    subject.Overrides,
+		Items:        quota.Report(subject.Limits(conf), subject.Usage),
+	}, nil
+}
+
+// SetAccountQuota replaces account's own limits overriding group and namespace ones, negative value lifts inherited limit
+func (s *AccountsServiceServer) SetAccountQuota(ctx context.Context, account string, limits quota.Limits) (*QuotaReport, error) {
+	log := s.log.Named("SetAccountQuota")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("account", account), zap.Any("limits", limits))
+
+	if requester == account || !s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.ACCOUNTS_COL, account), access.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	for r := range limits {
+		if !slices.Contains(quota.Resources, r) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Unknown quota resource %s", r))
+		}
+	}
+
+	if err := graph.SetAccountQuota(ctx, s.db, account, limits); err != nil {
+		log.Error("Error setting account quota", zap.String("account", account), zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error setting account quota")
+	}
+	logRiskEvent(log, account, "quota", requester, limits)
+	return s.GetQuotaReport(ctx, account)
+}
+
+func (s *AccountsServiceServer) RegisterQuotaRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/{uuid}/quotas", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGetQuotaReport))).Methods("GET")
+	router.Handle("/accounts/{uuid}/quotas", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleSetAccountQuota))).Methods("PUT")
+}
+
+func (s *AccountsServiceServer) HandleGetQuotaReport(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.GetQuotaReport(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *AccountsServiceServer) HandleSetAccountQuota(writer http.ResponseWriter, request *http.Request) {
+	var limits quota.Limits
+	if err := json.NewDecoder(request.Body).Decode(&limits); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.SetAccountQuota(request.Context(), mux.Vars(request)["uuid"], limits)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
@@ -0,0 +1,528 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/credentials"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const accountRecoverySettingsKey = "account-recovery"
+
+type AccountRecoverySettings struct {
+	// Links sent in emails, $TOKEN is replaced with issued token
+	PasswordResetURL     string `json:"password_reset_url"`
+	EmailVerificationURL string `json:"email_verification_url"`
+
+	PasswordResetTTL     int64 `json:"password_reset_ttl"`     // seconds
+	EmailVerificationTTL int64 `json:"email_verification_ttl"` // seconds
+
+	// Max requests per account and per IP within RateLimitWindow
+	AccountRateLimit int64 `json:"account_rate_limit"`
+	IPRateLimit      int64 `json:"ip_rate_limit"`
+	RateLimitWindow  int64 `json:"rate_limit_window"` // seconds
+}
+
+var defaultAccountRecoverySettings = &sc.Setting[AccountRecoverySettings]{
+	Value: AccountRecoverySettings{
+		PasswordResetTTL:     3600,
+		EmailVerificationTTL: 86400,
+		AccountRateLimit:     3,
+		IPRateLimit:          10,
+		RateLimitWindow:      3600,
+	},
+	Description: "Password reset and email verification",
+	Level:       access.Level_ADMIN,
+}
+
+func getAccountRecoverySettings(log *zap.Logger) AccountRecoverySettings {
+	var conf AccountRecoverySettings
+	if scErr := sc.Fetch(accountRecoverySettingsKey, &conf, defaultAccountRecoverySettings); scErr != nil {
+		log.Warn("Cannot fetch account recovery settings", zap.Error(scErr))
+		conf = defaultAccountRecoverySettings.Value
+	}
+	return conf
+}
+
+const (
+	tokenPurposePasswordReset     = "password-reset"
+	tokenPurposeEmailVerification = "email-verification"
+)
+
+const accountTokenKeyTemplate = "registry-token-%s-%s"                // purpose, id
+const accountTokenAccountKeyTemplate = "registry-token-%s-account-%s" // purpose, account
+const rateLimitKeyTemplate = "registry-rate-%s-%s-%s"                 // action, subject kind, subject
+
+type accountToken struct {
+	Account string `json:"account"`
+	// Email the token was sent to, so token becomes invalid once email is changed
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"expires"`
+}
+
+var errInvalidAccountToken = status.Error(codes.InvalidArgument, "Token is invalid or expired")
+
+// Atomic GET + DEL, makes tokens single-use
+const consumeScript = `
+local v = redis.call('GET', KEYS[1])
+if v then redis.call('DEL', KEYS[1]) end
+return v
+`
+
+// INCR with window set on first hit, returns current counter
+const rateLimitScript = `
+local c = redis.call('INCR', KEYS[1])
+if c == 1 then redis.call('EXPIRE', KEYS[1], ARGV[1]) end
+return c
+`
+
+func (s *AccountsServiceServer) signAccountToken(purpose, id string, expires int64) string {
+	mac := hmac.New(sha256.New, s.SIGNING_KEY)
+	mac.Write([]byte(purpose + "." + id + "." + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue token for given purpose, previously issued token of the same purpose for the account is dropped
+func (s *AccountsServiceServer) issueAccountToken(ctx context.Context, purpose string, data accountToken, ttl time.Duration) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := crand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+	data.Expires = time.Now().Add(ttl).Unix()
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	accountKey := fmt.Sprintf(accountTokenAccountKeyTemplate, purpose, data.Account)
+	if old, err := s.rdb.Get(ctx, accountKey).Result(); err == nil && old != "" {
+		s.rdb.Del(ctx, fmt.Sprintf(accountTokenKeyTemplate, purpose, old))
+	}
+	if err = s.rdb.Set(ctx, fmt.Sprintf(accountTokenKeyTemplate, purpose, id), string(encoded), ttl).Err(); err != nil {
+		return "", err
+	}
+	if err = s.rdb.Set(ctx, accountKey, id, ttl).Err(); err != nil {
+		return "", err
+	}
+
+	return id + "." + strconv.FormatInt(data.Expires, 10) + "." + s.signAccountToken(purpose, id, data.Expires), nil
+}
+
+// Verify token signature and consume it, token can't be used again after this call
+func (s *AccountsServiceServer) consumeAccountToken(ctx context.Context, purpose, token string) (accountToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return accountToken{}, errInvalidAccountToken
+	}
+	id := parts[0]
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return accountToken{}, errInvalidAccountToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(s.signAccountToken(purpose, id, expires))) {
+		return accountToken{}, errInvalidAccountToken
+	}
+	if time.Now().Unix() > expires {
+		return accountToken{}, errInvalidAccountToken
+	}
+
+	res, err := s.rdb.Eval(ctx, consumeScript, []string{fmt.Sprintf(accountTokenKeyTemplate, purpose, id)}).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return accountToken{}, errInvalidAccountToken
+		}
+		return accountToken{}, status.Error(codes.Internal, "Failed to check token")
+	}
+	raw, ok := res.(string)
+	if !ok {
+		return accountToken{}, errInvalidAccountToken
+	}
+
+	var data accountToken
+	if err = json.Unmarshal([]byte(raw), &data); err != nil {
+		return accountToken{}, errInvalidAccountToken
+	}
+	s.rdb.Del(ctx, fmt.Sprintf(accountTokenAccountKeyTemplate, purpose, data.Account))
+	return data, nil
+}
+
+// Returns ResourceExhausted error if subject has exceeded the limit
+func (s *AccountsServiceServer) checkRateLimit(ctx context.Context, action, kind, subject string, limit int64, window time.Duration) error {
+	if subject == "" || limit <= 0 {
+		return nil
+	}
+	count, err := s.rdb.Eval(ctx, rateLimitScript, []string{fmt.Sprintf(rateLimitKeyTemplate, action, kind, subject)}, int64(window.Seconds())).Int64()
+	if err != nil {
+		// Failing closed, otherwise Redis outage lifts every limit
+		s.log.Error("Failed to check rate limit", zap.String("action", action), zap.Error(err))
+		return status.Error(codes.Unavailable, "Try again later.")
+	}
+	if count > limit {
+		return status.Error(codes.ResourceExhausted, "Too many requests. Try again later.")
+	}
+	return nil
+}
+
+const findAccountByLoginQuery = `
+LET by_username = (
+	FOR cred IN @@credentials
+	FILTER cred.username == @login
+	FOR account IN 1 INBOUND cred GRAPH @credentials_graph
+	RETURN account._key
+)
+LET by_email = (
+	FOR account IN @@accounts
+	FILTER LOWER(account.data.email) == LOWER(@login)
+	RETURN account._key
+)
+RETURN FIRST(UNION_DISTINCT(by_username, by_email))
+`
+
+func (s *AccountsServiceServer) findAccountByLogin(ctx context.Context, login string) (string, error) {
+	c, err := s.db.Query(ctx, findAccountByLoginQuery, map[string]interface{}{
+		"login":             login,
+		"@credentials":      schema.CREDENTIALS_COL,
+		"@accounts":         schema.ACCOUNTS_COL,
+		"credentials_graph": schema.CREDENTIALS_GRAPH.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	var key *string
+	if _, err = c.ReadDocument(ctx, &key); err != nil {
+		return "", err
+	}
+	if key == nil {
+		return "", nil
+	}
+	return *key, nil
+}
+
+func accountEmail(acc graph.Account) string {
+	if acc.GetData() == nil {
+		return ""
+	}
+	email, _ := acc.GetData().AsMap()["email"].(string)
+	return email
+}
+
+func tokenLink(template, token string) string {
+	if template == "" {
+		return ""
+	}
+	return strings.ReplaceAll(template, "$TOKEN", token)
+}
+
+// RequestPasswordReset sends password reset link to account found by username or email
+// Unknown logins are not reported to the caller, so accounts can't be enumerated
+func (s *AccountsServiceServer) RequestPasswordReset(ctx context.Context, login, ip string) error {
+	log := s.log.Named("RequestPasswordReset")
+	conf := getAccountRecoverySettings(log)
+	window := time.Duration(conf.RateLimitWindow) * time.Second
+
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return status.Error(codes.InvalidArgument, "Login is required")
+	}
+	if err := s.checkRateLimit(ctx, tokenPurposePasswordReset, "ip", ip, conf.IPRateLimit, window); err != nil {
+		return err
+	}
+
+	key, err := s.findAccountByLogin(ctx, login)
+	if err != nil {
+		log.Error("Failed to find account", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to request password reset")
+	}
+	if key == "" {
+		log.Debug("Account not found", zap.String("login", login))
+		return nil
+	}
+	if err := s.checkRateLimit(ctx, tokenPurposePasswordReset, "account", key, conf.AccountRateLimit, window); err != nil {
+		return err
+	}
+
+	acc, err := s.ctrl.Get(ctx, key)
+	if err != nil {
+		log.Error("Failed to get account", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to request password reset")
+	}
+	edge, _ := s.db.Collection(ctx, schema.ACC2CRED)
+	if _, has := s.ctrl.GetCredentials(ctx, edge, acc, "standard"); !has {
+		log.Debug("Account has no standard credentials", zap.String("account", key))
+		return nil
+	}
+
+	ttl := time.Duration(conf.PasswordResetTTL) * time.Second
+	token, err := s.issueAccountToken(ctx, tokenPurposePasswordReset, accountToken{Account: acc.Key, Email: accountEmail(acc)}, ttl)
+	if err != nil {
+		log.Error("Failed to issue token", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to request password reset")
+	}
+
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      acc.Key,
+		Scope:     "database",
+		Action:    "password_reset_requested",
+		Rc:        0,
+		Requestor: acc.Key,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: "IP: " + ip,
+		},
+	})
+	s.sendEmail(acc.Key, "password_reset", map[string]*structpb.Value{
+		"token":   structpb.NewStringValue(token),
+		"link":    structpb.NewStringValue(tokenLink(conf.PasswordResetURL, token)),
+		"expires": structpb.NewNumberValue(float64(time.Now().Add(ttl).Unix())),
+		"ip":      structpb.NewStringValue(ip),
+	})
+	return nil
+}
+
+// ConfirmPasswordReset sets new password and revokes all account sessions
+func (s *AccountsServiceServer) ConfirmPasswordReset(ctx context.Context, token, password string) error {
+	log := s.log.Named("ConfirmPasswordReset")
+
+	if password == "" {
+		return status.Error(codes.InvalidArgument, "Password is required")
+	}
+	data, err := s.consumeAccountToken(ctx, tokenPurposePasswordReset, token)
+	if err != nil {
+		return err
+	}
+
+	acc, err := s.ctrl.Get(ctx, data.Account)
+	if err != nil {
+		log.Error("Failed to get account", zap.Error(err))
+		return errInvalidAccountToken
+	}
+	// Link sent to the previous email must not work once email is changed
+	if email := accountEmail(acc); email == "" || !strings.EqualFold(email, data.Email) {
+		log.Info("Token email doesn't match account email", zap.String("account", acc.Key))
+		return errInvalidAccountToken
+	}
+	edge, _ := s.db.Collection(ctx, schema.ACC2CRED)
+	credKey, has := s.ctrl.GetCredentials(ctx, edge, acc, "standard")
+	if !has {
+		return errInvalidAccountToken
+	}
+
+	credCol, _ := s.db.Collection(ctx, schema.CREDENTIALS_COL)
+	var old credentials.StandardCredentials
+	if err = old.FindByKey(ctx, credCol, credKey); err != nil {
+		log.Error("Failed to get credentials", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to reset password")
+	}
+	cred, err := credentials.NewStandardCredentials([]string{old.Username, password})
+	if err != nil {
+		log.Error("Failed to create credentials", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to reset password")
+	}
+	if err = s.ctrl.UpdateCredentials(ctx, credKey, cred); err != nil {
+		log.Error("Failed to update credentials", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to reset password")
+	}
+
+	s.revokeAllSessions(log, acc.Key)
+
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      acc.Key,
+		Scope:     "database",
+		Action:    "password_reset",
+		Rc:        0,
+		Requestor: acc.Key,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: "",
+		},
+	})
+	s.sendEmail(acc.Key, "password_changed", nil)
+	return nil
+}
+
+func (s *AccountsServiceServer) revokeAllSessions(log *zap.Logger, account string) {
+	if _, err := sessions.RevokeAll(s.rdb, account); err != nil {
+		log.Error("Failed to revoke sessions", zap.String("account", account), zap.Error(err))
+	}
+}
+
+// RequestEmailVerification sends verification link to current account email
+func (s *AccountsServiceServer) RequestEmailVerification(ctx context.Context, acc graph.Account, ip string) error {
+	log := s.log.Named("RequestEmailVerification")
+	conf := getAccountRecoverySettings(log)
+	window := time.Duration(conf.RateLimitWindow) * time.Second
+
+	if acc.GetIsEmailVerified() {
+		return status.Error(codes.FailedPrecondition, "Email is already verified")
+	}
+	email := accountEmail(acc)
+	if email == "" {
+		return status.Error(codes.FailedPrecondition, "Account has no email")
+	}
+	if err := s.checkRateLimit(ctx, tokenPurposeEmailVerification, "ip", ip, conf.IPRateLimit, window); err != nil {
+		return err
+	}
+	if err := s.checkRateLimit(ctx, tokenPurposeEmailVerification, "account", acc.Key, conf.AccountRateLimit, window); err != nil {
+		return err
+	}
+
+	ttl := time.Duration(conf.EmailVerificationTTL) * time.Second
+	token, err := s.issueAccountToken(ctx, tokenPurposeEmailVerification, accountToken{Account: acc.Key, Email: email}, ttl)
+	if err != nil {
+		log.Error("Failed to issue token", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to request email verification")
+	}
+
+	s.sendEmail(acc.Key, "email_verification", map[string]*structpb.Value{
+		"token":   structpb.NewStringValue(token),
+		"link":    structpb.NewStringValue(tokenLink(conf.EmailVerificationURL, token)),
+		"expires": structpb.NewNumberValue(float64(time.Now().Add(ttl).Unix())),
+		"email":   structpb.NewStringValue(email),
+	})
+	return nil
+}
+
+// VerifyEmail marks account email as verified if token was issued for the current email
+func (s *AccountsServiceServer) VerifyEmail(ctx context.Context, token string) error {
+	return s.verifyEmail(ctx, token, "")
+}
+
+// If expectedAccount is set, token issued for another account is rejected
+func (s *AccountsServiceServer) verifyEmail(ctx context.Context, token, expectedAccount string) error {
+	log := s.log.Named("VerifyEmail")
+
+	data, err := s.consumeAccountToken(ctx, tokenPurposeEmailVerification, token)
+	if err != nil {
+		return err
+	}
+	if expectedAccount != "" && data.Account != expectedAccount {
+		return errInvalidAccountToken
+	}
+	acc, err := s.ctrl.Get(ctx, data.Account)
+	if err != nil {
+		log.Error("Failed to get account", zap.Error(err))
+		return errInvalidAccountToken
+	}
+	email := accountEmail(acc)
+	if email == "" || !strings.EqualFold(email, data.Email) {
+		return errInvalidAccountToken
+	}
+	if err = s.ctrl.Update(ctx, acc, map[string]interface{}{"is_email_verified": true}); err != nil {
+		log.Error("Failed to update account", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to verify email")
+	}
+
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      acc.Key,
+		Scope:     "database",
+		Action:    "email_verified",
+		Rc:        0,
+		Requestor: acc.Key,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: "Email: " + email,
+		},
+	})
+	return nil
+}
+
+func (s *AccountsServiceServer) RegisterRecoveryRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	subRouter := router.PathPrefix("/accounts").Subrouter()
+	subRouter.HandleFunc("/password/reset", s.HandleRequestPasswordReset).Methods("POST")
+	subRouter.HandleFunc("/password/reset/confirm", s.HandleConfirmPasswordReset).Methods("POST")
+	subRouter.Handle("/email/verify/request", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleRequestEmailVerification))).Methods("POST")
+	subRouter.HandleFunc("/email/verify", s.HandleVerifyEmail).Methods("POST")
+}
+
+func (s *AccountsServiceServer) HandleRequestPasswordReset(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	http_server.WriteResult(writer, s.RequestPasswordReset(request.Context(), req.Login, http_server.ClientIP(request)))
+}
+
+func (s *AccountsServiceServer) HandleConfirmPasswordReset(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	http_server.WriteResult(writer, s.ConfirmPasswordReset(request.Context(), req.Token, req.Password))
+}
+
+func (s *AccountsServiceServer) HandleRequestEmailVerification(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	requester, _ := ctx.Value(nocloud.NoCloudAccount).(string)
+	acc, err := s.ctrl.Get(ctx, requester)
+	if err != nil {
+		http.Error(writer, "Account not found", http.StatusNotFound)
+		return
+	}
+	http_server.WriteResult(writer, s.RequestEmailVerification(ctx, acc, http_server.ClientIP(request)))
+}
+
+func (s *AccountsServiceServer) HandleVerifyEmail(writer http.ResponseWriter, request *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	http_server.WriteResult(writer, s.VerifyEmail(request.Context(), req.Token))
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	redisdb_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCheckRateLimit(t *testing.T) {
+	key := fmt.Sprintf(rateLimitKeyTemplate, tokenPurposePasswordReset, "ip", "203.0.113.7")
+
+	t.Run("under limit", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().Eval(mock.Anything, rateLimitScript, []string{key}, int64(60)).Return(redis.NewCmdResult(int64(3), nil))
+		s := &AccountsServiceServer{rdb: rdb, log: zap.NewNop()}
+
+		assert.NoError(t, s.checkRateLimit(context.Background(), tokenPurposePasswordReset, "ip", "203.0.113.7", 3, time.Minute))
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().Eval(mock.Anything, rateLimitScript, []string{key}, int64(60)).Return(redis.NewCmdResult(int64(4), nil))
+		s := &AccountsServiceServer{rdb: rdb, log: zap.NewNop()}
+
+		err := s.checkRateLimit(context.Background(), tokenPurposePasswordReset, "ip", "203.0.113.7", 3, time.Minute)
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("redis unavailable", func(t *testing.T) {
+		rdb := redisdb_mocks.NewMockClient(t)
+		rdb.EXPECT().Eval(mock.Anything, rateLimitScript, []string{key}, int64(60)).Return(redis.NewCmdResult(nil, errors.New("connection refused")))
+		s := &AccountsServiceServer{rdb: rdb, log: zap.NewNop()}
+
+		err := s.checkRateLimit(context.Background(), tokenPurposePasswordReset, "ip", "203.0.113.7", 3, time.Minute)
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+func TestConfirmPasswordResetRejectsChangedEmail(t *testing.T) {
+	rdb := redisdb_mocks.NewMockClient(t)
+	ctrl := graph_mocks.NewMockAccountsController(t)
+	s := &AccountsServiceServer{rdb: rdb, ctrl: ctrl, log: zap.NewNop(), SIGNING_KEY: []byte("key")}
+
+	expires := time.Now().Add(time.Hour).Unix()
+	raw, err := json.Marshal(accountToken{Account: "acc", Email: "old@example.com", Expires: expires})
+	require.NoError(t, err)
+	token := "id." + strconv.FormatInt(expires, 10) + "." + s.signAccountToken(tokenPurposePasswordReset, "id", expires)
+
+	rdb.EXPECT().Eval(mock.Anything, consumeScript, []string{fmt.Sprintf(accountTokenKeyTemplate, tokenPurposePasswordReset, "id")}).
+		Return(redis.NewCmdResult(string(raw), nil))
+	rdb.EXPECT().Del(mock.Anything, fmt.Sprintf(accountTokenAccountKeyTemplate, tokenPurposePasswordReset, "acc")).
+		Return(redis.NewIntResult(1, nil))
+
+	acc := testAccount("acc")
+	acc.Data, err = structpb.NewStruct(map[string]any{"email": "new@example.com"})
+	require.NoError(t, err)
+	ctrl.EXPECT().Get(mock.Anything, "acc").Return(acc, nil)
+
+	err = s.ConfirmPasswordReset(context.Background(), token, "new-password")
+	assert.Equal(t, errInvalidAccountToken, err)
+	ctrl.AssertNotCalled(t, "UpdateCredentials", mock.Anything, mock.Anything, mock.Anything)
+}
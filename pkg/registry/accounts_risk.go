@@ -0,0 +1,248 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	accountspb "github.com/slntopp/nocloud-proto/registry/accounts"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/risk"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var defaultRiskSettings = &sc.Setting[risk.Config]{
+	Value:       risk.DefaultConfig(),
+	Description: "Signup and first order risk screening",
+	Level:       access.Level_ADMIN,
+}
+
+func getRiskSettings(log *zap.Logger) risk.Config {
+	var conf risk.Config
+	if scErr := sc.Fetch(risk.SettingsKey, &conf, defaultRiskSettings); scErr != nil {
+		log.Warn("Cannot fetch signup-risk settings", zap.Error(scErr))
+		conf = defaultRiskSettings.Value
+	}
+	return conf
+}
+
+// screenSignup scores registration before account is created, nil if screening is disabled
+func (s *AccountsServiceServer) screenSignup(ctx context.Context, log *zap.Logger, data map[string]interface{}) *risk.Assessment {
+	conf := getRiskSettings(log)
+	if !conf.Enabled {
+		return nil
+	}
+	in := graph.RiskInput(risk.StageSignup, "", data)
+	in.IP = http_server.GRPCClientIP(ctx)
+	in.IPCountry = incomingHeader(ctx, conf.CountryHeader)
+	in.Device = incomingHeader(ctx, conf.DeviceHeader)
+
+	a := conf.Pipeline(risk.NewRedisCounter(s.rdb), graph.NewRiskDuplicateLookup(s.db)).Evaluate(ctx, in)
+	if len(a.Errors) > 0 {
+		log.Warn("Some risk checks failed", zap.Strings("errors", a.Errors))
+	}
+	log.Info("Signup screened", zap.Int("score", a.Score), zap.String("decision", string(a.Decision)), zap.Any("reasons", a.Reasons))
+	return a
+}
+
+// storeRiskAssessment saves assessment on account and holds it if needed
+func (s *AccountsServiceServer) storeRiskAssessment(ctx context.Context, log *zap.Logger, acc graph.Account, a *risk.Assessment) {
+	if a == nil {
+		return
+	}
+	profile := &graph.RiskProfile{}
+	profile.Add(a)
+	if err := graph.SetAccountRisk(ctx, s.db, acc.Key, profile); err != nil {
+		log.Error("Error storing risk assessment", zap.String("account", acc.Key), zap.Error(err))
+	}
+	if a.Decision == risk.Hold {
+		if err := s.ctrl.Update(ctx, acc, map[string]interface{}{
+			"status":    accountspb.AccountStatus_LOCK,
+			"suspended": true,
+		}); err != nil {
+			log.Error("Error holding account", zap.String("account", acc.Key), zap.Error(err))
+		}
+	}
+	logRiskEvent(log, acc.Key, "risk_assessed", acc.Key, a)
+}
+
+func logRiskEvent(log *zap.Logger, account, action, requester string, diff any) {
+	snapshot, _ := json.Marshal(diff)
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      account,
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: string(snapshot),
+		},
+	})
+}
+
+func (s *AccountsServiceServer) GetAccountRisk(ctx context.Context, uuid string) (*graph.RiskProfile, error) {
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	acc, err := s.ctrl.Get(ctx, uuid)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	if !s.ca.HasAccess(ctx, requester, acc.ID, access.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "NoAccess")
+	}
+	profile, err := graph.GetAccountRisk(ctx, s.db, acc.Key)
+	if err != nil {
+		s.log.Error("Error getting risk profile", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error getting risk profile")
+	}
+	if profile == nil {
+		return nil, status.Error(codes.NotFound, "Account wasn't screened")
+	}
+	return profile, nil
+}
+
+// ListHeldAccounts returns accounts waiting for manual review
+func (s *AccountsServiceServer) ListHeldAccounts(ctx context.Context) ([]graph.HeldAccount, error) {
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	rootNs := driver.NewDocumentID(schema.NAMESPACES_COL, schema.ROOT_NAMESPACE_KEY)
+	if !s.ca.HasAccess(ctx, requester, rootNs, access.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "NoAccess")
+	}
+	held, err := graph.ListHeldAccounts(ctx, s.db)
+	if err != nil {
+		s.log.Error("Error listing held accounts", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing held accounts")
+	}
+	return held, nil
+}
+
+type RiskReviewRequest struct {
+	Approved bool   `json:"approved"`
+	Comment  string `json:"comment"`
+}
+
+// ReviewAccountRisk resolves hold or verification requirement, rejected accounts stay locked and suspended
+func (s *AccountsServiceServer) ReviewAccountRisk(ctx context.Context, uuid string, req *RiskReviewRequest) (*graph.RiskProfile, error) {
+	log := s.log.Named("ReviewAccountRisk")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("account", uuid), zap.Any("request", req))
+
+	if requester == uuid {
+		return nil, status.Error(codes.PermissionDenied, "Cannot review own account")
+	}
+	acc, err := s.ctrl.Get(ctx, uuid)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	if !s.ca.HasAccess(ctx, requester, acc.ID, access.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "NoAccess")
+	}
+	profile, err := graph.GetAccountRisk(ctx, s.db, acc.Key)
+	if err != nil {
+		log.Error("Error getting risk profile", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error getting risk profile")
+	}
+	if profile == nil {
+		return nil, status.Error(codes.FailedPrecondition, "Account wasn't screened")
+	}
+
+	wasHeld := profile.Effective() == risk.Hold
+	profile.Review = &graph.RiskReview{
+		Approved:   req.Approved,
+		Comment:    req.Comment,
+		ReviewedBy: requester,
+		ReviewedAt: time.Now().Unix(),
+	}
+	if err := graph.SetAccountRisk(ctx, s.db, acc.Key, profile); err != nil {
+		log.Error("Error storing review", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error storing review")
+	}
+
+	patch := map[string]interface{}{}
+	if req.Approved && wasHeld {
+		patch["status"] = accountspb.AccountStatus_ACTIVE
+		patch["suspended"] = false
+	} else if !req.Approved {
+		patch["status"] = accountspb.AccountStatus_LOCK
+		patch["suspended"] = true
+	}
+	if len(patch) > 0 {
+		if err := s.ctrl.Update(ctx, acc, patch); err != nil {
+			log.Error("Error updating account", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error updating account")
+		}
+	}
+	if !req.Approved {
+		s.revokeAllSessions(log, acc.Key)
+	}
+
+	logRiskEvent(log, acc.Key, "risk_reviewed", requester, profile.Review)
+	return profile, nil
+}
+
+func (s *AccountsServiceServer) RegisterRiskRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/risk/held", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListHeldAccounts))).Methods("GET")
+	router.Handle("/accounts/{uuid}/risk", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleGetAccountRisk))).Methods("GET")
+	router.Handle("/accounts/{uuid}/risk/review", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleReviewAccountRisk))).Methods("POST")
+}
+
+func (s *AccountsServiceServer) HandleListHeldAccounts(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListHeldAccounts(request.Context())
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *AccountsServiceServer) HandleGetAccountRisk(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.GetAccountRisk(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *AccountsServiceServer) HandleReviewAccountRisk(writer http.ResponseWriter, request *http.Request) {
+	var req RiskReviewRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.ReviewAccountRisk(request.Context(), mux.Vars(request)["uuid"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
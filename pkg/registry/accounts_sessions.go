@@ -0,0 +1,143 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	sspb "github.com/slntopp/nocloud-proto/sessions"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const sessionsSettingsKey = "sessions"
+
+type SessionsSettings struct {
+	// Seconds of inactivity after which session is revoked, 0 disables
+	IdleTimeout int64 `json:"idle_timeout"`
+	// Max concurrent sessions per account, oldest are revoked on login, 0 means unlimited
+	MaxConcurrent int `json:"max_concurrent"`
+	// Overrides MaxConcurrent for account groups, keyed by account group UUID
+	GroupMaxConcurrent map[string]int `json:"group_max_concurrent"`
+	// Send email on login from device account hasn't used before
+	NotifyUnknownDevice bool `json:"notify_unknown_device"`
+}
+
+var defaultSessionsSettings = &sc.Setting[SessionsSettings]{
+	Value: SessionsSettings{
+		IdleTimeout:         0,
+		MaxConcurrent:       0,
+		GroupMaxConcurrent:  map[string]int{},
+		NotifyUnknownDevice: true,
+	},
+	Description: "Sessions idle timeout, concurrent sessions limits and notifications",
+	Level:       access.Level_ADMIN,
+}
+
+func (c SessionsSettings) maxConcurrent(group string) int {
+	if limit, ok := c.GroupMaxConcurrent[group]; ok {
+		return limit
+	}
+	return c.MaxConcurrent
+}
+
+func incomingHeader(ctx context.Context, names ...string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, name := range names {
+		// grpc-gateway forwards HTTP headers prefixed with grpcgateway-
+		for _, key := range []string{"grpcgateway-" + name, name} {
+			if v := md.Get(key); len(v) > 0 && v[0] != "" {
+				return v[0]
+			}
+		}
+	}
+	return ""
+}
+
+// Store session metadata, apply concurrent sessions limit and notify about unknown device
+func (s *AccountsServiceServer) onSessionCreated(ctx context.Context, log *zap.Logger, acc graph.Account, session *sspb.Session, method string) {
+	var conf SessionsSettings
+	if scErr := sc.Fetch(sessionsSettingsKey, &conf, defaultSessionsSettings); scErr != nil {
+		log.Warn("Cannot fetch sessions settings", zap.Error(scErr))
+		conf = defaultSessionsSettings.Value
+	}
+
+	meta := sessions.Metadata{
+		IP:          http_server.GRPCClientIP(ctx),
+		UserAgent:   incomingHeader(ctx, "user-agent"),
+		Country:     strings.ToUpper(incomingHeader(ctx, "cf-ipcountry", "x-geo-country")),
+		City:        incomingHeader(ctx, "x-geo-city"),
+		Method:      method,
+		IdleTimeout: conf.IdleTimeout,
+	}
+	meta.Device = sessions.DeviceFingerprint(meta.UserAgent, meta.Country)
+	if err := sessions.StoreMetadata(s.rdb, acc.Key, session, meta); err != nil {
+		log.Error("Failed to store session metadata", zap.Error(err))
+	}
+
+	evicted, err := sessions.EnforceLimit(s.rdb, acc.Key, conf.maxConcurrent(acc.GetAccountGroup()), session.GetId())
+	if err != nil {
+		log.Error("Failed to enforce sessions limit", zap.Error(err))
+	}
+	if len(evicted) > 0 {
+		nocloud.Log(log, &elpb.Event{
+			Entity:    schema.ACCOUNTS_COL,
+			Uuid:      acc.Key,
+			Scope:     "database",
+			Action:    "sessions_evicted",
+			Rc:        0,
+			Requestor: acc.Key,
+			Ts:        time.Now().Unix(),
+			Snapshot: &elpb.Snapshot{
+				Diff: "Sessions: " + strings.Join(evicted, ","),
+			},
+		})
+	}
+
+	// Sudo tokens are issued for already authenticated users
+	if method == "sudo" || !conf.NotifyUnknownDevice {
+		return
+	}
+	unknown, err := sessions.RememberDevice(s.rdb, acc.Key, meta.Device)
+	if err != nil {
+		log.Error("Failed to remember device", zap.Error(err))
+		return
+	}
+	if unknown {
+		s.sendEmail(acc.Key, "new_device_login", map[string]*structpb.Value{
+			"ip":         structpb.NewStringValue(meta.IP),
+			"user_agent": structpb.NewStringValue(meta.UserAgent),
+			"country":    structpb.NewStringValue(meta.Country),
+			"city":       structpb.NewStringValue(meta.City),
+			"method":     structpb.NewStringValue(meta.Method),
+			"ts":         structpb.NewNumberValue(float64(time.Now().Unix())),
+		})
+	}
+}
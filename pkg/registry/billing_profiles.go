@@ -0,0 +1,293 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Fields of billing profile data set by users, the rest is computed
+var billingProfileFields = []string{"company", "address", "city", "postal_code", "country", "tax_id", "phone"}
+
+type BillingProfileRequest struct {
+	Title    string            `json:"title"`
+	Default  bool              `json:"default"`
+	Data     map[string]string `json:"data"`
+	Currency int32             `json:"currency"`
+	Emails   []string          `json:"emails"`
+}
+
+type BillingProfileSelection struct {
+	// Empty profile removes selection, so default profile applies
+	Profile        string `json:"profile"`
+	Service        string `json:"service"`
+	InstancesGroup string `json:"instances_group"`
+}
+
+// prepareBillingProfile copies request into profile and recalculates tax the same way as for account data
+func (s *AccountsServiceServer) prepareBillingProfile(ctx context.Context, log *zap.Logger, p *graph.BillingProfile, req *BillingProfileRequest) error {
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		return status.Error(codes.InvalidArgument, "Title is required")
+	}
+	emails := make([]string, 0, len(req.Emails))
+	for _, e := range req.Emails {
+		addr, err := mail.ParseAddress(strings.TrimSpace(e))
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid email %q", e)
+		}
+		emails = append(emails, addr.Address)
+	}
+	if req.Currency != 0 {
+		if _, err := s.cur_ctrl.Get(ctx, req.Currency); err != nil {
+			return status.Error(codes.InvalidArgument, "Currency not found")
+		}
+	}
+
+	data := map[string]interface{}{}
+	for _, k := range billingProfileFields {
+		if v := strings.TrimSpace(req.Data[k]); v != "" {
+			data[k] = v
+		}
+	}
+	// Keep cached VAT ID check if number didn't change
+	if prev, ok := p.Data[taxIDValidationKey]; ok {
+		data[taxIDValidationKey] = prev
+	}
+	if res := s.validateTaxID(ctx, log, data, false); res != nil {
+		s.recordTaxIDValidation(ctx, log, p.Account, ctx.Value(nocloud.NoCloudAccount).(string), res)
+	}
+	applyTaxRate(data)
+
+	p.Title = title
+	p.Data = data
+	p.Currency = req.Currency
+	p.Emails = emails
+	return nil
+}
+
+func (s *AccountsServiceServer) ListBillingProfiles(ctx context.Context, account string) ([]graph.BillingProfile, error) {
+	log := s.log.Named("ListBillingProfiles")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	if !s.canManageAccountData(ctx, requester, account) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.BILLING_PROFILES_COL)
+	profiles, err := graph.ListBillingProfiles(ctx, s.db, account)
+	if err != nil {
+		log.Error("Error listing billing profiles", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing billing profiles")
+	}
+	return profiles, nil
+}
+
+func (s *AccountsServiceServer) CreateBillingProfile(ctx context.Context, account string, req *BillingProfileRequest) (*graph.BillingProfile, error) {
+	log := s.log.Named("CreateBillingProfile")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("account", account))
+	if !s.canManageAccountData(ctx, requester, account) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.BILLING_PROFILES_COL)
+
+	p := &graph.BillingProfile{Account: account}
+	if err := s.prepareBillingProfile(ctx, log, p, req); err != nil {
+		return nil, err
+	}
+	p, err := graph.CreateBillingProfile(ctx, s.db, p)
+	if err != nil {
+		log.Error("Error creating billing profile", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error creating billing profile")
+	}
+	if req.Default {
+		if err := graph.SetDefaultBillingProfile(ctx, s.db, account, p.Key); err != nil {
+			log.Error("Error setting default billing profile", zap.Error(err))
+		}
+		p.Default = true
+	}
+	logRiskEvent(log, account, "billing_profile_created", requester, p)
+	return p, nil
+}
+
+func (s *AccountsServiceServer) getOwnBillingProfile(ctx context.Context, requester, id string) (*graph.BillingProfile, error) {
+	p, err := graph.GetBillingProfile(ctx, s.db, id)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Billing profile not found")
+	}
+	if !s.canManageAccountData(ctx, requester, p.Account) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	return p, nil
+}
+
+func (s *AccountsServiceServer) UpdateBillingProfile(ctx context.Context, id string, req *BillingProfileRequest) (*graph.BillingProfile, error) {
+	log := s.log.Named("UpdateBillingProfile")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("profile", id))
+
+	p, err := s.getOwnBillingProfile(ctx, requester, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.prepareBillingProfile(ctx, log, p, req); err != nil {
+		return nil, err
+	}
+	if err := graph.UpdateBillingProfile(ctx, s.db, p); err != nil {
+		log.Error("Error updating billing profile", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error updating billing profile")
+	}
+	if req.Default != p.Default {
+		key := ""
+		if req.Default {
+			key = p.Key
+		}
+		if err := graph.SetDefaultBillingProfile(ctx, s.db, p.Account, key); err != nil {
+			log.Error("Error setting default billing profile", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error setting default billing profile")
+		}
+		p.Default = req.Default
+	}
+	logRiskEvent(log, p.Account, "billing_profile_updated", requester, p)
+	return p, nil
+}
+
+// DeleteBillingProfile removes profile, services and groups it was selected for fall back to default profile
+func (s *AccountsServiceServer) DeleteBillingProfile(ctx context.Context, id string) error {
+	log := s.log.Named("DeleteBillingProfile")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	p, err := s.getOwnBillingProfile(ctx, requester, id)
+	if err != nil {
+		return err
+	}
+	if err := graph.DeleteBillingProfile(ctx, s.db, id); err != nil {
+		log.Error("Error deleting billing profile", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting billing profile")
+	}
+	logRiskEvent(log, p.Account, "billing_profile_deleted", requester, p)
+	return nil
+}
+
+// SelectBillingProfile sets profile used for invoices of service or instances group
+func (s *AccountsServiceServer) SelectBillingProfile(ctx context.Context, account string, req *BillingProfileSelection) error {
+	log := s.log.Named("SelectBillingProfile")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("account", account), zap.Any("request", req))
+
+	if !s.canManageAccountData(ctx, requester, account) {
+		return status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	if (req.Service == "") == (req.InstancesGroup == "") {
+		return status.Error(codes.InvalidArgument, "Either service or instances_group must be set")
+	}
+	isGroup := req.InstancesGroup != ""
+	target, node := req.Service, driver.NewDocumentID(schema.SERVICES_COL, req.Service)
+	if isGroup {
+		target, node = req.InstancesGroup, driver.NewDocumentID(schema.INSTANCES_GROUPS_COL, req.InstancesGroup)
+	}
+	// Account itself must manage the target, not only requester
+	if !s.ca.HasAccess(ctx, account, node, access.Level_MGMT) || !s.ca.HasAccess(ctx, requester, node, access.Level_MGMT) {
+		return status.Error(codes.PermissionDenied, "Not enough access rights to "+node.Collection())
+	}
+	if req.Profile != "" {
+		p, err := graph.GetBillingProfile(ctx, s.db, req.Profile)
+		if err != nil || p.Account != account {
+			return status.Error(codes.NotFound, "Billing profile not found")
+		}
+	}
+	graph.GetEnsureCollection(log, ctx, s.db, schema.BILLING_PROFILES_COL)
+	if err := graph.SelectBillingProfile(ctx, s.db, account, req.Profile, isGroup, target); err != nil {
+		log.Error("Error selecting billing profile", zap.Error(err))
+		return status.Error(codes.Internal, "Error selecting billing profile")
+	}
+	logRiskEvent(log, account, "billing_profile_selected", requester, req)
+	return nil
+}
+
+func (s *AccountsServiceServer) RegisterBillingProfileRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/{uuid}/billing_profiles", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListBillingProfiles))).Methods("GET")
+	router.Handle("/accounts/{uuid}/billing_profiles", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleCreateBillingProfile))).Methods("POST")
+	router.Handle("/accounts/{uuid}/billing_profiles/select", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleSelectBillingProfile))).Methods("POST")
+	router.Handle("/billing_profiles/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleUpdateBillingProfile))).Methods("PUT")
+	router.Handle("/billing_profiles/{id}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleDeleteBillingProfile))).Methods("DELETE")
+}
+
+func (s *AccountsServiceServer) HandleListBillingProfiles(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListBillingProfiles(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *AccountsServiceServer) HandleCreateBillingProfile(writer http.ResponseWriter, request *http.Request) {
+	var req BillingProfileRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.CreateBillingProfile(request.Context(), mux.Vars(request)["uuid"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *AccountsServiceServer) HandleUpdateBillingProfile(writer http.ResponseWriter, request *http.Request) {
+	var req BillingProfileRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.UpdateBillingProfile(request.Context(), mux.Vars(request)["id"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *AccountsServiceServer) HandleDeleteBillingProfile(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.DeleteBillingProfile(request.Context(), mux.Vars(request)["id"]))
+}
+
+func (s *AccountsServiceServer) HandleSelectBillingProfile(writer http.ResponseWriter, request *http.Request) {
+	var req BillingProfileSelection
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	http_server.WriteResult(writer, s.SelectBillingProfile(request.Context(), mux.Vars(request)["uuid"], &req))
+}
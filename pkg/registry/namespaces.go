@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	"github.com/arangodb/go-driver"
+	epb "github.com/slntopp/nocloud-proto/events"
 	pb "github.com/slntopp/nocloud-proto/registry"
 	namespacespb "github.com/slntopp/nocloud-proto/registry/namespaces"
 
@@ -29,6 +30,7 @@ import (
 	"github.com/slntopp/nocloud/pkg/nocloud/roles"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -38,6 +40,12 @@ type NamespacesServiceServer struct {
 	ctrl     graph.NamespacesController
 	acc_ctrl graph.AccountsController
 	ca       graph.CommonActionsController
+	inv_ctrl graph.InvitationsController
+
+	eventsClient epb.EventsServiceClient
+	eventsCtx    context.Context
+	// Authorized with internal token, used for calls made on behalf of the system
+	internalCtx context.Context
 
 	log *zap.Logger
 }
@@ -54,9 +62,20 @@ func NewNamespacesServer(log *zap.Logger, db driver.Database) *NamespacesService
 		ca: graph.NewCommonActionsController(
 			log, db,
 		),
+		inv_ctrl: graph.NewInvitationsController(
+			log, db,
+		),
 	}
 }
 
+func (s *NamespacesServiceServer) SetupEventsClient(eventsClient epb.EventsServiceClient, internal_token string) {
+	s.eventsClient = eventsClient
+	s.eventsCtx = metadata.AppendToOutgoingContext(
+		context.Background(), "authorization", "bearer "+internal_token,
+	)
+	s.internalCtx = s.eventsCtx
+}
+
 func (s *NamespacesServiceServer) Create(ctx context.Context, request *namespacespb.CreateRequest) (*namespacespb.CreateResponse, error) {
 	log := s.log.Named("CreateNamespace")
 	log.Debug("Request received", zap.Any("request", request), zap.Any("context", ctx))
@@ -217,10 +236,9 @@ func (s *NamespacesServiceServer) Delete(ctx context.Context, request *namespace
 		return nil, status.Error(codes.PermissionDenied, "NoAccess")
 	}
 
-	err = ns.Delete(ctx, s.db)
-	if err != nil {
-		s.log.Debug("Error deleting account and it's children", zap.Error(err))
-		return nil, status.Error(codes.Internal, "Error deleting account")
+	// Namespace is purged by PurgeRoutine once grace period is over
+	if err = s.markForDeletion(ctx, log, ns, requestor); err != nil {
+		return nil, err
 	}
 
 	return &namespacespb.DeleteResponse{Result: true}, nil
@@ -0,0 +1,130 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// markForDeletion suspends namespace services until grace period is over
+func (s *NamespacesServiceServer) markForDeletion(ctx context.Context, log *zap.Logger, ns graph.Namespace, requester string) error {
+	if ns.Key == schema.ROOT_NAMESPACE_KEY {
+		return status.Error(codes.PermissionDenied, "Root namespace cannot be deleted")
+	}
+	conf := getSoftDeleteSettings(log)
+	now := time.Now()
+
+	deletion := &graph.PendingDeletion{
+		RequestedAt: now.Unix(),
+		RequestedBy: requester,
+		PurgeAt:     now.AddDate(0, 0, conf.GracePeriod).Unix(),
+	}
+	if conf.GracePeriod <= 0 {
+		return purgeNamespace(ctx, s.internalCtx, log, s.db, ns, deletion)
+	}
+
+	services, err := graph.ListOwnedActiveServices(ctx, s.db, ns.ID)
+	if err != nil {
+		log.Error("Error listing Services to suspend", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting namespace")
+	}
+	deletion.Services = services
+
+	if err = graph.MarkForDeletion(ctx, s.db, ns.ID, deletion); err != nil {
+		if errors.Is(err, graph.ErrPendingDeletion) {
+			return status.Error(codes.FailedPrecondition, "Namespace is already pending deletion")
+		}
+		log.Error("Error marking namespace for deletion", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting namespace")
+	}
+	setServicesSuspended(s.internalCtx, log, services, true)
+
+	logDeletionEvent(log, ns.ID, "deletion_requested", requester, deletion)
+	return nil
+}
+
+// RestoreNamespace cancels pending deletion, unsuspending services suspended by it
+func (s *NamespacesServiceServer) RestoreNamespace(ctx context.Context, uuid string) error {
+	log := s.log.Named("RestoreNamespace")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("namespace", uuid))
+
+	ns, err := s.ctrl.Get(ctx, uuid)
+	if err != nil {
+		log.Debug("Error getting namespace", zap.Error(err))
+		return status.Error(codes.NotFound, "Namespace not found")
+	}
+	if !s.ca.HasAccess(ctx, requester, ns.ID, access.Level_ADMIN) {
+		return status.Error(codes.PermissionDenied, "NoAccess")
+	}
+
+	deletion, err := graph.ClearDeletion(ctx, s.db, ns.ID)
+	if err != nil {
+		if errors.Is(err, graph.ErrNotPendingDeletion) {
+			return status.Error(codes.FailedPrecondition, "Namespace is not pending deletion")
+		}
+		log.Error("Error clearing deletion mark", zap.Error(err))
+		return status.Error(codes.Internal, "Error restoring namespace")
+	}
+	setServicesSuspended(s.internalCtx, log, deletion.Services, false)
+
+	logDeletionEvent(log, ns.ID, "restored", requester, deletion)
+	return nil
+}
+
+// purgeNamespace deletes namespace services through their controllers, then deletes namespace with everything it owns
+func purgeNamespace(ctx, internalCtx context.Context, log *zap.Logger, db driver.Database, ns graph.Namespace, deletion *graph.PendingDeletion) error {
+	if err := teardownServices(internalCtx, log, db, ns.ID); err != nil {
+		log.Error("Error deleting owned Services", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting namespace services")
+	}
+
+	removed, err := graph.PurgeRecursive(ctx, db, ns.ID)
+	if err != nil {
+		log.Error("Error deleting namespace and it's children", zap.Error(err))
+		return status.Error(codes.Internal, "Error deleting namespace")
+	}
+
+	recordDeletion(ctx, log, db, &graph.DeletionRecord{
+		Entity:      schema.NAMESPACES_COL,
+		Uuid:        ns.Key,
+		Title:       ns.GetTitle(),
+		RequestedAt: deletion.RequestedAt,
+		RequestedBy: deletion.RequestedBy,
+		Purged:      time.Now().Unix(),
+		Mode:        "deleted",
+		Removed:     removed,
+	})
+	return nil
+}
+
+func (s *NamespacesServiceServer) HandleRestoreNamespace(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.RestoreNamespace(request.Context(), mux.Vars(request)["uuid"]))
+}
@@ -0,0 +1,476 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const invitationsSettingsKey = "namespace-invitations"
+
+type InvitationsSettings struct {
+	TTL int64 `json:"ttl"` // seconds
+	// $TOKEN is replaced with invitation token
+	AcceptURL string `json:"accept_url"`
+}
+
+var defaultInvitationsSettings = &sc.Setting[InvitationsSettings]{
+	Value: InvitationsSettings{
+		TTL:       7 * 24 * 3600,
+		AcceptURL: "",
+	},
+	Description: "Namespace invitations",
+	Level:       access.Level_ADMIN,
+}
+
+const (
+	invitationEmail         = "namespace_invitation"
+	invitationResolvedEmail = "namespace_invitation_resolved"
+)
+
+type InviteRequest struct {
+	Email   string `json:"email"`
+	Account string `json:"account"`
+	// Defaults to requester access level - 1
+	Access *access.Level `json:"access"`
+	Role   string        `json:"role"`
+}
+
+type resolveInvitationRequest struct {
+	Uuid  string `json:"uuid"`
+	Token string `json:"token"`
+}
+
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func namespaceByKey(key string) graph.Namespace {
+	return graph.Namespace{
+		DocumentMeta: driver.DocumentMeta{
+			Key: key,
+			ID:  driver.NewDocumentID(schema.NAMESPACES_COL, key),
+		},
+	}
+}
+
+func (s *NamespacesServiceServer) sendEmail(account, key string, data map[string]*structpb.Value) {
+	publishEmail(s.eventsCtx, s.log, s.eventsClient, account, key, data)
+}
+
+func (s *NamespacesServiceServer) audit(log *zap.Logger, uuid, action, requester, diff string) {
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.NAMESPACES_COL,
+		Uuid:      uuid,
+		Scope:     "database",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: diff,
+		},
+	})
+}
+
+// Invite creates pending invitation to namespace and sends it by email
+func (s *NamespacesServiceServer) Invite(ctx context.Context, namespace string, req *InviteRequest) (*graph.Invitation, error) {
+	log := s.log.Named("Invite")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("namespace", namespace), zap.Any("request", req))
+
+	ns, err := s.ctrl.Get(ctx, namespace)
+	if err != nil {
+		log.Debug("Error getting namespace", zap.Error(err))
+		return nil, status.Error(codes.NotFound, "Namespace not found")
+	}
+	ok, level := s.ca.AccessLevel(ctx, requester, ns.ID)
+	if !ok || level < access.Level_ADMIN {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Namespace")
+	}
+
+	reqLevel := level - 1
+	if req.Access != nil {
+		reqLevel = *req.Access
+	}
+	if reqLevel > level {
+		return nil, status.Error(codes.PermissionDenied, "Cannot select higher level")
+	}
+	role := req.Role
+	if role == "" {
+		role = roles.DEFAULT
+	}
+	if role != roles.DEFAULT && role != roles.OWNER {
+		return nil, status.Error(codes.InvalidArgument, "Unknown role")
+	}
+	// Owner role grants ROOT access, so only owners can pass it on
+	if role == roles.OWNER && level < access.Level_ROOT {
+		return nil, status.Error(codes.PermissionDenied, "Cannot grant role higher than own")
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if email == "" && req.Account == "" {
+		return nil, status.Error(codes.InvalidArgument, "Either email or account must be set")
+	}
+	if email != "" {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid email")
+		}
+	}
+	// Account to deliver email to, recipient may not have signed up yet
+	recipient := req.Account
+	if req.Account != "" {
+		col, err := s.db.Collection(ctx, schema.ACCOUNTS_COL)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Failed to create invitation")
+		}
+		if exists, err := col.DocumentExists(ctx, req.Account); err != nil || !exists {
+			return nil, status.Error(codes.NotFound, "Account not found")
+		}
+	} else if recipient, err = s.findAccountByEmail(ctx, email); err != nil {
+		log.Warn("Failed to look up account by email", zap.Error(err))
+	}
+
+	var conf InvitationsSettings
+	if scErr := sc.Fetch(invitationsSettingsKey, &conf, defaultInvitationsSettings); scErr != nil {
+		log.Warn("Cannot fetch invitations settings", zap.Error(scErr))
+		conf = defaultInvitationsSettings.Value
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to create invitation")
+	}
+	token := hex.EncodeToString(secret)
+
+	now := time.Now().Unix()
+	inv, err := s.inv_ctrl.Create(ctx, &graph.Invitation{
+		Namespace: ns.Key,
+		Email:     email,
+		Account:   req.Account,
+		Level:     reqLevel,
+		Role:      role,
+		InvitedBy: requester,
+		Status:    graph.InvitationPending,
+		Created:   now,
+		Expires:   now + conf.TTL,
+		TokenHash: hashInvitationToken(token),
+	})
+	if err != nil {
+		log.Error("Failed to create invitation", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to create invitation")
+	}
+	inv.TokenHash = ""
+
+	s.audit(log, ns.Key, "invitation_created", requester, fmt.Sprintf("Invitation: %s, Email: %s, Account: %s, Level: %d, Role: %s", inv.Uuid, email, req.Account, reqLevel, role))
+	data := map[string]*structpb.Value{
+		"email":      structpb.NewStringValue(email),
+		"namespace":  structpb.NewStringValue(ns.Key),
+		"title":      structpb.NewStringValue(ns.GetTitle()),
+		"invited_by": structpb.NewStringValue(requester),
+		"level":      structpb.NewNumberValue(float64(reqLevel)),
+		"role":       structpb.NewStringValue(role),
+		"link":       structpb.NewStringValue(tokenLink(conf.AcceptURL, token)),
+		"token":      structpb.NewStringValue(token),
+		"expires":    structpb.NewNumberValue(float64(inv.Expires)),
+	}
+	if recipient != "" {
+		s.sendEmail(recipient, invitationEmail, data)
+	} else {
+		// Invitee hasn't signed up yet, so there is no account to deliver to
+		publishEmailToAddress(s.eventsCtx, s.log, s.eventsClient, email, invitationEmail, data)
+	}
+	return inv, nil
+}
+
+func (s *NamespacesServiceServer) findAccountByEmail(ctx context.Context, email string) (string, error) {
+	c, err := s.db.Query(ctx, `FOR a IN @@accounts FILTER LOWER(a.data.email) == @email LIMIT 1 RETURN a._key`, map[string]interface{}{
+		"@accounts": schema.ACCOUNTS_COL,
+		"email":     email,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if !c.HasMore() {
+		return "", nil
+	}
+	var key string
+	_, err = c.ReadDocument(ctx, &key)
+	return key, err
+}
+
+// ListInvitations lists all invitations to namespace
+func (s *NamespacesServiceServer) ListInvitations(ctx context.Context, namespace string) ([]*graph.Invitation, error) {
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	if !s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.NAMESPACES_COL, namespace), access.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Namespace")
+	}
+	list, err := s.inv_ctrl.List(ctx, graph.InvitationsFilter{Namespace: namespace})
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to list invitations")
+	}
+	return list, nil
+}
+
+// ListOwnInvitations lists pending invitations addressed to requester account or its verified email
+func (s *NamespacesServiceServer) ListOwnInvitations(ctx context.Context) ([]*graph.Invitation, error) {
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	acc, err := s.acc_ctrl.Get(ctx, requester)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	filter := graph.InvitationsFilter{Account: acc.Key, Status: graph.InvitationPending}
+	if email := accountEmail(acc); email != "" && acc.GetIsEmailVerified() {
+		filter.Emails = []string{strings.ToLower(email)}
+	}
+	list, err := s.inv_ctrl.List(ctx, filter)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to list invitations")
+	}
+	return list, nil
+}
+
+// Find invitation by token from email, or by UUID if it's addressed to requester
+func (s *NamespacesServiceServer) invitationFor(ctx context.Context, acc graph.Account, req *resolveInvitationRequest) (*graph.Invitation, error) {
+	var inv *graph.Invitation
+	var err error
+	if req.Token != "" {
+		inv, err = s.inv_ctrl.GetByToken(ctx, hashInvitationToken(req.Token))
+	} else {
+		inv, err = s.inv_ctrl.Get(ctx, req.Uuid)
+	}
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Invitation not found")
+	}
+
+	if inv.Account != "" {
+		if inv.Account != acc.Key {
+			return nil, status.Error(codes.PermissionDenied, "Invitation is addressed to another account")
+		}
+		return inv, nil
+	}
+	if req.Token != "" {
+		return inv, nil
+	}
+	email := accountEmail(acc)
+	if !acc.GetIsEmailVerified() || !strings.EqualFold(email, inv.Email) {
+		return nil, status.Error(codes.PermissionDenied, "Invitation is addressed to another email")
+	}
+	return inv, nil
+}
+
+// AcceptInvitation links requester to namespace with invitation access level and role
+func (s *NamespacesServiceServer) AcceptInvitation(ctx context.Context, req *resolveInvitationRequest) (*graph.Invitation, error) {
+	return s.resolveInvitation(ctx, req, graph.InvitationAccepted)
+}
+
+func (s *NamespacesServiceServer) DeclineInvitation(ctx context.Context, req *resolveInvitationRequest) (*graph.Invitation, error) {
+	return s.resolveInvitation(ctx, req, graph.InvitationDeclined)
+}
+
+func (s *NamespacesServiceServer) resolveInvitation(ctx context.Context, req *resolveInvitationRequest, result graph.InvitationStatus) (*graph.Invitation, error) {
+	log := s.log.Named("ResolveInvitation")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	acc, err := s.acc_ctrl.Get(ctx, requester)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	inv, err := s.invitationFor(ctx, acc, req)
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err = s.inv_ctrl.Resolve(ctx, inv.Uuid, result, requester)
+	if errors.Is(err, graph.ErrInvitationNotPending) {
+		return nil, status.Error(codes.FailedPrecondition, "Invitation is not pending or has expired")
+	}
+	if err != nil {
+		log.Error("Failed to resolve invitation", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Failed to resolve invitation")
+	}
+
+	if result == graph.InvitationAccepted {
+		if err = s.ctrl.Link(ctx, acc, namespaceByKey(inv.Namespace), inv.Level, inv.Role); err != nil {
+			log.Error("Failed to link account to namespace", zap.String("invitation", inv.Uuid), zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error while linking account to namespace")
+		}
+	}
+	inv.TokenHash = ""
+
+	s.audit(log, inv.Namespace, "invitation_"+string(result), requester, "Invitation: "+inv.Uuid)
+	s.sendEmail(inv.InvitedBy, invitationResolvedEmail, map[string]*structpb.Value{
+		"namespace": structpb.NewStringValue(inv.Namespace),
+		"account":   structpb.NewStringValue(requester),
+		"email":     structpb.NewStringValue(inv.Email),
+		"status":    structpb.NewStringValue(string(result)),
+	})
+	return inv, nil
+}
+
+// RevokeInvitation cancels pending invitation
+func (s *NamespacesServiceServer) RevokeInvitation(ctx context.Context, namespace, uuid string) error {
+	log := s.log.Named("RevokeInvitation")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	if !s.ca.HasAccess(ctx, requester, driver.NewDocumentID(schema.NAMESPACES_COL, namespace), access.Level_ADMIN) {
+		return status.Error(codes.PermissionDenied, "Not enough access rights to Namespace")
+	}
+	inv, err := s.inv_ctrl.Get(ctx, uuid)
+	if err != nil || inv.Namespace != namespace {
+		return status.Error(codes.NotFound, "Invitation not found")
+	}
+	if _, err = s.inv_ctrl.Resolve(ctx, uuid, graph.InvitationRevoked, requester); err != nil {
+		if errors.Is(err, graph.ErrInvitationNotPending) {
+			return status.Error(codes.FailedPrecondition, "Invitation is not pending or has expired")
+		}
+		log.Error("Failed to revoke invitation", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to revoke invitation")
+	}
+
+	s.audit(log, namespace, "invitation_revoked", requester, "Invitation: "+uuid)
+	return nil
+}
+
+// Leave unlinks requester from namespace
+func (s *NamespacesServiceServer) Leave(ctx context.Context, namespace string) error {
+	log := s.log.Named("Leave")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	acc, err := s.acc_ctrl.Get(ctx, requester)
+	if err != nil {
+		return status.Error(codes.NotFound, "Account not found")
+	}
+	err = s.ctrl.Leave(ctx, acc, namespaceByKey(namespace))
+	switch {
+	case err == nil:
+	case errors.Is(err, graph.ErrLastOwner):
+		return status.Error(codes.FailedPrecondition, "Last owner cannot leave Namespace")
+	case driver.IsNotFound(err):
+		return status.Error(codes.NotFound, "Account is not a member of Namespace")
+	default:
+		log.Error("Failed to leave namespace", zap.Error(err))
+		return status.Error(codes.Internal, "Failed to leave Namespace")
+	}
+
+	s.audit(log, namespace, "member_left", requester, "Account: "+requester)
+	return nil
+}
+
+func (s *NamespacesServiceServer) RegisterRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	auth := func(h http.HandlerFunc) http.Handler {
+		return interceptor.JwtMiddleWare(h)
+	}
+
+	nsRouter := router.PathPrefix("/namespaces/{uuid}").Subrouter()
+	nsRouter.Handle("/invitations", auth(s.HandleInvite)).Methods("POST")
+	nsRouter.Handle("/invitations", auth(s.HandleListInvitations)).Methods("GET")
+	nsRouter.Handle("/invitations/{id}", auth(s.HandleRevokeInvitation)).Methods("DELETE")
+	nsRouter.Handle("/leave", auth(s.HandleLeave)).Methods("POST")
+	nsRouter.Handle("/restore", auth(s.HandleRestoreNamespace)).Methods("POST")
+
+	invRouter := router.PathPrefix("/invitations").Subrouter()
+	invRouter.Handle("", auth(s.HandleListOwnInvitations)).Methods("GET")
+	invRouter.Handle("/accept", auth(s.handleResolveInvitation(s.AcceptInvitation))).Methods("POST")
+	invRouter.Handle("/decline", auth(s.handleResolveInvitation(s.DeclineInvitation))).Methods("POST")
+}
+
+func (s *NamespacesServiceServer) HandleInvite(writer http.ResponseWriter, request *http.Request) {
+	var req InviteRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	inv, err := s.Invite(request.Context(), mux.Vars(request)["uuid"], &req)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, inv)
+}
+
+func (s *NamespacesServiceServer) HandleListInvitations(writer http.ResponseWriter, request *http.Request) {
+	list, err := s.ListInvitations(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, map[string]any{"pool": list})
+}
+
+func (s *NamespacesServiceServer) HandleRevokeInvitation(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	http_server.WriteResult(writer, s.RevokeInvitation(request.Context(), vars["uuid"], vars["id"]))
+}
+
+func (s *NamespacesServiceServer) HandleLeave(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.Leave(request.Context(), mux.Vars(request)["uuid"]))
+}
+
+func (s *NamespacesServiceServer) HandleListOwnInvitations(writer http.ResponseWriter, request *http.Request) {
+	list, err := s.ListOwnInvitations(request.Context())
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, map[string]any{"pool": list})
+}
+
+func (s *NamespacesServiceServer) handleResolveInvitation(resolve func(context.Context, *resolveInvitationRequest) (*graph.Invitation, error)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var req resolveInvitationRequest
+		if err := json.NewDecoder(request.Body).Decode(&req); err != nil || (req.Uuid == "" && req.Token == "") {
+			http.Error(writer, "Either uuid or token must be set", http.StatusBadRequest)
+			return
+		}
+		inv, err := resolve(request.Context(), &req)
+		if err != nil {
+			http_server.WriteResult(writer, err)
+			return
+		}
+		http_server.WriteJSON(writer, http.StatusOK, inv)
+	}
+}
@@ -0,0 +1,131 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arangodb/go-driver"
+	"github.com/slntopp/nocloud-proto/access"
+	epb "github.com/slntopp/nocloud-proto/events"
+	nspb "github.com/slntopp/nocloud-proto/registry/namespaces"
+	driver_mocks "github.com/slntopp/nocloud/mocks/github.com/arangodb/go-driver"
+	graph_mocks "github.com/slntopp/nocloud/mocks/github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/roles"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeInvitations struct {
+	graph.InvitationsController
+	created *graph.Invitation
+}
+
+func (f *fakeInvitations) Create(_ context.Context, inv *graph.Invitation) (*graph.Invitation, error) {
+	inv.Uuid = "inv"
+	f.created = inv
+	return inv, nil
+}
+
+type fakeEvents struct {
+	epb.EventsServiceClient
+	published []*epb.Event
+}
+
+func (f *fakeEvents) Publish(_ context.Context, event *epb.Event, _ ...grpc.CallOption) (*epb.Response, error) {
+	f.published = append(f.published, event)
+	return &epb.Response{}, nil
+}
+
+type invitationsFixture struct {
+	srv    *NamespacesServiceServer
+	db     *driver_mocks.MockDatabase
+	ca     *graph_mocks.MockCommonActionsController
+	inv    *fakeInvitations
+	events *fakeEvents
+}
+
+func newInvitationsFixture(t *testing.T, level access.Level) *invitationsFixture {
+	f := &invitationsFixture{
+		db:     driver_mocks.NewMockDatabase(t),
+		ca:     graph_mocks.NewMockCommonActionsController(t),
+		inv:    &fakeInvitations{},
+		events: &fakeEvents{},
+	}
+	ctrl := graph_mocks.NewMockNamespacesController(t)
+	ns := namespaceByKey("ns")
+	ns.Namespace = &nspb.Namespace{Title: "Team"}
+	ctrl.EXPECT().Get(mock.Anything, "ns").Return(ns, nil)
+	f.ca.EXPECT().AccessLevel(mock.Anything, "inviter", driver.NewDocumentID(schema.NAMESPACES_COL, "ns")).Return(true, level)
+
+	f.srv = &NamespacesServiceServer{
+		db:           f.db,
+		ctrl:         ctrl,
+		ca:           f.ca,
+		inv_ctrl:     f.inv,
+		eventsClient: f.events,
+		eventsCtx:    context.Background(),
+		log:          zap.NewNop(),
+	}
+	return f
+}
+
+func inviterContext() context.Context {
+	return context.WithValue(context.Background(), nocloud.NoCloudAccount, "inviter")
+}
+
+func TestInviteRoleIsCappedByInviterLevel(t *testing.T) {
+	f := newInvitationsFixture(t, access.Level_ADMIN)
+
+	_, err := f.srv.Invite(inviterContext(), "ns", &InviteRequest{Email: "new@example.com", Role: roles.OWNER})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Nil(t, f.inv.created)
+}
+
+func TestInviteEmailWithoutAccount(t *testing.T) {
+	f := newInvitationsFixture(t, access.Level_ROOT)
+
+	cursor := driver_mocks.NewMockCursor(t)
+	cursor.EXPECT().HasMore().Return(false)
+	cursor.EXPECT().Close().Return(nil)
+	f.db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(cursor, nil)
+
+	inv, err := f.srv.Invite(inviterContext(), "ns", &InviteRequest{Email: " New@Example.com ", Role: roles.OWNER})
+	require.NoError(t, err)
+	assert.Equal(t, "new@example.com", inv.Email)
+	assert.Equal(t, roles.OWNER, inv.Role)
+	assert.Empty(t, inv.TokenHash)
+
+	require.Len(t, f.events.published, 1)
+	event := f.events.published[0]
+	assert.Equal(t, "email", event.GetType())
+	assert.Equal(t, "new@example.com", event.GetUuid())
+	assert.Equal(t, invitationEmail, event.GetKey())
+	assert.Equal(t, "new@example.com", event.GetData()["to"].GetStringValue())
+}
+
+func TestInviteEmailOfExistingAccount(t *testing.T) {
+	f := newInvitationsFixture(t, access.Level_ADMIN)
+
+	cursor := driver_mocks.NewMockCursor(t)
+	cursor.EXPECT().HasMore().Return(true)
+	cursor.EXPECT().ReadDocument(mock.Anything, mock.Anything).Run(func(_ context.Context, result interface{}) {
+		*result.(*string) = "invitee"
+	}).Return(driver.DocumentMeta{}, nil)
+	cursor.EXPECT().Close().Return(nil)
+	f.db.EXPECT().Query(mock.Anything, mock.Anything, mock.Anything).Return(cursor, nil)
+
+	_, err := f.srv.Invite(inviterContext(), "ns", &InviteRequest{Email: "member@example.com"})
+	require.NoError(t, err)
+
+	require.Len(t, f.events.published, 1)
+	assert.Equal(t, "invitee", f.events.published[0].GetUuid())
+	assert.Equal(t, access.Level_MGMT, f.inv.created.Level)
+}
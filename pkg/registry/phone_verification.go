@@ -0,0 +1,132 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/sms"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+)
+
+const phoneVerificationSettingsKey = "phone-verification"
+
+type PhoneVerificationSettings struct {
+	// $CODE is replaced with verification code
+	MessageTemplate string `json:"message_template"`
+	CodeTTL         int64  `json:"code_ttl"`        // seconds
+	ResendInterval  int64  `json:"resend_interval"` // seconds
+	// Wrong codes allowed before new code must be requested
+	MaxAttempts int `json:"max_attempts"`
+	// Codes allowed to be sent to the same number
+	NumberRequestsLimit int `json:"number_requests_limit"`
+}
+
+var defaultPhoneVerificationSettings = &sc.Setting[PhoneVerificationSettings]{
+	Value: PhoneVerificationSettings{
+		MessageTemplate:     "Ваш код верификации ЛК: $CODE. Хостинг-провайдер support.by",
+		CodeTTL:             600,
+		ResendInterval:      150,
+		MaxAttempts:         5,
+		NumberRequestsLimit: 5,
+	},
+	Description: "Phone verification",
+	Level:       access.Level_ADMIN,
+}
+
+func getPhoneVerificationSettings(log *zap.Logger) PhoneVerificationSettings {
+	var conf PhoneVerificationSettings
+	if scErr := sc.Fetch(phoneVerificationSettingsKey, &conf, defaultPhoneVerificationSettings); scErr != nil {
+		log.Warn("Cannot fetch phone verification settings", zap.Error(scErr))
+		conf = defaultPhoneVerificationSettings.Value
+	}
+	return conf
+}
+
+const smsProvidersSettingsKey = "sms-providers"
+
+var defaultSMSProvidersSettings = &sc.Setting[sms.Config]{
+	Value:       sms.Config{},
+	Description: "SMS providers, routes by country calling code and failover order",
+	Level:       access.Level_ROOT,
+}
+
+// SetupSMSProviders builds SMS router from settings, given providers (e.g. Asterisk) are registered along with configured HTTP ones
+// Settings client must be set up before
+func (s *AccountsServiceServer) SetupSMSProviders(providers ...sms.SMSProvider) error {
+	var conf sms.Config
+	if scErr := sc.Fetch(smsProvidersSettingsKey, &conf, defaultSMSProvidersSettings); scErr != nil {
+		s.log.Warn("Cannot fetch sms providers settings", zap.Error(scErr))
+	}
+	router, err := sms.NewRouter(conf, providers...)
+	if err != nil {
+		// Keep built-in providers working even if settings are broken
+		s.log.Error("Invalid sms providers settings", zap.Error(err))
+		if router, err = sms.NewRouter(sms.Config{}, providers...); err != nil {
+			return fmt.Errorf("failed to set up sms providers: %w", err)
+		}
+	}
+	s.smsProvider = router
+	return nil
+}
+
+func (s *AccountsServiceServer) RegisterPhoneVerificationRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/phone/verification", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandlePhoneVerificationStatus))).Methods("GET")
+}
+
+// HandlePhoneVerificationStatus reports state of the last verification code sent to requester
+func (s *AccountsServiceServer) HandlePhoneVerificationStatus(writer http.ResponseWriter, request *http.Request) {
+	log := s.log.Named("PhoneVerificationStatus")
+	ctx := request.Context()
+	requester, _ := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	var vData VerificationData
+	if err := getRedisParsed(s.rdb, fmt.Sprintf(phoneVerificationDataKeyTemplate, requester), &vData, vData); err != nil {
+		log.Error("Failed to get verification data from redis", zap.Error(err))
+		http.Error(writer, "Failed to get verification data", http.StatusInternalServerError)
+		return
+	}
+	if vData.Code == "" {
+		http.Error(writer, "No verification code was requested", http.StatusNotFound)
+		return
+	}
+
+	delivery := sms.StatusUnknown
+	if s.smsProvider != nil && vData.MessageID != "" {
+		st, err := s.smsProvider.Status(ctx, vData.MessageID)
+		if err != nil {
+			log.Warn("Failed to get delivery status", zap.String("message", vData.MessageID), zap.Error(err))
+		} else {
+			delivery = st
+		}
+	}
+
+	conf := getPhoneVerificationSettings(log)
+	http_server.WriteJSON(writer, http.StatusOK, map[string]any{
+		"delivery":      delivery,
+		"sent":          vData.Sent,
+		"expires":       vData.Expires,
+		"attempts_left": max(conf.MaxAttempts-vData.Attempts, 0),
+	})
+}
@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	"github.com/pariz/gountries"
+	"github.com/slntopp/nocloud/pkg/nocloud/vat"
 )
 
 const vatRate = 0.23
@@ -84,11 +85,36 @@ func CalculateTaxRate(country, taxID string) float64 {
 	return vatRate // EU B2C / individual without VAT ID
 }
 
+// Key the VAT ID is stored by in validation results, e.g. DE136695976
+func taxIDKey(country, taxID string) string {
+	code, number := vat.Normalize(normalizeCountryCode(country), taxID)
+	if number == "" {
+		return ""
+	}
+	return code + number
+}
+
+// validatedTaxID returns tax_id only if tax_id_validation confirms this exact number is valid
+func validatedTaxID(data map[string]interface{}) string {
+	country, _ := data["country"].(string)
+	taxID, _ := data["tax_id"].(string)
+	validation, ok := data[taxIDValidationKey].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	valid, _ := validation["valid"].(bool)
+	checked, _ := validation["tax_id"].(string)
+	if !valid || checked == "" || checked != taxIDKey(country, taxID) {
+		return ""
+	}
+	return taxID
+}
+
+// applyTaxRate grants reverse charge only for VAT ID validated by validateTaxID
 func applyTaxRate(data map[string]interface{}) {
 	if data == nil {
 		return
 	}
 	country, _ := data["country"].(string)
-	taxID, _ := data["tax_id"].(string)
-	data["tax_rate"] = CalculateTaxRate(country, taxID)
+	data["tax_rate"] = CalculateTaxRate(country, validatedTaxID(data))
 }
@@ -0,0 +1,381 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	"github.com/slntopp/nocloud/pkg/nocloud/vat"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const vatValidationSettingsKey = "vat-validation"
+
+type VatValidationSettings struct {
+	// VIES REST API or compatible endpoint, local format and checksum stub is used if empty
+	Endpoint string `json:"endpoint"`
+	// Own VAT number sent to VIES to receive consultation number
+	RequesterCountry string `json:"requester_country"`
+	RequesterNumber  string `json:"requester_number"`
+	// Seconds to wait for VIES in scheduled re-validation
+	Timeout int64 `json:"timeout"`
+	// Seconds to wait for VIES while handling request, check is left pending and retried in background if exceeded
+	InlineTimeout int64 `json:"inline_timeout"`
+	// Days check result is reused for the same VAT ID
+	CacheTTL int `json:"cache_ttl"`
+	// Seconds between re-validation runs
+	RevalidateFrequency int64 `json:"revalidate_frequency"`
+	// Seconds before pending check is retried
+	PendingRetry int64 `json:"pending_retry"`
+}
+
+var defaultVatValidationSettings = &sc.Setting[VatValidationSettings]{
+	Value: VatValidationSettings{
+		Endpoint:            vat.DefaultViesURL,
+		Timeout:             15,
+		InlineTimeout:       3,
+		CacheTTL:            30,
+		RevalidateFrequency: 86400,
+		PendingRetry:        300,
+	},
+	Description: "VAT ID validation via VIES",
+	Level:       access.Level_ADMIN,
+}
+
+func getVatValidationSettings(log *zap.Logger) VatValidationSettings {
+	var conf VatValidationSettings
+	if scErr := sc.Fetch(vatValidationSettingsKey, &conf, defaultVatValidationSettings); scErr != nil {
+		log.Warn("Cannot fetch vat-validation settings", zap.Error(scErr))
+		conf = defaultVatValidationSettings.Value
+	}
+	return conf
+}
+
+const (
+	taxIDValidationKey   = "tax_id_validation"
+	taxRevalidateLockKey = "registry-tax-id-revalidation-lock"
+	taxRevalidateBatch   = 100
+)
+
+// vatCheckerFactory builds checker for given settings and timeout, so tests can replace VIES
+type vatCheckerFactory func(conf VatValidationSettings, timeout int64) (vat.Checker, error)
+
+func newVatChecker(conf VatValidationSettings, timeout int64) (vat.Checker, error) {
+	if conf.Endpoint == "" {
+		return vat.NewStub(), nil
+	}
+	return vat.NewViesChecker(vat.ViesConfig{
+		URL:              conf.Endpoint,
+		RequesterCountry: conf.RequesterCountry,
+		RequesterNumber:  conf.RequesterNumber,
+		Timeout:          timeout,
+	})
+}
+
+func toUnix(v interface{}) int64 {
+	switch t := v.(type) {
+	case float64:
+		return int64(t)
+	case int64:
+		return t
+	case int:
+		return int64(t)
+	}
+	return 0
+}
+
+// validateTaxID checks data tax_id within inline timeout, so requests aren't held by slow VIES.
+// If VIES doesn't answer in time, validation is left pending and retried by TaxIDRevalidationRoutine
+func (s *AccountsServiceServer) validateTaxID(ctx context.Context, log *zap.Logger, data map[string]interface{}, force bool) *vat.Result {
+	conf := getVatValidationSettings(log)
+	return s.checkTaxID(ctx, log, conf, conf.InlineTimeout, data, force)
+}
+
+// checkTaxID checks data tax_id and stores outcome in data tax_id_validation, which applyTaxRate relies on.
+// Returns result of performed check to be stored in history, or nil if cached one was reused
+func (s *AccountsServiceServer) checkTaxID(ctx context.Context, log *zap.Logger, conf VatValidationSettings, timeout int64, data map[string]interface{}, force bool) *vat.Result {
+	if data == nil {
+		return nil
+	}
+	country, _ := data["country"].(string)
+	taxID, _ := data["tax_id"].(string)
+	key := taxIDKey(country, taxID)
+	if key == "" {
+		delete(data, taxIDValidationKey)
+		return nil
+	}
+	now := time.Now().Unix()
+	code := normalizeCountryCode(country)
+	if !isEUCountry(code) {
+		// Reverse charge doesn't apply outside EU, nothing to check
+		data[taxIDValidationKey] = map[string]interface{}{
+			"tax_id":     key,
+			"valid":      false,
+			"checked_at": now,
+			"error":      vat.ErrUnsupportedCountry.Error(),
+		}
+		return nil
+	}
+
+	prev, _ := data[taxIDValidationKey].(map[string]interface{})
+	if prev != nil && prev["tax_id"] == key && !force {
+		errMsg, _ := prev["error"].(string)
+		if errMsg == "" && now-toUnix(prev["checked_at"]) < int64(conf.CacheTTL)*86400 {
+			return nil
+		}
+	}
+
+	newChecker := s.vatChecker
+	if newChecker == nil {
+		newChecker = newVatChecker
+	}
+	checker, err := newChecker(conf, timeout)
+	var res *vat.Result
+	if err == nil {
+		res, err = vat.Check(ctx, checker, code, taxID)
+	}
+	if err != nil {
+		log.Warn("VAT ID check failed", zap.String("tax_id", key), zap.Error(err))
+		vc, vn := vat.Normalize(code, taxID)
+		res = &vat.Result{Country: vc, Number: vn, CheckedAt: time.Unix(now, 0), Source: "error", Error: err.Error()}
+		// Outage says nothing about the number, previous positive answer stays until next successful check
+		if prev != nil && prev["tax_id"] == key && prev["valid"] == true {
+			prev["error"] = err.Error()
+			return res
+		}
+		data[taxIDValidationKey] = map[string]interface{}{
+			"tax_id":     key,
+			"valid":      false,
+			"pending":    true,
+			"checked_at": now,
+			"source":     res.Source,
+			"error":      res.Error,
+		}
+		return res
+	}
+
+	validation := map[string]interface{}{
+		"tax_id":     key,
+		"valid":      res.Valid,
+		"checked_at": res.CheckedAt.Unix(),
+		"source":     res.Source,
+	}
+	if res.ConsultationNumber != "" {
+		validation["consultation_number"] = res.ConsultationNumber
+	}
+	if res.Error != "" {
+		validation["error"] = res.Error
+	}
+	data[taxIDValidationKey] = validation
+	return res
+}
+
+func (s *AccountsServiceServer) recordTaxIDValidation(ctx context.Context, log *zap.Logger, account, requester string, res *vat.Result) {
+	if res == nil {
+		return
+	}
+	rec := &graph.TaxIDValidation{
+		Account:            account,
+		Country:            res.Country,
+		TaxID:              res.Country + res.Number,
+		Valid:              res.Valid,
+		Name:               res.Name,
+		Address:            res.Address,
+		ConsultationNumber: res.ConsultationNumber,
+		CheckedAt:          res.CheckedAt.Unix(),
+		Source:             res.Source,
+		Error:              res.Error,
+		Requester:          requester,
+	}
+	if err := graph.RecordTaxIDValidation(ctx, s.db, rec); err != nil {
+		log.Error("Error storing VAT ID validation", zap.Any("record", rec), zap.Error(err))
+	}
+}
+
+// revalidateTaxID re-checks account VAT ID and updates tax rate if outcome changed
+func (s *AccountsServiceServer) revalidateTaxID(ctx context.Context, log *zap.Logger, conf VatValidationSettings, timeout int64, acc graph.Account, requester string) (*vat.Result, error) {
+	data := map[string]interface{}{}
+	if acc.Data != nil {
+		data = acc.Data.AsMap()
+	}
+	res := s.checkTaxID(ctx, log, conf, timeout, data, true)
+	applyTaxRate(data)
+	if err := s.ctrl.Update(ctx, acc, map[string]interface{}{"data": data}); err != nil {
+		return nil, err
+	}
+	s.recordTaxIDValidation(ctx, log, acc.Key, requester, res)
+	return res, nil
+}
+
+type TaxIDValidationResponse struct {
+	Validation interface{} `json:"validation"`
+	TaxRate    interface{} `json:"tax_rate"`
+	// Present if registry was queried, not set when cached result was reused
+	Result *vat.Result `json:"result,omitempty"`
+}
+
+// ValidateAccountTaxID forces check of account VAT ID
+func (s *AccountsServiceServer) ValidateAccountTaxID(ctx context.Context, uuid string) (*TaxIDValidationResponse, error) {
+	log := s.log.Named("ValidateAccountTaxID")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+	log.Debug("Request received", zap.String("requester", requester), zap.String("account", uuid))
+
+	if !s.canManageAccountData(ctx, requester, uuid) {
+		return nil, status.Error(codes.PermissionDenied, "Not enough access rights to Account")
+	}
+	acc, err := s.ctrl.Get(ctx, uuid)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+
+	graph.GetEnsureCollection(log, ctx, s.db, schema.TAX_ID_VALIDATIONS_COL)
+	conf := getVatValidationSettings(log)
+	res, err := s.revalidateTaxID(ctx, log, conf, conf.InlineTimeout, acc, requester)
+	if err != nil {
+		log.Error("Error updating account", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error while updating account")
+	}
+	acc, err = s.ctrl.Get(ctx, uuid)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error while getting account")
+	}
+	data := acc.Data.AsMap()
+	return &TaxIDValidationResponse{
+		Validation: data[taxIDValidationKey],
+		TaxRate:    data["tax_rate"],
+		Result:     res,
+	}, nil
+}
+
+// TaxIDValidationHistory lists VAT ID checks of account, newest first
+func (s *AccountsServiceServer) TaxIDValidationHistory(ctx context.Context, uuid string, limit int) ([]graph.TaxIDValidation, error) {
+	log := s.log.Named("TaxIDValidationHistory")
+	requester := ctx.Value(nocloud.NoCloudAccount).(string)
+
+	acc, err := s.ctrl.Get(ctx, uuid)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Account not found")
+	}
+	if !s.ca.HasAccess(ctx, requester, acc.ID, access.Level_ADMIN) {
+		return nil, status.Error(codes.PermissionDenied, "NoAccess")
+	}
+
+	graph.GetEnsureCollection(log, ctx, s.db, schema.TAX_ID_VALIDATIONS_COL)
+	history, err := graph.ListTaxIDValidations(ctx, s.db, acc.Key, limit)
+	if err != nil {
+		log.Error("Error listing VAT ID validations", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Error listing VAT ID validations")
+	}
+	return history, nil
+}
+
+// TaxIDRevalidationRoutine re-checks VAT IDs which results are older than cache TTL or left pending
+func (s *AccountsServiceServer) TaxIDRevalidationRoutine(ctx context.Context) {
+	log := s.log.Named("TaxIDRevalidationRoutine")
+	graph.GetEnsureCollection(log, ctx, s.db, schema.TAX_ID_VALIDATIONS_COL)
+
+start:
+	conf := getVatValidationSettings(log)
+	// Pending checks are retried on the same schedule, so routine runs at least as often as they are due
+	frequency := time.Duration(max(min(conf.RevalidateFrequency, conf.PendingRetry), 60)) * time.Second
+
+	upd := make(chan bool, 1)
+	go sc.Subscribe([]string{vatValidationSettingsKey}, upd)
+
+	log.Info("Got Configuration", zap.Any("conf", conf))
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+
+	for {
+		// Only one replica queries VIES at a time
+		locked, err := s.rdb.SetNX(ctx, taxRevalidateLockKey, time.Now().Unix(), frequency/2).Result()
+		if err != nil {
+			log.Error("Error acquiring revalidation lock", zap.Error(err))
+		} else if locked {
+			s.revalidateDue(ctx, log, conf)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info("Context is done. Quitting")
+			return
+		case <-ticker.C:
+			continue
+		case <-upd:
+			log.Info("New Configuration Received, restarting Routine")
+			ticker.Stop()
+			goto start
+		}
+	}
+}
+
+func (s *AccountsServiceServer) revalidateDue(ctx context.Context, log *zap.Logger, conf VatValidationSettings) {
+	now := time.Now().Unix()
+	accounts, err := graph.ListTaxIDsToRevalidate(ctx, s.db, now-int64(conf.CacheTTL)*86400, now-conf.PendingRetry, taxRevalidateBatch)
+	if err != nil {
+		log.Error("Error listing accounts to revalidate", zap.Error(err))
+		return
+	}
+	for _, key := range accounts {
+		acc, err := s.ctrl.Get(ctx, key)
+		if err != nil {
+			log.Error("Error getting account", zap.String("account", key), zap.Error(err))
+			continue
+		}
+		if _, err := s.revalidateTaxID(ctx, log, conf, conf.Timeout, acc, "system"); err != nil {
+			log.Error("Error revalidating VAT ID", zap.String("account", key), zap.Error(err))
+		}
+	}
+	log.Info("VAT IDs revalidated", zap.Int("count", len(accounts)))
+}
+
+func (s *AccountsServiceServer) RegisterTaxRoutes(router *mux.Router) {
+	interceptor := rest_auth.NewInterceptor(s.log, s.rdb, s.SIGNING_KEY)
+	router.Handle("/accounts/{uuid}/tax_id/validate", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleValidateTaxID))).Methods("POST")
+	router.Handle("/accounts/{uuid}/tax_id/history", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleTaxIDHistory))).Methods("GET")
+}
+
+func (s *AccountsServiceServer) HandleValidateTaxID(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ValidateAccountTaxID(request.Context(), mux.Vars(request)["uuid"])
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *AccountsServiceServer) HandleTaxIDHistory(writer http.ResponseWriter, request *http.Request) {
+	limit, _ := strconv.Atoi(request.URL.Query().Get("limit"))
+	res, err := s.TaxIDValidationHistory(request.Context(), mux.Vars(request)["uuid"], limit)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
@@ -0,0 +1,58 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/slntopp/nocloud/pkg/nocloud/vat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// stubVatServer checks VAT IDs with stub failing with err instead of VIES
+func stubVatServer(err error) *AccountsServiceServer {
+	return &AccountsServiceServer{
+		vatChecker: func(VatValidationSettings, int64) (vat.Checker, error) {
+			stub := vat.NewStub()
+			stub.Err = err
+			return stub, nil
+		},
+	}
+}
+
+func TestValidateTaxID(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		s := stubVatServer(nil)
+		data := map[string]interface{}{"country": "DE", "tax_id": "DE136695976"}
+
+		res := s.validateTaxID(context.Background(), zap.NewNop(), data, false)
+		require.NotNil(t, res)
+		validation := data[taxIDValidationKey].(map[string]interface{})
+		assert.Equal(t, true, validation["valid"])
+		assert.Nil(t, validation["pending"])
+	})
+
+	t.Run("registry unavailable", func(t *testing.T) {
+		s := stubVatServer(vat.ErrUnavailable)
+		data := map[string]interface{}{"country": "DE", "tax_id": "DE136695976"}
+
+		s.validateTaxID(context.Background(), zap.NewNop(), data, false)
+		validation := data[taxIDValidationKey].(map[string]interface{})
+		assert.Equal(t, false, validation["valid"])
+		// Retried by revalidation routine instead of holding the request
+		assert.Equal(t, true, validation["pending"])
+	})
+
+	t.Run("outage keeps previous positive answer", func(t *testing.T) {
+		s := stubVatServer(vat.ErrUnavailable)
+		data := map[string]interface{}{"country": "DE", "tax_id": "DE136695976", taxIDValidationKey: map[string]interface{}{
+			"tax_id": "DE136695976", "valid": true, "checked_at": int64(0),
+		}}
+
+		s.validateTaxID(context.Background(), zap.NewNop(), data, true)
+		validation := data[taxIDValidationKey].(map[string]interface{})
+		assert.Equal(t, true, validation["valid"])
+		assert.Nil(t, validation["pending"])
+	})
+}
@@ -0,0 +1,159 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/drivers"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type DriverRegistration struct {
+	Endpoint string `json:"endpoint"`
+}
+
+func (s *ServicesServer) logDriverEvent(log *zap.Logger, typ, action, requester string) {
+	nocloud.Log(log, &elpb.Event{
+		Entity:    "Drivers",
+		Uuid:      typ,
+		Scope:     "driver",
+		Action:    action,
+		Rc:        0,
+		Requestor: requester,
+		Ts:        time.Now().Unix(),
+		Snapshot:  &elpb.Snapshot{},
+	})
+}
+
+func (s *ServicesServer) ListDrivers(ctx context.Context) ([]drivers.Info, error) {
+	if _, err := graph.CheckRootAccess(ctx, s.ca, access.Level_ROOT); err != nil {
+		return nil, err
+	}
+	return s.drivers.List(), nil
+}
+
+// AddDriver dials endpoint and registers driver under the type it reports
+func (s *ServicesServer) AddDriver(ctx context.Context, req *DriverRegistration, source, requester string) (*drivers.Info, error) {
+	log := s.log.Named("AddDriver")
+	endpoint := strings.TrimSpace(req.Endpoint)
+	if endpoint == "" {
+		return nil, status.Error(codes.InvalidArgument, "Endpoint is required")
+	}
+	info, err := s.drivers.Add(ctx, endpoint, source)
+	if err != nil {
+		log.Warn("Failed to register driver", zap.String("endpoint", endpoint), zap.Error(err))
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	s.logDriverEvent(log, info.Type, "register", requester)
+	return info, nil
+}
+
+func (s *ServicesServer) RemoveDriver(ctx context.Context, typ string) error {
+	log := s.log.Named("RemoveDriver")
+	requester, err := graph.CheckRootAccess(ctx, s.ca, access.Level_ROOT)
+	if err != nil {
+		return err
+	}
+	if err := s.drivers.Remove(ctx, typ); err != nil {
+		if errors.Is(err, drivers.ErrNotRegistered) {
+			return status.Error(codes.NotFound, "Driver not registered")
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	s.logDriverEvent(log, typ, "unregister", requester)
+	return nil
+}
+
+// RegisterDriverRoutes exposes drivers admin API. Drivers may register themselves with registrationToken,
+// self registration is disabled if it's empty
+func (s *ServicesServer) RegisterDriverRoutes(router *mux.Router, rdb redisdb.Client, signingKey []byte, registrationToken string) {
+	interceptor := rest_auth.NewInterceptor(s.log, rdb, signingKey)
+	router.Handle("/drivers", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleListDrivers))).Methods("GET")
+	router.Handle("/drivers", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleAddDriver))).Methods("POST")
+	router.Handle("/drivers/{type}", interceptor.JwtMiddleWare(http.HandlerFunc(s.HandleRemoveDriver))).Methods("DELETE")
+	router.HandleFunc("/drivers/register", func(writer http.ResponseWriter, request *http.Request) {
+		s.HandleSelfRegister(writer, request, registrationToken)
+	}).Methods("POST")
+}
+
+func (s *ServicesServer) HandleListDrivers(writer http.ResponseWriter, request *http.Request) {
+	res, err := s.ListDrivers(request.Context())
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusOK, res)
+}
+
+func (s *ServicesServer) HandleAddDriver(writer http.ResponseWriter, request *http.Request) {
+	requester, err := graph.CheckRootAccess(request.Context(), s.ca, access.Level_ROOT)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	var req DriverRegistration
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.AddDriver(request.Context(), &req, drivers.SourceAPI, requester)
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
+
+func (s *ServicesServer) HandleRemoveDriver(writer http.ResponseWriter, request *http.Request) {
+	http_server.WriteResult(writer, s.RemoveDriver(request.Context(), mux.Vars(request)["type"]))
+}
+
+// HandleSelfRegister is called by drivers on start with X-Driver-Token header
+func (s *ServicesServer) HandleSelfRegister(writer http.ResponseWriter, request *http.Request, token string) {
+	given := request.Header.Get("X-Driver-Token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(writer, "Invalid registration token", http.StatusUnauthorized)
+		return
+	}
+	var req DriverRegistration
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Malformed request body", http.StatusBadRequest)
+		return
+	}
+	res, err := s.AddDriver(request.Context(), &req, drivers.SourceSelf, "driver")
+	if err != nil {
+		http_server.WriteResult(writer, err)
+		return
+	}
+	http_server.WriteJSON(writer, http.StatusCreated, res)
+}
@@ -0,0 +1,48 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package services
+
+import (
+	"context"
+
+	pb "github.com/slntopp/nocloud-proto/services"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkKYC rejects service if any of its instances orders product blocked until account passes KYC
+func (s *ServicesServer) checkKYC(ctx context.Context, log *zap.Logger, account string, service *pb.Service) error {
+	conf := graph.GetKYCSettings(log)
+	if len(conf.Rules) == 0 {
+		return nil
+	}
+
+	for _, group := range service.GetInstancesGroups() {
+		for _, inst := range group.GetInstances() {
+			blocked, err := graph.KYCBlocks(ctx, s.db, conf, account, inst.GetBillingPlan().GetUuid(), inst.GetProduct())
+			if err != nil {
+				log.Error("Error checking KYC", zap.String("account", account), zap.Error(err))
+				return status.Error(codes.Internal, "Error checking KYC")
+			}
+			if blocked {
+				return status.Errorf(codes.FailedPrecondition, "KYC verification is required for product %s", inst.GetProduct())
+			}
+		}
+	}
+	return nil
+}
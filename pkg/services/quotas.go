@@ -0,0 +1,68 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package services
+
+import (
+	"context"
+	"errors"
+
+	"github.com/slntopp/nocloud-proto/access"
+	pb "github.com/slntopp/nocloud-proto/services"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud/quota"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var defaultQuotaSettings = &sc.Setting[quota.Config]{
+	Value:       quota.DefaultConfig(),
+	Description: "Account quotas: default, per account group and per namespace limits of instances, cpu, ram, disk, services and monthly_spend",
+	Level:       access.Level_ADMIN,
+}
+
+// serviceUsage is what service adds to owner's usage once created
+func serviceUsage(service *pb.Service) quota.Usage {
+	usage := quota.Usage{quota.Services: 1}
+	for _, group := range service.GetInstancesGroups() {
+		for _, inst := range group.GetInstances() {
+			usage = usage.Add(graph.ResourcesUsage(inst.GetResources()))
+		}
+	}
+	return usage
+}
+
+// checkQuota rejects request if account would go over its quota, empty delta checks current usage only
+func (s *ServicesServer) checkQuota(ctx context.Context, log *zap.Logger, account string, delta quota.Usage) error {
+	var conf quota.Config
+	if scErr := sc.Fetch(quota.SettingsKey, &conf, defaultQuotaSettings); scErr != nil {
+		log.Warn("Cannot fetch quota settings", zap.Error(scErr))
+		conf = defaultQuotaSettings.Value
+	}
+
+	err := graph.CheckQuota(ctx, s.db, conf, account, delta)
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		log.Info("Quota exceeded", zap.String("account", account), zap.Error(err))
+		return status.Error(codes.ResourceExhausted, exceeded.Error())
+	}
+	if err != nil {
+		log.Error("Error checking quota", zap.String("account", account), zap.Error(err))
+		return status.Error(codes.Internal, "Error checking quota")
+	}
+	return nil
+}
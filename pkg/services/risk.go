@@ -0,0 +1,122 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
+	accountspb "github.com/slntopp/nocloud-proto/registry/accounts"
+	"github.com/slntopp/nocloud/pkg/graph"
+	"github.com/slntopp/nocloud/pkg/nocloud"
+	http_server "github.com/slntopp/nocloud/pkg/nocloud/http"
+	"github.com/slntopp/nocloud/pkg/nocloud/risk"
+	"github.com/slntopp/nocloud/pkg/nocloud/schema"
+	sc "github.com/slntopp/nocloud/pkg/settings/client"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var defaultRiskSettings = &sc.Setting[risk.Config]{
+	Value:       risk.DefaultConfig(),
+	Description: "Signup and first order risk screening",
+	Level:       access.Level_ADMIN,
+}
+
+// screenFirstOrder enforces signup screening decision and scores namespace owner account once more on its first order
+func (s *ServicesServer) screenFirstOrder(ctx context.Context, log *zap.Logger, account string, header http.Header, peerAddr string) error {
+	profile, err := graph.GetAccountRisk(ctx, s.db, account)
+	if err != nil {
+		log.Error("Error getting risk profile", zap.String("account", account), zap.Error(err))
+		return nil
+	}
+	acc, err := s.acc_ctrl.Get(ctx, account)
+	if err != nil {
+		log.Error("Error getting account", zap.String("account", account), zap.Error(err))
+		return nil
+	}
+
+	if profile == nil || profile.FirstOrder == nil {
+		var conf risk.Config
+		if scErr := sc.Fetch(risk.SettingsKey, &conf, defaultRiskSettings); scErr != nil {
+			log.Warn("Cannot fetch signup-risk settings", zap.Error(scErr))
+			conf = defaultRiskSettings.Value
+		}
+		if conf.Enabled {
+			var data map[string]interface{}
+			if acc.Data != nil {
+				data = acc.Data.AsMap()
+			}
+			in := graph.RiskInput(risk.StageFirstOrder, account, data)
+			in.IP = http_server.HeaderClientIP(header, peerAddr)
+			in.IPCountry = header.Get(conf.CountryHeader)
+			in.Device = header.Get(conf.DeviceHeader)
+
+			var counter risk.Counter
+			if s.rdb != nil {
+				counter = risk.NewRedisCounter(s.rdb)
+			}
+			a := conf.Pipeline(counter, graph.NewRiskDuplicateLookup(s.db)).Evaluate(ctx, in)
+			log.Info("First order screened", zap.String("account", account), zap.Int("score", a.Score),
+				zap.String("decision", string(a.Decision)), zap.Any("reasons", a.Reasons))
+
+			if profile == nil {
+				profile = &graph.RiskProfile{}
+			}
+			profile.Add(a)
+			if err := graph.SetAccountRisk(ctx, s.db, account, profile); err != nil {
+				log.Error("Error storing risk assessment", zap.String("account", account), zap.Error(err))
+			}
+			if a.Decision == risk.Hold {
+				if err := s.acc_ctrl.Update(ctx, acc, map[string]interface{}{
+					"status":    accountspb.AccountStatus_LOCK,
+					"suspended": true,
+				}); err != nil {
+					log.Error("Error holding account", zap.String("account", account), zap.Error(err))
+				}
+			}
+
+			diff, _ := json.Marshal(a)
+			nocloud.Log(log, &elpb.Event{
+				Entity:    schema.ACCOUNTS_COL,
+				Uuid:      account,
+				Scope:     "database",
+				Action:    "risk_assessed",
+				Rc:        0,
+				Requestor: account,
+				Ts:        time.Now().Unix(),
+				Snapshot: &elpb.Snapshot{
+					Diff: string(diff),
+				},
+			})
+		}
+	}
+
+	switch profile.Effective() {
+	case risk.Hold:
+		return status.Error(codes.FailedPrecondition, "Account is held for manual review")
+	case risk.Verify:
+		if !acc.GetIsPhoneVerified() {
+			return status.Error(codes.FailedPrecondition, "Phone verification is required before ordering")
+		}
+	}
+	return nil
+}
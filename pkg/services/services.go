@@ -17,7 +17,6 @@ package services
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"reflect"
 	"sync"
@@ -39,6 +38,8 @@ import (
 	statuspb "github.com/slntopp/nocloud-proto/statuses"
 	"github.com/slntopp/nocloud/pkg/graph"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/drivers"
+	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
 	"github.com/slntopp/nocloud/pkg/nocloud/roles"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	sc "github.com/slntopp/nocloud/pkg/settings/client"
@@ -60,12 +61,18 @@ type ServicesServer struct {
 	instances graph.InstancesController
 	ca        graph.CommonActionsController
 
-	drivers map[string]driverpb.DriverServiceClient
+	drivers *drivers.Registry
 
 	billing bpb.BillingServiceClient
 
 	ps *pubsub.PubSub
 
+	// Used for risk screening velocity counters, optional
+	rdb redisdb.Client
+
+	// Stream sources by uuid prefix, see RegisterStreamSource
+	streamSources map[string]StreamSource
+
 	log *zap.Logger
 }
 
@@ -81,7 +88,7 @@ func NewServicesServer(_log *zap.Logger, db driver.Database, ps *pubsub.PubSub,
 		cur_ctrl:  graph.NewCurrencyController(log, db),
 		instances: graph.NewInstancesController(log, db, conn),
 		ca:        graph.NewCommonActionsController(log, db),
-		drivers:   make(map[string]driverpb.DriverServiceClient),
+		drivers:   drivers.NewRegistry(log, nil, drivers.DefaultConfig()),
 		ps:        ps,
 	}
 }
@@ -91,8 +98,9 @@ type InstancesGroupDriverContext struct {
 	client *driverpb.DriverServiceClient
 }
 
-func (s *ServicesServer) RegisterDriver(type_key string, client driverpb.DriverServiceClient) {
-	s.drivers[type_key] = client
+// SetupDriverRegistry shares drivers registry, so drivers added at runtime are visible to the server
+func (s *ServicesServer) SetupDriverRegistry(reg *drivers.Registry) {
+	s.drivers = reg
 }
 
 func (s *ServicesServer) SetupSettingsClient(stC stpb.SettingsServiceClient, internal_token string) {
@@ -113,6 +121,10 @@ func (s *ServicesServer) SetupBillingClient(bC bpb.BillingServiceClient) {
 	s.billing = bC
 }
 
+func (s *ServicesServer) SetupRedisClient(rdb redisdb.Client) {
+	s.rdb = rdb
+}
+
 type InstanceBillingPlanSettings struct {
 	Required bool `json:"required"` // each instance must have it
 }
@@ -256,11 +268,11 @@ func (s *ServicesServer) DoTestServiceConfig(ctx context.Context, log *zap.Logge
 			InstanceGroup: group.Title,
 		}
 
-		client, ok := s.drivers[groupType]
-		if !ok {
+		client, err := s.drivers.Client(groupType)
+		if err != nil {
 			response.Result = false
-			log.Error("Not such driver", zap.Any("any", client))
-			config_err.Error = fmt.Sprintf("Driver Type '%s' not registered", groupType)
+			log.Error("Driver unavailable", zap.Error(err))
+			config_err.Error = err.Error()
 			response.Errors = append(
 				response.Errors, &config_err,
 			)
@@ -356,6 +368,24 @@ func (s *ServicesServer) Create(ctx context.Context, _request *connect.Request[p
 	service := request.GetService()
 	contexts := make(map[string]*InstancesGroupDriverContext)
 
+	if requestor != schema.ROOT_ACCOUNT_KEY {
+		// Order is placed on behalf of namespace owner, who is the one billed for it
+		owner, err := graph.OwnerAccount(ctx, s.db, ns.ID)
+		if err != nil {
+			log.Error("Error getting namespace owner", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error getting namespace owner")
+		}
+		if err := s.screenFirstOrder(ctx, log, owner, _request.Header(), _request.Peer().Addr); err != nil {
+			return nil, err
+		}
+		if err := s.checkKYC(ctx, log, owner, service); err != nil {
+			return nil, err
+		}
+		if err := s.checkQuota(ctx, log, owner, serviceUsage(service)); err != nil {
+			return nil, err
+		}
+	}
+
 	s.keepProviderOwnedData(ctx, log, requestor, service, nil)
 
 	testResult, err := s.DoTestServiceConfig(ctx, log, service)
@@ -394,9 +424,9 @@ func (s *ServicesServer) Create(ctx context.Context, _request *connect.Request[p
 		}
 
 		groupType := group.GetType()
-		client, ok := s.drivers[groupType]
-		if !ok {
-			return nil, status.Errorf(codes.InvalidArgument, "Driver of type '%s' not registered", groupType)
+		client, err := s.drivers.Client(groupType)
+		if err != nil {
+			return nil, drivers.Status(err)
 		}
 		contexts[group.GetUuid()] = &InstancesGroupDriverContext{sp, &client}
 	}
@@ -458,6 +488,18 @@ func (s *ServicesServer) Update(ctx context.Context, _service *connect.Request[p
 	}
 	s.keepProviderOwnedData(ctx, log, requestor, service, stored)
 
+	// Products blocked until KYC can't be added by updating existing service either
+	if !okRoot {
+		owner, err := graph.OwnerAccount(ctx, s.db, docID)
+		if err != nil {
+			log.Error("Error getting service owner", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error getting service owner")
+		}
+		if err := s.checkKYC(ctx, log, owner, service); err != nil {
+			return nil, err
+		}
+	}
+
 	err = s.ctrl.Update(ctx, service, true)
 	if err != nil {
 		log.Error("Error while updating service", zap.Error(err))
@@ -517,6 +559,20 @@ func (s *ServicesServer) Up(ctx context.Context, _request *connect.Request[pb.Up
 		return nil, status.Error(codes.PermissionDenied, "Can't deploy suspended service")
 	}
 
+	if requestor != schema.ROOT_ACCOUNT_KEY {
+		owner, err := graph.OwnerAccount(ctx, s.db, driver.NewDocumentID(schema.SERVICES_COL, service.GetUuid()))
+		if err != nil {
+			log.Error("Error getting service owner", zap.Error(err))
+			return nil, status.Error(codes.Internal, "Error getting service owner")
+		}
+		if err := s.checkKYC(ctx, log, owner, service); err != nil {
+			return nil, err
+		}
+		if err := s.checkQuota(ctx, log, owner, nil); err != nil {
+			return nil, err
+		}
+	}
+
 	contexts := make(map[string]*InstancesGroupDriverContext)
 
 	for _, group := range service.GetInstancesGroups() {
@@ -528,9 +584,9 @@ func (s *ServicesServer) Up(ctx context.Context, _request *connect.Request[pb.Up
 		}
 
 		groupType := group.GetType()
-		client, ok := s.drivers[groupType]
-		if !ok {
-			return nil, status.Errorf(codes.InvalidArgument, "Driver of type '%s' not registered", groupType)
+		client, err := s.drivers.Client(groupType)
+		if err != nil {
+			return nil, drivers.Status(err)
 		}
 		contexts[group.GetUuid()] = &InstancesGroupDriverContext{sp, &client}
 	}
@@ -775,9 +831,9 @@ func (s *ServicesServer) Down(ctx context.Context, _request *connect.Request[pb.
 		}
 
 		groupType := group.GetType()
-		client, ok := s.drivers[groupType]
-		if !ok {
-			return nil, status.Errorf(codes.InvalidArgument, "Driver of type '%s' not registered", groupType)
+		client, err := s.drivers.Client(groupType)
+		if err != nil {
+			return nil, drivers.Status(err)
 		}
 
 		contexts[group.GetUuid()] = &InstancesGroupDriverContext{sp, &client}
@@ -968,21 +1024,10 @@ func (s *ServicesServer) Stream(ctx context.Context, _req *connect.Request[pb.St
 	log.Debug("Request received", zap.Any("req", req))
 	requestor := ctx.Value(nocloud.NoCloudAccount).(string)
 
-	if service, err := s.ctrl.Get(ctx, requestor, req.GetUuid()); err != nil || service.GetAccess().GetLevel() < access.Level_READ {
-		log.Warn("Failed access check", zap.String("uuid", req.GetUuid()))
-		return errors.New("failed access check")
-	}
-
-	uuids, err := s.ctrl.GetServiceInstancesUuids(req.GetUuid())
+	topics, err := s.streamTopics(ctx, log, requestor, req.GetUuid())
 	if err != nil {
-		log.Error("Couldn't find service", zap.Any("uuid", req.GetUuid()), zap.Error(err))
 		return err
 	}
-
-	topics := make([]string, len(uuids))
-	for i, id := range uuids {
-		topics[i] = "instance/" + id
-	}
 	s.log.Debug("topics", zap.Any("topics", topics))
 
 	reconnections := 0
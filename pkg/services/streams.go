@@ -0,0 +1,65 @@
+/*
+Copyright © 2021-2023 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/slntopp/nocloud-proto/access"
+	"go.uber.org/zap"
+)
+
+// StreamSource checks requester may follow uuid and returns pubsub topics to stream, messages must be *states.ObjectState
+type StreamSource func(ctx context.Context, requester, uuid string) ([]string, error)
+
+// RegisterStreamSource makes Stream serve uuids starting with prefix from source instead of service instances
+func (s *ServicesServer) RegisterStreamSource(prefix string, source StreamSource) {
+	if s.streamSources == nil {
+		s.streamSources = map[string]StreamSource{}
+	}
+	s.streamSources[prefix] = source
+}
+
+func (s *ServicesServer) streamTopics(ctx context.Context, log *zap.Logger, requestor, uuid string) ([]string, error) {
+	for prefix, source := range s.streamSources {
+		if strings.HasPrefix(uuid, prefix) {
+			topics, err := source(ctx, requestor, uuid)
+			if err != nil {
+				log.Warn("Failed access check", zap.String("uuid", uuid), zap.Error(err))
+			}
+			return topics, err
+		}
+	}
+
+	if service, err := s.ctrl.Get(ctx, requestor, uuid); err != nil || service.GetAccess().GetLevel() < access.Level_READ {
+		log.Warn("Failed access check", zap.String("uuid", uuid))
+		return nil, errors.New("failed access check")
+	}
+
+	uuids, err := s.ctrl.GetServiceInstancesUuids(uuid)
+	if err != nil {
+		log.Error("Couldn't find service", zap.Any("uuid", uuid), zap.Error(err))
+		return nil, err
+	}
+
+	topics := make([]string, len(uuids))
+	for i, id := range uuids {
+		topics[i] = "instance/" + id
+	}
+	return topics, nil
+}
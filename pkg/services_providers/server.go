@@ -34,6 +34,7 @@ import (
 	proto "github.com/slntopp/nocloud-proto/states"
 	"github.com/slntopp/nocloud/pkg/graph"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"github.com/slntopp/nocloud/pkg/nocloud/drivers"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	p "github.com/slntopp/nocloud/pkg/public_data"
 	s "github.com/slntopp/nocloud/pkg/states"
@@ -45,7 +46,7 @@ import (
 type ServicesProviderServer struct {
 	sppb.UnimplementedServicesProvidersServiceServer
 
-	drivers map[string]driverpb.DriverServiceClient
+	drivers *drivers.Registry
 
 	extention_servers map[string]sppb.ServicesProvidersExtentionsServiceClient
 	db                driver.Database
@@ -72,14 +73,15 @@ func NewServicesProviderServer(log *zap.Logger, db driver.Database, rbmq rabbitm
 		log: log, db: db, ctrl: graph.NewServicesProvidersController(log, db),
 		ns_ctrl:           graph.NewNamespacesController(log, db),
 		ca:                graph.NewCommonActionsController(log, db),
-		drivers:           make(map[string]driverpb.DriverServiceClient),
+		drivers:           drivers.NewRegistry(log, nil, drivers.DefaultConfig()),
 		extention_servers: make(map[string]sppb.ServicesProvidersExtentionsServiceClient),
 		rdb:               rdb,
 	}
 }
 
-func (s *ServicesProviderServer) RegisterDriver(type_key string, client driverpb.DriverServiceClient) {
-	s.drivers[type_key] = client
+// SetupDriverRegistry shares drivers registry, so drivers added at runtime are visible to the server
+func (s *ServicesProviderServer) SetupDriverRegistry(reg *drivers.Registry) {
+	s.drivers = reg
 }
 
 func (s *ServicesProviderServer) RegisterExtentionServer(type_key string, client sppb.ServicesProvidersExtentionsServiceClient) {
@@ -105,9 +107,9 @@ func (s *ServicesProviderServer) Test(ctx context.Context, req *sppb.ServicesPro
 		return nil, status.Error(codes.InvalidArgument, "Services Provider 'title' is not given")
 	}
 
-	client, ok := s.drivers[req.GetType()]
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Driver type '%s' not registered", req.GetType())
+	client, err := s.drivers.Client(req.GetType())
+	if err != nil {
+		return nil, drivers.Status(err)
 	}
 
 	tfc, ok := ctx.Value(nocloud.TestFromCreate).(bool)
@@ -569,10 +571,10 @@ func (s *ServicesProviderServer) Invoke(ctx context.Context, req *sppb.InvokeReq
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	client, ok := s.drivers[sp.Type]
-	if !ok {
-		log.Error("Failed to get driver", zap.String("type", sp.Type))
-		return nil, status.Error(codes.NotFound, "Driver not found")
+	client, err := s.drivers.Client(sp.Type)
+	if err != nil {
+		log.Error("Failed to get driver", zap.String("type", sp.Type), zap.Error(err))
+		return nil, drivers.Status(err)
 	}
 
 	invoke, err := client.SpInvoke(ctx, &driverpb.SpInvokeRequest{
@@ -622,10 +624,10 @@ func (s *ServicesProviderServer) Prep(ctx context.Context, req *sppb.PrepSP) (*s
 		return nil, status.Error(codes.InvalidArgument, "ServicesProvider base config is not present")
 	}
 
-	client, ok := s.drivers[sp.Type]
-	if !ok {
-		log.Error("Failed to get driver", zap.String("type", sp.Type))
-		return nil, status.Error(codes.NotFound, "Driver not found")
+	client, err := s.drivers.Client(sp.Type)
+	if err != nil {
+		log.Error("Failed to get driver", zap.String("type", sp.Type), zap.Error(err))
+		return nil, drivers.Status(err)
 	}
 
 	return client.SpPrep(ctx, req)
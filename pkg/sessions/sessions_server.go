@@ -2,10 +2,18 @@ package sessions
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
 	"github.com/slntopp/nocloud-proto/access"
+	elpb "github.com/slntopp/nocloud-proto/events_logging"
 	"github.com/slntopp/nocloud/pkg/graph"
 	redisdb "github.com/slntopp/nocloud/pkg/nocloud/redis"
+	"github.com/slntopp/nocloud/pkg/nocloud/rest_auth"
 	"github.com/slntopp/nocloud/pkg/nocloud/schema"
 	"github.com/slntopp/nocloud/pkg/nocloud/sessions"
 	"google.golang.org/grpc/codes"
@@ -108,3 +116,118 @@ func (c *SessionsServer) Revoke(ctx context.Context, req *sspb.Session) (*sspb.D
 
 	return &sspb.DeleteResponse{}, nil
 }
+
+// RevokeAll revokes every session of the requester, including current one
+func (c *SessionsServer) RevokeAll(ctx context.Context) ([]string, error) {
+	requestor := ctx.Value(nocloud.NoCloudAccount).(string)
+	return c.revoke(ctx, "RevokeAll", requestor)
+}
+
+// RevokeOthers revokes every session of the requester except current one
+func (c *SessionsServer) RevokeOthers(ctx context.Context) ([]string, error) {
+	requestor := ctx.Value(nocloud.NoCloudAccount).(string)
+	sid, _ := ctx.Value(nocloud.NoCloudSession).(string)
+	if sid == "" {
+		return nil, status.Error(codes.FailedPrecondition, "Current token has no session")
+	}
+	return c.revoke(ctx, "RevokeOthers", requestor, sid)
+}
+
+func (c *SessionsServer) revoke(_ context.Context, action, requestor string, except ...string) ([]string, error) {
+	log := c.log.Named(action)
+	log.Debug("Invoked", zap.String("requestor", requestor))
+
+	revoked, err := sessions.RevokeAll(c.rdb, requestor, except...)
+	if err != nil {
+		log.Error("Failed to revoke sessions", zap.Error(err))
+		return revoked, status.Error(codes.Internal, "Failed to revoke sessions")
+	}
+
+	nocloud.Log(log, &elpb.Event{
+		Entity:    schema.ACCOUNTS_COL,
+		Uuid:      requestor,
+		Scope:     "database",
+		Action:    "sessions_revoked",
+		Rc:        0,
+		Requestor: requestor,
+		Ts:        time.Now().Unix(),
+		Snapshot: &elpb.Snapshot{
+			Diff: "Sessions: " + strings.Join(revoked, ","),
+		},
+	})
+	return revoked, nil
+}
+
+// SessionInfo is Session along with metadata recorded on login
+type SessionInfo struct {
+	*sspb.Session
+	Metadata sessions.Metadata `json:"metadata"`
+}
+
+// ListWithMetadata returns requester sessions along with IP, user agent, location and login method
+func (c *SessionsServer) ListWithMetadata(ctx context.Context) ([]SessionInfo, error) {
+	requestor := ctx.Value(nocloud.NoCloudAccount).(string)
+	sid, _ := ctx.Value(nocloud.NoCloudSession).(string)
+
+	list, err := sessions.Get(c.rdb, requestor)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(list))
+	for i, session := range list {
+		ids[i] = session.GetId()
+	}
+	meta, err := sessions.GetMetadata(c.rdb, requestor, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	current := true
+	result := make([]SessionInfo, len(list))
+	for i, session := range list {
+		if session.Id == sid {
+			session.Current = &current
+		}
+		result[i] = SessionInfo{Session: session, Metadata: meta[session.GetId()]}
+	}
+	return result, nil
+}
+
+func (c *SessionsServer) RegisterRoutes(router *mux.Router, signingKey []byte) {
+	interceptor := rest_auth.NewInterceptor(c.log, c.rdb, signingKey)
+	subRouter := router.PathPrefix("/sessions").Subrouter()
+	subRouter.Handle("", interceptor.JwtMiddleWare(http.HandlerFunc(c.HandleList))).Methods("GET")
+	subRouter.Handle("/revoke_all", interceptor.JwtMiddleWare(http.HandlerFunc(c.handleRevoke(c.RevokeAll)))).Methods("POST")
+	subRouter.Handle("/revoke_others", interceptor.JwtMiddleWare(http.HandlerFunc(c.handleRevoke(c.RevokeOthers)))).Methods("POST")
+}
+
+func (c *SessionsServer) HandleList(writer http.ResponseWriter, request *http.Request) {
+	result, err := c.ListWithMetadata(request.Context())
+	if err != nil {
+		c.log.Error("Failed to list sessions", zap.Error(err))
+		http.Error(writer, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(map[string]any{"sessions": result})
+}
+
+func (c *SessionsServer) handleRevoke(revoke func(context.Context) ([]string, error)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		revoked, err := revoke(request.Context())
+		if err != nil {
+			st, _ := status.FromError(err)
+			code := http.StatusInternalServerError
+			if st.Code() == codes.FailedPrecondition {
+				code = http.StatusConflict
+			}
+			http.Error(writer, st.Message(), code)
+			return
+		}
+		if revoked == nil {
+			revoked = []string{}
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(map[string]any{"revoked": revoked})
+	}
+}